@@ -0,0 +1,76 @@
+package minidb
+
+import (
+	"io"
+	"os"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// Backup はデータベースの一貫したコピーを dst に書く
+// 書いたバイト列はそのままヒープファイルとして Open できる
+//
+// 全てのページを書き戻してから、ヒープファイルをコピーし終えるまで他の操作を待たせる。
+// コピー中に書き込みが挟まらないので、どのテーブルも Backup を呼んだ時点の内容になる
+func (db *DB) Backup(dst io.Writer) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	if err := db.saveCounters(); err != nil {
+		return err
+	}
+	old, err := db.saveZoneMaps()
+	if err != nil {
+		return err
+	}
+	if err := db.bufmgr.Flush(); err != nil {
+		return err
+	}
+	for _, treeID := range old {
+		if err := db.freeTree(treeID); err != nil {
+			return err
+		}
+	}
+	src, err := os.Open(db.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// BackupFile は Backup でコピーを path に書き、マニフェストも作る
+// 書き終えるまでは一時ファイルに書くので、途中で失敗しても path は壊れない
+func (db *DB) BackupFile(path string) error {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err := db.Backup(f); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	m, err := disk.BuildManifest(path)
+	if err != nil {
+		return err
+	}
+	return disk.WriteManifest(disk.ManifestPath(path), m)
+}
@@ -0,0 +1,76 @@
+//go:build badger
+
+package bench
+
+import (
+	"errors"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+func init() {
+	Register("badger", openBadger)
+}
+
+// badgerStore は badger のディレクトリ1つを使うストア
+// minidb と同じく書き込みごとには fsync せず、Sync でまとめて書き戻す
+type badgerStore struct {
+	db *badger.DB
+}
+
+func openBadger(dir string) (Store, error) {
+	db, err := badger.Open(badger.DefaultOptions(dir).WithLogger(nil))
+	if err != nil {
+		return nil, err
+	}
+	return &badgerStore{db: db}, nil
+}
+
+func (s *badgerStore) Put(key, value []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(key, value)
+	})
+}
+
+func (s *badgerStore) Get(key []byte) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(key)
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if errors.Is(err, badger.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	return value, err == nil, err
+}
+
+func (s *badgerStore) Scan(start []byte, n int, fn func(key, value []byte)) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(start); it.Valid() && n > 0; it.Next() {
+			item := it.Item()
+			err := item.Value(func(v []byte) error {
+				fn(item.Key(), v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
+
+func (s *badgerStore) Sync() error {
+	return s.db.Sync()
+}
+
+func (s *badgerStore) Close() error {
+	return s.db.Close()
+}
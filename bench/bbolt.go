@@ -0,0 +1,76 @@
+//go:build bbolt
+
+package bench
+
+import (
+	"path/filepath"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func init() {
+	Register("bbolt", openBolt)
+}
+
+// boltBucket は bbolt のアダプタが使うバケット名
+var boltBucket = []byte("bench")
+
+// boltStore は bbolt のファイル1つに1つのバケットを作ったストア
+// 他のストアと揃えるため NoSync にし、書き込みごとには fsync しない
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBolt(dir string) (Store, error) {
+	db, err := bolt.Open(filepath.Join(dir, "bolt.db"), 0644, nil)
+	if err != nil {
+		return nil, err
+	}
+	db.NoSync = true
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Put(key, value []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBucket).Put(key, value)
+	})
+}
+
+func (s *boltStore) Get(key []byte) ([]byte, bool, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		// トランザクションの外では使えないのでコピーする
+		if v := tx.Bucket(boltBucket).Get(key); v != nil {
+			value = append([]byte{}, v...)
+		}
+		return nil
+	})
+	return value, value != nil, err
+}
+
+func (s *boltStore) Scan(start []byte, n int, fn func(key, value []byte)) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBucket).Cursor()
+		for k, v := c.Seek(start); k != nil && n > 0; k, v = c.Next() {
+			fn(k, v)
+			n--
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Sync() error {
+	return s.db.Sync()
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,262 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Store は負荷を流すKVストアのアダプタ
+type Store interface {
+	// Put はキーに値を書き込む。キーがあれば値を置き換える
+	Put(key, value []byte) error
+	// Get はキーの値を返す。キーがなければ false を返す
+	Get(key []byte) ([]byte, bool, error)
+	// Scan は start 以上のキーを順に最大 n 件 fn に渡す
+	Scan(start []byte, n int, fn func(key, value []byte)) error
+	// Sync は書き込んだ内容をディスクに書き戻す
+	Sync() error
+	// Close はストアを閉じる
+	Close() error
+}
+
+// Opener は dir に新しいストアを開く
+type Opener func(dir string) (Store, error)
+
+var (
+	storesMu sync.Mutex
+	stores   = map[string]Opener{}
+)
+
+// Register はストアを名前で登録する。アダプタの init から呼ぶ
+func Register(name string, open Opener) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	stores[name] = open
+}
+
+// Stores は登録されているストアの名前をソートして返す
+func Stores() []string {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	names := make([]string, 0, len(stores))
+	for name := range stores {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup は登録されているストアを名前で探す
+func lookup(name string) (Opener, error) {
+	storesMu.Lock()
+	defer storesMu.Unlock()
+	open, ok := stores[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown store %q (built with the right tags?)", name)
+	}
+	return open, nil
+}
+
+// Workload はストアに流す負荷
+type Workload struct {
+	Name string
+	// Load は時間を計る前に書き込んでおくキーの数
+	Load int
+	// Ops は時間を計る操作の数
+	Ops int
+	// ValueSize は書き込む値のバイト数
+	ValueSize int
+	// Op は i 番目の操作を行う。r は負荷ごとに同じ種から作る
+	Op func(s Store, r *rand.Rand, i int) error
+	// Sync が true なら、最後の Sync までを時間に含める
+	Sync bool
+}
+
+// Key は i 番目のキーを返す。どのストアでも同じ順序に並ぶ
+func Key(i int) []byte {
+	return []byte(fmt.Sprintf("key%012d", i))
+}
+
+// Value は size バイトの値を返す
+func Value(i, size int) []byte {
+	v := make([]byte, size)
+	copy(v, fmt.Sprintf("value%d:", i))
+	return v
+}
+
+// DefaultWorkloads は keys 件のキーと valueSize バイトの値を使う標準の負荷を返す
+func DefaultWorkloads(keys, valueSize int) []Workload {
+	put := func(s Store, i int) error {
+		return s.Put(Key(i), Value(i, valueSize))
+	}
+	return []Workload{
+		{
+			Name: "fill-seq", Ops: keys, ValueSize: valueSize, Sync: true,
+			Op: func(s Store, _ *rand.Rand, i int) error { return put(s, i) },
+		},
+		{
+			Name: "fill-random", Ops: keys, ValueSize: valueSize, Sync: true,
+			Op: func(s Store, r *rand.Rand, _ int) error { return put(s, r.Intn(keys)) },
+		},
+		{
+			Name: "read-random", Load: keys, Ops: keys, ValueSize: valueSize,
+			Op: func(s Store, r *rand.Rand, _ int) error {
+				i := r.Intn(keys)
+				_, ok, err := s.Get(Key(i))
+				if err == nil && !ok {
+					err = fmt.Errorf("key %s not found", Key(i))
+				}
+				return err
+			},
+		},
+		{
+			Name: "scan", Load: keys, Ops: max(keys/100, 1), ValueSize: valueSize,
+			Op: func(s Store, r *rand.Rand, _ int) error {
+				return s.Scan(Key(r.Intn(keys)), 100, func(key, value []byte) {})
+			},
+		},
+		{
+			Name: "update-random", Load: keys, Ops: keys, ValueSize: valueSize, Sync: true,
+			Op: func(s Store, r *rand.Rand, _ int) error { return put(s, r.Intn(keys)) },
+		},
+	}
+}
+
+// Result は1つのストアに1つの負荷を流した結果
+type Result struct {
+	Store    string
+	Workload string
+	Ops      int
+	Elapsed  time.Duration
+	// FileBytes は負荷を流した後にストアのディレクトリにあるファイルの合計サイズ
+	FileBytes int64
+}
+
+// NsPerOp は1操作あたりのナノ秒を返す
+func (r Result) NsPerOp() int64 {
+	if r.Ops == 0 {
+		return 0
+	}
+	return r.Elapsed.Nanoseconds() / int64(r.Ops)
+}
+
+// OpsPerSec は1秒あたりの操作数を返す
+func (r Result) OpsPerSec() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Ops) / r.Elapsed.Seconds()
+}
+
+// Run は dir の下に新しいストアを開き、負荷を1つ流す
+// 種を固定した乱数を使うので、どのストアにも同じ順序で同じキーを渡す
+func Run(store string, w Workload, dir string) (Result, error) {
+	open, err := lookup(store)
+	if err != nil {
+		return Result{}, err
+	}
+	storeDir, err := os.MkdirTemp(dir, store+"_"+w.Name+"_*")
+	if err != nil {
+		return Result{}, err
+	}
+	defer os.RemoveAll(storeDir)
+
+	s, err := open(storeDir)
+	if err != nil {
+		return Result{}, fmt.Errorf("%s: open: %w", store, err)
+	}
+	defer s.Close()
+
+	for i := 0; i < w.Load; i++ {
+		if err := s.Put(Key(i), Value(i, w.ValueSize)); err != nil {
+			return Result{}, fmt.Errorf("%s: load: %w", store, err)
+		}
+	}
+	if err := s.Sync(); err != nil {
+		return Result{}, fmt.Errorf("%s: load: %w", store, err)
+	}
+
+	r := rand.New(rand.NewSource(1))
+	start := time.Now()
+	for i := 0; i < w.Ops; i++ {
+		if err := w.Op(s, r, i); err != nil {
+			return Result{}, fmt.Errorf("%s: %s: %w", store, w.Name, err)
+		}
+	}
+	if w.Sync {
+		if err := s.Sync(); err != nil {
+			return Result{}, fmt.Errorf("%s: %s: %w", store, w.Name, err)
+		}
+	}
+	elapsed := time.Since(start)
+
+	size, err := dirSize(storeDir)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Store: store, Workload: w.Name, Ops: w.Ops, Elapsed: elapsed, FileBytes: size}, nil
+}
+
+// RunAll は全ての負荷を全てのストアに流す。結果は負荷ごとにストアを並べる
+func RunAll(storeNames []string, workloads []Workload, dir string) ([]Result, error) {
+	var results []Result
+	for _, w := range workloads {
+		for _, store := range storeNames {
+			result, err := Run(store, w, dir)
+			if err != nil {
+				return results, err
+			}
+			results = append(results, result)
+		}
+	}
+	return results, nil
+}
+
+// dirSize は dir の下にあるファイルの合計サイズを返す
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// WriteReport は結果を列を揃えた表で書き出す
+func WriteReport(w io.Writer, results []Result) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "store\tworkload\tops\tns/op\tops/sec\tfile")
+	for _, r := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.0f\t%s\n",
+			r.Store, r.Workload, r.Ops, r.NsPerOp(), r.OpsPerSec(), formatBytes(r.FileBytes))
+	}
+	return tw.Flush()
+}
+
+// formatBytes はバイト数を読みやすい単位にする
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
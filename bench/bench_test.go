@@ -0,0 +1,71 @@
+package bench
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunMinidb(t *testing.T) {
+	workloads := DefaultWorkloads(500, 64)
+	results, err := RunAll([]string{"minidb"}, workloads, t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to run: %v", err)
+	}
+	if len(results) != len(workloads) {
+		t.Fatalf("expected %d results, got %d", len(workloads), len(results))
+	}
+	for i, r := range results {
+		if r.Store != "minidb" || r.Workload != workloads[i].Name || r.Ops != workloads[i].Ops {
+			t.Errorf("unexpected result %+v", r)
+		}
+		if r.FileBytes == 0 {
+			t.Errorf("%s: expected a non-empty file", r.Workload)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteReport(&buf, results); err != nil {
+		t.Fatalf("failed to write report: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(results)+1 || !strings.HasPrefix(lines[0], "store") {
+		t.Errorf("unexpected report:\n%s", buf.String())
+	}
+
+	if _, err := Run("nosuchstore", workloads[0], t.TempDir()); err == nil {
+		t.Error("expected an error for an unknown store")
+	}
+}
+
+func TestMinidbStore(t *testing.T) {
+	s, err := OpenMinidb(64)(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer s.Close()
+
+	for i := 0; i < 10; i++ {
+		if err := s.Put(Key(i), []byte("old")); err != nil {
+			t.Fatalf("failed to put: %v", err)
+		}
+	}
+	// 既存のキーは置き換える
+	if err := s.Put(Key(3), []byte("new")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if v, ok, err := s.Get(Key(3)); err != nil || !ok || string(v) != "new" {
+		t.Errorf("expected new, got %q %v %v", v, ok, err)
+	}
+	if _, ok, err := s.Get(Key(99)); err != nil || ok {
+		t.Errorf("expected no key, got %v %v", ok, err)
+	}
+
+	var keys []string
+	if err := s.Scan(Key(7), 5, func(key, value []byte) { keys = append(keys, string(key)) }); err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if len(keys) != 3 || keys[0] != string(Key(7)) {
+		t.Errorf("unexpected scan %v", keys)
+	}
+}
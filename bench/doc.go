@@ -0,0 +1,41 @@
+/*
+Package bench はminidbと他の組み込みKVストアを同じ負荷で比べるベンチマークを提供する。
+
+# 概要
+
+ストアごとに Store を実装したアダプタを用意し、同じ Workload を順に流して
+1操作あたりの時間と書き込んだファイルの大きさを比べる。
+性能を改善するときに、minidb の数字だけでなく外部の実装との差を見るために使う。
+
+	results, err := bench.RunAll([]string{"minidb", "bbolt"}, bench.DefaultWorkloads(100000, 100), dir)
+	bench.WriteReport(os.Stdout, results)
+	// store   workload     ops     ns/op  ops/sec  file
+	// minidb  fill-seq     100000  ...
+	// bbolt   fill-seq     100000  ...
+
+# ストア
+
+minidb のアダプタは常に使える。bbolt と badger のアダプタはビルドタグの後ろにあり、
+依存を go.mod に加えてからタグを付けてビルドする：
+
+	go get go.etcd.io/bbolt github.com/dgraph-io/badger/v4
+	go run -tags bbolt,badger ./cmd/minidb-bench -stores minidb,bbolt,badger
+
+アダプタは init で Register する。他のストアを比べたいときも同じように追加できる。
+
+# 負荷
+
+DefaultWorkloads は次の負荷を返す。各負荷は空のディレクトリに新しいストアを開き、
+Load 件を読み込んでから時間を計り始める：
+
+  - fill-seq: キーの順に書き込む
+  - fill-random: ランダムな順に書き込む
+  - read-random: 読み込んだキーをランダムに読む
+  - scan: ランダムな位置から100件ずつ順に読む
+  - update-random: 読み込んだキーの値をランダムに置き換える
+
+書き込む負荷は最後の Sync（ディスクへの書き戻し）までを時間に含める。
+どのストアも1つの書き込みを1回のトランザクションとして扱い、
+書き込みごとには fsync せず Sync でまとめて書き戻す。
+*/
+package bench
@@ -0,0 +1,89 @@
+package bench
+
+import (
+	"path/filepath"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// DefaultMinidbPoolSize は minidb のアダプタが使うバッファプールのフレーム数（64MiB）
+// ベンチマークのデータセットがプールに収まり、ディスクI/Oが結果に混ざらない大きさにしている
+const DefaultMinidbPoolSize = 16384
+
+func init() {
+	Register("minidb", OpenMinidb(DefaultMinidbPoolSize))
+}
+
+// minidbStore は1つのヒープファイルを1本のB-treeとして開いたストア
+type minidbStore struct {
+	disk   *disk.DiskManager
+	bufmgr *buffer.BufferPoolManager
+	tree   *btree.BTree
+}
+
+// OpenMinidb は poolSize フレームのバッファプールで minidb を開く Opener を返す
+// 別のプールの大きさで比べたいときは、同じ名前で Register し直す
+func OpenMinidb(poolSize int) Opener {
+	return func(dir string) (Store, error) {
+		diskMgr, err := disk.Open(filepath.Join(dir, "minidb.db"))
+		if err != nil {
+			return nil, err
+		}
+		bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(poolSize))
+		tree, err := btree.Create(bufmgr)
+		if err != nil {
+			diskMgr.Close()
+			return nil, err
+		}
+		return &minidbStore{disk: diskMgr, bufmgr: bufmgr, tree: tree}, nil
+	}
+}
+
+func (s *minidbStore) Put(key, value []byte) error {
+	// Merge なら既存のキーでも1回の探索で置き換えられる
+	return s.tree.Merge(s.bufmgr, key, func([]byte) []byte { return value })
+}
+
+func (s *minidbStore) Get(key []byte) ([]byte, bool, error) {
+	values, err := s.tree.GetAll(s.bufmgr, key)
+	if err != nil || len(values) == 0 {
+		return nil, false, err
+	}
+	return values[0], true, nil
+}
+
+func (s *minidbStore) Scan(start []byte, n int, fn func(key, value []byte)) error {
+	iter, err := s.tree.Search(s.bufmgr, btree.NewSearchKey(start))
+	if err != nil {
+		return err
+	}
+	defer iter.Close(s.bufmgr)
+	for i := 0; i < n; i++ {
+		pair, err := iter.Next(s.bufmgr)
+		if err != nil {
+			return err
+		}
+		if pair == nil {
+			return nil
+		}
+		fn(pair.Key, pair.Value)
+	}
+	return nil
+}
+
+func (s *minidbStore) Sync() error {
+	if err := s.bufmgr.Flush(); err != nil {
+		return err
+	}
+	return s.disk.Sync()
+}
+
+func (s *minidbStore) Close() error {
+	if err := s.Sync(); err != nil {
+		s.disk.Close()
+		return err
+	}
+	return s.disk.Close()
+}
@@ -0,0 +1,179 @@
+package btree
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// approxSamples は ApproxCount でルートからリーフまで降りる回数
+const approxSamples = 32
+
+// ApproxCount は木のペア数の見積もりを返す。木全体は読まない
+// ルートから子をランダムに選んでリーフまで降り、通ったブランチの子の数の積にリーフのペア数を
+// 掛けたものを平均する。読むページは高々 木の高さ×32 で、各段のノードの大きさが揃っているほど
+// 正確になる。リーフだけの木では正確な数になる。重複キーを許す木ではエントリの数を数える
+func (t *BTree) ApproxCount(bufmgr *buffer.BufferPoolManager) (int, error) {
+	return t.ApproxCountContext(context.Background(), bufmgr)
+}
+
+// ApproxCountContext は ApproxCount と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) ApproxCountContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (int, error) {
+	// 同じ木には同じ見積もりを返すよう、乱数の種は固定する
+	rng := rand.New(rand.NewSource(int64(t.MetaPageID)))
+	var sum float64
+	for i := 0; i < approxSamples; i++ {
+		nodeBuffer, err := t.fetchRootPage(ctx, bufmgr)
+		if err != nil {
+			return 0, err
+		}
+		weight := 1.0
+		for {
+			node := NewNode(nodeBuffer.Page[:])
+			if node.Header.NodeType == NodeTypeLeaf {
+				break
+			}
+			if node.Header.NodeType != NodeTypeBranch {
+				bufmgr.UnpinPage(nodeBuffer)
+				return 0, errors.New("invalid node type")
+			}
+			branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+			n := branch.NumChildren()
+			weight *= float64(n)
+			childBuffer, err := fetchNode(ctx, bufmgr, branch.ChildAt(rng.Intn(n)))
+			bufmgr.UnpinPage(nodeBuffer)
+			if err != nil {
+				return 0, err
+			}
+			nodeBuffer = childBuffer
+		}
+		numPairs := NewLeaf(nodeBuffer.Page[NodeHeaderSize:]).NumPairs()
+		bufmgr.UnpinPage(nodeBuffer)
+		if weight == 1 {
+			// ルートがリーフなら数えたものがそのまま答え
+			return numPairs, nil
+		}
+		sum += weight * float64(numPairs)
+	}
+	return int(math.Round(sum / approxSamples)), nil
+}
+
+// ApproxRangeCount はキーが [lo, hi] に入るペア数の見積もりを返す
+// lo, hi に nil を渡すとその側は無制限になる。lo と hi をそれぞれ探してリーフの中の位置を求め、
+// 木の中の位置の割合の差に ApproxCount を掛ける。lo と hi が同じリーフに入れば正確な数になる
+// 重複キーを許す木では、キーが範囲に入るエントリの数を見積もる
+func (t *BTree) ApproxRangeCount(bufmgr *buffer.BufferPoolManager, lo, hi []byte) (int, error) {
+	return t.ApproxRangeCountContext(context.Background(), bufmgr, lo, hi)
+}
+
+// ApproxRangeCountContext は ApproxRangeCount と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) ApproxRangeCountContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, lo, hi []byte) (int, error) {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return 0, err
+	}
+	// 格納したキーの上で [from, to) に直す。to が nil なら木の終わり
+	var from, to []byte
+	if flags&MetaFlagDuplicates != 0 {
+		if lo != nil {
+			from = duplicatePrefix(lo)
+		}
+		if hi != nil {
+			to = duplicatePrefixEnd(hi)
+		}
+	} else {
+		from = lo
+		to = hi
+	}
+	start, err := t.locate(ctx, bufmgr, from, false)
+	if err != nil {
+		return 0, err
+	}
+	// 重複キーを許す木の to は格納したどのキーとも一致しないので、after を付けても同じ
+	end, err := t.locate(ctx, bufmgr, to, true)
+	if err != nil {
+		return 0, err
+	}
+	if start.leaf == end.leaf {
+		return max(end.slot-start.slot, 0), nil
+	}
+	if end.frac <= start.frac {
+		return 0, nil
+	}
+	total, err := t.ApproxCountContext(ctx, bufmgr)
+	if err != nil {
+		return 0, err
+	}
+	return int(math.Round((end.frac - start.frac) * float64(total))), nil
+}
+
+// keyPosition は木の中の位置
+type keyPosition struct {
+	leaf disk.PageID // 位置があるリーフ
+	slot int         // リーフの中のスロット番号
+	frac float64     // 木の先頭からの位置の割合（0〜1）。各段の子が同じ数のペアを持つとみなす
+}
+
+// locate はキーが木の中のどこに来るかを返す
+// after なら key と等しいキーの後ろの位置を返す。key が nil なら after でなければ木の先頭、
+// after なら木の終わりの位置を返す
+func (t *BTree) locate(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte, after bool) (keyPosition, error) {
+	nodeBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return keyPosition{}, err
+	}
+	var pos keyPosition
+	width := 1.0
+	for {
+		node := NewNode(nodeBuffer.Page[:])
+		if node.Header.NodeType == NodeTypeLeaf {
+			break
+		}
+		if node.Header.NodeType != NodeTypeBranch {
+			bufmgr.UnpinPage(nodeBuffer)
+			return keyPosition{}, errors.New("invalid node type")
+		}
+		branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+		n := branch.NumChildren()
+		idx := 0
+		switch {
+		case key != nil:
+			idx = branch.SearchChildIdx(key)
+		case after:
+			idx = n - 1
+		}
+		width /= float64(n)
+		pos.frac += width * float64(idx)
+		childBuffer, err := fetchNode(ctx, bufmgr, branch.ChildAt(idx))
+		bufmgr.UnpinPage(nodeBuffer)
+		if err != nil {
+			return keyPosition{}, err
+		}
+		nodeBuffer = childBuffer
+	}
+	defer bufmgr.UnpinPage(nodeBuffer)
+
+	leaf := NewLeaf(nodeBuffer.Page[NodeHeaderSize:])
+	numPairs := leaf.NumPairs()
+	switch {
+	case key != nil:
+		slot, found := leaf.SearchSlotID(key)
+		if found && after {
+			slot++
+		}
+		pos.slot = slot
+	case after:
+		pos.slot = numPairs
+	}
+	pos.leaf = nodeBuffer.PageID
+	if numPairs > 0 {
+		pos.frac += width * float64(pos.slot) / float64(numPairs)
+	} else if after {
+		pos.frac += width
+	}
+	return pos, nil
+}
@@ -2,16 +2,22 @@ package btree
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/kkumaki12/minidb/disk"
 )
 
-// Branchノードのレイアウト:
-// [num_children: 2] [free_space_offset: 2]
-// スロット配列（各2バイト：キーデータへのオフセット）
-// 子ページID配列（各8バイト）
+// Branchノードのレイアウト（BranchFormatInterleaved）:
+// [format: 4bit | num_children: 12bit] [free_space_offset: 2]
+// エントリ配列（各10バイト：子ページID 8バイト + キーデータへのオフセット 2バイト）
 // ページ末尾からキーデータが詰められる
 //
+// エントリ配列とキーデータは互いに向かって伸びるので、キーが短いほど多くの子を持てる。
+// 最後のエントリは子ページIDだけを使い、キーオフセットの2バイトは使わない
+//
+// 以前のフォーマット（BranchFormatFixed）では、キーオフセットを100個分の固定長の
+// スロット配列に、子ページIDをその後ろの配列に置いていた
+//
 // 例: n個のキーがある場合、n+1個の子ページIDがある
 // keys:     [k0] [k1] [k2] ... [k(n-1)]
 // children: [c0] [c1] [c2] ... [cn]
@@ -21,8 +27,20 @@ const (
 	BranchNumChildrenOffset     = 0
 	BranchFreeSpaceOffsetOffset = 2
 	BranchHeaderSize            = 4
-	BranchSlotSize              = 2  // キーオフセット
-	BranchChildSize             = 8  // PageID
+	BranchSlotSize              = 2 // キーオフセット
+	BranchChildSize             = 8 // PageID
+	BranchEntrySize             = BranchChildSize + BranchSlotSize
+)
+
+// ブランチのフォーマット
+// num_children の上位4ビットに格納する。以前のファイルではこのビットは常に0になっている
+const (
+	BranchFormatFixed       = 0 // キー数の上限が100の固定レイアウト（以前のフォーマット）
+	BranchFormatInterleaved = 1 // 子ページIDとキーオフセットを並べて持つ
+
+	branchFormatShift     = 12
+	branchNumChildrenMask = 1<<branchFormatShift - 1
+	branchFixedMaxKeys    = 100
 )
 
 // Branch はブランチノードを表す
@@ -35,13 +53,19 @@ func NewBranch(data []byte) *Branch {
 	return &Branch{data: data}
 }
 
+// Format はブランチのフォーマット（BranchFormatFixed または BranchFormatInterleaved）を返す
+func (b *Branch) Format() int {
+	return int(readUint16(b.data[BranchNumChildrenOffset:]) >> branchFormatShift)
+}
+
 // NumChildren は子の数を返す
 func (b *Branch) NumChildren() int {
-	return int(readUint16(b.data[BranchNumChildrenOffset:]))
+	return int(readUint16(b.data[BranchNumChildrenOffset:]) & branchNumChildrenMask)
 }
 
 func (b *Branch) setNumChildren(n uint16) {
-	writeUint16(b.data[BranchNumChildrenOffset:], n)
+	format := readUint16(b.data[BranchNumChildrenOffset:]) &^ branchNumChildrenMask
+	writeUint16(b.data[BranchNumChildrenOffset:], format|n)
 }
 
 func (b *Branch) freeSpaceOffset() uint16 {
@@ -63,21 +87,38 @@ func (b *Branch) NumKeys() int {
 
 // keySlotOffset はキースロットのオフセットを返す
 func (b *Branch) keySlotOffset(idx int) int {
-	return BranchHeaderSize + idx*BranchSlotSize
+	if b.Format() == BranchFormatFixed {
+		return BranchHeaderSize + idx*BranchSlotSize
+	}
+	return BranchHeaderSize + idx*BranchEntrySize + BranchChildSize
 }
 
 // childOffset は子ページIDのオフセットを返す
+// childOffset(NumChildren()) はエントリ配列（固定レイアウトでは子ページID配列）の終わりになる
 func (b *Branch) childOffset(idx int) int {
-	// スロット配列の後に子ページID配列がある
-	maxKeys := b.maxKeys()
-	return BranchHeaderSize + maxKeys*BranchSlotSize + idx*BranchChildSize
+	if b.Format() == BranchFormatFixed {
+		// スロット配列の後に子ページID配列がある
+		return BranchHeaderSize + branchFixedMaxKeys*BranchSlotSize + idx*BranchChildSize
+	}
+	return BranchHeaderSize + idx*BranchEntrySize
 }
 
-// maxKeys は最大キー数を計算する
+// childEntrySize は子を1つ増やすときにエントリ配列が伸びるバイト数を返す
+func (b *Branch) childEntrySize() int {
+	if b.Format() == BranchFormatFixed {
+		return BranchChildSize
+	}
+	return BranchEntrySize
+}
+
+// maxKeys は最大キー数を返す
+// 固定レイアウトではスロット配列の大きさで決まる。それ以外では空のキーだけを
+// 詰めた場合の数で、実際の上限はキーの長さに応じて空き領域で決まる
 func (b *Branch) maxKeys() int {
-	// 簡略化：固定値として計算
-	// 実際には動的に計算すべきだが、ここでは十分な値を使用
-	return 100
+	if b.Format() == BranchFormatFixed {
+		return branchFixedMaxKeys
+	}
+	return (len(b.data) - BranchHeaderSize - BranchEntrySize) / (BranchEntrySize + 2)
 }
 
 // getKeySlot は指定インデックスのキーオフセットを返す
@@ -108,21 +149,32 @@ func (b *Branch) KeyAt(idx int) []byte {
 }
 
 // Initialize はブランチノードを初期化する
+// 新しく初期化したブランチは常に BranchFormatInterleaved になる
 func (b *Branch) Initialize(key []byte, leftChild, rightChild disk.PageID) {
-	b.setNumChildren(2)
-	b.setFreeSpaceOffset(uint16(len(b.data)))
-
-	// キーを書き込む
-	keyLen := len(key)
-	newOffset := b.freeSpaceOffset() - uint16(2+keyLen)
-	writeUint16(b.data[newOffset:], uint16(keyLen))
-	copy(b.data[newOffset+2:], key)
-	b.setKeySlot(0, newOffset)
-	b.setFreeSpaceOffset(newOffset)
+	b.build([][]byte{key}, []disk.PageID{leftChild, rightChild})
+}
 
-	// 子ページIDを設定
-	b.setChild(0, leftChild)
-	b.setChild(1, rightChild)
+// build はブランチを BranchFormatInterleaved で初期化し、keys と children を詰める
+// children は keys より1つ多くなければならない。収まらなければ panic する
+func (b *Branch) build(keys [][]byte, children []disk.PageID) {
+	if size := branchSize(keys, children); size > len(b.data) {
+		// 呼び出し側は keys と children が収まることを確かめてから組み直すので、ここには来ない
+		panic(fmt.Sprintf("btree: branch of %d bytes does not fit in %d bytes", size, len(b.data)))
+	}
+	writeUint16(b.data[BranchNumChildrenOffset:], uint16(BranchFormatInterleaved<<branchFormatShift|len(children)))
+	b.setFreeSpaceOffset(uint16(len(b.data)))
+	for i, k := range keys {
+		newOffset := b.freeSpaceOffset() - uint16(2+len(k))
+		writeUint16(b.data[newOffset:], uint16(len(k)))
+		copy(b.data[newOffset+2:], k)
+		b.setKeySlot(i, newOffset)
+		b.setFreeSpaceOffset(newOffset)
+	}
+	for i, child := range children {
+		b.setChild(i, child)
+	}
+	// 組み直す前のキーのバイトが空き領域に残らないようにする
+	clear(b.data[b.childOffset(len(children)):b.freeSpaceOffset()])
 }
 
 // SearchChildIdx はキーに対応する子のインデックスを返す
@@ -149,29 +201,32 @@ func (b *Branch) SearchChild(key []byte) disk.PageID {
 
 // freeSpace は空き領域のサイズを返す
 func (b *Branch) freeSpace() int {
-	numChildren := b.NumChildren()
-	slotsEnd := BranchHeaderSize + b.maxKeys()*BranchSlotSize + numChildren*BranchChildSize
-	return int(b.freeSpaceOffset()) - slotsEnd
+	return int(b.freeSpaceOffset()) - b.childOffset(b.NumChildren())
 }
 
 // Insert はキーと子ページIDを挿入する
 // 成功したらtrue、スペース不足ならfalseを返す
 func (b *Branch) Insert(childIdx int, key []byte, newChildPageID disk.PageID) bool {
 	keyLen := len(key)
-	needed := 2 + keyLen + BranchChildSize // キー長 + キー + 子ページID
+	needed := 2 + keyLen + b.childEntrySize() // キー長 + キー + エントリ
 
 	if b.freeSpace() < needed {
 		return false
 	}
+	// 固定レイアウトのスロット配列は maxKeys 個分しか確保していないので、それを超えたら分割する
+	if b.NumKeys() >= b.maxKeys() {
+		return false
+	}
 
 	numChildren := b.NumChildren()
 	numKeys := b.NumKeys()
 
 	// 子ページIDをずらす
-	for i := numChildren; i > childIdx+1; i-- {
+	// 分割で作られた新しい子は前半（小さい側）を持つので、元の子の左に入れる
+	for i := numChildren; i > childIdx; i-- {
 		b.setChild(i, b.ChildAt(i-1))
 	}
-	b.setChild(childIdx+1, newChildPageID)
+	b.setChild(childIdx, newChildPageID)
 
 	// キースロットをずらす
 	for i := numKeys; i > childIdx; i-- {
@@ -213,41 +268,21 @@ func (b *Branch) SplitInsert(newBranch *Branch, key []byte, newChildPageID disk.
 
 	// 新しいキーと子を挿入
 	keys = append(keys[:insertPos], append([][]byte{key}, keys[insertPos:]...)...)
-	children = append(children[:insertPos+1], append([]disk.PageID{newChildPageID}, children[insertPos+1:]...)...)
-
-	// 分割点
-	mid := len(keys) / 2
-	overflowKey := keys[mid]
-
-	// 新しいブランチ（前半）を構築
-	newBranch.setNumChildren(uint16(mid + 1))
-	newBranch.setFreeSpaceOffset(uint16(len(newBranch.data)))
-	for i := 0; i < mid; i++ {
-		k := keys[i]
-		newOffset := newBranch.freeSpaceOffset() - uint16(2+len(k))
-		writeUint16(newBranch.data[newOffset:], uint16(len(k)))
-		copy(newBranch.data[newOffset+2:], k)
-		newBranch.setKeySlot(i, newOffset)
-		newBranch.setFreeSpaceOffset(newOffset)
-	}
-	for i := 0; i <= mid; i++ {
-		newBranch.setChild(i, children[i])
+	children = append(children[:insertPos], append([]disk.PageID{newChildPageID}, children[insertPos:]...)...)
+
+	// 分割点。キーの長さは揃っていないので、キーの数ではなくバイト数がおよそ半分になるところで分ける
+	total := branchSize(keys, children)
+	mid, size := 1, BranchHeaderSize+BranchEntrySize+2+len(keys[0])
+	for mid < len(keys)-2 && size+BranchEntrySize+2+len(keys[mid]) < total/2 {
+		size += BranchEntrySize + 2 + len(keys[mid])
+		mid++
 	}
+	overflowKey := keys[mid]
 
-	// 現在のブランチ（後半）を再構築
-	b.setNumChildren(uint16(len(keys) - mid))
-	b.setFreeSpaceOffset(uint16(len(b.data)))
-	for i := mid + 1; i < len(keys); i++ {
-		k := keys[i]
-		newOffset := b.freeSpaceOffset() - uint16(2+len(k))
-		writeUint16(b.data[newOffset:], uint16(len(k)))
-		copy(b.data[newOffset+2:], k)
-		b.setKeySlot(i-mid-1, newOffset)
-		b.setFreeSpaceOffset(newOffset)
-	}
-	for i := mid + 1; i <= len(keys); i++ {
-		b.setChild(i-mid-1, children[i])
-	}
+	// 新しいブランチ（前半）と現在のブランチ（後半）を構築
+	// 以前のフォーマットのブランチもここで BranchFormatInterleaved に移行される
+	newBranch.build(keys[:mid], children[:mid+1])
+	b.build(keys[mid+1:], children[mid+1:])
 
 	return overflowKey
 }
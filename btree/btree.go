@@ -1,7 +1,10 @@
 package btree
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"sync/atomic"
 
 	"github.com/kkumaki12/minidb/buffer"
 	"github.com/kkumaki12/minidb/disk"
@@ -10,6 +13,7 @@ import (
 // エラー定義
 var (
 	ErrDuplicateKey = errors.New("duplicate key")
+	ErrKeyNotFound  = errors.New("key not found")
 )
 
 // SearchMode は検索モードを表す
@@ -20,6 +24,13 @@ const (
 	SearchModeStart SearchMode = iota
 	// SearchModeKey は指定キーから検索を開始する
 	SearchModeKey
+	// SearchModeKeyExclusive は指定キーより大きい最初のキーから検索を開始する
+	SearchModeKeyExclusive
+	// SearchModeLast は最後のペアから検索を開始する
+	SearchModeLast
+	// SearchModePrefix は指定した接頭辞を持つ最初のキーから検索を開始し、
+	// 接頭辞を持たないキーに達したら終わる
+	SearchModePrefix
 )
 
 // Search は検索条件を表す
@@ -38,13 +49,33 @@ func NewSearchKey(key []byte) *Search {
 	return &Search{Mode: SearchModeKey, Key: key}
 }
 
+// NewSearchKeyExclusive は指定キーより大きい最初のキーからの検索を作成する
+// 下限を含まない範囲検索で、一致するキーを呼び出し側で読み飛ばさずに済む
+func NewSearchKeyExclusive(key []byte) *Search {
+	return &Search{Mode: SearchModeKeyExclusive, Key: key}
+}
+
+// NewSearchLast は最後のペアからの検索を作成する
+// 最初の Next が最大のキーを返すので、MAX(key) を木を走査せずに求められる
+func NewSearchLast() *Search {
+	return &Search{Mode: SearchModeLast}
+}
+
+// NewSearchPrefix は接頭辞を持つキーだけを返す検索を作成する
+// (userID, timestamp) のような複合キーで、あるユーザーの行だけを読むときに使う
+func NewSearchPrefix(prefix []byte) *Search {
+	return &Search{Mode: SearchModePrefix, Key: prefix}
+}
+
 // childPageID はブランチノードから子ページIDを取得する
 func (s *Search) childPageID(branch *Branch) disk.PageID {
 	switch s.Mode {
 	case SearchModeStart:
 		return branch.ChildAt(0)
-	case SearchModeKey:
+	case SearchModeKey, SearchModeKeyExclusive, SearchModePrefix:
 		return branch.SearchChild(s.Key)
+	case SearchModeLast:
+		return branch.ChildAt(branch.NumChildren() - 1)
 	}
 	return branch.ChildAt(0)
 }
@@ -55,8 +86,16 @@ func (s *Search) tupleSlotID(leaf *Leaf) (int, bool) {
 	switch s.Mode {
 	case SearchModeStart:
 		return 0, false
-	case SearchModeKey:
+	case SearchModeKey, SearchModePrefix:
 		return leaf.SearchSlotID(s.Key)
+	case SearchModeKeyExclusive:
+		slotID, found := leaf.SearchSlotID(s.Key)
+		if found {
+			slotID++
+		}
+		return slotID, false
+	case SearchModeLast:
+		return max(leaf.NumPairs()-1, 0), false
 	}
 	return 0, false
 }
@@ -64,15 +103,36 @@ func (s *Search) tupleSlotID(leaf *Leaf) (int, bool) {
 // BTree はB+木を表す
 type BTree struct {
 	MetaPageID disk.PageID
+	cache      atomic.Pointer[treeCache] // メタページの内容のキャッシュ（root.go）
+}
+
+// Options はB-treeの作成時の設定
+// 設定はメタページに記録されるので、開く時に指定する必要はない
+type Options struct {
+	// AllowDuplicates を有効にすると、同じキーで何度でも Insert できる
+	// 同じキーのエントリは挿入順に並び、Search や GetAll で全て取り出せる
+	AllowDuplicates bool
+	// DeltaValues を有効にすると、リーフの値を中央の値との差分で格納する
+	// 時系列のように隣り合う行の値の大部分が共通する場合にページを節約できる
+	DeltaValues bool
+	// SecureDelete を有効にすると、削除・更新で不要になったペアのバイトをリーフ内で0で上書きし、
+	// 参照されなくなったオーバーフローページも0で埋める。削除したデータをファイルに残さない
+	SecureDelete bool
 }
 
 // Create は新しいB-treeを作成する
 func Create(bufmgr *buffer.BufferPoolManager) (*BTree, error) {
+	return CreateWithOptions(bufmgr, Options{})
+}
+
+// CreateWithOptions は設定を指定して新しいB-treeを作成する
+func CreateWithOptions(bufmgr *buffer.BufferPoolManager, opts Options) (*BTree, error) {
 	// メタページを作成
 	metaBuffer, err := bufmgr.CreatePage()
 	if err != nil {
 		return nil, err
 	}
+	defer bufmgr.UnpinPage(metaBuffer)
 	meta := NewMeta(metaBuffer.Page[:])
 
 	// ルートページ（リーフ）を作成
@@ -80,20 +140,44 @@ func Create(bufmgr *buffer.BufferPoolManager) (*BTree, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer bufmgr.UnpinPage(rootBuffer)
 	rootNode := NewNode(rootBuffer.Page[:])
 	rootNode.InitializeAsLeaf()
 	rootNode.WriteHeader(rootBuffer.Page[:])
+	setRootNode(rootBuffer.Page[:], true)
 	leaf := NewLeaf(rootBuffer.Page[NodeHeaderSize:])
-	leaf.Initialize()
+	if opts.DeltaValues {
+		leaf.initializeDelta(nil, nil)
+	} else {
+		leaf.Initialize()
+	}
 
-	// メタページにルートページIDを設定
+	// メタページにルートページIDと設定を書く
 	meta.Header.RootPageID = rootBuffer.PageID
+	meta.Header.Flags = opts.metaFlags()
 	meta.Sync()
 
 	metaBuffer.IsDirty = true
 	rootBuffer.IsDirty = true
 
-	return &BTree{MetaPageID: metaBuffer.PageID}, nil
+	tree := &BTree{MetaPageID: metaBuffer.PageID}
+	tree.cache.Store(&treeCache{rootPageID: rootBuffer.PageID, flags: meta.Header.Flags})
+	return tree, nil
+}
+
+// metaFlags は設定をメタページに記録するフラグにする
+func (opts Options) metaFlags() uint32 {
+	var flags uint32
+	if opts.AllowDuplicates {
+		flags |= MetaFlagDuplicates
+	}
+	if opts.DeltaValues {
+		flags |= MetaFlagDeltaValues
+	}
+	if opts.SecureDelete {
+		flags |= MetaFlagSecureDelete
+	}
+	return flags
 }
 
 // NewBTree は既存のB-treeを開く
@@ -101,252 +185,816 @@ func NewBTree(metaPageID disk.PageID) *BTree {
 	return &BTree{MetaPageID: metaPageID}
 }
 
-// fetchRootPage はルートページを取得する
-func (t *BTree) fetchRootPage(bufmgr *buffer.BufferPoolManager) (*buffer.Buffer, error) {
-	metaBuffer, err := bufmgr.FetchPage(t.MetaPageID)
+// Search は指定された検索条件でイテレータを返す
+func (t *BTree) Search(bufmgr *buffer.BufferPoolManager, search *Search) (*Iter, error) {
+	return t.SearchContext(context.Background(), bufmgr, search)
+}
+
+// SearchContext は Search と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// 重複キーを許す木では、キーを指定した検索はそのキーの最初のエントリから始まる
+func (t *BTree) SearchContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, search *Search) (*Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	flags, err := t.flags(ctx, bufmgr)
 	if err != nil {
 		return nil, err
 	}
-	meta := NewMeta(metaBuffer.Page[:])
-	rootPageID := meta.Header.RootPageID
-
-	return bufmgr.FetchPage(rootPageID)
-}
+	duplicates := flags&MetaFlagDuplicates != 0
+	if duplicates {
+		switch search.Mode {
+		case SearchModeKey:
+			search = NewSearchKey(duplicatePrefix(search.Key))
+		case SearchModeKeyExclusive:
+			// 同じキーのエントリを全て飛ばすので、接頭辞のすぐ後ろから探す
+			search = NewSearchKey(duplicatePrefixEnd(search.Key))
+		case SearchModePrefix:
+			// エスケープは1バイトずつの置き換えなので、キーの接頭辞はエスケープしても接頭辞になる
+			search = NewSearchPrefix(escapeDuplicateKey(search.Key))
+		}
+	}
 
-// Search は指定された検索条件でイテレータを返す
-func (t *BTree) Search(bufmgr *buffer.BufferPoolManager, search *Search) (*Iter, error) {
-	rootBuffer, err := t.fetchRootPage(bufmgr)
+	rootBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := t.searchInternal(ctx, bufmgr, rootBuffer, search)
 	if err != nil {
 		return nil, err
 	}
-	return t.searchInternal(bufmgr, rootBuffer, search)
+	iter.duplicates = duplicates
+	iter.position = startPosition(search)
+	if search.Mode == SearchModePrefix {
+		iter.prefix = search.Key
+	}
+	if pair := iter.get(); pair != nil && search.Mode == SearchModeLast {
+		iter.position = resumePosition{mode: resumeAt, key: pair.Key}
+	}
+	return iter, nil
 }
 
-// searchInternal は内部検索処理
-func (t *BTree) searchInternal(bufmgr *buffer.BufferPoolManager, nodeBuffer *buffer.Buffer, search *Search) (*Iter, error) {
-	node := NewNode(nodeBuffer.Page[:])
-
-	switch node.Header.NodeType {
-	case NodeTypeLeaf:
-		leaf := NewLeaf(nodeBuffer.Page[NodeHeaderSize:])
-		slotID, _ := search.tupleSlotID(leaf)
-		isRightMost := leaf.NumPairs() == slotID
+// searchInternal は nodeBuffer から search の位置のリーフまで降りて、イテレータを返す
+// nodeBuffer のピンは呼び出し側から引き継ぐ。ブランチのピンは子を取得したら外すので、
+// 降りている間にピンしているページは高々2つで、返すイテレータはリーフのピンだけを持つ
+func (t *BTree) searchInternal(ctx context.Context, bufmgr *buffer.BufferPoolManager, nodeBuffer *buffer.Buffer, search *Search) (*Iter, error) {
+	for {
+		node := NewNode(nodeBuffer.Page[:])
+
+		switch node.Header.NodeType {
+		case NodeTypeLeaf:
+			if search.Mode == SearchModeLast {
+				// 削除で空になったリーフは前に戻って読み飛ばす
+				var err error
+				if nodeBuffer, err = lastPairLeaf(ctx, bufmgr, nodeBuffer); err != nil {
+					return nil, err
+				}
+			}
+			leaf := NewLeaf(nodeBuffer.Page[NodeHeaderSize:])
+			slotID, _ := search.tupleSlotID(leaf)
+			isRightMost := leaf.NumPairs() == slotID
+
+			iter := &Iter{
+				buffer:     nodeBuffer,
+				slotID:     slotID,
+				tree:       t,
+				prevPageID: leafPrev(leaf),
+			}
 
-		iter := &Iter{
-			buffer: nodeBuffer,
-			slotID: slotID,
-		}
+			if isRightMost {
+				if err := iter.advance(ctx, bufmgr); err != nil {
+					iter.Close(bufmgr)
+					return nil, err
+				}
+			}
+			return iter, nil
 
-		if isRightMost {
-			if err := iter.advance(bufmgr); err != nil {
+		case NodeTypeBranch:
+			branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+			childBuffer, err := fetchNode(ctx, bufmgr, search.childPageID(branch))
+			bufmgr.UnpinPage(nodeBuffer)
+			if err != nil {
 				return nil, err
 			}
+			nodeBuffer = childBuffer
+
+		default:
+			bufmgr.UnpinPage(nodeBuffer)
+			return nil, errors.New("invalid node type")
 		}
-		return iter, nil
+	}
+}
 
-	case NodeTypeBranch:
-		branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
-		childPageID := search.childPageID(branch)
-		childBuffer, err := bufmgr.FetchPage(childPageID)
+// lastPairLeaf は leafBuffer から前のリーフに戻り、ペアを持つ最初のリーフを返す
+// leafBuffer のピンは引き継ぐ。どのリーフも空なら最初のリーフを返す
+func lastPairLeaf(ctx context.Context, bufmgr *buffer.BufferPoolManager, leafBuffer *buffer.Buffer) (*buffer.Buffer, error) {
+	for {
+		leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+		prevPageID := leaf.PrevPageID()
+		if leaf.NumPairs() > 0 || prevPageID == nil {
+			return leafBuffer, nil
+		}
+		prevBuffer, err := fetchNode(ctx, bufmgr, *prevPageID)
+		bufmgr.UnpinPage(leafBuffer)
 		if err != nil {
 			return nil, err
 		}
-		return t.searchInternal(bufmgr, childBuffer, search)
+		leafBuffer = prevBuffer
 	}
-
-	return nil, errors.New("invalid node type")
 }
 
 // Insert はキーと値を挿入する
 func (t *BTree) Insert(bufmgr *buffer.BufferPoolManager, key, value []byte) error {
-	metaBuffer, err := bufmgr.FetchPage(t.MetaPageID)
+	return t.InsertContext(context.Background(), bufmgr, key, value)
+}
+
+// InsertContext は Insert と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// キャンセルを確認するのはノードを書き換える前（木を降りている間）だけで、
+// 分割を始めた後は木を壊さないよう最後までやり切る
+//
+// キーが MaxKeySize を超える場合は ErrKeyTooLarge、値が MaxValueSize を超える場合は
+// ErrValueTooLarge を返す。MaxInlineValueSize を超える値はオーバーフローページに置く
+func (t *BTree) InsertContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key, value []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	flags, err := t.flags(ctx, bufmgr)
 	if err != nil {
 		return err
 	}
-	meta := NewMeta(metaBuffer.Page[:])
-	rootPageID := meta.Header.RootPageID
+	if flags&MetaFlagDuplicates != 0 {
+		if key, err = t.duplicateKey(ctx, bufmgr, key); err != nil {
+			return err
+		}
+	}
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+	if len(value) > MaxInlineValueSize {
+		// 重複していればオーバーフローページを無駄に書かないよう、先に確認する
+		exists, err := t.contains(ctx, bufmgr, key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrDuplicateKey
+		}
+	}
+	pair, err := storePair(ctx, bufmgr, key, value)
+	if err != nil {
+		return err
+	}
+	return t.insertPair(ctx, bufmgr, pair)
+}
 
-	rootBuffer, err := bufmgr.FetchPage(rootPageID)
+// contains はキーが存在するかを返す
+func (t *BTree) contains(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) (bool, error) {
+	leafBuffer, err := t.findLeaf(ctx, bufmgr, key)
+	if err != nil {
+		return false, err
+	}
+	defer bufmgr.UnpinPage(leafBuffer)
+	_, found := NewLeaf(leafBuffer.Page[NodeHeaderSize:]).SearchSlotID(key)
+	return found, nil
+}
+
+// insertPair は storePair で作ったペアを木に挿入する
+//
+// ルートからリーフまでループで降り、通ったブランチを path に積む。
+// リーフが分割されたら path を逆に辿って分割を親に伝え、分割が収まった時点で
+// 残りの祖先のピンをまとめて外す。ルートまで分割が伝われば新しいルートを作る
+func (t *BTree) insertPair(ctx context.Context, bufmgr *buffer.BufferPoolManager, pair *Pair) error {
+	flags, err := t.flags(ctx, bufmgr)
 	if err != nil {
 		return err
 	}
+	delta := flags&MetaFlagDeltaValues != 0
+
+	var path []pathEntry
+	defer func() {
+		for _, entry := range path {
+			bufmgr.UnpinPage(entry.buffer)
+		}
+	}()
 
-	overflow, err := t.insertInternal(bufmgr, rootBuffer, key, value)
+	nodeBuffer, err := t.fetchRootPage(ctx, bufmgr)
 	if err != nil {
 		return err
 	}
+	rootPageID := nodeBuffer.PageID
+	for {
+		node := NewNode(nodeBuffer.Page[:])
+		if node.Header.NodeType == NodeTypeLeaf {
+			break
+		}
+		if node.Header.NodeType != NodeTypeBranch {
+			bufmgr.UnpinPage(nodeBuffer)
+			return errors.New("invalid node type")
+		}
+		branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+		childIdx := branch.SearchChildIdx(pair.Key)
+		path = append(path, pathEntry{buffer: nodeBuffer, childIdx: childIdx})
+		if nodeBuffer, err = fetchNode(ctx, bufmgr, branch.ChildAt(childIdx)); err != nil {
+			return err
+		}
+	}
 
-	// オーバーフローがあれば新しいルートを作成
-	if overflow != nil {
-		newRootBuffer, err := bufmgr.CreatePage()
+	overflow, err := insertLeaf(ctx, bufmgr, nodeBuffer, pair, delta)
+	bufmgr.UnpinPage(nodeBuffer)
+	if err != nil {
+		return err
+	}
+
+	// 分割を親に伝えながら上る。子は分割済みなので、ここから先は中断しない
+	for overflow != nil && len(path) > 0 {
+		entry := path[len(path)-1]
+		path = path[:len(path)-1]
+		overflow, err = insertBranch(context.WithoutCancel(ctx), bufmgr, entry, overflow)
+		bufmgr.UnpinPage(entry.buffer)
 		if err != nil {
 			return err
 		}
-		newRootNode := NewNode(newRootBuffer.Page[:])
-		newRootNode.InitializeAsBranch()
-		newRootNode.WriteHeader(newRootBuffer.Page[:])
-		branch := NewBranch(newRootBuffer.Page[NodeHeaderSize:])
-		branch.Initialize(overflow.key, overflow.childPageID, rootPageID)
-
-		meta.Header.RootPageID = newRootBuffer.PageID
-		meta.Sync()
-		metaBuffer.IsDirty = true
-		newRootBuffer.IsDirty = true
+	}
+	if overflow == nil {
+		return nil
 	}
 
+	// ルートまで分割が伝わったので新しいルートを作成
+	ctx = context.WithoutCancel(ctx)
+	metaBuffer, err := bufmgr.FetchPageContext(ctx, t.MetaPageID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(metaBuffer)
+	oldRootBuffer, err := bufmgr.FetchPageContext(ctx, rootPageID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(oldRootBuffer)
+	newRootBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(newRootBuffer)
+	newRootNode := NewNode(newRootBuffer.Page[:])
+	newRootNode.InitializeAsBranch()
+	newRootNode.WriteHeader(newRootBuffer.Page[:])
+	branch := NewBranch(newRootBuffer.Page[NodeHeaderSize:])
+	branch.Initialize(overflow.key, overflow.childPageID, rootPageID)
+
+	t.setRoot(metaBuffer, oldRootBuffer, newRootBuffer, flags)
 	return nil
 }
 
+// pathEntry は挿入で降りてきた経路上のブランチと、そこから降りた子の位置
+type pathEntry struct {
+	buffer   *buffer.Buffer
+	childIdx int
+}
+
 // overflow は分割時のオーバーフロー情報
 type overflow struct {
 	key         []byte
 	childPageID disk.PageID
 }
 
-// insertInternal は内部挿入処理
-func (t *BTree) insertInternal(bufmgr *buffer.BufferPoolManager, nodeBuffer *buffer.Buffer, key, value []byte) (*overflow, error) {
-	node := NewNode(nodeBuffer.Page[:])
+// insertLeaf はリーフにペアを挿入する。収まらなければリーフを分割し、
+// 親に追加するキーと新しいリーフを返す。leafBuffer のピンは外さない
+// delta が true なら、分割したリーフを LeafFormatDelta で組み直す
+func insertLeaf(ctx context.Context, bufmgr *buffer.BufferPoolManager, leafBuffer *buffer.Buffer, pair *Pair, delta bool) (*overflow, error) {
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	slotID, found := leaf.SearchSlotID(pair.Key)
+	if found {
+		return nil, ErrDuplicateKey
+	}
 
-	switch node.Header.NodeType {
-	case NodeTypeLeaf:
-		leaf := NewLeaf(nodeBuffer.Page[NodeHeaderSize:])
-		slotID, found := leaf.SearchSlotID(key)
-		if found {
-			return nil, ErrDuplicateKey
-		}
+	if leaf.insertPair(slotID, pair) {
+		leafBuffer.IsDirty = true
+		return nil, verifyPage(leafBuffer.PageID, leafBuffer.Page[:])
+	}
 
-		if leaf.Insert(slotID, key, value) {
-			nodeBuffer.IsDirty = true
-			return nil, nil
+	// スペース不足：分割が必要
+	prevPageID := leaf.PrevPageID()
+	var prevBuffer *buffer.Buffer
+	if prevPageID != nil {
+		var err error
+		prevBuffer, err = bufmgr.FetchPageContext(ctx, *prevPageID)
+		if err != nil {
+			return nil, err
 		}
+		defer bufmgr.UnpinPage(prevBuffer)
+	}
 
-		// スペース不足：分割が必要
-		prevPageID := leaf.PrevPageID()
-		var prevBuffer *buffer.Buffer
-		if prevPageID != nil {
-			var err error
-			prevBuffer, err = bufmgr.FetchPage(*prevPageID)
+	newLeafBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(newLeafBuffer)
+
+	// 前のリーフのnextを更新
+	if prevBuffer != nil {
+		prevNode := NewNode(prevBuffer.Page[:])
+		prevLeaf := NewLeaf(prevNode.Body)
+		prevLeaf.SetNextPageID(&newLeafBuffer.PageID)
+		prevBuffer.IsDirty = true
+	}
+	leaf.SetPrevPageID(&newLeafBuffer.PageID)
+
+	// 新しいリーフを初期化
+	newLeafNode := NewNode(newLeafBuffer.Page[:])
+	newLeafNode.InitializeAsLeaf()
+	newLeafNode.WriteHeader(newLeafBuffer.Page[:])
+	newLeaf := NewLeaf(newLeafBuffer.Page[NodeHeaderSize:])
+	newLeaf.Initialize()
+
+	// 分割
+	overflowKey := leaf.splitInsertPair(newLeaf, pair, delta)
+	newLeaf.SetNextPageID(&leafBuffer.PageID)
+	newLeaf.SetPrevPageID(prevPageID)
+
+	leafBuffer.IsDirty = true
+	newLeafBuffer.IsDirty = true
+	if err := verifyPages(leafBuffer, newLeafBuffer); err != nil {
+		return nil, err
+	}
+
+	return &overflow{key: overflowKey, childPageID: newLeafBuffer.PageID}, nil
+}
+
+// insertBranch は子の分割で増えたキーと子をブランチに追加する。収まらなければ
+// ブランチを分割し、さらに親に追加するキーと新しいブランチを返す。entry のピンは外さない
+func insertBranch(ctx context.Context, bufmgr *buffer.BufferPoolManager, entry pathEntry, child *overflow) (*overflow, error) {
+	nodeBuffer := entry.buffer
+	branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+	if branch.Insert(entry.childIdx, child.key, child.childPageID) {
+		nodeBuffer.IsDirty = true
+		return nil, verifyPage(nodeBuffer.PageID, nodeBuffer.Page[:])
+	}
+
+	// ブランチの分割
+	newBranchBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(newBranchBuffer)
+	newBranchNode := NewNode(newBranchBuffer.Page[:])
+	newBranchNode.InitializeAsBranch()
+	newBranchNode.WriteHeader(newBranchBuffer.Page[:])
+	newBranch := NewBranch(newBranchBuffer.Page[NodeHeaderSize:])
+
+	overflowKey := branch.SplitInsert(newBranch, child.key, child.childPageID)
+
+	nodeBuffer.IsDirty = true
+	newBranchBuffer.IsDirty = true
+	if err := verifyPages(nodeBuffer, newBranchBuffer); err != nil {
+		return nil, err
+	}
+
+	return &overflow{key: overflowKey, childPageID: newBranchBuffer.PageID}, nil
+}
+
+// findLeaf はキーが属するリーフのバッファを返す
+// 降りる途中のブランチのピンは子を取得したら外す。返したリーフのピンは呼び出し側が外す
+func (t *BTree) findLeaf(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) (*buffer.Buffer, error) {
+	nodeBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		node := NewNode(nodeBuffer.Page[:])
+		switch node.Header.NodeType {
+		case NodeTypeLeaf:
+			return nodeBuffer, nil
+		case NodeTypeBranch:
+			branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+			childBuffer, err := fetchNode(ctx, bufmgr, branch.SearchChild(key))
+			bufmgr.UnpinPage(nodeBuffer)
 			if err != nil {
 				return nil, err
 			}
+			nodeBuffer = childBuffer
+		default:
+			bufmgr.UnpinPage(nodeBuffer)
+			return nil, errors.New("invalid node type")
 		}
+	}
+}
 
-		newLeafBuffer, err := bufmgr.CreatePage()
-		if err != nil {
-			return nil, err
-		}
-
-		// 前のリーフのnextを更新
-		if prevBuffer != nil {
-			prevNode := NewNode(prevBuffer.Page[:])
-			prevLeaf := NewLeaf(prevNode.Body)
-			prevLeaf.SetNextPageID(&newLeafBuffer.PageID)
-			prevBuffer.IsDirty = true
-		}
-		leaf.SetPrevPageID(&newLeafBuffer.PageID)
+// Delete はキーに対応するペアを削除する
+// キーが存在しない場合は ErrKeyNotFound を返す
+// 小さくなったノードは兄弟と併合・再分配する
+func (t *BTree) Delete(bufmgr *buffer.BufferPoolManager, key []byte) error {
+	return t.DeleteContext(context.Background(), bufmgr, key)
+}
 
-		// 新しいリーフを初期化
-		newLeafNode := NewNode(newLeafBuffer.Page[:])
-		newLeafNode.InitializeAsLeaf()
-		newLeafNode.WriteHeader(newLeafBuffer.Page[:])
-		newLeaf := NewLeaf(newLeafBuffer.Page[NodeHeaderSize:])
-		newLeaf.Initialize()
+// DeleteContext は Delete と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// 重複キーを許す木では、キーに一致する全てのエントリを削除する
+func (t *BTree) DeleteContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) error {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	secure := flags&MetaFlagSecureDelete != 0
+	if flags&MetaFlagDuplicates != 0 {
+		return t.deleteDuplicates(ctx, bufmgr, key, secure)
+	}
+	return t.deleteKey(ctx, bufmgr, key, secure)
+}
 
-		// 分割
-		overflowKey := leaf.SplitInsert(newLeaf, key, value)
-		newLeaf.SetNextPageID(&nodeBuffer.PageID)
-		newLeaf.SetPrevPageID(prevPageID)
+// deleteKey は格納されているキーと完全に一致するペアを削除する
+// secure が true なら削除したペアのバイトとオーバーフローページを0で上書きする
+// リーフが小さくなったら兄弟と併合・再分配し、木から外したページを解放する（rebalance.go）
+func (t *BTree) deleteKey(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte, secure bool) (err error) {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
 
-		nodeBuffer.IsDirty = true
-		newLeafBuffer.IsDirty = true
+	var freed []disk.PageID
+	path, err := t.findPath(ctx, bufmgr, key)
+	defer func() {
+		if freeErr := releasePath(bufmgr, path, freed); err == nil {
+			err = freeErr
+		}
+	}()
+	if err != nil {
+		return err
+	}
 
-		return &overflow{key: overflowKey, childPageID: newLeafBuffer.PageID}, nil
+	leaf := NewLeaf(path[len(path)-1].buffer.Page[NodeHeaderSize:])
+	slotID, found := leaf.SearchSlotID(key)
+	if !found {
+		return ErrKeyNotFound
+	}
+	freed, err = t.removeSlot(ctx, bufmgr, path, slotID, secure, flags&MetaFlagDeltaValues != 0)
+	return err
+}
 
-	case NodeTypeBranch:
+// findPath はルートからキーが属するリーフまで降り、通ったノードを返す
+// 末尾はリーフで、ブランチには降りた子の位置を入れる。エラーを返したときも、
+// それまでに積んだノードのピンは呼び出し側が releasePath で外す
+func (t *BTree) findPath(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) ([]pathEntry, error) {
+	nodeBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	var path []pathEntry
+	for {
+		path = append(path, pathEntry{buffer: nodeBuffer})
+		node := NewNode(nodeBuffer.Page[:])
+		if node.Header.NodeType == NodeTypeLeaf {
+			return path, nil
+		}
+		if node.Header.NodeType != NodeTypeBranch {
+			return path, errors.New("invalid node type")
+		}
 		branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
 		childIdx := branch.SearchChildIdx(key)
-		childPageID := branch.ChildAt(childIdx)
-
-		childBuffer, err := bufmgr.FetchPage(childPageID)
-		if err != nil {
-			return nil, err
+		path[len(path)-1].childIdx = childIdx
+		if nodeBuffer, err = fetchNode(ctx, bufmgr, branch.ChildAt(childIdx)); err != nil {
+			return path, err
 		}
+	}
+}
 
-		childOverflow, err := t.insertInternal(bufmgr, childBuffer, key, value)
-		if err != nil {
-			return nil, err
+// removeSlot は path の末尾のリーフから slotID のペアを削除し、小さくなったノードを
+// 兄弟と併合・再分配する。secure が true なら削除したペアのバイトとオーバーフローページを0で上書きする
+// 削除したペアのオーバーフローページと、木から外したページのIDを返す。
+// 呼び出し側は全てのピンを外してから releasePath で解放する
+func (t *BTree) removeSlot(ctx context.Context, bufmgr *buffer.BufferPoolManager, path []pathEntry, slotID int, secure, delta bool) ([]disk.PageID, error) {
+	leafBuffer := path[len(path)-1].buffer
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	old := leaf.PairAt(slotID)
+	leaf.Delete(slotID)
+	leafBuffer.IsDirty = true
+	if secure {
+		leaf.scrubFreeSpace()
+	}
+	freed, err := releaseOverflow(ctx, bufmgr, old, secure)
+	if err != nil {
+		return freed, err
+	}
+	if err := verifyPage(leafBuffer.PageID, leafBuffer.Page[:]); err != nil {
+		return freed, err
+	}
+
+	// ペアは削除済みなので、ここから先は中断しない
+	removed, err := t.rebalance(context.WithoutCancel(ctx), bufmgr, path, delta)
+	return append(freed, removed...), err
+}
+
+// releasePath は path のピンを外してから、freed のページを空きページに戻す
+// イテレータがまだピンしているページは解放しない（そのページは再利用されないだけ）
+// 解放に失敗しても残りのページは解放を試み、最初のエラーを返す
+func releasePath(bufmgr *buffer.BufferPoolManager, path []pathEntry, freed []disk.PageID) error {
+	for _, entry := range path {
+		bufmgr.UnpinPage(entry.buffer)
+	}
+	var err error
+	for _, pageID := range freed {
+		if freeErr := bufmgr.FreePage(pageID); freeErr != nil && !errors.Is(freeErr, buffer.ErrPagePinned) && err == nil {
+			err = freeErr
 		}
+	}
+	return err
+}
 
-		if childOverflow == nil {
-			return nil, nil
+// CompareAndSwap はキーの現在の値が oldValue と一致する場合に限り newValue に置き換える
+// oldValue が nil の場合はキーが存在しないことを、newValue が nil の場合は削除を意味する
+// 置き換えが行われた場合は true を返す
+//
+// 比較から書き込みまでを1回のリーフ探索の中で行うため、
+// 呼び出し側で Search と Insert を組み合わせる必要がない
+func (t *BTree) CompareAndSwap(bufmgr *buffer.BufferPoolManager, key, oldValue, newValue []byte) (bool, error) {
+	swapped := false
+	err := t.modify(bufmgr, key, func(current []byte) ([]byte, bool) {
+		if (current == nil) != (oldValue == nil) || !bytes.Equal(current, oldValue) {
+			return nil, false
 		}
+		swapped = true
+		return newValue, true
+	})
+	return swapped, err
+}
+
+// Merge はキーの現在の値に fn を適用し、その結果で置き換える
+// キーが存在しない場合 fn には nil が渡され、fn が nil を返すとキーを削除する
+// カウンタのような読み込み→変更→書き込みを1回の操作で行える
+func (t *BTree) Merge(bufmgr *buffer.BufferPoolManager, key []byte, fn func(old []byte) []byte) error {
+	return t.modify(bufmgr, key, func(current []byte) ([]byte, bool) {
+		return fn(current), true
+	})
+}
 
-		if branch.Insert(childIdx, childOverflow.key, childOverflow.childPageID) {
-			nodeBuffer.IsDirty = true
-			return nil, nil
+// modify はキーの現在の値を decide に渡し、その結果に応じて値を書き換える
+// decide は (新しい値, 書き換えるか) を返す。新しい値が nil なら削除する
+// 重複キーを許す木では書き換える対象が決まらないので ErrDuplicatesAllowed を返す
+// 新しい値を書き込めなかったときは古い値を残す
+func (t *BTree) modify(bufmgr *buffer.BufferPoolManager, key []byte, decide func(current []byte) ([]byte, bool)) (err error) {
+	ctx := context.Background()
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	if flags&MetaFlagDuplicates != 0 {
+		return ErrDuplicatesAllowed
+	}
+
+	// 削除で小さくなったノードを併合できるよう、deleteKey と同じく降りた経路を持っておく
+	var freed []disk.PageID
+	path, err := t.findPath(ctx, bufmgr, key)
+	defer func() {
+		if freeErr := releasePath(bufmgr, path, freed); err == nil {
+			err = freeErr
 		}
+	}()
+	if err != nil {
+		return err
+	}
 
-		// ブランチの分割
-		newBranchBuffer, err := bufmgr.CreatePage()
+	leafBuffer := path[len(path)-1].buffer
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	slotID, found := leaf.SearchSlotID(key)
+	var old *Pair
+	var current []byte
+	if found {
+		old = leaf.PairAt(slotID)
+		current, err = loadValue(ctx, bufmgr, old)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		newBranchNode := NewNode(newBranchBuffer.Page[:])
-		newBranchNode.InitializeAsBranch()
-		newBranchNode.WriteHeader(newBranchBuffer.Page[:])
-		newBranch := NewBranch(newBranchBuffer.Page[NodeHeaderSize:])
-
-		overflowKey := branch.SplitInsert(newBranch, childOverflow.key, childOverflow.childPageID)
+	}
 
-		nodeBuffer.IsDirty = true
-		newBranchBuffer.IsDirty = true
+	value, ok := decide(current)
+	if !ok {
+		return nil
+	}
+	if !found && value == nil {
+		return nil
+	}
+	secure := flags&MetaFlagSecureDelete != 0
+	if value == nil {
+		freed, err = t.removeSlot(ctx, bufmgr, path, slotID, secure, flags&MetaFlagDeltaValues != 0)
+		return err
+	}
 
-		return &overflow{key: overflowKey, childPageID: newBranchBuffer.PageID}, nil
+	if err := checkSize(key, value); err != nil {
+		return err
+	}
+	pair, err := storePair(ctx, bufmgr, key, value)
+	if err != nil {
+		return err
 	}
 
-	return nil, errors.New("invalid node type")
+	// 新しいペアを入れるまで古いペアの中身（オーバーフローページを含む）は消さない
+	if found {
+		leaf.Delete(slotID)
+		leafBuffer.IsDirty = true
+	}
+	if !leaf.insertPair(slotID, pair) {
+		// 同じリーフに収まらない場合は分割を伴う通常の挿入に任せる
+		// 失敗したら古いペアを戻す。古いペアは元のリーフに収まっていたので分割せずに入る
+		if err := t.insertPair(ctx, bufmgr, pair); err != nil {
+			// 書けなかった新しい値のオーバーフローページはどこからも参照されない
+			if pages, pagesErr := releaseOverflow(ctx, bufmgr, pair, false); pagesErr == nil {
+				freed = pages
+			}
+			if found {
+				if restoreErr := t.insertPair(context.WithoutCancel(ctx), bufmgr, old); restoreErr != nil {
+					return errors.Join(err, restoreErr)
+				}
+			}
+			return err
+		}
+	}
+	if found {
+		if secure {
+			leaf.scrubFreeSpace()
+		}
+		if freed, err = releaseOverflow(ctx, bufmgr, old, secure); err != nil {
+			return err
+		}
+	}
+	return verifyPage(leafBuffer.PageID, leafBuffer.Page[:])
 }
 
 // Iter はB-treeのイテレータ
 type Iter struct {
-	buffer *buffer.Buffer
-	slotID int
+	buffer     *buffer.Buffer
+	slotID     int
+	readAhead  readAhead      // シーケンシャルアクセスの検出と先読み
+	duplicates bool           // 重複キーを許す木のキーを元に戻して返す
+	position   resumePosition // Token で書き出す現在位置
+	prefix     []byte         // 接頭辞検索の接頭辞。これを持たないキーに達したら終端とする
+	keysOnly   bool           // Next でキーだけを返す（keyonly.go）
+	pending    bool           // 直前の Next が返したペアにまだ留まっている（keysOnly のとき）
+	err        error          // All のループを終わらせたエラー（seq.go）
+	tree       *BTree         // 位置がずれたときに降り直す木（validate.go）
+	prevPageID disk.PageID    // 今のリーフに入ったときの prev リンク（validate.go）
 }
 
 // get は現在位置のキーと値を返す
+// 接頭辞検索で接頭辞を持たないキーに達していれば、終端として nil を返す
 func (it *Iter) get() *Pair {
+	if it.buffer == nil {
+		return nil
+	}
 	leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
-	if it.slotID < leaf.NumPairs() {
+	if it.slotID < leaf.NumPairs() && it.inPrefix(leaf) {
 		return leaf.PairAt(it.slotID)
 	}
 	return nil
 }
 
+// inPrefix は現在位置のキーが接頭辞検索の接頭辞を持つかを返す
+// キーはコピーせずにリーフの中で比べる
+func (it *Iter) inPrefix(leaf *Leaf) bool {
+	if it.prefix == nil {
+		return true
+	}
+	leafPrefix := leaf.Prefix()
+	n := min(len(leafPrefix), len(it.prefix))
+	if !bytes.Equal(leafPrefix[:n], it.prefix[:n]) {
+		return false
+	}
+	return bytes.HasPrefix(leaf.KeyAt(it.slotID), it.prefix[n:])
+}
+
 // advance は次の位置に進む
-func (it *Iter) advance(bufmgr *buffer.BufferPoolManager) error {
-	it.slotID++
-	leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
-	if it.slotID < leaf.NumPairs() {
+// 削除で空になったリーフは読み飛ばす
+// 次のリーフに移ったら、それまでのリーフのピンは外す
+func (it *Iter) advance(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	if it.buffer == nil {
 		return nil
 	}
+	it.slotID++
+	for {
+		leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
+		if it.slotID < leaf.NumPairs() {
+			return nil
+		}
 
-	nextPageID := leaf.NextPageID()
-	if nextPageID != nil {
-		nextBuffer, err := bufmgr.FetchPage(*nextPageID)
+		nextPageID := leaf.NextPageID()
+		if nextPageID == nil {
+			return nil
+		}
+		it.readAhead.beforeFetch(bufmgr, *nextPageID)
+		nextBuffer, err := fetchNode(ctx, bufmgr, *nextPageID)
 		if err != nil {
 			return err
 		}
+		bufmgr.UnpinPage(it.buffer)
 		it.buffer = nextBuffer
 		it.slotID = 0
+		it.prevPageID = leafPrev(NewLeaf(nextBuffer.Page[NodeHeaderSize:]))
+		it.readAhead.afterFetch(bufmgr, nextBuffer)
 	}
-	return nil
+}
+
+// SetReadAhead はこのイテレータの先読みを設定する
+// depth > 0 なら、次のリーフに進むたびにその先の depth 個のリーフを別の goroutine で
+// バッファプールに読み込み、読み込みを待たずに今のリーフの処理を続けられるようにする。
+// 0 なら既定（続けて次のリーフに進んだときだけ、深さを調整しながら同期的に先読みする）、
+// 負なら先読みしない。先読みは Close で止まる
+func (it *Iter) SetReadAhead(bufmgr *buffer.BufferPoolManager, depth int) {
+	it.readAhead.stop()
+	it.readAhead = readAhead{disabled: depth < 0, async: max(depth, 0)}
+	if depth > 0 && it.buffer != nil {
+		it.readAhead.startAsync(bufmgr, it.buffer)
+	}
+}
+
+// PageID はイテレータが現在指しているリーフのページIDを返す
+// Close 後は InvalidPageID を返す
+func (it *Iter) PageID() disk.PageID {
+	if it.buffer == nil {
+		return InvalidPageID
+	}
+	return it.buffer.PageID
+}
+
+// SkipLeaf は現在のリーフの残りを読み飛ばし、次のリーフの先頭に進む
+// 次のリーフがない場合はイテレータを終端に進める
+func (it *Iter) SkipLeaf(bufmgr *buffer.BufferPoolManager) error {
+	return it.SkipLeafContext(context.Background(), bufmgr)
+}
+
+// SkipLeafContext は SkipLeaf と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (it *Iter) SkipLeafContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	if err := it.revalidate(ctx, bufmgr); err != nil {
+		return err
+	}
+	if it.buffer == nil {
+		return nil
+	}
+	leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
+	if numPairs := leaf.NumPairs(); numPairs > 0 {
+		it.position = resumePosition{mode: resumeAfter, key: leaf.keyAt(numPairs - 1)}
+	}
+	it.slotID = leaf.NumPairs() - 1
+	it.pending = false
+	return it.advance(ctx, bufmgr)
 }
 
 // Next は次のキーと値を返す
+// 終端に達したら nil を返し、その時点でリーフのピンも外す
 func (it *Iter) Next(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	return it.NextContext(context.Background(), bufmgr)
+}
+
+// NextContext は Next と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// 長いスキャンを途中で止めたい場合に使う。エラーを返した後も Close は必要
+func (it *Iter) NextContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := it.revalidate(ctx, bufmgr); err != nil {
+		return nil, err
+	}
+	if it.pending {
+		it.pending = false
+		if err := it.advance(ctx, bufmgr); err != nil {
+			return nil, err
+		}
+	}
+	if it.keysOnly {
+		return it.nextKey(bufmgr), nil
+	}
 	pair := it.get()
-	if err := it.advance(bufmgr); err != nil {
+	if pair == nil {
+		it.Close(bufmgr)
+		return nil, nil
+	}
+	value, err := loadValue(ctx, bufmgr, pair)
+	if err != nil {
+		return nil, err
+	}
+	key := pair.Key
+	if it.duplicates {
+		key = decodeDuplicateKey(key)
+	}
+	it.position = resumePosition{mode: resumeAfter, key: pair.Key}
+	pair = &Pair{Key: key, Value: value}
+	if err := it.advance(ctx, bufmgr); err != nil {
 		return nil, err
 	}
 	return pair, nil
 }
+
+// Err は All のループを終わらせたエラーを返す。最後まで読めたなら nil
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Close はイテレータが保持しているリーフのピンを外す
+// 最後まで読まずにスキャンを打ち切る場合は必ず呼ぶこと。何度呼んでもよい
+// Close 後の Next は常に nil を返す
+func (it *Iter) Close(bufmgr *buffer.BufferPoolManager) {
+	it.readAhead.stop()
+	it.pending = false
+	if it.buffer == nil {
+		return
+	}
+	bufmgr.UnpinPage(it.buffer)
+	it.buffer = nil
+}
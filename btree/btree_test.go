@@ -2,8 +2,15 @@ package btree
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"math"
+	"math/rand"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 
 	"github.com/kkumaki12/minidb/buffer"
@@ -13,6 +20,13 @@ import (
 // テスト用のヘルパー関数
 func setupTestEnv(t *testing.T) (*buffer.BufferPoolManager, func()) {
 	t.Helper()
+	// BufferPoolは小さめのサイズでテスト
+	return setupTestEnvWithPool(t, 10)
+}
+
+// setupTestEnvWithPool はバッファプールのフレーム数を指定してテスト環境を作る
+func setupTestEnvWithPool(t *testing.T, poolSize int) (*buffer.BufferPoolManager, func()) {
+	t.Helper()
 
 	// 一時ファイルを作成
 	tmpFile, err := os.CreateTemp("", "btree_test_*.db")
@@ -29,8 +43,8 @@ func setupTestEnv(t *testing.T) (*buffer.BufferPoolManager, func()) {
 		t.Fatalf("failed to open disk manager: %v", err)
 	}
 
-	// BufferPoolを作成（小さめのサイズでテスト）
-	pool := buffer.NewBufferPool(10)
+	// BufferPoolを作成
+	pool := buffer.NewBufferPool(poolSize)
 	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
 
 	cleanup := func() {
@@ -265,51 +279,3517 @@ func TestBTreeRangeSearch(t *testing.T) {
 	}
 }
 
-// ベンチマーク
-func BenchmarkBTreeInsert(b *testing.B) {
-	tmpFile, _ := os.CreateTemp("", "btree_bench_*.db")
-	tmpPath := tmpFile.Name()
-	tmpFile.Close()
-	defer os.Remove(tmpPath)
+func TestBTreeSearchAfterSplit(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
 
-	diskMgr, _ := disk.Open(tmpPath)
-	pool := buffer.NewBufferPool(100)
-	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
 
-	tree, _ := Create(bufmgr)
+	// リーフの分割が複数回発生する件数を挿入
+	n := 500
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := fmt.Sprintf("key%010d", i)
-		value := fmt.Sprintf("value%010d", i)
-		tree.Insert(bufmgr, []byte(key), []byte(value))
+	// 分割後も全てのキーがちょうどその位置で見つかるか
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		iter, err := tree.Search(bufmgr, NewSearchKey([]byte(key)))
+		if err != nil {
+			t.Fatalf("failed to search %s: %v", key, err)
+		}
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil || string(pair.Key) != key {
+			t.Fatalf("expected key %s, got %v", key, pair)
+		}
+	}
+
+	// 分割済みの区切りキーを重複挿入してもエラーになるか
+	if err := tree.Insert(bufmgr, []byte("key00250"), []byte("value")); err != ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
 	}
 }
 
-func BenchmarkBTreeSearch(b *testing.B) {
-	tmpFile, _ := os.CreateTemp("", "btree_bench_*.db")
-	tmpPath := tmpFile.Name()
-	tmpFile.Close()
-	defer os.Remove(tmpPath)
+func TestBTreeDelete(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
 
-	diskMgr, _ := disk.Open(tmpPath)
-	pool := buffer.NewBufferPool(100)
-	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
 
-	tree, _ := Create(bufmgr)
+	n := 500
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
 
-	// データを挿入
-	n := 10000
+	// 先頭のリーフが空になるまで削除する
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Delete(bufmgr, []byte(key)); err != nil {
+			t.Fatalf("failed to delete %s: %v", key, err)
+		}
+	}
+
+	// 存在しないキーの削除はエラー
+	if err := tree.Delete(bufmgr, []byte("key00000")); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 空のリーフを読み飛ばして残りのキーだけが返るか
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	count := 0
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			break
+		}
+		expected := fmt.Sprintf("key%05d", 300+count)
+		if string(pair.Key) != expected {
+			t.Fatalf("expected key %s, got %s", expected, pair.Key)
+		}
+		count++
+	}
+	if count != n-300 {
+		t.Errorf("expected %d pairs, got %d", n-300, count)
+	}
+
+	// 削除したキーは再挿入できる
+	if err := tree.Insert(bufmgr, []byte("key00000"), []byte("again")); err != nil {
+		t.Errorf("failed to reinsert: %v", err)
+	}
+}
+
+func TestBTreeCompareAndSwap(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	key := []byte("key")
+	steps := []struct {
+		old, new []byte
+		swapped  bool
+	}{
+		{nil, []byte("v1"), true},               // 存在しない場合のみ挿入
+		{nil, []byte("v2"), false},              // 既に存在するので失敗
+		{[]byte("v0"), []byte("v2"), false},     // 値が一致しないので失敗
+		{[]byte("v1"), []byte("v2-long"), true}, // 一致したので置き換え
+		{[]byte("v2-long"), nil, true},          // 一致したので削除
+	}
+	for i, step := range steps {
+		swapped, err := tree.CompareAndSwap(bufmgr, key, step.old, step.new)
+		if err != nil {
+			t.Fatalf("step %d: failed to compare and swap: %v", i, err)
+		}
+		if swapped != step.swapped {
+			t.Errorf("step %d: expected swapped=%v, got %v", i, step.swapped, swapped)
+		}
+	}
+
+	if err := tree.Delete(bufmgr, key); err != ErrKeyNotFound {
+		t.Errorf("expected key to be deleted, got %v", err)
+	}
+}
+
+func TestBTreeMerge(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	// カウンタのインクリメント
+	increment := func(old []byte) []byte {
+		n := 0
+		if old != nil {
+			fmt.Sscanf(string(old), "%d", &n)
+		}
+		return []byte(fmt.Sprintf("%d", n+1))
+	}
+	for i := 0; i < 12; i++ {
+		if err := tree.Merge(bufmgr, []byte("counter"), increment); err != nil {
+			t.Fatalf("failed to merge: %v", err)
+		}
+	}
+
+	iter, err := tree.Search(bufmgr, NewSearchKey([]byte("counter")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	pair, err := iter.Next(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to get next: %v", err)
+	}
+	if pair == nil || string(pair.Value) != "12" {
+		t.Errorf("expected counter 12, got %v", pair)
+	}
+}
+
+func TestBTreeMergeKeepsOldValueOnFailure(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 3)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	// ルートのリーフを、MaxInlineValueSize の値が入らないところまで埋める
+	rootBuffer, err := tree.fetchRootPage(context.Background(), bufmgr)
+	if err != nil {
+		t.Fatalf("failed to fetch root: %v", err)
+	}
+	root := NewLeaf(rootBuffer.Page[NodeHeaderSize:])
+	for i := 0; root.freeSpace() > 150; i++ {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%03d", i)), make([]byte, 100)); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	bufmgr.UnpinPage(rootBuffer)
+
+	// 残りのフレームをピンしておくと、分割のための新しいページが取れない
+	metaBuffer, err := bufmgr.FetchPage(tree.MetaPageID)
+	if err != nil {
+		t.Fatalf("failed to fetch meta page: %v", err)
+	}
+	extraBuffer, err := bufmgr.CreatePage()
+	if err != nil {
+		t.Fatalf("failed to create page: %v", err)
+	}
+	err = tree.Merge(bufmgr, []byte("key000"), func([]byte) []byte { return make([]byte, MaxInlineValueSize) })
+	if !errors.Is(err, buffer.ErrNoFreeBuffer) {
+		t.Fatalf("expected ErrNoFreeBuffer, got %v", err)
+	}
+	bufmgr.UnpinPage(metaBuffer)
+	bufmgr.UnpinPage(extraBuffer)
+
+	// 書き換えられなかった値は元のまま残る
+	value, err := tree.Get(bufmgr, []byte("key000"))
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if len(value) != 100 {
+		t.Errorf("expected the old value of 100 bytes, got %d bytes", len(value))
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestBTreeCheck(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	// 逆順に挿入して、分割が左側で起きる場合も確認する
+	for i := 600; i > 0; i-- {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	for i := 1; i <= 600; i += 3 {
+		if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("expected a consistent tree, got %v", err)
+	}
+
+	// 先頭のリーフの next を壊すと検出される
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	leafBuffer, err := bufmgr.FetchPage(iter.PageID())
+	if err != nil {
+		t.Fatalf("failed to fetch leaf: %v", err)
+	}
+	iter.Close(bufmgr)
+	NewLeaf(leafBuffer.Page[NodeHeaderSize:]).SetNextPageID(nil)
+	bufmgr.UnpinPage(leafBuffer)
+
+	err = Check(bufmgr, tree)
+	if !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("expected ErrCorrupted, got %v", err)
+	}
+	var checkErr *CheckError
+	if !errors.As(err, &checkErr) || checkErr.PageID != leafBuffer.PageID {
+		t.Errorf("expected an error for page %d, got %v", leafBuffer.PageID, err)
+	}
+}
+
+func TestBTreeCheckCorruptedPages(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(first, second *Leaf, firstID, thirdID disk.PageID)
+		want    string
+	}{
+		{
+			name: "slot past data region",
+			corrupt: func(leaf, _ *Leaf, _, _ disk.PageID) {
+				// 最後のスロットのキー長を伸ばして、ペアがデータ領域の末尾を越えるようにする
+				offset := leaf.getSlot(leaf.NumPairs() - 1)
+				writeUint16(leaf.data[offset:], 2000)
+			},
+			want: "past the data region end",
+		},
+		{
+			name: "overlapping slots",
+			corrupt: func(leaf, _ *Leaf, _, _ disk.PageID) {
+				leaf.setSlot(1, leaf.getSlot(0))
+			},
+			want: "overlap or gap",
+		},
+		{
+			name: "slot before free space",
+			corrupt: func(leaf, _ *Leaf, _, _ disk.PageID) {
+				leaf.setSlot(0, uint16(leaf.slotOffset(leaf.NumPairs())))
+			},
+			want: "outside the data region",
+		},
+		{
+			name: "leaf chain skips a leaf",
+			corrupt: func(first, _ *Leaf, _, thirdID disk.PageID) {
+				first.SetNextPageID(&thirdID)
+			},
+			want: "leaf chain has",
+		},
+		{
+			name: "leaf chain loops",
+			corrupt: func(_, second *Leaf, firstID, _ disk.PageID) {
+				// 2つ目のリーフから先頭に戻る
+				second.SetNextPageID(&firstID)
+			},
+			want: "leaf chain has 2 leaves",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bufmgr, cleanup := setupTestEnv(t)
+			defer cleanup()
+
+			tree, err := Create(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to create btree: %v", err)
+			}
+			for i := 0; i < 600; i++ {
+				if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("expected a consistent tree, got %v", err)
+			}
+
+			// 先頭の2つのリーフと3つ目のページIDを取り出し、壊す
+			iter, err := tree.Search(bufmgr, NewSearchStart())
+			if err != nil {
+				t.Fatalf("failed to search: %v", err)
+			}
+			firstID := iter.PageID()
+			iter.Close(bufmgr)
+			firstBuffer, err := bufmgr.FetchPage(firstID)
+			if err != nil {
+				t.Fatalf("failed to fetch leaf: %v", err)
+			}
+			defer bufmgr.UnpinPage(firstBuffer)
+			first := NewLeaf(firstBuffer.Page[NodeHeaderSize:])
+			secondBuffer, err := bufmgr.FetchPage(*first.NextPageID())
+			if err != nil {
+				t.Fatalf("failed to fetch leaf: %v", err)
+			}
+			defer bufmgr.UnpinPage(secondBuffer)
+			second := NewLeaf(secondBuffer.Page[NodeHeaderSize:])
+			tt.corrupt(first, second, firstID, *second.NextPageID())
+
+			err = Check(bufmgr, tree)
+			if !errors.Is(err, ErrCorrupted) {
+				t.Fatalf("expected ErrCorrupted, got %v", err)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestBTreeStrict(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	SetStrict(true)
+	defer SetStrict(false)
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	// 壊れていなければ分割や削除を含む操作はそのまま成功する
+	for i := 300; i > 0; i-- {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	for i := 1; i <= 300; i += 3 {
+		if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+
+	// 先頭のリーフの最初の2つのスロットを入れ替えてキーの順序を壊す
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	leafBuffer, err := bufmgr.FetchPage(iter.PageID())
+	if err != nil {
+		t.Fatalf("failed to fetch leaf: %v", err)
+	}
+	iter.Close(bufmgr)
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	first, second := leaf.getSlot(0), leaf.getSlot(1)
+	leaf.setSlot(0, second)
+	leaf.setSlot(1, first)
+	bufmgr.UnpinPage(leafBuffer)
+
+	// 読むだけの検索でもリーフに着いた時点で検出される
+	_, err = tree.Search(bufmgr, NewSearchStart())
+	var checkErr *CheckError
+	if !errors.As(err, &checkErr) || checkErr.PageID != leafBuffer.PageID {
+		t.Fatalf("expected an error for page %d, got %v", leafBuffer.PageID, err)
+	}
+	if !errors.Is(err, ErrCorrupted) {
+		t.Errorf("expected ErrCorrupted, got %v", err)
+	}
+
+	// 厳格モードでなければ確認しない
+	SetStrict(false)
+	iter, err = tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("expected no error without strict mode, got %v", err)
+	}
+	iter.Close(bufmgr)
+}
+
+func TestBTreeStats(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	stats, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	if stats.Height != 1 || stats.Pairs != 0 || stats.MinKey != nil {
+		t.Errorf("unexpected stats for an empty tree: %v", stats)
+	}
+
+	n := 500
 	for i := 0; i < n; i++ {
-		key := fmt.Sprintf("key%010d", i)
-		value := fmt.Sprintf("value%010d", i)
-		tree.Insert(bufmgr, []byte(key), []byte(value))
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
 	}
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		key := fmt.Sprintf("key%010d", i%n)
-		iter, _ := tree.Search(bufmgr, NewSearchKey([]byte(key)))
-		iter.Next(bufmgr)
+	stats, err = Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	if stats.Height != 2 || stats.BranchPages != 1 || stats.LeafPages < 2 {
+		t.Errorf("unexpected shape: %v", stats)
+	}
+	if stats.Pairs != n {
+		t.Errorf("expected %d pairs, got %d", n, stats.Pairs)
+	}
+	if string(stats.MinKey) != "key00000" || string(stats.MaxKey) != "key00499" {
+		t.Errorf("unexpected min/max: %q %q", stats.MinKey, stats.MaxKey)
+	}
+	leafLevel := stats.Levels[len(stats.Levels)-1]
+	if leafLevel.Pages != stats.LeafPages || leafLevel.FillFactor <= 0.3 || leafLevel.FillFactor > 1 {
+		t.Errorf("unexpected leaf level stats: %+v", leafLevel)
+	}
+
+	// PageCount はリーフを読まずに同じ数を数える
+	pages, err := PageCount(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to count pages: %v", err)
+	}
+	if want := 1 + stats.BranchPages + stats.LeafPages; pages != want {
+		t.Errorf("expected %d pages, got %d", want, pages)
+	}
+}
+
+func TestBTreeDump(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+
+	var text bytes.Buffer
+	if err := Dump(bufmgr, tree, &text); err != nil {
+		t.Fatalf("failed to dump: %v", err)
+	}
+	out := text.String()
+	for _, want := range []string{"level 0:\n", "level 1:\n", "branch keys=", `leaf pairs=`, `"key00000"`, `"key00299"`} {
+		if !bytes.Contains([]byte(out), []byte(want)) {
+			t.Errorf("dump does not contain %q:\n%s", want, out)
+		}
+	}
+
+	var dot bytes.Buffer
+	if err := DumpDOT(bufmgr, tree, &dot); err != nil {
+		t.Fatalf("failed to dump dot: %v", err)
+	}
+	if !bytes.HasPrefix(dot.Bytes(), []byte("digraph btree {")) || !bytes.Contains(dot.Bytes(), []byte("style=dashed")) {
+		t.Errorf("unexpected dot output:\n%s", dot.String())
+	}
+}
+
+func TestBTreeContextCanceled(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	iter, err := tree.SearchContext(ctx, bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	defer iter.Close(bufmgr)
+
+	if _, err := iter.NextContext(ctx, bufmgr); err != nil {
+		t.Fatalf("failed to get next: %v", err)
+	}
+
+	// キャンセル後のスキャンは ctx.Err() を返す
+	cancel()
+	if _, err := iter.NextContext(ctx, bufmgr); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if _, err := tree.SearchContext(ctx, bufmgr, NewSearchStart()); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from search, got %v", err)
+	}
+	if err := tree.InsertContext(ctx, bufmgr, []byte("key99999"), []byte("value")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled from insert, got %v", err)
+	}
+}
+
+func TestLeafPrefixCompression(t *testing.T) {
+	// 以前のフォーマットのリーフ（format ビットが0、prefix_len なし）を手で作る
+	plain := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	plain.setPrevPageID(InvalidPageID)
+	plain.setNextPageID(InvalidPageID)
+	plain.setFreeSpaceOffset(uint16(len(plain.data)))
+
+	fill := func(leaf *Leaf) int {
+		n := 0
+		for {
+			key := []byte(fmt.Sprintf("user:%07d", n))
+			if !leaf.Insert(n, key, []byte("v")) {
+				return n
+			}
+			n++
+		}
+	}
+	if plain.Format() != LeafFormatPlain {
+		t.Fatalf("expected plain format, got %d", plain.Format())
+	}
+	plainCount := fill(plain)
+
+	// 空のリーフは接頭辞を持たないので、最初の2件で接頭辞を決めてから空にして詰める
+	prefixed := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	prefixed.rebuild([]*Pair{{Key: []byte("user:0000000"), Value: []byte("v")}, {Key: []byte("user:0000999"), Value: []byte("v")}}, false)
+	if string(prefixed.Prefix()) != "user:0000" {
+		t.Fatalf("unexpected prefix %q", prefixed.Prefix())
+	}
+	prefixed.Delete(1)
+	prefixed.Delete(0)
+	prefixedCount := fill(prefixed)
+	if prefixedCount <= plainCount {
+		t.Errorf("prefix compression did not help: %d <= %d pairs", prefixedCount, plainCount)
+	}
+
+	for _, leaf := range []*Leaf{plain, prefixed} {
+		for i := 0; i < leaf.NumPairs(); i++ {
+			want := fmt.Sprintf("user:%07d", i)
+			if slotID, found := leaf.SearchSlotID([]byte(want)); !found || slotID != i {
+				t.Fatalf("format %d: %s not found at slot %d", leaf.Format(), want, i)
+			}
+		}
+	}
+
+	// 接頭辞に合わないキーを入れると接頭辞が短くなる
+	leaf := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	leaf.rebuild([]*Pair{{Key: []byte("user:01"), Value: []byte("a")}, {Key: []byte("user:02"), Value: []byte("b")}}, false)
+	if !leaf.Insert(0, []byte("admin"), []byte("c")) {
+		t.Fatal("failed to insert a key outside the prefix")
+	}
+	if len(leaf.Prefix()) != 0 {
+		t.Errorf("expected empty prefix, got %q", leaf.Prefix())
+	}
+	for i, want := range []string{"admin", "user:01", "user:02"} {
+		if got := leaf.PairAt(i).Key; string(got) != want {
+			t.Errorf("slot %d: expected %s, got %s", i, want, got)
+		}
+	}
+}
+
+func TestLeafZeroCopyAccess(t *testing.T) {
+	plain := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	plain.Initialize()
+	prefixed := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	prefixed.rebuild([]*Pair{{Key: []byte("user:000"), Value: []byte("v")}, {Key: []byte("user:099"), Value: []byte("v")}}, false)
+	prefixed.Delete(1)
+	prefixed.Delete(0)
+	for _, leaf := range []*Leaf{plain, prefixed} {
+		for i := 0; i < 50; i++ {
+			if !leaf.Insert(i, []byte(fmt.Sprintf("user:%03d", i)), []byte(fmt.Sprintf("value%d", i))) {
+				t.Fatalf("failed to insert %d", i)
+			}
+		}
+	}
+	if string(prefixed.Prefix()) != "user:0" {
+		t.Fatalf("unexpected prefix %q", prefixed.Prefix())
+	}
+
+	for _, leaf := range []*Leaf{plain, prefixed} {
+		for i := 0; i < leaf.NumPairs(); i++ {
+			pair := leaf.PairAt(i)
+			key := append(append([]byte{}, leaf.Prefix()...), leaf.KeyAt(i)...)
+			value, ok := leaf.ValueAt(i)
+			if !bytes.Equal(key, pair.Key) || !ok || !bytes.Equal(value, pair.Value) {
+				t.Fatalf("slot %d: expected %s=%s, got %s=%s (%v)", i, pair.Key, pair.Value, key, value, ok)
+			}
+		}
+		for _, tc := range []struct {
+			key   string
+			slot  int
+			found bool
+		}{
+			{"user:000", 0, true},
+			{"user:025", 25, true},
+			{"user:0255", 26, false},
+			{"user:0", 0, false},
+			{"user:", 0, false},
+			{"a", 0, false},
+			{"user:1", 50, false},
+			{"z", 50, false},
+		} {
+			if slot, found := leaf.SearchSlotID([]byte(tc.key)); slot != tc.slot || found != tc.found {
+				t.Errorf("prefix %q: search %s: expected (%d, %v), got (%d, %v)", leaf.Prefix(), tc.key, tc.slot, tc.found, slot, found)
+			}
+		}
+
+		// 探索ではペアをコピーしない
+		key := []byte("user:037")
+		if allocs := testing.AllocsPerRun(100, func() { leaf.SearchSlotID(key) }); allocs != 0 {
+			t.Errorf("expected no allocations in SearchSlotID, got %v", allocs)
+		}
+	}
+
+	// 差分符号化した値はそのままの形で入っていない
+	delta := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	delta.initializeDelta(nil, nil)
+	delta.Insert(0, []byte("k"), []byte("v"))
+	if _, ok := delta.ValueAt(0); ok {
+		t.Error("expected ValueAt to refuse a delta encoded value")
+	}
+}
+
+func TestBTreePrefixCompression(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	n := 600
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("user:%05d/profile", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	stats, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	var separators []string
+	err = walkLevels(bufmgr, tree, func(info *nodeInfo) error {
+		if !info.isLeaf {
+			separators = append(separators, string(info.firstKey), string(info.lastKey))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to walk: %v", err)
+	}
+	// 区切りキーは番号の違う桁までで切り詰められる
+	for _, sep := range separators {
+		if len(sep) > len("user:00000") {
+			t.Errorf("separator %q was not truncated", sep)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("user:%05d/profile", i)
+		iter, err := tree.Search(bufmgr, NewSearchKey([]byte(key)))
+		if err != nil {
+			t.Fatalf("failed to search %s: %v", key, err)
+		}
+		pair, err := iter.Next(bufmgr)
+		iter.Close(bufmgr)
+		if err != nil || pair == nil || string(pair.Key) != key {
+			t.Fatalf("expected %s, got %v (%v)", key, pair, err)
+		}
+	}
+	if stats.Pairs != n {
+		t.Errorf("expected %d pairs, got %d", n, stats.Pairs)
+	}
+}
+
+func TestBranchVariableFanout(t *testing.T) {
+	// 以前のフォーマットのブランチ（format ビットが0）を手で作る
+	fixed := NewBranch(make([]byte, disk.PageSize-NodeHeaderSize))
+	fixed.setNumChildren(1)
+	fixed.setChild(0, disk.PageID(10000))
+	fixed.setFreeSpaceOffset(uint16(len(fixed.data)))
+	n := 0
+	for fixed.Insert(0, []byte(fmt.Sprintf("k%04d", 9999-n)), disk.PageID(9999-n)) {
+		n++
+	}
+	if fixed.Format() != BranchFormatFixed || n != branchFixedMaxKeys {
+		t.Fatalf("expected %d keys in a fixed branch, got %d (format %d)", branchFixedMaxKeys, n, fixed.Format())
+	}
+	// 区切りキーと等しいキーは右の子に進む
+	if got := fixed.SearchChild([]byte("k9950")); got != disk.PageID(9951) {
+		t.Errorf("expected child 9951, got %d", got)
+	}
+
+	// 分割すると両方とも新しいフォーマットに移行する
+	left := NewBranch(make([]byte, disk.PageSize-NodeHeaderSize))
+	overflowKey := fixed.SplitInsert(left, []byte("k9899"), disk.PageID(9899))
+	if fixed.Format() != BranchFormatInterleaved || left.Format() != BranchFormatInterleaved {
+		t.Fatalf("expected interleaved format after split, got %d and %d", left.Format(), fixed.Format())
+	}
+	if left.NumKeys()+fixed.NumKeys()+1 != branchFixedMaxKeys+1 {
+		t.Errorf("lost keys in split: %d + %d", left.NumKeys(), fixed.NumKeys())
+	}
+	for _, key := range []string{"k9899", "k9900", "k9950", "k9999"} {
+		branch := fixed
+		if bytes.Compare([]byte(key), overflowKey) < 0 {
+			branch = left
+		}
+		want := disk.PageID(0)
+		fmt.Sscanf(key, "k%d", &want)
+		want++
+		if got := branch.SearchChild([]byte(key)); got != want {
+			t.Errorf("%s: expected child %d, got %d", key, want, got)
+		}
+	}
+
+	// 短いキーなら100個を超えて入る
+	branch := NewBranch(make([]byte, disk.PageSize-NodeHeaderSize))
+	branch.Initialize([]byte("a"), 0, 1)
+	n = 1
+	for branch.Insert(n+1, []byte(fmt.Sprintf("a%03d", n)), disk.PageID(n+1)) {
+		n++
+	}
+	if n <= branchFixedMaxKeys {
+		t.Errorf("expected more than %d short keys, got %d", branchFixedMaxKeys, n)
+	}
+}
+
+func TestBTreeWideBranch(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 1000)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	// 大きな値でリーフを増やし、1つのルートに100を超える子を持たせる
+	value := bytes.Repeat([]byte("v"), 1000)
+	n := 300
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), value); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	stats, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	if stats.Height != 2 || stats.LeafPages <= branchFixedMaxKeys+1 {
+		t.Errorf("expected a single branch over more than %d leaves: %v", branchFixedMaxKeys+1, stats)
+	}
+}
+
+func TestBTreeSizeLimits(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	if err := tree.Insert(bufmgr, make([]byte, MaxKeySize+1), []byte("v")); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("expected ErrKeyTooLarge, got %v", err)
+	}
+	if err := tree.Insert(bufmgr, []byte("key"), make([]byte, MaxValueSize+1)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected ErrValueTooLarge, got %v", err)
+	}
+	err = tree.Merge(bufmgr, []byte("key"), func([]byte) []byte { return make([]byte, MaxValueSize+1) })
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("expected ErrValueTooLarge from merge, got %v", err)
+	}
+
+	// インラインの上限の前後と、複数ページにまたがる値
+	sizes := []int{0, MaxInlineValueSize, MaxInlineValueSize + 1, disk.PageSize * 3, 100000}
+	for i, size := range sizes {
+		key := fmt.Sprintf("key%02d", i)
+		value := bytes.Repeat([]byte{byte('a' + i)}, size)
+		if err := tree.Insert(bufmgr, []byte(key), value); err != nil {
+			t.Fatalf("failed to insert %d bytes: %v", size, err)
+		}
+	}
+	if err := tree.Insert(bufmgr, []byte("key04"), make([]byte, 5000)); err != ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+
+	// オーバーフローページにある値を書き換える
+	err = tree.Merge(bufmgr, []byte("key03"), func(old []byte) []byte {
+		return append(old, 'z')
+	})
+	if err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	defer iter.Close(bufmgr)
+	for i, size := range sizes {
+		pair, err := iter.Next(bufmgr)
+		if err != nil || pair == nil {
+			t.Fatalf("expected pair %d, got %v (%v)", i, pair, err)
+		}
+		want := bytes.Repeat([]byte{byte('a' + i)}, size)
+		if i == 3 {
+			want = append(want, 'z')
+		}
+		if !bytes.Equal(pair.Value, want) {
+			t.Errorf("%s: value of %d bytes does not match (want %d bytes)", pair.Key, len(pair.Value), len(want))
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+}
+
+func TestBTreeMaxKeySize(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 1000)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	// 最大のキーと最大のインラインの値でも、リーフとブランチの分割が成り立つ
+	n := 60
+	keyOf := func(i int) []byte {
+		return []byte(fmt.Sprintf("%s%04d", bytes.Repeat([]byte("k"), MaxKeySize-4), i))
+	}
+	value := bytes.Repeat([]byte("v"), MaxInlineValueSize)
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(bufmgr, keyOf((i*37)%n), value); err != nil {
+			t.Fatalf("failed to insert %d: %v", i, err)
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	stats, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to collect stats: %v", err)
+	}
+	if stats.Pairs != n || stats.Height < 3 {
+		t.Errorf("unexpected shape: %v", stats)
+	}
+}
+
+func TestBTreeSplitMixedValueSizes(t *testing.T) {
+	// 小さい値の後ろに最大に近い値が並ぶと、ペアの数の中央で分けた後半がリーフに収まらない
+	// 分割はバイト数で決めるので、どのキーも失われない
+	check := func(t *testing.T, tree *BTree, bufmgr *buffer.BufferPoolManager, want map[string][]byte) {
+		t.Helper()
+		for key, value := range want {
+			got, err := tree.Get(bufmgr, []byte(key))
+			if err != nil {
+				t.Fatalf("failed to get %q: %v", key, err)
+			}
+			if !bytes.Equal(got, value) {
+				t.Fatalf("%q: value of %d bytes does not match (want %d bytes)", key, len(got), len(value))
+			}
+		}
+		iter, err := tree.Search(bufmgr, NewSearchStart())
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		defer iter.Close(bufmgr)
+		count := 0
+		for {
+			pair, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to scan: %v", err)
+			}
+			if pair == nil {
+				break
+			}
+			count++
+		}
+		if count != len(want) {
+			t.Errorf("expected %d pairs, scanned %d", len(want), count)
+		}
+		if err := Check(bufmgr, tree); err != nil {
+			t.Errorf("check failed: %v", err)
+		}
+	}
+
+	for _, delta := range []bool{false, true} {
+		t.Run(fmt.Sprintf("delta=%v", delta), func(t *testing.T) {
+			bufmgr, cleanup := setupTestEnvWithPool(t, 1000)
+			defer cleanup()
+			tree, err := CreateWithOptions(bufmgr, Options{DeltaValues: delta})
+			if err != nil {
+				t.Fatalf("failed to create btree: %v", err)
+			}
+			want := map[string][]byte{}
+			insert := func(key string, value []byte) {
+				t.Helper()
+				if err := tree.Insert(bufmgr, []byte(key), value); err != nil {
+					t.Fatalf("failed to insert %q: %v", key, err)
+				}
+				want[key] = value
+			}
+			for i := 0; i < 60; i++ {
+				insert(fmt.Sprintf("k%03d", i), []byte{byte(i)})
+			}
+			for i := 60; i < 64; i++ {
+				insert(fmt.Sprintf("k%03d", i), bytes.Repeat([]byte{byte(i)}, MaxInlineValueSize))
+			}
+			check(t, tree, bufmgr, want)
+
+			// 小さい値・最大に近い値・オーバーフローページに置く値と、長さの違うキーを混ぜる
+			rnd := rand.New(rand.NewSource(1))
+			for i := 0; i < 2000; i++ {
+				key := fmt.Sprintf("r%06d%s", rnd.Intn(1000000), bytes.Repeat([]byte("k"), rnd.Intn(4)*rnd.Intn(MaxKeySize/4)))
+				if _, ok := want[key]; ok {
+					continue
+				}
+				var value []byte
+				switch rnd.Intn(4) {
+				case 0, 1:
+					value = []byte{byte(i)}
+				case 2:
+					value = bytes.Repeat([]byte{byte(i)}, MaxInlineValueSize-rnd.Intn(8))
+				default:
+					value = bytes.Repeat([]byte{byte(i)}, MaxInlineValueSize+1+rnd.Intn(3000))
+				}
+				insert(key, value)
+			}
+			check(t, tree, bufmgr, want)
+
+			// 削除による再分配と併合でも失われない
+			deleted := 0
+			for key := range want {
+				if deleted%2 == 0 {
+					if err := tree.Delete(bufmgr, []byte(key)); err != nil {
+						t.Fatalf("failed to delete %q: %v", key, err)
+					}
+					delete(want, key)
+				}
+				deleted++
+			}
+			check(t, tree, bufmgr, want)
+		})
+	}
+}
+
+func TestBTreeDuplicates(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	created, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	// 設定はメタページに記録されているので、開き直しても引き継がれる
+	tree := NewBTree(created.MetaPageID)
+	if ok, err := tree.AllowsDuplicates(bufmgr); err != nil || !ok {
+		t.Fatalf("expected duplicates to be allowed, got %v (%v)", ok, err)
+	}
+
+	inserts := []struct{ key, value string }{
+		{"b", "1"}, {"ab", "2"}, {"a", "3"}, {"a\x00", "4"}, {"a", "5"}, {"a", "6"},
+	}
+	for _, d := range inserts {
+		if err := tree.Insert(bufmgr, []byte(d.key), []byte(d.value)); err != nil {
+			t.Fatalf("failed to insert %q: %v", d.key, err)
+		}
+	}
+
+	values, err := tree.GetAll(bufmgr, []byte("a"))
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if fmt.Sprint(values) != fmt.Sprint([][]byte{[]byte("3"), []byte("5"), []byte("6")}) {
+		t.Errorf("expected values in insertion order, got %q", values)
+	}
+
+	// 全件の走査では元のキーの順に、同じキーの中では挿入順に並ぶ
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	var got []string
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			break
+		}
+		got = append(got, fmt.Sprintf("%q=%s", pair.Key, pair.Value))
+	}
+	want := []string{`"a"=3`, `"a"=5`, `"a"=6`, `"a\x00"=4`, `"ab"=2`, `"b"=1`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if err := tree.Merge(bufmgr, []byte("a"), func(old []byte) []byte { return old }); err != ErrDuplicatesAllowed {
+		t.Errorf("expected ErrDuplicatesAllowed, got %v", err)
+	}
+
+	if err := tree.Delete(bufmgr, []byte("a")); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := tree.Delete(bufmgr, []byte("a")); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if values, _ := tree.GetAll(bufmgr, []byte("a")); len(values) != 0 {
+		t.Errorf("expected no values after delete, got %q", values)
+	}
+	if values, _ := tree.GetAll(bufmgr, []byte("a\x00")); len(values) != 1 {
+		t.Errorf("delete removed a different key: %q", values)
+	}
+}
+
+func TestBTreeDuplicatesAcrossLeaves(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 100)
+	defer cleanup()
+
+	tree, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	// 1つのキーのエントリが複数のリーフにまたがる
+	n := 400
+	for i := 0; i < n; i++ {
+		for _, key := range []string{"dup", fmt.Sprintf("key%03d", i)} {
+			if err := tree.Insert(bufmgr, []byte(key), []byte(fmt.Sprintf("value%03d", i))); err != nil {
+				t.Fatalf("failed to insert %s: %v", key, err)
+			}
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	values, err := tree.GetAll(bufmgr, []byte("dup"))
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if len(values) != n {
+		t.Fatalf("expected %d values, got %d", n, len(values))
+	}
+	for i, v := range values {
+		if want := fmt.Sprintf("value%03d", i); string(v) != want {
+			t.Fatalf("value %d: expected %s, got %s", i, want, v)
+		}
+	}
+
+	if err := tree.Delete(bufmgr, []byte("dup")); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if values, _ := tree.GetAll(bufmgr, []byte("dup")); len(values) != 0 {
+		t.Errorf("expected no values after delete, got %d", len(values))
+	}
+	if values, _ := tree.GetAll(bufmgr, []byte("key123")); len(values) != 1 {
+		t.Errorf("expected key123 to remain, got %q", values)
+	}
+}
+
+func TestDeltaEncoding(t *testing.T) {
+	base := []byte("temp=21.5;hum=40;ts=1000")
+	for _, value := range []string{
+		"temp=21.5;hum=40;ts=1000",
+		"temp=21.7;hum=40;ts=1001",
+		"temp=21.5",
+		"ts=1000",
+		"",
+		"completely different",
+		"temp=21.5;hum=40;ts=1000;extra",
+	} {
+		delta := encodeDelta(base, []byte(value))
+		if got := decodeDelta(base, delta); string(got) != value {
+			t.Errorf("%q: decoded %q", value, got)
+		}
+	}
+	if delta := encodeDelta(base, []byte("temp=21.7;hum=40;ts=1000")); len(delta) != 4+1 {
+		t.Errorf("expected a small delta, got %d bytes", len(delta))
+	}
+
+	// 基準値を持つリーフに挿入・削除しても値が戻る
+	leaf := NewLeaf(make([]byte, disk.PageSize-NodeHeaderSize))
+	leaf.initializeDelta(nil, nil)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("sensor:%03d", i)
+		if !leaf.Insert(i, []byte(key), []byte(fmt.Sprintf("temp=21.5;hum=40;ts=%04d", i))) {
+			t.Fatalf("failed to insert %s", key)
+		}
+	}
+	if leaf.Format() != LeafFormatDelta || len(leaf.Base()) == 0 {
+		t.Fatalf("expected a delta leaf with a base, got format %d base %q", leaf.Format(), leaf.Base())
+	}
+	leaf.Delete(5)
+	// 接頭辞に合わないキーを入れると接頭辞を短くして組み直す
+	if !leaf.Insert(leaf.NumPairs(), []byte("zone:1"), []byte("temp=30.0;hum=40;ts=9999")) {
+		t.Fatal("failed to insert a key outside the prefix")
+	}
+	for i := 0; i < leaf.NumPairs(); i++ {
+		pair := leaf.PairAt(i)
+		want := "temp=30.0;hum=40;ts=9999"
+		if string(pair.Key) != "zone:1" {
+			var n int
+			fmt.Sscanf(string(pair.Key), "sensor:%03d", &n)
+			want = fmt.Sprintf("temp=21.5;hum=40;ts=%04d", n)
+		}
+		if string(pair.Value) != want {
+			t.Errorf("%s: expected %q, got %q", pair.Key, want, pair.Value)
+		}
+	}
+}
+
+func TestBTreeDeltaValues(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 1000)
+	defer cleanup()
+
+	plain, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	delta, err := CreateWithOptions(bufmgr, Options{DeltaValues: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	const n = 3000
+	value := func(i int) []byte {
+		if i%500 == 0 {
+			return bytes.Repeat([]byte("x"), 2000) // オーバーフローページに置かれる値は差分にしない
+		}
+		return []byte(fmt.Sprintf("host=web-01;region=ap-northeast-1;metric=cpu;value=%03d;ts=2024-01-01T00:%05d", i%1000, i))
+	}
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		key := []byte(fmt.Sprintf("cpu:%05d", i))
+		for _, tree := range []*BTree{plain, delta} {
+			if err := tree.Insert(bufmgr, key, value(i)); err != nil {
+				t.Fatalf("failed to insert %s: %v", key, err)
+			}
+		}
+	}
+	if err := Check(bufmgr, delta); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+
+	iter, err := delta.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		pair, err := iter.Next(bufmgr)
+		if err != nil || pair == nil {
+			t.Fatalf("scan ended at %d: %v", i, err)
+		}
+		if !bytes.Equal(pair.Value, value(i)) {
+			t.Fatalf("%s: unexpected value %q", pair.Key, pair.Value)
+		}
+	}
+	iter.Close(bufmgr)
+
+	plainStats, err := Stats(bufmgr, plain)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	deltaStats, err := Stats(bufmgr, delta)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if deltaStats.LeafPages*2 > plainStats.LeafPages {
+		t.Errorf("expected delta encoding to at least halve the leaves: %d vs %d", deltaStats.LeafPages, plainStats.LeafPages)
+	}
+
+	// 更新・削除しても整合性が保たれる
+	if err := delta.Merge(bufmgr, []byte("cpu:00001"), func([]byte) []byte { return []byte("short") }); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	for i := 0; i < n; i += 3 {
+		if err := delta.Delete(bufmgr, []byte(fmt.Sprintf("cpu:%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := Check(bufmgr, delta); err != nil {
+		t.Fatalf("check failed after deletes: %v", err)
+	}
+	if values, _ := delta.GetAll(bufmgr, []byte("cpu:00001")); len(values) != 1 || string(values[0]) != "short" {
+		t.Errorf("unexpected value after update: %q", values)
+	}
+
+	// バルクロードでも差分で詰める
+	pairs := make([]Pair, n)
+	for i := range pairs {
+		pairs[i] = Pair{Key: []byte(fmt.Sprintf("cpu:%05d", i)), Value: value(i)}
+	}
+	bulk, err := BulkLoadWithOptions(bufmgr, pairs, BulkLoadOptions{Options: Options{DeltaValues: true}, Workers: 2})
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	if err := Check(bufmgr, bulk); err != nil {
+		t.Fatalf("check failed after bulk load: %v", err)
+	}
+	bulkStats, err := Stats(bufmgr, bulk)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if bulkStats.LeafPages > deltaStats.LeafPages {
+		t.Errorf("expected bulk load to pack at least as tightly: %d vs %d", bulkStats.LeafPages, deltaStats.LeafPages)
+	}
+	if values, _ := bulk.GetAll(bufmgr, []byte("cpu:01234")); len(values) != 1 || !bytes.Equal(values[0], value(1234)) {
+		t.Errorf("unexpected value after bulk load: %q", values)
+	}
+}
+
+func TestBTreeSecureDelete(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "btree_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(100))
+
+	// 削除したデータがファイルに残っているかを、印の有無で調べる
+	fileContains := func(marker string) bool {
+		t.Helper()
+		if err := bufmgr.Flush(); err != nil {
+			t.Fatalf("failed to flush: %v", err)
+		}
+		data, err := os.ReadFile(tmpPath)
+		if err != nil {
+			t.Fatalf("failed to read file: %v", err)
+		}
+		return bytes.Contains(data, []byte(marker))
+	}
+
+	for _, secure := range []bool{false, true} {
+		tree, err := CreateWithOptions(bufmgr, Options{SecureDelete: secure})
+		if err != nil {
+			t.Fatalf("failed to create btree: %v", err)
+		}
+		marker := fmt.Sprintf("secret-%v", secure)
+		for i := 0; i < 300; i++ {
+			if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%04d", i))); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+		inline := []byte(marker + "-inline")
+		large := bytes.Repeat([]byte(marker+"-large "), 500)
+		if err := tree.Insert(bufmgr, []byte("key0100a"), inline); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if err := tree.Insert(bufmgr, []byte("key0200a"), large); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if !fileContains(marker+"-inline") || !fileContains(marker+"-large") {
+			t.Fatal("expected the markers to be written")
+		}
+
+		if err := tree.Delete(bufmgr, []byte("key0100a")); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+		if err := tree.Merge(bufmgr, []byte("key0200a"), func([]byte) []byte { return []byte("replaced") }); err != nil {
+			t.Fatalf("failed to update: %v", err)
+		}
+		// 古いオーバーフローページは解放するので、無効でも0で埋まる
+		if fileContains(marker + "-large") {
+			t.Errorf("secure=%v: overflow value left in file", secure)
+		}
+		if secure && fileContains(marker+"-inline") {
+			t.Error("inline value left in file")
+		}
+		if err := Check(bufmgr, tree); err != nil {
+			t.Fatalf("check failed: %v", err)
+		}
+	}
+}
+
+func TestBulkLoad(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 1000)
+	defer cleanup()
+
+	const n = 20000
+	pairs := make([]Pair, n)
+	for i, j := range rand.New(rand.NewSource(1)).Perm(n) {
+		value := []byte(fmt.Sprintf("value%05d", j))
+		if j%1000 == 0 {
+			value = bytes.Repeat(value, 500) // オーバーフローページに置かれる
+		}
+		pairs[i] = Pair{Key: []byte(fmt.Sprintf("key%05d", j)), Value: value}
+	}
+
+	tree, err := BulkLoadWithOptions(bufmgr, pairs, BulkLoadOptions{Workers: 4})
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed after bulk load: %v", err)
+	}
+
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	for i := 0; i < n; i++ {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			t.Fatalf("scan ended after %d pairs", i)
+		}
+		if want := fmt.Sprintf("key%05d", i); string(pair.Key) != want {
+			t.Fatalf("pair %d: expected key %s, got %s", i, want, pair.Key)
+		}
+		if i%1000 == 0 && len(pair.Value) != 500*len("value00000") {
+			t.Errorf("pair %d: expected large value, got %d bytes", i, len(pair.Value))
+		}
+	}
+	if pair, _ := iter.Next(bufmgr); pair != nil {
+		t.Errorf("expected end of scan, got %s", pair.Key)
+	}
+	iter.Close(bufmgr)
+
+	// 読み込んだ後も普通に挿入できる
+	for i := 0; i < 200; i++ {
+		key := fmt.Sprintf("key%05d+", i*97)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("late")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	if err := tree.Insert(bufmgr, []byte("key00042"), []byte("dup")); err != ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed after inserts: %v", err)
+	}
+}
+
+func TestBulkLoadErrors(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	pairs := []Pair{
+		{Key: []byte("b"), Value: []byte("1")},
+		{Key: []byte("a"), Value: []byte("2")},
+		{Key: []byte("b"), Value: []byte("3")},
+	}
+	if _, err := BulkLoadWithOptions(bufmgr, pairs, BulkLoadOptions{Workers: 2}); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+	tooLarge := []Pair{{Key: make([]byte, MaxKeySize+1)}}
+	if _, err := BulkLoad(bufmgr, tooLarge); !errors.Is(err, ErrKeyTooLarge) {
+		t.Errorf("expected ErrKeyTooLarge, got %v", err)
+	}
+
+	// 重複キーを許す木では、同じキーは入力の順に並ぶ
+	tree, err := BulkLoadWithOptions(bufmgr, pairs, BulkLoadOptions{
+		Options: Options{AllowDuplicates: true},
+		Workers: 2,
+	})
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	values, err := tree.GetAll(bufmgr, []byte("b"))
+	if err != nil {
+		t.Fatalf("failed to get all: %v", err)
+	}
+	if fmt.Sprintf("%s", values) != "[1 3]" {
+		t.Errorf("unexpected values: %s", values)
+	}
+	if err := tree.Insert(bufmgr, []byte("b"), []byte("4")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if values, _ := tree.GetAll(bufmgr, []byte("b")); fmt.Sprintf("%s", values) != "[1 3 4]" {
+		t.Errorf("unexpected values after insert: %s", values)
+	}
+
+	// 空の入力では空の木を作る
+	tree, err = BulkLoad(bufmgr, nil)
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	if err := tree.Insert(bufmgr, []byte("a"), []byte("1")); err != nil {
+		t.Fatalf("failed to insert into empty bulk loaded tree: %v", err)
+	}
+}
+
+func TestBulkLoadFromSpilledRuns(t *testing.T) {
+	bufmgr, cleanup := setupTestEnvWithPool(t, 1000)
+	defer cleanup()
+
+	// RunSize を小さくして、入力を何本ものランに分けて一時ファイルに書き出させる
+	const n = 5000
+	perm := rand.New(rand.NewSource(2)).Perm(n)
+	i := 0
+	next := func() (*Pair, error) {
+		if i >= n {
+			return nil, nil
+		}
+		j := perm[i]
+		i++
+		return &Pair{Key: []byte(fmt.Sprintf("key%05d", j)), Value: []byte(fmt.Sprintf("value%05d", j))}, nil
+	}
+	dir := t.TempDir()
+	opts := BulkLoadOptions{Workers: 3, RunSize: 4096, TempDir: dir}
+	tree, err := BulkLoadFrom(bufmgr, next, opts)
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed after bulk load: %v", err)
+	}
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	for j := 0; j < n; j++ {
+		pair, err := iter.Next(bufmgr)
+		if err != nil || pair == nil {
+			t.Fatalf("scan ended after %d pairs: %v", j, err)
+		}
+		if want := fmt.Sprintf("key%05d", j); string(pair.Key) != want {
+			t.Fatalf("pair %d: expected key %s, got %s", j, want, pair.Key)
+		}
+	}
+	if pair, _ := iter.Next(bufmgr); pair != nil {
+		t.Errorf("expected end of scan, got %s", pair.Key)
+	}
+	iter.Close(bufmgr)
+
+	// 別々のランに入った重複キーも見つける
+	pairs := make([]Pair, 0, 1001)
+	for j := 0; j < 1000; j++ {
+		pairs = append(pairs, Pair{Key: []byte(fmt.Sprintf("key%05d", j)), Value: []byte("v")})
+	}
+	pairs = append(pairs, Pair{Key: []byte("key00000"), Value: []byte("dup")})
+	if _, err := BulkLoadFrom(bufmgr, sliceSource(pairs), opts); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+
+	// 重複キーを許す木では、ランをまたいでも同じキーは入力の順に並ぶ
+	opts.Options.AllowDuplicates = true
+	tree, err = BulkLoadFrom(bufmgr, sliceSource(pairs), opts)
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	values, err := tree.GetAll(bufmgr, []byte("key00000"))
+	if err != nil {
+		t.Fatalf("failed to get all: %v", err)
+	}
+	if fmt.Sprintf("%s", values) != "[v dup]" {
+		t.Errorf("unexpected values: %s", values)
+	}
+
+	// 書き出したランのファイルは残らない
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read temp dir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no run files left, got %d", len(entries))
+	}
+}
+
+func TestIterResumeToken(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for i := 0; i < 300; i += 2 {
+		key := fmt.Sprintf("key%03d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+
+	readKeys := func(iter *Iter, n int) []string {
+		var keys []string
+		for n < 0 || len(keys) < n {
+			pair, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next: %v", err)
+			}
+			if pair == nil {
+				break
+			}
+			keys = append(keys, string(pair.Key))
+		}
+		return keys
+	}
+
+	// 検索直後のトークンは検索の開始位置から再開する
+	iter, err := tree.Search(bufmgr, NewSearchKey([]byte("key101")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	token := iter.Token()
+	iter.Close(bufmgr)
+	iter, err = tree.Resume(bufmgr, token)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if got := readKeys(iter, 2); fmt.Sprint(got) != "[key102 key104]" {
+		t.Errorf("unexpected keys after resuming a fresh search: %v", got)
+	}
+
+	// 途中まで読んでトークンを取り、間に書き込みがあっても続きから読める
+	token = iter.Token()
+	iter.Close(bufmgr)
+	for _, key := range []string{"key103", "key105"} {
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	iter, err = tree.Resume(bufmgr, token)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if got := readKeys(iter, 3); fmt.Sprint(got) != "[key105 key106 key108]" {
+		t.Errorf("unexpected keys after resuming: %v", got)
+	}
+
+	// 最後まで読んだトークンからは何も返らない
+	rest := readKeys(iter, -1)
+	if len(rest) == 0 || rest[len(rest)-1] != "key298" {
+		t.Fatalf("unexpected rest of scan: %v", rest)
+	}
+	iter, err = tree.Resume(bufmgr, iter.Token())
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if got := readKeys(iter, -1); len(got) != 0 {
+		t.Errorf("expected nothing after the end, got %v", got)
+	}
+
+	for _, token := range [][]byte{nil, {0, 0}, {resumeTokenVersion, 9}} {
+		if _, err := tree.Resume(bufmgr, token); err != ErrInvalidToken {
+			t.Errorf("token %v: expected ErrInvalidToken, got %v", token, err)
+		}
+	}
+}
+
+func TestIterResumeTokenDuplicates(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tree, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := tree.Insert(bufmgr, []byte("dup"), []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// 同じキーのエントリの途中からでも再開できる
+	iter, err := tree.Search(bufmgr, NewSearchKey([]byte("dup")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := iter.Next(bufmgr); err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+	}
+	token := iter.Token()
+	iter.Close(bufmgr)
+
+	iter, err = tree.Resume(bufmgr, token)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	defer iter.Close(bufmgr)
+	var values []string
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			break
+		}
+		if string(pair.Key) != "dup" {
+			t.Errorf("expected decoded key, got %q", pair.Key)
+		}
+		values = append(values, string(pair.Value))
+	}
+	if fmt.Sprint(values) != "[2 3 4]" {
+		t.Errorf("unexpected values after resuming: %v", values)
+	}
+}
+
+func TestIterReadAhead(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "btree_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(100))
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 3000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+
+	// 1件だけ読むランダムアクセスでは先読みしない
+	iter, err := tree.Search(bufmgr, NewSearchKey([]byte("key01000")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	if _, err := iter.Next(bufmgr); err != nil {
+		t.Fatalf("failed to get next: %v", err)
+	}
+	if iter.readAhead.depth != 0 {
+		t.Errorf("expected no read-ahead for point lookup, got depth %d", iter.readAhead.depth)
+	}
+
+	// 長いスキャンでは深さが広がり、先のリーフがバッファプールに載っている
+	iter, err = tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	count := 0
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			break
+		}
+		count++
+		if count == n/2 {
+			if iter.readAhead.depth < 2 {
+				t.Errorf("expected read-ahead depth to grow, got %d", iter.readAhead.depth)
+			}
+			if iter.readAhead.ahead > 0 && !bufmgr.Contains(iter.readAhead.last) {
+				t.Errorf("expected prefetched leaf %d to be resident", iter.readAhead.last)
+			}
+		}
+	}
+	if count != n {
+		t.Errorf("expected %d pairs, got %d", n, count)
+	}
+}
+
+func TestIterAsyncReadAhead(t *testing.T) {
+	tmpPath := filepath.Join(t.TempDir(), "readahead.db")
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(1000))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 3000
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	diskMgr.Close()
+
+	// 開き直して、リーフがまだプールにない状態からスキャンする
+	diskMgr, err = disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	defer diskMgr.Close()
+	bufmgr = buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(64))
+
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	iter.SetReadAhead(bufmgr, 4)
+	prefetcher := iter.readAhead.prefetcher
+	if prefetcher == nil {
+		t.Fatal("expected an asynchronous prefetch to start")
+	}
+	prefetcher.Wait()
+	next := NewLeaf(iter.buffer.Page[NodeHeaderSize:]).NextPageID()
+	if next == nil || !bufmgr.Contains(*next) {
+		t.Errorf("expected the next leaf to be prefetched")
+	}
+
+	count := 0
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			break
+		}
+		count++
+	}
+	if count != n {
+		t.Errorf("expected %d pairs, got %d", n, count)
+	}
+	if iter.readAhead.prefetcher != nil {
+		t.Error("expected the prefetch to stop at the end of the scan")
+	}
+
+	// 負の深さでは先読みしない
+	iter, err = tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	defer iter.Close(bufmgr)
+	iter.SetReadAhead(bufmgr, -1)
+	for i := 0; i < n/2; i++ {
+		if _, err := iter.Next(bufmgr); err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+	}
+	if iter.readAhead.depth != 0 || iter.readAhead.prefetcher != nil {
+		t.Errorf("expected no read-ahead, got depth %d", iter.readAhead.depth)
+	}
+}
+
+func TestIterUnpinsLeaves(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "btree_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	// 大きなバッファプールで多数のリーフを持つ木を作り、ディスクに書き出す
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(100))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 3000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	diskMgr.Close()
+
+	// リーフ数より小さいバッファプールで開き直してもスキャンできるか
+	diskMgr, err = disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr = buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(5))
+	tree = NewBTree(tree.MetaPageID)
+
+	for round := 0; round < 3; round++ {
+		iter, err := tree.Search(bufmgr, NewSearchStart())
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		count := 0
+		for {
+			pair, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next after %d pairs: %v", count, err)
+			}
+			if pair == nil {
+				break
+			}
+			count++
+		}
+		if count != n {
+			t.Errorf("expected %d pairs, got %d", n, count)
+		}
+	}
+
+	// 途中で打ち切ったイテレータも Close でピンが外れる
+	for i := 0; i < 10; i++ {
+		iter, err := tree.Search(bufmgr, NewSearchKey([]byte(fmt.Sprintf("key%05d", i*300))))
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		if _, err := iter.Next(bufmgr); err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		iter.Close(bufmgr)
+		iter.Close(bufmgr)
+		if pair, _ := iter.Next(bufmgr); pair != nil {
+			t.Errorf("expected nil after close, got %v", pair)
+		}
+	}
+}
+
+func TestBTreeGetContains(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(16), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 2000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value"+key)); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	large := bytes.Repeat([]byte("L"), 3*MaxInlineValueSize)
+	if err := tree.Insert(bufmgr, []byte("large"), large); err != nil {
+		t.Fatalf("failed to insert large value: %v", err)
+	}
+
+	for i := 0; i < n; i += 13 {
+		key := fmt.Sprintf("key%05d", i)
+		value, err := tree.Get(bufmgr, []byte(key))
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", key, err)
+		}
+		if string(value) != "value"+key {
+			t.Errorf("expected value%s, got %s", key, value)
+		}
+		if ok, err := tree.Contains(bufmgr, []byte(key)); err != nil || !ok {
+			t.Errorf("expected %s to exist, got %v, %v", key, ok, err)
+		}
+	}
+	if value, err := tree.Get(bufmgr, []byte("large")); err != nil || !bytes.Equal(value, large) {
+		t.Errorf("unexpected large value: %d bytes, %v", len(value), err)
+	}
+	if _, err := tree.Get(bufmgr, []byte("key")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if ok, err := tree.Contains(bufmgr, []byte("zzz")); err != nil || ok {
+		t.Errorf("expected zzz to be missing, got %v, %v", ok, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := tree.GetContext(ctx, bufmgr, []byte("key00000")); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after get: %v", leaks)
+	}
+
+	dup, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for _, key := range []string{"a", "a", "ab"} {
+		if err := dup.Insert(bufmgr, []byte(key), []byte("v")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	if _, err := dup.Get(bufmgr, []byte("a")); !errors.Is(err, ErrDuplicatesAllowed) {
+		t.Errorf("expected ErrDuplicatesAllowed, got %v", err)
+	}
+	for key, want := range map[string]bool{"a": true, "ab": true, "": false, "aa": false, "b": false} {
+		if ok, err := dup.Contains(bufmgr, []byte(key)); err != nil || ok != want {
+			t.Errorf("Contains(%q): expected %v, got %v, %v", key, want, ok, err)
+		}
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after contains: %v", leaks)
+	}
+}
+
+func TestBTreeGetBatch(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(64), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 3000
+	for i := 0; i < n; i += 2 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value"+key)); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	large := bytes.Repeat([]byte("L"), 3*MaxInlineValueSize)
+	if err := tree.Insert(bufmgr, []byte("large"), large); err != nil {
+		t.Fatalf("failed to insert large value: %v", err)
+	}
+	if err := tree.Insert(bufmgr, []byte("empty"), nil); err != nil {
+		t.Fatalf("failed to insert empty value: %v", err)
+	}
+
+	// 奇数のキーは存在しない。同じキーを2回含めても、それぞれの位置に値を返す
+	var keys [][]byte
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		keys = append(keys, []byte(fmt.Sprintf("key%05d", i)))
+	}
+	keys = append(keys, []byte("large"), []byte("empty"), []byte("key00010"), []byte("zzz"), nil)
+	values, err := tree.GetBatch(bufmgr, keys)
+	if err != nil {
+		t.Fatalf("failed to get batch: %v", err)
+	}
+	if len(values) != len(keys) {
+		t.Fatalf("expected %d values, got %d", len(keys), len(values))
+	}
+	for i, key := range keys {
+		want, err := tree.Get(bufmgr, key)
+		if errors.Is(err, ErrKeyNotFound) {
+			want = nil
+		} else if err != nil {
+			t.Fatalf("failed to get %s: %v", key, err)
+		}
+		if !bytes.Equal(values[i], want) || (values[i] == nil) != (want == nil) {
+			t.Errorf("%q: expected %.20q, got %.20q", key, want, values[i])
+		}
+	}
+	if values[len(keys)-4] == nil || len(values[len(keys)-4]) != 0 {
+		t.Errorf("expected empty non-nil value, got %v", values[len(keys)-4])
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after get batch: %v", leaks)
+	}
+
+	// 連続したキーはリーフごとに1回だけ降りるので、Get を繰り返すよりページの取得が少ない
+	keys = keys[:0]
+	for i := 0; i < 1000; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("key%05d", i)))
+	}
+	before := bufmgr.Stats()
+	if _, err := tree.GetBatch(bufmgr, keys); err != nil {
+		t.Fatalf("failed to get batch: %v", err)
+	}
+	batch := bufmgr.Stats().Sub(before)
+	before = bufmgr.Stats()
+	for _, key := range keys {
+		tree.Get(bufmgr, key)
+	}
+	single := bufmgr.Stats().Sub(before)
+	if batch.Hits+batch.Misses >= (single.Hits+single.Misses)/4 {
+		t.Errorf("expected far fewer fetches: batch %d, get %d", batch.Hits+batch.Misses, single.Hits+single.Misses)
+	}
+
+	if values, err := tree.GetBatch(bufmgr, nil); err != nil || len(values) != 0 {
+		t.Errorf("expected no values, got %v, %v", values, err)
+	}
+	dup, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	if _, err := dup.GetBatch(bufmgr, keys); !errors.Is(err, ErrDuplicatesAllowed) {
+		t.Errorf("expected ErrDuplicatesAllowed, got %v", err)
+	}
+}
+
+func TestBTreeApproxCount(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(1000))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	if count, err := tree.ApproxCount(bufmgr); err != nil || count != 0 {
+		t.Errorf("expected 0 for empty tree, got %d, %v", count, err)
+	}
+	n := 20000
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+
+	within := func(name string, got, want int, tolerance float64) {
+		t.Helper()
+		if math.Abs(float64(got-want)) > tolerance*float64(want) {
+			t.Errorf("%s: expected about %d, got %d", name, want, got)
+		}
+	}
+	stats, _ := Stats(bufmgr, tree)
+	before := bufmgr.Stats()
+	count, err := tree.ApproxCount(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to count: %v", err)
+	}
+	within("count", count, n, 0.2)
+	if fetched := bufmgr.Stats().Sub(before); fetched.Hits+fetched.Misses > uint64(approxSamples*stats.Height) {
+		t.Errorf("expected at most %d fetches, got %d", approxSamples*stats.Height, fetched.Hits+fetched.Misses)
+	}
+
+	rangeCount := func(lo, hi []byte) int {
+		t.Helper()
+		count, err := tree.ApproxRangeCount(bufmgr, lo, hi)
+		if err != nil {
+			t.Fatalf("failed to count range: %v", err)
+		}
+		return count
+	}
+	within("all", rangeCount(nil, nil), n, 0.2)
+	within("range", rangeCount([]byte("key05000"), []byte("key12999")), 8000, 0.25)
+	within("from", rangeCount([]byte("key15000"), nil), 5000, 0.25)
+	within("to", rangeCount(nil, []byte("key01999")), 2000, 0.25)
+	// 同じリーフに入る範囲は正確に数える
+	if got := rangeCount([]byte("key00100"), []byte("key00104")); got != 5 {
+		t.Errorf("expected 5, got %d", got)
+	}
+	if got := rangeCount([]byte("key00100x"), []byte("key00104x")); got != 4 {
+		t.Errorf("expected 4, got %d", got)
+	}
+	if got := rangeCount([]byte("key09000"), []byte("key01000")); got != 0 {
+		t.Errorf("expected 0 for reversed range, got %d", got)
+	}
+
+	// 後ろ半分を消すと、見積もりも追従する
+	for i := n / 2; i < n; i++ {
+		if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	count, err = tree.ApproxCount(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to count: %v", err)
+	}
+	within("count after delete", count, n/2, 0.2)
+	within("range after delete", rangeCount([]byte("key05000"), []byte("key12999")), 5000, 0.25)
+
+	dup, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for _, key := range []string{"a", "a", "a", "ab", "b", "b"} {
+		if err := dup.Insert(bufmgr, []byte(key), []byte("v")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	for _, tc := range []struct {
+		lo, hi []byte
+		want   int
+	}{
+		{[]byte("a"), []byte("a"), 3},
+		{[]byte("a"), []byte("ab"), 4},
+		{[]byte("ab"), nil, 3},
+		{nil, nil, 6},
+		{[]byte("c"), nil, 0},
+	} {
+		if got, err := dup.ApproxRangeCount(bufmgr, tc.lo, tc.hi); err != nil || got != tc.want {
+			t.Errorf("[%q, %q]: expected %d, got %d, %v", tc.lo, tc.hi, tc.want, got, err)
+		}
+	}
+	if count, err := dup.ApproxCount(bufmgr); err != nil || count != 6 {
+		t.Errorf("expected 6, got %d, %v", count, err)
+	}
+}
+
+func TestBTreeReleasesPins(t *testing.T) {
+	// 木の高さより少し大きいだけのプールでも、操作の後にピンが残らなければ動き続ける
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(8), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	n := 5000
+	value := bytes.Repeat([]byte("v"), 100)
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), value); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	if err := tree.Insert(bufmgr, []byte("key00000"), value); !errors.Is(err, ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Fatalf("pins left after inserts: %v", leaks)
+	}
+
+	for i := 0; i < n; i += 97 {
+		iter, err := tree.Search(bufmgr, NewSearchKey([]byte(fmt.Sprintf("key%05d", i))))
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if want := fmt.Sprintf("key%05d", i); pair == nil || string(pair.Key) != want {
+			t.Errorf("expected %s, got %v", want, pair)
+		}
+		iter.Close(bufmgr)
+	}
+	for i := 0; i < n; i += 7 {
+		if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := tree.Delete(bufmgr, []byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if err := tree.Merge(bufmgr, []byte("key00001"), func(old []byte) []byte { return []byte("merged") }); err != nil {
+		t.Fatalf("failed to merge: %v", err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after search and delete: %v", leaks)
+	}
+}
+
+func TestBTreeRootCache(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	writer, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	reader := NewBTree(writer.MetaPageID)
+
+	search := func(tree *BTree, key string) {
+		t.Helper()
+		iter, err := tree.Search(bufmgr, NewSearchKey([]byte(key)))
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		defer iter.Close(bufmgr)
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil || string(pair.Key) != key {
+			t.Errorf("expected %s, got %v", key, pair)
+		}
+	}
+
+	if err := writer.Insert(bufmgr, []byte("key00000"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	search(reader, "key00000")
+
+	// キャッシュしたルートが使えれば、メタページは読まない（ルートとリーフだけ）
+	before := bufmgr.Stats()
+	search(reader, "key00000")
+	if fetches := bufmgr.Stats().Sub(before).Hits; fetches != 1 {
+		t.Errorf("expected 1 fetch with cached root, got %d", fetches)
+	}
+
+	// 別の BTree の値からルートが分割されても、古いキャッシュは使わない
+	for i := 1; i < 3000; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := writer.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	for i := 0; i < 3000; i += 100 {
+		search(reader, fmt.Sprintf("key%05d", i))
+	}
+	if err := reader.Insert(bufmgr, []byte("key99999"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	search(writer, "key99999")
+	if err := Check(bufmgr, writer); err != nil {
+		t.Errorf("check failed: %v", err)
+	}
+
+	// 設定を読んだときにルートも覚えるので、続けてルートを取ってもメタページは読まない
+	fresh := NewBTree(writer.MetaPageID)
+	if _, err := fresh.flags(context.Background(), bufmgr); err != nil {
+		t.Fatalf("failed to read flags: %v", err)
+	}
+	before = bufmgr.Stats()
+	rootBuffer, err := fresh.fetchRootPage(context.Background(), bufmgr)
+	if err != nil {
+		t.Fatalf("failed to fetch root: %v", err)
+	}
+	bufmgr.UnpinPage(rootBuffer)
+	if fetches := bufmgr.Stats().Sub(before).Hits; fetches != 1 {
+		t.Errorf("expected 1 fetch after reading flags, got %d", fetches)
+	}
+}
+
+func TestIterKeysOnly(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 500
+	bigValue := bytes.Repeat([]byte("x"), MaxInlineValueSize*3)
+	for i := 0; i < n; i++ {
+		value := []byte(fmt.Sprintf("value%d", i))
+		if i%100 == 0 {
+			value = bigValue
+		}
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	iter.SetKeysOnly(true)
+	before := bufmgr.Stats()
+	for i := 0; ; i++ {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			if i != n {
+				t.Errorf("expected %d keys, got %d", n, i)
+			}
+			break
+		}
+		if want := fmt.Sprintf("key%05d", i); string(pair.Key) != want || pair.Value != nil {
+			t.Fatalf("expected key %s without value, got %q %q", want, pair.Key, pair.Value)
+		}
+	}
+	// オーバーフローページは読まない
+	leaves := bufmgr.Stats().Sub(before).Hits
+	if leaves > uint64(n/10) {
+		t.Errorf("expected only leaf fetches, got %d", leaves)
+	}
+	if value, err := iter.Value(bufmgr); err != nil || value != nil {
+		t.Errorf("expected no value after end, got %q, %v", value, err)
+	}
+
+	// 値は必要なペアだけ読める
+	iter, err = tree.Search(bufmgr, NewSearchKey([]byte("key00099")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	defer iter.Close(bufmgr)
+	iter.SetKeysOnly(true)
+	for _, want := range []struct {
+		key   string
+		value []byte
+	}{
+		{"key00099", []byte("value99")},
+		{"key00100", bigValue},
+		{"key00101", []byte("value101")},
+	} {
+		pair, err := iter.Next(bufmgr)
+		if err != nil || pair == nil || string(pair.Key) != want.key {
+			t.Fatalf("expected %s, got %v, %v", want.key, pair, err)
+		}
+		value, err := iter.Value(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get value: %v", err)
+		}
+		if !bytes.Equal(value, want.value) {
+			t.Errorf("%s: expected value of %d bytes, got %d", want.key, len(want.value), len(value))
+		}
+	}
+
+	// 途中で値も返すモードに戻せる
+	iter.SetKeysOnly(false)
+	pair, err := iter.Next(bufmgr)
+	if err != nil || pair == nil || string(pair.Key) != "key00102" || string(pair.Value) != "value102" {
+		t.Errorf("expected key00102 with value, got %v, %v", pair, err)
+	}
+}
+
+func TestBTreeSearchExclusiveAndLast(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	first := func(search *Search) string {
+		t.Helper()
+		iter, err := tree.Search(bufmgr, search)
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		defer iter.Close(bufmgr)
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			return ""
+		}
+		return string(pair.Key)
+	}
+
+	if got := first(NewSearchLast()); got != "" {
+		t.Errorf("expected nothing in an empty tree, got %s", got)
+	}
+	// 偶数のキーだけを入れる
+	for i := 0; i < 2000; i += 2 {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	for _, tc := range []struct {
+		key  string
+		want string
+	}{
+		{"key00000", "key00002"},
+		{"key00001", "key00002"},
+		{"key00998", "key01000"},
+		{"a", "key00000"},
+		{"key01998", ""},
+		{"z", ""},
+	} {
+		if got := first(NewSearchKeyExclusive([]byte(tc.key))); got != tc.want {
+			t.Errorf("exclusive %s: expected %q, got %q", tc.key, tc.want, got)
+		}
+	}
+	if got := first(NewSearchLast()); got != "key01998" {
+		t.Errorf("expected key01998 as the last key, got %s", got)
+	}
+
+	// 末尾のリーフが空になっても、前のリーフの最後のペアに戻る
+	for i := 1000; i < 2000; i += 2 {
+		if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if got := first(NewSearchLast()); got != "key00998" {
+		t.Errorf("expected key00998 as the last key after deletes, got %s", got)
+	}
+
+	// 再開トークンは下限を含まない位置を覚えている
+	iter, err := tree.Search(bufmgr, NewSearchKeyExclusive([]byte("key00100")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	token := iter.Token()
+	iter.Close(bufmgr)
+	iter, err = tree.Resume(bufmgr, token)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if pair, _ := iter.Next(bufmgr); pair == nil || string(pair.Key) != "key00102" {
+		t.Errorf("expected key00102 after resume, got %v", pair)
+	}
+	iter.Close(bufmgr)
+
+	// 重複キーを許す木では同じキーのエントリを全て飛ばす
+	dup, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for _, key := range []string{"a", "b", "b", "b", "b\x00", "c"} {
+		if err := dup.Insert(bufmgr, []byte(key), []byte("v")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	tree = dup
+	if got := first(NewSearchKeyExclusive([]byte("b"))); got != "b\x00" {
+		t.Errorf("expected b\\x00 after b, got %q", got)
+	}
+	if got := first(NewSearchLast()); got != "c" {
+		t.Errorf("expected c as the last key, got %q", got)
+	}
+}
+
+func TestBTreeSearchPrefix(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	collect := func(tree *BTree, search *Search, keysOnly bool, limit int) ([]string, []byte) {
+		t.Helper()
+		iter, err := tree.Search(bufmgr, search)
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		defer iter.Close(bufmgr)
+		iter.SetKeysOnly(keysOnly)
+		var keys []string
+		for len(keys) != limit {
+			pair, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next: %v", err)
+			}
+			if pair == nil {
+				break
+			}
+			keys = append(keys, string(pair.Key))
+		}
+		return keys, iter.Token()
+	}
+
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for user := 0; user < 10; user++ {
+		for ts := 0; ts < 200; ts++ {
+			key := fmt.Sprintf("user%d:%04d", user, ts)
+			if err := tree.Insert(bufmgr, []byte(key), []byte("value")); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+	}
+
+	for _, keysOnly := range []bool{false, true} {
+		keys, _ := collect(tree, NewSearchPrefix([]byte("user3:")), keysOnly, -1)
+		if len(keys) != 200 || keys[0] != "user3:0000" || keys[199] != "user3:0199" {
+			t.Errorf("keysOnly=%v: unexpected prefix scan of %d keys: %v...", keysOnly, len(keys), keys[:min(len(keys), 3)])
+		}
+	}
+	if keys, _ := collect(tree, NewSearchPrefix([]byte("user3:01")), false, -1); len(keys) != 100 {
+		t.Errorf("expected 100 keys, got %d", len(keys))
+	}
+	if keys, _ := collect(tree, NewSearchPrefix([]byte("user9:9")), false, -1); len(keys) != 0 {
+		t.Errorf("expected no keys, got %v", keys)
+	}
+
+	// 再開しても同じ接頭辞で止まる
+	keys, token := collect(tree, NewSearchPrefix([]byte("user5:")), false, 150)
+	iter, err := tree.Resume(bufmgr, token)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if pair == nil {
+			break
+		}
+		keys = append(keys, string(pair.Key))
+	}
+	if len(keys) != 200 || keys[150] != "user5:0150" || keys[199] != "user5:0199" {
+		t.Errorf("unexpected keys after resume: %d", len(keys))
+	}
+
+	// 重複キーを許す木でも元のキーの接頭辞で絞り込む
+	dup, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for _, key := range []string{"a", "a\x00b", "a\x00b", "ab", "b"} {
+		if err := dup.Insert(bufmgr, []byte(key), []byte("v")); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if keys, _ := collect(dup, NewSearchPrefix([]byte("a\x00")), false, -1); fmt.Sprintf("%q", keys) != `["a\x00b" "a\x00b"]` {
+		t.Errorf("unexpected duplicate prefix scan %q", keys)
+	}
+	if keys, _ := collect(dup, NewSearchPrefix([]byte("a")), true, -1); len(keys) != 4 {
+		t.Errorf("expected 4 entries, got %q", keys)
+	}
+}
+
+// ベンチマーク
+func BenchmarkBTreeInsert(b *testing.B) {
+	tmpFile, _ := os.CreateTemp("", "btree_bench_*.db")
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	diskMgr, _ := disk.Open(tmpPath)
+	pool := buffer.NewBufferPool(100)
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+
+	tree, _ := Create(bufmgr)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key%010d", i)
+		value := fmt.Sprintf("value%010d", i)
+		tree.Insert(bufmgr, []byte(key), []byte(value))
+	}
+}
+
+func BenchmarkBTreeSearch(b *testing.B) {
+	tmpFile, _ := os.CreateTemp("", "btree_bench_*.db")
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	diskMgr, _ := disk.Open(tmpPath)
+	pool := buffer.NewBufferPool(100)
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+
+	tree, _ := Create(bufmgr)
+
+	// データを挿入
+	n := 10000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%010d", i)
+		value := fmt.Sprintf("value%010d", i)
+		tree.Insert(bufmgr, []byte(key), []byte(value))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("key%010d", i%n)
+		iter, _ := tree.Search(bufmgr, NewSearchKey([]byte(key)))
+		iter.Next(bufmgr)
+	}
+}
+
+// BenchmarkBTreeGet はイテレータを作る Search と Get、100キーずつの GetBatch の点検索を比べる
+func BenchmarkBTreeGet(b *testing.B) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(1000))
+	tree, _ := Create(bufmgr)
+	n := 10000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%010d", i)
+		value := fmt.Sprintf("value%010d", i)
+		tree.Insert(bufmgr, []byte(key), []byte(value))
+	}
+
+	b.Run("search", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := fmt.Sprintf("key%010d", i%n)
+			iter, _ := tree.Search(bufmgr, NewSearchKey([]byte(key)))
+			iter.Next(bufmgr)
+			iter.Close(bufmgr)
+		}
+	})
+	b.Run("get", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := fmt.Sprintf("key%010d", i%n)
+			tree.Get(bufmgr, []byte(key))
+		}
+	})
+	b.Run("batch", func(b *testing.B) {
+		keys := make([][]byte, 100)
+		for i := 0; i < b.N; i += len(keys) {
+			for j := range keys {
+				keys[j] = []byte(fmt.Sprintf("key%010d", (i+j)%n))
+			}
+			tree.GetBatch(bufmgr, keys)
+		}
+	})
+}
+
+// BenchmarkBTreeSearchRootCache はルートページIDのキャッシュの有無で検索を比べる
+// uncached は操作のたびにキャッシュを捨てて、毎回メタページを読む
+func BenchmarkBTreeSearchRootCache(b *testing.B) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(1000))
+	tree, _ := Create(bufmgr)
+	n := 10000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%010d", i)
+		value := fmt.Sprintf("value%010d", i)
+		tree.Insert(bufmgr, []byte(key), []byte(value))
+	}
+
+	for _, cached := range []bool{true, false} {
+		name := "cached"
+		if !cached {
+			name = "uncached"
+		}
+		b.Run(name, func(b *testing.B) {
+			before := bufmgr.Stats()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if !cached {
+					tree.cache.Store(nil)
+				}
+				key := fmt.Sprintf("key%010d", i%n)
+				iter, _ := tree.Search(bufmgr, NewSearchKey([]byte(key)))
+				iter.Next(bufmgr)
+				iter.Close(bufmgr)
+			}
+			stats := bufmgr.Stats().Sub(before)
+			b.ReportMetric(float64(stats.Hits+stats.Misses)/float64(b.N), "fetches/op")
+		})
+	}
+}
+
+// BenchmarkIterKeysOnly は値も返すスキャンとキーだけのスキャンの割り当てを比べる
+func BenchmarkIterKeysOnly(b *testing.B) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(1000))
+	tree, _ := Create(bufmgr)
+	value := bytes.Repeat([]byte("v"), 200)
+	for i := 0; i < 10000; i++ {
+		tree.Insert(bufmgr, []byte(fmt.Sprintf("key%010d", i)), value)
+	}
+
+	for _, keysOnly := range []bool{false, true} {
+		name := "pairs"
+		if keysOnly {
+			name = "keys"
+		}
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				iter, _ := tree.Search(bufmgr, NewSearchStart())
+				iter.SetKeysOnly(keysOnly)
+				for {
+					pair, _ := iter.Next(bufmgr)
+					if pair == nil {
+						break
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCursor(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(100), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	cursor := tree.Cursor()
+	if pair, err := cursor.First(bufmgr); err != nil || pair != nil {
+		t.Errorf("expected nothing in an empty tree, got %v, %v", pair, err)
+	}
+	if pair, err := cursor.Last(bufmgr); err != nil || pair != nil {
+		t.Errorf("expected nothing in an empty tree, got %v, %v", pair, err)
+	}
+
+	// 偶数のキーを入れ、途中のリーフが空になるよう一部をまとめて消す
+	value := bytes.Repeat([]byte("v"), 100)
+	var want []string
+	for i := 0; i < 2000; i += 2 {
+		key := fmt.Sprintf("key%05d", i)
+		if err := tree.Insert(bufmgr, []byte(key), value); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	for i := 0; i < 2000; i += 2 {
+		key := fmt.Sprintf("key%05d", i)
+		if i >= 500 && i < 900 {
+			if err := tree.Delete(bufmgr, []byte(key)); err != nil {
+				t.Fatalf("failed to delete: %v", err)
+			}
+			continue
+		}
+		want = append(want, key)
+	}
+
+	var forward []string
+	pair, err := cursor.First(bufmgr)
+	for ; pair != nil && err == nil; pair, err = cursor.Next(bufmgr) {
+		forward = append(forward, string(pair.Key))
+	}
+	if err != nil {
+		t.Fatalf("failed to move forward: %v", err)
+	}
+	if !slices.Equal(forward, want) {
+		t.Errorf("forward scan returned %d keys, expected %d", len(forward), len(want))
+	}
+	if pair, err := cursor.Current(bufmgr); err != nil || pair != nil {
+		t.Errorf("expected no position after the end, got %v, %v", pair, err)
+	}
+
+	var backward []string
+	pair, err = cursor.Last(bufmgr)
+	for ; pair != nil && err == nil; pair, err = cursor.Prev(bufmgr) {
+		backward = append(backward, string(pair.Key))
+	}
+	if err != nil {
+		t.Fatalf("failed to move backward: %v", err)
+	}
+	slices.Reverse(backward)
+	if !slices.Equal(backward, want) {
+		t.Errorf("backward scan returned %d keys, expected %d", len(backward), len(want))
+	}
+
+	tests := []struct {
+		seek string
+		want string
+		prev string
+	}{
+		{seek: "key00100", want: "key00100", prev: "key00098"},
+		{seek: "key00101", want: "key00102", prev: "key00100"},
+		{seek: "key00500", want: "key00900", prev: "key00498"}, // 空のリーフを越える
+		{seek: "a", want: "key00000", prev: ""},
+		{seek: "key01998", want: "key01998", prev: "key01996"},
+		{seek: "z", want: "", prev: ""},
+	}
+	for _, tt := range tests {
+		pair, err := cursor.Seek(bufmgr, []byte(tt.seek))
+		if err != nil {
+			t.Fatalf("failed to seek %s: %v", tt.seek, err)
+		}
+		if got := pairKey(pair); got != tt.want {
+			t.Errorf("Seek(%s) = %s, expected %s", tt.seek, got, tt.want)
+			continue
+		}
+		if pair == nil {
+			continue
+		}
+		if pair, err := cursor.Current(bufmgr); err != nil || pairKey(pair) != tt.want {
+			t.Errorf("Current after Seek(%s) = %v, %v", tt.seek, pair, err)
+		}
+		// 前に戻ってから、また同じ位置に進める
+		pair, err = cursor.Prev(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to move backward: %v", err)
+		}
+		if got := pairKey(pair); got != tt.prev {
+			t.Errorf("Prev after Seek(%s) = %s, expected %s", tt.seek, got, tt.prev)
+		}
+		if pair == nil {
+			continue
+		}
+		if pair, err := cursor.Next(bufmgr); err != nil || pairKey(pair) != tt.want {
+			t.Errorf("Next after Prev from %s = %v, %v", tt.seek, pair, err)
+		}
+	}
+	cursor.Close(bufmgr)
+	cursor.Close(bufmgr)
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after closing the cursor: %v", leaks)
+	}
+}
+
+func TestCursorDuplicates(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	tree, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for _, key := range []string{"a", "b", "b", "b", "c"} {
+		if err := tree.Insert(bufmgr, []byte(key), []byte(key)); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	cursor := tree.Cursor()
+	defer cursor.Close(bufmgr)
+
+	pair, err := cursor.Seek(bufmgr, []byte("b"))
+	if err != nil || pairKey(pair) != "b" {
+		t.Fatalf("Seek(b) = %v, %v", pair, err)
+	}
+	if pair, err := cursor.Prev(bufmgr); err != nil || pairKey(pair) != "a" {
+		t.Errorf("expected the entry before every b to be a, got %v, %v", pair, err)
+	}
+	var keys []string
+	pair, err = cursor.Last(bufmgr)
+	for ; pair != nil && err == nil; pair, err = cursor.Prev(bufmgr) {
+		keys = append(keys, string(pair.Key))
+	}
+	if err != nil || !slices.Equal(keys, []string{"c", "b", "b", "b", "a"}) {
+		t.Errorf("backward scan returned %v, %v", keys, err)
+	}
+}
+
+func pairKey(pair *Pair) string {
+	if pair == nil {
+		return ""
+	}
+	return string(pair.Key)
+}
+
+func TestIterConcurrentWrites(t *testing.T) {
+	for _, keysOnly := range []bool{false, true} {
+		t.Run(fmt.Sprintf("keysOnly=%v", keysOnly), func(t *testing.T) {
+			bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(100), buffer.Options{
+				TrackPins: true,
+			})
+			tree, err := Create(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to create btree: %v", err)
+			}
+			// 偶数のキーはスキャンの間ずっと残し、奇数のキーを挿入・削除してリーフを分割させる
+			value := bytes.Repeat([]byte("v"), 50)
+			n := 2000
+			for i := 0; i < n; i += 2 {
+				if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+
+			iter, err := tree.Search(bufmgr, NewSearchStart())
+			if err != nil {
+				t.Fatalf("failed to search: %v", err)
+			}
+			iter.SetKeysOnly(keysOnly)
+			defer iter.Close(bufmgr)
+
+			rng := rand.New(rand.NewSource(1))
+			inserted := map[int]bool{}
+			var prev string
+			seen := 0
+			for {
+				pair, err := iter.Next(bufmgr)
+				if err != nil {
+					t.Fatalf("failed to get next: %v", err)
+				}
+				if pair == nil {
+					break
+				}
+				key := string(pair.Key)
+				if key <= prev {
+					t.Fatalf("got %s after %s", key, prev)
+				}
+				prev = key
+				var i int
+				fmt.Sscanf(key, "key%05d", &i)
+				if i%2 == 0 {
+					seen++
+				}
+
+				for j := 0; j < 3; j++ {
+					k := rng.Intn(n/2)*2 + 1
+					key := []byte(fmt.Sprintf("key%05d", k))
+					if inserted[k] {
+						err = tree.Delete(bufmgr, key)
+					} else {
+						err = tree.Insert(bufmgr, key, value)
+					}
+					if err != nil {
+						t.Fatalf("failed to write %s: %v", key, err)
+					}
+					inserted[k] = !inserted[k]
+				}
+				if keysOnly && i%2 == 0 {
+					got, err := iter.Value(bufmgr)
+					if err != nil || !bytes.Equal(got, value) {
+						t.Fatalf("Value(%s) = %q, %v", key, got, err)
+					}
+				}
+			}
+			if seen != n/2 {
+				t.Errorf("saw %d of %d keys present during the whole scan", seen, n/2)
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+			if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+				t.Errorf("pins left after the scan: %v", leaks)
+			}
+		})
+	}
+}
+
+func TestBTreeDeleteRebalance(t *testing.T) {
+	for _, opts := range []Options{{}, {DeltaValues: true}, {AllowDuplicates: true}} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			diskMgr := disk.NewMemManager()
+			bufmgr := buffer.NewBufferPoolManagerWithOptions(diskMgr, buffer.NewBufferPool(64), buffer.Options{
+				TrackPins: true,
+			})
+			tree, err := CreateWithOptions(bufmgr, opts)
+			if err != nil {
+				t.Fatalf("failed to create btree: %v", err)
+			}
+			n := 3000
+			rng := rand.New(rand.NewSource(1))
+			for _, i := range rng.Perm(n) {
+				// 値の長さを変えて、併合できない組と再分配する組を混ぜる
+				value := bytes.Repeat([]byte{byte(i)}, 10+i%150)
+				if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			full, err := Stats(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get stats: %v", err)
+			}
+
+			// 9割を消すと、リーフもほぼ1割まで減る
+			deleted := map[int]bool{}
+			for j, i := range rng.Perm(n) {
+				if i%10 == 0 {
+					continue
+				}
+				if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+					t.Fatalf("failed to delete key%05d: %v", i, err)
+				}
+				deleted[i] = true
+				if j%300 == 0 {
+					if err := Check(bufmgr, tree); err != nil {
+						t.Fatalf("check failed after %d deletes: %v", len(deleted), err)
+					}
+				}
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+			if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+				t.Fatalf("pins left after deletes: %v", leaks)
+			}
+			stats, err := Stats(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get stats: %v", err)
+			}
+			if stats.Pairs != n/10 {
+				t.Errorf("expected %d pairs, got %d", n/10, stats.Pairs)
+			}
+			if stats.LeafPages > full.LeafPages/5 {
+				t.Errorf("expected at most %d leaves after deletes, got %d (from %d)", full.LeafPages/5, stats.LeafPages, full.LeafPages)
+			}
+			freedPages := diskMgr.NumFreePages()
+			if want := full.LeafPages + full.BranchPages - stats.LeafPages - stats.BranchPages; freedPages != want {
+				t.Errorf("expected %d free pages, got %d", want, freedPages)
+			}
+
+			// 残ったキーが全て読め、消したキーは読めない
+			iter, err := tree.Search(bufmgr, NewSearchStart())
+			if err != nil {
+				t.Fatalf("failed to search: %v", err)
+			}
+			for i := 0; i < n; i += 10 {
+				pair, err := iter.Next(bufmgr)
+				if err != nil {
+					t.Fatalf("failed to get next: %v", err)
+				}
+				if want := fmt.Sprintf("key%05d", i); pair == nil || string(pair.Key) != want || !bytes.Equal(pair.Value, bytes.Repeat([]byte{byte(i)}, 10+i%150)) {
+					t.Fatalf("expected %s, got %v", want, pair)
+				}
+			}
+			if pair, err := iter.Next(bufmgr); err != nil || pair != nil {
+				t.Errorf("expected the end, got %v, %v", pair, err)
+			}
+
+			// 挿入し直すと、解放したページを再利用してファイルを伸ばさない
+			for i := range deleted {
+				if i > 2000 {
+					continue
+				}
+				if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), []byte("again")); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			if diskMgr.NumFreePages() >= freedPages {
+				t.Errorf("expected freed pages to be reused, %d of %d left", diskMgr.NumFreePages(), freedPages)
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("check failed after reinserting: %v", err)
+			}
+
+			// 全て消すとルートは空のリーフになる
+			iter, err = tree.Search(bufmgr, NewSearchStart())
+			if err != nil {
+				t.Fatalf("failed to search: %v", err)
+			}
+			var keys [][]byte
+			for {
+				pair, err := iter.Next(bufmgr)
+				if err != nil {
+					t.Fatalf("failed to get next: %v", err)
+				}
+				if pair == nil {
+					break
+				}
+				keys = append(keys, pair.Key)
+			}
+			for _, key := range keys {
+				if err := tree.Delete(bufmgr, key); err != nil {
+					t.Fatalf("failed to delete %s: %v", key, err)
+				}
+			}
+			stats, err = Stats(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get stats: %v", err)
+			}
+			if stats.Height != 1 || stats.Pairs != 0 {
+				t.Errorf("expected an empty leaf root, got height %d with %d pairs", stats.Height, stats.Pairs)
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("check failed after deleting everything: %v", err)
+			}
+		})
+	}
+}
+
+func TestBTreeModifyDeleteRebalance(t *testing.T) {
+	diskMgr := disk.NewMemManager()
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(diskMgr, buffer.NewBufferPool(64), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 2000
+	large := bytes.Repeat([]byte("x"), MaxInlineValueSize*3)
+	value := func(i int) []byte {
+		if i%100 == 0 {
+			return large
+		}
+		return bytes.Repeat([]byte{byte(i)}, 50)
+	}
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), value(i)); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	full, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+
+	// CompareAndSwap と Merge で消しても、Delete と同じく併合してページとオーバーフローページを解放する
+	for i := 0; i < n; i++ {
+		if i%10 == 5 {
+			continue
+		}
+		key := []byte(fmt.Sprintf("key%05d", i))
+		if i%2 == 0 {
+			swapped, err := tree.CompareAndSwap(bufmgr, key, value(i), nil)
+			if err != nil || !swapped {
+				t.Fatalf("failed to delete %s: %v %v", key, swapped, err)
+			}
+		} else if err := tree.Merge(bufmgr, key, func([]byte) []byte { return nil }); err != nil {
+			t.Fatalf("failed to delete %s: %v", key, err)
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Fatalf("pins left after deletes: %v", leaks)
+	}
+	stats, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if stats.Pairs != n/10 {
+		t.Errorf("expected %d pairs, got %d", n/10, stats.Pairs)
+	}
+	if stats.LeafPages > full.LeafPages/5 {
+		t.Errorf("expected at most %d leaves after deletes, got %d (from %d)", full.LeafPages/5, stats.LeafPages, full.LeafPages)
+	}
+	perPage := disk.PageSize - NodeHeaderSize - OverflowHeaderSize
+	chain := (len(large) + perPage - 1) / perPage
+	if want := full.LeafPages + full.BranchPages - stats.LeafPages - stats.BranchPages + n/100*chain; diskMgr.NumFreePages() != want {
+		t.Errorf("expected %d free pages, got %d", want, diskMgr.NumFreePages())
+	}
+
+	// 置き換えた古い値のオーバーフローページも解放する
+	before := diskMgr.NumFreePages()
+	if err := tree.Insert(bufmgr, []byte("big"), large); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := tree.Merge(bufmgr, []byte("big"), func(old []byte) []byte { return append(old[:len(old):len(old)], 'y') }); err != nil {
+			t.Fatalf("failed to merge: %v", err)
+		}
+	}
+	if used := before - diskMgr.NumFreePages(); used > chain+1 {
+		t.Errorf("expected old overflow pages to be reused, %d pages taken", used)
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed after merging: %v", err)
+	}
+}
+
+func TestBTreeDeleteKeepsPinnedPages(t *testing.T) {
+	diskMgr := disk.NewMemManager()
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(64))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	value := bytes.Repeat([]byte("v"), 100)
+	for i := 0; i < 1000; i++ {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), value); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// イテレータが読んでいる最後のリーフを空にすると、左のリーフに併合されて木から外れる
+	iter, err := tree.Search(bufmgr, NewSearchKey([]byte("key00990")))
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	defer iter.Close(bufmgr)
+	pinned := iter.PageID()
+	for i := 900; i < 999; i++ {
+		if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	pages, err := Pages(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to list pages: %v", err)
+	}
+	if slices.Contains(pages, pinned) {
+		t.Fatalf("expected leaf %d to be merged away", pinned)
+	}
+
+	// ピンされていたので解放されず、新しいページに再利用されない
+	for range diskMgr.NumFreePages() {
+		buf, err := bufmgr.CreatePage()
+		if err != nil {
+			t.Fatalf("failed to create page: %v", err)
+		}
+		if buf.PageID == pinned {
+			t.Errorf("pinned leaf %d was reused", pinned)
+		}
+		bufmgr.UnpinPage(buf)
+	}
+
+	// イテレータは外されたリーフから降り直し、消したキーを返さない
+	pair, err := iter.Next(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to get next: %v", err)
+	}
+	if pair == nil || string(pair.Key) != "key00999" {
+		t.Errorf("expected key00999, got %v", pair)
+	}
+}
+
+func TestBTreeRebuild(t *testing.T) {
+	for _, opts := range []Options{{}, {DeltaValues: true}, {AllowDuplicates: true}} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			diskMgr := disk.NewMemManager()
+			bufmgr := buffer.NewBufferPoolManagerWithOptions(diskMgr, buffer.NewBufferPool(64), buffer.Options{
+				TrackPins: true,
+			})
+			tree, err := CreateWithOptions(bufmgr, opts)
+			if err != nil {
+				t.Fatalf("failed to create btree: %v", err)
+			}
+			// 大きな値はオーバーフローページに置かれる
+			value := func(i int) []byte {
+				if i%97 == 0 {
+					return bytes.Repeat([]byte{byte(i)}, 3*MaxInlineValueSize)
+				}
+				return bytes.Repeat([]byte{byte(i)}, 20+i%40)
+			}
+			n := 3000
+			rng := rand.New(rand.NewSource(1))
+			for _, i := range rng.Perm(n) {
+				if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), value(i)); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			// 半分を消しても併合されない程度にしかページは減らない
+			for i := 0; i < n; i++ {
+				if i%2 == 0 {
+					continue
+				}
+				if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+					t.Fatalf("failed to delete: %v", err)
+				}
+			}
+			if opts.AllowDuplicates {
+				if err := tree.Insert(bufmgr, []byte("key00000"), []byte("second")); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+			before, err := Stats(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get stats: %v", err)
+			}
+			pages, err := Pages(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get pages: %v", err)
+			}
+			rootBuffer, err := tree.fetchRootPage(context.Background(), bufmgr)
+			if err != nil {
+				t.Fatalf("failed to fetch root: %v", err)
+			}
+			rootPageID := rootBuffer.PageID
+			bufmgr.UnpinPage(rootBuffer)
+			freeBefore := diskMgr.NumFreePages()
+
+			if err := tree.Rebuild(bufmgr); err != nil {
+				t.Fatalf("failed to rebuild: %v", err)
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+			if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+				t.Fatalf("pins left after rebuild: %v", leaks)
+			}
+			after, err := Stats(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get stats: %v", err)
+			}
+			if after.Pairs != before.Pairs {
+				t.Errorf("expected %d pairs, got %d", before.Pairs, after.Pairs)
+			}
+			if after.LeafPages*3 > before.LeafPages*2 {
+				t.Errorf("expected fewer leaves after rebuild, got %d (from %d)", after.LeafPages, before.LeafPages)
+			}
+			newPages, err := Pages(bufmgr, tree)
+			if err != nil {
+				t.Fatalf("failed to get pages: %v", err)
+			}
+			// 古いルートは空きページに戻さない
+			if got, want := diskMgr.NumFreePages()-freeBefore, len(pages)-len(newPages)-1; got != want {
+				t.Errorf("expected %d more free pages, got %d", want, got)
+			}
+			// 新しいページは空きページのうちIDの小さいものから使われる
+			if maxPage := slices.Max(newPages); maxPage >= slices.Max(pages) {
+				t.Errorf("expected rebuilt pages below %d, got %d", slices.Max(pages), maxPage)
+			}
+			rootBuffer, err = tree.fetchRootPage(context.Background(), bufmgr)
+			if err != nil {
+				t.Fatalf("failed to fetch root: %v", err)
+			}
+			if rootBuffer.PageID == rootPageID {
+				t.Errorf("expected root to move from page %d", rootPageID)
+			}
+			bufmgr.UnpinPage(rootBuffer)
+			oldRootBuffer, err := bufmgr.FetchPage(rootPageID)
+			if err != nil {
+				t.Fatalf("failed to fetch old root: %v", err)
+			}
+			if isRootNode(oldRootBuffer.Page[:]) || !isRemovedNode(oldRootBuffer.Page[:]) {
+				t.Error("old root is still marked as the root")
+			}
+			bufmgr.UnpinPage(oldRootBuffer)
+
+			// 開き直した木からも全て読め、消したキーは読めない
+			tree = NewBTree(tree.MetaPageID)
+			iter, err := tree.Search(bufmgr, NewSearchStart())
+			if err != nil {
+				t.Fatalf("failed to search: %v", err)
+			}
+			defer iter.Close(bufmgr)
+			for i := 0; i < n; i += 2 {
+				pair, err := iter.Next(bufmgr)
+				if err != nil {
+					t.Fatalf("failed to get next: %v", err)
+				}
+				if want := fmt.Sprintf("key%05d", i); pair == nil || string(pair.Key) != want || !bytes.Equal(pair.Value, value(i)) {
+					t.Fatalf("expected %s, got %v", want, pair)
+				}
+				if i == 0 && opts.AllowDuplicates {
+					if pair, err := iter.Next(bufmgr); err != nil || pair == nil || string(pair.Value) != "second" {
+						t.Fatalf("expected the second entry of key00000, got %v, %v", pair, err)
+					}
+				}
+			}
+			if pair, err := iter.Next(bufmgr); err != nil || pair != nil {
+				t.Errorf("expected the end, got %v, %v", pair, err)
+			}
+			if opts.AllowDuplicates {
+				// 連番はそのまま引き継ぐので、後から入れたエントリも最後に並ぶ
+				if err := tree.Insert(bufmgr, []byte("key00000"), []byte("third")); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+				values, err := tree.GetAll(bufmgr, []byte("key00000"))
+				if err != nil || len(values) != 3 || string(values[2]) != "third" {
+					t.Errorf("expected 3 entries ending with third, got %q, %v", values, err)
+				}
+			}
+
+			// 全て消してから作り直すと、空のリーフのルートだけが残る
+			for i := 0; i < n; i += 2 {
+				if err := tree.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+					t.Fatalf("failed to delete: %v", err)
+				}
+			}
+			if err := tree.Rebuild(bufmgr); err != nil {
+				t.Fatalf("failed to rebuild: %v", err)
+			}
+			if err := Check(bufmgr, tree); err != nil {
+				t.Fatalf("check failed: %v", err)
+			}
+			if stats, err := Stats(bufmgr, tree); err != nil || stats.Height != 1 || stats.Pairs != 0 {
+				t.Errorf("expected an empty root leaf, got %+v, %v", stats, err)
+			}
+		})
+	}
+}
+
+func TestBTreeRebuildFillFactor(t *testing.T) {
+	diskMgr := disk.NewMemManager()
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(diskMgr, buffer.NewBufferPool(64), buffer.Options{
+		TrackPins: true,
+	})
+	n := 5000
+	pairs := make([]Pair, n)
+	for i := range pairs {
+		pairs[i] = Pair{Key: []byte(fmt.Sprintf("key%05d", i)), Value: bytes.Repeat([]byte{byte(i)}, 30)}
+	}
+	if _, err := BulkLoadWithOptions(bufmgr, pairs, BulkLoadOptions{FillFactor: 1.5}); !errors.Is(err, ErrInvalidFillFactor) {
+		t.Errorf("expected ErrInvalidFillFactor, got %v", err)
+	}
+	tree, err := BulkLoadWithOptions(bufmgr, pairs, BulkLoadOptions{FillFactor: 0.7})
+	if err != nil {
+		t.Fatalf("failed to bulk load: %v", err)
+	}
+	leafFill := func() float64 {
+		t.Helper()
+		if err := Check(bufmgr, tree); err != nil {
+			t.Fatalf("check failed: %v", err)
+		}
+		stats, err := Stats(bufmgr, tree)
+		if err != nil {
+			t.Fatalf("failed to get stats: %v", err)
+		}
+		if stats.Pairs != n {
+			t.Fatalf("expected %d pairs, got %d", n, stats.Pairs)
+		}
+		return stats.Levels[len(stats.Levels)-1].FillFactor
+	}
+	if fill := leafFill(); fill < 0.65 || fill > 0.7 {
+		t.Errorf("expected leaves filled to about 70%%, got %.2f", fill)
+	}
+
+	// 組み立てている間も古い木のまま読め、付け替えた後は新しい木から続きを読む
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := iter.Next(bufmgr); err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+	}
+	pagesBefore := diskMgr.NumPages()
+	if err := tree.RebuildWithOptions(bufmgr, RebuildOptions{FillFactor: 0.9, Online: true}); err != nil {
+		t.Fatalf("failed to rebuild: %v", err)
+	}
+	if diskMgr.NumPages() <= pagesBefore {
+		t.Error("expected the online rebuild to write new pages before freeing old ones")
+	}
+	for i := 100; i < n; i++ {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if want := fmt.Sprintf("key%05d", i); pair == nil || string(pair.Key) != want {
+			t.Fatalf("expected %s, got %v", want, pair)
+		}
+	}
+	iter.Close(bufmgr)
+	if fill := leafFill(); fill < 0.85 || fill > 0.9 {
+		t.Errorf("expected leaves filled to about 90%%, got %.2f", fill)
+	}
+
+	// 詰めずに残した余地には、分割せずに挿入できる
+	if err := tree.RebuildWithOptions(bufmgr, RebuildOptions{FillFactor: 0.5}); err != nil {
+		t.Fatalf("failed to rebuild: %v", err)
+	}
+	before, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	for i := 0; i < n; i += 10 {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d+", i)), nil); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	after, err := Stats(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if after.LeafPages != before.LeafPages {
+		t.Errorf("expected no splits, leaves went from %d to %d", before.LeafPages, after.LeafPages)
+	}
+	if err := tree.RebuildWithOptions(bufmgr, RebuildOptions{FillFactor: -1}); !errors.Is(err, ErrInvalidFillFactor) {
+		t.Errorf("expected ErrInvalidFillFactor, got %v", err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left: %v", leaks)
+	}
+}
+
+func TestBTreeNextSequence(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(16))
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for want := uint64(0); want < 3; want++ {
+		if got, err := tree.NextSequence(bufmgr); err != nil || got != want {
+			t.Fatalf("expected %d, got %d %v", want, got, err)
+		}
+	}
+	// 連番はメタページにあるので、開き直しても続きから払い出す
+	if got, err := NewBTree(tree.MetaPageID).NextSequence(bufmgr); err != nil || got != 3 {
+		t.Errorf("expected 3 after reopening, got %d %v", got, err)
+	}
+
+	dup, err := CreateWithOptions(bufmgr, Options{AllowDuplicates: true})
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	if _, err := dup.NextSequence(bufmgr); !errors.Is(err, ErrDuplicatesAllowed) {
+		t.Errorf("expected ErrDuplicatesAllowed, got %v", err)
+	}
+}
+
+func TestBTreeTruncate(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(64), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), bytes.Repeat([]byte{byte(i)}, 30)); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if _, err := tree.NextSequence(bufmgr); err != nil {
+		t.Fatalf("failed to get next sequence: %v", err)
+	}
+	if err := tree.Truncate(bufmgr); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	if err := Check(bufmgr, tree); err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	pageIDs, err := Pages(bufmgr, tree)
+	if err != nil {
+		t.Fatalf("failed to get pages: %v", err)
+	}
+	if len(pageIDs) != 2 {
+		t.Errorf("expected the meta page and an empty root, got %d pages", len(pageIDs))
+	}
+	iter, err := tree.Search(bufmgr, NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	if pair, err := iter.Next(bufmgr); err != nil || pair != nil {
+		t.Errorf("expected no pairs, got %v %v", pair, err)
+	}
+	iter.Close(bufmgr)
+
+	// 消した後も挿入でき、連番は巻き戻らない
+	if err := tree.Insert(bufmgr, []byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to insert after truncate: %v", err)
+	}
+	if got, err := tree.NextSequence(bufmgr); err != nil || got != 1 {
+		t.Errorf("expected 1, got %d %v", got, err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pin leaks: %v", leaks)
 	}
 }
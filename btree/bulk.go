@@ -0,0 +1,504 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// バルクロード
+//
+// 空の木に大量のペアを1つずつ Insert すると、ペアごとに根から降りてリーフを分割するので遅い。
+// バルクロードは次の手順で木を下から組み立てる:
+//
+//  1. 入力を RunSize バイトずつのランに分けてソートする。1つのランはワーカーの数に分けて
+//     並列にソートしてから併合する。入力が1つのランに収まらなければ、ソートしたランを
+//     一時ファイルに書き出し、最後にディスク上のランを併合しながら読む（bulksort.go）
+//  2. ソート済みの列を RunSize バイトずつ取り出し、それをキーの範囲でワーカーの数に分けて、
+//     各ワーカーが自分の範囲のリーフを並列に作って詰める（大きな値のオーバーフローページもここで書く）
+//  3. 範囲の境目でリーフの連結リストをつなぎ、全てのリーフの上にブランチを1段ずつ積んで
+//     1つのルートにまとめる
+
+// エラー定義
+var (
+	ErrInvalidFillFactor = errors.New("fill factor must be in (0, 1]")
+)
+
+// BulkLoadOptions はバルクロードの設定
+type BulkLoadOptions struct {
+	// Options は作成する木の設定
+	Options Options
+	// Workers はソートとリーフの作成に使うgoroutineの数（0なら runtime.GOMAXPROCS(0)）
+	// 各ワーカーは同時に最大3ページをピンするので、バッファプールはそれより大きくしておくこと
+	Workers int
+	// FillFactor は各ページをどこまで詰めるか（ページ本体のバイト数に対する割合）
+	// 0なら1（満杯まで）。読み込んだ後に挿入するなら 0.7 などにして分割の余地を残す
+	// 1ページに少なくとも1つのペア（ブランチなら2つの子）は入れる
+	FillFactor float64
+	// RunSize はメモリ上でソートする1つのランのバイト数（キーと値の合計。0なら DefaultBulkRunSize）
+	// 入力がこれを超えると、ソートしたランを一時ファイルに書き出してから併合する
+	RunSize int
+	// TempDir はランを書き出す一時ファイルを作るディレクトリ（空なら os.TempDir()）
+	TempDir string
+}
+
+// nodeCapacity は FillFactor から1ページに詰めるバイト数を求める
+func nodeCapacity(fillFactor float64) (int, error) {
+	if fillFactor == 0 {
+		fillFactor = 1
+	}
+	if !(fillFactor > 0 && fillFactor <= 1) {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidFillFactor, fillFactor)
+	}
+	return int(fillFactor * (disk.PageSize - NodeHeaderSize)), nil
+}
+
+// BulkLoad は pairs を全て格納した新しいB-treeを作成する
+// pairs はソートされていなくてよい。同じキーが含まれていれば ErrDuplicateKey を返す
+func BulkLoad(bufmgr *buffer.BufferPoolManager, pairs []Pair) (*BTree, error) {
+	return BulkLoadContext(context.Background(), bufmgr, pairs, BulkLoadOptions{})
+}
+
+// BulkLoadWithOptions は設定を指定して BulkLoad を行う
+func BulkLoadWithOptions(bufmgr *buffer.BufferPoolManager, pairs []Pair, opts BulkLoadOptions) (*BTree, error) {
+	return BulkLoadContext(context.Background(), bufmgr, pairs, opts)
+}
+
+// BulkLoadContext は BulkLoadWithOptions と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// 重複キーを許す木では、同じキーのエントリは pairs の中の順に並ぶ
+// 失敗した場合、それまでに書いたページは再利用されない
+func BulkLoadContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, pairs []Pair, opts BulkLoadOptions) (*BTree, error) {
+	return BulkLoadFromContext(ctx, bufmgr, sliceSource(pairs), opts)
+}
+
+// BulkLoadFrom は next が返すペアを全て格納した新しいB-treeを作成する
+// ペアはソートされていなくてよい。メモリには RunSize バイトのランだけを持ち、
+// それを超える入力は一時ファイルに書き出したランを併合してソートする
+func BulkLoadFrom(bufmgr *buffer.BufferPoolManager, next PairSource, opts BulkLoadOptions) (*BTree, error) {
+	return BulkLoadFromContext(context.Background(), bufmgr, next, opts)
+}
+
+// BulkLoadFromContext は BulkLoadFrom と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// 重複キーを許す木では、同じキーのエントリは next が返した順に並ぶ
+func BulkLoadFromContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, next PairSource, opts BulkLoadOptions) (*BTree, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	capacity, err := nodeCapacity(opts.FillFactor)
+	if err != nil {
+		return nil, err
+	}
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	runSize := opts.RunSize
+	if runSize <= 0 {
+		runSize = DefaultBulkRunSize
+	}
+
+	// ランに分けてソートする。呼び出し側のペアは並べ替えずに、ペアを指すポインタを並べる
+	sorter := &runSorter{runSize: runSize, workers: workers, dir: opts.TempDir}
+	defer sorter.close()
+	count := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pair, err := next()
+		if err != nil {
+			return nil, err
+		}
+		if pair == nil {
+			break
+		}
+		key := pair.Key
+		if opts.Options.AllowDuplicates {
+			// 入力の位置を連番にすれば全てのキーが異なり、同じキーは入力の順に並ぶ
+			key = encodeDuplicateKey(key, uint64(count))
+		}
+		if err := checkSize(key, pair.Value); err != nil {
+			return nil, err
+		}
+		if err := sorter.add(&Pair{Key: key, Value: pair.Value}); err != nil {
+			return nil, err
+		}
+		count++
+	}
+	if count == 0 {
+		return CreateWithOptions(bufmgr, opts.Options)
+	}
+	sorted, err := sorter.sorted()
+	if err != nil {
+		return nil, err
+	}
+
+	// ソートした列を RunSize バイトずつ取り出して、リーフを並列に作る
+	b := &bulkBuilder{bufmgr: bufmgr, workers: workers, delta: opts.Options.DeltaValues, capacity: capacity}
+	var chunk []*Pair
+	size := 0
+	for {
+		pair, err := sorted()
+		if err != nil {
+			return nil, err
+		}
+		if pair != nil {
+			prev := b.lastKey
+			if len(chunk) > 0 {
+				prev = chunk[len(chunk)-1].Key
+			}
+			if prev != nil && bytes.Equal(prev, pair.Key) {
+				return nil, fmt.Errorf("%w: %q", ErrDuplicateKey, pair.Key)
+			}
+			chunk = append(chunk, pair)
+			size += len(pair.Key) + len(pair.Value)
+			if size < runSize {
+				continue
+			}
+		}
+		if len(chunk) > 0 {
+			if err := b.addLeaves(ctx, chunk); err != nil {
+				return nil, err
+			}
+			chunk, size = chunk[:0], 0
+		}
+		if pair == nil {
+			break
+		}
+	}
+	nodes := b.nodes
+
+	// ブランチを積んで1つのルートにまとめる
+	for len(nodes) > 1 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if nodes, err = buildBranches(ctx, bufmgr, nodes, capacity); err != nil {
+			return nil, err
+		}
+	}
+
+	rootBuffer, err := bufmgr.FetchPageContext(ctx, nodes[0].pageID)
+	if err != nil {
+		return nil, err
+	}
+	setRootNode(rootBuffer.Page[:], true)
+	rootBuffer.IsDirty = true
+	bufmgr.UnpinPage(rootBuffer)
+
+	metaBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(metaBuffer)
+	meta := NewMeta(metaBuffer.Page[:])
+	meta.Header.RootPageID = nodes[0].pageID
+	meta.Header.Flags = opts.Options.metaFlags()
+	if opts.Options.AllowDuplicates {
+		meta.Header.NextSequence = uint64(count)
+	}
+	meta.Sync()
+	metaBuffer.IsDirty = true
+
+	tree := &BTree{MetaPageID: metaBuffer.PageID}
+	tree.cache.Store(&treeCache{rootPageID: nodes[0].pageID, flags: meta.Header.Flags})
+	return tree, nil
+}
+
+// bulkBuilder はソートした列から取り出した塊ごとにリーフを作り、作ったリーフを順に持つ
+type bulkBuilder struct {
+	bufmgr   *buffer.BufferPoolManager
+	workers  int
+	delta    bool
+	capacity int
+	nodes    []bulkNode // これまでに作ったリーフ
+	lastKey  []byte     // 最後のリーフの最後のキー
+}
+
+// addLeaves はソート済みの pairs をキーの範囲でワーカーの数に分けてリーフを並列に作り、
+// これまでに作ったリーフの後ろにつなぐ。pairs の先頭は lastKey より大きいこと
+func (b *bulkBuilder) addLeaves(ctx context.Context, sorted []*Pair) error {
+	workers := min(b.workers, len(sorted))
+	parts := make([][]bulkNode, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		lo, hi := len(sorted)*w/workers, len(sorted)*(w+1)/workers
+		wg.Add(1)
+		go func(w int, pairs []*Pair) {
+			defer wg.Done()
+			parts[w], errs[w] = buildLeaves(ctx, b.bufmgr, pairs, b.delta, b.capacity)
+		}(w, sorted[lo:hi])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	// 範囲の境目でリーフをつなぎ、区切りキーを決める
+	for w, part := range parts {
+		prevKey := b.lastKey
+		if w > 0 {
+			prevKey = sorted[len(sorted)*w/workers-1].Key
+		}
+		if len(b.nodes) > 0 {
+			part[0].separator = shortestSeparator(prevKey, sorted[len(sorted)*w/workers].Key)
+			if err := linkLeaves(ctx, b.bufmgr, b.nodes[len(b.nodes)-1].pageID, part[0].pageID); err != nil {
+				return err
+			}
+		}
+		b.nodes = append(b.nodes, part...)
+	}
+	b.lastKey = sorted[len(sorted)-1].Key
+	return nil
+}
+
+// bulkNode はバルクロードで作ったノード
+// separator はこのノードと直前のノードの間の区切りキーで、先頭のノードでは使わない
+type bulkNode struct {
+	pageID    disk.PageID
+	separator []byte
+}
+
+// parallelSort は pairs をランに分けて並列にソートし、隣り合うランを並列に併合していく
+func parallelSort(pairs []*Pair, runs int) {
+	less := func(a, b *Pair) bool { return bytes.Compare(a.Key, b.Key) < 0 }
+
+	bounds := make([]int, runs+1)
+	for i := range bounds {
+		bounds[i] = len(pairs) * i / runs
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < runs; i++ {
+		wg.Add(1)
+		go func(run []*Pair) {
+			defer wg.Done()
+			sort.Slice(run, func(i, j int) bool { return less(run[i], run[j]) })
+		}(pairs[bounds[i]:bounds[i+1]])
+	}
+	wg.Wait()
+
+	buf := make([]*Pair, len(pairs))
+	for len(bounds) > 2 {
+		var next []int
+		for i := 0; i+1 < len(bounds); i += 2 {
+			next = append(next, bounds[i])
+			if i+2 >= len(bounds) {
+				// 相手のいないランはそのまま次の段に残す
+				continue
+			}
+			wg.Add(1)
+			go func(lo, mid, hi int) {
+				defer wg.Done()
+				mergeRuns(buf[lo:hi], pairs[lo:mid], pairs[mid:hi], less)
+				copy(pairs[lo:hi], buf[lo:hi])
+			}(bounds[i], bounds[i+1], bounds[i+2])
+		}
+		next = append(next, bounds[len(bounds)-1])
+		wg.Wait()
+		bounds = next
+	}
+}
+
+// mergeRuns はソート済みの a と b を併合して dst に書く
+func mergeRuns(dst, a, b []*Pair, less func(a, b *Pair) bool) {
+	i, j := 0, 0
+	for k := range dst {
+		if j >= len(b) || (i < len(a) && !less(b[j], a[i])) {
+			dst[k] = a[i]
+			i++
+		} else {
+			dst[k] = b[j]
+			j++
+		}
+	}
+}
+
+// buildLeaves はソート済みの pairs をリーフに詰め、作ったリーフを順に返す
+// delta が true なら LeafFormatDelta で組み立てる。各リーフは capacity バイトまで詰める
+// リーフ同士は連結リストでつなぐ。範囲の外とのリンクは linkLeaves でつなぐ
+func buildLeaves(ctx context.Context, bufmgr *buffer.BufferPoolManager, pairs []*Pair, delta bool, capacity int) ([]bulkNode, error) {
+	var nodes []bulkNode
+	var prevBuffer *buffer.Buffer
+	defer func() {
+		if prevBuffer != nil {
+			bufmgr.UnpinPage(prevBuffer)
+		}
+	}()
+
+	format := LeafFormatPrefix
+	if delta {
+		format = LeafFormatDelta
+	}
+
+	// 大きな値は先にオーバーフローページに書いておき、リーフには参照を詰める
+	stored := make([]*Pair, len(pairs))
+	for i, p := range pairs {
+		s, err := storePair(ctx, bufmgr, p.Key, p.Value)
+		if err != nil {
+			return nil, err
+		}
+		stored[i] = s
+	}
+
+	for len(stored) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		n, prefix, base := packLeaf(stored, delta, capacity)
+		leafPairs := stored[:n]
+		stored = stored[n:]
+
+		leafBuffer, err := bufmgr.CreatePageContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		node := NewNode(leafBuffer.Page[:])
+		node.InitializeAsLeaf()
+		node.WriteHeader(leafBuffer.Page[:])
+		leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+		leaf.initialize(nil)
+		leaf.reset(format, prefix, base, leafPairs)
+		leafBuffer.IsDirty = true
+
+		bn := bulkNode{pageID: leafBuffer.PageID}
+		if prevBuffer != nil {
+			prevLeaf := NewLeaf(prevBuffer.Page[NodeHeaderSize:])
+			prevLeaf.SetNextPageID(&leafBuffer.PageID)
+			leaf.SetPrevPageID(&prevBuffer.PageID)
+			bn.separator = shortestSeparator(prevLeaf.PairAt(prevLeaf.NumPairs()-1).Key, leafPairs[0].Key)
+			bufmgr.UnpinPage(prevBuffer)
+		}
+		prevBuffer = leafBuffer
+		nodes = append(nodes, bn)
+	}
+	return nodes, nil
+}
+
+// packLeaf は先頭から何個のペアを capacity バイトのリーフに詰められるかを、そのリーフの接頭辞と基準値と共に返す
+// delta が true なら最初のインラインの値を基準値にし、値を差分にした大きさで数える
+// 1つのペアは必ずリーフに収まる（MaxKeySize と MaxInlineValueSize をそう決めている）
+func packLeaf(pairs []*Pair, delta bool, capacity int) (int, []byte, []byte) {
+	headerSize := LeafPrefixHeaderSize
+	var base []byte
+	if delta {
+		headerSize = LeafDeltaHeaderSize
+		for _, p := range pairs {
+			if !p.overflow {
+				base = p.Value
+				break
+			}
+		}
+	}
+	storedLen := func(p *Pair) int {
+		if delta && !p.overflow {
+			return len(encodeDelta(base, p.Value))
+		}
+		return len(p.Value)
+	}
+
+	prefix := pairs[0].Key
+	keys, values := len(pairs[0].Key), storedLen(pairs[0])
+	n := 1
+	for ; n < len(pairs); n++ {
+		p := pairs[n]
+		newPrefix := commonPrefix(prefix, p.Key)
+		value := storedLen(p)
+		// 接頭辞と基準値はページ末尾に1回だけ置き、各ペアのキーからは接頭辞の分を除く
+		need := headerSize + len(base) + len(newPrefix) +
+			(n+1)*(LeafSlotSize+PairSize(0, 0)-len(newPrefix)) + keys + len(p.Key) + values + value
+		if need > capacity {
+			break
+		}
+		prefix = newPrefix
+		keys += len(p.Key)
+		values += value
+	}
+	return n, prefix, base
+}
+
+// linkLeaves は範囲の境目にある2つのリーフを連結リストでつなぐ
+func linkLeaves(ctx context.Context, bufmgr *buffer.BufferPoolManager, leftID, rightID disk.PageID) error {
+	leftBuffer, err := bufmgr.FetchPageContext(ctx, leftID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(leftBuffer)
+	rightBuffer, err := bufmgr.FetchPageContext(ctx, rightID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(rightBuffer)
+
+	NewLeaf(leftBuffer.Page[NodeHeaderSize:]).SetNextPageID(&rightID)
+	NewLeaf(rightBuffer.Page[NodeHeaderSize:]).SetPrevPageID(&leftID)
+	leftBuffer.IsDirty = true
+	rightBuffer.IsDirty = true
+	return nil
+}
+
+// buildBranches は nodes の上に1段分のブランチを作り、作ったブランチを順に返す
+// 各ブランチの境目にある区切りキーは、ブランチに入れずに1つ上の段へ渡す
+// 各ブランチは capacity バイトまで詰めるが、ページに収まる限り子は2つ以上入れる
+func buildBranches(ctx context.Context, bufmgr *buffer.BufferPoolManager, nodes []bulkNode, capacity int) ([]bulkNode, error) {
+	// 先に各ブランチに入る子の範囲を決める
+	var groups [][]bulkNode
+	start, used := 0, BranchHeaderSize+BranchEntrySize
+	for i := 1; i < len(nodes); i++ {
+		need := BranchEntrySize + 2 + len(nodes[i].separator)
+		if used+need > disk.PageSize-NodeHeaderSize || used+need > capacity && i-start >= 2 {
+			groups = append(groups, nodes[start:i])
+			start, used = i, BranchHeaderSize+BranchEntrySize
+			continue
+		}
+		used += need
+	}
+	groups = append(groups, nodes[start:])
+
+	// ブランチは少なくとも2つの子を持たなければならないので、最後が1つなら前から1つ移す
+	// 前も2つしかなければ（FillFactor で区切った場合）前にまとめる。ページには必ず3つ以上の子が入る
+	if n := len(groups); n > 1 && len(groups[n-1]) == 1 {
+		prev := groups[n-2]
+		if len(prev) == 2 {
+			groups = append(groups[:n-2], nodes[len(nodes)-3:])
+		} else {
+			groups[n-2] = prev[:len(prev)-1]
+			groups[n-1] = nodes[len(nodes)-2:]
+		}
+	}
+
+	parents := make([]bulkNode, 0, len(groups))
+	for _, group := range groups {
+		branchBuffer, err := bufmgr.CreatePageContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+		node := NewNode(branchBuffer.Page[:])
+		node.InitializeAsBranch()
+		node.WriteHeader(branchBuffer.Page[:])
+
+		keys := make([][]byte, 0, len(group)-1)
+		children := make([]disk.PageID, 0, len(group))
+		for i, child := range group {
+			if i > 0 {
+				keys = append(keys, child.separator)
+			}
+			children = append(children, child.pageID)
+		}
+		NewBranch(branchBuffer.Page[NodeHeaderSize:]).build(keys, children)
+		branchBuffer.IsDirty = true
+		bufmgr.UnpinPage(branchBuffer)
+
+		parents = append(parents, bulkNode{pageID: branchBuffer.PageID, separator: group[0].separator})
+	}
+	return parents, nil
+}
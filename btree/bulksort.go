@@ -0,0 +1,200 @@
+package btree
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// バルクロードの外部ソート
+//
+// 入力を RunSize バイトずつランに分けてメモリ上でソートする。入力が1つのランに収まれば
+// そのまま使い、収まらなければソートしたランを一時ファイルに書き出して、最後に全てのランを
+// 先頭から読みながら併合する。メモリに持つのは1つのランと、各ランの読みかけのペアだけになる
+//
+// ランのファイルには、ペアを [key_len: 4] [value_len: 4] [key] [value] の形で並べる
+
+// DefaultBulkRunSize は BulkLoadOptions.RunSize の既定値
+const DefaultBulkRunSize = 64 << 20
+
+// PairSource は BulkLoadFrom に渡すペアの列
+// 呼ぶたびに次のペアを返し、終わりに達したら nil を返す。返したペアのキーと値は
+// バルクロードが終わるまで持ち続けることがあるので、呼び出し側で使い回さないこと
+type PairSource func() (*Pair, error)
+
+// sliceSource は pairs を先頭から返す PairSource を作る
+func sliceSource(pairs []Pair) PairSource {
+	i := 0
+	return func() (*Pair, error) {
+		if i >= len(pairs) {
+			return nil, nil
+		}
+		i++
+		return &pairs[i-1], nil
+	}
+}
+
+// runSorter は入力をランに分けてソートし、収まらなければ一時ファイルに書き出す
+type runSorter struct {
+	runSize int
+	workers int
+	dir     string
+	run     []*Pair    // まだ書き出していないラン
+	size    int        // run のキーと値のバイト数の合計
+	files   []*os.File // 書き出したラン
+}
+
+// add はペアをランに加え、ランが runSize に達したらソートして書き出す
+func (s *runSorter) add(pair *Pair) error {
+	s.run = append(s.run, pair)
+	s.size += len(pair.Key) + len(pair.Value)
+	if s.size < s.runSize {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill は今のランをソートして一時ファイルに書き出す
+func (s *runSorter) spill() error {
+	parallelSort(s.run, min(s.workers, len(s.run)))
+	f, err := os.CreateTemp(s.dir, "minidb_bulk_*.tmp")
+	if err != nil {
+		return err
+	}
+	s.files = append(s.files, f)
+	w := bufio.NewWriter(f)
+	var lenBuf [8]byte
+	for _, p := range s.run {
+		binary.LittleEndian.PutUint32(lenBuf[0:4], uint32(len(p.Key)))
+		binary.LittleEndian.PutUint32(lenBuf[4:8], uint32(len(p.Value)))
+		if _, err := w.Write(lenBuf[:]); err != nil {
+			return err
+		}
+		if _, err := w.Write(p.Key); err != nil {
+			return err
+		}
+		if _, err := w.Write(p.Value); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	clear(s.run)
+	s.run, s.size = s.run[:0], 0
+	return nil
+}
+
+// sorted は全てのペアをキーの順に返す関数を作る
+// 1つも書き出していなければメモリ上のランをソートして返し、そうでなければ
+// 残りのランも書き出してから、全てのランのファイルを併合しながら読む
+func (s *runSorter) sorted() (PairSource, error) {
+	if len(s.files) == 0 {
+		parallelSort(s.run, min(s.workers, len(s.run)))
+		return sortedSource(s.run), nil
+	}
+	if len(s.run) > 0 {
+		if err := s.spill(); err != nil {
+			return nil, err
+		}
+	}
+	m := &runMerger{}
+	for _, f := range s.files {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		r := &runReader{r: bufio.NewReader(f)}
+		if err := r.next(); err != nil {
+			return nil, err
+		}
+		if r.pair != nil {
+			m.readers = append(m.readers, r)
+		}
+	}
+	heap.Init(m)
+	return m.next, nil
+}
+
+// close は書き出したランのファイルを閉じて削除する
+func (s *runSorter) close() {
+	for _, f := range s.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+	s.files = nil
+}
+
+// sortedSource はソート済みの pairs を先頭から返す PairSource を作る
+func sortedSource(pairs []*Pair) PairSource {
+	i := 0
+	return func() (*Pair, error) {
+		if i >= len(pairs) {
+			return nil, nil
+		}
+		i++
+		return pairs[i-1], nil
+	}
+}
+
+// runReader は書き出したランを先頭から1つずつ読む
+type runReader struct {
+	r    *bufio.Reader
+	pair *Pair // 読みかけのペア。読み終えたら nil
+}
+
+// next は次のペアを pair に読む
+func (r *runReader) next() error {
+	var lenBuf [8]byte
+	if _, err := io.ReadFull(r.r, lenBuf[:]); err != nil {
+		if err == io.EOF {
+			r.pair = nil
+			return nil
+		}
+		return err
+	}
+	keyLen := binary.LittleEndian.Uint32(lenBuf[0:4])
+	data := make([]byte, keyLen+binary.LittleEndian.Uint32(lenBuf[4:8]))
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return err
+	}
+	r.pair = &Pair{Key: data[:keyLen:keyLen], Value: data[keyLen:]}
+	return nil
+}
+
+// runMerger は読みかけのペアのキーが小さい順にランを並べたヒープ
+type runMerger struct {
+	readers []*runReader
+}
+
+func (m *runMerger) Len() int { return len(m.readers) }
+func (m *runMerger) Less(i, j int) bool {
+	return bytes.Compare(m.readers[i].pair.Key, m.readers[j].pair.Key) < 0
+}
+func (m *runMerger) Swap(i, j int) { m.readers[i], m.readers[j] = m.readers[j], m.readers[i] }
+func (m *runMerger) Push(x any)    { m.readers = append(m.readers, x.(*runReader)) }
+func (m *runMerger) Pop() any {
+	r := m.readers[len(m.readers)-1]
+	m.readers = m.readers[:len(m.readers)-1]
+	return r
+}
+
+// next は全てのランのうちキーが最も小さいペアを返す。全て読み終えたら nil を返す
+func (m *runMerger) next() (*Pair, error) {
+	if len(m.readers) == 0 {
+		return nil, nil
+	}
+	r := m.readers[0]
+	pair := r.pair
+	if err := r.next(); err != nil {
+		return nil, err
+	}
+	if r.pair == nil {
+		heap.Pop(m)
+	} else {
+		heap.Fix(m, 0)
+	}
+	return pair, nil
+}
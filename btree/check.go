@@ -0,0 +1,389 @@
+package btree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// エラー定義
+var (
+	ErrCorrupted = errors.New("btree corrupted")
+)
+
+// CheckError は Check が見つけた1つの不整合
+type CheckError struct {
+	PageID disk.PageID
+	Msg    string
+}
+
+func (e *CheckError) Error() string {
+	return fmt.Sprintf("page %d: %s", e.PageID, e.Msg)
+}
+
+// Unwrap は errors.Is(err, ErrCorrupted) で判定できるようにする
+func (e *CheckError) Unwrap() error {
+	return ErrCorrupted
+}
+
+// Check は木全体を辿って次の不変条件を確認する
+//
+//   - ノード内のキーが昇順に並んでいる
+//   - ブランチの区切りキーと子の部分木のキーが c0 < k0 <= c1 < k1 <= ... を満たす
+//   - 全てのリーフが同じ深さにある
+//   - リーフの prev/next がキー順のリーフ列と両方向で一致している
+//   - 先頭のリーフから next を辿ったリーフの数が、ルートから辿ったリーフの数と一致している
+//   - 同じページが2回参照されていない（循環や共有がない）
+//   - スロットが指すペアの位置と長さがデータ領域に収まり、ペア同士が重ならず、空き領域のオフセットと一致している
+//   - オーバーフローページへの参照と LeafFormatDelta の差分が、形式に合った長さを持つ
+//
+// ルートから辿れないのにリーフのリンクからは辿れるページは、リンクの不一致として報告する。
+// 見つかった不整合は全て CheckError としてまとめて返す。問題がなければ nil を返す
+func Check(bufmgr *buffer.BufferPoolManager, tree *BTree) error {
+	metaBuffer, err := bufmgr.FetchPage(tree.MetaPageID)
+	if err != nil {
+		return err
+	}
+	rootPageID := NewMeta(metaBuffer.Page[:]).Header.RootPageID
+	bufmgr.UnpinPage(metaBuffer)
+
+	c := &checker{
+		bufmgr:    bufmgr,
+		visited:   map[disk.PageID]bool{tree.MetaPageID: true},
+		leafDepth: -1,
+	}
+	if err := c.checkNode(rootPageID, nil, nil, 0); err != nil {
+		return err
+	}
+	c.checkLeafLinks()
+	c.checkLeafChain()
+	return errors.Join(c.errs...)
+}
+
+// checker は Check の途中経過を保持する
+type checker struct {
+	bufmgr    *buffer.BufferPoolManager
+	visited   map[disk.PageID]bool
+	leaves    []leafLinks // キー順に並んだリーフ
+	leafDepth int         // 最初に見つけたリーフの深さ（-1 なら未到達）
+	errs      []error
+}
+
+// leafLinks はリーフのページIDと兄弟へのリンク
+type leafLinks struct {
+	pageID disk.PageID
+	prev   *disk.PageID
+	next   *disk.PageID
+}
+
+func (c *checker) report(pageID disk.PageID, format string, args ...any) {
+	c.errs = append(c.errs, &CheckError{PageID: pageID, Msg: fmt.Sprintf(format, args...)})
+}
+
+// checkNode はノードとその部分木を確認する
+// 部分木のキーは lo 以上 hi 未満でなければならない（nil は制限なし）
+// ページを読めないなどの致命的なエラーだけを返し、不整合は c.errs に溜める
+func (c *checker) checkNode(pageID disk.PageID, lo, hi []byte, depth int) error {
+	if c.visited[pageID] {
+		c.report(pageID, "referenced more than once")
+		return nil
+	}
+	c.visited[pageID] = true
+
+	nodeBuffer, err := c.bufmgr.FetchPage(pageID)
+	if err != nil {
+		return err
+	}
+	defer c.bufmgr.UnpinPage(nodeBuffer)
+
+	node := NewNode(nodeBuffer.Page[:])
+	switch node.Header.NodeType {
+	case NodeTypeLeaf:
+		c.checkLeaf(pageID, NewLeaf(nodeBuffer.Page[NodeHeaderSize:]), lo, hi, depth)
+		return nil
+
+	case NodeTypeBranch:
+		branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+		if !c.checkBranch(pageID, branch, lo, hi) {
+			return nil
+		}
+		// 子を辿る間に追い出されても困らないよう、先に子とキーを取り出しておく
+		numKeys := branch.NumKeys()
+		keys := make([][]byte, numKeys)
+		for i := range keys {
+			keys[i] = append([]byte{}, branch.KeyAt(i)...)
+		}
+		children := make([]disk.PageID, numKeys+1)
+		for i := range children {
+			children[i] = branch.ChildAt(i)
+		}
+		for i, child := range children {
+			childLo, childHi := lo, hi
+			if i > 0 {
+				childLo = keys[i-1]
+			}
+			if i < numKeys {
+				childHi = keys[i]
+			}
+			if err := c.checkNode(child, childLo, childHi, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	c.report(pageID, "invalid node type %d", node.Header.NodeType)
+	return nil
+}
+
+// checkLeaf はリーフ内のキーの順序とデータ領域を確認する
+func (c *checker) checkLeaf(pageID disk.PageID, leaf *Leaf, lo, hi []byte, depth int) {
+	if c.leafDepth < 0 {
+		c.leafDepth = depth
+	} else if depth != c.leafDepth {
+		c.report(pageID, "leaf at depth %d, expected %d", depth, c.leafDepth)
+	}
+	c.leaves = append(c.leaves, leafLinks{pageID: pageID, prev: leaf.PrevPageID(), next: leaf.NextPageID()})
+
+	switch format := leaf.Format(); format {
+	case LeafFormatPlain:
+	case LeafFormatPrefix, LeafFormatDelta:
+		if prefixLen := int(readUint16(leaf.data[LeafPrefixLenOffset:])); prefixLen > len(leaf.data)-LeafPrefixHeaderSize {
+			c.report(pageID, "prefix length %d exceeds the page", prefixLen)
+			return
+		}
+		if format == LeafFormatDelta {
+			prefixLen := int(readUint16(leaf.data[LeafPrefixLenOffset:]))
+			if baseLen := int(readUint16(leaf.data[LeafBaseLenOffset:])); baseLen+prefixLen > len(leaf.data)-LeafDeltaHeaderSize {
+				c.report(pageID, "base length %d exceeds the page", baseLen)
+				return
+			}
+		}
+	default:
+		c.report(pageID, "invalid leaf format %d", format)
+		return
+	}
+
+	numPairs := leaf.NumPairs()
+	freeSpaceOffset := int(leaf.freeSpaceOffset())
+	dataEnd := leaf.dataEnd()
+	if slotsEnd := leaf.slotOffset(numPairs); freeSpaceOffset < slotsEnd || freeSpaceOffset > dataEnd {
+		c.report(pageID, "free space offset %d outside [%d, %d]", freeSpaceOffset, slotsEnd, dataEnd)
+		return
+	}
+
+	extents := make([]extent, numPairs)
+	for i := 0; i < numPairs; i++ {
+		offset := int(leaf.getSlot(i))
+		if offset < freeSpaceOffset || offset+4 > dataEnd {
+			c.report(pageID, "slot %d points to %d outside the data region", i, offset)
+			return
+		}
+		keyLen := int(readUint16(leaf.data[offset:]))
+		rawValueLen := readUint16(leaf.data[offset+2:])
+		valueLen := int(rawValueLen &^ pairOverflowFlag)
+		size := PairSize(keyLen, valueLen)
+		if offset+size > dataEnd {
+			c.report(pageID, "slot %d at %d has %d bytes, past the data region end %d", i, offset, size, dataEnd)
+			return
+		}
+		if !c.checkStoredValue(pageID, leaf, i, leaf.data[offset+4+keyLen:offset+size], rawValueLen&pairOverflowFlag != 0) {
+			return
+		}
+		extents[i] = extent{offset: offset, size: size}
+	}
+	if !c.checkExtents(pageID, extents, freeSpaceOffset, dataEnd) {
+		return
+	}
+
+	var prev []byte
+	for i := 0; i < numPairs; i++ {
+		key := leaf.keyAt(i)
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			c.report(pageID, "key %q at slot %d is not greater than %q", key, i, prev)
+		}
+		c.checkBounds(pageID, key, lo, hi)
+		prev = key
+	}
+}
+
+// checkStoredValue はスロットに格納された値の長さが形式に合っているかを確認する
+// オーバーフローページへの参照は overflowRefSize バイト、LeafFormatDelta の差分は
+// 基準値の範囲に収まる先頭と末尾の長さを持たなければならない
+func (c *checker) checkStoredValue(pageID disk.PageID, leaf *Leaf, slotID int, value []byte, overflow bool) bool {
+	if overflow {
+		if len(value) != overflowRefSize {
+			c.report(pageID, "slot %d has an overflow reference of %d bytes, expected %d", slotID, len(value), overflowRefSize)
+			return false
+		}
+		return true
+	}
+	if leaf.Format() != LeafFormatDelta {
+		return true
+	}
+	if len(value) < 4 {
+		c.report(pageID, "slot %d has a delta of %d bytes", slotID, len(value))
+		return false
+	}
+	if head, tail := int(readUint16(value[0:2])), int(readUint16(value[2:4])); head+tail > len(leaf.Base()) {
+		c.report(pageID, "slot %d has a delta of %d+%d bytes, base is %d bytes", slotID, head, tail, len(leaf.Base()))
+		return false
+	}
+	return true
+}
+
+// checkBranch はブランチ内のキーの順序とデータ領域を確認する
+// 子を辿っても意味がないほど壊れていれば false を返す
+func (c *checker) checkBranch(pageID disk.PageID, branch *Branch, lo, hi []byte) bool {
+	if format := branch.Format(); format != BranchFormatFixed && format != BranchFormatInterleaved {
+		c.report(pageID, "invalid branch format %d", format)
+		return false
+	}
+	numChildren := branch.NumChildren()
+	numKeys := branch.NumKeys()
+	if numChildren < 2 {
+		c.report(pageID, "branch has %d children", numChildren)
+		return false
+	}
+	if numKeys > branch.maxKeys() {
+		c.report(pageID, "branch has %d keys, max %d", numKeys, branch.maxKeys())
+		return false
+	}
+
+	freeSpaceOffset := int(branch.freeSpaceOffset())
+	if slotsEnd := branch.childOffset(numChildren); freeSpaceOffset < slotsEnd || freeSpaceOffset > len(branch.data) {
+		c.report(pageID, "free space offset %d outside [%d, %d]", freeSpaceOffset, slotsEnd, len(branch.data))
+		return false
+	}
+
+	extents := make([]extent, numKeys)
+	for i := 0; i < numKeys; i++ {
+		offset := int(branch.getKeySlot(i))
+		if offset < freeSpaceOffset || offset+2 > len(branch.data) {
+			c.report(pageID, "key slot %d points to %d outside the data region", i, offset)
+			return false
+		}
+		size := 2 + int(readUint16(branch.data[offset:]))
+		if offset+size > len(branch.data) {
+			c.report(pageID, "key slot %d at %d has %d bytes, past the page end %d", i, offset, size, len(branch.data))
+			return false
+		}
+		extents[i] = extent{offset: offset, size: size}
+	}
+	if !c.checkExtents(pageID, extents, freeSpaceOffset, len(branch.data)) {
+		return false
+	}
+
+	var prev []byte
+	for i := 0; i < numKeys; i++ {
+		key := branch.KeyAt(i)
+		if prev != nil && bytes.Compare(prev, key) >= 0 {
+			c.report(pageID, "separator %q at %d is not greater than %q", key, i, prev)
+		}
+		c.checkBounds(pageID, key, lo, hi)
+		prev = key
+	}
+	return true
+}
+
+// extent はデータ領域の中の1つのエントリの位置
+type extent struct {
+	offset int
+	size   int
+}
+
+// checkExtents はエントリが重ならず、空き領域のオフセットからページ末尾までを
+// 隙間なく埋めているかを確認する（削除や分割の際にデータ領域は詰められる）
+// リーフの接頭辞はデータ領域の外（end 以降）に置かれる
+func (c *checker) checkExtents(pageID disk.PageID, extents []extent, freeSpaceOffset, end int) bool {
+	sorted := append([]extent{}, extents...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].offset < sorted[j].offset })
+
+	pos := freeSpaceOffset
+	for _, e := range sorted {
+		if e.offset != pos {
+			c.report(pageID, "entry at %d, expected %d (overlap or gap)", e.offset, pos)
+			return false
+		}
+		pos += e.size
+	}
+	if pos != end {
+		c.report(pageID, "data region ends at %d, expected %d", pos, end)
+		return false
+	}
+	return true
+}
+
+// checkBounds はキーが親の区切りキーの範囲 [lo, hi) に収まっているかを確認する
+func (c *checker) checkBounds(pageID disk.PageID, key, lo, hi []byte) {
+	if lo != nil && bytes.Compare(key, lo) < 0 {
+		c.report(pageID, "key %q is less than separator %q", key, lo)
+	}
+	if hi != nil && bytes.Compare(key, hi) >= 0 {
+		c.report(pageID, "key %q is not less than separator %q", key, hi)
+	}
+}
+
+// checkLeafLinks はリーフの prev/next がキー順のリーフ列と一致するかを確認する
+func (c *checker) checkLeafLinks() {
+	for i, leaf := range c.leaves {
+		var wantPrev, wantNext *disk.PageID
+		if i > 0 {
+			wantPrev = &c.leaves[i-1].pageID
+		}
+		if i < len(c.leaves)-1 {
+			wantNext = &c.leaves[i+1].pageID
+		}
+		if !samePageID(leaf.prev, wantPrev) {
+			c.report(leaf.pageID, "prev is %s, expected %s", formatPageID(leaf.prev), formatPageID(wantPrev))
+		}
+		if !samePageID(leaf.next, wantNext) {
+			c.report(leaf.pageID, "next is %s, expected %s", formatPageID(leaf.next), formatPageID(wantNext))
+		}
+	}
+}
+
+// checkLeafChain は先頭のリーフから next を辿ったリーフの数が、ルートから辿ったリーフの数と一致するかを確認する
+// ルートから辿れないページに出るか、同じリーフに2回来たらそこで打ち切る
+func (c *checker) checkLeafChain() {
+	if len(c.leaves) == 0 {
+		return
+	}
+	leaves := make(map[disk.PageID]leafLinks, len(c.leaves))
+	for _, leaf := range c.leaves {
+		leaves[leaf.pageID] = leaf
+	}
+	first := c.leaves[0].pageID
+	seen := map[disk.PageID]bool{}
+	count := 0
+	for next := &first; next != nil; {
+		leaf, ok := leaves[*next]
+		if !ok || seen[*next] {
+			break
+		}
+		seen[*next] = true
+		count++
+		next = leaf.next
+	}
+	if count != len(c.leaves) {
+		c.report(first, "leaf chain has %d leaves, %d reachable from the root", count, len(c.leaves))
+	}
+}
+
+func samePageID(a, b *disk.PageID) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func formatPageID(id *disk.PageID) string {
+	if id == nil {
+		return "none"
+	}
+	return fmt.Sprintf("%d", *id)
+}
@@ -0,0 +1,170 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// Cursor は木の中を前後に移動できるカーソル
+// Iter が前にしか進めないのに対して、Cursor は First・Last・Seek で位置を決め、
+// Next・Prev でどちらの向きにも1つずつ移動できる。ページ送りや逆順の走査に使う
+//
+// カーソルは今いるリーフのピンを1つだけ持つ。木の端を越えて移動すると位置を失って
+// ピンを外し、Current は nil を返す（First・Last・Seek で位置を決め直せる）。
+// Iter と違って書き込みの後に位置を確かめ直さないので、書き込んだら Seek で位置を決め直すこと。
+// 使い終わったら Close を呼ぶこと
+type Cursor struct {
+	tree       *BTree
+	buffer     *buffer.Buffer // 今いるリーフ（nil なら位置がない）
+	slotID     int
+	duplicates bool
+}
+
+// Cursor は木のカーソルを作る。位置は First・Last・Seek で決める
+func (t *BTree) Cursor() *Cursor {
+	return &Cursor{tree: t}
+}
+
+// First は最初のペアに移動してそれを返す。木が空なら nil を返す
+func (c *Cursor) First(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	return c.position(context.Background(), bufmgr, NewSearchStart())
+}
+
+// Last は最後のペアに移動してそれを返す。木が空なら nil を返す
+func (c *Cursor) Last(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	return c.position(context.Background(), bufmgr, NewSearchLast())
+}
+
+// Seek はキー以上の最初のペアに移動してそれを返す。そのようなペアがなければ nil を返す
+// 重複キーを許す木では、そのキーの最初のエントリに移動する
+func (c *Cursor) Seek(bufmgr *buffer.BufferPoolManager, key []byte) (*Pair, error) {
+	return c.SeekContext(context.Background(), bufmgr, key)
+}
+
+// SeekContext は Seek と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (c *Cursor) SeekContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) (*Pair, error) {
+	return c.position(ctx, bufmgr, NewSearchKey(key))
+}
+
+// position は search の位置に移動して、そこのペアを返す
+func (c *Cursor) position(ctx context.Context, bufmgr *buffer.BufferPoolManager, search *Search) (*Pair, error) {
+	c.Close(bufmgr)
+	iter, err := c.tree.SearchContext(ctx, bufmgr, search)
+	if err != nil {
+		return nil, err
+	}
+	// イテレータからリーフのピンを引き継ぐ
+	iter.readAhead.stop()
+	c.buffer, c.slotID, c.duplicates = iter.buffer, iter.slotID, iter.duplicates
+	if c.buffer != nil && c.slotID >= NewLeaf(c.buffer.Page[NodeHeaderSize:]).NumPairs() {
+		// 最後のリーフの末尾にいる（キーより大きいペアがない）
+		c.Close(bufmgr)
+	}
+	return c.CurrentContext(ctx, bufmgr)
+}
+
+// Next は次のペアに移動してそれを返す。最後のペアを越えたら位置を失い nil を返す
+// 削除で空になったリーフは読み飛ばす
+func (c *Cursor) Next(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	return c.NextContext(context.Background(), bufmgr)
+}
+
+// NextContext は Next と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (c *Cursor) NextContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.buffer == nil {
+		return nil, nil
+	}
+	c.slotID++
+	for {
+		leaf := NewLeaf(c.buffer.Page[NodeHeaderSize:])
+		if c.slotID < leaf.NumPairs() {
+			return c.CurrentContext(ctx, bufmgr)
+		}
+		nextPageID := leaf.NextPageID()
+		if nextPageID == nil {
+			c.Close(bufmgr)
+			return nil, nil
+		}
+		if err := c.moveTo(ctx, bufmgr, *nextPageID); err != nil {
+			return nil, err
+		}
+		c.slotID = 0
+	}
+}
+
+// Prev は前のペアに移動してそれを返す。最初のペアを越えたら位置を失い nil を返す
+// 削除で空になったリーフは読み飛ばす
+func (c *Cursor) Prev(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	return c.PrevContext(context.Background(), bufmgr)
+}
+
+// PrevContext は Prev と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (c *Cursor) PrevContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if c.buffer == nil {
+		return nil, nil
+	}
+	c.slotID--
+	for c.slotID < 0 {
+		prevPageID := NewLeaf(c.buffer.Page[NodeHeaderSize:]).PrevPageID()
+		if prevPageID == nil {
+			c.Close(bufmgr)
+			return nil, nil
+		}
+		if err := c.moveTo(ctx, bufmgr, *prevPageID); err != nil {
+			return nil, err
+		}
+		c.slotID = NewLeaf(c.buffer.Page[NodeHeaderSize:]).NumPairs() - 1
+	}
+	return c.CurrentContext(ctx, bufmgr)
+}
+
+// moveTo は隣のリーフに移り、それまでのリーフのピンを外す
+// 読めなかった場合は位置を失う
+func (c *Cursor) moveTo(ctx context.Context, bufmgr *buffer.BufferPoolManager, pageID disk.PageID) error {
+	nextBuffer, err := fetchNode(ctx, bufmgr, pageID)
+	c.Close(bufmgr)
+	if err != nil {
+		return err
+	}
+	c.buffer = nextBuffer
+	return nil
+}
+
+// Current は今の位置のペアを、移動せずに返す。位置がなければ nil を返す
+func (c *Cursor) Current(bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	return c.CurrentContext(context.Background(), bufmgr)
+}
+
+// CurrentContext は Current と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (c *Cursor) CurrentContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*Pair, error) {
+	if c.buffer == nil {
+		return nil, nil
+	}
+	pair := NewLeaf(c.buffer.Page[NodeHeaderSize:]).PairAt(c.slotID)
+	value, err := loadValue(ctx, bufmgr, pair)
+	if err != nil {
+		return nil, err
+	}
+	key := pair.Key
+	if c.duplicates {
+		key = decodeDuplicateKey(key)
+	}
+	return &Pair{Key: key, Value: value}, nil
+}
+
+// Close はカーソルが持っているリーフのピンを外し、位置を失わせる。何度呼んでもよい
+func (c *Cursor) Close(bufmgr *buffer.BufferPoolManager) {
+	if c.buffer == nil {
+		return
+	}
+	bufmgr.UnpinPage(c.buffer)
+	c.buffer = nil
+}
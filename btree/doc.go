@@ -32,6 +32,7 @@ Branch（ブランチノード）:
   - キーと子ページへのポインタを持つ
   - n個のキーに対してn+1個の子ポインタ
   - 検索時の経路案内役
+  - 子の数に固定の上限はなく、キーが短いほど多くの子を持てる
 
 Meta（メタページ）:
   - ルートページIDを保持
@@ -54,24 +55,349 @@ Meta（メタページ）:
   - データ領域: 実際のキー・値（末尾から前方へ伸びる）
   - 可変長データを効率的に格納できる
 
+ブランチでは子ページIDとキーへのオフセットを1つのエントリとして並べる。
+エントリ配列とキーデータが互いに向かって伸び、間の空き領域がなくなったら分割する：
+
+	┌──────────────────────────────────────────┐
+	│ Header                                    │
+	├──────────────────────────────────────────┤
+	│ [c0|off0] [c1|off1] ... [cn|-]  →       │
+	│                                          │
+	│            ← ... Key[1] Key[0]          │
+	└──────────────────────────────────────────┘
+
+以前のファイルのブランチ（キーオフセット100個分の固定スロット配列の後に
+子ページID配列を置く形式）もそのまま読み書きでき、分割の際に新しい形式に移行する。
+
+# 重複キー
+
+CreateWithOptions で AllowDuplicates を指定すると、同じキーで何度でも Insert できる。
+設定はメタページに記録されるので、NewBTree で開き直しても引き継がれる。
+
+格納するキーは元のキーをエスケープして終端を付け、挿入順の連番を後ろに付けたもの：
+
+	"a"  → 61 00 01 | 00 00 00 00 00 00 00 07
+	"ab" → 61 62 00 01 | 00 00 00 00 00 00 00 03
+
+元のキーの 0x00 は 0x00 0xFF に置き換えるので、格納したキーの順序は元のキーの順序と
+一致し、同じキーのエントリは挿入順に並ぶ。Search と Iter はこの変換を隠し、元のキーを返す。
+GetAll はキーに一致する全ての値を、Delete は一致する全てのエントリを削除する。
+書き換える対象が1つに決まらない CompareAndSwap と Merge は ErrDuplicatesAllowed を返す。
+
+	tree, _ := btree.CreateWithOptions(bufmgr, btree.Options{AllowDuplicates: true})
+	tree.Insert(bufmgr, []byte("tag:go"), []byte("post1"))
+	tree.Insert(bufmgr, []byte("tag:go"), []byte("post2"))
+	values, _ := tree.GetAll(bufmgr, []byte("tag:go")) // [post1 post2]
+
+重複キーを許さない木では、メタページの連番を NextSequence で払い出せる。
+連番はページと一緒に書き戻されるので、自動採番のキーに使える。
+
+# キーと値の大きさ
+
+キーは MaxKeySize（1024バイト）まで、値は MaxValueSize（16MiB）まで格納できる。
+これを超える挿入は ErrKeyTooLarge / ErrValueTooLarge を返し、木には触れない。
+
+MaxInlineValueSize（1000バイト）を超える値はリーフに直接置かず、
+オーバーフローページの連結リストに書いてリーフには参照だけを置く：
+
+	leaf:     [key | ref(page 42, 100000 bytes)]
+	overflow: page 42 [next=43 | 4078 bytes] → page 43 [next=44 | ...] → ...
+
+上限は最大のキーと最大のインラインの値でも、分割したリーフとブランチが
+それぞれ少なくとも1つのエントリを持てるように決めている。
+値を削除・更新したら、古いオーバーフローページは空きページに戻して再利用する
+（CompareAndSwap と Merge で削除・更新した場合も同じ）。
+
+# 安全な削除
+
+Options.SecureDelete を有効にすると、Delete や値の更新で不要になったペアのバイトを
+リーフの空き領域から0で消し、参照されなくなったオーバーフローページも全て0で埋める。
+削除したデータをデータファイルに残してはならない場合に使う：
+
+	tree, _ := btree.CreateWithOptions(bufmgr, btree.Options{SecureDelete: true})
+
+分割や接頭辞の取り直しでリーフ・ブランチを組み直すときは、設定に関わらず
+空き領域を0で埋める。設定はメタページに記録され、開き直しても引き継がれる。
+WAL やバックアップなど、データファイルの外に書かれたコピーは消さない。
+
+# 接頭辞圧縮
+
+"user:0000123" のように共通の接頭辞を持つキーが多いと、同じバイト列が何度も
+ページに書かれる。これを避けるため2種類の圧縮を行う：
+
+  - リーフ: ページ内の全てのキーに共通する接頭辞を末尾に1回だけ置き、
+    各ペアには残りの部分だけを格納する。接頭辞に合わないキーが挿入されたら
+    接頭辞を短くして組み直し、分割の際には左右それぞれで取り直す
+  - ブランチ: リーフの分割で親に渡す区切りキーを、左側の最大キーより大きく
+    右側の最小キー以下である最も短いバイト列に切り詰める
+
+	leaf:   [header] [slots...] [空き領域] ["123" v] ["124" v] ["user:0000"]
+	branch: "user:00001/profile" | "user:00002/profile" → 区切りキー "user:00002"
+
+リーフのフォーマットは num_pairs の上位4ビットに記録する。以前のファイルのリーフは
+LeafFormatPlain としてそのまま読み書きでき、分割で組み直されたときに
+LeafFormatPrefix に移行する。
+
+# 値の差分符号化
+
+時系列のように隣り合う行の値がほとんど同じ場合は、Options.DeltaValues を有効にすると
+リーフごとに中央の値を基準値として1回だけ置き、各値を基準値との差分で格納する。
+差分は先頭と末尾で基準値と一致する長さと、残りの中間部分からなる：
+
+	base:  "temp=21.5;hum=40;ts=1000"
+	value: "temp=21.7;hum=40;ts=1000" → [head=8 tail=15 "7"]
+
+読み出すときは PairAt が値に戻すので、呼び出し側からは区別がつかない。
+基準値は分割やバルクロードでリーフを組み直すときに取り直す。オーバーフローページに
+置いた値は差分にしない。設定はメタページに記録され、開き直しても引き継がれる。
+
 # 検索アルゴリズム
 
-1. メタページからルートページIDを取得
+1. メタページからルートページIDを取得（キャッシュがあれば読まない）
 2. ルートから開始し、ブランチノードを辿る
 3. 各ブランチで二分探索し、適切な子を選択
 4. リーフノードに到達したら二分探索でキーを探す
 
+木は再帰ではなくループで降りる。子を取得したら親のピンを外すので、
+検索中にピンしているページは高々2つで、イテレータはリーフのピンだけを持つ。
+
+検索の開始位置は Search で指定する。NewSearchStart は先頭から、NewSearchKey は
+キー以上の最初のペアから、NewSearchKeyExclusive はキーより大きい最初のペアから、
+NewSearchLast は最後のペアから始める。NewSearchPrefix は接頭辞を持つ最初のキーから始め、
+接頭辞を持たないキーに達したら Next が nil を返す。NewSearchLast はいちばん右の子を辿って降り、
+削除で空になったリーフは前に戻って読み飛ばすので、最初の Next が最大のキーを返す。
+
+1つのキーを読むだけなら Get と Contains を使う。イテレータを作らずにリーフまで降り、
+値をコピーしたらピンを外して返す。Contains は値を読まない。重複キーを許す木では
+Get は ErrDuplicatesAllowed を返す（GetAll を使う）。
+GetBatch は複数のキーをソートしてから探し、同じリーフに入るキーは1回の降下でまとめて読む。
+降りるときに区切りキーからリーフの受け持つ範囲の上限を覚えておき、次のキーが上限を
+超えたときだけルートから降り直す。値は渡したキーの順に返し、存在しないキーは nil になる。
+
 # 挿入アルゴリズム
 
-1. 検索と同様にリーフノードを見つける
+1. 検索と同様にリーフノードを見つける。通ったブランチはスタックに積む
 2. リーフにスペースがあれば挿入
 3. スペースがなければ分割（split）:
    - 新しいリーフを作成
    - データを半分ずつ分ける
    - 親ブランチに新しいキーと子ポインタを追加
-4. ブランチも満杯なら再帰的に分割
+4. ブランチも満杯ならスタックを遡りながら分割
 5. ルートが分割されたら新しいルートを作成
 
+分割が伝わるかもしれないので、スタックのブランチは分割が収まるまでピンしておき、
+収まった時点で残りをまとめて外す。操作が終わった後に残るピンはない。
+
+# 削除アルゴリズム
+
+1. 挿入と同様にリーフノードを見つけ、通ったブランチをスタックに積む
+2. リーフからペアを削除
+3. リーフの使用量がページの1/4を下回ったら、同じ親を持つ隣の兄弟と合わせて見る:
+   - 1ページに収まれば左に寄せて右を木から外し（併合）、親から区切りキーを取り除く
+   - 収まらなければ半分ずつに分け直し（再分配）、親の区切りキーを付け替える
+4. 併合で親も小さくなればスタックを遡りながら繰り返す（ブランチは区切りキーを下ろしてつなぐ）
+5. ルートの子が1つになったら、子の中身をルートのページに写す（木が1段低くなる）
+
+木から外したページは buffer.BufferPoolManager.FreePage で空きページに戻し、
+後の分割で再利用する。イテレータがピンしているページは解放せずに残し、
+NodeFlagRemoved の印でイテレータに降り直させる。ルートのページIDは変わらない。
+
+# ルートのキャッシュ
+
+BTree はメタページから読んだルートページIDと設定を覚えておき、次の操作では
+メタページを読まずにルートから降りる。ルートのノードヘッダーには印（NodeFlagRoot）を
+付け、ルートを分割するときに古いルートから外すので、キャッシュしたページに印がなければ
+メタページを読み直す。同じ木を別の BTree の値から書き換えても古いルートは使わない。
+印のない以前のファイルの木は、ルートが分割されるまで毎回メタページを読む。
+効果は BenchmarkBTreeSearchRootCache で比べられる。
+
+# バルクロード
+
+大量のペアから木を作るときは、1つずつ Insert する代わりに BulkLoad を使う。
+入力はソートされていなくてよい。並列にソートしてからキーの範囲ごとにリーフを
+並列に詰め、その上にブランチを積んで1つのルートにまとめる：
+
+	pairs := []btree.Pair{
+	    {Key: []byte("b"), Value: []byte("2")},
+	    {Key: []byte("a"), Value: []byte("1")},
+	}
+	tree, err := btree.BulkLoadWithOptions(bufmgr, pairs, btree.BulkLoadOptions{Workers: 4})
+
+FillFactor を指定しなければリーフとブランチは満杯まで詰めるので、読み込んだ後に挿入するとすぐに分割が起きる。
+
+メモリに収まらない入力は BulkLoadFrom に PairSource で1つずつ渡す。
+RunSize バイト（既定は64MiB）ごとにソートしたランを TempDir の一時ファイルに書き出し、
+最後に全てのランを併合しながらリーフを詰めるので、メモリに持つのは1つのランだけになる。
+一時ファイルは成功しても失敗しても削除する：
+
+	tree, err := btree.BulkLoadFrom(bufmgr, func() (*btree.Pair, error) {
+	    if !rows.Next() {
+	        return nil, rows.Err()
+	    }
+	    return &btree.Pair{Key: rows.Key(), Value: rows.Value()}, nil
+	}, btree.BulkLoadOptions{RunSize: 16 << 20, TempDir: dir})
+
+# 作り直し
+
+削除を繰り返すと、併合されない程度に中身の減ったページが木に散らばる。
+Rebuild は残っているペアを全て読み込み、古いページを空きページに戻してから
+バルクロードと同じ手順で詰め直す。新しいページは空きページのうちIDの小さいものから
+使われるので、使うページがファイルの先頭に寄る。メタページのIDは変わらない。
+古いルートのページはルートの印を外して残し、空きページには戻さない
+（別の BTree の値がキャッシュしていても、別の木のルートと取り違えないように）：
+
+	err := tree.Rebuild(bufmgr)
+
+RebuildWithOptions では FillFactor でページをどこまで詰めるかを決められる
+（BulkLoadOptions.FillFactor も同じ）。Online を有効にすると、古い木を残したまま
+新しいページに組み立て、メタページのルートを付け替えてから古いページを解放する。
+
+Truncate は空のリーフをルートに付け替えてから、それまでのページを空きページに戻し、
+全てのペアを消す。メタページのIDと NextSequence の連番はそのまま残る。
+
+# 先読み
+
+イテレータはNextPageIDを辿って続けて次のリーフに進むとシーケンシャルスキャンと判断し、
+その先のリーフをバッファプールに先読みする。先読みが役に立つたびに深さを倍にし、
+先読みしたページが使う前に追い出された場合は深さを半分に戻す。
+Searchで位置決めして数件読むだけのランダムアクセスでは先読みしない。
+
+全件を読むと分かっているスキャンでは、Iter.SetReadAhead で深さを固定できる。
+深さが正なら BufferPoolManager.PrefetchChain で別の goroutine がリーフの
+NextPageID を辿って読み込むので、ディスクを待たずに今のリーフの処理を続けられる。
+負の深さを指定すると先読みしない。table.ScanOptions.ReadAhead も同じ設定になる：
+
+	iter, _ := tree.Search(bufmgr, btree.NewSearchStart())
+	iter.SetReadAhead(bufmgr, 8)
+	defer iter.Close(bufmgr) // 先読みの goroutine も止まる
+
+# キーだけのスキャン
+
+存在確認やキーだけで済むスキャンでは Iter.SetKeysOnly を使う。Next はキーだけを返し
+（Value は nil）、値のコピーもオーバーフローページの読み込みもしない。
+次の Next まで返したペアの位置に留まるので、必要なペアだけ Iter.Value で値を読める：
+
+	iter, _ := tree.Search(bufmgr, btree.NewSearchStart())
+	defer iter.Close(bufmgr)
+	iter.SetKeysOnly(true)
+	for {
+	    pair, _ := iter.Next(bufmgr)
+	    if pair == nil {
+	        break
+	    }
+	    if wanted(pair.Key) {
+	        value, _ := iter.Value(bufmgr)
+	        use(pair.Key, value)
+	    }
+	}
+
+# コピーしない読み出し
+
+PairAt はキーと値をコピーして返す。Leaf.KeyAt / Leaf.ValueAt はページの中を指す
+スライスをそのまま返すので、割り当てが起きない。接頭辞圧縮したリーフの KeyAt は
+接頭辞を除いた部分で、ValueAt はオーバーフローページや差分符号化した値には false を返す。
+スライスはバッファのピンを外すかリーフを書き換えるまでしか使えないので、
+残しておくならコピーすること。SearchSlotID は接頭辞を先に1回だけ比べ、
+二分探索では KeyAt で比べるのでペアをコピーしない。
+
+# 整合性チェック
+
+Check は木全体を辿り、キーの順序・区切りキーと子の範囲・リーフの深さ・
+リーフの双方向リンク・リンクで辿ったリーフの数・ページの重複参照・
+スロットが指すペアの位置と長さ（データ領域に収まり、重ならないこと）を確認する。
+分割のバグを追うときに、挿入のたびに呼ぶと壊れた瞬間を見つけやすい。
+
+	if err := btree.Check(bufmgr, tree); err != nil {
+	    // errors.Is(err, btree.ErrCorrupted)
+	    log.Print(err) // page 12: next is none, expected 15
+	}
+
+# 厳格モード
+
+SetStrict(true) にすると、全ての操作がノードを読むたび・書き換えるたびに
+そのページ単体をCheckと同じ規則で確認する（ノードの種類・スロットとデータ領域の範囲・
+ページ内のキーの順序）。壊れていればその操作が *CheckError を返すので、
+ノードの処理を書き換えて試すときに、どの操作がどのページを壊したかがすぐ分かる：
+
+	btree.SetStrict(true)
+	err := tree.Insert(bufmgr, key, value)
+	// page 7: key "b" at slot 3 is not greater than "c"
+
+区切りキーとの関係やリーフのリンクなど、複数のページにまたがる確認は Check に任せる。
+全ての操作が遅くなるので、学習やテストのときだけ使う。
+
+# 統計
+
+Stats は木の高さ・リーフとブランチのページ数・ペア数・最小と最大のキー、
+段ごとのページ数と充填率を返す。分割が続いて半分空のページが増えていないか、
+データファイルの容量がどう使われているかを確認するのに使う。
+
+	stats, _ := btree.Stats(bufmgr, tree)
+	fmt.Println(stats)
+	// height=2 leaves=3 branches=1 pairs=500 min="key00000" max="key00499"
+	// level 0: pages=1 entries=2 fill=1.3%
+	// level 1: pages=3 entries=500 fill=57.7%
+
+Dump は木を段ごとに1ノード1行で書き出し、DumpDOT は同じ内容を Graphviz の
+DOT 形式で書き出す。分割のバグを追うときは、挿入の前後で Dump を比べると分かりやすい：
+
+	btree.Dump(bufmgr, tree, os.Stdout)
+	btree.DumpDOT(bufmgr, tree, f) // dot -Tsvg tree.dot -o tree.svg
+
+Stats は木全体を読むので、件数を安く知りたいときは ApproxCount と ApproxRangeCount を使う。
+ApproxCount はルートから子をランダムに選んでリーフまで32回降り、通ったブランチの子の数の積と
+リーフのペア数から件数を見積もる。ApproxRangeCount は範囲の両端を探して木の中の位置の割合を求め、
+その差に ApproxCount を掛ける。両端が同じリーフに入れば正確な数を返す。
+PageCount はブランチだけを読み、最下段のブランチの子の数からリーフの数を数えてページ数を返す。
+
+# 再開トークン
+
+Iter.Token はイテレータの位置（最後に返したキー）を不透明なバイト列にする。
+Resume にトークンを渡すと、イテレータを閉じた後でも続きからスキャンできる。
+ページやスロットではなくキーを覚えるので、間に挿入・削除・分割があっても
+最後に返したキーより後のエントリから再開する：
+
+	token := iter.Token()
+	iter.Close(bufmgr)
+	// ... 後で
+	iter, err := tree.Resume(bufmgr, token)
+
+接頭辞検索のトークンは接頭辞も覚えているので、再開した後も同じ接頭辞で止まる。
+形式が壊れたトークンには ErrInvalidToken を返す。
+
+# 走査中の書き込み
+
+イテレータはリーフのスロット番号で位置を覚えているので、Next と Next の間に同じリーフへ
+挿入・削除・分割があるとスロットがずれる。Next は毎回、手前のキーが最後に返したキーで、
+次のキーがまだ返していないキーかを確かめ（リーフの先頭なら prev リンクが変わっていないかを
+確かめ）、ずれていれば最後に返したキーから木を降り直す。キーの比較はリーフの中で行うので、
+書き込みがなければ降り直しもコピーも起きない。
+
+これで走査の間ずっと残っていたキーは、昇順にちょうど1回ずつ返る。走査中に挿入・削除した
+キーは返ることも返らないこともある。木にはラッチがないので、読み書きを別の goroutine から
+同時に行ってはならない（minidb.DB やサーバーは操作を1つずつ順に行う）。
+
+# カーソル
+
+Iter は前にしか進めない。前後に移動したいときは Cursor を使う。First・Last・Seek で
+位置を決め、Next・Prev で1つずつ移動し、Current で今の位置のペアを読み直す。
+リーフの prev/next をどちらの向きにも辿り、削除で空になったリーフは読み飛ばす。
+木の端を越えると位置を失い nil を返す：
+
+	c := tree.Cursor()
+	defer c.Close(bufmgr)
+	pair, _ := c.Seek(bufmgr, []byte("key5"))
+	prev, _ := c.Prev(bufmgr) // key5 の直前のペア
+
+カーソルは今いるリーフのピンを1つだけ持つ。Iter と違って位置を確かめ直さないので、
+書き込みの後は Seek で位置を決め直す。
+
+# キャンセル
+
+SearchContext・InsertContext・DeleteContext・Iter.NextContext は context.Context を受け取り、
+キャンセルされていれば ctx.Err() を返す。挿入はリーフの分割を始めた後は木を壊さないよう
+キャンセルを無視して最後まで行う。ctx を受け取らない版は context.Background() を使う。
+
 # 使用例
 
 	// B-treeを作成
@@ -83,6 +409,7 @@ Meta（メタページ）:
 
 	// 検索（イテレータを取得）
 	iter, _ := tree.Search(bufmgr, btree.NewSearchKey([]byte("key1")))
+	defer iter.Close(bufmgr) // 途中で打ち切ってもリーフのピンが外れるように
 	for {
 	    pair, _ := iter.Next(bufmgr)
 	    if pair == nil {
@@ -93,5 +420,22 @@ Meta（メタページ）:
 
 	// 範囲検索（先頭から）
 	iter, _ = tree.Search(bufmgr, btree.NewSearchStart())
+
+	// Go 1.23 以降なら range で回せる（途中で抜けてもピンは外れる）
+	// 読み込みに失敗するとループが終わるので、後で Err を確かめる
+	for key, value := range iter.All(bufmgr) {
+	    fmt.Printf("%s: %s\n", key, value)
+	}
+	if err := iter.Err(); err != nil {
+	    log.Fatal(err)
+	}
+
+	// 値が一致する場合のみ置き換える
+	swapped, _ := tree.CompareAndSwap(bufmgr, []byte("key1"), []byte("value1"), []byte("new"))
+
+	// 読み込み→変更→書き込みを1回で行う（キーがなければ old は nil）
+	tree.Merge(bufmgr, []byte("counter"), func(old []byte) []byte {
+	    return increment(old)
+	})
 */
 package btree
@@ -0,0 +1,102 @@
+package btree
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// Dump は木の構造を段ごとに書き出す
+// 各ノードのページID・種類・エントリ数・キーの範囲を1行ずつ出力する
+//
+//	level 0:
+//	  page 2 branch keys=3 ["key00120" .. "key00360"]
+//	level 1:
+//	  page 3 leaf pairs=120 ["key00000" .. "key00119"] next=1
+//	  ...
+func Dump(bufmgr *buffer.BufferPoolManager, tree *BTree, w io.Writer) error {
+	lastLevel := -1
+	return walkLevels(bufmgr, tree, func(n *nodeInfo) error {
+		if n.level != lastLevel {
+			lastLevel = n.level
+			if _, err := fmt.Fprintf(w, "level %d:\n", n.level); err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "  %s\n", describeNode(n))
+		return err
+	})
+}
+
+// DumpDOT は木の構造を Graphviz の DOT 形式で書き出す
+// 親子の辺を実線、リーフの next を破線で描く
+//
+//	DumpDOT(bufmgr, tree, f)
+//	// $ dot -Tsvg tree.dot -o tree.svg
+func DumpDOT(bufmgr *buffer.BufferPoolManager, tree *BTree, w io.Writer) error {
+	if _, err := fmt.Fprintln(w, "digraph btree {\n  node [shape=box, fontname=monospace];"); err != nil {
+		return err
+	}
+
+	var sameRank [][]string
+	err := walkLevels(bufmgr, tree, func(n *nodeInfo) error {
+		if n.level == len(sameRank) {
+			sameRank = append(sameRank, nil)
+		}
+		name := fmt.Sprintf("p%d", n.pageID)
+		sameRank[n.level] = append(sameRank[n.level], name)
+
+		if _, err := fmt.Fprintf(w, "  %s [label=%q];\n", name, describeNode(n)); err != nil {
+			return err
+		}
+		for _, child := range n.children {
+			if _, err := fmt.Fprintf(w, "  %s -> p%d;\n", name, child); err != nil {
+				return err
+			}
+		}
+		if n.next != nil {
+			if _, err := fmt.Fprintf(w, "  %s -> p%d [style=dashed, constraint=false];\n", name, *n.next); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// 同じ段のノードを横一列に並べる
+	for _, names := range sameRank {
+		if _, err := fmt.Fprint(w, "  { rank=same;"); err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err := fmt.Fprintf(w, " %s;", name); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w, " }"); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintln(w, "}")
+	return err
+}
+
+// describeNode はノードの要約を1行にする
+func describeNode(n *nodeInfo) string {
+	var s string
+	if n.isLeaf {
+		s = fmt.Sprintf("page %d leaf pairs=%d", n.pageID, n.numEntries)
+	} else {
+		s = fmt.Sprintf("page %d branch keys=%d", n.pageID, n.numEntries)
+	}
+	if n.numEntries > 0 {
+		s += fmt.Sprintf(" [%q .. %q]", n.firstKey, n.lastKey)
+	}
+	if n.next != nil {
+		s += fmt.Sprintf(" next=%d", *n.next)
+	}
+	return s
+}
@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// エラー定義
+var (
+	ErrDuplicatesAllowed = errors.New("operation not supported on a tree that allows duplicate keys")
+)
+
+// 重複キーを許す木では、キーをエスケープして終端を付け、その後ろに挿入順の連番を付けて格納する:
+//
+//	[escaped key] [0x00 0x01] [sequence: 8 (big endian)]
+//
+// キーの中の 0x00 は 0x00 0xFF に置き換える。終端の 0x00 0x01 は置き換えた 0x00 0xFF より
+// 小さいので、格納したキーのバイト順は元のキーの順と一致し、同じキーの中では挿入順に並ぶ。
+// 例えば "a" と "ab" は "a\x00\x01..." < "ab\x00\x01..." になる
+
+const duplicateSequenceSize = 8
+
+// duplicatePrefix はキーをエスケープして終端を付ける
+// 同じキーのエントリは全てこの接頭辞で始まる
+func duplicatePrefix(key []byte) []byte {
+	return append(escapeDuplicateKey(key), 0x00, 0x01)
+}
+
+// escapeDuplicateKey はキーの中の 0x00 を 0x00 0xFF に置き換える
+func escapeDuplicateKey(key []byte) []byte {
+	escaped := make([]byte, 0, len(key)+2+duplicateSequenceSize)
+	for _, b := range key {
+		if b == 0x00 {
+			escaped = append(escaped, 0x00, 0xFF)
+		} else {
+			escaped = append(escaped, b)
+		}
+	}
+	return escaped
+}
+
+// duplicatePrefixEnd はキーのどのエントリよりも大きく、次に大きいキーのエントリ以下になる
+// 最小のバイト列を返す（終端の 0x00 0x01 を 0x00 0x02 にしたもの）
+func duplicatePrefixEnd(key []byte) []byte {
+	end := duplicatePrefix(key)
+	end[len(end)-1]++
+	return end
+}
+
+// encodeDuplicateKey は格納するキーを作る
+func encodeDuplicateKey(key []byte, seq uint64) []byte {
+	return binary.BigEndian.AppendUint64(duplicatePrefix(key), seq)
+}
+
+// decodeDuplicateKey は格納したキーから元のキーを取り出す
+func decodeDuplicateKey(stored []byte) []byte {
+	escaped := stored[:len(stored)-duplicateSequenceSize-2]
+	key := make([]byte, 0, len(escaped))
+	for i := 0; i < len(escaped); i++ {
+		key = append(key, escaped[i])
+		if escaped[i] == 0x00 {
+			i++ // 0x00 0xFF の 0xFF を読み飛ばす
+		}
+	}
+	return key
+}
+
+// readMeta はメタページのヘッダーを読む
+func (t *BTree) readMeta(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*MetaHeader, error) {
+	metaBuffer, err := bufmgr.FetchPageContext(ctx, t.MetaPageID)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(metaBuffer)
+	header := *NewMeta(metaBuffer.Page[:]).Header
+	return &header, nil
+}
+
+// AllowsDuplicates は木が同じキーのエントリを複数持てるかを返す
+func (t *BTree) AllowsDuplicates(bufmgr *buffer.BufferPoolManager) (bool, error) {
+	flags, err := t.flags(context.Background(), bufmgr)
+	if err != nil {
+		return false, err
+	}
+	return flags&MetaFlagDuplicates != 0, nil
+}
+
+// duplicateKey は次の連番を払い出して、格納するキーを作る
+func (t *BTree) duplicateKey(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) ([]byte, error) {
+	metaBuffer, err := bufmgr.FetchPageContext(ctx, t.MetaPageID)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(metaBuffer)
+
+	meta := NewMeta(metaBuffer.Page[:])
+	seq := meta.Header.NextSequence
+	meta.Header.NextSequence++
+	meta.Sync()
+	metaBuffer.IsDirty = true
+	return encodeDuplicateKey(key, seq), nil
+}
+
+// GetAll はキーに一致する全てのエントリの値を返す
+// 重複キーを許す木では挿入順に、そうでない木では高々1つの値を返す。
+// 一致するエントリがなければ空のスライスを返す
+func (t *BTree) GetAll(bufmgr *buffer.BufferPoolManager, key []byte) ([][]byte, error) {
+	return t.GetAllContext(context.Background(), bufmgr, key)
+}
+
+// GetAllContext は GetAll と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) GetAllContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) ([][]byte, error) {
+	iter, err := t.SearchContext(ctx, bufmgr, NewSearchKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(bufmgr)
+
+	values := [][]byte{}
+	for {
+		pair, err := iter.NextContext(ctx, bufmgr)
+		if err != nil {
+			return nil, err
+		}
+		if pair == nil || !bytes.Equal(pair.Key, key) {
+			return values, nil
+		}
+		values = append(values, pair.Value)
+	}
+}
+
+// deleteDuplicates はキーに一致する全てのエントリを削除する
+// 一致するエントリがなければ ErrKeyNotFound を返す
+func (t *BTree) deleteDuplicates(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte, secure bool) error {
+	prefix := duplicatePrefix(key)
+
+	// 削除しながら辿るとスロットがずれるので、先に格納したキーを集める
+	rootBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	iter, err := t.searchInternal(ctx, bufmgr, rootBuffer, NewSearchKey(prefix))
+	if err != nil {
+		return err
+	}
+	var storedKeys [][]byte
+	for {
+		pair := iter.get()
+		if pair == nil || !bytes.HasPrefix(pair.Key, prefix) {
+			break
+		}
+		storedKeys = append(storedKeys, bytes.Clone(pair.Key))
+		if err := iter.advance(ctx, bufmgr); err != nil {
+			iter.Close(bufmgr)
+			return err
+		}
+	}
+	iter.Close(bufmgr)
+
+	if len(storedKeys) == 0 {
+		return ErrKeyNotFound
+	}
+	for _, stored := range storedKeys {
+		if err := t.deleteKey(ctx, bufmgr, stored, secure); err != nil {
+			return err
+		}
+	}
+	return nil
+}
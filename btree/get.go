@@ -0,0 +1,173 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"slices"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// Get はキーに対応する値を返す。キーがなければ ErrKeyNotFound を返す
+// イテレータを作らずにルートからリーフまで降り、値をコピーしたらリーフのピンを外す。
+// 大きな値はリーフのピンを外してからオーバーフローページを読む
+// 重複キーを許す木では値が1つに決まらないので ErrDuplicatesAllowed を返す（GetAll を使う）
+func (t *BTree) Get(bufmgr *buffer.BufferPoolManager, key []byte) ([]byte, error) {
+	return t.GetContext(context.Background(), bufmgr, key)
+}
+
+// GetContext は Get と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) GetContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) ([]byte, error) {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	if flags&MetaFlagDuplicates != 0 {
+		return nil, ErrDuplicatesAllowed
+	}
+	leafBuffer, err := t.findLeaf(ctx, bufmgr, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	slotID, found := leaf.SearchSlotID(key)
+	if !found {
+		bufmgr.UnpinPage(leafBuffer)
+		return nil, ErrKeyNotFound
+	}
+	pair := leaf.PairAt(slotID)
+	bufmgr.UnpinPage(leafBuffer)
+	return loadValue(ctx, bufmgr, pair)
+}
+
+// Contains はキーが存在するかを返す。値は読まない
+// 重複キーを許す木では、キーに一致するエントリが1つでもあれば true を返す
+func (t *BTree) Contains(bufmgr *buffer.BufferPoolManager, key []byte) (bool, error) {
+	return t.ContainsContext(context.Background(), bufmgr, key)
+}
+
+// ContainsContext は Contains と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) ContainsContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) (bool, error) {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return false, err
+	}
+	if flags&MetaFlagDuplicates == 0 {
+		return t.contains(ctx, bufmgr, key)
+	}
+
+	// 連番付きのキーは接頭辞の後ろのリーフに並ぶので、キーだけのスキャンで最初のエントリを見る
+	iter, err := t.SearchContext(ctx, bufmgr, NewSearchKey(key))
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close(bufmgr)
+	iter.SetKeysOnly(true)
+	pair, err := iter.NextContext(ctx, bufmgr)
+	if err != nil {
+		return false, err
+	}
+	return pair != nil && bytes.Equal(pair.Key, key), nil
+}
+
+// GetBatch は keys のそれぞれに対応する値を、keys と同じ順に返す。存在しないキーの値は nil
+// キーをソートしてから読むので、同じリーフに入るキーはまとめて1回の降下で探す。
+// 点検索が多いときは Get を繰り返すよりページの取得がずっと少ない
+// 重複キーを許す木では ErrDuplicatesAllowed を返す
+func (t *BTree) GetBatch(bufmgr *buffer.BufferPoolManager, keys [][]byte) ([][]byte, error) {
+	return t.GetBatchContext(context.Background(), bufmgr, keys)
+}
+
+// GetBatchContext は GetBatch と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) GetBatchContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, keys [][]byte) ([][]byte, error) {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	if flags&MetaFlagDuplicates != 0 {
+		return nil, ErrDuplicatesAllowed
+	}
+
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return bytes.Compare(keys[a], keys[b]) })
+
+	// リーフを読む間はペアだけを集め、オーバーフローページはリーフのピンを外してから読む
+	pairs := make([]*Pair, len(keys))
+	var leafBuffer *buffer.Buffer
+	var upper []byte
+	for _, i := range order {
+		key := keys[i]
+		// upper は今のリーフが受け持つ範囲の上限（含まない）。nil なら上限がない
+		if leafBuffer != nil && upper != nil && bytes.Compare(key, upper) >= 0 {
+			bufmgr.UnpinPage(leafBuffer)
+			leafBuffer = nil
+		}
+		if leafBuffer == nil {
+			if leafBuffer, upper, err = t.findLeafBounded(ctx, bufmgr, key); err != nil {
+				return nil, err
+			}
+		}
+		leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+		if slotID, found := leaf.SearchSlotID(key); found {
+			pairs[i] = leaf.PairAt(slotID)
+		}
+	}
+	if leafBuffer != nil {
+		bufmgr.UnpinPage(leafBuffer)
+	}
+
+	values := make([][]byte, len(keys))
+	for i, pair := range pairs {
+		if pair == nil {
+			continue
+		}
+		value, err := loadValue(ctx, bufmgr, pair)
+		if err != nil {
+			return nil, err
+		}
+		if value == nil {
+			// 空の値を存在しないキーと区別する
+			value = []byte{}
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// findLeafBounded は findLeaf と同じくキーが入るリーフを返し、
+// 加えてそのリーフが受け持つキーの上限（含まない）を返す。いちばん右のリーフなら nil
+func (t *BTree) findLeafBounded(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) (*buffer.Buffer, []byte, error) {
+	nodeBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var upper []byte
+	for {
+		node := NewNode(nodeBuffer.Page[:])
+		switch node.Header.NodeType {
+		case NodeTypeLeaf:
+			return nodeBuffer, upper, nil
+		case NodeTypeBranch:
+			branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+			idx := branch.SearchChildIdx(key)
+			// 下の階層の区切りキーほど範囲が狭いので、見つかったら置き換える
+			if idx < branch.NumKeys() {
+				upper = bytes.Clone(branch.KeyAt(idx))
+			}
+			childBuffer, err := fetchNode(ctx, bufmgr, branch.ChildAt(idx))
+			bufmgr.UnpinPage(nodeBuffer)
+			if err != nil {
+				return nil, nil, err
+			}
+			nodeBuffer = childBuffer
+		default:
+			bufmgr.UnpinPage(nodeBuffer)
+			return nil, nil, errors.New("invalid node type")
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// SetKeysOnly はこのイテレータの Next がキーだけを返すようにする
+// 返す Pair の Value は nil で、値のコピーもオーバーフローページの読み込みもしない。
+// 存在確認やキーだけで済むスキャンで使う。値が必要になったペアだけ Value で読める
+//
+// キーだけを返す間は、Next の後も次の Next まで返したペアの位置に留まる
+func (it *Iter) SetKeysOnly(keysOnly bool) {
+	it.keysOnly = keysOnly
+}
+
+// nextKey は現在位置のキーだけを返し、その位置に留まる
+// 終端に達したら nil を返してリーフのピンを外す
+func (it *Iter) nextKey(bufmgr *buffer.BufferPoolManager) *Pair {
+	if it.buffer == nil {
+		return nil
+	}
+	leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
+	if it.slotID >= leaf.NumPairs() || !it.inPrefix(leaf) {
+		it.Close(bufmgr)
+		return nil
+	}
+	key := leaf.keyAt(it.slotID)
+	it.position = resumePosition{mode: resumeAfter, key: key}
+	it.pending = true
+	if it.duplicates {
+		key = decodeDuplicateKey(key)
+	}
+	return &Pair{Key: key}
+}
+
+// Value は SetKeysOnly で値を省いたスキャンで、直前の Next が返したペアの値を読む
+// 直前の Next がキーを返していなければ nil を返す
+func (it *Iter) Value(bufmgr *buffer.BufferPoolManager) ([]byte, error) {
+	return it.ValueContext(context.Background(), bufmgr)
+}
+
+// ValueContext は Value と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (it *Iter) ValueContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := it.revalidate(ctx, bufmgr); err != nil {
+		return nil, err
+	}
+	if !it.pending || it.buffer == nil {
+		return nil, nil
+	}
+	pair := NewLeaf(it.buffer.Page[NodeHeaderSize:]).PairAt(it.slotID)
+	return loadValue(ctx, bufmgr, pair)
+}
@@ -2,23 +2,51 @@ package btree
 
 import (
 	"bytes"
+	"fmt"
 
 	"github.com/kkumaki12/minidb/disk"
 )
 
 // Leafヘッダーのレイアウト:
-// [prev_page_id: 8] [next_page_id: 8] [num_pairs: 2] [free_space_offset: 2]
+// [prev_page_id: 8] [next_page_id: 8] [format: 4bit | num_pairs: 12bit] [free_space_offset: 2]
+// [prefix_len: 2]（LeafFormatPrefix と LeafFormatDelta）[base_len: 2]（LeafFormatDelta のみ）
 // その後にスロット配列（各2バイト）が続き、ページ末尾からデータが詰められる
+//
+// LeafFormatPrefix のリーフは、全てのキーに共通する接頭辞をページ末尾に1回だけ置き、
+// 各ペアには接頭辞を除いたキーの残りだけを格納する:
+// [header] [slots...] [空き領域] [pairs...] [prefix]
+//
+// LeafFormatDelta のリーフは、さらに基準値を接頭辞の手前に1回だけ置き、各ペアの値を
+// 基準値との差分として格納する（オーバーフローページへの参照はそのまま格納する）:
+// [header] [slots...] [空き領域] [pairs...] [base] [prefix]
+// 差分のフォーマット: [head: 2] [tail: 2] [middle]
+// 値は base[:head] + middle + base[len(base)-tail:] になる
 
 const (
 	LeafPrevPageIDOffset      = 0
 	LeafNextPageIDOffset      = 8
 	LeafNumPairsOffset        = 16
 	LeafFreeSpaceOffsetOffset = 18
+	LeafPrefixLenOffset       = 20
 	LeafHeaderSize            = 20
+	LeafPrefixHeaderSize      = 22
+	LeafBaseLenOffset         = 22
+	LeafDeltaHeaderSize       = 24
 	LeafSlotSize              = 2 // 各スロットはオフセット値（2バイト）
 )
 
+// リーフのフォーマット
+// num_pairs の上位4ビットに格納する。ペア数は1ページに4096個を超えないので、
+// 以前のファイルではこのビットは常に0になっている
+const (
+	LeafFormatPlain  = 0 // 接頭辞圧縮なし（以前のフォーマット）
+	LeafFormatPrefix = 1 // 共通接頭辞をページに1回だけ持つ
+	LeafFormatDelta  = 2 // 共通接頭辞に加えて、値を基準値との差分で持つ
+
+	leafFormatShift  = 12
+	leafNumPairsMask = 1<<leafFormatShift - 1
+)
+
 // InvalidPageID は無効なページIDを示す
 const InvalidPageID = disk.PageID(0xFFFFFFFFFFFFFFFF)
 
@@ -33,11 +61,71 @@ func NewLeaf(data []byte) *Leaf {
 }
 
 // Initialize はリーフノードを初期化する
+// 新しく初期化したリーフは常に LeafFormatPrefix になる
 func (l *Leaf) Initialize() {
+	l.initialize(nil)
+}
+
+// initialize は接頭辞 prefix を持つ空のリーフとして初期化する
+func (l *Leaf) initialize(prefix []byte) {
 	l.setPrevPageID(InvalidPageID)
 	l.setNextPageID(InvalidPageID)
-	l.setNumPairs(0)
-	l.setFreeSpaceOffset(uint16(len(l.data)))
+	writeUint16(l.data[LeafNumPairsOffset:], LeafFormatPrefix<<leafFormatShift)
+	writeUint16(l.data[LeafPrefixLenOffset:], uint16(len(prefix)))
+	end := len(l.data) - len(prefix)
+	copy(l.data[end:], prefix)
+	l.setFreeSpaceOffset(uint16(end))
+}
+
+// initializeDelta は接頭辞 prefix と基準値 base を持つ空の LeafFormatDelta のリーフとして初期化する
+func (l *Leaf) initializeDelta(prefix, base []byte) {
+	l.initialize(prefix)
+	writeUint16(l.data[LeafNumPairsOffset:], LeafFormatDelta<<leafFormatShift)
+	writeUint16(l.data[LeafBaseLenOffset:], uint16(len(base)))
+	end := len(l.data) - len(prefix) - len(base)
+	copy(l.data[end:], base)
+	l.setFreeSpaceOffset(uint16(end))
+}
+
+// Format はリーフのフォーマット（LeafFormatPlain・LeafFormatPrefix・LeafFormatDelta のいずれか）を返す
+func (l *Leaf) Format() int {
+	return int(readUint16(l.data[LeafNumPairsOffset:]) >> leafFormatShift)
+}
+
+// Prefix は全てのキーに共通する接頭辞を返す
+// LeafFormatPlain のリーフでは常に空になる
+func (l *Leaf) Prefix() []byte {
+	if l.Format() == LeafFormatPlain {
+		return nil
+	}
+	n := int(readUint16(l.data[LeafPrefixLenOffset:]))
+	return l.data[len(l.data)-n:]
+}
+
+// Base は値の差分の基準値を返す
+// LeafFormatDelta 以外のリーフでは常に空になる
+func (l *Leaf) Base() []byte {
+	if l.Format() != LeafFormatDelta {
+		return nil
+	}
+	end := len(l.data) - len(l.Prefix())
+	return l.data[end-int(readUint16(l.data[LeafBaseLenOffset:])) : end]
+}
+
+// headerSize はフォーマットに応じたヘッダーのサイズを返す
+func (l *Leaf) headerSize() int {
+	switch l.Format() {
+	case LeafFormatPrefix:
+		return LeafPrefixHeaderSize
+	case LeafFormatDelta:
+		return LeafDeltaHeaderSize
+	}
+	return LeafHeaderSize
+}
+
+// dataEnd はペアを詰めるデータ領域の終わり（基準値と接頭辞の手前）を返す
+func (l *Leaf) dataEnd() int {
+	return len(l.data) - len(l.Prefix()) - len(l.Base())
 }
 
 // PrevPageID は前のリーフページIDを返す
@@ -86,11 +174,12 @@ func (l *Leaf) SetNextPageID(id *disk.PageID) {
 
 // NumPairs はペアの数を返す
 func (l *Leaf) NumPairs() int {
-	return int(readUint16(l.data[LeafNumPairsOffset:]))
+	return int(readUint16(l.data[LeafNumPairsOffset:]) & leafNumPairsMask)
 }
 
 func (l *Leaf) setNumPairs(n uint16) {
-	writeUint16(l.data[LeafNumPairsOffset:], n)
+	format := readUint16(l.data[LeafNumPairsOffset:]) &^ leafNumPairsMask
+	writeUint16(l.data[LeafNumPairsOffset:], format|n)
 }
 
 func (l *Leaf) freeSpaceOffset() uint16 {
@@ -103,7 +192,7 @@ func (l *Leaf) setFreeSpaceOffset(offset uint16) {
 
 // slotOffset はスロット配列の開始位置を返す
 func (l *Leaf) slotOffset(slotID int) int {
-	return LeafHeaderSize + slotID*LeafSlotSize
+	return l.headerSize() + slotID*LeafSlotSize
 }
 
 // getSlot は指定スロットのデータオフセットを返す
@@ -123,20 +212,92 @@ func (l *Leaf) freeSpace() int {
 }
 
 // PairAt は指定スロットのペアを返す
+// キーには接頭辞を補った完全なキーが、値には差分を戻した値が入る
 func (l *Leaf) PairAt(slotID int) *Pair {
 	offset := l.getSlot(slotID)
-	return PairFromBytes(l.data[offset:])
+	pair := PairFromBytes(l.data[offset:])
+	if prefix := l.Prefix(); len(prefix) > 0 {
+		pair.Key = append(append(make([]byte, 0, len(prefix)+len(pair.Key)), prefix...), pair.Key...)
+	}
+	if l.Format() == LeafFormatDelta && !pair.overflow {
+		pair.Value = decodeDelta(l.Base(), pair.Value)
+	}
+	return pair
+}
+
+// KeyAt は指定スロットのキーを、ページの中を指すスライスで返す（コピーしない）
+// 接頭辞圧縮したリーフでは接頭辞を除いた部分なので、完全なキーは Prefix() に続けたものになる
+//
+// スライスはバッファのピンを外すか、リーフを書き換えるまでしか使えない。
+// それより後まで残すならコピーするか、PairAt を使う
+func (l *Leaf) KeyAt(slotID int) []byte {
+	data := l.data[l.getSlot(slotID):]
+	keyLen := int(readUint16(data[0:2]))
+	return data[4 : 4+keyLen : 4+keyLen]
+}
+
+// ValueAt は指定スロットの値を、ページの中を指すスライスで返す（コピーしない）
+// 値がリーフにそのままの形で入っていない（オーバーフローページに置いている、
+// 差分符号化している）場合は false を返す。その値は Iter で読む
+// スライスを使える期間は KeyAt と同じ
+func (l *Leaf) ValueAt(slotID int) ([]byte, bool) {
+	data := l.data[l.getSlot(slotID):]
+	keyLen := int(readUint16(data[0:2]))
+	rawValueLen := readUint16(data[2:4])
+	if rawValueLen&pairOverflowFlag != 0 || l.Format() == LeafFormatDelta {
+		return nil, false
+	}
+	start := 4 + keyLen
+	end := start + int(rawValueLen)
+	return data[start:end:end], true
+}
+
+// keyAt は指定スロットの完全なキーをコピーして返す
+// PairAt と違って値はコピーもデコードもしない
+func (l *Leaf) keyAt(slotID int) []byte {
+	prefix, key := l.Prefix(), l.KeyAt(slotID)
+	return append(append(make([]byte, 0, len(prefix)+len(key)), prefix...), key...)
+}
+
+// storedValue はペアの値をこのリーフに格納する形にする
+func (l *Leaf) storedValue(pair *Pair) []byte {
+	if l.Format() == LeafFormatDelta && !pair.overflow {
+		return encodeDelta(l.Base(), pair.Value)
+	}
+	return pair.Value
+}
+
+// storedValueLen は指定スロットに格納されている値（差分）のバイト数を返す
+func (l *Leaf) storedValueLen(slotID int) int {
+	return int(readUint16(l.data[l.getSlot(slotID)+2:]) &^ pairOverflowFlag)
+}
+
+// storedPairSize は指定オフセットに格納されているペアのバイト数を返す
+func (l *Leaf) storedPairSize(offset uint16) int {
+	keyLen := int(readUint16(l.data[offset:]))
+	valueLen := int(readUint16(l.data[offset+2:]) &^ pairOverflowFlag)
+	return PairSize(keyLen, valueLen)
 }
 
 // SearchSlotID はキーを検索してスロットIDを返す
 // 見つかった場合は (slotID, true)、見つからない場合は (挿入位置, false)
 func (l *Leaf) SearchSlotID(key []byte) (int, bool) {
+	// 全てのキーに共通する接頭辞は先に1回だけ比べ、残りはページの中のまま比べる
+	prefix := l.Prefix()
+	n := min(len(prefix), len(key))
+	switch cmp := bytes.Compare(key[:n], prefix[:n]); {
+	case cmp < 0 || (cmp == 0 && len(key) < len(prefix)):
+		return 0, false
+	case cmp > 0:
+		return l.NumPairs(), false
+	}
+	suffix := key[len(prefix):]
+
 	// 二分探索
 	lo, hi := 0, l.NumPairs()
 	for lo < hi {
 		mid := (lo + hi) / 2
-		pair := l.PairAt(mid)
-		cmp := bytes.Compare(pair.Key, key)
+		cmp := bytes.Compare(l.KeyAt(mid), suffix)
 		if cmp < 0 {
 			lo = mid + 1
 		} else if cmp > 0 {
@@ -150,8 +311,28 @@ func (l *Leaf) SearchSlotID(key []byte) (int, bool) {
 
 // Insert はキーと値を挿入する
 // 成功したらtrue、スペース不足ならfalseを返す
+// キーが現在の接頭辞で始まらない場合は、接頭辞を短くしてリーフを組み直す
 func (l *Leaf) Insert(slotID int, key, value []byte) bool {
-	pairBytes := (&Pair{Key: key, Value: value}).ToBytes()
+	return l.insertPair(slotID, &Pair{Key: key, Value: value})
+}
+
+// insertPair は Insert と同じだが、オーバーフローページへの参照もそのまま格納する
+func (l *Leaf) insertPair(slotID int, pair *Pair) bool {
+	if l.Format() == LeafFormatDelta && l.NumPairs() == 0 && len(l.Base()) == 0 && !pair.overflow {
+		// 空のリーフでは最初の値を基準値にする
+		l.reset(LeafFormatDelta, l.Prefix(), pair.Value, nil)
+	}
+	key := pair.Key
+	value := l.storedValue(pair)
+	prefix := l.Prefix()
+	if !bytes.HasPrefix(key, prefix) {
+		if !l.shrinkPrefix(commonPrefix(prefix, key), PairSize(len(key), len(value))) {
+			return false
+		}
+		prefix = l.Prefix()
+	}
+
+	pairBytes := (&Pair{Key: key[len(prefix):], Value: value, overflow: pair.overflow}).ToBytes()
 	pairLen := len(pairBytes)
 
 	// 空き領域チェック（スロット分 + データ分）
@@ -176,9 +357,41 @@ func (l *Leaf) Insert(slotID int, key, value []byte) bool {
 	return true
 }
 
+// Delete は指定スロットのペアを削除する
+// 削除したデータ領域は詰めて、空き領域に戻す
+func (l *Leaf) Delete(slotID int) {
+	numPairs := l.NumPairs()
+	offset := l.getSlot(slotID)
+	pairLen := uint16(l.storedPairSize(offset))
+
+	// 削除するデータより手前（空き領域側）にあるデータを後ろにずらす
+	freeSpaceOffset := l.freeSpaceOffset()
+	copy(l.data[freeSpaceOffset+pairLen:offset+pairLen], l.data[freeSpaceOffset:offset])
+
+	// スロットを詰めつつ、ずらしたデータのオフセットを補正する
+	for i := slotID; i < numPairs-1; i++ {
+		l.setSlot(i, l.getSlot(i+1))
+	}
+	for i := 0; i < numPairs-1; i++ {
+		if s := l.getSlot(i); s < offset {
+			l.setSlot(i, s+pairLen)
+		}
+	}
+
+	l.setFreeSpaceOffset(freeSpaceOffset + pairLen)
+	l.setNumPairs(uint16(numPairs - 1))
+}
+
 // SplitInsert はリーフを分割して挿入する
 // 新しいリーフにデータの前半を移動し、オーバーフローキーを返す
 func (l *Leaf) SplitInsert(newLeaf *Leaf, key, value []byte) []byte {
+	return l.splitInsertPair(newLeaf, &Pair{Key: key, Value: value}, l.Format() == LeafFormatDelta)
+}
+
+// splitInsertPair は SplitInsert と同じだが、オーバーフローページへの参照もそのまま格納する
+// delta が true なら、分割後のリーフを収まる限り LeafFormatDelta で組み直す
+func (l *Leaf) splitInsertPair(newLeaf *Leaf, newPair *Pair, delta bool) []byte {
+	key := newPair.Key
 	// 全ペアを一時的に取り出す
 	pairs := make([]*Pair, l.NumPairs())
 	for i := 0; i < l.NumPairs(); i++ {
@@ -192,24 +405,192 @@ func (l *Leaf) SplitInsert(newLeaf *Leaf, key, value []byte) []byte {
 	}
 
 	// 新しいペアを挿入
-	newPair := &Pair{Key: key, Value: value}
 	pairs = append(pairs[:insertPos], append([]*Pair{newPair}, pairs[insertPos:]...)...)
 
-	// 分割点（中央）
-	mid := len(pairs) / 2
+	// 今の基準値で差分にすれば、分割前のペアは今と同じ大きさで格納できる
+	// 中央の値を基準値にすると収まらない側では、こちらも試す
+	var base []byte
+	if l.Format() == LeafFormatDelta && len(l.Base()) > 0 {
+		base = append([]byte{}, l.Base()...)
+	}
+	mid := splitPoint(pairs, func(pairs []*Pair) bool {
+		_, _, ok := leafLayout(pairs, delta, base, len(l.data))
+		return ok
+	})
 
 	// 新しいリーフ（前半）を再構築
-	newLeaf.Initialize()
-	for i := 0; i < mid; i++ {
-		newLeaf.Insert(i, pairs[i].Key, pairs[i].Value)
-	}
+	// 分割後はそれぞれの半分で共通接頭辞を取り直す（以前のフォーマットもここで移行される）
+	newLeaf.rebuildWithBase(pairs[:mid], delta, base)
 
 	// 現在のリーフ（後半）を再構築
-	l.Initialize()
-	for i := mid; i < len(pairs); i++ {
-		l.Insert(i-mid, pairs[i].Key, pairs[i].Value)
+	l.rebuildWithBase(pairs[mid:], delta, base)
+
+	// オーバーフローキーを返す
+	// ブランチの不変条件 c0 < k0 <= c1 を満たす範囲で最も短いキーを区切りにする
+	return shortestSeparator(pairs[mid-1].Key, pairs[mid].Key)
+}
+
+// splitPoint は pairs を2つのリーフに分ける位置を返す
+// 格納するバイト数がおよそ半分になる位置から近い順に、両側が fits を満たす位置を探す
+// ペアの数で分けると、小さい値の後ろに大きい値が並んだときに後半が収まらない
+func splitPoint(pairs []*Pair, fits func(pairs []*Pair) bool) int {
+	total := 0
+	for _, p := range pairs {
+		total += PairSize(len(p.Key), len(p.Value))
+	}
+	mid, size := 1, PairSize(len(pairs[0].Key), len(pairs[0].Value))
+	for mid < len(pairs)-1 && size+PairSize(len(pairs[mid].Key), len(pairs[mid].Value))/2 < total/2 {
+		size += PairSize(len(pairs[mid].Key), len(pairs[mid].Value))
+		mid++
+	}
+	for d := 0; d < len(pairs); d++ {
+		for _, m := range []int{mid - d, mid + d} {
+			if m >= 1 && m < len(pairs) && fits(pairs[:m]) && fits(pairs[m:]) {
+				return m
+			}
+		}
+	}
+	// どう分けても収まらなければ、ペアを黙って落とさず panic する
+	panic(fmt.Sprintf("btree: %d pairs cannot be split into two leaves", len(pairs)))
+}
+
+// rebuild はリーフの中身を pairs で置き換える
+// 接頭辞は pairs の共通接頭辞にし、前後のリンクはそのまま残す
+// delta が true なら中央の値を基準値にした LeafFormatDelta にする。ただし差分にすると
+// 1ページに収まらない場合は LeafFormatPrefix にする。どちらでも収まらなければ panic する
+func (l *Leaf) rebuild(pairs []*Pair, delta bool) {
+	l.rebuildWithBase(pairs, delta, nil)
+}
+
+// rebuildWithBase は rebuild と同じだが、中央の値を基準値にすると収まらない場合に base（nil でなければ）も試す
+func (l *Leaf) rebuildWithBase(pairs []*Pair, delta bool, base []byte) {
+	format, base, _ := leafLayout(pairs, delta, base, len(l.data))
+	l.reset(format, pairsPrefix(pairs), base, pairs)
+}
+
+// leafLayout は pairs を capacity バイトのリーフに詰めるときの形式と基準値を返す
+// delta が true なら中央の値、fallback（nil でなければ）の順に基準値を試し、
+// 差分にしても収まらなければ LeafFormatPrefix にする。それでも収まらなければ ok は false
+func leafLayout(pairs []*Pair, delta bool, fallback []byte, capacity int) (format int, base []byte, ok bool) {
+	if delta {
+		prefix := pairsPrefix(pairs)
+		bases := [][]byte{chooseBase(pairs)}
+		if fallback != nil {
+			bases = append(bases, fallback)
+		}
+		for _, base := range bases {
+			if deltaLeafSize(pairs, prefix, base) <= capacity {
+				return LeafFormatDelta, base, true
+			}
+		}
+	}
+	return LeafFormatPrefix, nil, leafSize(pairs) <= capacity
+}
+
+// shrinkPrefix は接頭辞を prefix に短くしてリーフを組み直す
+// 組み直した後に extra バイト（接頭辞を含む）のペアを追加する余地がなければ何もせず false を返す
+func (l *Leaf) shrinkPrefix(prefix []byte, extra int) bool {
+	pairs := make([]*Pair, l.NumPairs())
+	format, base := l.Format(), l.Base()
+	headerSize := LeafPrefixHeaderSize
+	if format == LeafFormatDelta {
+		headerSize = LeafDeltaHeaderSize
+	}
+	// 接頭辞はページ末尾に1回だけ置き、追加するペアはその分短く格納されるので打ち消し合う
+	// 基準値は変えないので、格納済みの値（差分）の大きさも変わらない
+	need := headerSize + len(base) + (len(pairs)+1)*LeafSlotSize + extra
+	for i := range pairs {
+		pairs[i] = l.PairAt(i)
+		need += PairSize(len(pairs[i].Key)-len(prefix), l.storedValueLen(i))
+	}
+	if need > len(l.data) {
+		return false
+	}
+	l.reset(format, prefix, base, pairs)
+	return true
+}
+
+// reset は接頭辞 prefix（LeafFormatDelta なら基準値 base も）でリーフを初期化し直して pairs を詰める
+// pairs のキーは全て prefix で始まっていなければならない。前後のリンクはそのまま残す
+// pairs が収まらなければペアを黙って落とさず panic する
+func (l *Leaf) reset(format int, prefix, base []byte, pairs []*Pair) {
+	// prefix と base はページの一部を指していることがあるので、初期化で上書きする前にコピーする
+	prefix = append([]byte{}, prefix...)
+	base = append([]byte{}, base...)
+	prevPageID, nextPageID := l.PrevPageID(), l.NextPageID()
+	if format == LeafFormatDelta {
+		l.initializeDelta(prefix, base)
+	} else {
+		l.initialize(prefix)
+	}
+	l.SetPrevPageID(prevPageID)
+	l.SetNextPageID(nextPageID)
+	for i, p := range pairs {
+		if !l.insertPair(i, p) {
+			// 呼び出し側は pairs が収まることを確かめてから組み直すので、ここには来ない
+			panic(fmt.Sprintf("btree: %d of %d pairs do not fit in the leaf", len(pairs)-i, len(pairs)))
+		}
 	}
+	// 組み直す前のペアのバイトが空き領域に残らないようにする
+	l.scrubFreeSpace()
+}
+
+// scrubFreeSpace はスロット配列とデータ領域の間の空き領域を0で埋める
+func (l *Leaf) scrubFreeSpace() {
+	clear(l.data[l.slotOffset(l.NumPairs()):l.freeSpaceOffset()])
+}
+
+// chooseBase は pairs の中央付近にあるインラインの値を基準値として返す
+func chooseBase(pairs []*Pair) []byte {
+	for i := len(pairs) / 2; i < len(pairs); i++ {
+		if !pairs[i].overflow {
+			return pairs[i].Value
+		}
+	}
+	for i := len(pairs)/2 - 1; i >= 0; i-- {
+		if !pairs[i].overflow {
+			return pairs[i].Value
+		}
+	}
+	return nil
+}
+
+// encodeDelta は value を base との差分にする
+// 先頭と末尾で base と一致する部分の長さと、残りの中間部分を格納する
+func encodeDelta(base, value []byte) []byte {
+	head := len(commonPrefix(base, value))
+	tail := 0
+	for tail < len(base)-head && tail < len(value)-head && base[len(base)-1-tail] == value[len(value)-1-tail] {
+		tail++
+	}
+	buf := make([]byte, 4, 4+len(value)-head-tail)
+	writeUint16(buf[0:2], uint16(head))
+	writeUint16(buf[2:4], uint16(tail))
+	return append(buf, value[head:len(value)-tail]...)
+}
+
+// decodeDelta は encodeDelta で作った差分から値を戻す
+func decodeDelta(base, delta []byte) []byte {
+	head, tail := int(readUint16(delta[0:2])), int(readUint16(delta[2:4]))
+	middle := delta[4:]
+	value := make([]byte, 0, head+len(middle)+tail)
+	value = append(value, base[:head]...)
+	value = append(value, middle...)
+	return append(value, base[len(base)-tail:]...)
+}
+
+// commonPrefix は a と b に共通する接頭辞を返す
+func commonPrefix(a, b []byte) []byte {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return a[:n]
+}
 
-	// オーバーフローキー（新しいリーフの最後のキー）を返す
-	return pairs[mid-1].Key
+// shortestSeparator は left < sep <= right を満たす最も短い sep を返す（left < right であること）
+// 共通部分の次の1バイトまでで right を切り詰めれば、left より大きく right 以下になる
+func shortestSeparator(left, right []byte) []byte {
+	n := len(commonPrefix(left, right))
+	return append([]byte{}, right[:n+1]...)
 }
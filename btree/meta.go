@@ -1,16 +1,30 @@
 package btree
 
 import (
+	"encoding/binary"
+
 	"github.com/kkumaki12/minidb/disk"
 )
 
 // MetaHeader はメタページのヘッダー情報
-// ルートページのIDを保持する
+// ルートページのIDと木の設定を保持する
+//
+// レイアウト: [root_page_id: 8] [flags: 4] [reserved: 4] [next_sequence: 8]
+// 以前のファイルでは root_page_id より後ろは0になっている
 type MetaHeader struct {
-	RootPageID disk.PageID
+	RootPageID   disk.PageID
+	Flags        uint32 // MetaFlag の組み合わせ
+	NextSequence uint64 // 重複キーを許す木では次のエントリに付ける連番、他の木では BTree.NextSequence が次に払い出す連番
 }
 
-const MetaHeaderSize = 8
+const MetaHeaderSize = 24
+
+// MetaFlag はメタページに記録する木の設定
+const (
+	MetaFlagDuplicates   uint32 = 1 << 0 // 同じキーのエントリを複数持てる
+	MetaFlagDeltaValues  uint32 = 1 << 1 // リーフの値を差分で格納する
+	MetaFlagSecureDelete uint32 = 1 << 2 // 削除したペアのバイトを0で上書きする
+)
 
 // Meta はB-treeのメタデータページを表す
 type Meta struct {
@@ -22,7 +36,9 @@ type Meta struct {
 func NewMeta(data []byte) *Meta {
 	return &Meta{
 		Header: &MetaHeader{
-			RootPageID: disk.PageID(readUint64(data[0:8])),
+			RootPageID:   disk.PageID(readUint64(data[0:8])),
+			Flags:        binary.LittleEndian.Uint32(data[8:12]),
+			NextSequence: readUint64(data[16:24]),
 		},
 		data: data,
 	}
@@ -31,4 +47,6 @@ func NewMeta(data []byte) *Meta {
 // Sync はヘッダーの内容をデータに書き戻す
 func (m *Meta) Sync() {
 	writeUint64(m.data[0:8], uint64(m.Header.RootPageID))
+	binary.LittleEndian.PutUint32(m.data[8:12], m.Header.Flags)
+	writeUint64(m.data[16:24], m.Header.NextSequence)
 }
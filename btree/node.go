@@ -2,22 +2,33 @@ package btree
 
 import (
 	"encoding/binary"
+
+	"github.com/kkumaki12/minidb/buffer"
 )
 
 // NodeType はノードの種類を表す
 type NodeType uint8
 
 const (
-	NodeTypeLeaf   NodeType = 1
-	NodeTypeBranch NodeType = 2
+	NodeTypeLeaf     NodeType = 1
+	NodeTypeBranch   NodeType = 2
+	NodeTypeOverflow NodeType = 3 // 大きな値を格納するページ（木のノードではない）
 )
 
 // ノードヘッダーのサイズ
+// レイアウト: [node_type: 1] [flags: 1] [reserved: 6]
 const NodeHeaderSize = 8
 
+// NodeFlag はノードヘッダーに記録するフラグ
+const (
+	NodeFlagRoot    uint8 = 1 << 0 // 木のルート。キャッシュしたルートページIDの確認に使う
+	NodeFlagRemoved uint8 = 1 << 1 // 併合で木から外した。ピンしていたイテレータが降り直すのに使う
+)
+
 // NodeHeader はノードのヘッダー情報
 type NodeHeader struct {
 	NodeType NodeType
+	Flags    uint8 // NodeFlag の組み合わせ
 }
 
 // Node はB-treeのノードを表す
@@ -31,6 +42,7 @@ func NewNode(data []byte) *Node {
 	return &Node{
 		Header: NodeHeader{
 			NodeType: NodeType(data[0]),
+			Flags:    data[1],
 		},
 		Body: data[NodeHeaderSize:],
 	}
@@ -39,16 +51,44 @@ func NewNode(data []byte) *Node {
 // InitializeAsLeaf はノードをリーフノードとして初期化する
 func (n *Node) InitializeAsLeaf() {
 	n.Header.NodeType = NodeTypeLeaf
+	n.Header.Flags = 0
 }
 
 // InitializeAsBranch はノードをブランチノードとして初期化する
 func (n *Node) InitializeAsBranch() {
 	n.Header.NodeType = NodeTypeBranch
+	n.Header.Flags = 0
 }
 
 // WriteHeader はヘッダーをバイト列に書き込む
 func (n *Node) WriteHeader(data []byte) {
 	data[0] = byte(n.Header.NodeType)
+	data[1] = n.Header.Flags
+}
+
+// isRootNode はノードにルートの印が付いているかを返す
+func isRootNode(data []byte) bool {
+	return data[1]&NodeFlagRoot != 0
+}
+
+// setRootNode はノードにルートの印を付ける、または外す
+func setRootNode(data []byte, root bool) {
+	if root {
+		data[1] |= NodeFlagRoot
+	} else {
+		data[1] &^= NodeFlagRoot
+	}
+}
+
+// isRemovedNode はノードが木から外されているかを返す
+func isRemovedNode(data []byte) bool {
+	return data[1]&NodeFlagRemoved != 0
+}
+
+// markRemovedNode はノードに木から外した印を付ける
+func markRemovedNode(nodeBuffer *buffer.Buffer) {
+	nodeBuffer.Page[1] |= NodeFlagRemoved
+	nodeBuffer.IsDirty = true
 }
 
 // ヘルパー関数：バイト列からuint64を読む
@@ -0,0 +1,172 @@
+package btree
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// キーと値の大きさの上限
+//
+// リーフは分割後にそれぞれ少なくとも1つのペアを持てなければならず、
+// ブランチは分割で親に1つ渡した後にそれぞれ少なくとも1つのキーを持てなければならない。
+// MaxKeySize と MaxInlineValueSize は、最大のペア2つが LeafFormatPrefix の1つのリーフに収まるように決めている。
+// これで満杯のリーフに1つ足しても、格納するバイト数で分ければ両側が収まる。
+// ペアの数で分けると、小さいペアの後ろに大きいペアが並んだときに片側が収まらない
+const (
+	MaxKeySize         = 1024     // キーの最大バイト数
+	MaxInlineValueSize = 1000     // リーフに直接格納する値の最大バイト数。これを超える値はオーバーフローページに置く
+	MaxValueSize       = 16 << 20 // 値の最大バイト数
+)
+
+// エラー定義
+var (
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+)
+
+// オーバーフローページのレイアウト:
+// [node_header: 8] [next_page_id: 8] [length: 2] [data]
+//
+// MaxInlineValueSize を超える値は先頭から順にオーバーフローページの連結リストに書き、
+// リーフには値の代わりに [first_page_id: 8] [value_len: 4] を置く。
+// リーフのペアの value_len の最上位ビットがこの参照であることを示す
+
+const (
+	OverflowNextPageIDOffset = 0
+	OverflowLengthOffset     = 8
+	OverflowHeaderSize       = 10
+	overflowRefSize          = 12
+)
+
+// checkSize はキーと値が格納できる大きさかを確認する
+func checkSize(key, value []byte) error {
+	if len(key) > MaxKeySize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrKeyTooLarge, len(key), MaxKeySize)
+	}
+	if len(value) > MaxValueSize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrValueTooLarge, len(value), MaxValueSize)
+	}
+	return nil
+}
+
+// storePair はリーフに格納するペアを作る
+// 値が MaxInlineValueSize を超える場合はオーバーフローページに書き、参照を値にする
+func storePair(ctx context.Context, bufmgr *buffer.BufferPoolManager, key, value []byte) (*Pair, error) {
+	if len(value) <= MaxInlineValueSize {
+		return &Pair{Key: key, Value: value}, nil
+	}
+	firstPageID, err := writeOverflow(ctx, bufmgr, value)
+	if err != nil {
+		return nil, err
+	}
+	ref := make([]byte, overflowRefSize)
+	writeUint64(ref[0:8], uint64(firstPageID))
+	binary.LittleEndian.PutUint32(ref[8:12], uint32(len(value)))
+	return &Pair{Key: key, Value: ref, overflow: true}, nil
+}
+
+// loadValue はリーフから読んだペアの値を返す
+// オーバーフローページへの参照であれば、連結リストを辿って値を組み立てる
+func loadValue(ctx context.Context, bufmgr *buffer.BufferPoolManager, pair *Pair) ([]byte, error) {
+	if !pair.overflow {
+		return pair.Value, nil
+	}
+	ref := pair.Value
+	pageID := disk.PageID(readUint64(ref[0:8]))
+	length := int(binary.LittleEndian.Uint32(ref[8:12]))
+
+	value := make([]byte, 0, length)
+	for len(value) < length {
+		if pageID == InvalidPageID {
+			return nil, fmt.Errorf("overflow chain ended at %d of %d bytes", len(value), length)
+		}
+		pageBuffer, err := bufmgr.FetchPageContext(ctx, pageID)
+		if err != nil {
+			return nil, err
+		}
+		if node := NewNode(pageBuffer.Page[:]); node.Header.NodeType != NodeTypeOverflow {
+			bufmgr.UnpinPage(pageBuffer)
+			return nil, fmt.Errorf("page %d: expected overflow page, got node type %d", pageID, node.Header.NodeType)
+		}
+		body := pageBuffer.Page[NodeHeaderSize:]
+		n := int(readUint16(body[OverflowLengthOffset:]))
+		value = append(value, body[OverflowHeaderSize:OverflowHeaderSize+n]...)
+		pageID = disk.PageID(readUint64(body[OverflowNextPageIDOffset:]))
+		bufmgr.UnpinPage(pageBuffer)
+	}
+	return value, nil
+}
+
+// writeOverflow は値をオーバーフローページの連結リストに書き、先頭のページIDを返す
+// 値を削除・更新したら古いオーバーフローページは解放する（SecureDelete なら0で埋めてから）
+func writeOverflow(ctx context.Context, bufmgr *buffer.BufferPoolManager, value []byte) (disk.PageID, error) {
+	firstPageID := InvalidPageID
+	var prevBuffer *buffer.Buffer
+	for len(value) > 0 {
+		pageBuffer, err := bufmgr.CreatePageContext(ctx)
+		if err != nil {
+			if prevBuffer != nil {
+				bufmgr.UnpinPage(prevBuffer)
+			}
+			return InvalidPageID, err
+		}
+		node := NewNode(pageBuffer.Page[:])
+		node.Header.NodeType = NodeTypeOverflow
+		node.WriteHeader(pageBuffer.Page[:])
+
+		body := pageBuffer.Page[NodeHeaderSize:]
+		n := copy(body[OverflowHeaderSize:], value)
+		value = value[n:]
+		writeUint64(body[OverflowNextPageIDOffset:], uint64(InvalidPageID))
+		writeUint16(body[OverflowLengthOffset:], uint16(n))
+		pageBuffer.IsDirty = true
+
+		if prevBuffer == nil {
+			firstPageID = pageBuffer.PageID
+		} else {
+			writeUint64(prevBuffer.Page[NodeHeaderSize+OverflowNextPageIDOffset:], uint64(pageBuffer.PageID))
+			bufmgr.UnpinPage(prevBuffer)
+		}
+		prevBuffer = pageBuffer
+	}
+	if prevBuffer != nil {
+		bufmgr.UnpinPage(prevBuffer)
+	}
+	return firstPageID, nil
+}
+
+// releaseOverflow は pair が参照するオーバーフローページの連結リストのページIDを返す
+// 参照を削除した後に呼び、呼び出し側は全てのピンを外してから返したページを解放する。
+// scrub が true ならページを0で埋める。0で埋めたページはどこからも参照されない
+// オーバーフローページを参照しないペアでは何もしない
+func releaseOverflow(ctx context.Context, bufmgr *buffer.BufferPoolManager, pair *Pair, scrub bool) ([]disk.PageID, error) {
+	if !pair.overflow {
+		return nil, nil
+	}
+	var pageIDs []disk.PageID
+	pageID := disk.PageID(readUint64(pair.Value[0:8]))
+	for pageID != InvalidPageID {
+		pageBuffer, err := bufmgr.FetchPageContext(ctx, pageID)
+		if err != nil {
+			return pageIDs, err
+		}
+		if node := NewNode(pageBuffer.Page[:]); node.Header.NodeType != NodeTypeOverflow {
+			bufmgr.UnpinPage(pageBuffer)
+			return pageIDs, fmt.Errorf("page %d: expected overflow page, got node type %d", pageID, node.Header.NodeType)
+		}
+		pageIDs = append(pageIDs, pageID)
+		next := disk.PageID(readUint64(pageBuffer.Page[NodeHeaderSize+OverflowNextPageIDOffset:]))
+		if scrub {
+			clear(pageBuffer.Page[:])
+			pageBuffer.IsDirty = true
+		}
+		bufmgr.UnpinPage(pageBuffer)
+		pageID = next
+	}
+	return pageIDs, nil
+}
@@ -0,0 +1,57 @@
+package btree
+
+import (
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// Pages は木を構成する全てのページのIDを返す
+// メタページ・ブランチ・リーフと、値を置いたオーバーフローページを含む
+// 削除や更新で参照されなくなったオーバーフローページは含まない
+// 1つの木のページだけを書き戻す BufferPoolManager.FlushPages に渡すのに使う
+func Pages(bufmgr *buffer.BufferPoolManager, tree *BTree) ([]disk.PageID, error) {
+	pageIDs := []disk.PageID{tree.MetaPageID}
+	err := walkLevels(bufmgr, tree, func(info *nodeInfo) error {
+		pageIDs = append(pageIDs, info.pageID)
+		if !info.isLeaf {
+			return nil
+		}
+		overflow, err := overflowPages(bufmgr, info.pageID)
+		pageIDs = append(pageIDs, overflow...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pageIDs, nil
+}
+
+// overflowPages はリーフのペアが参照するオーバーフローページのIDを返す
+func overflowPages(bufmgr *buffer.BufferPoolManager, leafPageID disk.PageID) ([]disk.PageID, error) {
+	leafBuffer, err := bufmgr.FetchPage(leafPageID)
+	if err != nil {
+		return nil, err
+	}
+	var firstPageIDs []disk.PageID
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	for i := 0; i < leaf.NumPairs(); i++ {
+		if pair := leaf.PairAt(i); pair.overflow {
+			firstPageIDs = append(firstPageIDs, disk.PageID(readUint64(pair.Value[0:8])))
+		}
+	}
+	bufmgr.UnpinPage(leafBuffer)
+
+	var pageIDs []disk.PageID
+	for _, pageID := range firstPageIDs {
+		for pageID != InvalidPageID {
+			pageIDs = append(pageIDs, pageID)
+			pageBuffer, err := bufmgr.FetchPage(pageID)
+			if err != nil {
+				return nil, err
+			}
+			pageID = disk.PageID(readUint64(pageBuffer.Page[NodeHeaderSize+OverflowNextPageIDOffset:]))
+			bufmgr.UnpinPage(pageBuffer)
+		}
+	}
+	return pageIDs, nil
+}
@@ -8,8 +8,13 @@ import (
 type Pair struct {
 	Key   []byte
 	Value []byte
+
+	overflow bool // Value がオーバーフローページへの参照であるか（リーフの中でだけ使う）
 }
 
+// pairOverflowFlag は value_len の最上位ビットで、値がオーバーフローページへの参照であることを示す
+const pairOverflowFlag = 0x8000
+
 // ToBytes はPairをバイト列にシリアライズする
 // フォーマット: [key_len(2)] [value_len(2)] [key] [value]
 func (p *Pair) ToBytes() []byte {
@@ -17,7 +22,11 @@ func (p *Pair) ToBytes() []byte {
 	valueLen := len(p.Value)
 	buf := make([]byte, 4+keyLen+valueLen)
 	binary.LittleEndian.PutUint16(buf[0:2], uint16(keyLen))
-	binary.LittleEndian.PutUint16(buf[2:4], uint16(valueLen))
+	flag := uint16(0)
+	if p.overflow {
+		flag = pairOverflowFlag
+	}
+	binary.LittleEndian.PutUint16(buf[2:4], uint16(valueLen)|flag)
 	copy(buf[4:4+keyLen], p.Key)
 	copy(buf[4+keyLen:], p.Value)
 	return buf
@@ -26,12 +35,13 @@ func (p *Pair) ToBytes() []byte {
 // PairFromBytes はバイト列からPairをデシリアライズする
 func PairFromBytes(data []byte) *Pair {
 	keyLen := binary.LittleEndian.Uint16(data[0:2])
-	valueLen := binary.LittleEndian.Uint16(data[2:4])
+	rawValueLen := binary.LittleEndian.Uint16(data[2:4])
+	valueLen := rawValueLen &^ pairOverflowFlag
 	key := make([]byte, keyLen)
 	value := make([]byte, valueLen)
 	copy(key, data[4:4+keyLen])
 	copy(value, data[4+keyLen:4+int(keyLen)+int(valueLen)])
-	return &Pair{Key: key, Value: value}
+	return &Pair{Key: key, Value: value, overflow: rawValueLen&pairOverflowFlag != 0}
 }
 
 // PairSize はシリアライズ後のバイト数を返す
@@ -0,0 +1,141 @@
+package btree
+
+import (
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+const (
+	// readAheadTrigger はこの回数続けて次のリーフに進んだら先読みを始める
+	readAheadTrigger = 2
+	// maxReadAheadDepth は先読みするリーフ数の上限
+	maxReadAheadDepth = 32
+)
+
+// readAhead はイテレータのアクセスパターンから先読みの深さを調整する
+//
+// Searchで位置決めした直後のようなランダムアクセスでは先読みせず、
+// NextPageIDを辿って次のリーフに続けて進んだ場合だけ先読みを始める。
+// 先読みしたリーフに深さ分だけ到達するたびに深さを倍にし、先読みしたページが
+// 到達前に追い出されていた場合（バッファプールが足りない）は半分に戻す。
+//
+// Iter.SetReadAhead で深さを固定した場合は、別の goroutine で先読みする（async）
+type readAhead struct {
+	depth int         // 先読みするリーフ数
+	run   int         // 続けて次のリーフに進んだ回数
+	hits  int         // 今の深さになってから先読み済みのリーフに到達した回数
+	ahead int         // 先読み済みで、まだ到達していないリーフ数
+	last  disk.PageID // 最後に先読みしたリーフのページID
+
+	disabled   bool               // 先読みしない
+	async      int                // 別の goroutine で先読みするリーフ数（0なら同期的に先読みする）
+	prefetcher *buffer.Prefetcher // 実行中の非同期の先読み
+}
+
+// nextLeaf は先読みしたページがリーフならその次のリーフのページIDを返す
+func nextLeaf(page []byte) (disk.PageID, bool) {
+	if NewNode(page).Header.NodeType != NodeTypeLeaf {
+		return 0, false
+	}
+	next := NewLeaf(page[NodeHeaderSize:]).NextPageID()
+	if next == nil {
+		return 0, false
+	}
+	return *next, true
+}
+
+// startAsync は current の次から async 個のリーフを別の goroutine で先読みする
+// 前の先読みがまだ続いていれば何もしない
+func (r *readAhead) startAsync(bufmgr *buffer.BufferPoolManager, current *buffer.Buffer) {
+	if r.prefetcher != nil && !r.prefetcher.Done() {
+		return
+	}
+	nextPageID := NewLeaf(current.Page[NodeHeaderSize:]).NextPageID()
+	if nextPageID == nil {
+		return
+	}
+	r.prefetcher = bufmgr.PrefetchChain(*nextPageID, r.async, nextLeaf)
+}
+
+// stop は非同期の先読みを止める
+func (r *readAhead) stop() {
+	if r.prefetcher != nil {
+		r.prefetcher.Stop()
+		r.prefetcher = nil
+	}
+}
+
+// beforeFetch は次のリーフを取得する直前に呼ぶ
+// 先読みしたはずのページが追い出されていれば、深さを半分にする
+func (r *readAhead) beforeFetch(bufmgr *buffer.BufferPoolManager, nextPageID disk.PageID) {
+	if r.disabled || r.async > 0 {
+		return
+	}
+	if r.ahead > 0 && !bufmgr.Contains(nextPageID) {
+		r.depth /= 2
+		r.hits = 0
+		r.ahead = 0
+	}
+}
+
+// afterFetch は次のリーフに進んだ直後に呼ぶ
+// 必要に応じて深さを調整し、その先のリーフを先読みする
+func (r *readAhead) afterFetch(bufmgr *buffer.BufferPoolManager, current *buffer.Buffer) {
+	if r.disabled {
+		return
+	}
+	if r.async > 0 {
+		r.startAsync(bufmgr, current)
+		return
+	}
+	r.run++
+	if r.ahead > 0 {
+		r.ahead--
+		r.hits++
+	}
+	if r.run < readAheadTrigger {
+		return
+	}
+
+	// 先読みが深さ分だけ役に立ったら深さを広げる
+	if r.depth == 0 {
+		r.depth = 1
+	} else if r.hits >= r.depth && r.depth < maxReadAheadDepth {
+		r.depth *= 2
+		r.hits = 0
+	}
+	// 残りが半分を切るまでは追加で読まない
+	if r.ahead > r.depth/2 {
+		return
+	}
+	r.fill(bufmgr, current)
+}
+
+// fill は先読み済みのリーフが depth 個になるまで、その先のリーフを読み込む
+// 先読みは最適化にすぎないので、失敗してもスキャン自体は続けられるようにエラーは返さない
+func (r *readAhead) fill(bufmgr *buffer.BufferPoolManager, current *buffer.Buffer) {
+	from := current
+	if r.ahead > 0 {
+		var err error
+		from, err = bufmgr.PrefetchPage(r.last)
+		if err != nil {
+			r.ahead = 0
+			return
+		}
+	}
+
+	for r.ahead < r.depth {
+		nextPageID := NewLeaf(from.Page[NodeHeaderSize:]).NextPageID()
+		if nextPageID == nil {
+			return
+		}
+		// PrefetchPage の戻り値はピンされていないので、次の読み込みまでに NextPageID を読む
+		next, err := bufmgr.PrefetchPage(*nextPageID)
+		if err != nil {
+			return
+		}
+		from = next
+		r.last = *nextPageID
+		r.ahead++
+	}
+}
@@ -0,0 +1,292 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// 削除で小さくなったノードの扱い
+//
+// 削除したリーフの使用量がページの 1/underflowDivisor を下回ったら、同じ親を持つ隣の兄弟
+// （右の兄弟、いちばん右の子なら左の兄弟）と合わせて見る。2つの中身が1ページに収まれば
+// 左のノードに寄せて右のノードを木から外し、親から区切りキーと子を1つ取り除く（併合）。
+// 収まらなければ中身を半分ずつに分け直し、親の区切りキーを付け替える（再分配）。
+// 併合で親が小さくなれば、1つ上で同じことを繰り返す。ブランチの併合では親の区切りキーを
+// 間に下ろしてつなぐ
+//
+// ルートが子を1つしか持たないブランチになったら、子の中身をルートのページに写して子を外す。
+// ルートのページIDは変わらないので、メタページも他の BTree が覚えているルートもそのまま使える
+//
+// 木から外したページは、全てのピンを外してから bufmgr.FreePage で空きページに戻す。
+// 外したページには NodeFlagRemoved の印を付けるので、そのページにいたイテレータは次の Next で
+// キーから降り直す。イテレータが読んでいる（ピンしている）ページは解放せずに残し、再利用しない
+
+// underflowDivisor はノードを小さすぎるとみなす使用量（ページの 1/underflowDivisor 未満）
+const underflowDivisor = 4
+
+// nodeUnderflows はノードの使用量がページの 1/underflowDivisor を下回っているかを返す
+func nodeUnderflows(nodeBuffer *buffer.Buffer) bool {
+	body := nodeBuffer.Page[NodeHeaderSize:]
+	var free int
+	switch NewNode(nodeBuffer.Page[:]).Header.NodeType {
+	case NodeTypeLeaf:
+		free = NewLeaf(body).freeSpace()
+	case NodeTypeBranch:
+		free = NewBranch(body).freeSpace()
+	default:
+		return false
+	}
+	return len(body)-free < len(body)/underflowDivisor
+}
+
+// rebalance は path の末尾（削除したリーフ）から上に向かって、小さくなったノードを
+// 兄弟と併合するか再分配する。path のピンは呼び出し側が外す
+// 木から外したページのIDを返すので、呼び出し側は全てのピンを外してから解放する
+func (t *BTree) rebalance(ctx context.Context, bufmgr *buffer.BufferPoolManager, path []pathEntry, delta bool) ([]disk.PageID, error) {
+	var freed []disk.PageID
+	for level := len(path) - 1; level > 0; level-- {
+		if !nodeUnderflows(path[level].buffer) {
+			break
+		}
+		parent := path[level-1]
+		// ルートでない親が子を2つしか持たなければ、併合すると子が1つになるので再分配だけにする
+		canMerge := level == 1 || NewBranch(parent.buffer.Page[NodeHeaderSize:]).NumChildren() > 2
+		removed, err := rebalanceChild(ctx, bufmgr, parent, path[level].buffer, canMerge, delta)
+		if err != nil {
+			return freed, err
+		}
+		if removed == InvalidPageID {
+			break
+		}
+		freed = append(freed, removed)
+	}
+
+	rootBuffer := path[0].buffer
+	if NewNode(rootBuffer.Page[:]).Header.NodeType != NodeTypeBranch {
+		return freed, nil
+	}
+	root := NewBranch(rootBuffer.Page[NodeHeaderSize:])
+	if root.NumChildren() != 1 {
+		return freed, nil
+	}
+	childBuffer, err := fetchNode(ctx, bufmgr, root.ChildAt(0))
+	if err != nil {
+		return freed, err
+	}
+	defer bufmgr.UnpinPage(childBuffer)
+	rootBuffer.Page = childBuffer.Page
+	setRootNode(rootBuffer.Page[:], true)
+	rootBuffer.IsDirty = true
+	markRemovedNode(childBuffer)
+	return append(freed, childBuffer.PageID), verifyPage(rootBuffer.PageID, rootBuffer.Page[:])
+}
+
+// rebalanceChild は親 parent の childIdx 番目の子 childBuffer を隣の兄弟と併合するか再分配する
+// 併合したら木から外したページのIDを、そうでなければ InvalidPageID を返す
+func rebalanceChild(ctx context.Context, bufmgr *buffer.BufferPoolManager, parent pathEntry, childBuffer *buffer.Buffer, canMerge, delta bool) (disk.PageID, error) {
+	branch := NewBranch(parent.buffer.Page[NodeHeaderSize:])
+	if branch.NumChildren() < 2 {
+		return InvalidPageID, nil
+	}
+	// sepIdx は左右の子を分ける区切りキーの位置。左の子が sepIdx、右の子が sepIdx+1 番目になる
+	sepIdx, siblingIdx := parent.childIdx, parent.childIdx+1
+	if siblingIdx == branch.NumChildren() {
+		sepIdx, siblingIdx = parent.childIdx-1, parent.childIdx-1
+	}
+	siblingBuffer, err := fetchNode(ctx, bufmgr, branch.ChildAt(siblingIdx))
+	if err != nil {
+		return InvalidPageID, err
+	}
+	defer bufmgr.UnpinPage(siblingBuffer)
+
+	leftBuffer, rightBuffer := childBuffer, siblingBuffer
+	if siblingIdx == sepIdx {
+		leftBuffer, rightBuffer = siblingBuffer, childBuffer
+	}
+	childType := NewNode(childBuffer.Page[:]).Header.NodeType
+	if NewNode(siblingBuffer.Page[:]).Header.NodeType != childType {
+		return InvalidPageID, nil
+	}
+	if childType == NodeTypeLeaf {
+		return rebalanceLeaves(ctx, bufmgr, parent.buffer, sepIdx, leftBuffer, rightBuffer, canMerge, delta)
+	}
+	return rebalanceBranches(parent.buffer, sepIdx, leftBuffer, rightBuffer, canMerge)
+}
+
+// rebalanceLeaves は隣り合うリーフを併合するか再分配する
+func rebalanceLeaves(ctx context.Context, bufmgr *buffer.BufferPoolManager, parentBuffer *buffer.Buffer, sepIdx int, leftBuffer, rightBuffer *buffer.Buffer, canMerge, delta bool) (disk.PageID, error) {
+	left := NewLeaf(leftBuffer.Page[NodeHeaderSize:])
+	right := NewLeaf(rightBuffer.Page[NodeHeaderSize:])
+	if next := left.NextPageID(); next == nil || *next != rightBuffer.PageID {
+		return InvalidPageID, nil
+	}
+	pairs := make([]*Pair, 0, left.NumPairs()+right.NumPairs())
+	for i := 0; i < left.NumPairs(); i++ {
+		pairs = append(pairs, left.PairAt(i))
+	}
+	for i := 0; i < right.NumPairs(); i++ {
+		pairs = append(pairs, right.PairAt(i))
+	}
+	parent := NewBranch(parentBuffer.Page[NodeHeaderSize:])
+	keys, children := branchEntries(parent)
+
+	if canMerge && leafSize(pairs) <= len(left.data) {
+		// 右のリーフを外すので、その次のリーフの prev を左のリーフに付け替える
+		// 読み込みに失敗しても木を変えずに済むよう、書き換える前に取得する
+		var nextBuffer *buffer.Buffer
+		nextPageID := right.NextPageID()
+		if nextPageID != nil {
+			var err error
+			if nextBuffer, err = fetchNode(ctx, bufmgr, *nextPageID); err != nil {
+				return InvalidPageID, err
+			}
+			defer bufmgr.UnpinPage(nextBuffer)
+		}
+		left.rebuild(pairs, delta)
+		left.SetNextPageID(nextPageID)
+		if nextBuffer != nil {
+			NewLeaf(nextBuffer.Page[NodeHeaderSize:]).SetPrevPageID(&leftBuffer.PageID)
+			nextBuffer.IsDirty = true
+		}
+		keys = append(keys[:sepIdx], keys[sepIdx+1:]...)
+		children = append(children[:sepIdx+1], children[sepIdx+2:]...)
+		parent.build(keys, children)
+		leftBuffer.IsDirty = true
+		parentBuffer.IsDirty = true
+		markRemovedNode(rightBuffer)
+		return rightBuffer.PageID, verifyPages(leftBuffer, parentBuffer)
+	}
+
+	// 格納するバイト数がおよそ半分になるところで分ける
+	total := 0
+	for _, p := range pairs {
+		total += PairSize(len(p.Key), len(p.Value))
+	}
+	mid, size := 0, 0
+	for mid < len(pairs)-1 && size+PairSize(len(pairs[mid].Key), len(pairs[mid].Value))/2 < total/2 {
+		size += PairSize(len(pairs[mid].Key), len(pairs[mid].Value))
+		mid++
+	}
+	if mid == 0 || leafSize(pairs[:mid]) > len(left.data) || leafSize(pairs[mid:]) > len(right.data) {
+		return InvalidPageID, nil
+	}
+	keys[sepIdx] = shortestSeparator(pairs[mid-1].Key, pairs[mid].Key)
+	if branchSize(keys, children) > len(parent.data) {
+		return InvalidPageID, nil
+	}
+	left.rebuild(pairs[:mid], delta)
+	right.rebuild(pairs[mid:], delta)
+	parent.build(keys, children)
+	leftBuffer.IsDirty = true
+	rightBuffer.IsDirty = true
+	parentBuffer.IsDirty = true
+	return InvalidPageID, verifyPages(leftBuffer, rightBuffer, parentBuffer)
+}
+
+// rebalanceBranches は隣り合うブランチを併合するか再分配する
+// 親の区切りキーを間に下ろして1列にしてから、1つに詰めるか2つに分け直す
+func rebalanceBranches(parentBuffer *buffer.Buffer, sepIdx int, leftBuffer, rightBuffer *buffer.Buffer, canMerge bool) (disk.PageID, error) {
+	left := NewBranch(leftBuffer.Page[NodeHeaderSize:])
+	right := NewBranch(rightBuffer.Page[NodeHeaderSize:])
+	parent := NewBranch(parentBuffer.Page[NodeHeaderSize:])
+	parentKeys, parentChildren := branchEntries(parent)
+
+	leftKeys, leftChildren := branchEntries(left)
+	rightKeys, rightChildren := branchEntries(right)
+	keys := append(append(leftKeys, parentKeys[sepIdx]), rightKeys...)
+	children := append(leftChildren, rightChildren...)
+
+	if canMerge && branchSize(keys, children) <= len(left.data) {
+		left.build(keys, children)
+		parentKeys = append(parentKeys[:sepIdx], parentKeys[sepIdx+1:]...)
+		parentChildren = append(parentChildren[:sepIdx+1], parentChildren[sepIdx+2:]...)
+		parent.build(parentKeys, parentChildren)
+		leftBuffer.IsDirty = true
+		parentBuffer.IsDirty = true
+		markRemovedNode(rightBuffer)
+		return rightBuffer.PageID, verifyPages(leftBuffer, parentBuffer)
+	}
+
+	// keys[mid] を新しい区切りキーとして親に上げ、左右に残りを分ける
+	total := branchSize(keys, children)
+	mid, size := 0, BranchHeaderSize
+	for mid < len(keys)-1 && size+BranchEntrySize+2+len(keys[mid]) < total/2 {
+		size += BranchEntrySize + 2 + len(keys[mid])
+		mid++
+	}
+	if mid == 0 || branchSize(keys[:mid], children[:mid+1]) > len(left.data) || branchSize(keys[mid+1:], children[mid+1:]) > len(right.data) {
+		return InvalidPageID, nil
+	}
+	parentKeys[sepIdx] = keys[mid]
+	if branchSize(parentKeys, parentChildren) > len(parent.data) {
+		return InvalidPageID, nil
+	}
+	left.build(keys[:mid], children[:mid+1])
+	right.build(keys[mid+1:], children[mid+1:])
+	parent.build(parentKeys, parentChildren)
+	leftBuffer.IsDirty = true
+	rightBuffer.IsDirty = true
+	parentBuffer.IsDirty = true
+	return InvalidPageID, verifyPages(leftBuffer, rightBuffer, parentBuffer)
+}
+
+// leafSize は pairs を LeafFormatPrefix のリーフに詰めたときのバイト数を返す
+func leafSize(pairs []*Pair) int {
+	prefix := pairsPrefix(pairs)
+	size := LeafPrefixHeaderSize + len(prefix)
+	for _, p := range pairs {
+		size += LeafSlotSize + PairSize(len(p.Key)-len(prefix), len(p.Value))
+	}
+	return size
+}
+
+// deltaLeafSize は pairs を base を基準値にした LeafFormatDelta のリーフに詰めたときのバイト数を返す
+// prefix は pairs の共通接頭辞であること
+func deltaLeafSize(pairs []*Pair, prefix, base []byte) int {
+	size := LeafDeltaHeaderSize + len(prefix) + len(base)
+	for _, p := range pairs {
+		value := p.Value
+		if !p.overflow {
+			value = encodeDelta(base, value)
+		}
+		size += LeafSlotSize + PairSize(len(p.Key)-len(prefix), len(value))
+	}
+	return size
+}
+
+// pairsPrefix は pairs のキーの共通接頭辞を返す
+func pairsPrefix(pairs []*Pair) []byte {
+	var prefix []byte
+	if len(pairs) > 0 {
+		prefix = pairs[0].Key
+		for _, p := range pairs[1:] {
+			prefix = commonPrefix(prefix, p.Key)
+		}
+	}
+	return prefix
+}
+
+// branchEntries はブランチのキーと子をコピーして返す
+func branchEntries(b *Branch) ([][]byte, []disk.PageID) {
+	numKeys := b.NumKeys()
+	keys := make([][]byte, numKeys)
+	for i := range keys {
+		keys[i] = append([]byte{}, b.KeyAt(i)...)
+	}
+	children := make([]disk.PageID, numKeys+1)
+	for i := range children {
+		children[i] = b.ChildAt(i)
+	}
+	return keys, children
+}
+
+// branchSize は keys と children を BranchFormatInterleaved のブランチに詰めたときのバイト数を返す
+func branchSize(keys [][]byte, children []disk.PageID) int {
+	size := BranchHeaderSize + len(children)*BranchEntrySize
+	for _, k := range keys {
+		size += 2 + len(k)
+	}
+	return size
+}
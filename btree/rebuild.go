@@ -0,0 +1,229 @@
+package btree
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// RebuildOptions は作り直しの設定
+type RebuildOptions struct {
+	// FillFactor は各ページをどこまで詰めるか。BulkLoadOptions.FillFactor と同じ
+	// 読み込みが中心の木なら 0.9、書き込みの多い木なら 0.7 などにする
+	FillFactor float64
+	// Online を有効にすると、古い木を残したまま新しいページに組み立て、メタページのルートを
+	// 付け替えてから古いページを空きページに戻す。ルートを付け替えるまでは古い木がそのまま
+	// 読め、途中で失敗しても古い木が残る（組み立てかけのページは再利用されない）。
+	// 無効なら先に古いページを空きページに戻すので、新しいページがファイルの先頭に寄る
+	Online bool
+}
+
+// Rebuild は木に残っているペアを詰め直して、木を作り直す
+// 削除を繰り返して中身の少ないページが散らばった木を、バルクロードと同じ手順で
+// ぎっしり詰まったページに組み立て直し、それまでのページを空きページにする
+//
+// メタページのIDは変えないので、木を開き直す必要はない。ペアは一度全てメモリに読み込む。
+// 作り直している間の書き込みは呼び出し側で止めておくこと
+//
+// 古いルートのページだけは空きページに戻さず、ルートの印を外して残す。別の BTree の値が
+// 古いルートをキャッシュしていても、そのページが別の木のルートに再利用されることはなく、
+// 印がないのでメタページを読み直す。どの BTree の値も残っていないと分かっている
+// 呼び出し側（minidb.DB.Vacuum）は、木から参照されないページとして後で回収できる
+func (t *BTree) Rebuild(bufmgr *buffer.BufferPoolManager) error {
+	return t.RebuildContext(context.Background(), bufmgr, RebuildOptions{})
+}
+
+// RebuildWithOptions は設定を指定して Rebuild を行う
+func (t *BTree) RebuildWithOptions(bufmgr *buffer.BufferPoolManager, opts RebuildOptions) error {
+	return t.RebuildContext(context.Background(), bufmgr, opts)
+}
+
+// RebuildContext は RebuildWithOptions と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// キャンセルを確かめるのは、古い木を壊さずにやめられる間だけ
+// （Online でなければペアを読み終えるまで、Online ならルートを付け替えるまで）。
+// Online でなければ、古いページを解放し始めた後にI/Oエラーが起きると木の中身は失われる
+func (t *BTree) RebuildContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, opts RebuildOptions) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	capacity, err := nodeCapacity(opts.FillFactor)
+	if err != nil {
+		return err
+	}
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	pageIDs, err := Pages(bufmgr, t)
+	if err != nil {
+		return err
+	}
+	rootBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	rootPageID := rootBuffer.PageID
+	bufmgr.UnpinPage(rootBuffer)
+
+	// キーは格納されている形のまま（重複キーを許す木では連番付き）で読む
+	iter, err := t.seekPosition(ctx, bufmgr, resumePosition{mode: resumeStart})
+	if err != nil {
+		return err
+	}
+	var pairs []*Pair
+	for {
+		pair, err := iter.NextContext(ctx, bufmgr)
+		if err != nil {
+			iter.Close(bufmgr)
+			return err
+		}
+		if pair == nil {
+			break
+		}
+		pairs = append(pairs, pair)
+	}
+
+	if !opts.Online {
+		// 古いページを空きページにしてから組み立てれば、新しいページはIDの小さい空きページから埋まる
+		// ここから先は途中でやめると木が壊れる
+		ctx = context.WithoutCancel(ctx)
+		if err := t.removePages(ctx, bufmgr, pageIDs, rootPageID); err != nil {
+			return err
+		}
+	}
+
+	newRootBuffer, err := buildTree(ctx, bufmgr, pairs, flags, capacity)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(newRootBuffer)
+
+	ctx = context.WithoutCancel(ctx)
+	if err := t.swapRoot(ctx, bufmgr, rootPageID, newRootBuffer, flags); err != nil {
+		return err
+	}
+	if opts.Online {
+		return t.removePages(ctx, bufmgr, pageIDs, rootPageID)
+	}
+	return nil
+}
+
+// Truncate は木の全てのペアを消す
+// 空のリーフを新しいルートにしてから、それまでのページを空きページに戻す。
+// メタページのIDは変えないので、木を開き直す必要はない。古いルートの扱いは Rebuild と同じ。
+// NextSequence で払い出した連番は巻き戻さない
+func (t *BTree) Truncate(bufmgr *buffer.BufferPoolManager) error {
+	return t.TruncateContext(context.Background(), bufmgr)
+}
+
+// TruncateContext は Truncate と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// キャンセルを確かめるのは、ルートを付け替えるまで
+func (t *BTree) TruncateContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	pageIDs, err := Pages(bufmgr, t)
+	if err != nil {
+		return err
+	}
+	rootBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return err
+	}
+	rootPageID := rootBuffer.PageID
+	bufmgr.UnpinPage(rootBuffer)
+
+	newRootBuffer, err := createEmptyLeaf(ctx, bufmgr, flags)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(newRootBuffer)
+
+	ctx = context.WithoutCancel(ctx)
+	if err := t.swapRoot(ctx, bufmgr, rootPageID, newRootBuffer, flags); err != nil {
+		return err
+	}
+	return t.removePages(ctx, bufmgr, pageIDs, rootPageID)
+}
+
+// swapRoot はメタページのルートを newRootBuffer に付け替え、古いルートに印を付ける
+func (t *BTree) swapRoot(ctx context.Context, bufmgr *buffer.BufferPoolManager, rootPageID disk.PageID, newRootBuffer *buffer.Buffer, flags uint32) error {
+	metaBuffer, err := bufmgr.FetchPageContext(ctx, t.MetaPageID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(metaBuffer)
+	oldRootBuffer, err := fetchNode(ctx, bufmgr, rootPageID)
+	if err != nil {
+		return err
+	}
+	// メタページのルートを書き換えた時点で新しい木に切り替わる
+	t.setRoot(metaBuffer, oldRootBuffer, newRootBuffer, flags)
+	markRemovedNode(oldRootBuffer)
+	bufmgr.UnpinPage(oldRootBuffer)
+	return nil
+}
+
+// removePages は作り直す前の木のページに印を付けて空きページに戻す
+// メタページと古いルート rootPageID は残す（Rebuild のコメントを参照）
+// イテレータがピンしているページは解放できないが、印を付けておけば次の Next で降り直す
+func (t *BTree) removePages(ctx context.Context, bufmgr *buffer.BufferPoolManager, pageIDs []disk.PageID, rootPageID disk.PageID) error {
+	for _, pageID := range pageIDs {
+		if pageID == t.MetaPageID || pageID == rootPageID {
+			continue
+		}
+		pageBuffer, err := bufmgr.FetchPageContext(ctx, pageID)
+		if err != nil {
+			return err
+		}
+		markRemovedNode(pageBuffer)
+		bufmgr.UnpinPage(pageBuffer)
+		if err := bufmgr.FreePage(pageID); err != nil && !errors.Is(err, buffer.ErrPagePinned) {
+			return err
+		}
+	}
+	return nil
+}
+
+// buildTree はソート済みの pairs から各ページを capacity バイトまで詰めた木を組み立て、
+// ピンしたルートを返す。ルートの印は付けない
+func buildTree(ctx context.Context, bufmgr *buffer.BufferPoolManager, pairs []*Pair, flags uint32, capacity int) (*buffer.Buffer, error) {
+	if len(pairs) == 0 {
+		return createEmptyLeaf(ctx, bufmgr, flags)
+	}
+	nodes, err := buildLeaves(ctx, bufmgr, pairs, flags&MetaFlagDeltaValues != 0, capacity)
+	if err != nil {
+		return nil, err
+	}
+	for len(nodes) > 1 {
+		if nodes, err = buildBranches(ctx, bufmgr, nodes, capacity); err != nil {
+			return nil, err
+		}
+	}
+	return fetchNode(ctx, bufmgr, nodes[0].pageID)
+}
+
+// createEmptyLeaf はペアのないリーフを作る
+func createEmptyLeaf(ctx context.Context, bufmgr *buffer.BufferPoolManager, flags uint32) (*buffer.Buffer, error) {
+	leafBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	node := NewNode(leafBuffer.Page[:])
+	node.InitializeAsLeaf()
+	node.WriteHeader(leafBuffer.Page[:])
+	leaf := NewLeaf(leafBuffer.Page[NodeHeaderSize:])
+	if flags&MetaFlagDeltaValues != 0 {
+		leaf.initializeDelta(nil, nil)
+	} else {
+		leaf.Initialize()
+	}
+	leafBuffer.IsDirty = true
+	return leafBuffer, nil
+}
@@ -0,0 +1,133 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// エラー定義
+var (
+	ErrInvalidToken = errors.New("invalid resume token")
+)
+
+// 再開トークンのフォーマット:
+// [version: 1] [mode: 1] [prefix_len: 2] [prefix] [key]
+//
+// key は木に格納されているキーそのもの（重複キーを許す木では連番付き）なので、
+// 同じキーのエントリが複数あっても返した位置の直後から正確に再開できる
+// prefix は接頭辞検索の接頭辞で、再開した後も同じ接頭辞で止まる
+// バージョン1のトークンには prefix_len と prefix がない
+const resumeTokenVersion = 2
+
+// resumeMode は再開する位置の種類
+type resumeMode uint8
+
+const (
+	resumeStart resumeMode = iota // 先頭から
+	resumeAt                      // key 以上の最初のエントリから
+	resumeAfter                   // key より大きい最初のエントリから
+)
+
+// resumePosition はイテレータが次に返すエントリの位置
+// エントリそのものではなくキーで覚えておくので、間に挿入や削除があっても再開できる
+type resumePosition struct {
+	mode resumeMode
+	key  []byte
+}
+
+// startPosition は検索条件から最初の位置を作る
+func startPosition(search *Search) resumePosition {
+	switch search.Mode {
+	case SearchModeKey, SearchModePrefix:
+		return resumePosition{mode: resumeAt, key: search.Key}
+	case SearchModeKeyExclusive:
+		return resumePosition{mode: resumeAfter, key: search.Key}
+	}
+	return resumePosition{mode: resumeStart}
+}
+
+// Token はイテレータの現在位置を、後で Resume に渡せるバイト列にする
+// トークンは Next で最後に返したキーを覚えているだけなので、プロセスを再起動した後や
+// 間に書き込みがあった後でも、まだ返していないキーから続けて読める
+// 中身は不透明なものとして扱い、同じ木の Resume にだけ渡すこと
+func (it *Iter) Token() []byte {
+	token := make([]byte, 0, 4+len(it.prefix)+len(it.position.key))
+	token = append(token, resumeTokenVersion, byte(it.position.mode))
+	token = binary.BigEndian.AppendUint16(token, uint16(len(it.prefix)))
+	token = append(token, it.prefix...)
+	return append(token, it.position.key...)
+}
+
+// Resume は Token で書き出した位置から走査を再開するイテレータを返す
+// 壊れたトークンや未知のバージョンのトークンには ErrInvalidToken を返す
+func (t *BTree) Resume(bufmgr *buffer.BufferPoolManager, token []byte) (*Iter, error) {
+	return t.ResumeContext(context.Background(), bufmgr, token)
+}
+
+// ResumeContext は Resume と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) ResumeContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, token []byte) (*Iter, error) {
+	if len(token) < 2 || token[0] < 1 || token[0] > resumeTokenVersion || resumeMode(token[1]) > resumeAfter {
+		return nil, ErrInvalidToken
+	}
+	rest := token[2:]
+	var prefix []byte
+	if token[0] >= 2 {
+		if len(rest) < 2 || len(rest)-2 < int(binary.BigEndian.Uint16(rest)) {
+			return nil, ErrInvalidToken
+		}
+		n := int(binary.BigEndian.Uint16(rest))
+		if n > 0 {
+			prefix = append([]byte{}, rest[2:2+n]...)
+		}
+		rest = rest[2+n:]
+	}
+	position := resumePosition{mode: resumeMode(token[1]), key: append([]byte{}, rest...)}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+
+	// キーは格納されている形のままなので、SearchContext のような変換はしない
+	iter, err := t.seekPosition(ctx, bufmgr, position)
+	if err != nil {
+		return nil, err
+	}
+	iter.duplicates = flags&MetaFlagDuplicates != 0
+	iter.prefix = prefix
+	return iter, nil
+}
+
+// seekPosition は position から走査を始めるイテレータを返す
+// position のキーは格納されている形のままで扱う
+func (t *BTree) seekPosition(ctx context.Context, bufmgr *buffer.BufferPoolManager, position resumePosition) (*Iter, error) {
+	search := NewSearchStart()
+	if position.mode != resumeStart {
+		search = NewSearchKey(position.key)
+	}
+	rootBuffer, err := t.fetchRootPage(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := t.searchInternal(ctx, bufmgr, rootBuffer, search)
+	if err != nil {
+		return nil, err
+	}
+	iter.position = position
+
+	if position.mode == resumeAfter {
+		if pair := iter.get(); pair != nil && bytes.Equal(pair.Key, position.key) {
+			if err := iter.advance(ctx, bufmgr); err != nil {
+				iter.Close(bufmgr)
+				return nil, err
+			}
+		}
+	}
+	return iter, nil
+}
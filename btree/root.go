@@ -0,0 +1,83 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// treeCache はメタページから読んだ内容のうち、操作のたびに読み直さなくてよいもの
+//
+// 設定は作成後に変わらないのでそのまま使う。ルートは分割で変わるので、キャッシュした
+// ページを取得してルートの印（NodeFlagRoot）を確かめてから使い、印がなければ
+// メタページを読み直す。ルートを分割するときは古いルートの印を外すので、
+// 別の BTree の値から分割されてもキャッシュが古いことが分かる
+type treeCache struct {
+	rootPageID disk.PageID // 最後に読んだルート。ルートの印がないと分かれば InvalidPageID
+	flags      uint32      // MetaFlag の組み合わせ
+}
+
+// flags は木の設定（MetaFlag の組み合わせ）を返す
+// メタページを読んだらルートも覚えておくので、続く fetchRootPage はメタページを読み直さない
+func (t *BTree) flags(ctx context.Context, bufmgr *buffer.BufferPoolManager) (uint32, error) {
+	if cache := t.cache.Load(); cache != nil {
+		return cache.flags, nil
+	}
+	meta, err := t.readMeta(ctx, bufmgr)
+	if err != nil {
+		return 0, err
+	}
+	t.cache.Store(&treeCache{rootPageID: meta.RootPageID, flags: meta.Flags})
+	return meta.Flags, nil
+}
+
+// fetchRootPage はルートページを取得する
+// ページがバッファプールにあってもディスクI/Oが起きないため、先に ctx を確認する
+// キャッシュしたルートがまだルートなら、メタページは読まない
+func (t *BTree) fetchRootPage(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*buffer.Buffer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if cache := t.cache.Load(); cache != nil && cache.rootPageID != InvalidPageID {
+		rootBuffer, err := fetchNode(ctx, bufmgr, cache.rootPageID)
+		if err != nil {
+			return nil, err
+		}
+		if isRootNode(rootBuffer.Page[:]) {
+			return rootBuffer, nil
+		}
+		// ルートが分割されて別のページに移っている
+		bufmgr.UnpinPage(rootBuffer)
+	}
+
+	meta, err := t.readMeta(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	rootBuffer, err := fetchNode(ctx, bufmgr, meta.RootPageID)
+	if err != nil {
+		return nil, err
+	}
+	cache := &treeCache{rootPageID: meta.RootPageID, flags: meta.Flags}
+	if !isRootNode(rootBuffer.Page[:]) {
+		// 印のない以前のファイルの木は、ルートが分割されるまで毎回メタページを読む
+		cache.rootPageID = InvalidPageID
+	}
+	t.cache.Store(cache)
+	return rootBuffer, nil
+}
+
+// setRoot はメタページのルートを rootBuffer に置き換え、印とキャッシュを付け替える
+// oldRootBuffer は置き換える前のルート
+func (t *BTree) setRoot(metaBuffer, oldRootBuffer, rootBuffer *buffer.Buffer, flags uint32) {
+	meta := NewMeta(metaBuffer.Page[:])
+	meta.Header.RootPageID = rootBuffer.PageID
+	meta.Sync()
+	setRootNode(oldRootBuffer.Page[:], false)
+	setRootNode(rootBuffer.Page[:], true)
+	metaBuffer.IsDirty = true
+	oldRootBuffer.IsDirty = true
+	rootBuffer.IsDirty = true
+	t.cache.Store(&treeCache{rootPageID: rootBuffer.PageID, flags: flags})
+}
@@ -0,0 +1,36 @@
+//go:build go1.23
+
+package btree
+
+import (
+	"iter"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// All はイテレータの残りのキーと値を返す range over func 用のイテレータを返す
+// ループが終わると（途中で抜けた場合も）イテレータを Close する。
+// 読み込みに失敗したらループを終わらせ、エラーは Err で返す
+//
+//	it, _ := tree.Search(bufmgr, btree.NewSearchPrefix(prefix))
+//	for key, value := range it.All(bufmgr) {
+//	    ...
+//	}
+//	if err := it.Err(); err != nil {
+//	    ...
+//	}
+func (it *Iter) All(bufmgr *buffer.BufferPoolManager) iter.Seq2[[]byte, []byte] {
+	return func(yield func([]byte, []byte) bool) {
+		defer it.Close(bufmgr)
+		for {
+			pair, err := it.Next(bufmgr)
+			if err != nil {
+				it.err = err
+				return
+			}
+			if pair == nil || !yield(pair.Key, pair.Value) {
+				return
+			}
+		}
+	}
+}
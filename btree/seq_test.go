@@ -0,0 +1,76 @@
+//go:build go1.23
+
+package btree
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+func TestBTreeAll(t *testing.T) {
+	diskMgr := disk.NewMemManager()
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(diskMgr, buffer.NewBufferPool(8), buffer.Options{
+		TrackPins: true,
+	})
+	tree, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	n := 3000
+	for i := 0; i < n; i++ {
+		if err := tree.Insert(bufmgr, []byte(fmt.Sprintf("key%05d", i)), []byte(fmt.Sprintf("value%d", i))); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// all は木の先頭から読むイテレータを返す
+	all := func() *Iter {
+		t.Helper()
+		it, err := tree.Search(bufmgr, NewSearchStart())
+		if err != nil {
+			t.Fatalf("failed to search: %v", err)
+		}
+		return it
+	}
+
+	i := 0
+	it := all()
+	for key, value := range it.All(bufmgr) {
+		if string(key) != fmt.Sprintf("key%05d", i) || string(value) != fmt.Sprintf("value%d", i) {
+			t.Fatalf("unexpected pair %s=%s at %d", key, value, i)
+		}
+		i++
+	}
+	if i != n || it.Err() != nil {
+		t.Errorf("expected %d pairs, got %d (%v)", n, i, it.Err())
+	}
+
+	// 途中で抜けてもピンが残らない
+	for key := range all().All(bufmgr) {
+		if string(key) == "key00010" {
+			break
+		}
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after break: %v", leaks)
+	}
+
+	// 読み込みのエラーは Err で分かる
+	it = all()
+	diskMgr.InjectFaults(disk.Faults{FailReadAt: 1})
+	count := 0
+	for range it.All(bufmgr) {
+		count++
+	}
+	diskMgr.InjectFaults(disk.Faults{})
+	if !errors.Is(it.Err(), disk.ErrInjectedFault) || count == 0 || count == n {
+		t.Errorf("expected the loop to stop with an injected fault, got %v after %d pairs", it.Err(), count)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after error: %v", leaks)
+	}
+}
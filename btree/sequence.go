@@ -0,0 +1,38 @@
+package btree
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// NextSequence はメタページの連番を1つ払い出す。最初は0を返し、呼ぶたびに1つ増える
+// 連番はメタページに記録されるので、ページを書き戻せば開き直しても続きから払い出す。
+// 自動採番のキーを作るのに使う。重複キーを許す木では連番をエントリの区別に使うので
+// ErrDuplicatesAllowed を返す
+func (t *BTree) NextSequence(bufmgr *buffer.BufferPoolManager) (uint64, error) {
+	return t.NextSequenceContext(context.Background(), bufmgr)
+}
+
+// NextSequenceContext は NextSequence と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *BTree) NextSequenceContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (uint64, error) {
+	flags, err := t.flags(ctx, bufmgr)
+	if err != nil {
+		return 0, err
+	}
+	if flags&MetaFlagDuplicates != 0 {
+		return 0, ErrDuplicatesAllowed
+	}
+	metaBuffer, err := bufmgr.FetchPageContext(ctx, t.MetaPageID)
+	if err != nil {
+		return 0, err
+	}
+	defer bufmgr.UnpinPage(metaBuffer)
+
+	meta := NewMeta(metaBuffer.Page[:])
+	seq := meta.Header.NextSequence
+	meta.Header.NextSequence++
+	meta.Sync()
+	metaBuffer.IsDirty = true
+	return seq, nil
+}
@@ -0,0 +1,208 @@
+package btree
+
+import (
+	"fmt"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// TreeStats は木の形とページの使用状況
+type TreeStats struct {
+	Height      int          // ルートからリーフまでの段数（リーフだけなら1）
+	LeafPages   int          // リーフページ数
+	BranchPages int          // ブランチページ数
+	Pairs       int          // キー・値ペアの総数
+	Levels      []LevelStats // 段ごとの統計（0がルート）
+	MinKey      []byte       // 最小のキー（空の木なら nil）
+	MaxKey      []byte       // 最大のキー（空の木なら nil）
+}
+
+// LevelStats は木の1段分の統計
+type LevelStats struct {
+	Pages      int     // この段のページ数
+	Entries    int     // リーフならペア数、ブランチならキー数の合計
+	FillFactor float64 // 使用中のバイト数 ÷ ページ本体のバイト数 の平均（0〜1）
+}
+
+// Stats は木全体を辿って TreeStats を集める
+func Stats(bufmgr *buffer.BufferPoolManager, tree *BTree) (*TreeStats, error) {
+	stats := &TreeStats{}
+	used := []int{}
+	total := []int{}
+
+	err := walkLevels(bufmgr, tree, func(n *nodeInfo) error {
+		if n.level == len(stats.Levels) {
+			stats.Levels = append(stats.Levels, LevelStats{})
+			used = append(used, 0)
+			total = append(total, 0)
+		}
+		level := &stats.Levels[n.level]
+		level.Pages++
+		level.Entries += n.numEntries
+		used[n.level] += n.usedBytes
+		total[n.level] += n.totalBytes
+
+		if !n.isLeaf {
+			stats.BranchPages++
+			return nil
+		}
+		stats.LeafPages++
+		stats.Pairs += n.numEntries
+		if n.numEntries > 0 {
+			// リーフはキー順に訪れるので、最初と最後に見たものが最小と最大
+			if stats.MinKey == nil {
+				stats.MinKey = n.firstKey
+			}
+			stats.MaxKey = n.lastKey
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stats.Height = len(stats.Levels)
+	for i := range stats.Levels {
+		if total[i] > 0 {
+			stats.Levels[i].FillFactor = float64(used[i]) / float64(total[i])
+		}
+	}
+	return stats, nil
+}
+
+// PageCount は木のページ数（メタページ・ブランチ・リーフ）を返す
+// 最も左の道を降りて高さを調べた後はブランチだけを読み、最下段のブランチの子の数をリーフの数とする。
+// リーフを全て読む Stats や Pages よりずっと少ないページで済む。オーバーフローページは数えない
+func PageCount(bufmgr *buffer.BufferPoolManager, tree *BTree) (int, error) {
+	metaBuffer, err := bufmgr.FetchPage(tree.MetaPageID)
+	if err != nil {
+		return 0, err
+	}
+	rootPageID := NewMeta(metaBuffer.Page[:]).Header.RootPageID
+	bufmgr.UnpinPage(metaBuffer)
+
+	height := 1
+	for pageID := rootPageID; ; height++ {
+		info, err := readNodeInfo(bufmgr, pageID)
+		if err != nil {
+			return 0, err
+		}
+		if info.isLeaf {
+			break
+		}
+		pageID = info.children[0]
+	}
+
+	pages := 1
+	current := []disk.PageID{rootPageID}
+	for level := 0; level < height-1; level++ {
+		var next []disk.PageID
+		for _, pageID := range current {
+			info, err := readNodeInfo(bufmgr, pageID)
+			if err != nil {
+				return 0, err
+			}
+			next = append(next, info.children...)
+		}
+		pages += len(current)
+		current = next
+	}
+	return pages + len(current), nil
+}
+
+// String は TreeStats を人が読める形にする
+func (s *TreeStats) String() string {
+	out := fmt.Sprintf("height=%d leaves=%d branches=%d pairs=%d min=%q max=%q",
+		s.Height, s.LeafPages, s.BranchPages, s.Pairs, s.MinKey, s.MaxKey)
+	for i, level := range s.Levels {
+		out += fmt.Sprintf("\nlevel %d: pages=%d entries=%d fill=%.1f%%", i, level.Pages, level.Entries, level.FillFactor*100)
+	}
+	return out
+}
+
+// nodeInfo は walkLevels が訪れたノードの要約
+type nodeInfo struct {
+	pageID     disk.PageID
+	level      int
+	isLeaf     bool
+	numEntries int    // リーフならペア数、ブランチならキー数
+	usedBytes  int    // ページ本体のうち空き領域以外のバイト数
+	totalBytes int    // ページ本体のバイト数
+	firstKey   []byte // 最初のキー（エントリがなければ nil）
+	lastKey    []byte // 最後のキー（エントリがなければ nil）
+	children   []disk.PageID
+	next       *disk.PageID // リーフの次のリーフ
+}
+
+// walkLevels はルートから1段ずつ、各段を左から右へノードを訪れる
+// リーフの段ではキーの順に訪れることになる
+func walkLevels(bufmgr *buffer.BufferPoolManager, tree *BTree, visit func(*nodeInfo) error) error {
+	metaBuffer, err := bufmgr.FetchPage(tree.MetaPageID)
+	if err != nil {
+		return err
+	}
+	rootPageID := NewMeta(metaBuffer.Page[:]).Header.RootPageID
+	bufmgr.UnpinPage(metaBuffer)
+
+	current := []disk.PageID{rootPageID}
+	for level := 0; len(current) > 0; level++ {
+		var next []disk.PageID
+		for _, pageID := range current {
+			info, err := readNodeInfo(bufmgr, pageID)
+			if err != nil {
+				return err
+			}
+			info.level = level
+			if err := visit(info); err != nil {
+				return err
+			}
+			next = append(next, info.children...)
+		}
+		current = next
+	}
+	return nil
+}
+
+// readNodeInfo はページを読んで nodeInfo を作る
+func readNodeInfo(bufmgr *buffer.BufferPoolManager, pageID disk.PageID) (*nodeInfo, error) {
+	nodeBuffer, err := bufmgr.FetchPage(pageID)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(nodeBuffer)
+
+	info := &nodeInfo{pageID: pageID}
+	node := NewNode(nodeBuffer.Page[:])
+	switch node.Header.NodeType {
+	case NodeTypeLeaf:
+		leaf := NewLeaf(nodeBuffer.Page[NodeHeaderSize:])
+		info.isLeaf = true
+		info.numEntries = leaf.NumPairs()
+		info.totalBytes = len(leaf.data)
+		info.usedBytes = len(leaf.data) - leaf.freeSpace()
+		if n := leaf.NumPairs(); n > 0 {
+			info.firstKey = leaf.keyAt(0)
+			info.lastKey = leaf.keyAt(n - 1)
+		}
+		info.next = leaf.NextPageID()
+
+	case NodeTypeBranch:
+		branch := NewBranch(nodeBuffer.Page[NodeHeaderSize:])
+		info.numEntries = branch.NumKeys()
+		info.totalBytes = len(branch.data)
+		info.usedBytes = len(branch.data) - branch.freeSpace()
+		if n := branch.NumKeys(); n > 0 {
+			info.firstKey = append([]byte{}, branch.KeyAt(0)...)
+			info.lastKey = append([]byte{}, branch.KeyAt(n-1)...)
+		}
+		info.children = make([]disk.PageID, branch.NumChildren())
+		for i := range info.children {
+			info.children[i] = branch.ChildAt(i)
+		}
+
+	default:
+		return nil, fmt.Errorf("page %d: invalid node type %d", pageID, node.Header.NodeType)
+	}
+	return info, nil
+}
@@ -0,0 +1,72 @@
+package btree
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// strict は厳格モードが有効かどうか
+var strict atomic.Bool
+
+// SetStrict は厳格モードを切り替える
+//
+// 厳格モードでは、操作がノードを読むたびと書き換えるたびにそのページ単体の不変条件
+// （ノードの種類・スロットとデータ領域の範囲・ページ内のキーの順序）を確認し、
+// 破れていれば操作をその場で *CheckError（ErrCorrupted）で失敗させる。
+// 木全体を辿る Check と違い、壊した直後の操作で壊れたページが分かる。
+// 学習用にノードの処理を書き換えるときに使う。全ての操作が遅くなる
+func SetStrict(enabled bool) {
+	strict.Store(enabled)
+}
+
+// Strict は厳格モードが有効かを返す
+func Strict() bool {
+	return strict.Load()
+}
+
+// verifyPage は厳格モードならノードのページ単体の不変条件を確認する
+// 区切りキーとの関係やリーフのリンクなど、他のページが必要な確認は Check に任せる
+func verifyPage(pageID disk.PageID, page []byte) error {
+	if !strict.Load() {
+		return nil
+	}
+	c := &checker{leafDepth: -1}
+	node := NewNode(page)
+	switch node.Header.NodeType {
+	case NodeTypeLeaf:
+		c.checkLeaf(pageID, NewLeaf(page[NodeHeaderSize:]), nil, nil, 0)
+	case NodeTypeBranch:
+		c.checkBranch(pageID, NewBranch(page[NodeHeaderSize:]), nil, nil)
+	default:
+		c.report(pageID, "invalid node type %d", node.Header.NodeType)
+	}
+	return errors.Join(c.errs...)
+}
+
+// fetchNode はノードのページを取得する
+// 厳格モードでページが壊れていれば、ピンを外してエラーを返す
+func fetchNode(ctx context.Context, bufmgr *buffer.BufferPoolManager, pageID disk.PageID) (*buffer.Buffer, error) {
+	nodeBuffer, err := bufmgr.FetchPageContext(ctx, pageID)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyPage(pageID, nodeBuffer.Page[:]); err != nil {
+		bufmgr.UnpinPage(nodeBuffer)
+		return nil, err
+	}
+	return nodeBuffer, nil
+}
+
+// verifyPages は書き換えたページをまとめて verifyPage で確認する
+func verifyPages(buffers ...*buffer.Buffer) error {
+	for _, b := range buffers {
+		if err := verifyPage(b.PageID, b.Page[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package btree
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// イテレータはリーフのピンとスロット番号で位置を覚えているので、Next の間に
+// 同じリーフへの挿入・削除・分割があると、スロットがずれてキーを読み飛ばしたり
+// 2回返したりする。そこで Next のたびに、現在位置が「最後に返したキーの直後」を
+// まだ指しているかを確かめ、ずれていればキーで木を降り直す（再開トークンと同じ）
+//
+// スロットの手前のキーがもう返したキーで、スロットのキーがまだ返していないキーなら、
+// リーフの中の位置は正しい。リーフの先頭にいるときは手前のキーがないので、
+// リーフに入ったときの prev リンクが変わっていないことを確かめる
+// （分割で前半が新しいリーフに移ると、そのリーフが prev に入る）。併合で木から外された
+// リーフにいるときは、中身が変わっていなくても降り直す（rebalance.go）
+
+// leafPrev はリーフの前のリーフのページIDを返す。なければ InvalidPageID
+func leafPrev(leaf *Leaf) disk.PageID {
+	if prevPageID := leaf.PrevPageID(); prevPageID != nil {
+		return *prevPageID
+	}
+	return InvalidPageID
+}
+
+// compareKeyAt はスロットのキー（接頭辞を含む）と key を比べる
+// キーはコピーせずにリーフの中で比べる
+func (l *Leaf) compareKeyAt(slotID int, key []byte) int {
+	prefix := l.Prefix()
+	n := min(len(prefix), len(key))
+	if c := bytes.Compare(prefix[:n], key[:n]); c != 0 {
+		return c
+	}
+	if len(prefix) > len(key) {
+		return 1
+	}
+	return bytes.Compare(l.KeyAt(slotID), key[len(prefix):])
+}
+
+// wants はスロットのキーが、この位置から先で返すべきキーかを返す
+func (p resumePosition) wants(leaf *Leaf, slotID int) bool {
+	switch p.mode {
+	case resumeAt:
+		return leaf.compareKeyAt(slotID, p.key) >= 0
+	case resumeAfter:
+		return leaf.compareKeyAt(slotID, p.key) > 0
+	}
+	return true
+}
+
+// valid は現在位置が position の直後をまだ指しているかを返す
+func (it *Iter) valid() bool {
+	if isRemovedNode(it.buffer.Page[:]) {
+		return false
+	}
+	leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
+	next := it.slotID
+	if it.pending {
+		next++
+	}
+	numPairs := leaf.NumPairs()
+	if next > numPairs {
+		return false
+	}
+	if next < numPairs && !it.position.wants(leaf, next) {
+		return false
+	}
+	if next == 0 {
+		return leafPrev(leaf) == it.prevPageID
+	}
+	return !it.position.wants(leaf, next-1)
+}
+
+// revalidate は前回の Next の後にリーフが書き換えられて位置がずれていれば、
+// position から木を降り直す
+func (it *Iter) revalidate(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	if it.buffer == nil || it.tree == nil || it.valid() {
+		return nil
+	}
+	it.readAhead.stop()
+	bufmgr.UnpinPage(it.buffer)
+	it.buffer = nil
+
+	// キーだけのスキャンで返したペアに留まっているなら、そのペアに戻る
+	position := it.position
+	if it.pending {
+		position.mode = resumeAt
+	}
+	fresh, err := it.tree.seekPosition(ctx, bufmgr, position)
+	if err != nil {
+		it.pending = false
+		return err
+	}
+	it.buffer, it.slotID, it.prevPageID = fresh.buffer, fresh.slotID, fresh.prevPageID
+	if it.pending {
+		leaf := NewLeaf(it.buffer.Page[NodeHeaderSize:])
+		it.pending = it.slotID < leaf.NumPairs() && leaf.compareKeyAt(it.slotID, it.position.key) == 0
+	}
+	it.readAhead = readAhead{disabled: it.readAhead.disabled, async: it.readAhead.async}
+	if it.readAhead.async > 0 {
+		it.readAhead.startAsync(bufmgr, it.buffer)
+	}
+	return nil
+}
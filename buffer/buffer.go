@@ -1,7 +1,11 @@
 package buffer
 
 import (
+	"context"
 	"errors"
+	"slices"
+	"sync"
+	"time"
 
 	"github.com/kkumaki12/minidb/disk"
 )
@@ -22,7 +26,10 @@ type Buffer struct {
 	PageID   disk.PageID // このバッファが保持しているページのID
 	Page     Page        // ページデータ本体
 	IsDirty  bool        // ディスクに書き戻す必要があるか
+	PageLSN  LSN         // このページへの最後の変更を記録したログレコードの LSN（MarkDirty で設定）
+	recLSN   LSN         // 最後に書き戻してから最初の変更の LSN
 	refCount int         // 参照カウント（0なら evict 可能）
+	noSteal  bool        // dirty の間は追い出さない（Options.NoSteal で MarkNoSteal したページ）
 	isValid  bool        // このバッファが有効なページを保持しているか
 }
 
@@ -69,13 +76,19 @@ func (p *BufferPool) Evict() (BufferID, error) {
 		nextVictimID := p.nextVictimID
 		frame := &p.frames[nextVictimID]
 
+		// 追い出せないフレームはピンされているものとして扱う
+		evictable := frame.Buffer.refCount == 0 && !(frame.Buffer.noSteal && frame.Buffer.IsDirty)
+
 		// UsageCountが0なら、このフレームを置換対象とする
-		if frame.UsageCount == 0 {
+		// 針は次のフレームに進めておく。進めないと、次の Evict で読み込んだばかりの
+		// ページの UsageCount をすぐに減らしてしまい、2度目の機会が公平に回らない
+		if frame.UsageCount == 0 && evictable {
+			p.nextVictimID = p.incrementID(nextVictimID)
 			return nextVictimID, nil
 		}
 
 		// 参照カウントが0（誰も使っていない）ならUsageCountを減らす
-		if frame.Buffer.refCount == 0 {
+		if evictable {
 			frame.UsageCount--
 			consecutivePinned = 0
 		} else {
@@ -96,116 +109,529 @@ func (p *BufferPool) incrementID(bufferID BufferID) BufferID {
 	return BufferID((int(bufferID) + 1) % p.Size())
 }
 
+// Options はBufferPoolManagerの動作を設定する
+type Options struct {
+	// WaitForFrame が true の場合、全てのフレームがピンされていても
+	// すぐに ErrNoFreeBuffer を返さず、いずれかのピンが外れるまで待つ
+	WaitForFrame bool
+	// WaitTimeout は空きフレームを待つ時間の上限（0なら上限なし）
+	// 上限を超えた場合は ErrNoFreeBuffer を返す
+	WaitTimeout time.Duration
+	// Partitions はバッファプールを分ける数（0なら1）
+	// ページはページIDで決まるパーティションのフレームにだけ置かれ、パーティションごとに
+	// ページテーブル・ロック・Clock-sweep の針を持つ。複数の goroutine が別々のページを
+	// 読むときにロックを取り合わずに済む。フレームの数より多くは分けない
+	Partitions int
+	// FlushLog を指定すると、ページを書き戻す前にそのページの PageLSN を渡して呼ぶ
+	// WAL を使う場合はここでその LSN までのログを書き戻す（WAL の規則）
+	// エラーを返すとページは書き戻さない
+	FlushLog func(lsn LSN) error
+	// TrackPins を有効にすると、ピンを取るたびにスタックトレースを記録する
+	// PinLeaks でピンが外れていないページとその場所が分かる。遅いのでデバッグ用
+	TrackPins bool
+	// OnPinLeak を指定すると、Flush の後にピンされたままのページがあれば呼ぶ
+	OnPinLeak func(leaks []PinLeak)
+	// OnEvict を指定すると、ページをプールから追い出すたびに呼ぶ
+	// wasDirty は追い出す前に書き戻したかどうか。パーティションのロックを持ったまま呼ぶので、
+	// バッファプールを操作してはいけない
+	OnEvict func(pageID disk.PageID, wasDirty bool)
+	// NoSteal を有効にすると、MarkNoSteal したページは dirty の間は追い出さず、
+	// Flush でも書き戻さない（no-steal）。取り消しログなしでは書けない未確定の変更を
+	// ディスクに書かないために使う。ピンと同じくフレームを塞ぐので、使い終わったら ClearNoSteal する
+	NoSteal bool
+}
+
 // BufferPoolManager はバッファプールとディスクマネージャを管理する
+// 複数のgoroutineから呼び出してもよいが、バッファの中身（Page）の
+// 読み書きの排他は呼び出し側の責任とする
 type BufferPoolManager struct {
+	disk       *disk.DiskManager
+	opts       Options
+	partitions []*partition
+	allocMu    sync.Mutex // disk.AllocatePage を保護する
+}
+
+// partition はバッファプールを分けた1つ
+// ページID % パーティション数 が自分の番号になるページだけを置く
+type partition struct {
 	disk      *disk.DiskManager
+	opts      Options
 	pool      *BufferPool
 	pageTable map[disk.PageID]BufferID // ページIDからバッファIDへのマッピング
+
+	mu         sync.Mutex           // pool と pageTable を保護する
+	frameFreed chan struct{}        // ピンが外れてフレームが空いたら close される
+	stats      Stats                // 累計の統計（mu で保護する）
+	pins       map[*Buffer][]string // Options.TrackPins で記録したピンの場所
+}
+
+// Stats はバッファプールの累計の統計
+// 2つの時点の差を取れば、その間の操作がどれだけI/Oを発生させたかが分かる
+type Stats struct {
+	Hits   uint64        // FetchPage でページがプール上にあった回数
+	Misses uint64        // FetchPage でディスクから読み込んだ回数
+	Reads  uint64        // ディスクから読んだページ数（先読みを含む）
+	Writes uint64        // ディスクに書いたページ数
+	IOTime time.Duration // ディスクの読み書きにかかった時間の合計
+}
+
+// Sub は s から before を引いた差分を返す
+func (s Stats) Sub(before Stats) Stats {
+	return Stats{
+		Hits:   s.Hits - before.Hits,
+		Misses: s.Misses - before.Misses,
+		Reads:  s.Reads - before.Reads,
+		Writes: s.Writes - before.Writes,
+		IOTime: s.IOTime - before.IOTime,
+	}
+}
+
+// add は s に other を足す
+func (s *Stats) add(other Stats) {
+	s.Hits += other.Hits
+	s.Misses += other.Misses
+	s.Reads += other.Reads
+	s.Writes += other.Writes
+	s.IOTime += other.IOTime
 }
 
 // NewBufferPoolManager は新しいBufferPoolManagerを作成する
 func NewBufferPoolManager(diskManager *disk.DiskManager, pool *BufferPool) *BufferPoolManager {
-	return &BufferPoolManager{
-		disk:      diskManager,
-		pool:      pool,
-		pageTable: make(map[disk.PageID]BufferID),
+	return NewBufferPoolManagerWithOptions(diskManager, pool, Options{})
+}
+
+// NewBufferPoolManagerWithOptions は動作を指定してBufferPoolManagerを作成する
+// opts.Partitions が2以上なら、pool のフレームをパーティションの数に均等に分ける
+func NewBufferPoolManagerWithOptions(diskManager *disk.DiskManager, pool *BufferPool, opts Options) *BufferPoolManager {
+	n := min(max(opts.Partitions, 1), max(pool.Size(), 1))
+	m := &BufferPoolManager{
+		disk:       diskManager,
+		opts:       opts,
+		partitions: make([]*partition, n),
 	}
+	for i := range m.partitions {
+		subPool := pool
+		if n > 1 {
+			subPool = &BufferPool{frames: pool.frames[i*pool.Size()/n : (i+1)*pool.Size()/n]}
+		}
+		m.partitions[i] = &partition{
+			disk:       diskManager,
+			opts:       opts,
+			pool:       subPool,
+			pageTable:  make(map[disk.PageID]BufferID),
+			frameFreed: make(chan struct{}),
+		}
+	}
+	return m
+}
+
+// partitionOf はページを置くパーティションを返す
+// 連続するページIDは別々のパーティションに分かれるので、スキャンでも偏らない
+func (m *BufferPoolManager) partitionOf(pageID disk.PageID) *partition {
+	return m.partitions[uint64(pageID)%uint64(len(m.partitions))]
 }
 
 // FetchPage は指定されたページIDのバッファを取得する
 // キャッシュにあればそれを返し、なければディスクから読み込む
 func (m *BufferPoolManager) FetchPage(pageID disk.PageID) (*Buffer, error) {
-	// ページテーブルにあればキャッシュヒット
-	if bufferID, ok := m.pageTable[pageID]; ok {
-		frame := &m.pool.frames[bufferID]
-		frame.UsageCount++
-		frame.Buffer.refCount++
-		return frame.Buffer, nil
-	}
+	return m.FetchPageContext(context.Background(), pageID)
+}
 
-	// キャッシュミス：置換対象を探す
-	bufferID, err := m.pool.Evict()
-	if err != nil {
-		return nil, err
-	}
+// FetchPageContext は FetchPage と同じだが、空きフレームを待っている間に
+// ctx がキャンセルされた場合は ctx.Err() を返す
+func (m *BufferPoolManager) FetchPageContext(ctx context.Context, pageID disk.PageID) (*Buffer, error) {
+	p := m.partitionOf(pageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
 
-	frame := &m.pool.frames[bufferID]
-	evictPageID := frame.Buffer.PageID
-	wasValid := frame.Buffer.isValid
+	var deadline time.Time
+	for {
+		// ページテーブルにあればキャッシュヒット
+		if bufferID, ok := p.pageTable[pageID]; ok {
+			frame := &p.pool.frames[bufferID]
+			frame.UsageCount++
+			frame.Buffer.refCount++
+			p.stats.Hits++
+			p.recordPin(frame.Buffer)
+			return frame.Buffer, nil
+		}
 
-	// 古いバッファがdirtyなら書き戻す
-	if wasValid && frame.Buffer.IsDirty {
-		if err := m.disk.WritePageData(evictPageID, frame.Buffer.Page[:]); err != nil {
+		// キャッシュミス：ディスクから読み込む
+		frame, err := p.loadPage(ctx, pageID)
+		if err == nil {
+			frame.Buffer.refCount = 1
+			p.stats.Misses++
+			p.recordPin(frame.Buffer)
+			return frame.Buffer, nil
+		}
+		if err != ErrNoFreeBuffer {
+			return nil, err
+		}
+		// 待っている間に他のgoroutineが同じページを読み込むかもしれないので最初からやり直す
+		if err := p.waitForFrame(ctx, &deadline); err != nil {
 			return nil, err
 		}
 	}
+}
 
-	// 新しいページをディスクから読み込む
-	frame.Buffer.PageID = pageID
-	frame.Buffer.IsDirty = false
-	frame.Buffer.isValid = true
-	if err := m.disk.ReadPageData(pageID, frame.Buffer.Page[:]); err != nil {
-		return nil, err
+// waitForFrame はパーティションのいずれかのフレームのピンが外れるまで待つ
+// WaitForFrame が無効なら待たずに ErrNoFreeBuffer を返す
+// deadline は最初に待ち始めた時に WaitTimeout から決まり、以降の待ちでも共有する
+// 呼び出し時は p.mu を保持していること。待っている間だけ p.mu を解放する
+func (p *partition) waitForFrame(ctx context.Context, deadline *time.Time) error {
+	if !p.opts.WaitForFrame {
+		return ErrNoFreeBuffer
 	}
-	frame.UsageCount = 1
-	frame.Buffer.refCount = 1
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var timeout <-chan time.Time
+	if p.opts.WaitTimeout > 0 {
+		if deadline.IsZero() {
+			*deadline = time.Now().Add(p.opts.WaitTimeout)
+		}
+		remaining := time.Until(*deadline)
+		if remaining <= 0 {
+			return ErrNoFreeBuffer
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	frameFreed := p.frameFreed
+	p.mu.Unlock()
+	defer p.mu.Lock()
+
+	select {
+	case <-frameFreed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeout:
+		return ErrNoFreeBuffer
+	}
+}
 
-	// ページテーブルを更新（有効だったバッファのみ削除）
-	if wasValid {
-		delete(m.pageTable, evictPageID)
+// UnpinPage はバッファのピン（参照カウント）を1つ外す
+// FetchPage / CreatePage で取得したバッファは、使い終わったらこれで解放する
+// 参照カウントが0になったバッファは置換対象になり得る
+func (m *BufferPoolManager) UnpinPage(buffer *Buffer) {
+	p := m.partitionOf(buffer.PageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if buffer.refCount > 0 {
+		buffer.refCount--
+		p.recordUnpin(buffer)
+	}
+	if buffer.refCount == 0 {
+		// 空きフレームを待っているgoroutineを全て起こす
+		close(p.frameFreed)
+		p.frameFreed = make(chan struct{})
 	}
-	m.pageTable[pageID] = bufferID
+}
 
+// PrefetchPage は指定されたページをピンせずにバッファプールへ読み込む
+// 既にキャッシュにあれば何もしない。シーケンシャルスキャンの先読みに使う
+//
+// 返されるバッファはピンされていないため、次にバッファプールを操作するまでの間
+// （次のリーフのページIDを読む程度）しか使ってはいけない
+func (m *BufferPoolManager) PrefetchPage(pageID disk.PageID) (*Buffer, error) {
+	p := m.partitionOf(pageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if bufferID, ok := p.pageTable[pageID]; ok {
+		return p.pool.frames[bufferID].Buffer, nil
+	}
+	frame, err := p.loadPage(context.Background(), pageID)
+	if err != nil {
+		return nil, err
+	}
 	return frame.Buffer, nil
 }
 
-// CreatePage は新しいページを作成してバッファを返す
-func (m *BufferPoolManager) CreatePage() (*Buffer, error) {
-	// 置換対象を探す
-	bufferID, err := m.pool.Evict()
+// Contains は指定されたページがバッファプール上にあるかを返す
+func (m *BufferPoolManager) Contains(pageID disk.PageID) bool {
+	p := m.partitionOf(pageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	_, ok := p.pageTable[pageID]
+	return ok
+}
+
+// loadPage は置換対象のフレームにディスクからページを読み込む
+// 読み込んだフレームはピンされていない状態で返す
+func (p *partition) loadPage(ctx context.Context, pageID disk.PageID) (*Frame, error) {
+	bufferID, err := p.evictFrame(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	frame := &m.pool.frames[bufferID]
-	evictPageID := frame.Buffer.PageID
-	wasValid := frame.Buffer.isValid
+	frame := &p.pool.frames[bufferID]
+	start := time.Now()
+	err = p.disk.ReadPageDataContext(ctx, pageID, frame.Buffer.Page[:])
+	p.stats.IOTime += time.Since(start)
+	if err != nil {
+		return nil, err
+	}
+	p.stats.Reads++
+	frame.Buffer.PageID = pageID
+	frame.Buffer.markClean()
+	frame.Buffer.PageLSN = 0
+	frame.Buffer.noSteal = false
+	frame.Buffer.isValid = true
+	frame.Buffer.refCount = 0
+	frame.UsageCount = 1
+	p.pageTable[pageID] = bufferID
+
+	return frame, nil
+}
+
+// evictFrame は置換対象のフレームを選び、空きフレームとして返す
+// 古いページがdirtyならディスクに書き戻し、ページテーブルから外す
+func (p *partition) evictFrame(ctx context.Context) (BufferID, error) {
+	bufferID, err := p.pool.Evict()
+	if err != nil {
+		return 0, err
+	}
+
+	frame := &p.pool.frames[bufferID]
+	if !frame.Buffer.isValid {
+		return bufferID, nil
+	}
 
 	// 古いバッファがdirtyなら書き戻す
-	if wasValid && frame.Buffer.IsDirty {
-		if err := m.disk.WritePageData(evictPageID, frame.Buffer.Page[:]); err != nil {
-			return nil, err
+	evictPageID := frame.Buffer.PageID
+	wasDirty := frame.Buffer.IsDirty
+	if wasDirty {
+		if err := p.writePage(ctx, evictPageID, frame.Buffer); err != nil {
+			return 0, err
 		}
 	}
+	frame.Buffer.markClean()
+	frame.Buffer.isValid = false
+	delete(p.pageTable, evictPageID)
+	p.evicted(evictPageID, wasDirty)
 
+	return bufferID, nil
+}
+
+// CreatePage は新しいページを作成してバッファを返す
+func (m *BufferPoolManager) CreatePage() (*Buffer, error) {
+	return m.CreatePageContext(context.Background())
+}
+
+// CreatePageContext は CreatePage と同じだが、空きフレームを待っている間に
+// ctx がキャンセルされた場合は ctx.Err() を返す
+//
+// ページIDが決まるまで置くパーティションが決まらないので、先にページを割り当てる
+// フレームを確保できなければ、割り当てたページIDは使われずに残る
+func (m *BufferPoolManager) CreatePageContext(ctx context.Context) (*Buffer, error) {
 	// 新しいページを割り当て
+	m.allocMu.Lock()
 	pageID := m.disk.AllocatePage()
+	m.allocMu.Unlock()
+
+	p := m.partitionOf(pageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// FreePage で解放したページを再利用するときは、その後に読まれてプールに残っている
+	// 古いフレームをそのまま使う（同じページのフレームを2つ作らない）
+	bufferID, cached := p.pageTable[pageID]
+	if !cached {
+		// 置換対象を探す
+		var deadline time.Time
+		var err error
+		bufferID, err = p.evictFrame(ctx)
+		for err == ErrNoFreeBuffer {
+			if err := p.waitForFrame(ctx, &deadline); err != nil {
+				return nil, err
+			}
+			bufferID, err = p.evictFrame(ctx)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
 	// バッファを初期化
+	frame := &p.pool.frames[bufferID]
 	frame.Buffer.PageID = pageID
-	frame.Buffer.Page = Page{} // ゼロクリア
+	frame.Buffer.Page = Page{}  // ゼロクリア
 	frame.Buffer.IsDirty = true // 新規作成なので dirty
+	frame.Buffer.PageLSN = 0
+	frame.Buffer.recLSN = 0
+	frame.Buffer.noSteal = false
 	frame.Buffer.isValid = true
 	frame.Buffer.refCount = 1
 	frame.UsageCount = 1
-
-	// ページテーブルを更新（有効だったバッファのみ削除）
-	if wasValid {
-		delete(m.pageTable, evictPageID)
-	}
-	m.pageTable[pageID] = bufferID
+	p.pageTable[pageID] = bufferID
+	p.recordPin(frame.Buffer)
 
 	return frame.Buffer, nil
 }
 
 // Flush は全てのdirtyページをディスクに書き戻す
+// dirty でないページはディスクの内容と同じなので書かない
 func (m *BufferPoolManager) Flush() error {
-	for pageID, bufferID := range m.pageTable {
-		frame := &m.pool.frames[bufferID]
-		if err := m.disk.WritePageData(pageID, frame.Buffer.Page[:]); err != nil {
+	return m.FlushContext(context.Background())
+}
+
+// FlushContext は Flush と同じだが、ctx がキャンセルされたら残りのページを
+// 書き戻さずに ctx.Err() を返す
+// IDの連続するページは別々のパーティションにあるので、全てのパーティションをロックする
+func (m *BufferPoolManager) FlushContext(ctx context.Context) error {
+	defer m.reportPinLeaks() // ロックを外した後に呼ぶ
+	m.lockAll()
+	defer m.unlockAll()
+
+	var pageIDs []disk.PageID
+	for _, p := range m.partitions {
+		for pageID := range p.pageTable {
+			pageIDs = append(pageIDs, pageID)
+		}
+	}
+	return m.flushLocked(ctx, pageIDs)
+}
+
+// FlushPage は指定されたページがプール上にあって dirty なら、ディスクに書き戻す
+func (m *BufferPoolManager) FlushPage(pageID disk.PageID) error {
+	return m.FlushPagesContext(context.Background(), []disk.PageID{pageID})
+}
+
+// FlushPages は指定されたページのうち、プール上にあって dirty なものだけをディスクに書き戻す
+// 1つのB-treeのページだけを書き戻すときに使う
+func (m *BufferPoolManager) FlushPages(pageIDs []disk.PageID) error {
+	return m.FlushPagesContext(context.Background(), pageIDs)
+}
+
+// FlushPagesContext は FlushPages と同じだが、ctx がキャンセルされたら残りのページを
+// 書き戻さずに ctx.Err() を返す
+func (m *BufferPoolManager) FlushPagesContext(ctx context.Context, pageIDs []disk.PageID) error {
+	m.lockAll()
+	defer m.unlockAll()
+	return m.flushLocked(ctx, pageIDs)
+}
+
+// flushLocked は pageIDs のうちプール上にあって dirty なページを書き戻し、fsync する
+// IDの連続するページは1回の書き込みにまとめる
+// 呼び出し時は全てのパーティションのロックを保持していること
+func (m *BufferPoolManager) flushLocked(ctx context.Context, pageIDs []disk.PageID) error {
+	dirty := make([]disk.PageID, 0, len(pageIDs))
+	for _, pageID := range pageIDs {
+		p := m.partitionOf(pageID)
+		if bufferID, ok := p.pageTable[pageID]; ok && p.pool.frames[bufferID].Buffer.IsDirty && !p.pool.frames[bufferID].Buffer.noSteal {
+			dirty = append(dirty, pageID)
+		}
+	}
+	slices.Sort(dirty)
+	dirty = slices.Compact(dirty)
+	for start := 0; start < len(dirty); {
+		end := start + 1
+		for end < len(dirty) && dirty[end] == dirty[end-1]+1 {
+			end++
+		}
+		if err := m.writeRun(ctx, dirty[start:end]); err != nil {
 			return err
 		}
-		frame.Buffer.IsDirty = false
+		start = end
 	}
 	return m.disk.Sync()
 }
+
+// lockAll は全てのパーティションを番号の順にロックする
+// 2つ以上のパーティションを同時にロックするのはここだけなので、順序を守れば行き詰まらない
+func (m *BufferPoolManager) lockAll() {
+	for _, p := range m.partitions {
+		p.mu.Lock()
+	}
+}
+
+// unlockAll は lockAll でかけたロックを外す
+func (m *BufferPoolManager) unlockAll() {
+	for _, p := range m.partitions {
+		p.mu.Unlock()
+	}
+}
+
+// buffer はプール上にあるページのバッファを返す
+// 呼び出し時はページのパーティションのロックを保持していること
+func (m *BufferPoolManager) buffer(pageID disk.PageID) *Buffer {
+	p := m.partitionOf(pageID)
+	return p.pool.frames[p.pageTable[pageID]].Buffer
+}
+
+// writeRun はIDの連続するページをまとめてディスクに書き込み、dirtyフラグを落とす
+// 呼び出し時は全てのパーティションのロックを保持していること
+func (m *BufferPoolManager) writeRun(ctx context.Context, pageIDs []disk.PageID) error {
+	if len(pageIDs) == 1 {
+		buffer := m.buffer(pageIDs[0])
+		if err := m.partitionOf(pageIDs[0]).writePage(ctx, pageIDs[0], buffer); err != nil {
+			return err
+		}
+		buffer.markClean()
+		return nil
+	}
+
+	buffers := make([]*Buffer, len(pageIDs))
+	data := make([]byte, 0, len(pageIDs)*disk.PageSize)
+	for i, pageID := range pageIDs {
+		buffers[i] = m.buffer(pageID)
+		data = append(data, buffers[i].Page[:]...)
+	}
+	if err := flushLog(m.opts, buffers...); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := m.disk.WritePagesContext(ctx, pageIDs[0], data)
+	m.partitionOf(pageIDs[0]).stats.IOTime += time.Since(start)
+	if err != nil {
+		return err
+	}
+	for _, pageID := range pageIDs {
+		m.partitionOf(pageID).stats.Writes++
+		m.buffer(pageID).markClean()
+	}
+	return nil
+}
+
+// CheckDisk はディスクに書き込める状態かを確認する
+// ページは書き戻さない。ヘルスチェック用
+func (m *BufferPoolManager) CheckDisk() error {
+	m.allocMu.Lock()
+	defer m.allocMu.Unlock()
+	return m.disk.CheckWritable()
+}
+
+// writePage はバッファの内容をディスクに書き込み、統計を更新する
+// 呼び出し時は p.mu を保持していること
+func (p *partition) writePage(ctx context.Context, pageID disk.PageID, buffer *Buffer) error {
+	if err := flushLog(p.opts, buffer); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := p.disk.WritePageDataContext(ctx, pageID, buffer.Page[:])
+	p.stats.IOTime += time.Since(start)
+	if err != nil {
+		return err
+	}
+	p.stats.Writes++
+	return nil
+}
+
+// Stats は現在までの累計の統計を返す
+// パーティションに分けている場合は全てのパーティションの合計になる
+func (m *BufferPoolManager) Stats() Stats {
+	var stats Stats
+	for _, p := range m.partitions {
+		p.mu.Lock()
+		stats.add(p.stats)
+		p.mu.Unlock()
+	}
+	return stats
+}
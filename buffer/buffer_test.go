@@ -0,0 +1,432 @@
+package buffer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// テスト用のヘルパー関数
+// 2ページ分のデータを持つファイルを作り、1フレームだけのバッファプールで開く
+func setupTestEnv(t *testing.T, opts Options) (*BufferPoolManager, func()) {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "buffer_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		var page Page
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), page[:]); err != nil {
+			os.Remove(tmpPath)
+			t.Fatalf("failed to write page: %v", err)
+		}
+	}
+
+	bufmgr := NewBufferPoolManagerWithOptions(diskMgr, NewBufferPool(1), opts)
+	cleanup := func() {
+		os.Remove(tmpPath)
+	}
+	return bufmgr, cleanup
+}
+
+func TestFetchPageNoFreeBuffer(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t, Options{})
+	defer cleanup()
+
+	if _, err := bufmgr.FetchPage(0); err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	// 待たない設定ではすぐにエラーになる
+	if _, err := bufmgr.FetchPage(1); err != ErrNoFreeBuffer {
+		t.Errorf("expected ErrNoFreeBuffer, got %v", err)
+	}
+}
+
+func TestFetchPageWaitsForUnpin(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t, Options{WaitForFrame: true})
+	defer cleanup()
+
+	buf, err := bufmgr.FetchPage(0)
+	if err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		bufmgr.UnpinPage(buf)
+	}()
+
+	// ページ0のピンが外れるまで待ってから読み込める
+	buf, err = bufmgr.FetchPage(1)
+	if err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	if buf.PageID != 1 {
+		t.Errorf("expected page 1, got %d", buf.PageID)
+	}
+}
+
+func TestFetchPageWaitCancelled(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t, Options{WaitForFrame: true})
+	defer cleanup()
+
+	if _, err := bufmgr.FetchPage(0); err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := bufmgr.FetchPageContext(ctx, 1); err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestFetchPageWaitTimeout(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t, Options{WaitForFrame: true, WaitTimeout: 10 * time.Millisecond})
+	defer cleanup()
+
+	if _, err := bufmgr.FetchPage(0); err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	if _, err := bufmgr.CreatePage(); err != ErrNoFreeBuffer {
+		t.Errorf("expected ErrNoFreeBuffer, got %v", err)
+	}
+}
+
+func TestFetchPageReadFault(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t, Options{})
+	defer cleanup()
+
+	bufmgr.disk.InjectFaults(disk.Faults{FailReadAt: 1})
+	if _, err := bufmgr.FetchPage(0); !errors.Is(err, disk.ErrInjectedFault) {
+		t.Fatalf("expected ErrInjectedFault, got %v", err)
+	}
+	// 失敗した読み込みでフレームを使い切っていなければ、次は読める
+	buffer, err := bufmgr.FetchPage(0)
+	if err != nil {
+		t.Fatalf("failed to fetch page after fault: %v", err)
+	}
+	buffer.IsDirty = true
+	bufmgr.UnpinPage(buffer)
+
+	bufmgr.disk.InjectFaults(disk.Faults{FailWriteAt: 1})
+	if err := bufmgr.Flush(); !errors.Is(err, disk.ErrInjectedFault) {
+		t.Errorf("expected ErrInjectedFault from Flush, got %v", err)
+	}
+}
+
+// setupPartitioned はページIDを先頭に書いた numPages ページを持つ、パーティションに分けたプールを作る
+func setupPartitioned(t testing.TB, numPages, poolSize, partitions int) *BufferPoolManager {
+	t.Helper()
+	bufmgr := NewBufferPoolManagerWithOptions(disk.NewMemManager(), NewBufferPool(poolSize), Options{Partitions: partitions})
+	for i := 0; i < numPages; i++ {
+		buffer, err := bufmgr.CreatePage()
+		if err != nil {
+			t.Fatalf("failed to create page: %v", err)
+		}
+		binary.BigEndian.PutUint64(buffer.Page[:], uint64(buffer.PageID))
+		bufmgr.UnpinPage(buffer)
+	}
+	return bufmgr
+}
+
+func TestPartitions(t *testing.T) {
+	bufmgr := setupPartitioned(t, 64, 16, 4)
+	if len(bufmgr.partitions) != 4 {
+		t.Fatalf("expected 4 partitions, got %d", len(bufmgr.partitions))
+	}
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 200; i++ {
+				pageID := disk.PageID((g*31 + i*7) % 64)
+				buffer, err := bufmgr.FetchPage(pageID)
+				if err != nil {
+					t.Errorf("failed to fetch page %d: %v", pageID, err)
+					return
+				}
+				if got := binary.BigEndian.Uint64(buffer.Page[:]); got != uint64(pageID) {
+					t.Errorf("page %d: got content of page %d", pageID, got)
+				}
+				bufmgr.UnpinPage(buffer)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	stats := bufmgr.Stats()
+	if stats.Hits+stats.Misses != 8*200 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+	// パーティションの数はフレームの数を超えない
+	if n := len(NewBufferPoolManagerWithOptions(disk.NewMemManager(), NewBufferPool(2), Options{Partitions: 8}).partitions); n != 2 {
+		t.Errorf("expected 2 partitions, got %d", n)
+	}
+}
+
+func BenchmarkFetchPageParallel(b *testing.B) {
+	for _, partitions := range []int{1, 16} {
+		b.Run(fmt.Sprintf("partitions=%d", partitions), func(b *testing.B) {
+			bufmgr := setupPartitioned(b, 1024, 1024, partitions)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					buffer, err := bufmgr.FetchPage(disk.PageID(i % 1024))
+					if err != nil {
+						b.Fatal(err)
+					}
+					bufmgr.UnpinPage(buffer)
+					i += 7
+				}
+			})
+		})
+	}
+}
+
+func TestResize(t *testing.T) {
+	bufmgr := setupPartitioned(t, 8, 8, 2)
+	if err := bufmgr.Resize(1); err == nil {
+		t.Error("expected error resizing below the number of partitions")
+	}
+
+	// ページ1と3はどちらもパーティション1にあるので、1フレームずつには縮められない
+	pinned, _ := bufmgr.FetchPage(3)
+	other, _ := bufmgr.FetchPage(1)
+	if err := bufmgr.Resize(2); !errors.Is(err, ErrResizePinned) {
+		t.Errorf("expected ErrResizePinned, got %v", err)
+	}
+	bufmgr.UnpinPage(other)
+
+	// 縮めると外したページは書き戻され、読み直せる
+	if err := bufmgr.Resize(2); err != nil {
+		t.Fatalf("failed to shrink: %v", err)
+	}
+	if size := bufmgr.Size(); size != 2 {
+		t.Errorf("expected 2 frames, got %d", size)
+	}
+	if !bufmgr.Contains(3) {
+		t.Error("pinned page was evicted")
+	}
+	for _, pageID := range []disk.PageID{0, 2, 4, 6} {
+		buffer, err := bufmgr.FetchPage(pageID)
+		if err != nil {
+			t.Fatalf("failed to fetch page %d: %v", pageID, err)
+		}
+		if got := binary.BigEndian.Uint64(buffer.Page[:]); got != uint64(pageID) {
+			t.Errorf("page %d: got content of page %d", pageID, got)
+		}
+		bufmgr.UnpinPage(buffer)
+	}
+	bufmgr.UnpinPage(pinned)
+
+	if err := bufmgr.ResizeBytes(64 * disk.PageSize); err != nil {
+		t.Fatalf("failed to grow: %v", err)
+	}
+	if size := bufmgr.Size(); size != 64 {
+		t.Errorf("expected 64 frames, got %d", size)
+	}
+}
+
+func TestDirtyPagesAndFlushLog(t *testing.T) {
+	var flushed []LSN
+	bufmgr := NewBufferPoolManagerWithOptions(disk.NewMemManager(), NewBufferPool(4), Options{
+		FlushLog: func(lsn LSN) error {
+			flushed = append(flushed, lsn)
+			return nil
+		},
+	})
+	var buffers []*Buffer
+	for i := 0; i < 3; i++ {
+		buffer, err := bufmgr.CreatePage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buffers = append(buffers, buffer)
+	}
+	bufmgr.Flush()
+	flushed = nil
+
+	bufmgr.MarkDirty(buffers[0], 10)
+	bufmgr.MarkDirty(buffers[0], 30)
+	bufmgr.MarkDirty(buffers[2], 20)
+	dirty := bufmgr.DirtyPages()
+	if len(dirty) != 2 || dirty[buffers[0].PageID] != 10 || dirty[buffers[2].PageID] != 20 {
+		t.Errorf("unexpected dirty page table: %v", dirty)
+	}
+	if buffers[0].PageLSN != 30 {
+		t.Errorf("expected PageLSN 30, got %d", buffers[0].PageLSN)
+	}
+
+	// ページを書く前に PageLSN までのログを書き戻させる
+	if err := bufmgr.FlushPage(buffers[0].PageID); err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != 1 || flushed[0] != 30 {
+		t.Errorf("expected log flushed up to 30, got %v", flushed)
+	}
+	if dirty := bufmgr.DirtyPages(); len(dirty) != 1 {
+		t.Errorf("unexpected dirty page table after flush: %v", dirty)
+	}
+}
+
+func TestPinLeaks(t *testing.T) {
+	var reported []PinLeak
+	bufmgr := NewBufferPoolManagerWithOptions(disk.NewMemManager(), NewBufferPool(4), Options{
+		TrackPins: true,
+		OnPinLeak: func(leaks []PinLeak) { reported = leaks },
+	})
+	leaked, _ := bufmgr.CreatePage()
+	released, _ := bufmgr.CreatePage()
+	bufmgr.UnpinPage(released)
+
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(reported) != 1 || reported[0].PageID != leaked.PageID || reported[0].RefCount != 1 {
+		t.Fatalf("unexpected leaks: %v", reported)
+	}
+	if len(reported[0].Stacks) != 1 || !strings.Contains(reported[0].Stacks[0], "TestPinLeaks") {
+		t.Errorf("stack does not point at the leaking call: %v", reported[0].Stacks)
+	}
+
+	bufmgr.UnpinPage(leaked)
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("expected no leaks, got %v", leaks)
+	}
+}
+
+func TestEvictAdvancesHand(t *testing.T) {
+	pool := NewBufferPool(3)
+	for want := BufferID(0); want < 3; want++ {
+		got, err := pool.Evict()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("expected victim %d, got %d", want, got)
+		}
+		// 読み込まれたことにする
+		pool.frames[got].UsageCount = 1
+	}
+}
+
+func TestOnEvictAndNoSteal(t *testing.T) {
+	type eviction struct {
+		pageID   disk.PageID
+		wasDirty bool
+	}
+	var evictions []eviction
+	bufmgr := NewBufferPoolManagerWithOptions(disk.NewMemManager(), NewBufferPool(2), Options{
+		NoSteal: true,
+		OnEvict: func(pageID disk.PageID, wasDirty bool) {
+			evictions = append(evictions, eviction{pageID, wasDirty})
+		},
+	})
+	held, _ := bufmgr.CreatePage()
+	bufmgr.MarkNoSteal(held)
+	bufmgr.UnpinPage(held)
+	other, _ := bufmgr.CreatePage()
+	otherPageID := other.PageID // フレームが使い回されるとバッファの PageID も変わる
+	bufmgr.UnpinPage(other)
+
+	// no-steal のページは dirty の間は追い出されない
+	third, err := bufmgr.CreatePage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bufmgr.UnpinPage(third)
+	if len(evictions) != 1 || evictions[0] != (eviction{otherPageID, true}) {
+		t.Errorf("unexpected evictions: %v", evictions)
+	}
+	// Flush でも書き戻さない
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bufmgr.DirtyPages()[held.PageID]; !ok {
+		t.Error("no-steal page was flushed")
+	}
+
+	bufmgr.ClearNoSteal(held)
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if dirty := bufmgr.DirtyPages(); len(dirty) != 0 {
+		t.Errorf("expected no dirty pages, got %v", dirty)
+	}
+}
+
+func TestFreePage(t *testing.T) {
+	bufmgr := setupPartitioned(t, 8, 4, 2)
+
+	pinned, err := bufmgr.FetchPage(3)
+	if err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	if err := bufmgr.FreePage(3); !errors.Is(err, ErrPagePinned) {
+		t.Errorf("expected ErrPagePinned, got %v", err)
+	}
+	bufmgr.UnpinPage(pinned)
+
+	// プールにあるページもないページも解放でき、中身は0になる
+	for _, pageID := range []disk.PageID{3, 0} {
+		if err := bufmgr.FreePage(pageID); err != nil {
+			t.Fatalf("failed to free page %d: %v", pageID, err)
+		}
+		if bufmgr.Contains(pageID) {
+			t.Errorf("freed page %d is still cached", pageID)
+		}
+	}
+	buffer, err := bufmgr.FetchPage(3)
+	if err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	if buffer.Page != (Page{}) {
+		t.Error("freed page was not zeroed on disk")
+	}
+	bufmgr.UnpinPage(buffer)
+
+	// 新しいページは解放したページをIDの小さいものから再利用し、それから末尾を伸ばす
+	// 解放した後に読んだページ3もプールに2つ置かれることはない
+	for _, want := range []disk.PageID{0, 3, 8} {
+		buffer, err := bufmgr.CreatePage()
+		if err != nil {
+			t.Fatalf("failed to create page: %v", err)
+		}
+		if buffer.PageID != want {
+			t.Errorf("expected page %d, got %d", want, buffer.PageID)
+		}
+		if buffer.Page != (Page{}) {
+			t.Errorf("reused page %d is not empty", buffer.PageID)
+		}
+		binary.BigEndian.PutUint64(buffer.Page[:], uint64(buffer.PageID)+100)
+		bufmgr.UnpinPage(buffer)
+	}
+	buffer, err = bufmgr.FetchPage(3)
+	if err != nil {
+		t.Fatalf("failed to fetch page: %v", err)
+	}
+	if got := binary.BigEndian.Uint64(buffer.Page[:]); got != 103 {
+		t.Errorf("expected the reused page 3 to hold 103, got %d", got)
+	}
+	bufmgr.UnpinPage(buffer)
+}
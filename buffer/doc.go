@@ -51,6 +51,8 @@ Clock-sweepは時計の針のようにFrameを順番に見ていき：
   3. 参照中（pinされている）のFrameはスキップ
 
 これにより、最近使われていないページが優先的に追い出される。
+置換対象を選んだら針を次のFrameに進めるので、読み込んだばかりのページが
+次の置換ですぐに UsageCount を減らされることはない。
 
 	        nextVictimID
 	             ↓
@@ -58,10 +60,115 @@ Clock-sweepは時計の針のようにFrameを順番に見ていき：
 	│ 0 │→│ 1 │→│ 2 │→│ 3 │→│ 4 │→ (循環)
 	└───┘ └───┘ └───┘ └───┘ └───┘
 
+Options.OnEvict を指定すると、ページを追い出すたびに（書き戻したかどうかと一緒に）
+知らせる。Options.NoSteal を有効にすると、MarkNoSteal したページは dirty の間は
+追い出しも Flush もせず、ClearNoSteal するまでメモリに留める（no-steal）。
+
+# ピン（参照カウント）
+
+FetchPage / CreatePage で取得したバッファはピンされ、使用中の間は追い出されない。
+使い終わったら UnpinPage でピンを外す。ピンを外し忘れると、
+その分のフレームが永久に使えなくなり、いずれ ErrNoFreeBuffer になる。
+
+外し忘れを探すときは Options.TrackPins を有効にする。ピンを取るたびにスタックトレースを
+記録し、PinLeaks がピンされたままのページと、外れていないピンを取った場所を返す。
+Options.OnPinLeak を指定すれば Flush のたびに報告させられる：
+
+	mgr := buffer.NewBufferPoolManagerWithOptions(disk, pool, buffer.Options{
+	    TrackPins: true,
+	    OnPinLeak: func(leaks []buffer.PinLeak) {
+	        for _, leak := range leaks {
+	            log.Print(leak) // page 12 pinned 1 times / --- pinned at: ...
+	        }
+	    },
+	})
+
+# 空きフレームを待つ
+
+全てのフレームがピンされていると、FetchPage / CreatePage は ErrNoFreeBuffer を返す。
+Options.WaitForFrame を有効にすると、エラーにする代わりに他のgoroutineが
+ピンを外すまで待つ。待ち時間の上限は Options.WaitTimeout で、
+個々の呼び出しの中断は FetchPageContext / CreatePageContext の ctx で指定できる：
+
+	mgr := buffer.NewBufferPoolManagerWithOptions(disk, pool, buffer.Options{
+	    WaitForFrame: true,
+	    WaitTimeout:  time.Second,
+	})
+	buf, err := mgr.FetchPageContext(ctx, pageID)
+
+# パーティション
+
+ページテーブルとロックが1つだけだと、複数のgoroutineが別々のページを読むときも
+全員が同じロックを待つ。Options.Partitions を指定すると、フレームをその数に分け、
+パーティションごとにページテーブル・ロック・Clock-sweep の針を持たせる。
+ページは ページID % Partitions 番のパーティションに置く：
+
+	mgr := buffer.NewBufferPoolManagerWithOptions(disk, buffer.NewBufferPool(1024), buffer.Options{
+	    Partitions: 16,
+	})
+
+ページはそのパーティションのフレームにしか置けないので、1つのパーティションの
+フレームが全てピンされると、他が空いていても ErrNoFreeBuffer になる（待つ設定なら待つ）。
+Flush は全てのパーティションをロックする。効果は BenchmarkFetchPageParallel を
+-cpu を変えて比べると分かる。
+
+# プールの大きさ
+
+NewBufferPoolBytes はフレームの数の代わりにメモリの量でプールを作る。
+Resize / ResizeBytes は動いたままフレームを足したり外したりする。
+外すのは空のフレームとピンされていないページのフレームで、dirty なら先に書き戻す。
+ピンされたページが多くて縮められなければ、何も変えずに ErrResizePinned を返す：
+
+	mgr := buffer.NewBufferPoolManager(disk, buffer.NewBufferPoolBytes(64<<20)) // 64MiB
+	// メモリが逼迫したら
+	err := mgr.ResizeBytes(16 << 20)
+
+# ページの解放
+
+FreePage は使わなくなったページをプールから捨て、ディスク上の中身を0で埋めてから
+disk.FreePage で空きページの一覧に戻す。以後の CreatePage はそのページを再利用する。
+ピンされたページは解放せずに ErrPagePinned を返す（B-tree はイテレータが読んでいる
+ページを解放しないためにこれを使う）。
+TruncateFreePages はファイルの末尾に並んだ空きページをファイルから切り詰める。
+空きページはIDの小さいものから再利用されるので、使われるページは先頭に寄っていく。
+
 # Dirty Page（ダーティページ）
 
 メモリ上で変更されたがディスクに書き戻されていないページ。
 ページを追い出す前に、dirtyならディスクに書き戻す必要がある。
+Flush も dirty なページだけを書き戻す。FlushPage / FlushPages は指定したページだけを
+書き戻すので、1つのB-treeだけを永続化したいときは btree.Pages と組み合わせる
+（table.SimpleTable.Flush がこれを行う）。
+
+# LSN とダーティページテーブル
+
+WAL を載せるための準備として、バッファは PageLSN（最後の変更のログレコードの LSN）と
+recLSN（書き戻してから最初の変更の LSN）を持てる。MarkDirty で変更の LSN を渡し、
+DirtyPages で dirty なページと recLSN の表を得る。Options.FlushLog を指定すると、
+ページを書き戻す前にその PageLSN までのログを書き戻させる（WAL の規則）：
+
+	mgr := buffer.NewBufferPoolManagerWithOptions(disk, pool, buffer.Options{
+	    FlushLog: wal.FlushTo,
+	})
+	mgr.MarkDirty(buf, lsn)
+
+このDBにはまだWALがなく、PageLSN はページの中には書かれない。
+
+# 先読み（Prefetch）
+
+PrefetchPageはページをピンせずにバッファプールへ読み込む。
+B-treeのイテレータがリーフを順に辿っていることを検出すると、
+この先使われるリーフをあらかじめ読み込んでおくために使う。
+
+# 統計
+
+Stats はキャッシュヒット・ミスの回数、ディスクから読んだ・書いたページ数、
+ディスクI/Oにかかった時間の累計を返す。操作の前後で差を取れば、
+その操作のコストが分かる：
+
+	before := mgr.Stats()
+	// ... 何か操作 ...
+	cost := mgr.Stats().Sub(before)
 
 # 使用例
 
@@ -77,6 +184,7 @@ Clock-sweepは時計の針のようにFrameを順番に見ていき：
 	newBuf, _ := mgr.CreatePage()
 
 	// 全ての変更をディスクに書き戻す
+	// IDの連続するページは disk.WritePages で1回の書き込みにまとめる
 	mgr.Flush()
 */
 package buffer
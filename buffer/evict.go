@@ -0,0 +1,37 @@
+package buffer
+
+import "github.com/kkumaki12/minidb/disk"
+
+// evicted は Options.OnEvict があれば、ページを追い出したことを知らせる
+// 呼び出し時は p.mu を保持していること
+func (p *partition) evicted(pageID disk.PageID, wasDirty bool) {
+	if p.opts.OnEvict != nil {
+		p.opts.OnEvict(pageID, wasDirty)
+	}
+}
+
+// MarkNoSteal は Options.NoSteal が有効なら、ページを dirty の間は追い出さず、
+// Flush でも書き戻さないようにする。Options.NoSteal が無効なら何もしない
+func (m *BufferPoolManager) MarkNoSteal(buffer *Buffer) {
+	if !m.opts.NoSteal {
+		return
+	}
+	p := m.partitionOf(buffer.PageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	buffer.noSteal = true
+}
+
+// ClearNoSteal は MarkNoSteal を取り消し、ページを普通に追い出せるようにする
+// 空きフレームを待っている goroutine を起こす
+func (m *BufferPoolManager) ClearNoSteal(buffer *Buffer) {
+	p := m.partitionOf(buffer.PageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !buffer.noSteal {
+		return
+	}
+	buffer.noSteal = false
+	close(p.frameFreed)
+	p.frameFreed = make(chan struct{})
+}
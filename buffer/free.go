@@ -0,0 +1,57 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// ErrPagePinned はピンされているページを解放しようとしたことを表す
+var ErrPagePinned = errors.New("page is pinned")
+
+// FreePage は使わなくなったページを空きページにする
+// プールにあればフレームから捨て（dirty でも書き戻さない）、ディスク上の中身を0で埋めてから
+// disk.FreePage で空きページの一覧に戻す。以後の CreatePage はそのページを再利用する
+//
+// ページがピンされていれば何もせずに ErrPagePinned を返す。呼び出し側は先にピンを外しておくこと
+func (m *BufferPoolManager) FreePage(pageID disk.PageID) error {
+	p := m.partitionOf(pageID)
+	p.mu.Lock()
+	buffer := &Buffer{PageID: pageID}
+	bufferID, cached := p.pageTable[pageID]
+	if cached {
+		buffer = p.pool.frames[bufferID].Buffer
+		if buffer.refCount > 0 {
+			p.mu.Unlock()
+			return ErrPagePinned
+		}
+		buffer.Page = Page{}
+		buffer.PageLSN = 0
+	}
+	// 解放したページに古い中身を残さない
+	if err := p.writePage(context.Background(), pageID, buffer); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	if cached {
+		buffer.markClean()
+		buffer.isValid = false
+		p.pool.frames[bufferID].UsageCount = 0
+		delete(p.pageTable, pageID)
+	}
+	p.mu.Unlock()
+
+	m.allocMu.Lock()
+	m.disk.FreePage(pageID)
+	m.allocMu.Unlock()
+	return nil
+}
+
+// TruncateFreePages は disk.TruncateFreePages でファイルの末尾に並んだ空きページを切り詰め、
+// 切り詰めたページ数を返す。ページの割り当てとは排他する
+func (m *BufferPoolManager) TruncateFreePages() (int, error) {
+	m.allocMu.Lock()
+	defer m.allocMu.Unlock()
+	return m.disk.TruncateFreePages()
+}
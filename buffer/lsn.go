@@ -0,0 +1,64 @@
+package buffer
+
+import (
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// LSN はログレコードの位置（Log Sequence Number）
+// 0 はログに書かれた変更がないことを表す
+type LSN uint64
+
+// MarkDirty はバッファを dirty にし、変更を記録したログレコードの LSN を覚える
+// PageLSN はこのページへの最後の変更の LSN、recLSN は最後に書き戻してから最初の変更の LSN
+// ログを使わない呼び出し側はこれまで通り IsDirty を直接 true にしてよい
+func (m *BufferPoolManager) MarkDirty(buffer *Buffer, lsn LSN) {
+	p := m.partitionOf(buffer.PageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	buffer.IsDirty = true
+	buffer.PageLSN = max(buffer.PageLSN, lsn)
+	if buffer.recLSN == 0 {
+		buffer.recLSN = lsn
+	}
+}
+
+// DirtyPages はダーティページテーブル（dirty なページのIDから recLSN への対応）を返す
+// チェックポイントでは、この中の最小の recLSN より前のログが不要になる
+// IsDirty を直接立てたページの recLSN は0になる
+func (m *BufferPoolManager) DirtyPages() map[disk.PageID]LSN {
+	m.lockAll()
+	defer m.unlockAll()
+
+	dirty := map[disk.PageID]LSN{}
+	for _, p := range m.partitions {
+		for pageID, bufferID := range p.pageTable {
+			if buffer := p.pool.frames[bufferID].Buffer; buffer.IsDirty {
+				dirty[pageID] = buffer.recLSN
+			}
+		}
+	}
+	return dirty
+}
+
+// flushLog は WAL の規則を守るため、ページを書く前に PageLSN までのログを書き戻させる
+// Options.FlushLog がなければ何もしない
+func flushLog(opts Options, buffers ...*Buffer) error {
+	if opts.FlushLog == nil {
+		return nil
+	}
+	var lsn LSN
+	for _, buffer := range buffers {
+		lsn = max(lsn, buffer.PageLSN)
+	}
+	if lsn == 0 {
+		return nil
+	}
+	return opts.FlushLog(lsn)
+}
+
+// markClean はバッファをディスクに書き戻した状態にする
+func (b *Buffer) markClean() {
+	b.IsDirty = false
+	b.recLSN = 0
+}
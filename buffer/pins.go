@@ -0,0 +1,89 @@
+package buffer
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sort"
+	"strings"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// PinLeak はピンが外れていないページ
+type PinLeak struct {
+	PageID   disk.PageID
+	RefCount int
+	Stacks   []string // 外れていないピンを取った時のスタックトレース（古い順）
+}
+
+func (l PinLeak) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "page %d pinned %d times", l.PageID, l.RefCount)
+	for _, stack := range l.Stacks {
+		fmt.Fprintf(&b, "\n--- pinned at:\n%s", stack)
+	}
+	return b.String()
+}
+
+// recordPin は Options.TrackPins が有効なら、ピンを取った場所を覚える
+// 呼び出し時は p.mu を保持していること
+func (p *partition) recordPin(buffer *Buffer) {
+	if !p.opts.TrackPins {
+		return
+	}
+	if p.pins == nil {
+		p.pins = map[*Buffer][]string{}
+	}
+	p.pins[buffer] = append(p.pins[buffer], string(debug.Stack()))
+}
+
+// recordUnpin はピンを取った場所の記録を1つ消す
+// どのピンが外されたかは区別できないので、最後に取ったピンの記録を消す
+// 呼び出し時は p.mu を保持していること
+func (p *partition) recordUnpin(buffer *Buffer) {
+	stacks := p.pins[buffer]
+	if len(stacks) == 0 {
+		return
+	}
+	if len(stacks) == 1 {
+		delete(p.pins, buffer)
+		return
+	}
+	p.pins[buffer] = stacks[:len(stacks)-1]
+}
+
+// PinLeaks はピンされたままのページを、ページIDの順に返す
+// Options.TrackPins が有効なら、外れていないピンを取った時のスタックトレースも返す
+// イテレータの閉じ忘れなどを探すため、全ての処理が終わった時点で呼ぶ
+func (m *BufferPoolManager) PinLeaks() []PinLeak {
+	m.lockAll()
+	defer m.unlockAll()
+
+	var leaks []PinLeak
+	for _, p := range m.partitions {
+		for _, frame := range p.pool.frames {
+			buffer := frame.Buffer
+			if !buffer.isValid || buffer.refCount == 0 {
+				continue
+			}
+			leaks = append(leaks, PinLeak{
+				PageID:   buffer.PageID,
+				RefCount: buffer.refCount,
+				Stacks:   append([]string{}, p.pins[buffer]...),
+			})
+		}
+	}
+	sort.Slice(leaks, func(i, j int) bool { return leaks[i].PageID < leaks[j].PageID })
+	return leaks
+}
+
+// reportPinLeaks はピンされたままのページがあれば Options.OnPinLeak に渡す
+// パーティションのロックを持たずに呼ぶこと
+func (m *BufferPoolManager) reportPinLeaks() {
+	if m.opts.OnPinLeak == nil {
+		return
+	}
+	if leaks := m.PinLeaks(); len(leaks) > 0 {
+		m.opts.OnPinLeak(leaks)
+	}
+}
@@ -0,0 +1,78 @@
+package buffer
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// Prefetcher は別の goroutine で行っている先読み
+type Prefetcher struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// PrefetchChain は startPageID から始めて next が返すページを辿り、最大 n ページを
+// 別の goroutine でバッファプールに読み込む。呼び出し側は待たずに処理を続けられる
+//
+// next は読み込んだページの中身から次に読むページIDを返す（なければ false）。
+// next はプールのロックを持ったまま呼ばれるので、ページを読む以外のことはしないこと。
+// 読み込んだページはピンしない。既にプールにあるページは読み直さずに辿るだけにする。
+// 先読みは最適化にすぎないので、失敗したらそこで止める
+func (m *BufferPoolManager) PrefetchChain(startPageID disk.PageID, n int, next func(page []byte) (disk.PageID, bool)) *Prefetcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Prefetcher{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		pageID := startPageID
+		for i := 0; i < n && ctx.Err() == nil; i++ {
+			nextPageID, ok, err := m.prefetchNext(ctx, pageID, next)
+			if err != nil || !ok {
+				return
+			}
+			pageID = nextPageID
+		}
+	}()
+	return p
+}
+
+// prefetchNext は1ページを先読みし、next で次のページIDを求める
+func (m *BufferPoolManager) prefetchNext(ctx context.Context, pageID disk.PageID, next func(page []byte) (disk.PageID, bool)) (disk.PageID, bool, error) {
+	p := m.partitionOf(pageID)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var buffer *Buffer
+	if bufferID, ok := p.pageTable[pageID]; ok {
+		buffer = p.pool.frames[bufferID].Buffer
+	} else {
+		frame, err := p.loadPage(ctx, pageID)
+		if err != nil {
+			return 0, false, err
+		}
+		buffer = frame.Buffer
+	}
+	nextPageID, ok := next(buffer.Page[:])
+	return nextPageID, ok, nil
+}
+
+// Done は先読みが終わっているかを返す
+func (p *Prefetcher) Done() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait は先読みが終わるまで待つ
+func (p *Prefetcher) Wait() {
+	<-p.done
+}
+
+// Stop は先読みを打ち切り、goroutine が終わるまで待つ。何度呼んでもよい
+func (p *Prefetcher) Stop() {
+	p.cancel()
+	<-p.done
+}
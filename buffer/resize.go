@@ -0,0 +1,140 @@
+package buffer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// ErrResizePinned はピンされたページが多すぎてプールを縮められないことを表す
+var ErrResizePinned = errors.New("too many pinned pages to shrink buffer pool")
+
+// NewBufferPoolBytes はおよそ size バイトのページを置けるバッファプールを作成する
+// フレームの数は size をページサイズで割った数（少なくとも1）
+func NewBufferPoolBytes(size int64) *BufferPool {
+	return NewBufferPool(framesForBytes(size))
+}
+
+// framesForBytes は size バイトに収まるフレームの数を返す
+func framesForBytes(size int64) int {
+	return int(max(size/int64(len(Page{})), 1))
+}
+
+// Size はプール全体のフレームの数を返す
+func (m *BufferPoolManager) Size() int {
+	m.lockAll()
+	defer m.unlockAll()
+	size := 0
+	for _, p := range m.partitions {
+		size += p.pool.Size()
+	}
+	return size
+}
+
+// ResizeBytes はプールをおよそ size バイトのページを置ける大きさにする
+func (m *BufferPoolManager) ResizeBytes(size int64) error {
+	return m.Resize(framesForBytes(size))
+}
+
+// Resize は動いたままプールのフレームの数を n にする
+// 増やす場合は空のフレームを足し、空きフレームを待っている goroutine を起こす
+// 減らす場合は空のフレームから、次にピンされていないページのフレームから外す
+// 外すページが dirty なら先にディスクに書き戻す
+//
+// パーティションに分けている場合は、n をパーティションに均等に分ける
+// どこかのパーティションでピンされたページが割り当てより多ければ、何も変えずに
+// ErrResizePinned を返す
+func (m *BufferPoolManager) Resize(n int) error {
+	m.lockAll()
+	defer m.unlockAll()
+
+	if n < len(m.partitions) {
+		return fmt.Errorf("buffer pool of %d frames cannot be split into %d partitions", n, len(m.partitions))
+	}
+	targets := make([]int, len(m.partitions))
+	for i, p := range m.partitions {
+		targets[i] = n*(i+1)/len(m.partitions) - n*i/len(m.partitions)
+		if pinned := p.pinned(); pinned > targets[i] {
+			return fmt.Errorf("%w: %d pinned, %d frames", ErrResizePinned, pinned, targets[i])
+		}
+	}
+	for i, p := range m.partitions {
+		if err := p.resize(targets[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinned はピンされているか、no-steal で追い出せないフレームの数を返す
+func (p *partition) pinned() int {
+	count := 0
+	for _, frame := range p.pool.frames {
+		if frame.Buffer.refCount > 0 || (frame.Buffer.noSteal && frame.Buffer.IsDirty) {
+			count++
+		}
+	}
+	return count
+}
+
+// resize はパーティションのフレームの数を n にする
+// 呼び出し時は p.mu を保持していること
+func (p *partition) resize(n int) error {
+	frames := p.pool.frames
+	if n >= len(frames) {
+		// 他のパーティションとフレームの配列を共有しているかもしれないので、必ずコピーする
+		grown := make([]Frame, len(frames), n)
+		copy(grown, frames)
+		for len(grown) < n {
+			grown = append(grown, Frame{Buffer: &Buffer{}})
+		}
+		p.pool = &BufferPool{frames: grown, nextVictimID: p.pool.nextVictimID}
+		// 空きフレームを待っているgoroutineを全て起こす
+		close(p.frameFreed)
+		p.frameFreed = make(chan struct{})
+		return nil
+	}
+
+	// まず空のフレームを外し、足りなければピンされていないページのフレームを外す
+	drop := len(frames) - n
+	remove := make([]bool, len(frames))
+	for _, wantValid := range []bool{false, true} {
+		for i, frame := range frames {
+			if drop == 0 {
+				break
+			}
+			if remove[i] || frame.Buffer.refCount > 0 || (frame.Buffer.noSteal && frame.Buffer.IsDirty) || frame.Buffer.isValid != wantValid {
+				continue
+			}
+			wasDirty := frame.Buffer.isValid && frame.Buffer.IsDirty
+			if wasDirty {
+				if err := p.writePage(context.Background(), frame.Buffer.PageID, frame.Buffer); err != nil {
+					return err
+				}
+				frame.Buffer.markClean()
+			}
+			if frame.Buffer.isValid {
+				p.evicted(frame.Buffer.PageID, wasDirty)
+			}
+			remove[i] = true
+			drop--
+		}
+	}
+
+	kept := make([]Frame, 0, n)
+	pageTable := make(map[disk.PageID]BufferID, n)
+	for i, frame := range frames {
+		if remove[i] {
+			continue
+		}
+		if frame.Buffer.isValid {
+			pageTable[frame.Buffer.PageID] = BufferID(len(kept))
+		}
+		kept = append(kept, frame)
+	}
+	p.pool = &BufferPool{frames: kept}
+	p.pageTable = pageTable
+	return nil
+}
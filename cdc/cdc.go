@@ -0,0 +1,420 @@
+package cdc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+// Suffix はヒープファイルのパスに付ける変更ログの拡張子
+const Suffix = ".cdc"
+
+// Path はヒープファイルに対応する変更ログのパスを返す
+func Path(heapFilePath string) string {
+	return heapFilePath + Suffix
+}
+
+// 変更ログの形式
+// ファイルの先頭にマジックを置き、その後にレコードを書き足していく
+//
+//	[magic "minidbcd": 8] [record] [record] ...
+//	record: [payload_len: 4] [crc32: 4] [payload]
+//	payload: [kind: 1] [table] [key] [flags: 1] [old] [new]
+//
+// 文字列とバイト列は uvarint の長さの後に中身を、Tuple は uvarint の要素数の後に各要素を置く
+// flags のビット0が立っていれば old が、ビット1が立っていれば new が続く
+// 全て big endian で、crc32 は payload に対するもの
+const (
+	magic            = "minidbcd"
+	recordHeaderSize = 8
+	flagOld          = 1 << 0
+	flagNew          = 1 << 1
+)
+
+// maxPayloadSize はレコードの payload の上限。壊れた長さで巨大な領域を確保しないためのもの
+const maxPayloadSize = 64 << 20
+
+// エラー定義
+var (
+	ErrNotChangeLog = errors.New("not a change log")
+	ErrCorrupt      = errors.New("change log corrupted")
+)
+
+// LSN は変更ログの中の位置。レコードの先頭のファイルオフセットで、書いた順に大きくなる
+type LSN uint64
+
+// FirstLSN は最初のレコードの LSN
+const FirstLSN LSN = LSN(len(magic))
+
+// Kind は変更の種類。minidb.ChangeKind と同じ値を使う
+type Kind uint8
+
+const (
+	Insert Kind = iota + 1 // 行を挿入した
+	Update                 // 行を置き換えた
+	Delete                 // 行を削除した
+	// Gap は、この前に適用した変更のうち変更ログに書けなかったものがあることを示す
+	// Table と Key は空で、どの行が欠けたかは分からない
+	Gap
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Insert:
+		return "insert"
+	case Update:
+		return "update"
+	case Delete:
+		return "delete"
+	case Gap:
+		return "gap"
+	}
+	return "unknown"
+}
+
+// Record は変更ログの1行の変更
+type Record struct {
+	LSN   LSN         // レコードの位置。Append で書いたときに決まる
+	Table string      // テーブル名
+	Kind  Kind        // 変更の種類
+	Key   table.Tuple // 行のキーの列
+	Old   table.Tuple // 変更前の行。Insert なら nil
+	New   table.Tuple // 変更後の行。Delete なら nil
+}
+
+// encode はレコードを [payload_len] [crc32] [payload] の形にする
+func (r *Record) encode() []byte {
+	payload := []byte{byte(r.Kind)}
+	payload = appendBytes(payload, []byte(r.Table))
+	payload = appendTuple(payload, r.Key)
+	var flags byte
+	if r.Old != nil {
+		flags |= flagOld
+	}
+	if r.New != nil {
+		flags |= flagNew
+	}
+	payload = append(payload, flags)
+	if r.Old != nil {
+		payload = appendTuple(payload, r.Old)
+	}
+	if r.New != nil {
+		payload = appendTuple(payload, r.New)
+	}
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+func appendBytes(b, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+func appendTuple(b []byte, tuple table.Tuple) []byte {
+	b = binary.AppendUvarint(b, uint64(len(tuple)))
+	for _, elem := range tuple {
+		b = appendBytes(b, elem)
+	}
+	return b
+}
+
+// decodeRecord は payload からレコードを読み出す
+func decodeRecord(lsn LSN, payload []byte) (*Record, error) {
+	d := &decoder{data: payload}
+	r := &Record{LSN: lsn, Kind: Kind(d.byte())}
+	r.Table = string(d.bytes())
+	r.Key = d.tuple()
+	flags := d.byte()
+	if flags&flagOld != 0 {
+		r.Old = d.tuple()
+	}
+	if flags&flagNew != 0 {
+		r.New = d.tuple()
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = ErrCorrupt
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: record at %d", d.err, lsn)
+	}
+	return r, nil
+}
+
+// decoder は payload を前から読む。途中で壊れていたら err を残す
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.data) == 0 {
+		d.err = ErrCorrupt
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uvarint() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 || v > uint64(len(d.data)) {
+		// 長さも要素数も残りのバイト数を超えることはない
+		d.err = ErrCorrupt
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil || n > len(d.data) {
+		d.err = ErrCorrupt
+		return nil
+	}
+	b := make([]byte, n)
+	copy(b, d.data[:n])
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) tuple() table.Tuple {
+	n := d.uvarint()
+	tuple := make(table.Tuple, 0, n)
+	for i := 0; i < n && d.err == nil; i++ {
+		tuple = append(tuple, d.bytes())
+	}
+	return tuple
+}
+
+// readRecord は lsn の位置のレコードを読み、次のレコードの位置を返す
+// レコードが書きかけ（ファイルの終わりで切れている）なら nil を返す
+func readRecord(file *os.File, lsn LSN) (*Record, LSN, error) {
+	header := make([]byte, recordHeaderSize)
+	if _, err := file.ReadAt(header, int64(lsn)); err != nil {
+		if err == io.EOF {
+			return nil, lsn, nil
+		}
+		return nil, lsn, err
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > maxPayloadSize {
+		return nil, lsn, fmt.Errorf("%w: record at %d has length %d", ErrCorrupt, lsn, size)
+	}
+	payload := make([]byte, size)
+	if _, err := file.ReadAt(payload, int64(lsn)+recordHeaderSize); err != nil {
+		if err == io.EOF {
+			return nil, lsn, nil
+		}
+		return nil, lsn, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, lsn, fmt.Errorf("%w: checksum mismatch at %d", ErrCorrupt, lsn)
+	}
+	record, err := decodeRecord(lsn, payload)
+	if err != nil {
+		return nil, lsn, err
+	}
+	return record, lsn + recordHeaderSize + LSN(size), nil
+}
+
+// Writer は変更ログにレコードを書き足す
+// 1つの変更ログに書く Writer は1つだけにすること
+type Writer struct {
+	mu   sync.Mutex
+	file *os.File
+	end  LSN // 次のレコードを書く位置
+}
+
+// OpenWriter は変更ログを開く。ファイルがなければ作る
+// 前回の書き込みの途中でクラッシュしてレコードが壊れていれば、そこから後ろを切り捨てる
+// 変更ログでないファイルなら ErrNotChangeLog を返す
+func OpenWriter(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{file: file}
+	if err := w.recover(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// recover はマジックを確かめ、最後の完全なレコードの後ろを end にする
+func (w *Writer) recover() error {
+	info, err := w.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if _, err := w.file.WriteAt([]byte(magic), 0); err != nil {
+			return err
+		}
+		w.end = FirstLSN
+		return w.file.Sync()
+	}
+	if err := checkMagic(w.file); err != nil {
+		return err
+	}
+
+	lsn := FirstLSN
+	for {
+		record, next, err := readRecord(w.file, lsn)
+		if record == nil {
+			// 壊れたレコードは fsync が終わる前に書きかけたもの。呼び出し元には
+			// 成功を返していないので捨ててよい
+			if err != nil && !errors.Is(err, ErrCorrupt) {
+				return err
+			}
+			break
+		}
+		lsn = next
+	}
+	w.end = lsn
+	if LSN(info.Size()) != lsn {
+		if err := w.file.Truncate(int64(lsn)); err != nil {
+			return err
+		}
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// checkMagic はファイルの先頭が変更ログのマジックかを確かめる
+func checkMagic(file *os.File) error {
+	buf := make([]byte, len(magic))
+	if _, err := file.ReadAt(buf, 0); err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("%w: %s", ErrNotChangeLog, file.Name())
+		}
+		return err
+	}
+	if string(buf) != magic {
+		return fmt.Errorf("%w: %s", ErrNotChangeLog, file.Name())
+	}
+	return nil
+}
+
+// Append はレコードを順に書き足して fsync し、次のレコードを書く位置を返す
+// 各レコードの LSN は書いた位置に書き換える。書き込みに失敗したら、どのレコードも
+// 書かなかったことになる
+func (w *Writer) Append(records []*Record) (LSN, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var buf []byte
+	lsn := w.end
+	for _, r := range records {
+		encoded := r.encode()
+		if len(encoded)-recordHeaderSize > maxPayloadSize {
+			return w.end, fmt.Errorf("change log record for %q is too large: %d bytes", r.Table, len(encoded))
+		}
+		r.LSN = lsn
+		lsn += LSN(len(encoded))
+		buf = append(buf, encoded...)
+	}
+	if _, err := w.file.WriteAt(buf, int64(w.end)); err != nil {
+		w.file.Truncate(int64(w.end))
+		return w.end, err
+	}
+	if err := w.file.Sync(); err != nil {
+		return w.end, err
+	}
+	w.end = lsn
+	return w.end, nil
+}
+
+// End は次のレコードを書く位置を返す
+// ここから読む Reader には、この後に書いたレコードだけが届く
+func (w *Writer) End() LSN {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.end
+}
+
+// Close はファイルを閉じる
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Reader は変更ログのレコードを書いた順に読む
+// 終わりまで読んだ後も、Writer が書き足したレコードを続けて読める
+type Reader struct {
+	file *os.File
+	pos  LSN // 次に読むレコードの位置
+}
+
+// OpenReader は変更ログを from の位置から読む Reader を返す
+// from には FirstLSN か、以前の Reader の Position を渡す。0 なら FirstLSN から読む
+// レコードの境目でない位置を渡すと、Next が ErrCorrupt を返す
+func OpenReader(path string, from LSN) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMagic(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if from < FirstLSN {
+		from = FirstLSN
+	}
+	return &Reader{file: file, pos: from}, nil
+}
+
+// Next は次のレコードを返す。まだ書かれていなければ nil を返す
+// nil が返ったら、しばらく待ってから呼び直せば追いかけられる
+func (r *Reader) Next() (*Record, error) {
+	record, next, err := readRecord(r.file, r.pos)
+	if err != nil {
+		// 書いている途中のレコードを読んだだけかもしれないので、ファイルの最後の
+		// レコードなら書き終わるまで待つ
+		if errors.Is(err, ErrCorrupt) && r.atTail() {
+			return nil, nil
+		}
+		return nil, err
+	}
+	r.pos = next
+	return record, nil
+}
+
+// atTail は次に読むレコードがファイルの最後のレコードかを返す
+func (r *Reader) atTail() bool {
+	header := make([]byte, recordHeaderSize)
+	if _, err := r.file.ReadAt(header, int64(r.pos)); err != nil {
+		return true
+	}
+	info, err := r.file.Stat()
+	if err != nil {
+		return false
+	}
+	size := binary.BigEndian.Uint32(header[0:4])
+	return int64(r.pos)+recordHeaderSize+int64(size) >= info.Size()
+}
+
+// Position は次に読むレコードの位置を返す
+// 消費者はこれを保存しておき、再開するときに OpenReader に渡す
+func (r *Reader) Position() LSN {
+	return r.pos
+}
+
+// Close はファイルを閉じる
+func (r *Reader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,127 @@
+package cdc
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+func TestWriterReader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db.cdc")
+	w, err := OpenWriter(path)
+	if err != nil {
+		t.Fatalf("failed to open writer: %v", err)
+	}
+	if w.End() != FirstLSN {
+		t.Errorf("expected empty log to end at %d, got %d", FirstLSN, w.End())
+	}
+
+	records := []*Record{
+		{Table: "users", Kind: Insert, Key: table.Tuple{[]byte("1")}, New: table.Tuple{[]byte("1"), []byte("Alice")}},
+		{Table: "users", Kind: Update, Key: table.Tuple{[]byte("1")}, Old: table.Tuple{[]byte("1"), []byte("Alice")}, New: table.Tuple{[]byte("1"), []byte{}}},
+	}
+	if _, err := w.Append(records); err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if records[0].LSN != FirstLSN || records[1].LSN <= records[0].LSN {
+		t.Errorf("unexpected LSNs: %d %d", records[0].LSN, records[1].LSN)
+	}
+
+	r, err := OpenReader(path, 0)
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	defer r.Close()
+	for _, want := range records {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected %+v, got %+v", want, got)
+		}
+	}
+	if got, err := r.Next(); got != nil || err != nil {
+		t.Fatalf("expected end of log, got %+v %v", got, err)
+	}
+
+	// 追いついた後に書き足したレコードも読める
+	saved := r.Position()
+	deleted := &Record{Table: "users", Kind: Delete, Key: table.Tuple{[]byte("1")}, Old: table.Tuple{[]byte("1"), []byte{}}}
+	end, err := w.Append([]*Record{deleted})
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	if got, err := r.Next(); err != nil || !reflect.DeepEqual(got, deleted) {
+		t.Errorf("expected %+v, got %+v %v", deleted, got, err)
+	}
+	if r.Position() != end {
+		t.Errorf("expected position %d, got %d", end, r.Position())
+	}
+
+	// 保存した位置から再開できる
+	resumed, err := OpenReader(path, saved)
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	defer resumed.Close()
+	if got, err := resumed.Next(); err != nil || !reflect.DeepEqual(got, deleted) {
+		t.Errorf("expected %+v, got %+v %v", deleted, got, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+}
+
+func TestWriterRecover(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db.cdc")
+	w, err := OpenWriter(path)
+	if err != nil {
+		t.Fatalf("failed to open writer: %v", err)
+	}
+	end, err := w.Append([]*Record{{Table: "users", Kind: Insert, Key: table.Tuple{[]byte("1")}, New: table.Tuple{[]byte("1")}}})
+	if err != nil {
+		t.Fatalf("failed to append: %v", err)
+	}
+	w.Close()
+
+	// 書きかけのレコードを残す
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 10, 1, 2, 3, 4, 5})
+	f.Close()
+
+	r, err := OpenReader(path, end)
+	if err != nil {
+		t.Fatalf("failed to open reader: %v", err)
+	}
+	defer r.Close()
+	if got, err := r.Next(); got != nil || err != nil {
+		t.Errorf("expected torn record to be skipped, got %+v %v", got, err)
+	}
+
+	w, err = OpenWriter(path)
+	if err != nil {
+		t.Fatalf("failed to reopen writer: %v", err)
+	}
+	defer w.Close()
+	if w.End() != end {
+		t.Errorf("expected torn record to be truncated at %d, got %d", end, w.End())
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(end) {
+		t.Errorf("expected file size %d, got %v %v", end, info, err)
+	}
+
+	if err := os.WriteFile(path+".other", []byte("not a change log"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenWriter(path + ".other"); !errors.Is(err, ErrNotChangeLog) {
+		t.Errorf("expected ErrNotChangeLog, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Package cdc は、データベースの変更を外部のシステムに流すための変更ログを提供する。
+
+# 概要
+
+minidb.Options.ChangeLog を有効にして開いたデータベースは、書き込みを適用するたびに
+変わった行をヒープファイルとは別の変更ログ（ヒープファイルのパスに Suffix を付けたファイル）に
+書き足す。Subscribe と違い、変更ログは別のプロセスから読めて、読んだ位置を覚えておけば
+後から続きを読める。他のデータベースや検索エンジンへの複製に使う。
+
+# LSN
+
+レコードの位置は LSN（ファイルの先頭からのオフセット）で表す。LSN は書いた順に大きくなり、
+Reader.Position が次に読む位置を返す。消費者は処理したレコードの次の位置を保存しておき、
+再開するときに OpenReader に渡す：
+
+	reader, _ := cdc.OpenReader(cdc.Path("app.db"), savedLSN)
+	defer reader.Close()
+	for {
+	    record, err := reader.Next()
+	    if err != nil {
+	        return err
+	    }
+	    if record == nil {
+	        // 追いついた。少し待ってから続きを読む
+	        time.Sleep(time.Second)
+	        continue
+	    }
+	    apply(record)
+	    savedLSN = reader.Position()
+	}
+
+# 形式
+
+ファイルの先頭のマジックの後に、長さと CRC32 を付けたレコードを並べる。Writer は
+レコードを書くたびに fsync するので、Append が成功したレコードはクラッシュしても残る。
+書きかけのまま残ったレコードは、次に OpenWriter で開いたときに切り捨てる。
+
+# ヒープファイルとの食い違い
+
+変更ログは書き込みのたびに fsync するが、ヒープファイルのページは Flush か Close まで
+ディスクに届かない。そのためクラッシュした後は、変更ログの方がヒープファイルより先に
+進んでいることがある。変更ログにあるのに開き直したデータベースにない変更があり得るので、
+消費者はクラッシュの後に複製先をデータベースと突き合わせること。
+
+逆に、書き込みを適用した後に変更ログに書けなかった変更は欠ける。minidb はその書き込みに
+minidb.ErrChangeLog を返し、次に書けたときにその前へ Kind が Gap のレコードを置く。
+Gap を読んだ消費者は、欠けた変更を取り戻すためにデータベースから読み直す：
+
+	if record.Kind == cdc.Gap {
+	    resync()
+	    continue
+	}
+
+変更ログは書き足すだけで、古いレコードは消さない。
+*/
+package cdc
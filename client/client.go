@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/kkumaki12/minidb/protocol"
+)
+
+// エラー定義
+var (
+	ErrNotFound = errors.New("key not found")
+)
+
+// DeniedError はログインの失敗や権限不足でサーバーが実行を拒否したことを表す
+type DeniedError struct {
+	Message string
+}
+
+func (e *DeniedError) Error() string {
+	return "denied: " + e.Message
+}
+
+// ServerError はサーバー側で発生したエラー
+type ServerError struct {
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// Client はminidbサーバーへの接続
+// 1つの接続上でリクエストを順番に送るので、複数のgoroutineから使ってもよい
+type Client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	mu   sync.Mutex
+
+	lastMetrics protocol.Metrics // 直前のリクエストのコスト（mu で保護する）
+}
+
+// Dial はサーバーに接続する
+func Dial(addr string) (*Client, error) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient は既存の接続からClientを作成する
+func NewClient(conn net.Conn) *Client {
+	return &Client{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+}
+
+// Close は接続を閉じる
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Login はユーザー名とパスワードでログインする
+// サーバーに認証が設定されていない場合は常に成功する
+// 失敗した場合は *DeniedError を返す
+func (c *Client) Login(username, password string) error {
+	_, err := c.roundTrip(&protocol.Request{Op: protocol.OpLogin, Key: []byte(username), Value: []byte(password)})
+	return err
+}
+
+// Get はキーの値を返す
+// キーが存在しない場合は ErrNotFound を返す
+func (c *Client) Get(key []byte) ([]byte, error) {
+	resp, err := c.roundTrip(&protocol.Request{Op: protocol.OpGet, Key: key})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Value, nil
+}
+
+// Put はキーに値を書き込む。既に値があれば置き換える
+func (c *Client) Put(key, value []byte) error {
+	_, err := c.roundTrip(&protocol.Request{Op: protocol.OpPut, Key: key, Value: value})
+	return err
+}
+
+// Delete はキーを削除する
+// キーが存在しない場合は ErrNotFound を返す
+func (c *Client) Delete(key []byte) error {
+	_, err := c.roundTrip(&protocol.Request{Op: protocol.OpDelete, Key: key})
+	return err
+}
+
+// Scan は start 以降のペアを最大 limit 件返す
+// start が空なら先頭から、limit が0なら最後まで返す
+func (c *Client) Scan(start []byte, limit int) ([]protocol.Pair, error) {
+	resp, err := c.roundTrip(&protocol.Request{Op: protocol.OpScan, Key: start, Limit: uint32(limit)})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Pairs, nil
+}
+
+// LastMetrics は直前に完了したリクエストについてサーバーが返したコストを返す
+// 複数のgoroutineから使っている場合は、どのリクエストの値かは保証されない
+func (c *Client) LastMetrics() protocol.Metrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastMetrics
+}
+
+// roundTrip はリクエストを送ってレスポンスを受け取る
+// レスポンスのステータスはエラーに変換する
+func (c *Client) roundTrip(req *protocol.Request) (*protocol.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if err := protocol.WriteRequest(c.w, req); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	resp, err := protocol.ReadResponse(c.r)
+	if err != nil {
+		return nil, err
+	}
+	c.lastMetrics = resp.Metrics
+
+	switch resp.Status {
+	case protocol.StatusOK:
+		return resp, nil
+	case protocol.StatusNotFound:
+		return nil, ErrNotFound
+	case protocol.StatusDenied:
+		return nil, &DeniedError{Message: resp.Message}
+	}
+	return nil, &ServerError{Message: resp.Message}
+}
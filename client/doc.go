@@ -0,0 +1,29 @@
+/*
+Package client はminidbサーバーに接続するGoのクライアントを提供する。
+
+# 使用例
+
+	c, _ := client.Dial("localhost:7070")
+	defer c.Close()
+
+	// サーバーに認証が設定されている場合はログインする
+	c.Login("alice", "password")
+
+	c.Put([]byte("key1"), []byte("value1"))
+
+	value, err := c.Get([]byte("key1"))
+	if err == client.ErrNotFound {
+	    // キーが存在しない
+	}
+
+	// key1 以降を最大10件取得
+	pairs, _ := c.Scan([]byte("key1"), 10)
+	for _, p := range pairs {
+	    fmt.Printf("%s: %s\n", p.Key, p.Value)
+	}
+
+	// 直前のリクエストのコスト
+	m := c.LastMetrics()
+	fmt.Println(m.RowsScanned, m.BufferHits, m.BufferMisses, m.IOTime)
+*/
+package client
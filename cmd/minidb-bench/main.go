@@ -0,0 +1,52 @@
+// minidb-bench はminidbと他のKVストアに同じ負荷を流して比べる
+//
+// 使い方:
+//
+//	minidb-bench -stores minidb -keys 100000 -value 100
+//	go run -tags bbolt,badger ./cmd/minidb-bench -stores minidb,bbolt,badger
+//
+// 負荷ごとにストアを並べた表を標準出力に書く。
+// bbolt と badger はビルドタグを付けたときだけ使える（bench パッケージを参照）。
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/kkumaki12/minidb/bench"
+)
+
+func main() {
+	storeList := flag.String("stores", strings.Join(bench.Stores(), ","), "comma-separated stores to compare")
+	keys := flag.Int("keys", 100000, "number of keys per workload")
+	valueSize := flag.Int("value", 100, "value size in bytes")
+	pool := flag.Int("pool", bench.DefaultMinidbPoolSize, "number of buffer pool frames for minidb")
+	workloadList := flag.String("workloads", "", "comma-separated workloads to run (all if empty)")
+	dir := flag.String("dir", "", "directory for the store files (os.TempDir() if empty)")
+	flag.Parse()
+
+	bench.Register("minidb", bench.OpenMinidb(*pool))
+
+	workloads := bench.DefaultWorkloads(*keys, *valueSize)
+	if *workloadList != "" {
+		selected := map[string]bool{}
+		for _, name := range strings.Split(*workloadList, ",") {
+			selected[name] = true
+		}
+		var filtered []bench.Workload
+		for _, w := range workloads {
+			if selected[w.Name] {
+				filtered = append(filtered, w)
+			}
+		}
+		workloads = filtered
+	}
+
+	results, err := bench.RunAll(strings.Split(*storeList, ","), workloads, *dir)
+	bench.WriteReport(os.Stdout, results)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
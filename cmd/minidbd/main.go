@@ -0,0 +1,102 @@
+// minidbd はminidbをスタンドアロンのデータベースプロセスとして動かすサーバー
+//
+// 使い方:
+//
+//	minidbd -addr :7070 -db data.db -pool 1024
+//
+// 1つのヒープファイルを1本のB-treeとして開き、protocol パッケージの
+// 長さ付きフレームで GET/PUT/DELETE/SCAN を受け付ける。
+// SIGINT/SIGTERM を受け取ると全てのページをディスクに書き戻し、
+// マニフェスト（<db>.manifest）を更新して終了する。
+//
+// -health にアドレスを指定すると、HTTP で /healthz と /readyz に応答する。
+//
+// -verify を付けるとサーバーを起動せず、マニフェストとヒープファイルが
+// 一致するかだけを確認して終了する。
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+	"github.com/kkumaki12/minidb/server"
+)
+
+// metaPageID はminidbdが使うB-treeのメタページID
+// 新規ファイルでは最初に作られるページになる
+const metaPageID = disk.PageID(0)
+
+func main() {
+	addr := flag.String("addr", ":7070", "listen address")
+	dbPath := flag.String("db", "minidb.db", "path to the heap file")
+	poolSize := flag.Int("pool", 1024, "number of buffer pool frames")
+	verify := flag.Bool("verify", false, "verify the manifest and exit")
+	healthAddr := flag.String("health", "", "listen address for /healthz and /readyz (disabled if empty)")
+	flag.Parse()
+
+	if *verify {
+		if err := disk.VerifyManifest(disk.ManifestPath(*dbPath)); err != nil {
+			log.Fatalf("verify failed: %v", err)
+		}
+		log.Printf("%s: ok", *dbPath)
+		return
+	}
+
+	isNew := false
+	if info, err := os.Stat(*dbPath); os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		isNew = true
+	}
+
+	diskMgr, err := disk.Open(*dbPath)
+	if err != nil {
+		log.Fatalf("failed to open %s: %v", *dbPath, err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(*poolSize))
+
+	var tree *btree.BTree
+	if isNew {
+		tree, err = btree.Create(bufmgr)
+		if err != nil {
+			log.Fatalf("failed to create btree: %v", err)
+		}
+	} else {
+		tree = btree.NewBTree(metaPageID)
+	}
+
+	srv := server.New(bufmgr, tree)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sigCh
+		log.Printf("shutting down")
+		srv.Close()
+	}()
+
+	if *healthAddr != "" {
+		go func() {
+			if err := http.ListenAndServe(*healthAddr, srv.HealthHandler()); err != nil {
+				log.Printf("health endpoint error: %v", err)
+			}
+		}()
+	}
+
+	log.Printf("listening on %s (db=%s)", *addr, *dbPath)
+	if err := srv.ListenAndServe(*addr); err != nil && err != server.ErrServerClosed {
+		log.Fatalf("server error: %v", err)
+	}
+
+	if err := bufmgr.Flush(); err != nil {
+		log.Fatalf("failed to flush: %v", err)
+	}
+	if err := diskMgr.UpdateManifest(); err != nil {
+		log.Fatalf("failed to update manifest: %v", err)
+	}
+}
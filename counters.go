@@ -0,0 +1,261 @@
+package minidb
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+// catalogCountersColumn はカタログの行で、行数と大きさを置く列
+// 以前のバージョンで作ったテーブルの行にはない
+const catalogCountersColumn = 4
+
+// TableStats はテーブルの行数と大きさ。Table.Stats が返す
+type TableStats struct {
+	Rows       int // 行数。期限切れの行も PurgeExpired で消すまでは数える
+	KeyBytes   int // 行のキーの列を Tuple.Encode したバイト数の合計
+	ValueBytes int // 行の値の列を Tuple.Encode したバイト数の合計
+	Pages      int // B-treeのページ数（btree.PageCount）
+}
+
+// tableCounters は書き込みのたびに更新する行数と大きさ
+type tableCounters struct {
+	rows       int
+	keyBytes   int
+	valueBytes int
+	dirty      bool // カタログに記録した後に変わった
+	stale      bool // カタログに記録した数の後に書き込みを始めた印があった（開いたときに数え直す）
+}
+
+// encode はカタログの列に置くバイト列にする
+// フォーマット: 全て uvarint で [rows] [key_bytes] [value_bytes] ([stale])
+// stale は記録した後に書き込みを始めたことを表す印で、付けるときだけ 1 を足す
+func (c *tableCounters) encode(stale bool) []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(c.rows))
+	b = binary.AppendUvarint(b, uint64(c.keyBytes))
+	b = binary.AppendUvarint(b, uint64(c.valueBytes))
+	if stale {
+		b = binary.AppendUvarint(b, 1)
+	}
+	return b
+}
+
+// decodeCounters は encode したバイト列から行数と大きさを読み出す
+func decodeCounters(b []byte) (*tableCounters, error) {
+	var values [4]int
+	i := 0
+	for ; i < len(values) && (i < 3 || len(b) > 0); i++ {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid table counters")
+		}
+		values[i], b = int(v), b[n:]
+	}
+	if len(b) != 0 || values[3] > 1 {
+		return nil, errors.New("invalid table counters")
+	}
+	return &tableCounters{rows: values[0], keyBytes: values[1], valueBytes: values[2], stale: values[3] == 1}, nil
+}
+
+// catalogCounters はカタログの行から行数と大きさを読み出す。記録がなければ nil を返す
+func catalogCounters(row Tuple) (*tableCounters, error) {
+	if len(row) <= catalogCountersColumn || len(row[catalogCountersColumn]) == 0 {
+		return nil, nil
+	}
+	return decodeCounters(row[catalogCountersColumn])
+}
+
+// Stats はテーブルの行数・キーと値の大きさ・ページ数を返す
+// 行数と大きさは書き込みのたびに更新しているので、行は読まない。ページ数はブランチだけを読んで数える
+// 以前のバージョンで作ったテーブルでは、最初に呼んだときに一度だけ全ての行を読んで数える
+//
+// 数はメモリ上で更新し、Flush と Close でカタログに記録する。
+// 記録した後の最初の書き込みの前にカタログへ印を付けておくので、記録する前に異常終了しても
+// 次に開いたときに全ての行を読んで数え直す
+func (t *Table) Stats() (*TableStats, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	if t.counters == nil {
+		if err := t.recount(); err != nil {
+			return nil, err
+		}
+	}
+	pages, err := t.tbl.PageCount(t.db.bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	return &TableStats{
+		Rows:       t.counters.rows,
+		KeyBytes:   t.counters.keyBytes,
+		ValueBytes: t.counters.valueBytes,
+		Pages:      pages,
+	}, nil
+}
+
+// recount は全ての行を読んで、行数と大きさを数え直す
+// 呼び出し時は db.mu を保持していること
+func (t *Table) recount() error {
+	raw := t.rawTable()
+	iter, err := raw.Scan(t.db.bufmgr)
+	if err != nil {
+		return err
+	}
+	defer iter.Close(t.db.bufmgr)
+	counters := &tableCounters{dirty: true}
+	for {
+		row, err := iter.Next(t.db.bufmgr)
+		if err != nil {
+			return err
+		}
+		if row == nil {
+			break
+		}
+		counters.rows++
+		keyBytes, valueBytes := t.rowBytes(row)
+		counters.keyBytes += keyBytes
+		counters.valueBytes += valueBytes
+	}
+	t.counters = counters
+	return nil
+}
+
+// markStale は記録した後の最初の書き込みの前に、カタログの数とゾーンマップに印を付けてディスクに書く
+// 書き込んだ行が記録より先にディスクに届いてから異常終了しても、次に開いたときに数え直し、
+// ゾーンマップを作り直せる。どちらも、ないか既に印を付けたか記録していない変更があれば何もしない
+// 呼び出し時は db.mu を保持していること
+func (t *Table) markStale() error {
+	c, z := t.counters, t.zones
+	markCounters := c != nil && !c.dirty
+	markZones := z != nil && !z.dirty
+	if !markCounters && !markZones {
+		return nil
+	}
+	row, err := t.catalogRow()
+	if err != nil {
+		return err
+	}
+	row = slices.Clone(row)
+	if markCounters {
+		for len(row) <= catalogCountersColumn {
+			row = append(row, nil)
+		}
+		row[catalogCountersColumn] = c.encode(true)
+	}
+	if markZones {
+		for len(row) <= catalogZoneMapColumn {
+			row = append(row, nil)
+		}
+		row[catalogZoneMapColumn] = z.encode(true)
+	}
+	batch := table.NewWriteBatch()
+	batch.Put(t.db.catalog, row)
+	if err := batch.Apply(t.db.bufmgr); err != nil {
+		return err
+	}
+	// 印は行より先にディスクに届いていなければならない
+	if err := t.db.bufmgr.Flush(); err != nil {
+		return err
+	}
+	if markCounters {
+		c.dirty = true
+	}
+	if markZones {
+		z.dirty = true
+	}
+	return nil
+}
+
+// count は行が old から row に変わったことを行数と大きさに反映する。どちらも nil ならない行
+// 数えていないテーブルでは何もしない。呼び出し時は db.mu を保持していること
+func (t *Table) count(old, row Tuple) {
+	c := t.counters
+	if c == nil || (old == nil && row == nil) {
+		return
+	}
+	if old != nil {
+		keyBytes, valueBytes := t.rowBytes(old)
+		c.rows--
+		c.keyBytes -= keyBytes
+		c.valueBytes -= valueBytes
+	}
+	if row != nil {
+		keyBytes, valueBytes := t.rowBytes(row)
+		c.rows++
+		c.keyBytes += keyBytes
+		c.valueBytes += valueBytes
+	}
+	c.dirty = true
+}
+
+// rowBytes は格納した行のキーと値の列を Tuple.Encode したバイト数を返す
+func (t *Table) rowBytes(row Tuple) (int, int) {
+	key, value := table.SplitTuple(row, t.tbl.NumKeyElems)
+	return len(key.Encode()), len(value.Encode())
+}
+
+// rawTable は期限切れの行も読める t.tbl の写しを返す
+// 期限切れの行も PurgeExpired で消すまではページにあるので、数えるときはこちらで読む
+func (t *Table) rawTable() *table.SimpleTable {
+	if !t.tbl.Expiry {
+		return t.tbl
+	}
+	raw := *t.tbl
+	raw.Expiry = false
+	return &raw
+}
+
+// live は rawTable で読んだ行が期限切れなら nil を、そうでなければ row を返す
+func (t *Table) live(row Tuple) Tuple {
+	if row == nil || !t.tbl.Expiry || t.tbl.ExpiryColumn >= len(row) {
+		return row
+	}
+	at, ok := table.DecodeExpiry(row[t.tbl.ExpiryColumn])
+	now := time.Now()
+	if t.tbl.Clock != nil {
+		now = t.tbl.Clock()
+	}
+	if ok && !at.After(now) {
+		return nil
+	}
+	return row
+}
+
+// saveCounters は開いているテーブルのうち、変わった行数と大きさをカタログに記録する
+// 呼び出し時は db.mu を保持していること
+func (db *DB) saveCounters() error {
+	batch := table.NewWriteBatch()
+	var saved []*tableCounters
+	for _, t := range db.tables {
+		if t.counters == nil || !t.counters.dirty {
+			continue
+		}
+		row, err := t.catalogRow()
+		if err != nil {
+			return err
+		}
+		row = slices.Clone(row)
+		for len(row) <= catalogCountersColumn {
+			row = append(row, nil)
+		}
+		row[catalogCountersColumn] = t.counters.encode(false)
+		batch.Put(db.catalog, row)
+		saved = append(saved, t.counters)
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	if err := batch.Apply(db.bufmgr); err != nil {
+		return err
+	}
+	for _, c := range saved {
+		c.dirty = false
+	}
+	return nil
+}
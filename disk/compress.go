@@ -0,0 +1,373 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Compression はページを圧縮して格納する方式
+type Compression int
+
+const (
+	// CompressionNone は圧縮しない（既定）。ページIDの位置にそのまま格納する
+	CompressionNone Compression = iota
+	// CompressionFlate は DEFLATE（compress/flate の最速の設定）で圧縮する
+	CompressionFlate
+)
+
+// PageMapSuffix はヒープファイルのパスに付けるページマップの拡張子
+const PageMapSuffix = ".pagemap"
+
+// extentUnit は圧縮したページを格納する領域（エクステント）の単位
+// 大きさを揃えておくと、空いた領域を同じ大きさのページに使い回せる
+const extentUnit = 512
+
+// ページマップの形式
+// [magic "minidbpm": 8] [num_pages: 8] [entry: 16]... [crc32: 4]
+// entry: [offset: 8] [length: 4] [capacity: 4]
+const (
+	pageMapMagic      = "minidbpm"
+	pageMapHeaderSize = 16
+	pageMapEntrySize  = 16
+)
+
+// エラー定義
+var (
+	ErrCorruptPageMap = errors.New("corrupt page map")
+	errCompressOption = errors.New("compression cannot be used with mmap or direct I/O")
+)
+
+// extent は1ページを格納したファイル上の領域
+// length が PageSize なら圧縮せずにそのまま格納している
+// capacity は length を extentUnit に切り上げた大きさで、書き直すときはこの範囲に収まれば上書きする
+type extent struct {
+	offset   int64
+	length   uint32
+	capacity uint32
+	unsaved  bool // 保存済みのページマップからは参照されていない（最後に保存した後に割り当てた）
+}
+
+// CompressionStats はページ圧縮の統計
+type CompressionStats struct {
+	Pages       int   // 書き込まれたページ数
+	LogicalSize int64 // 圧縮前の大きさ（Pages × PageSize）
+	StoredSize  int64 // 圧縮したページの大きさの合計
+	FileSize    int64 // ヒープファイルの大きさ（空き領域を含む）
+	FreeSize    int64 // ページを書き直して空いた、再利用を待つ領域の大きさ（ページマップの保存を待つ領域を含む）
+}
+
+// Ratio は圧縮前の大きさに対するファイルの大きさの比を返す
+func (s CompressionStats) Ratio() float64 {
+	if s.LogicalSize == 0 {
+		return 0
+	}
+	return float64(s.FileSize) / float64(s.LogicalSize)
+}
+
+func (s CompressionStats) String() string {
+	return fmt.Sprintf("pages=%d logical=%d stored=%d file=%d free=%d ratio=%.2f",
+		s.Pages, s.LogicalSize, s.StoredSize, s.FileSize, s.FreeSize, s.Ratio())
+}
+
+// compressedStore は論理ページIDから圧縮したページの領域を引く表と、空き領域を管理する
+type compressedStore struct {
+	mu      sync.Mutex
+	path    string             // ページマップのパス
+	extents []extent           // 論理ページIDごとの領域（length が0なら未書き込み）
+	free    map[uint32][]int64 // 大きさごとの空き領域の位置
+	pending map[uint32][]int64 // 書き直して空いたが、保存済みのページマップがまだ指している領域
+	end     int64              // ファイルの使われている終端
+	dirty   bool               // 最後に保存してからページマップが変わったか
+	writers sync.Pool          // *flate.Writer
+}
+
+// openCompressed はページマップを読み込んで compressedStore を作る
+// ページマップがなければ空のヒープファイルとして始める
+func openCompressed(heapFile *os.File) (*compressedStore, error) {
+	s := &compressedStore{
+		path:    heapFile.Name() + PageMapSuffix,
+		free:    map[uint32][]int64{},
+		pending: map[uint32][]int64{},
+	}
+	data, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		info, err := heapFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() != 0 {
+			return nil, fmt.Errorf("%s: %w: missing for non-empty heap file", s.path, ErrCorruptPageMap)
+		}
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decode(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	s.rebuildFree()
+	return s, nil
+}
+
+// decode はページマップを読み込む
+func (s *compressedStore) decode(data []byte) error {
+	if len(data) < pageMapHeaderSize+4 || string(data[:8]) != pageMapMagic {
+		return ErrCorruptPageMap
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return fmt.Errorf("%w: checksum mismatch", ErrCorruptPageMap)
+	}
+	n := binary.BigEndian.Uint64(body[8:16])
+	if uint64(len(body)-pageMapHeaderSize) != n*pageMapEntrySize {
+		return fmt.Errorf("%w: %d pages in %d bytes", ErrCorruptPageMap, n, len(body))
+	}
+	s.extents = make([]extent, n)
+	for i := range s.extents {
+		e := body[pageMapHeaderSize+i*pageMapEntrySize:]
+		s.extents[i] = extent{
+			offset:   int64(binary.BigEndian.Uint64(e[0:8])),
+			length:   binary.BigEndian.Uint32(e[8:12]),
+			capacity: binary.BigEndian.Uint32(e[12:16]),
+		}
+	}
+	return nil
+}
+
+// encode はページマップをバイト列にする
+func (s *compressedStore) encode() []byte {
+	data := make([]byte, pageMapHeaderSize+len(s.extents)*pageMapEntrySize, pageMapHeaderSize+len(s.extents)*pageMapEntrySize+4)
+	copy(data, pageMapMagic)
+	binary.BigEndian.PutUint64(data[8:16], uint64(len(s.extents)))
+	for i, ext := range s.extents {
+		e := data[pageMapHeaderSize+i*pageMapEntrySize:]
+		binary.BigEndian.PutUint64(e[0:8], uint64(ext.offset))
+		binary.BigEndian.PutUint32(e[8:12], ext.length)
+		binary.BigEndian.PutUint32(e[12:16], ext.capacity)
+	}
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+}
+
+// rebuildFree はページマップから使われていない領域を求めて空き領域にする
+// 空き領域はファイルに記録しないので、開くたびにページの隙間から作り直す。
+// 保存を待っている領域（pending）は使われているものとして扱う
+func (s *compressedStore) rebuildFree() {
+	used := make([]extent, 0, len(s.extents))
+	for _, e := range s.extents {
+		if e.length != 0 {
+			used = append(used, e)
+		}
+	}
+	for capacity, offsets := range s.pending {
+		for _, offset := range offsets {
+			used = append(used, extent{offset: offset, capacity: capacity})
+		}
+	}
+	sort.Slice(used, func(i, j int) bool { return used[i].offset < used[j].offset })
+
+	var pos int64
+	for _, e := range used {
+		for gap := e.offset - pos; gap > 0; {
+			size := min(gap, PageSize)
+			s.free[uint32(size)] = append(s.free[uint32(size)], pos)
+			pos += size
+			gap -= size
+		}
+		pos = e.offset + int64(e.capacity)
+	}
+	s.end = pos
+}
+
+// numPages は書き込まれたページを含む論理ページ数を返す
+func (s *compressedStore) numPages() PageID {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return PageID(len(s.extents))
+}
+
+// compress はページを圧縮する。小さくならなければ元のページをそのまま返す
+func (s *compressedStore) compress(page []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, _ := s.writers.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&buf, flate.BestSpeed); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&buf)
+	}
+	defer s.writers.Put(w)
+	if _, err := w.Write(page); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	if buf.Len() >= PageSize {
+		return page, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// readPage は論理ページを読み込んで伸長する
+// 一度も書かれていないページは0で埋める
+func (s *compressedStore) readPage(file *os.File, pageID PageID, page []byte) error {
+	s.mu.Lock()
+	if int(pageID) >= len(s.extents) {
+		s.mu.Unlock()
+		return io.ErrUnexpectedEOF
+	}
+	e := s.extents[pageID]
+	s.mu.Unlock()
+
+	if e.length == 0 {
+		clear(page)
+		return nil
+	}
+	stored := make([]byte, e.length)
+	if _, err := file.ReadAt(stored, e.offset); err != nil {
+		return err
+	}
+	if e.length == PageSize {
+		copy(page, stored)
+		return nil
+	}
+	r := flate.NewReader(bytes.NewReader(stored))
+	defer r.Close()
+	if _, err := io.ReadFull(r, page); err != nil {
+		return fmt.Errorf("page %d: %w: %v", pageID, ErrCorruptPageMap, err)
+	}
+	return nil
+}
+
+// writePage は論理ページを圧縮して書き込む
+// 保存済みのページマップが指す領域を上書きするのは、圧縮した長さが変わらないときだけにする。
+// 長さが変わるのに上書きすると、保存する前に落ちたときに古いページマップの長さで読んで、
+// 古い内容も新しい内容も失う。そのときは別の領域に書いて元の領域を空ける。
+// 空けた領域は保存済みのページマップがまだ指しているので、save でページマップを書くまでは
+// 再利用しない。先に再利用すると、保存する前に落ちたときに古いページマップで別のページを読んでしまう
+// 最後に保存した後に割り当てた領域は、どのページマップからも参照されないので自由に上書きし、すぐ再利用する
+func (s *compressedStore) writePage(file *os.File, pageID PageID, page []byte) error {
+	stored, err := s.compress(page)
+	if err != nil {
+		return err
+	}
+	length := uint32(len(stored))
+	capacity := (length + extentUnit - 1) / extentUnit * extentUnit
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for int(pageID) >= len(s.extents) {
+		s.extents = append(s.extents, extent{})
+	}
+	e := s.extents[pageID]
+	inPlace := e.length != 0 && e.capacity >= capacity && (e.unsaved || e.length == length)
+	if !inPlace {
+		switch {
+		case e.length == 0:
+		case e.unsaved:
+			s.free[e.capacity] = append(s.free[e.capacity], e.offset)
+		default:
+			s.pending[e.capacity] = append(s.pending[e.capacity], e.offset)
+		}
+		e = extent{offset: s.allocate(capacity), capacity: capacity, unsaved: true}
+	}
+	// ページを書いている間に別の goroutine が同じ領域を割り当てないよう、ロックを持ったまま書く
+	if _, err := file.WriteAt(stored, e.offset); err != nil {
+		return err
+	}
+	e.length = length
+	s.extents[pageID] = e
+	s.dirty = true
+	return nil
+}
+
+// allocate は capacity バイトの領域を空き領域かファイルの終端から割り当てる
+func (s *compressedStore) allocate(capacity uint32) int64 {
+	if offsets := s.free[capacity]; len(offsets) > 0 {
+		offset := offsets[len(offsets)-1]
+		s.free[capacity] = offsets[:len(offsets)-1]
+		return offset
+	}
+	offset := s.end
+	s.end += int64(capacity)
+	return offset
+}
+
+// save はページマップが変わっていればアトミックに書き込む
+// 書き込んだら、書き直して空いた領域を再利用できるようにする。先にヒープファイルを書き戻しておくこと
+func (s *compressedStore) save() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	if err := writeFileAtomic(s.path, s.encode()); err != nil {
+		return err
+	}
+	for capacity, offsets := range s.pending {
+		s.free[capacity] = append(s.free[capacity], offsets...)
+	}
+	clear(s.pending)
+	for i := range s.extents {
+		s.extents[i].unsaved = false
+	}
+	s.dirty = false
+	return nil
+}
+
+// truncate は論理ページ end 以降をページマップから除き、使われなくなったファイルの末尾を切り詰める
+// 空き領域は残ったページの隙間から作り直す
+func (s *compressedStore) truncate(file *os.File, end PageID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int(end) >= len(s.extents) {
+		return nil
+	}
+	s.extents = s.extents[:end]
+	s.free = map[uint32][]int64{}
+	s.rebuildFree()
+	s.dirty = true
+	return file.Truncate(s.end)
+}
+
+// stats は圧縮の統計を返す
+func (s *compressedStore) stats() CompressionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var st CompressionStats
+	for _, e := range s.extents {
+		if e.length != 0 {
+			st.Pages++
+			st.StoredSize += int64(e.length)
+		}
+	}
+	for capacity, offsets := range s.free {
+		st.FreeSize += int64(capacity) * int64(len(offsets))
+	}
+	for capacity, offsets := range s.pending {
+		st.FreeSize += int64(capacity) * int64(len(offsets))
+	}
+	st.LogicalSize = int64(st.Pages) * PageSize
+	st.FileSize = s.end
+	return st
+}
+
+// CompressionStats はページ圧縮の統計を返す
+// Options.Compression を指定せずに開いた場合はゼロ値を返す
+func (d *DiskManager) CompressionStats() CompressionStats {
+	if d.compressed == nil {
+		return CompressionStats{}
+	}
+	return d.compressed.stats()
+}
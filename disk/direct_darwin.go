@@ -0,0 +1,27 @@
+//go:build darwin
+
+package disk
+
+import (
+	"os"
+	"syscall"
+)
+
+// directOpenFlag は macOS では O_DIRECT がないので0を返す（F_NOCACHE で代わりにする）
+func directOpenFlag() (int, error) {
+	return 0, nil
+}
+
+// disableCache はファイルに F_NOCACHE を設定してページキャッシュを通さないようにする
+func disableCache(f *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, f.Fd(), syscall.F_NOCACHE, 1)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fdatasync は macOS にはないので fsync で書き戻す
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
@@ -0,0 +1,23 @@
+//go:build linux
+
+package disk
+
+import (
+	"os"
+	"syscall"
+)
+
+// directOpenFlag はページキャッシュを通さずに開くフラグを返す
+func directOpenFlag() (int, error) {
+	return syscall.O_DIRECT, nil
+}
+
+// disableCache は Linux では O_DIRECT で済んでいるので何もしない
+func disableCache(f *os.File) error {
+	return nil
+}
+
+// fdatasync はファイルのデータだけを書き戻す
+func fdatasync(f *os.File) error {
+	return syscall.Fdatasync(int(f.Fd()))
+}
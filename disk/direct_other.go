@@ -0,0 +1,20 @@
+//go:build !linux && !darwin
+
+package disk
+
+import "os"
+
+// directOpenFlag は直接I/Oのないプラットフォームではエラーを返す
+func directOpenFlag() (int, error) {
+	return 0, ErrDirectIOUnsupported
+}
+
+// disableCache は何もしない
+func disableCache(f *os.File) error {
+	return nil
+}
+
+// fdatasync はないので fsync で書き戻す
+func fdatasync(f *os.File) error {
+	return f.Sync()
+}
@@ -1,8 +1,11 @@
 package disk
 
 import (
-	"io"
+	"context"
+	"errors"
 	"os"
+	"slices"
+	"sort"
 )
 
 // PageSize はディスク上のページサイズ（4KB）
@@ -12,12 +15,24 @@ type PageID uint64
 
 // DiskManager はヒープファイルへのページ単位の読み書きを管理する
 type DiskManager struct {
-	heapFile   *os.File // ヒープファイルのファイルディスクリプタ
-	nextPageID PageID   // 次に割り当てるページID（現在のページ数と同じ）
+	heapFile    *os.File           // ヒープファイルのファイルディスクリプタ
+	nextPageID  PageID             // 次に割り当てるページID（現在のページ数と同じ）
+	freePages   []PageID           // FreePage で戻された、再利用を待つページ（IDの降順）
+	directIO    bool               // ページキャッシュを通さずに読み書きする
+	dataSync    bool               // fsync の代わりに fdatasync を使う
+	syncMode    SyncMode           // 書き戻すタイミング
+	mmap        *mmapRegion        // Options.Mmap でマップした領域（使わなければ nil）
+	compressed  *compressedStore   // Options.Compression で圧縮したページの表（使わなければ nil）
+	encrypted   *encryptedStore    // Options.EncryptionKey で暗号化する（使わなければ nil）
+	mem         *memStore          // NewMemManager で作った場合のページ（heapFile は nil）
+	temporary   bool               // OpenTemp で作った一時ファイルなら Close で削除する
+	faults      *faultInjector     // InjectFaults で仕込んだ障害（なければ nil）
+	doubleWrite *doubleWriteBuffer // Options.DoubleWrite のダブルライトバッファ（使わなければ nil）
 }
 
 // NewDiskManager は既存のファイルからDiskManagerを作成する
 // ファイルサイズから現在のページ数を計算し、次に割り当てるページIDを決定する
+// ファイルにロックはかけない
 func NewDiskManager(heapFile *os.File) (*DiskManager, error) {
 	fileInfo, err := heapFile.Stat()
 	if err != nil {
@@ -33,52 +48,174 @@ func NewDiskManager(heapFile *os.File) (*DiskManager, error) {
 	}, nil
 }
 
-// Open はヒープファイルを開いてDiskManagerを作成する
+// ErrDatabaseLocked は別のプロセスがヒープファイルを開いていることを表す
+var ErrDatabaseLocked = errors.New("database is locked by another process")
+
+// Open はヒープファイルを読み書き両用で開いてDiskManagerを作成する
 // ファイルが存在しない場合は新規作成する（O_CREATE）
+//
+// 2つのプロセスが同じファイルに書き込むとファイルが壊れるので、ファイルに排他の
+// 勧告ロックをかける。他のプロセスが開いていれば ErrDatabaseLocked を返す。
+// ロックは Close するかプロセスが終了すると外れる
 func Open(heapFilePath string) (*DiskManager, error) {
-	// O_RDWR: 読み書き両用, O_CREATE: なければ作成, 0644: rw-r--r--
-	heapFile, err := os.OpenFile(heapFilePath, os.O_RDWR|os.O_CREATE, 0644)
+	return OpenWithOptions(heapFilePath, Options{})
+}
+
+// OpenReadOnly はヒープファイルを読み込み専用で開いてDiskManagerを作成する
+// 共有ロックをかけるので、読み込み専用どうしなら複数のプロセスから開ける
+// 読み書き両用で開いているプロセスがあれば ErrDatabaseLocked を返す
+func OpenReadOnly(heapFilePath string) (*DiskManager, error) {
+	heapFile, err := os.Open(heapFilePath)
+	if err != nil {
+		return nil, err
+	}
+	return openLocked(heapFile, false)
+}
+
+// openLocked はファイルにロックをかけてからDiskManagerを作成する
+// 失敗したらファイルを閉じる
+func openLocked(heapFile *os.File, exclusive bool) (*DiskManager, error) {
+	if err := lockFile(heapFile, exclusive); err != nil {
+		heapFile.Close()
+		return nil, err
+	}
+	d, err := NewDiskManager(heapFile)
 	if err != nil {
+		heapFile.Close()
 		return nil, err
 	}
-	return NewDiskManager(heapFile)
+	return d, nil
+}
+
+// Close はヒープファイルを閉じ、Open でかけたロックを外す
+// バッファプールを Flush した後に呼ぶこと
+func (d *DiskManager) Close() error {
+	if d.mem != nil {
+		d.mem.pages = nil
+		return nil
+	}
+	if d.temporary {
+		defer os.Remove(d.heapFile.Name())
+	}
+	if d.compressed != nil {
+		// SyncOff でもページマップは保存する。保存しないと書いたページを引けなくなる
+		err := d.Sync()
+		if err == nil {
+			err = d.compressed.save()
+		}
+		if err != nil {
+			d.heapFile.Close()
+			return err
+		}
+	}
+	if d.doubleWrite != nil {
+		d.doubleWrite.file.Close()
+	}
+	if d.mmap != nil {
+		if err := d.mmap.close(); err != nil {
+			d.heapFile.Close()
+			return err
+		}
+	}
+	return d.heapFile.Close()
 }
 
 // ReadPageData は指定されたページIDのデータを読み込む
 // data スライスは呼び出し側で PageSize 分確保しておく必要がある
 func (d *DiskManager) ReadPageData(pageID PageID, data []byte) error {
-	// ページID × ページサイズ = ファイル内のオフセット位置
-	offset := int64(PageSize * pageID)
-	_, err := d.heapFile.Seek(offset, io.SeekStart)
-	if err != nil {
-		return err
-	}
-	// io.ReadFull は len(data) バイト読むまでブロックする（EOFならエラー）
-	_, err = io.ReadFull(d.heapFile, data)
-	return err
+	return d.ReadPageDataContext(context.Background(), pageID, data)
+}
+
+// ReadPageDataContext は ReadPageData と同じだが、ctx がキャンセル済みなら
+// 読み込みを行わずに ctx.Err() を返す
+// 1ページの読み込み自体は短いので、始まったI/Oは中断しない
+//
+// 読み書きはオフセットを指定する pread / pwrite で行い、ファイルの現在位置を使わない。
+// そのため同じファイルディスクリプタから複数の goroutine が同時に読んでよい
+func (d *DiskManager) ReadPageDataContext(ctx context.Context, pageID PageID, data []byte) error {
+	return d.ReadPagesContext(ctx, pageID, data)
 }
 
 // WritePageData は指定されたページIDの位置にデータを書き込む
 func (d *DiskManager) WritePageData(pageID PageID, data []byte) error {
-	offset := int64(PageSize * pageID)
-	_, err := d.heapFile.Seek(offset, io.SeekStart)
-	if err != nil {
-		return err
-	}
-	_, err = d.heapFile.Write(data)
-	return err
+	return d.WritePageDataContext(context.Background(), pageID, data)
+}
+
+// WritePageDataContext は WritePageData と同じだが、ctx がキャンセル済みなら
+// 書き込みを行わずに ctx.Err() を返す
+func (d *DiskManager) WritePageDataContext(ctx context.Context, pageID PageID, data []byte) error {
+	return d.WritePagesContext(ctx, pageID, data)
 }
 
 // AllocatePage は新しいページを割り当ててそのIDを返す
+// FreePage で戻されたページがあれば、ファイルを伸ばさずにIDの小さいものから再利用する
+// 小さいIDから埋めるので、使われるページがファイルの先頭に寄り、TruncateFreePages で縮めやすくなる
 // 実際のディスク書き込みは WritePageData で行う
 func (d *DiskManager) AllocatePage() PageID {
+	if n := len(d.freePages); n > 0 {
+		pageID := d.freePages[n-1]
+		d.freePages = d.freePages[:n-1]
+		return pageID
+	}
 	pageID := d.nextPageID
 	d.nextPageID++
 	return pageID
 }
 
+// FreePage は使わなくなったページを空きページの一覧に戻し、AllocatePage で再利用できるようにする
+// 一覧はメモリ上にしか持たないので、閉じて開き直すとそれまでに戻したページは
+// 再利用されなくなる（ファイルの中に使われないページとして残るだけで、壊れはしない）
+// 既に一覧にあるページを戻しても何もしない
+// AllocatePage と同じく、呼び出し側で排他すること
+func (d *DiskManager) FreePage(pageID PageID) {
+	i := sort.Search(len(d.freePages), func(i int) bool { return d.freePages[i] <= pageID })
+	if i < len(d.freePages) && d.freePages[i] == pageID {
+		return
+	}
+	d.freePages = slices.Insert(d.freePages, i, pageID)
+}
+
+// NumFreePages は空きページの一覧にあるページ数を返す
+func (d *DiskManager) NumFreePages() int {
+	return len(d.freePages)
+}
+
+// CheckWritable はヒープファイルに書き込める状態かを確認する
+// ファイルが開けたままで、fsync が通れば nil を返す。ヘルスチェック用
+func (d *DiskManager) CheckWritable() error {
+	if d.mem != nil {
+		return nil
+	}
+	if _, err := d.heapFile.Stat(); err != nil {
+		return err
+	}
+	return d.heapFile.Sync()
+}
+
 // Sync はバッファの内容をディスクに書き込む（fsync）
 // クラッシュ時のデータ損失を防ぐために重要
+// SyncMode が SyncOff なら何もしない
+// Options.Mmap でマップしていれば、マップした領域に書いたページを先に msync で書き戻す
+// Options.Compression で圧縮していれば、書き戻した後にページマップを保存する
 func (d *DiskManager) Sync() error {
-	return d.heapFile.Sync()
+	if d.syncMode == SyncOff || d.mem != nil {
+		return nil
+	}
+	if d.mmap != nil {
+		if err := d.mmap.sync(); err != nil {
+			return err
+		}
+	}
+	if err := d.syncFile(); err != nil {
+		return err
+	}
+	if d.doubleWrite != nil {
+		if err := d.doubleWrite.synced(d); err != nil {
+			return err
+		}
+	}
+	if d.compressed != nil {
+		return d.compressed.save()
+	}
+	return nil
 }
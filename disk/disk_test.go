@@ -0,0 +1,821 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// テスト用のヘルパー関数
+func setupTestEnv(t *testing.T) (*DiskManager, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.db")
+	diskMgr, err := Open(path)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	t.Cleanup(func() { diskMgr.heapFile.Close() })
+	return diskMgr, path
+}
+
+func TestManifest(t *testing.T) {
+	diskMgr, path := setupTestEnv(t)
+
+	page := make([]byte, PageSize)
+	for i := 0; i < 3; i++ {
+		page[0] = byte(i)
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), page); err != nil {
+			t.Fatalf("failed to write page: %v", err)
+		}
+	}
+	if err := diskMgr.UpdateManifest(); err != nil {
+		t.Fatalf("failed to update manifest: %v", err)
+	}
+
+	manifestPath := ManifestPath(path)
+	if err := VerifyManifest(manifestPath); err != nil {
+		t.Fatalf("expected manifest to verify, got %v", err)
+	}
+	m, err := ReadManifest(manifestPath)
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(m.Segments) != 1 || m.Segments[0].Size != 3*PageSize {
+		t.Errorf("unexpected segments: %+v", m.Segments)
+	}
+
+	// マニフェストの更新後に書き換えたページは検出される
+	page[0] = 0xff
+	if err := diskMgr.WritePageData(1, page); err != nil {
+		t.Fatalf("failed to write page: %v", err)
+	}
+	if err := VerifyManifest(manifestPath); !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("expected ErrManifestMismatch, got %v", err)
+	}
+
+	// ヒープファイルが欠けている場合もエラーになる
+	if err := os.Remove(path); err != nil {
+		t.Fatalf("failed to remove heap file: %v", err)
+	}
+	if err := VerifyManifest(manifestPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected os.ErrNotExist, got %v", err)
+	}
+}
+
+func TestOpenLocked(t *testing.T) {
+	diskMgr, path := setupTestEnv(t)
+
+	// 読み書き両用で開いている間は、読み込み専用でも開けない
+	if _, err := Open(path); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("expected ErrDatabaseLocked, got %v", err)
+	}
+	if _, err := OpenReadOnly(path); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("expected ErrDatabaseLocked for read-only, got %v", err)
+	}
+
+	// 閉じればロックが外れ、読み込み専用どうしは同時に開ける
+	if err := diskMgr.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	r1, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("failed to open read-only: %v", err)
+	}
+	defer r1.Close()
+	r2, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatalf("failed to open read-only twice: %v", err)
+	}
+	defer r2.Close()
+	if _, err := Open(path); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("expected ErrDatabaseLocked while readers are open, got %v", err)
+	}
+}
+
+func TestHeader(t *testing.T) {
+	diskMgr, _ := setupTestEnv(t)
+
+	if _, err := diskMgr.ReadHeader(); !errors.Is(err, ErrNotDatabase) {
+		t.Errorf("expected ErrNotDatabase for an empty file, got %v", err)
+	}
+	diskMgr.AllocatePage()
+	if err := diskMgr.WriteHeader(NewHeader(7)); err != nil {
+		t.Fatalf("failed to write header: %v", err)
+	}
+	h, err := diskMgr.ReadHeader()
+	if err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if h != NewHeader(7) {
+		t.Errorf("expected %+v, got %+v", NewHeader(7), h)
+	}
+
+	page := make([]byte, PageSize)
+	copy(page, "random bytes")
+	if _, err := DecodeHeader(page); !errors.Is(err, ErrNotDatabase) {
+		t.Errorf("expected ErrNotDatabase, got %v", err)
+	}
+	Header{FormatVersion: HeapFormatVersion + 1, PageSize: PageSize}.Encode(page)
+	if _, err := DecodeHeader(page); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for a newer version, got %v", err)
+	}
+	Header{FormatVersion: HeapFormatVersion, PageSize: 8192}.Encode(page)
+	if _, err := DecodeHeader(page); !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for another page size, got %v", err)
+	}
+}
+
+func TestOpenWithOptions(t *testing.T) {
+	dir := t.TempDir()
+	for _, opts := range []Options{
+		{SyncMode: SyncAlways, DataSync: true},
+		{SyncMode: SyncOff},
+		{DirectIO: true},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("test_%v_%v_%v.db", opts.DirectIO, opts.DataSync, opts.SyncMode))
+		diskMgr, err := OpenWithOptions(path, opts)
+		if opts.DirectIO && (errors.Is(err, ErrDirectIOUnsupported) || errors.Is(err, syscall.EINVAL)) {
+			// tmpfs などは O_DIRECT に対応していない
+			t.Logf("direct I/O unavailable: %v", err)
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: failed to open: %v", opts, err)
+		}
+
+		page := make([]byte, PageSize)
+		for i := 0; i < 3; i++ {
+			// 先頭をずらして、ページサイズに揃っていないバッファでも読み書きできるか確かめる
+			data := make([]byte, PageSize+1)[1:]
+			copy(data, fmt.Sprintf("page %d", i))
+			if err := diskMgr.WritePageData(diskMgr.AllocatePage(), data); err != nil {
+				t.Fatalf("%+v: failed to write page: %v", opts, err)
+			}
+		}
+		if err := diskMgr.Sync(); err != nil {
+			t.Fatalf("%+v: failed to sync: %v", opts, err)
+		}
+		if err := diskMgr.ReadPageData(2, page); err != nil {
+			t.Fatalf("%+v: failed to read page: %v", opts, err)
+		}
+		if !bytes.HasPrefix(page, []byte("page 2")) {
+			t.Errorf("%+v: unexpected page %q", opts, page[:8])
+		}
+		diskMgr.Close()
+	}
+}
+
+func TestReadWritePages(t *testing.T) {
+	diskMgr, _ := setupTestEnv(t)
+
+	data := make([]byte, 3*PageSize)
+	for i := 0; i < 3; i++ {
+		diskMgr.AllocatePage()
+		copy(data[i*PageSize:], fmt.Sprintf("page %d", i))
+	}
+	if err := diskMgr.WritePages(0, data); err != nil {
+		t.Fatalf("failed to write pages: %v", err)
+	}
+
+	// 1ページずつでもまとめてでも同じ内容が読める
+	page := make([]byte, PageSize)
+	if err := diskMgr.ReadPageData(1, page); err != nil {
+		t.Fatalf("failed to read page: %v", err)
+	}
+	if !bytes.HasPrefix(page, []byte("page 1")) {
+		t.Errorf("unexpected page %q", page[:8])
+	}
+	got := make([]byte, 2*PageSize)
+	if err := diskMgr.ReadPages(1, got); err != nil {
+		t.Fatalf("failed to read pages: %v", err)
+	}
+	if !bytes.Equal(got, data[PageSize:]) {
+		t.Error("pages read together differ from the pages written")
+	}
+
+	if err := diskMgr.ReadPages(2, got); err == nil {
+		t.Error("expected an error when reading past the end of the file")
+	}
+	if err := diskMgr.WritePages(0, make([]byte, PageSize+1)); err == nil {
+		t.Error("expected an error for a partial page")
+	}
+}
+
+func TestConcurrentReads(t *testing.T) {
+	diskMgr, _ := setupTestEnv(t)
+
+	page := make([]byte, PageSize)
+	for i := 0; i < 8; i++ {
+		page[0] = byte(i)
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), page); err != nil {
+			t.Fatalf("failed to write page: %v", err)
+		}
+	}
+
+	// ファイルの現在位置を共有しないので、同時に読んでも別のページが混ざらない
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(pageID PageID) {
+			defer wg.Done()
+			buf := make([]byte, PageSize)
+			for n := 0; n < 100; n++ {
+				if err := diskMgr.ReadPageData(pageID, buf); err != nil {
+					errs <- err
+					return
+				}
+				if buf[0] != byte(pageID) {
+					errs <- fmt.Errorf("page %d: read %d", pageID, buf[0])
+					return
+				}
+			}
+		}(PageID(i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestOpenMmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	if _, err := OpenWithOptions(path, Options{Mmap: true, DirectIO: true}); err == nil {
+		t.Fatal("expected error for mmap with direct I/O")
+	}
+
+	diskMgr, err := OpenWithOptions(path, Options{Mmap: true})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	// 最初にマップした大きさ（1MiB）を越えるまで書き、マップし直しても読めるか確かめる
+	const numPages = 300
+	data := make([]byte, PageSize)
+	for i := 0; i < numPages; i++ {
+		copy(data, fmt.Sprintf("page %03d", i))
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), data); err != nil {
+			t.Fatalf("failed to write page %d: %v", i, err)
+		}
+	}
+	// マップした領域の中にあるページを上書きする
+	copy(data, "rewrite!")
+	if err := diskMgr.WritePageData(5, data); err != nil {
+		t.Fatalf("failed to rewrite page: %v", err)
+	}
+	if err := diskMgr.ReadPageData(numPages-1, data); err != nil {
+		t.Fatalf("failed to read page: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte("page 299")) {
+		t.Errorf("unexpected page %q", data[:8])
+	}
+	if err := diskMgr.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	diskMgr.Close()
+
+	// マップせずに開き直しても同じ内容が読める
+	diskMgr, err = Open(path)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer diskMgr.Close()
+	for pageID, want := range map[PageID]string{0: "page 000", 5: "rewrite!", 299: "page 299"} {
+		if err := diskMgr.ReadPageData(pageID, data); err != nil {
+			t.Fatalf("failed to read page %d: %v", pageID, err)
+		}
+		if !bytes.HasPrefix(data, []byte(want)) {
+			t.Errorf("page %d: got %q, want %q", pageID, data[:8], want)
+		}
+	}
+}
+
+func TestOpenCompressed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Compression: CompressionFlate}
+	diskMgr, err := OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	textPage := func(i int) []byte {
+		page := make([]byte, PageSize)
+		copy(page, bytes.Repeat([]byte(fmt.Sprintf("row %d: hello, world; ", i)), 100))
+		return page
+	}
+	for i := 0; i < 10; i++ {
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), textPage(i)); err != nil {
+			t.Fatalf("failed to write page %d: %v", i, err)
+		}
+	}
+	stats := diskMgr.CompressionStats()
+	if stats.Pages != 10 || stats.Ratio() >= 0.5 {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+
+	// 圧縮できないページで書き直すと、別の領域に移って元の領域が空く
+	noise := make([]byte, PageSize)
+	x := uint64(1)
+	for i := range noise {
+		x = x*6364136223846793005 + 1442695040888963407
+		noise[i] = byte(x >> 56)
+	}
+	if err := diskMgr.WritePageData(3, noise); err != nil {
+		t.Fatalf("failed to rewrite page: %v", err)
+	}
+	if stats := diskMgr.CompressionStats(); stats.FreeSize == 0 {
+		t.Errorf("expected free space after relocation: %v", stats)
+	}
+	if err := diskMgr.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	diskMgr, err = OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer diskMgr.Close()
+	if got := diskMgr.AllocatePage(); got != 10 {
+		t.Errorf("next page id: got %d, want 10", got)
+	}
+	page := make([]byte, PageSize)
+	for i := 0; i < 10; i++ {
+		want := textPage(i)
+		if i == 3 {
+			want = noise
+		}
+		if err := diskMgr.ReadPageData(PageID(i), page); err != nil {
+			t.Fatalf("failed to read page %d: %v", i, err)
+		}
+		if !bytes.Equal(page, want) {
+			t.Errorf("page %d: content mismatch", i)
+		}
+	}
+	// 空いた領域は開き直した後も再利用される
+	before := diskMgr.CompressionStats().FileSize
+	if err := diskMgr.WritePageData(10, textPage(10)); err != nil {
+		t.Fatalf("failed to write page: %v", err)
+	}
+	if after := diskMgr.CompressionStats().FileSize; after != before {
+		t.Errorf("file grew from %d to %d despite free space", before, after)
+	}
+}
+
+func TestCompressedReuseAfterSave(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	diskMgr, err := OpenWithOptions(path, Options{Compression: CompressionFlate})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer diskMgr.Close()
+	textPage := func(i int) []byte {
+		page := make([]byte, PageSize)
+		copy(page, bytes.Repeat([]byte(fmt.Sprintf("row %d: hello, world; ", i)), 100))
+		return page
+	}
+	for i := 0; i < 4; i++ {
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), textPage(i)); err != nil {
+			t.Fatalf("failed to write page %d: %v", i, err)
+		}
+	}
+	if err := diskMgr.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	saved := slices.Clone(diskMgr.compressed.extents)
+
+	// ページ1を圧縮できない内容で書き直すと、別の領域に移る
+	noise := make([]byte, PageSize)
+	x := uint64(1)
+	for i := range noise {
+		x = x*6364136223846793005 + 1442695040888963407
+		noise[i] = byte(x >> 56)
+	}
+	if err := diskMgr.WritePageData(1, noise); err != nil {
+		t.Fatalf("failed to rewrite page: %v", err)
+	}
+	// 保存したページマップはまだ元の領域を指しているので、ページマップを保存するまでは使い回さない
+	if err := diskMgr.WritePageData(diskMgr.AllocatePage(), textPage(4)); err != nil {
+		t.Fatalf("failed to write page: %v", err)
+	}
+	if got := diskMgr.compressed.extents[4].offset; got == saved[1].offset {
+		t.Fatalf("page 4 reused the extent of page 1 at %d before the page map was saved", got)
+	}
+	if stats := diskMgr.CompressionStats(); stats.FreeSize != int64(saved[1].capacity) {
+		t.Errorf("expected the old extent to wait for reuse: %v", stats)
+	}
+
+	// 保存した後は使い回す
+	if err := diskMgr.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	if err := diskMgr.WritePageData(diskMgr.AllocatePage(), textPage(5)); err != nil {
+		t.Fatalf("failed to write page: %v", err)
+	}
+	if got := diskMgr.compressed.extents[5].offset; got != saved[1].offset {
+		t.Errorf("page 5 at %d, expected the freed extent at %d", got, saved[1].offset)
+	}
+}
+
+func TestCompressedCrashBeforeSave(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	opts := Options{Compression: CompressionFlate}
+	diskMgr, err := OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer diskMgr.Close()
+	textPage := func(i int) []byte {
+		page := make([]byte, PageSize)
+		copy(page, bytes.Repeat([]byte(fmt.Sprintf("row %d: hello, world; ", i)), 100))
+		return page
+	}
+	for i := 0; i < 3; i++ {
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), textPage(i)); err != nil {
+			t.Fatalf("failed to write page %d: %v", i, err)
+		}
+	}
+	if err := diskMgr.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	saved := slices.Clone(diskMgr.compressed.extents)
+
+	// 長さの変わる書き直しは、元の領域に収まっても別の領域に書く
+	if err := diskMgr.WritePageData(1, textPage(1000)); err != nil {
+		t.Fatalf("failed to rewrite page: %v", err)
+	}
+	if e := diskMgr.compressed.extents[1]; e.length == saved[1].length || e.offset == saved[1].offset {
+		t.Fatalf("expected page 1 to move to a new extent: %+v, saved %+v", e, saved[1])
+	}
+	// 保存する前に落ちたときのファイルを作る
+	crashed := filepath.Join(dir, "crashed.db")
+	for _, suffix := range []string{"", PageMapSuffix} {
+		data, err := os.ReadFile(path + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(crashed+suffix, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	recovered, err := OpenWithOptions(crashed, opts)
+	if err != nil {
+		t.Fatalf("failed to open the crashed copy: %v", err)
+	}
+	defer recovered.Close()
+	page := make([]byte, PageSize)
+	for i := 0; i < 3; i++ {
+		if err := recovered.ReadPageData(PageID(i), page); err != nil {
+			t.Fatalf("failed to read page %d: %v", i, err)
+		}
+		if !bytes.Equal(page, textPage(i)) {
+			t.Errorf("page %d: expected the contents before the rewrite", i)
+		}
+	}
+
+	// 保存していない領域は、長さが変わってもそのまま上書きする
+	offset := diskMgr.compressed.extents[1].offset
+	if err := diskMgr.WritePageData(1, textPage(10)); err != nil {
+		t.Fatalf("failed to rewrite page: %v", err)
+	}
+	if got := diskMgr.compressed.extents[1].offset; got != offset {
+		t.Errorf("unsaved extent moved from %d to %d", offset, got)
+	}
+}
+
+func TestOpenEncrypted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	key := bytes.Repeat([]byte{1}, 32)
+	diskMgr, err := OpenWithOptions(path, Options{EncryptionKey: key})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	page := make([]byte, PageSize)
+	for i := 0; i < 3; i++ {
+		copy(page, fmt.Sprintf("secret %d", i))
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), page); err != nil {
+			t.Fatalf("failed to write page %d: %v", i, err)
+		}
+	}
+	diskMgr.Close()
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 3*EncryptedPageSize || bytes.Contains(raw, []byte("secret")) {
+		t.Errorf("heap file is not encrypted (%d bytes)", len(raw))
+	}
+
+	if _, err := OpenWithOptions(path, Options{EncryptionKey: bytes.Repeat([]byte{2}, 32)}); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("expected ErrDecryptionFailed with wrong key, got %v", err)
+	}
+
+	newKey := bytes.Repeat([]byte{3}, 16)
+	if err := RotateKey(path, key, newKey); err != nil {
+		t.Fatalf("failed to rotate key: %v", err)
+	}
+	if _, err := OpenWithOptions(path, Options{EncryptionKey: key}); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("old key still works after rotation: %v", err)
+	}
+	diskMgr, err = OpenWithOptions(path, Options{EncryptionKey: newKey})
+	if err != nil {
+		t.Fatalf("failed to open with new key: %v", err)
+	}
+	defer diskMgr.Close()
+	if err := diskMgr.ReadPageData(2, page); err != nil {
+		t.Fatalf("failed to read page: %v", err)
+	}
+	if !bytes.HasPrefix(page, []byte("secret 2")) {
+		t.Errorf("unexpected page %q", page[:8])
+	}
+}
+
+func TestTempManagers(t *testing.T) {
+	dir := t.TempDir()
+	temp, err := OpenTemp(dir)
+	if err != nil {
+		t.Fatalf("failed to open temp: %v", err)
+	}
+	for name, diskMgr := range map[string]*DiskManager{"mem": NewMemManager(), "temp": temp} {
+		page := make([]byte, PageSize)
+		for i := 0; i < 3; i++ {
+			copy(page, fmt.Sprintf("page %d", i))
+			if err := diskMgr.WritePageData(diskMgr.AllocatePage(), page); err != nil {
+				t.Fatalf("%s: failed to write page: %v", name, err)
+			}
+		}
+		if err := diskMgr.ReadPageData(1, page); err != nil {
+			t.Fatalf("%s: failed to read page: %v", name, err)
+		}
+		if !bytes.HasPrefix(page, []byte("page 1")) {
+			t.Errorf("%s: unexpected page %q", name, page[:8])
+		}
+		if err := diskMgr.ReadPageData(3, page); err == nil {
+			t.Errorf("%s: expected error reading unallocated page", name)
+		}
+		if err := diskMgr.Sync(); err != nil {
+			t.Errorf("%s: failed to sync: %v", name, err)
+		}
+		if err := diskMgr.Close(); err != nil {
+			t.Errorf("%s: failed to close: %v", name, err)
+		}
+	}
+
+	// 一時ファイルは Close で消える
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("temp file left behind: %v", entries)
+	}
+}
+
+func TestInjectFaults(t *testing.T) {
+	diskMgr, _ := setupTestEnv(t)
+	page := make([]byte, PageSize)
+	for i := 0; i < 2; i++ {
+		copy(page, bytes.Repeat([]byte{byte('a' + i)}, PageSize))
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), page); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	diskMgr.InjectFaults(Faults{FailWriteAt: 1, TornWriteAt: 2, TornBytes: 100})
+	copy(page, bytes.Repeat([]byte{'x'}, PageSize))
+	if err := diskMgr.WritePageData(0, page); !errors.Is(err, ErrInjectedFault) {
+		t.Errorf("write 1: expected ErrInjectedFault, got %v", err)
+	}
+	if err := diskMgr.WritePageData(1, page); !errors.Is(err, ErrInjectedFault) {
+		t.Errorf("write 2: expected ErrInjectedFault, got %v", err)
+	}
+
+	diskMgr.InjectFaults(Faults{ShortReadAt: 2})
+	if err := diskMgr.ReadPageData(0, page); err != nil {
+		t.Fatalf("read 1: %v", err)
+	}
+	if page[0] != 'a' {
+		t.Errorf("failed write modified page 0: %q", page[0])
+	}
+	if err := diskMgr.ReadPageData(1, page); err != io.ErrUnexpectedEOF {
+		t.Errorf("read 2: expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// 破れた書き込みでは先頭の100バイトだけが新しい内容になる
+	diskMgr.InjectFaults(Faults{})
+	if err := diskMgr.ReadPageData(1, page); err != nil {
+		t.Fatal(err)
+	}
+	if page[99] != 'x' || page[100] != 'b' {
+		t.Errorf("unexpected torn page: %q %q", page[99], page[100])
+	}
+}
+
+func TestDoubleWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{DoubleWrite: true}
+	diskMgr, err := OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for _, c := range []byte("abc") {
+		pageID := PageID(0)
+		if c != 'a' {
+			pageID = 1
+		}
+		if pageID == diskMgr.nextPageID {
+			diskMgr.AllocatePage()
+		}
+		if err := diskMgr.WritePageData(pageID, bytes.Repeat([]byte{c}, PageSize)); err != nil {
+			t.Fatalf("failed to write page: %v", err)
+		}
+	}
+	diskMgr.Close()
+
+	// ページ1の書き込みが先頭の512バイトで止まったことにする
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteAt(bytes.Repeat([]byte{'z'}, 512), PageSize)
+	f.Close()
+
+	diskMgr, err = OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer diskMgr.Close()
+	page := make([]byte, PageSize)
+	for pageID, want := range []byte("ac") {
+		if err := diskMgr.ReadPageData(PageID(pageID), page); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(page, bytes.Repeat([]byte{want}, PageSize)) {
+			t.Errorf("page %d was not restored: starts with %q", pageID, page[:4])
+		}
+	}
+}
+
+func TestDoubleWriteTruncate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{DoubleWrite: true}
+	diskMgr, err := OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := diskMgr.WritePageData(diskMgr.AllocatePage(), bytes.Repeat([]byte{byte('a' + i)}, PageSize)); err != nil {
+			t.Fatalf("failed to write page: %v", err)
+		}
+	}
+	if err := diskMgr.Sync(); err != nil {
+		t.Fatalf("failed to sync: %v", err)
+	}
+	// fsync した後はレコードが要らないので消える
+	if info, err := os.Stat(path + DoubleWriteSuffix); err != nil || info.Size() != 0 {
+		t.Errorf("expected an empty double write buffer after sync, got %v %v", info.Size(), err)
+	}
+
+	// 最後に書いたページを切り詰めても、開き直したときにレコードから戻らない
+	if err := diskMgr.WritePageData(5, bytes.Repeat([]byte{'z'}, PageSize)); err != nil {
+		t.Fatalf("failed to write page: %v", err)
+	}
+	diskMgr.FreePage(4)
+	diskMgr.FreePage(5)
+	if n, err := diskMgr.TruncateFreePages(); err != nil || n != 2 {
+		t.Fatalf("expected 2 truncated pages, got %d %v", n, err)
+	}
+	if err := diskMgr.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	diskMgr, err = OpenWithOptions(path, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer diskMgr.Close()
+	if n := diskMgr.NumPages(); n != 4 {
+		t.Errorf("expected 4 pages, got %d", n)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 4*PageSize {
+		t.Errorf("expected %d bytes, got %v %v", 4*PageSize, info.Size(), err)
+	}
+}
+
+func TestFreePage(t *testing.T) {
+	d := NewMemManager()
+	for want := PageID(0); want < 3; want++ {
+		if got := d.AllocatePage(); got != want {
+			t.Fatalf("expected page %d, got %d", want, got)
+		}
+	}
+	d.FreePage(2)
+	d.FreePage(0)
+	d.FreePage(2)
+	if n := d.NumFreePages(); n != 2 {
+		t.Errorf("expected 2 free pages, got %d", n)
+	}
+	// IDの小さいページから再利用し、使い切ったら末尾を伸ばす
+	for _, want := range []PageID{0, 2, 3} {
+		if got := d.AllocatePage(); got != want {
+			t.Errorf("expected page %d, got %d", want, got)
+		}
+	}
+}
+
+func TestTruncateFreePages(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		opts Options
+	}{
+		{"plain", Options{}},
+		{"mmap", Options{Mmap: true}},
+		{"compressed", Options{Compression: CompressionFlate}},
+		{"encrypted", Options{EncryptionKey: bytes.Repeat([]byte{1}, 32)}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.db")
+			d, err := OpenWithOptions(path, tc.opts)
+			if err != nil {
+				t.Fatalf("failed to open: %v", err)
+			}
+			page := make([]byte, PageSize)
+			for i := 0; i < 8; i++ {
+				pageID := d.AllocatePage()
+				page[0] = byte(pageID)
+				if err := d.WritePageData(pageID, page); err != nil {
+					t.Fatalf("failed to write page %d: %v", pageID, err)
+				}
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := info.Size()
+
+			// 末尾に続く 5, 6, 7 だけを切り詰め、間にある 2 は一覧に残す
+			for _, pageID := range []PageID{6, 2, 7, 5} {
+				d.FreePage(pageID)
+			}
+			n, err := d.TruncateFreePages()
+			if err != nil {
+				t.Fatalf("failed to truncate: %v", err)
+			}
+			if n != 3 {
+				t.Errorf("expected 3 truncated pages, got %d", n)
+			}
+			if got := d.NumPages(); got != 5 {
+				t.Errorf("expected 5 pages, got %d", got)
+			}
+			if got := d.NumFreePages(); got != 1 {
+				t.Errorf("expected 1 free page, got %d", got)
+			}
+			if info, err := os.Stat(path); err != nil {
+				t.Fatal(err)
+			} else if info.Size() >= before {
+				t.Errorf("file did not shrink: %d -> %d bytes", before, info.Size())
+			}
+			if n, err := d.TruncateFreePages(); err != nil || n != 0 {
+				t.Errorf("expected nothing to truncate, got %d, %v", n, err)
+			}
+
+			for _, want := range []PageID{2, 5} {
+				if got := d.AllocatePage(); got != want {
+					t.Errorf("expected page %d, got %d", want, got)
+				}
+			}
+			page[0] = 5
+			if err := d.WritePageData(5, page); err != nil {
+				t.Fatalf("failed to write page 5: %v", err)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatalf("failed to close: %v", err)
+			}
+
+			// 開き直しても残したページは読め、ページ数は縮んだまま
+			d, err = OpenWithOptions(path, tc.opts)
+			if err != nil {
+				t.Fatalf("failed to reopen: %v", err)
+			}
+			defer d.Close()
+			if got := d.NumPages(); got != 6 {
+				t.Errorf("expected 6 pages after reopen, got %d", got)
+			}
+			for _, pageID := range []PageID{4, 5} {
+				if err := d.ReadPageData(pageID, page); err != nil {
+					t.Fatalf("failed to read page %d: %v", pageID, err)
+				}
+				if page[0] != byte(pageID) {
+					t.Errorf("page %d: expected %d, got %d", pageID, pageID, page[0])
+				}
+			}
+		})
+	}
+}
@@ -27,18 +27,173 @@ PageIDはページを一意に識別する番号。ファイル先頭から順
 
 	offset = PageID × PageSize
 
+読み書きはこのオフセットを指定する pread / pwrite（ReadAt / WriteAt）で行う。
+ファイルの現在位置を動かさないので、同じファイルを複数の goroutine から同時に読める。
+
 # 主な機能
 
   - Open: ヒープファイルを開く（なければ作成）
+  - OpenReadOnly: ヒープファイルを読み込み専用で開く
   - ReadPageData: 指定ページをディスクから読み込む
   - WritePageData: 指定ページをディスクに書き込む
-  - AllocatePage: 新しいページを割り当てる
+  - ReadPages / WritePages: IDの連続する複数のページを1回の pread / pwrite で読み書きする
+  - AllocatePage: 新しいページを割り当てる（FreePage で戻したページがあればIDの小さいものから再利用する）
+  - FreePage: 使わなくなったページを空きページの一覧に戻す（一覧はメモリ上にだけ持つ）
+  - TruncateFreePages: ファイルの末尾に並んだ空きページを切り詰めてファイルを縮める
   - Sync: バッファをディスクに強制書き込み（fsync）
+  - UpdateManifest: マニフェストを現在のヒープファイルの内容で書き直す
+  - Close: ヒープファイルを閉じてロックを外す
 
 # なぜSyncが重要か
 
 OSはパフォーマンスのためにディスク書き込みをバッファリングする。
 Syncを呼ばないと、クラッシュ時にデータが失われる可能性がある。
 トランザクションのコミット時などにSyncを呼ぶことでデータの永続性を保証する。
+
+OpenWithOptions で、耐久性と速さのどちらを取るかを選べる：
+
+	diskMgr, err := disk.OpenWithOptions("data.db", disk.Options{
+	    SyncMode: disk.SyncAlways, // ページを書くたびに fsync（SyncNormal は Sync のときだけ、SyncOff はしない）
+	    DataSync: true,            // fsync の代わりに fdatasync
+	    DirectIO: true,            // OSのページキャッシュを通さない（O_DIRECT / F_NOCACHE）
+	})
+
+DirectIO ではページを一度ページサイズ境界に揃えたバッファに移してから読み書きする。
+tmpfs のように O_DIRECT に対応していないファイルシステムでは開けない。
+
+Options.Mmap を有効にすると、ヒープファイルを共有マッピングし、ページの読み書きを
+メモリのコピーで済ませる。ページごとの pread / pwrite のシステムコールがなくなるので、
+バッファプールから溢れるほど読み込みの多い負荷で効く。ファイルの終端より先への書き込みは
+pwrite で行い、マップした領域を広げる（足りなければマップし直す）。
+マップした領域に書いたページは Sync で msync してから fsync する。
+mmap のないプラットフォームでは Options.Mmap を無視する。
+
+# ページの圧縮
+
+Options.Compression に CompressionFlate を指定すると、ページを DEFLATE で圧縮してから書く。
+テキストの多い行なら、ファイルの大きさが数分の一になる。圧縮したページは大きさが
+まちまちなので、ページIDの位置ではなく512バイト単位の領域（エクステント）に置き、
+論理ページIDから領域を引く表をページマップ（<ヒープファイル>.pagemap）に持つ：
+
+	pagemap: page 0 → [offset 0, 812 bytes]  page 1 → [offset 1024, 430 bytes] ...
+
+保存済みのページマップが指す領域は、圧縮した長さが変わらないときだけ上書きする。
+長さが変わるか元の領域に収まらなければ別の領域に移し、空いた領域は同じ大きさの
+ページに使い回す。ページマップは Sync と Close で一時ファイルと rename で置き換える。
+保存済みのページマップはまだ元の領域を指しているので、空いた領域はページマップを
+保存するまで使い回さない（その前に落ちても、古いページマップで読むページは壊れていない）。
+CompressionStats で圧縮前後の大きさと空き領域を確認できる：
+
+	diskMgr, _ := disk.OpenWithOptions("data.db", disk.Options{Compression: disk.CompressionFlate})
+	fmt.Println(diskMgr.CompressionStats())
+	// pages=10 logical=40960 stored=800 file=5120 free=0 ratio=0.12
+
+WALがないため、Sync の途中でクラッシュするとページマップとページの中身が食い違うことがある。
+
+# 暗号化
+
+Options.EncryptionKey に16・24・32バイトの鍵を渡すと、ページを AES-GCM で暗号化して書く。
+ページごとに乱数の nonce と認証タグを付けるので、ヒープファイル上の1ページは
+EncryptedPageSize（4124バイト）になる。ページIDも一緒に認証するため、
+鍵が違う・ページが書き換えられた・別の位置に移されたのいずれも ErrDecryptionFailed になる。
+
+	diskMgr, err := disk.OpenWithOptions("data.db", disk.Options{EncryptionKey: key})
+
+鍵を替えるときは、データベースを閉じてから RotateKey で全てのページを暗号化し直す：
+
+	err := disk.RotateKey("data.db", oldKey, newKey)
+
+マニフェストやバックアップのコピーはヒープファイルをそのまま写すので、暗号化されたままになる。
+
+# 一時的なページ
+
+ソートやハッシュ結合の途中結果のように、使い終わったら捨てる木やヒープには
+NewMemManager か OpenTemp で作ったDiskManagerを使う。どちらも普通のDiskManagerと
+同じようにバッファプールに渡せる：
+
+	diskMgr := disk.NewMemManager()         // ページをメモリ上に持つ
+	diskMgr, err := disk.OpenTemp("")       // os.TempDir() の一時ファイルに書く
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(64))
+	tree, _ := btree.Create(bufmgr)
+	// ...
+	diskMgr.Close() // ページもファイルも消える
+
+OpenTemp のファイルは fsync せず、Close で削除する。
+
+# 障害の注入
+
+InjectFaults はテストのために、N回目のページの書き込みや読み込みを失敗させたり、
+読み込みを途中で切ったり、書き込みを先頭の数百バイトだけで止めたり（破れたページ）、
+読み書きのたびに待たせたりする。バッファプールやB-treeのエラー処理を決まった順序で試せる：
+
+	diskMgr.InjectFaults(disk.Faults{TornWriteAt: 3, TornBytes: 512})
+	err := bufmgr.Flush() // 3ページ目の書き込みで errors.Is(err, disk.ErrInjectedFault)
+	diskMgr.InjectFaults(disk.Faults{}) // 障害を取り除く
+
+回数は複数ページの読み書きでもページ単位で数える。
+
+# 破れたページの保護
+
+ページの書き込みの途中で電源が落ちると、ページの前半だけが新しい内容になることがある
+（破れたページ）。Options.DoubleWrite を有効にすると、ページをヒープファイルに書く前に
+同じ内容をダブルライトバッファ（<ヒープファイル>.dwb）に書いて fsync する：
+
+	1. 前の書き込みのページをヒープファイルで fsync する
+	2. [magic | start_page_id | num_pages | crc32 | pages...] を .dwb に書いて fsync する
+	3. ページをヒープファイルに書く
+
+開くときに .dwb に完全なレコードが残っていれば、そのページをヒープファイルに書き戻す。
+レコードが壊れていれば、ヒープファイルへの書き込みは始まっていないので何もしない。
+Sync でヒープファイルを fsync した後と、開いて書き戻した後と、ページを切り詰める前には
+.dwb を空にする。古いレコードを書き戻して、切り詰めたページを戻さないようにするため。
+WALがないので、ページの全体像をWALに書く方式ではなくこの方式を使う。
+
+# ファイルヘッダー
+
+minidb パッケージが作るファイルでは、ページ0をファイルヘッダーにする：
+
+	[magic "minidb\x00\x01": 8] [format_version: 4] [page_size: 4] [catalog_page_id: 8]
+
+DecodeHeader はマジックナンバーがなければ ErrNotDatabase を、形式のバージョンが
+HeapFormatVersion より新しいかページサイズが違えば ErrUnsupportedFormat を返す。
+1本のB-treeだけを置く minidbd のファイルにはヘッダーがない。
+
+# ファイルのロック
+
+2つのプロセスが同じヒープファイルに書き込むと、互いのページを上書きして壊してしまう。
+これを防ぐため、Open はファイルに排他の勧告ロックを、OpenReadOnly は
+共有ロックをかける。取れなければ待たずに ErrDatabaseLocked を返す：
+
+	diskMgr, err := disk.Open("data.db")
+	if errors.Is(err, disk.ErrDatabaseLocked) {
+	    // 別の minidbd が動いている
+	}
+
+ロックは Close するかプロセスが終了すると外れる。勧告ロックなので、
+ロックを確認しないプログラムからの書き込みは防げない。ロックのかけ方はプラットフォームで違う：
+
+  - Linux・macOS・FreeBSD・NetBSD・DragonFly BSD は flock
+  - Solaris・illumos・AIX・OpenBSD は fcntl。ロックはプロセス単位なので、
+    同じプロセスの中で2度開くのは防げない
+  - Windows は LockFileEx。ファイルの終わりのずっと先の1バイトをロックする
+
+これ以外（js/wasm・wasip1・Plan 9 など）ではロックをかけず、何も守らない。
+
+# マニフェスト
+
+ヒープファイルの隣にJSON形式のマニフェスト（<ヒープファイル>.manifest）を置き、
+データベースを構成するファイルのサイズ・CRC32・形式のバージョンを記録する。
+開く前に VerifyManifest を呼べば、ファイルの欠落や書きかけを検出できる。
+
+	bufmgr.Flush()
+	diskMgr.UpdateManifest()
+
+	// 別のツールから
+	if err := disk.VerifyManifest(disk.ManifestPath("data.db")); err != nil {
+	    // errors.Is(err, disk.ErrManifestMismatch)
+	}
+
+マニフェストは一時ファイルに書いてから rename で置き換えるため、
+更新中にクラッシュしても壊れたマニフェストが残ることはない。
 */
 package disk
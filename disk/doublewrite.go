@@ -0,0 +1,181 @@
+package disk
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+)
+
+// DoubleWriteSuffix はヒープファイルのパスに付けるダブルライトバッファの拡張子
+const DoubleWriteSuffix = ".dwb"
+
+// ダブルライトバッファのレコードの形式
+// [magic "minidbdw": 8] [start_page_id: 8] [num_pages: 4] [crc32: 4] [pages...]
+// crc32 はヘッダーの前半とページ全体に対するもの
+const (
+	doubleWriteMagic      = "minidbdw"
+	doubleWriteHeaderSize = 24
+)
+
+var errDoubleWriteOption = errors.New("double write cannot be used with mmap, compression or encryption")
+
+// doubleWriteBuffer はページをヒープファイルに書く前に、同じ内容を書いておくファイル
+// ヒープファイルへの書き込みの途中でクラッシュしてページが破れても、
+// 開き直したときにここからページを書き戻せる
+type doubleWriteBuffer struct {
+	mu        sync.Mutex
+	file      *os.File
+	heapDirty bool // 最後のレコードのページをヒープファイルに書いた後、まだ fsync していない
+	hasRecord bool // ファイルにレコードが残っている
+}
+
+// openDoubleWrite はダブルライトバッファを開き、残っているレコードをヒープファイルに書き戻す
+// 書き戻したレコード（と壊れたレコード）は、次に開いたときにまた書き戻さないよう消す
+func (d *DiskManager) openDoubleWrite() error {
+	file, err := os.OpenFile(d.heapFile.Name()+DoubleWriteSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	d.doubleWrite = &doubleWriteBuffer{file: file, hasRecord: true}
+	err = d.recoverDoubleWrite()
+	if err == nil {
+		err = d.doubleWrite.discard(d)
+	}
+	if err != nil {
+		file.Close()
+		d.doubleWrite = nil
+		return err
+	}
+	return nil
+}
+
+// recoverDoubleWrite はダブルライトバッファに完全なレコードが残っていれば、
+// そのページをヒープファイルに書き戻す
+//
+// レコードはヒープファイルに書く前に fsync しているので、完全なレコードの内容は
+// そのページの最新の内容と一致する。レコード自体が壊れていれば、ヒープファイルへの
+// 書き込みはまだ始まっていないので何もしない
+func (d *DiskManager) recoverDoubleWrite() error {
+	header := make([]byte, doubleWriteHeaderSize)
+	if _, err := d.doubleWrite.file.ReadAt(header, 0); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	if string(header[:8]) != doubleWriteMagic {
+		return nil
+	}
+	startPageID := PageID(binary.BigEndian.Uint64(header[8:16]))
+	numPages := binary.BigEndian.Uint32(header[16:20])
+	data := make([]byte, int(numPages)*PageSize)
+	if _, err := d.doubleWrite.file.ReadAt(data, doubleWriteHeaderSize); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		return err
+	}
+	if doubleWriteChecksum(header, data) != binary.BigEndian.Uint32(header[20:24]) {
+		return nil
+	}
+
+	if _, err := d.heapFile.WriteAt(data, int64(PageSize*startPageID)); err != nil {
+		return err
+	}
+	if err := d.syncFile(); err != nil {
+		return err
+	}
+	if end := startPageID + PageID(numPages); end > d.nextPageID {
+		d.nextPageID = end
+	}
+	return nil
+}
+
+// doubleWriteChecksum はレコードのヘッダーの前半とページのCRC32を求める
+func doubleWriteChecksum(header, data []byte) uint32 {
+	crc := crc32.ChecksumIEEE(header[:20])
+	return crc32.Update(crc, crc32.IEEETable, data)
+}
+
+// before はページをヒープファイルに書く前に、ダブルライトバッファにレコードを書いて fsync する
+// 前のレコードのページがまだヒープファイルで fsync されていなければ、先に fsync する
+// （レコードを上書きした後で前のページが破れても書き戻せなくなるため）
+// after を呼ぶまでロックを持ったままにする
+func (b *doubleWriteBuffer) before(d *DiskManager, startPageID PageID, data []byte) error {
+	b.mu.Lock()
+	if b.heapDirty && d.syncMode != SyncOff {
+		if err := d.syncFile(); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	b.heapDirty = false
+
+	record := make([]byte, doubleWriteHeaderSize, doubleWriteHeaderSize+len(data))
+	copy(record, doubleWriteMagic)
+	binary.BigEndian.PutUint64(record[8:16], uint64(startPageID))
+	binary.BigEndian.PutUint32(record[16:20], uint32(len(data)/PageSize))
+	binary.BigEndian.PutUint32(record[20:24], doubleWriteChecksum(record, data))
+	record = append(record, data...)
+	b.hasRecord = true
+	if _, err := b.file.WriteAt(record, 0); err != nil {
+		b.mu.Unlock()
+		return err
+	}
+	if d.syncMode != SyncOff {
+		if err := b.file.Sync(); err != nil {
+			b.mu.Unlock()
+			return err
+		}
+	}
+	return nil
+}
+
+// after はヒープファイルへの書き込みが終わったことを記録してロックを外す
+func (b *doubleWriteBuffer) after() {
+	b.heapDirty = true
+	b.mu.Unlock()
+}
+
+// synced はヒープファイルを fsync したことを記録し、もう要らないレコードを消す
+// 消さないと、開き直すたびに古いレコードを書き戻し、その後に切り詰めたページまで戻してしまう
+func (b *doubleWriteBuffer) synced(d *DiskManager) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.heapDirty = false
+	return b.clear(d)
+}
+
+// discard はレコードを消す。レコードのページがまだヒープファイルで fsync されていなければ、先に fsync する
+// ページを切り詰めるときは、切り詰めたページを開き直したときに書き戻さないよう先に呼ぶ
+func (b *doubleWriteBuffer) discard(d *DiskManager) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.heapDirty && d.syncMode != SyncOff {
+		if err := d.syncFile(); err != nil {
+			return err
+		}
+	}
+	b.heapDirty = false
+	return b.clear(d)
+}
+
+// clear はファイルを空にしてレコードを消す。b.mu を保持して呼ぶこと
+func (b *doubleWriteBuffer) clear(d *DiskManager) error {
+	if !b.hasRecord {
+		return nil
+	}
+	if err := b.file.Truncate(0); err != nil {
+		return err
+	}
+	if d.syncMode != SyncOff {
+		if err := b.file.Sync(); err != nil {
+			return err
+		}
+	}
+	b.hasRecord = false
+	return nil
+}
@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// 暗号化したページの形式
+// [nonce: 12] [AES-GCM で暗号化したページ: 4096] [tag: 16]
+// ページIDを追加データとして認証するので、別の位置に移されたページも検出できる
+const (
+	encryptionNonceSize = 12
+	encryptionTagSize   = 16
+	// EncryptedPageSize は暗号化したページがヒープファイル上で占める大きさ
+	EncryptedPageSize = encryptionNonceSize + PageSize + encryptionTagSize
+)
+
+// エラー定義
+var (
+	// ErrDecryptionFailed はページを復号できなかったことを表す
+	// 鍵が違うか、ページが壊れているか書き換えられている
+	ErrDecryptionFailed = errors.New("page decryption failed")
+	errEncryptOption    = errors.New("encryption cannot be used with mmap, direct I/O or compression")
+)
+
+// encryptedStore はページを AES-GCM で暗号化して格納する
+// ページ n はヒープファイルの n × EncryptedPageSize の位置に置く
+type encryptedStore struct {
+	aead cipher.AEAD
+}
+
+// newEncryptedStore は鍵から encryptedStore を作る
+// 鍵は16・24・32バイト（AES-128・AES-192・AES-256）
+func newEncryptedStore(key []byte) (*encryptedStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedStore{aead: aead}, nil
+}
+
+// additionalData はページを認証するときに一緒に使うページID
+func additionalData(pageID PageID) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(pageID))
+}
+
+// readPage はページを読み込んで復号する
+// 割り当てただけで一度も書かれていないページ（全て0）は0で埋める
+func (s *encryptedStore) readPage(file *os.File, pageID PageID, page []byte) error {
+	stored := make([]byte, EncryptedPageSize)
+	if _, err := file.ReadAt(stored, int64(pageID)*EncryptedPageSize); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	if isZero(stored) {
+		clear(page)
+		return nil
+	}
+	nonce, ciphertext := stored[:encryptionNonceSize], stored[encryptionNonceSize:]
+	if _, err := s.aead.Open(page[:0], nonce, ciphertext, additionalData(pageID)); err != nil {
+		return fmt.Errorf("page %d: %w", pageID, ErrDecryptionFailed)
+	}
+	return nil
+}
+
+// writePage はページを暗号化して書き込む
+// 同じページを書き直すたびに新しい nonce を使う
+func (s *encryptedStore) writePage(file *os.File, pageID PageID, page []byte) error {
+	stored := make([]byte, encryptionNonceSize, EncryptedPageSize)
+	if _, err := rand.Read(stored); err != nil {
+		return err
+	}
+	stored = s.aead.Seal(stored, stored, page, additionalData(pageID))
+	_, err := file.WriteAt(stored, int64(pageID)*EncryptedPageSize)
+	return err
+}
+
+// isZero は全てのバイトが0かどうかを返す
+func isZero(b []byte) bool {
+	for _, c := range b {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyKey は最初に書かれたページを復号して、鍵が合っているかを確かめる
+func (d *DiskManager) verifyKey() error {
+	page := make([]byte, PageSize)
+	for pageID := PageID(0); pageID < d.nextPageID; pageID++ {
+		stored := make([]byte, EncryptedPageSize)
+		if _, err := d.heapFile.ReadAt(stored, int64(pageID)*EncryptedPageSize); err != nil {
+			return err
+		}
+		if !isZero(stored) {
+			return d.encrypted.readPage(d.heapFile, pageID, page)
+		}
+	}
+	return nil
+}
+
+// RotateKey は暗号化したヒープファイルを新しい鍵で暗号化し直す
+// 全てのページを oldKey で復号して newKey で暗号化した一時ファイルを作り、
+// fsync してから rename で置き換える。途中で失敗しても元のファイルは残る
+// ヒープファイルを開いているプロセスがあれば ErrDatabaseLocked を返す
+func RotateKey(heapFilePath string, oldKey, newKey []byte) error {
+	src, err := OpenWithOptions(heapFilePath, Options{EncryptionKey: oldKey})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := heapFilePath + ".rotate"
+	os.Remove(tmpPath)
+	dst, err := OpenWithOptions(tmpPath, Options{EncryptionKey: newKey})
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath) // rename に成功していれば何もしない
+
+	page := make([]byte, PageSize)
+	for pageID := PageID(0); pageID < src.nextPageID; pageID++ {
+		if err := src.ReadPageData(pageID, page); err != nil {
+			dst.Close()
+			return err
+		}
+		if err := dst.WritePageData(dst.AllocatePage(), page); err != nil {
+			dst.Close()
+			return err
+		}
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, heapFilePath)
+}
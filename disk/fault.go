@@ -0,0 +1,125 @@
+package disk
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrInjectedFault は InjectFaults で仕込んだ障害によるエラーを表す
+var ErrInjectedFault = errors.New("injected fault")
+
+// DefaultTornBytes は破れた書き込みで実際に書くバイト数の既定値（1セクタ分）
+const DefaultTornBytes = 512
+
+// Faults はテストのためにDiskManagerに仕込む障害
+// 回数はページ単位で1から数える。0なら起こさない
+type Faults struct {
+	// FailWriteAt 回目のページの書き込みを、何も書かずに失敗させる
+	FailWriteAt int
+	// FailReadAt 回目のページの読み込みを失敗させる
+	FailReadAt int
+	// ShortReadAt 回目のページの読み込みで、ページの前半だけを読んで io.ErrUnexpectedEOF を返す
+	ShortReadAt int
+	// TornWriteAt 回目のページの書き込みで、先頭の TornBytes バイトだけを書いて失敗させる
+	// 書き込みの途中で電源が落ちた状態（破れたページ）を再現する
+	TornWriteAt int
+	// TornBytes は破れた書き込みで書くバイト数（0なら DefaultTornBytes）
+	TornBytes int
+	// Latency はページを読み書きするたびに待つ時間
+	Latency time.Duration
+}
+
+// faultInjector は仕込んだ障害と、これまでに読み書きしたページ数を持つ
+type faultInjector struct {
+	mu     sync.Mutex
+	faults Faults
+	reads  int
+	writes int
+}
+
+// InjectFaults は以降のページの読み書きに障害を仕込む。読み書きの回数は0から数え直す
+// バッファプールやB-treeのエラー処理を決まった順序で試すためのもので、テスト以外では使わない
+// ゼロ値の Faults を渡すと障害を取り除く
+func (d *DiskManager) InjectFaults(f Faults) {
+	if f == (Faults{}) {
+		d.faults = nil
+		return
+	}
+	d.faults = &faultInjector{faults: f}
+}
+
+// beforeRead は読み込みを数え、仕込んだ障害があればそれを返す
+// short が true なら、呼び出し側が読んだ後でページの後半を捨てる
+func (fi *faultInjector) beforeRead() (short bool, err error) {
+	fi.mu.Lock()
+	fi.reads++
+	n, f := fi.reads, fi.faults
+	fi.mu.Unlock()
+
+	time.Sleep(f.Latency)
+	if n == f.FailReadAt {
+		return false, ErrInjectedFault
+	}
+	return n == f.ShortReadAt, nil
+}
+
+// beforeWrite は書き込みを数え、仕込んだ障害があればそれを返す
+// torn が0より大きければ、呼び出し側はページの先頭 torn バイトだけを書く
+func (fi *faultInjector) beforeWrite() (torn int, err error) {
+	fi.mu.Lock()
+	fi.writes++
+	n, f := fi.writes, fi.faults
+	fi.mu.Unlock()
+
+	time.Sleep(f.Latency)
+	if n == f.FailWriteAt {
+		return 0, ErrInjectedFault
+	}
+	if n == f.TornWriteAt {
+		if f.TornBytes <= 0 || f.TornBytes >= PageSize {
+			return DefaultTornBytes, nil
+		}
+		return f.TornBytes, nil
+	}
+	return 0, nil
+}
+
+// readPageFaulty は障害を仕込んだDiskManagerで1ページを読む
+func (d *DiskManager) readPageFaulty(pageID PageID, page []byte) error {
+	short, err := d.faults.beforeRead()
+	if err != nil {
+		return err
+	}
+	if err := d.readPages(pageID, page); err != nil {
+		return err
+	}
+	if short {
+		clear(page[PageSize/2:])
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// writePageFaulty は障害を仕込んだDiskManagerで1ページを書く
+// 破れた書き込みでは、今のページの内容に新しいページの先頭だけを重ねて書く
+func (d *DiskManager) writePageFaulty(pageID PageID, page []byte) error {
+	torn, err := d.faults.beforeWrite()
+	if err != nil {
+		return err
+	}
+	if torn == 0 {
+		return d.writePages(pageID, page)
+	}
+	partial := make([]byte, PageSize)
+	if pageID < d.nextPageID {
+		// まだ書かれていないページなら読めないので0のままにする
+		d.readPages(pageID, partial)
+	}
+	copy(partial[:torn], page)
+	if err := d.writePages(pageID, partial); err != nil {
+		return err
+	}
+	return ErrInjectedFault
+}
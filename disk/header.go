@@ -0,0 +1,93 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// HeaderPageID はファイルヘッダーを置くページのID
+const HeaderPageID = PageID(0)
+
+// ファイルヘッダーのレイアウト（ページ0の先頭）:
+// [magic: 8] [format_version: 4] [page_size: 4] [catalog_page_id: 8]
+const (
+	headerMagicOffset         = 0
+	headerFormatVersionOffset = 8
+	headerPageSizeOffset      = 12
+	headerCatalogPageIDOffset = 16
+	HeaderSize                = 24
+)
+
+// headerMagic はminidbのファイルの先頭に置くバイト列
+var headerMagic = []byte("minidb\x00\x01")
+
+// エラー定義
+var (
+	ErrNotDatabase       = errors.New("not a minidb file")
+	ErrUnsupportedFormat = errors.New("unsupported file format")
+)
+
+// Header はヒープファイルの先頭ページに置くファイルヘッダー
+// minidbのファイルかどうか、どの形式で書かれたかを開く前に確かめるために使う
+type Header struct {
+	FormatVersion uint32 // ヒープファイルの形式のバージョン（HeapFormatVersion）
+	PageSize      uint32 // ページサイズ
+	CatalogPageID PageID // カタログのB-treeのメタページID
+}
+
+// NewHeader は現在の形式のファイルヘッダーを作る
+func NewHeader(catalogPageID PageID) Header {
+	return Header{FormatVersion: HeapFormatVersion, PageSize: PageSize, CatalogPageID: catalogPageID}
+}
+
+// Encode はヘッダーを page の先頭に書き、残りを0で埋める
+func (h Header) Encode(page []byte) {
+	clear(page)
+	copy(page[headerMagicOffset:], headerMagic)
+	binary.LittleEndian.PutUint32(page[headerFormatVersionOffset:], h.FormatVersion)
+	binary.LittleEndian.PutUint32(page[headerPageSizeOffset:], h.PageSize)
+	binary.LittleEndian.PutUint64(page[headerCatalogPageIDOffset:], uint64(h.CatalogPageID))
+}
+
+// DecodeHeader はページの先頭からファイルヘッダーを読み、検証する
+// マジックナンバーがなければ ErrNotDatabase、このバージョンで読めない形式や
+// ページサイズなら ErrUnsupportedFormat を返す
+func DecodeHeader(page []byte) (Header, error) {
+	if len(page) < HeaderSize || !bytes.Equal(page[headerMagicOffset:headerMagicOffset+len(headerMagic)], headerMagic) {
+		return Header{}, ErrNotDatabase
+	}
+	h := Header{
+		FormatVersion: binary.LittleEndian.Uint32(page[headerFormatVersionOffset:]),
+		PageSize:      binary.LittleEndian.Uint32(page[headerPageSizeOffset:]),
+		CatalogPageID: PageID(binary.LittleEndian.Uint64(page[headerCatalogPageIDOffset:])),
+	}
+	if h.FormatVersion == 0 || h.FormatVersion > HeapFormatVersion {
+		return Header{}, fmt.Errorf("%w: format version %d, supported up to %d", ErrUnsupportedFormat, h.FormatVersion, HeapFormatVersion)
+	}
+	if h.PageSize != PageSize {
+		return Header{}, fmt.Errorf("%w: page size %d, expected %d", ErrUnsupportedFormat, h.PageSize, PageSize)
+	}
+	return h, nil
+}
+
+// ReadHeader はヒープファイルのファイルヘッダーを読む
+func (d *DiskManager) ReadHeader() (Header, error) {
+	if d.nextPageID == 0 {
+		return Header{}, ErrNotDatabase
+	}
+	page := make([]byte, PageSize)
+	if err := d.ReadPageData(HeaderPageID, page); err != nil {
+		return Header{}, err
+	}
+	return DecodeHeader(page)
+}
+
+// WriteHeader はヒープファイルにファイルヘッダーを書く
+// ページ0はあらかじめ AllocatePage で割り当てておくこと
+func (d *DiskManager) WriteHeader(h Header) error {
+	page := make([]byte, PageSize)
+	h.Encode(page)
+	return d.WritePageData(HeaderPageID, page)
+}
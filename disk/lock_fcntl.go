@@ -0,0 +1,24 @@
+//go:build aix || openbsd || solaris
+
+package disk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile はファイル全体に fcntl で勧告ロックをかける
+// flock のない（または syscall.Flock を使えない）プラットフォームで使う。
+// fcntl のロックはプロセス単位なので、同じプロセスの中で2度開いても ErrDatabaseLocked にならない
+func lockFile(f *os.File, exclusive bool) error {
+	lk := syscall.Flock_t{Type: syscall.F_RDLCK, Whence: 0}
+	if exclusive {
+		lk.Type = syscall.F_WRLCK
+	}
+	err := syscall.FcntlFlock(f.Fd(), syscall.F_SETLK, &lk)
+	if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES) {
+		return ErrDatabaseLocked
+	}
+	return err
+}
@@ -0,0 +1,23 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd
+
+package disk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockFile はファイルに flock で勧告ロックをかける
+// exclusive なら排他ロック、そうでなければ共有ロックで、待たずに失敗する
+func lockFile(f *os.File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return ErrDatabaseLocked
+	}
+	return err
+}
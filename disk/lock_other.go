@@ -0,0 +1,10 @@
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris && !windows
+
+package disk
+
+import "os"
+
+// lockFile はファイルをロックできないプラットフォームでは何もしない
+func lockFile(f *os.File, exclusive bool) error {
+	return nil
+}
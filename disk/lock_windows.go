@@ -0,0 +1,35 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile はファイルに LockFileEx でロックをかける
+// Windows のロックは読み書きも止めるので、ファイルの中身ではなく、ページが届かない
+// ファイルの終わりのずっと先の1バイトをロックする
+func lockFile(f *os.File, exclusive bool) error {
+	flags := uint32(lockfileFailImmediately)
+	if exclusive {
+		flags |= lockfileExclusiveLock
+	}
+	ol := syscall.Overlapped{Offset: 0xfffffffe, OffsetHigh: 0x7fffffff}
+	r, _, err := procLockFileEx.Call(uintptr(f.Fd()), uintptr(flags), 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if errors.Is(err, errorLockViolation) {
+		return ErrDatabaseLocked
+	}
+	return err
+}
@@ -0,0 +1,197 @@
+package disk
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManifestVersion はマニフェスト自体の形式のバージョン
+const ManifestVersion = 1
+
+// HeapFormatVersion はヒープファイルの形式のバージョン
+// ページのレイアウトを変えたら上げる
+const HeapFormatVersion = 1
+
+// ManifestSuffix はヒープファイルのパスに付けるマニフェストの拡張子
+const ManifestSuffix = ".manifest"
+
+// エラー定義
+var (
+	ErrManifestMismatch = errors.New("manifest mismatch")
+)
+
+// Segment はデータベースを構成する1つのファイル
+type Segment struct {
+	Name          string `json:"name"`           // マニフェストからの相対パス
+	Size          int64  `json:"size"`           // ファイルサイズ（バイト）
+	Checksum      uint32 `json:"checksum"`       // ファイル全体のCRC32
+	FormatVersion int    `json:"format_version"` // ファイル形式のバージョン
+}
+
+// Manifest はデータベースを構成するファイルの一覧
+// 開く前にファイルが欠けたり書きかけになっていないかを確認するために使う
+type Manifest struct {
+	Version  int       `json:"version"`
+	PageSize int       `json:"page_size"`
+	Segments []Segment `json:"segments"`
+	// CheckpointLSN は最後のチェックポイントのLSN
+	// このDBにはまだWALがないため常に0
+	CheckpointLSN uint64 `json:"checkpoint_lsn"`
+}
+
+// ManifestPath はヒープファイルに対応するマニフェストのパスを返す
+func ManifestPath(heapFilePath string) string {
+	return heapFilePath + ManifestSuffix
+}
+
+// BuildManifest はヒープファイルの現在の内容からマニフェストを作る
+func BuildManifest(heapFilePath string) (*Manifest, error) {
+	segment, err := scanSegment(heapFilePath)
+	if err != nil {
+		return nil, err
+	}
+	segment.Name = filepath.Base(heapFilePath)
+	segment.FormatVersion = HeapFormatVersion
+
+	return &Manifest{
+		Version:  ManifestVersion,
+		PageSize: PageSize,
+		Segments: []Segment{segment},
+	}, nil
+}
+
+// scanSegment はファイルのサイズとチェックサムを求める
+func scanSegment(path string) (Segment, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Segment{}, err
+	}
+	defer f.Close()
+
+	hash := crc32.NewIEEE()
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return Segment{}, err
+	}
+	return Segment{Size: size, Checksum: hash.Sum32()}, nil
+}
+
+// WriteManifest はマニフェストをアトミックに書き込む
+// 同じディレクトリの一時ファイルに書いて fsync し、rename で置き換えるため、
+// 途中でクラッシュしても古いマニフェストか新しいマニフェストのどちらかが残る
+func WriteManifest(path string, m *Manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic は data をファイルにアトミックに書き込む
+// 同じディレクトリの一時ファイルに書いて fsync し、rename で置き換える
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath) // rename に成功していれば何もしない
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+
+	// rename 自体を永続化するためにディレクトリも fsync する
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// ReadManifest はマニフェストを読み込む
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &m, nil
+}
+
+// VerifyManifest はマニフェストに記録された全てのファイルが揃っていて、
+// サイズとチェックサムが一致するかを確認する
+// 不一致は全て ErrManifestMismatch をラップしたエラーとしてまとめて返す
+func VerifyManifest(path string) error {
+	m, err := ReadManifest(path)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	if m.Version != ManifestVersion {
+		errs = append(errs, fmt.Errorf("manifest version %d (want %d): %w", m.Version, ManifestVersion, ErrManifestMismatch))
+	}
+	if m.PageSize != PageSize {
+		errs = append(errs, fmt.Errorf("page size %d (want %d): %w", m.PageSize, PageSize, ErrManifestMismatch))
+	}
+
+	dir := filepath.Dir(path)
+	for _, want := range m.Segments {
+		if want.FormatVersion != HeapFormatVersion {
+			errs = append(errs, fmt.Errorf("%s: format version %d (want %d): %w", want.Name, want.FormatVersion, HeapFormatVersion, ErrManifestMismatch))
+			continue
+		}
+		got, err := scanSegment(filepath.Join(dir, want.Name))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", want.Name, err))
+			continue
+		}
+		if got.Size != want.Size {
+			errs = append(errs, fmt.Errorf("%s: size %d (want %d): %w", want.Name, got.Size, want.Size, ErrManifestMismatch))
+			continue
+		}
+		if got.Checksum != want.Checksum {
+			errs = append(errs, fmt.Errorf("%s: checksum %08x (want %08x): %w", want.Name, got.Checksum, want.Checksum, ErrManifestMismatch))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// UpdateManifest はヒープファイルを fsync してからマニフェストを書き直す
+// バッファプールを Flush した後に呼ぶこと
+func (d *DiskManager) UpdateManifest() error {
+	if err := d.Sync(); err != nil {
+		return err
+	}
+	if d.mem != nil {
+		return errInMemory
+	}
+	heapFilePath := d.heapFile.Name()
+	m, err := BuildManifest(heapFilePath)
+	if err != nil {
+		return err
+	}
+	return WriteManifest(ManifestPath(heapFilePath), m)
+}
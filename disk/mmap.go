@@ -0,0 +1,109 @@
+package disk
+
+import (
+	"errors"
+	"sync"
+)
+
+// mmapMinSize は最初にマップする大きさ。ファイルが小さくてもこれだけ予約しておき、
+// ファイルが伸びるたびにマップし直さずに済ませる
+const mmapMinSize = 1 << 20
+
+// errMmapDirectIO は Mmap と DirectIO を同時に指定したことを表す
+var errMmapDirectIO = errors.New("mmap and direct I/O cannot be used together")
+
+// mmapRegion はヒープファイルを共有マッピング（MAP_SHARED）した領域
+// マップした範囲のうち、ファイルの終端（size）までのページだけを読み書きできる
+// 終端より先に触れると SIGBUS になるので、伸ばすときは pwrite で書いてから size を広げる
+type mmapRegion struct {
+	mu   sync.RWMutex // data を張り替える remap と読み書きを排他する
+	data []byte       // マップした領域（ファイルより大きくてよい）
+	size int64        // ファイルの大きさ。data[:size] だけが有効
+}
+
+// openMmap はヒープファイルをマップする。mmap のないプラットフォームではマップせず、
+// DiskManager はこれまで通り pread / pwrite で読み書きする
+func (d *DiskManager) openMmap() error {
+	if !mmapSupported {
+		return nil
+	}
+	size := int64(d.nextPageID) * PageSize
+	data, err := mmapFile(d.heapFile, mmapCapacity(size))
+	if err != nil {
+		return err
+	}
+	d.mmap = &mmapRegion{data: data, size: size}
+	return nil
+}
+
+// mmapCapacity は size バイトのファイルに対してマップする大きさを返す
+// 伸びる余地を残すため、size の2倍を mmapMinSize 以上に切り上げる
+func mmapCapacity(size int64) int {
+	return int(max(size*2, mmapMinSize))
+}
+
+// read はマップした領域から data にコピーする
+// 範囲がファイルの終端を越えていれば false を返し、呼び出し側が pread で読む
+func (r *mmapRegion) read(offset int64, data []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if offset+int64(len(data)) > r.size {
+		return false
+	}
+	copy(data, r.data[offset:])
+	return true
+}
+
+// write はマップした領域に data を書く
+// 範囲がファイルの終端を越えていれば false を返し、呼び出し側が pwrite で書いてから grow する
+func (r *mmapRegion) write(offset int64, data []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if offset+int64(len(data)) > r.size {
+		return false
+	}
+	copy(r.data[offset:], data)
+	return true
+}
+
+// grow は pwrite でファイルが size バイトまで伸びたことを記録する
+// マップした領域に収まらなければ大きくマップし直す
+func (r *mmapRegion) grow(d *DiskManager, size int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if size <= r.size {
+		return nil
+	}
+	if size > int64(len(r.data)) {
+		// マップし直す前に、古い領域に書いたページを書き戻しておく必要はない
+		// （同じファイルの共有マッピングなので、ページキャッシュに残っている）
+		data, err := mmapFile(d.heapFile, mmapCapacity(size))
+		if err != nil {
+			return err
+		}
+		if err := munmap(r.data); err != nil {
+			munmap(data)
+			return err
+		}
+		r.data = data
+	}
+	r.size = size
+	return nil
+}
+
+// sync はマップした領域に書いたページを msync でファイルに書き戻す
+func (r *mmapRegion) sync() error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return msync(r.data[:r.size])
+}
+
+// close はマッピングを外す
+func (r *mmapRegion) close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := munmap(r.data)
+	r.data = nil
+	r.size = 0
+	return err
+}
@@ -0,0 +1,34 @@
+//go:build linux
+
+package disk
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// mmapSupported はこのプラットフォームで Options.Mmap が使えるかどうか
+const mmapSupported = true
+
+// mmapFile はファイルの先頭から length バイトを読み書き両用で共有マッピングする
+func mmapFile(f *os.File, length int) ([]byte, error) {
+	return syscall.Mmap(int(f.Fd()), 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+}
+
+// munmap はマッピングを外す
+func munmap(data []byte) error {
+	return syscall.Munmap(data)
+}
+
+// msync はマップした領域に書いた内容をファイルに書き戻し、終わるまで待つ
+func msync(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&data[0])), uintptr(len(data)), syscall.MS_SYNC)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+
+package disk
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapSupported はこのプラットフォームで Options.Mmap が使えるかどうか
+// 使えなければ Options.Mmap を無視して pread / pwrite で読み書きする
+const mmapSupported = false
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+func mmapFile(f *os.File, length int) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap(data []byte) error {
+	return nil
+}
+
+func msync(data []byte) error {
+	return nil
+}
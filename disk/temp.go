@@ -0,0 +1,72 @@
+package disk
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// errInMemory はヒープファイルのないメモリ上のDiskManagerではできない操作を表す
+var errInMemory = errors.New("in-memory disk manager has no heap file")
+
+// memStore はページをメモリ上に持つ。NewMemManager で作ったDiskManagerが使う
+type memStore struct {
+	mu    sync.RWMutex
+	pages [][]byte // ページIDごとのページ（一度も書かれていなければ nil）
+}
+
+// readPage はページをコピーする。割り当てただけのページは0で埋める
+func (s *memStore) readPage(_ *os.File, pageID PageID, page []byte) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if int(pageID) >= len(s.pages) {
+		return io.ErrUnexpectedEOF
+	}
+	if s.pages[pageID] == nil {
+		clear(page)
+		return nil
+	}
+	copy(page, s.pages[pageID])
+	return nil
+}
+
+// writePage はページのコピーを持つ
+func (s *memStore) writePage(_ *os.File, pageID PageID, page []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for int(pageID) >= len(s.pages) {
+		s.pages = append(s.pages, nil)
+	}
+	if s.pages[pageID] == nil {
+		s.pages[pageID] = make([]byte, PageSize)
+	}
+	copy(s.pages[pageID], page)
+	return nil
+}
+
+// NewMemManager はページをメモリ上に持つDiskManagerを作成する
+// ソートやハッシュ結合の途中結果など、使い終わったら捨てる一時的な木やヒープに使う
+// Close するとページは全て失われる。Sync は何もせず、マニフェストは作れない
+func NewMemManager() *DiskManager {
+	return &DiskManager{mem: &memStore{}}
+}
+
+// OpenTemp は dir に一時的なヒープファイルを作ってDiskManagerを作成する
+// dir が空なら os.TempDir() を使う。ページがメモリに収まらない途中結果に使い、
+// ファイルは Close で削除する。書き戻す必要がないので SyncMode は SyncOff になる
+func OpenTemp(dir string) (*DiskManager, error) {
+	heapFile, err := os.CreateTemp(dir, "minidb_temp_*.db")
+	if err != nil {
+		return nil, err
+	}
+	d, err := NewDiskManager(heapFile)
+	if err != nil {
+		heapFile.Close()
+		os.Remove(heapFile.Name())
+		return nil, err
+	}
+	d.syncMode = SyncOff
+	d.temporary = true
+	return d, nil
+}
@@ -0,0 +1,61 @@
+package disk
+
+// NumPages は割り当て済みのページ数（次に割り当てる新しいページのID）を返す
+// 空きページの一覧にあるページも数える
+func (d *DiskManager) NumPages() PageID {
+	return d.nextPageID
+}
+
+// TruncateFreePages はファイルの末尾に並んだ空きページを空きページの一覧から除き、
+// その分だけヒープファイルを切り詰める。切り詰めたページ数を返す
+// 末尾より前にある空きページは一覧に残り、AllocatePage で再利用される
+// AllocatePage と同じく、呼び出し側で排他すること
+func (d *DiskManager) TruncateFreePages() (int, error) {
+	// 一覧はIDの降順なので、末尾のページは一覧の先頭から続けて並んでいる
+	end := d.nextPageID
+	n := 0
+	for n < len(d.freePages) && d.freePages[n] == end-1 {
+		end--
+		n++
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	if err := d.truncate(end); err != nil {
+		return 0, err
+	}
+	d.freePages = append(d.freePages[:0], d.freePages[n:]...)
+	d.nextPageID = end
+	return n, nil
+}
+
+// truncate は格納方式に応じて、ページ end 以降をファイルから取り除く
+func (d *DiskManager) truncate(end PageID) error {
+	if d.doubleWrite != nil {
+		// 残ったレコードを開き直したときに書き戻すと、切り詰めたページが戻ってしまう
+		if err := d.doubleWrite.discard(d); err != nil {
+			return err
+		}
+	}
+	switch {
+	case d.mem != nil:
+		d.mem.mu.Lock()
+		defer d.mem.mu.Unlock()
+		if int(end) < len(d.mem.pages) {
+			d.mem.pages = d.mem.pages[:end]
+		}
+		return nil
+	case d.compressed != nil:
+		return d.compressed.truncate(d.heapFile, end)
+	case d.encrypted != nil:
+		return d.heapFile.Truncate(int64(end) * EncryptedPageSize)
+	}
+	size := int64(end) * PageSize
+	if d.mmap != nil {
+		// 切り詰めた後の範囲に触れないよう、先にマップした領域の終端を縮める
+		d.mmap.mu.Lock()
+		d.mmap.size = min(d.mmap.size, size)
+		d.mmap.mu.Unlock()
+	}
+	return d.heapFile.Truncate(size)
+}
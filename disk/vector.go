@@ -0,0 +1,158 @@
+package disk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ReadPages は startPageID から連続する len(data)/PageSize ページを1回の pread で読む
+// len(data) はページサイズの倍数でなければならない
+func (d *DiskManager) ReadPages(startPageID PageID, data []byte) error {
+	return d.ReadPagesContext(context.Background(), startPageID, data)
+}
+
+// ReadPagesContext は ReadPages と同じだが、ctx がキャンセル済みなら
+// 読み込みを行わずに ctx.Err() を返す
+func (d *DiskManager) ReadPagesContext(ctx context.Context, startPageID PageID, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(data)%PageSize != 0 {
+		return fmt.Errorf("read of %d bytes is not a multiple of the page size", len(data))
+	}
+	if d.faults != nil {
+		for i := 0; i < len(data); i += PageSize {
+			if err := d.readPageFaulty(startPageID+PageID(i/PageSize), data[i:i+PageSize]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return d.readPages(startPageID, data)
+}
+
+// readPages は格納方式に応じて連続するページを読む
+func (d *DiskManager) readPages(startPageID PageID, data []byte) error {
+	if store := d.pageStore(); store != nil {
+		for i := 0; i < len(data); i += PageSize {
+			if err := store.readPage(d.heapFile, startPageID+PageID(i/PageSize), data[i:i+PageSize]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	offset := int64(PageSize * startPageID)
+	if d.mmap != nil && d.mmap.read(offset, data) {
+		return nil
+	}
+	if d.directIO {
+		buf := alignedPages(len(data) / PageSize)
+		if _, err := d.heapFile.ReadAt(buf, offset); err != nil {
+			return err
+		}
+		copy(data, buf)
+		return nil
+	}
+	// ReadAt は len(data) バイト読めなければエラーを返す（ファイルの終端なら io.EOF）
+	_, err := d.heapFile.ReadAt(data, offset)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// WritePages は startPageID から連続する len(data)/PageSize ページを1回の pwrite で書く
+// len(data) はページサイズの倍数でなければならない
+// バッファプールの Flush が、IDの連続するページをまとめて書くのに使う
+func (d *DiskManager) WritePages(startPageID PageID, data []byte) error {
+	return d.WritePagesContext(context.Background(), startPageID, data)
+}
+
+// WritePagesContext は WritePages と同じだが、ctx がキャンセル済みなら
+// 書き込みを行わずに ctx.Err() を返す
+func (d *DiskManager) WritePagesContext(ctx context.Context, startPageID PageID, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if len(data)%PageSize != 0 {
+		return fmt.Errorf("write of %d bytes is not a multiple of the page size", len(data))
+	}
+	if d.faults != nil {
+		for i := 0; i < len(data); i += PageSize {
+			if err := d.writePageFaulty(startPageID+PageID(i/PageSize), data[i:i+PageSize]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return d.writePages(startPageID, data)
+}
+
+// writePages は格納方式に応じて連続するページを書く
+func (d *DiskManager) writePages(startPageID PageID, data []byte) error {
+	if d.directIO {
+		buf := alignedPages(len(data) / PageSize)
+		copy(buf, data)
+		data = buf
+	}
+	if store := d.pageStore(); store != nil {
+		// ページごとに変換するので、1ページずつ書く
+		for i := 0; i < len(data); i += PageSize {
+			if err := store.writePage(d.heapFile, startPageID+PageID(i/PageSize), data[i:i+PageSize]); err != nil {
+				return err
+			}
+		}
+		if d.syncMode == SyncAlways {
+			return d.Sync()
+		}
+		return nil
+	}
+	offset := int64(PageSize * startPageID)
+	if d.mmap != nil && d.mmap.write(offset, data) {
+		if d.syncMode == SyncAlways {
+			return d.Sync()
+		}
+		return nil
+	}
+	if d.doubleWrite != nil {
+		if err := d.doubleWrite.before(d, startPageID, data); err != nil {
+			return err
+		}
+		defer d.doubleWrite.after()
+	}
+	if _, err := d.heapFile.WriteAt(data, offset); err != nil {
+		return err
+	}
+	if d.mmap != nil {
+		// ファイルの終端より先に書いたので、マップした領域で読み書きできる範囲を広げる
+		if err := d.mmap.grow(d, offset+int64(len(data))); err != nil {
+			return err
+		}
+	}
+	if d.syncMode == SyncAlways {
+		return d.syncFile()
+	}
+	return nil
+}
+
+// pageStore はページを変換してからヒープファイルに置く格納方式
+// 圧縮や暗号化ではページIDの位置にページをそのまま置けないので、1ページずつ読み書きする
+type pageStore interface {
+	readPage(file *os.File, pageID PageID, page []byte) error
+	writePage(file *os.File, pageID PageID, page []byte) error
+}
+
+// pageStore はオプションで指定した格納方式を返す。そのまま置くなら nil を返す
+func (d *DiskManager) pageStore() pageStore {
+	switch {
+	case d.mem != nil:
+		return d.mem
+	case d.compressed != nil:
+		return d.compressed
+	case d.encrypted != nil:
+		return d.encrypted
+	}
+	return nil
+}
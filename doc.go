@@ -0,0 +1,226 @@
+/*
+Package minidb はminidbを組み込みデータベースとして使うための公開APIを提供する。
+
+# 概要
+
+btree・buffer・disk・table などのパッケージはストレージの実装そのもので、
+改善のたびに関数の形が変わる。アプリケーションからはこのパッケージの
+Open・DB・Table・Tx・Rows だけを使えば、内部の変更に引きずられずに済む。
+
+	db, err := minidb.Open("app.db", minidb.Options{})
+	defer db.Close()
+
+	users, err := db.CreateTable("users", 1, minidb.TableOptions{})
+	users.Insert(minidb.Tuple{[]byte("1"), []byte("Alice")})
+
+	row, err := users.Get(minidb.Tuple{[]byte("1")}) // [1 Alice]
+
+# カタログ
+
+テーブル名と、テーブルのB-treeのメタページ・キーの列数・設定の対応は、
+カタログという1本のB-treeに記録する。開き直したときは Table で名前から開ける：
+
+	users, err := db.Table("users")
+
+ヒープファイルのページ0はファイルヘッダー（disk.Header）で、マジックナンバー・
+形式のバージョン・ページサイズ・カタログのメタページIDを持つ。Open はこれを検証し、
+minidbのファイルでなければ disk.ErrNotDatabase を返す。ヘッダーのない以前のファイルは
+Options.MigrateLegacy を指定して開けば、カタログのメタページを末尾に移してヘッダーを加える。
+
+TableOptions の NotNull（NOT NULL 制約）・Defaults（列の既定値）・AutoIncrement（キーの自動採番）も
+カタログに記録され、開き直した後の書き込みにも効く。採番したキーは InsertReturning が返す行で分かる：
+
+	users, _ := db.CreateTable("users", 1, minidb.TableOptions{AutoIncrement: true})
+	row, _ := users.InsertReturning(minidb.Tuple{nil, []byte("Alice")})
+	id, _ := table.DecodeSequence(row[0])
+
+Tables は記録された全てのテーブルの名前を、Schema はテーブルの定義（キーの列数・制約・
+既定値・メタデータなど）を返すので、ツールからデータベースの中身を調べられる：
+
+	names, err := db.Tables()
+	info, err := db.Schema("users")
+
+RenameTable はカタログの行を付け替えてテーブルの名前を変える。開いていた Table は
+新しい名前のまま使える。テーブルにはメタデータ（コメントなど）を記録でき、
+CreateTable は作った時刻を MetadataCreatedAt のキーに入れる：
+
+	err := db.RenameTable("users", "members")
+	err = members.SetMetadata("comment", []byte("registered users"))
+	metadata, err := members.Metadata()
+
+# 列の追加と削除
+
+TableOptions.NumColumns で列数を決めたテーブルでは、AddColumn で最後に列を足し、
+DropColumn で値の列を除ける。どちらも格納した行を書き換えず、カタログに列と格納した行での
+位置の対応を記録して、SchemaVersion を1つ増やすだけなので、行数によらずすぐに終わる：
+
+	users, _ := db.CreateTable("users", 1, minidb.TableOptions{NumColumns: 3})
+	col, _ := users.AddColumn([]byte("member")) // 既にある行では "member" と読める
+	err := users.DropColumn(2)                  // 後ろの列が1つ前にずれる
+
+古い形の行は読むたびに今の列の並びに直し、足した列は既定値で埋める。書き直すのは行を
+書き込んだときだけで、まとめて書き直す仕組みはない（論理削除した行や期限切れの行も
+書き直すことになるため）。除いた列の値は行を書き込み直すまでページに残る。
+Analyze の統計の列は、格納した行での位置で数える。
+
+# ページ送り
+
+Rows.Token は最後に読んだ行の位置をバイト列にし、Table.Resume はその続きから読む。
+1ページ分読んだら Rows を閉じてトークンをクライアントに返せば、リクエストの間で
+ページをピンしたままにならない。開き直した後でも同じトークンで続きを読める：
+
+	token := rows.Token()
+	rows.Close()
+	// 次のリクエストで
+	rows, err := users.Resume(token, minidb.ScanOptions{})
+
+Table.ScanPrefix はキーの先頭の列を指定して、その列が等しい行だけを読む。(user, day, seq) を
+キーにしたテーブルでは (user) だけでも (user, day) まででもよく、キーのエンコードから
+B-treeの範囲を決めるので、合わない行は読まない。トークンは接頭辞も覚えている：
+
+	rows, err := events.ScanPrefix(minidb.Tuple{[]byte("u1"), []byte("mon")}, minidb.ScanOptions{})
+
+# 書き込みの一括適用
+
+Update の中で積んだ書き込みは、fn が nil を返したときに table.WriteBatch で
+まとめて適用される。全て適用されるか、1つも適用されないかのどちらかになる：
+
+	err := db.Update(func(tx *minidb.Tx) error {
+	    tx.Insert(users, minidb.Tuple{[]byte("2"), []byte("Bob")})
+	    tx.Delete(users, minidb.Tuple{[]byte("1")})
+	    return nil
+	})
+
+まだトランザクションの分離はなく、Tx の中の読み込みは積んだ書き込みを見ない。
+
+同じデータを何度読み込んでもよいようにするには、Insert の代わりに Upsert（同じキーの行を
+置き換える）か InsertIgnore（同じキーの行があれば何もしない）を使う。Tx の Put と
+InsertIgnore も同じ動きになる。
+
+Savepoint で積んだ書き込みの位置に名前を付けておくと、RollbackTo でその後に積んだ書き込み
+だけを捨てられる。大きな読み込みで、読めなかったチャンクだけを捨てて残りを適用するのに使う：
+
+	err := db.Update(func(tx *minidb.Tx) error {
+	    for _, chunk := range chunks {
+	        tx.Savepoint("chunk")
+	        if err := load(tx, chunk); err != nil {
+	            tx.RollbackTo("chunk")
+	        }
+	    }
+	    return nil
+	})
+
+列が多すぎるなど積むときに分かるエラーは、セーブポイントの後に起きたものなら RollbackTo で
+忘れられる。書き込みは最後にまとめて適用するので、キーの重複のように適用するときに分かるエラーは
+RollbackTo では戻せず、Update 全体が失敗する。
+
+# 変更の通知
+
+Subscribe で登録した関数には、テーブルの行が変わるたびに変更前と変更後の行が届く。
+キャッシュや検索インデックスをデータベースに合わせて更新するのに使う：
+
+	unsubscribe := db.Subscribe("users", func(ev minidb.ChangeEvent) {
+	    switch ev.Kind {
+	    case minidb.ChangeInsert, minidb.ChangeUpdate:
+	        cache.Set(string(ev.Key[0]), ev.New)
+	    case minidb.ChangeDelete:
+	        cache.Delete(string(ev.Key[0]))
+	    }
+	})
+	defer unsubscribe()
+
+イベントは書き込みが適用された後に、ロックを外してから届く。Update の書き込みは適用が
+終わってからまとめて届き、同じ行を何度書き換えても前後の差が1つのイベントになる。
+失敗した書き込みや、行を変えなかった書き込みのイベントは届かない。
+
+購読者のいるテーブルへの書き込みは、変更前と変更後の行を読むぶん遅くなる。
+PurgeExpired で消した行のイベントは届かない。
+
+別のプロセスや外部のシステムに変更を流すには、Options.ChangeLog を有効にして開く。
+Subscribe に届くのと同じ変更が、適用した順に変更ログ（cdc.Path のファイル）に書き足され、
+cdc.Reader で LSN を覚えながら読める。変更ログは書き込むたびに fsync するが、
+ヒープファイルは Flush するまでディスクに届かないので、クラッシュした後は変更ログの方が
+先に進んでいることがある。書き込みを適用した後に変更ログに書けなかったときは、その書き込みが
+ErrChangeLog を返し、変更ログには次に書けたときに cdc.Gap のレコードが入る。
+
+# バックアップ
+
+Backup は開いたままのデータベースの一貫したコピーを io.Writer に書く。
+BackupFile はコピーをファイルに書き、マニフェストも作る：
+
+	err := db.BackupFile("backup/app.db")
+
+全てのページを書き戻してからヒープファイルをコピーし、コピーが終わるまで
+他の操作を待たせる。コピーはそのまま Open できる。
+
+# 領域の回収
+
+行を削除しても、ヒープファイルは縮まない。空いたページは後の挿入で再利用されるが、
+空きページの一覧はメモリ上にしかないので、開き直すと再利用されなくなる。
+Vacuum は全てのテーブルのB-treeを詰め直し、どの木からも参照されないページを
+空きページに戻してから、ファイルの末尾に並んだ空きページを切り詰める：
+
+	err := db.Vacuum()
+
+実行中は他の操作を待たせる。スキャン中の Rows はそのまま続きから読める。
+
+DropTable はテーブルをカタログから消して、B-treeの全てのページを空きページに戻す。
+Truncate は全ての行を消してページを空きページに戻すが、テーブルの設定・列・統計や
+AutoIncrement の連番は残す。どちらも消した行のイベントは届けない：
+
+	err := db.Truncate("sessions")
+	err = db.DropTable("sessions")
+
+消したテーブルの Table と Rows は ErrTableNotFound を返す。インデックスはカタログに
+記録していないので、hashindex.HashIndex などで作った索引は呼び出し側で消すこと。
+
+# 有効期限
+
+TableOptions.Expiry を指定して作ったテーブルでは、ExpiryColumn 番目の列が行の有効期限になる。
+InsertWithTTL で挿入した行は期間が過ぎると読めなくなり、PurgeExpired で削除される。
+DB.PurgeExpired は全てのテーブルをまとめて掃除するので、定期的に呼ぶとよい：
+
+	sessions, err := db.CreateTable("sessions", 1, minidb.TableOptions{Expiry: true, ExpiryColumn: 2})
+	err = sessions.InsertWithTTL(minidb.Tuple{[]byte("s1"), data}, 30*time.Minute)
+	n, err := db.PurgeExpired()
+
+# 統計
+
+Analyze はテーブルの列ごとの統計（異なる値の数と等深ヒストグラム）を集めてカタログに記録し、
+Statistics で読み出せる。条件に合う行数の見積もりに使う：
+
+	stats, err := users.Analyze(minidb.AnalyzeOptions{})
+	n := stats.EstimateRows(1, []byte("Tokyo"), []byte("Tokyo"))
+
+統計は行を書き換えても更新されないので、データが大きく変わったら Analyze し直す。
+
+Table.Stats は行数・キーと値のバイト数・ページ数を返す。行数とバイト数は書き込みのたびに
+更新してカタログに記録しておくので、容量を監視するのに行を全て読まなくてよい。
+期限切れの行は PurgeExpired で消すまで数える。数は Flush と Close で記録する。
+記録した後の最初の書き込みの前にカタログに印を付けてディスクに書くので、記録する前に
+異常終了しても、次に開いたときに全ての行を読んで数え直す：
+
+	stats, err := users.Stats()
+	fmt.Println(stats.Rows, stats.KeyBytes+stats.ValueBytes, stats.Pages)
+
+# ゾーンマップ
+
+EnableZoneMap で列を指定すると、リーフごとにその列の最小値・最大値を記録する
+（table.SimpleTable.EnableZoneMap）。ScanColumnRange でその列の範囲を指定すると、
+条件に合う行を含み得ないリーフを読み飛ばす：
+
+	err := events.EnableZoneMap(1)
+	rows, err := events.ScanColumnRange(1, []byte("2024-01-01"), []byte("2024-01-31"))
+
+列はカタログに記録し、範囲は Flush と Close で別のB-treeに書き出すので、開き直しても
+全ての行を読まずに使える。行数と同じく書き出した後の最初の書き込みの前に印を付けるので、
+書き出す前に異常終了したら、次に開いたときに全ての行を読んで作り直す。
+Vacuum はリーフを詰め直すので、範囲も作り直して書き出す。
+
+# 互換性
+
+このパッケージの公開する名前は、メジャーバージョンを上げない限り削除も変更もしない。
+他のパッケージはストレージの実験の場なので、そうした約束はしない。
+DB のメソッドは1つずつ順に実行される。
+*/
+package minidb
@@ -0,0 +1,89 @@
+package minidb
+
+import (
+	"time"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+// InsertWithTTL は ttl 後に期限が切れる行を挿入する（table.SimpleTable.InsertWithTTL）
+// TableOptions.Expiry を指定せずに作ったテーブルでは table.ErrExpiryDisabled を返す
+func (t *Table) InsertWithTTL(row Tuple, ttl time.Duration) error {
+	defer t.db.deliver()
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	if !t.tbl.Expiry {
+		return table.ErrExpiryDisabled
+	}
+	row, err := t.toStored(row)
+	if err != nil {
+		return err
+	}
+	// 期限切れの行を置き換えることがあるので、採番してから書き込む前の行を読む
+	row, err = t.tbl.Prepare(t.db.bufmgr, row)
+	if err != nil {
+		return err
+	}
+	changes, err := t.watchRow(t.rowKey(row))
+	if err != nil {
+		return err
+	}
+	if _, err := t.tbl.InsertWithTTLReturning(t.db.bufmgr, row, ttl); err != nil {
+		return err
+	}
+	return changes.publish()
+}
+
+// PurgeExpired は期限切れの行を削除し、削除した行数を返す
+// 期限切れの行は読めなくなるが、PurgeExpired を呼ぶまでページに残る
+func (t *Table) PurgeExpired() (int, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	return t.purgeExpired()
+}
+
+// purgeExpired は期限切れの行を削除し、行数と大きさから引く
+// 呼び出し時は db.mu を保持していること
+func (t *Table) purgeExpired() (int, error) {
+	if err := t.markStale(); err != nil {
+		return 0, err
+	}
+	n, purged, err := t.tbl.PurgeExpiredReturning(t.db.bufmgr)
+	for _, row := range purged {
+		t.count(row, nil)
+	}
+	return n, err
+}
+
+// PurgeExpired は全てのテーブルの期限切れの行を削除し、削除した行数の合計を返す
+// 定期的に呼ぶなら、time.Ticker で回す goroutine から呼べばよい。実行中は他の操作を待たせる
+func (db *DB) PurgeExpired() (int, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return 0, ErrClosed
+	}
+	names, err := db.tableNames()
+	if err != nil {
+		return 0, err
+	}
+	total := 0
+	for _, name := range names {
+		t, err := db.openTable(name)
+		if err != nil {
+			return total, err
+		}
+		n, err := t.purgeExpired()
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
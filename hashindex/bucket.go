@@ -0,0 +1,156 @@
+package hashindex
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// バケットページのレイアウト:
+// [local_depth: 2] [num_pairs: 2] [free_space_offset: 2]
+// その後にスロット配列（各2バイト）が続き、ページ末尾からペアが詰められる
+// ペアのフォーマット: [key_len: 2] [value_len: 2] [key] [value]
+//
+// バケット内のペアに順序はない。バケットはせいぜい1ページなので線形に探す
+
+const (
+	BucketLocalDepthOffset      = 0
+	BucketNumPairsOffset        = 2
+	BucketFreeSpaceOffsetOffset = 4
+	BucketHeaderSize            = 6
+	BucketSlotSize              = 2
+
+	pairHeaderSize = 4
+
+	// MaxPairSize はキーと値の長さの合計の上限
+	MaxPairSize = disk.PageSize - BucketHeaderSize - BucketSlotSize - pairHeaderSize
+)
+
+// Bucket はバケットページを表す
+type Bucket struct {
+	data []byte
+}
+
+// NewBucket はデータからBucketを作成する
+func NewBucket(data []byte) *Bucket {
+	return &Bucket{data: data}
+}
+
+// Initialize は局所深度 localDepth の空のバケットとして初期化する
+func (b *Bucket) Initialize(localDepth int) {
+	b.setLocalDepth(localDepth)
+	b.setNumPairs(0)
+	b.setFreeSpaceOffset(len(b.data))
+}
+
+// LocalDepth はバケットの局所深度を返す
+// このバケットのキーは全て、ハッシュ値の下位 LocalDepth ビットが等しい
+func (b *Bucket) LocalDepth() int {
+	return int(binary.LittleEndian.Uint16(b.data[BucketLocalDepthOffset:]))
+}
+
+func (b *Bucket) setLocalDepth(depth int) {
+	binary.LittleEndian.PutUint16(b.data[BucketLocalDepthOffset:], uint16(depth))
+}
+
+// NumPairs はペアの数を返す
+func (b *Bucket) NumPairs() int {
+	return int(binary.LittleEndian.Uint16(b.data[BucketNumPairsOffset:]))
+}
+
+func (b *Bucket) setNumPairs(n int) {
+	binary.LittleEndian.PutUint16(b.data[BucketNumPairsOffset:], uint16(n))
+}
+
+func (b *Bucket) freeSpaceOffset() int {
+	return int(binary.LittleEndian.Uint16(b.data[BucketFreeSpaceOffsetOffset:]))
+}
+
+func (b *Bucket) setFreeSpaceOffset(offset int) {
+	binary.LittleEndian.PutUint16(b.data[BucketFreeSpaceOffsetOffset:], uint16(offset))
+}
+
+func (b *Bucket) slot(i int) int {
+	return int(binary.LittleEndian.Uint16(b.data[BucketHeaderSize+i*BucketSlotSize:]))
+}
+
+func (b *Bucket) setSlot(i, offset int) {
+	binary.LittleEndian.PutUint16(b.data[BucketHeaderSize+i*BucketSlotSize:], uint16(offset))
+}
+
+// freeSpace は空き領域のサイズを返す
+func (b *Bucket) freeSpace() int {
+	return b.freeSpaceOffset() - (BucketHeaderSize + b.NumPairs()*BucketSlotSize)
+}
+
+// pairSize は指定オフセットにあるペアのバイト数を返す
+func (b *Bucket) pairSize(offset int) int {
+	keyLen := int(binary.LittleEndian.Uint16(b.data[offset:]))
+	valueLen := int(binary.LittleEndian.Uint16(b.data[offset+2:]))
+	return pairHeaderSize + keyLen + valueLen
+}
+
+// PairAt は指定スロットのキーと値を返す
+// 返すスライスはページの一部を指すので、ページを書き換える前にコピーすること
+func (b *Bucket) PairAt(i int) (key, value []byte) {
+	offset := b.slot(i)
+	keyLen := int(binary.LittleEndian.Uint16(b.data[offset:]))
+	valueLen := int(binary.LittleEndian.Uint16(b.data[offset+2:]))
+	key = b.data[offset+pairHeaderSize : offset+pairHeaderSize+keyLen]
+	value = b.data[offset+pairHeaderSize+keyLen : offset+pairHeaderSize+keyLen+valueLen]
+	return key, value
+}
+
+// Find はキーのスロットを返す。見つからなければ -1 を返す
+func (b *Bucket) Find(key []byte) int {
+	for i := 0; i < b.NumPairs(); i++ {
+		if k, _ := b.PairAt(i); bytes.Equal(k, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Insert はペアを追加する
+// 成功したらtrue、スペース不足ならfalseを返す。キーの重複は確認しない
+func (b *Bucket) Insert(key, value []byte) bool {
+	size := pairHeaderSize + len(key) + len(value)
+	if b.freeSpace() < BucketSlotSize+size {
+		return false
+	}
+	offset := b.freeSpaceOffset() - size
+	binary.LittleEndian.PutUint16(b.data[offset:], uint16(len(key)))
+	binary.LittleEndian.PutUint16(b.data[offset+2:], uint16(len(value)))
+	copy(b.data[offset+pairHeaderSize:], key)
+	copy(b.data[offset+pairHeaderSize+len(key):], value)
+
+	n := b.NumPairs()
+	b.setSlot(n, offset)
+	b.setNumPairs(n + 1)
+	b.setFreeSpaceOffset(offset)
+	return true
+}
+
+// Delete は指定スロットのペアを削除する
+// 削除したデータ領域は詰めて、空き領域に戻す
+func (b *Bucket) Delete(i int) {
+	n := b.NumPairs()
+	offset := b.slot(i)
+	size := b.pairSize(offset)
+
+	// 削除するデータより手前（空き領域側）にあるデータを後ろにずらす
+	freeSpaceOffset := b.freeSpaceOffset()
+	copy(b.data[freeSpaceOffset+size:offset+size], b.data[freeSpaceOffset:offset])
+
+	// 順序はないので、最後のスロットを空いた位置に移す
+	b.setSlot(i, b.slot(n-1))
+	for j := 0; j < n-1; j++ {
+		if s := b.slot(j); s < offset {
+			b.setSlot(j, s+size)
+		}
+	}
+
+	b.setFreeSpaceOffset(freeSpaceOffset + size)
+	b.setNumPairs(n - 1)
+}
@@ -0,0 +1,54 @@
+/*
+Package hashindex は拡張可能ハッシュ法（extendible hashing）による索引を提供する。
+
+# 概要
+
+B-treeはキーの順序を保つので範囲検索ができるが、1回の検索で木の高さの分だけ
+ページを読む。キーの一致検索しかしない索引なら、ハッシュ索引の方が読むページが
+少なくて済む（ルート・ディレクトリ・バケットの3ページで、データ量によらない）。
+
+# 構成
+
+	        ルートページ                ディレクトリ              バケット
+	┌──────────────────────┐     ┌──────────────┐     ┌──────────────────┐
+	│ global_depth = 2     │     │ 00 ──────────┼────▶│ local_depth = 1  │
+	│ dir_page_id ... ─────┼────▶│ 01 ──────────┼──┐  │ (下位1ビットが0)  │
+	└──────────────────────┘     │ 10 ──────────┼──┼─▶└──────────────────┘
+	                             │ 11 ──────────┼─┐│  ┌──────────────────┐
+	                             └──────────────┘ │└─▶│ local_depth = 2  │ (01)
+	                                              │   └──────────────────┘
+	                                              │   ┌──────────────────┐
+	                                              └──▶│ local_depth = 2  │ (11)
+	                                                  └──────────────────┘
+
+キーのハッシュ値（FNV-1a）の下位 global_depth ビットでディレクトリを引き、
+バケットのページを見つける。局所深度が大域深度より小さいバケットは、
+ディレクトリの複数の項目から指される。
+
+# 分割とディレクトリの倍増
+
+バケットが満杯になったら局所深度を1つ増やして2つに分け、ハッシュ値の
+次のビットでペアを振り分ける。局所深度が大域深度に等しいバケットを分ける前には、
+ディレクトリを倍にする（新しい半分は元の半分と同じバケットを指す）。
+分割で影響を受けるのは満杯のバケット1つとディレクトリだけなので、
+B-treeのように分割が上に伝わることはない。
+
+大域深度の上限は MaxGlobalDepth で、それを超えて分割が必要になると ErrIndexFull を返す。
+同じハッシュ値のキーが1つのバケットに収まらないほど多い場合もこれになる。
+削除で空いたバケットは併合しない。
+
+# 使用例
+
+	idx, _ := hashindex.Create(bufmgr)
+
+	idx.Insert(bufmgr, []byte("user:1"), []byte("Alice"))
+	value, err := idx.Get(bufmgr, []byte("user:1"))
+	if errors.Is(err, hashindex.ErrKeyNotFound) {
+	    // 見つからない
+	}
+	idx.Delete(bufmgr, []byte("user:1"))
+
+	// 既存の索引を開く
+	idx = hashindex.NewHashIndex(rootPageID)
+*/
+package hashindex
@@ -0,0 +1,316 @@
+package hashindex
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// エラー定義
+var (
+	ErrDuplicateKey = errors.New("duplicate key")
+	ErrKeyNotFound  = errors.New("key not found")
+	ErrPairTooLarge = errors.New("pair too large")
+	ErrIndexFull    = errors.New("hash index directory is full")
+)
+
+// ルートページのレイアウト:
+// [global_depth: 2] [num_dir_pages: 2] [dir_page_id: 8] ...
+//
+// ディレクトリはハッシュ値の下位 global_depth ビットからバケットのページIDを引く
+// 2^global_depth 個の配列で、DirEntriesPerPage 個ずつディレクトリページに分けて置く
+
+const (
+	RootGlobalDepthOffset = 0
+	RootNumDirPagesOffset = 2
+	RootHeaderSize        = 4
+
+	// DirEntriesPerPage は1つのディレクトリページに入るバケットのページIDの数
+	DirEntriesPerPage = disk.PageSize / 8
+	// MaxDirPages はルートページに並べられるディレクトリページの数
+	MaxDirPages = (disk.PageSize - RootHeaderSize) / 8
+	// MaxGlobalDepth は大域深度の上限（2^17 個の項目が MaxDirPages に収まる）
+	MaxGlobalDepth = 17
+)
+
+// HashIndex は拡張可能ハッシュ法による索引
+// キーの一致検索だけを行い、B-treeのような範囲検索や順序付きの走査はできない
+type HashIndex struct {
+	RootPageID disk.PageID
+}
+
+// Create は新しいハッシュ索引を作成する
+// 最初は大域深度0で、1つのバケットだけを持つ
+func Create(bufmgr *buffer.BufferPoolManager) (*HashIndex, error) {
+	rootBuffer, err := bufmgr.CreatePage()
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(rootBuffer)
+
+	bucketBuffer, err := bufmgr.CreatePage()
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(bucketBuffer)
+	NewBucket(bucketBuffer.Page[:]).Initialize(0)
+	bucketBuffer.IsDirty = true
+
+	h := &HashIndex{RootPageID: rootBuffer.PageID}
+	if err := h.storeDirectory(context.Background(), bufmgr, rootBuffer, 0, []disk.PageID{bucketBuffer.PageID}); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// NewHashIndex は既存のハッシュ索引を開く
+func NewHashIndex(rootPageID disk.PageID) *HashIndex {
+	return &HashIndex{RootPageID: rootPageID}
+}
+
+// hashKey はキーのハッシュ値を返す
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// directoryIndex はハッシュ値の下位 depth ビットを返す
+func directoryIndex(hash uint64, depth int) int {
+	return int(hash & (1<<depth - 1))
+}
+
+// GlobalDepth は現在の大域深度（ディレクトリの大きさは 2^GlobalDepth）を返す
+func (h *HashIndex) GlobalDepth(bufmgr *buffer.BufferPoolManager) (int, error) {
+	rootBuffer, err := bufmgr.FetchPage(h.RootPageID)
+	if err != nil {
+		return 0, err
+	}
+	defer bufmgr.UnpinPage(rootBuffer)
+	return int(binary.LittleEndian.Uint16(rootBuffer.Page[RootGlobalDepthOffset:])), nil
+}
+
+// fetchBucket はハッシュ値に対応するバケットのバッファを返す
+func (h *HashIndex) fetchBucket(ctx context.Context, bufmgr *buffer.BufferPoolManager, hash uint64) (*buffer.Buffer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rootBuffer, err := bufmgr.FetchPageContext(ctx, h.RootPageID)
+	if err != nil {
+		return nil, err
+	}
+	globalDepth := int(binary.LittleEndian.Uint16(rootBuffer.Page[RootGlobalDepthOffset:]))
+	idx := directoryIndex(hash, globalDepth)
+	dirPageID := disk.PageID(binary.LittleEndian.Uint64(rootBuffer.Page[RootHeaderSize+idx/DirEntriesPerPage*8:]))
+	bufmgr.UnpinPage(rootBuffer)
+
+	dirBuffer, err := bufmgr.FetchPageContext(ctx, dirPageID)
+	if err != nil {
+		return nil, err
+	}
+	bucketPageID := disk.PageID(binary.LittleEndian.Uint64(dirBuffer.Page[idx%DirEntriesPerPage*8:]))
+	bufmgr.UnpinPage(dirBuffer)
+
+	return bufmgr.FetchPageContext(ctx, bucketPageID)
+}
+
+// Get はキーに対応する値を返す
+// キーが存在しない場合は ErrKeyNotFound を返す
+func (h *HashIndex) Get(bufmgr *buffer.BufferPoolManager, key []byte) ([]byte, error) {
+	return h.GetContext(context.Background(), bufmgr, key)
+}
+
+// GetContext は Get と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HashIndex) GetContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) ([]byte, error) {
+	bucketBuffer, err := h.fetchBucket(ctx, bufmgr, hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(bucketBuffer)
+
+	bucket := NewBucket(bucketBuffer.Page[:])
+	i := bucket.Find(key)
+	if i < 0 {
+		return nil, ErrKeyNotFound
+	}
+	_, value := bucket.PairAt(i)
+	return append([]byte{}, value...), nil
+}
+
+// Insert はキーと値を挿入する
+// キーが既に存在する場合は ErrDuplicateKey を返す
+// バケットが満杯なら分割し、必要ならディレクトリを倍にする
+func (h *HashIndex) Insert(bufmgr *buffer.BufferPoolManager, key, value []byte) error {
+	return h.InsertContext(context.Background(), bufmgr, key, value)
+}
+
+// InsertContext は Insert と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// キャンセルを確認するのはバケットを分割する前だけで、分割は最後までやり切る
+func (h *HashIndex) InsertContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key, value []byte) error {
+	if size := len(key) + len(value); size > MaxPairSize {
+		return fmt.Errorf("%w: %d bytes, max %d", ErrPairTooLarge, size, MaxPairSize)
+	}
+	hash := hashKey(key)
+	for {
+		bucketBuffer, err := h.fetchBucket(ctx, bufmgr, hash)
+		if err != nil {
+			return err
+		}
+		bucket := NewBucket(bucketBuffer.Page[:])
+		if bucket.Find(key) >= 0 {
+			bufmgr.UnpinPage(bucketBuffer)
+			return ErrDuplicateKey
+		}
+		if bucket.Insert(key, value) {
+			bucketBuffer.IsDirty = true
+			bufmgr.UnpinPage(bucketBuffer)
+			return nil
+		}
+
+		// 分割しても全てのペアが片方に寄れば、もう一度分割する
+		err = h.split(context.WithoutCancel(ctx), bufmgr, bucketBuffer)
+		bufmgr.UnpinPage(bucketBuffer)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// split は満杯のバケットを局所深度を1つ増やして2つに分ける
+// 局所深度が大域深度に等しければ、先にディレクトリを倍にする
+func (h *HashIndex) split(ctx context.Context, bufmgr *buffer.BufferPoolManager, bucketBuffer *buffer.Buffer) error {
+	rootBuffer, err := bufmgr.FetchPageContext(ctx, h.RootPageID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(rootBuffer)
+	globalDepth, dir, err := h.loadDirectory(ctx, bufmgr, rootBuffer)
+	if err != nil {
+		return err
+	}
+
+	bucket := NewBucket(bucketBuffer.Page[:])
+	localDepth := bucket.LocalDepth()
+	if localDepth == globalDepth {
+		if globalDepth == MaxGlobalDepth {
+			return ErrIndexFull
+		}
+		// ディレクトリを倍にする：新しい半分は元の半分と同じバケットを指す
+		dir = append(dir, dir...)
+		globalDepth++
+	}
+
+	newBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(newBuffer)
+	newBucket := NewBucket(newBuffer.Page[:])
+	newBucket.Initialize(localDepth + 1)
+
+	// ハッシュ値の localDepth ビット目が1のペアを新しいバケットに移す
+	type pair struct{ key, value []byte }
+	pairs := make([]pair, bucket.NumPairs())
+	for i := range pairs {
+		k, v := bucket.PairAt(i)
+		pairs[i] = pair{append([]byte{}, k...), append([]byte{}, v...)}
+	}
+	bucket.Initialize(localDepth + 1)
+	for _, p := range pairs {
+		if hashKey(p.key)>>localDepth&1 == 1 {
+			newBucket.Insert(p.key, p.value)
+		} else {
+			bucket.Insert(p.key, p.value)
+		}
+	}
+	bucketBuffer.IsDirty = true
+	newBuffer.IsDirty = true
+
+	for i, pageID := range dir {
+		if pageID == bucketBuffer.PageID && i>>localDepth&1 == 1 {
+			dir[i] = newBuffer.PageID
+		}
+	}
+	return h.storeDirectory(ctx, bufmgr, rootBuffer, globalDepth, dir)
+}
+
+// loadDirectory は大域深度とディレクトリ全体を読み込む
+func (h *HashIndex) loadDirectory(ctx context.Context, bufmgr *buffer.BufferPoolManager, rootBuffer *buffer.Buffer) (int, []disk.PageID, error) {
+	globalDepth := int(binary.LittleEndian.Uint16(rootBuffer.Page[RootGlobalDepthOffset:]))
+	dir := make([]disk.PageID, 1<<globalDepth)
+	for start := 0; start < len(dir); start += DirEntriesPerPage {
+		dirPageID := disk.PageID(binary.LittleEndian.Uint64(rootBuffer.Page[RootHeaderSize+start/DirEntriesPerPage*8:]))
+		dirBuffer, err := bufmgr.FetchPageContext(ctx, dirPageID)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := start; i < len(dir) && i < start+DirEntriesPerPage; i++ {
+			dir[i] = disk.PageID(binary.LittleEndian.Uint64(dirBuffer.Page[(i-start)*8:]))
+		}
+		bufmgr.UnpinPage(dirBuffer)
+	}
+	return globalDepth, dir, nil
+}
+
+// storeDirectory は大域深度とディレクトリ全体を書き込む
+// ディレクトリページが足りなければ作ってルートページに追加する
+func (h *HashIndex) storeDirectory(ctx context.Context, bufmgr *buffer.BufferPoolManager, rootBuffer *buffer.Buffer, globalDepth int, dir []disk.PageID) error {
+	numDirPages := int(binary.LittleEndian.Uint16(rootBuffer.Page[RootNumDirPagesOffset:]))
+	for start := 0; start < len(dir); start += DirEntriesPerPage {
+		p := start / DirEntriesPerPage
+		var dirBuffer *buffer.Buffer
+		var err error
+		if p < numDirPages {
+			dirPageID := disk.PageID(binary.LittleEndian.Uint64(rootBuffer.Page[RootHeaderSize+p*8:]))
+			dirBuffer, err = bufmgr.FetchPageContext(ctx, dirPageID)
+		} else {
+			dirBuffer, err = bufmgr.CreatePageContext(ctx)
+			if err == nil {
+				binary.LittleEndian.PutUint64(rootBuffer.Page[RootHeaderSize+p*8:], uint64(dirBuffer.PageID))
+				numDirPages++
+			}
+		}
+		if err != nil {
+			return err
+		}
+		for i := start; i < len(dir) && i < start+DirEntriesPerPage; i++ {
+			binary.LittleEndian.PutUint64(dirBuffer.Page[(i-start)*8:], uint64(dir[i]))
+		}
+		dirBuffer.IsDirty = true
+		bufmgr.UnpinPage(dirBuffer)
+	}
+	binary.LittleEndian.PutUint16(rootBuffer.Page[RootGlobalDepthOffset:], uint16(globalDepth))
+	binary.LittleEndian.PutUint16(rootBuffer.Page[RootNumDirPagesOffset:], uint16(numDirPages))
+	rootBuffer.IsDirty = true
+	return nil
+}
+
+// Delete はキーを削除する
+// キーが存在しない場合は ErrKeyNotFound を返す
+// 空になったバケットは併合せず、ディレクトリも縮めない
+func (h *HashIndex) Delete(bufmgr *buffer.BufferPoolManager, key []byte) error {
+	return h.DeleteContext(context.Background(), bufmgr, key)
+}
+
+// DeleteContext は Delete と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HashIndex) DeleteContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) error {
+	bucketBuffer, err := h.fetchBucket(ctx, bufmgr, hashKey(key))
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(bucketBuffer)
+
+	bucket := NewBucket(bucketBuffer.Page[:])
+	i := bucket.Find(key)
+	if i < 0 {
+		return ErrKeyNotFound
+	}
+	bucket.Delete(i)
+	bucketBuffer.IsDirty = true
+	return nil
+}
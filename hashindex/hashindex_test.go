@@ -0,0 +1,171 @@
+package hashindex
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// テスト用のヘルパー関数
+func setupTestEnv(t *testing.T) (*buffer.BufferPoolManager, func()) {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "hashindex_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+
+	pool := buffer.NewBufferPool(10)
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+
+	cleanup := func() {
+		os.Remove(tmpPath)
+	}
+
+	return bufmgr, cleanup
+}
+
+func TestBucket(t *testing.T) {
+	bucket := NewBucket(make([]byte, disk.PageSize))
+	bucket.Initialize(3)
+	if bucket.LocalDepth() != 3 {
+		t.Errorf("expected local depth 3, got %d", bucket.LocalDepth())
+	}
+
+	for i := 0; i < 5; i++ {
+		if !bucket.Insert([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("value%d", i))) {
+			t.Fatalf("failed to insert key%d", i)
+		}
+	}
+	bucket.Delete(bucket.Find([]byte("key1")))
+	if bucket.Find([]byte("key1")) >= 0 {
+		t.Error("expected key1 to be deleted")
+	}
+	for _, i := range []int{0, 2, 3, 4} {
+		slot := bucket.Find([]byte(fmt.Sprintf("key%d", i)))
+		if slot < 0 {
+			t.Fatalf("key%d not found", i)
+		}
+		if _, value := bucket.PairAt(slot); string(value) != fmt.Sprintf("value%d", i) {
+			t.Errorf("key%d: unexpected value %q", i, value)
+		}
+	}
+
+	big := make([]byte, MaxPairSize)
+	if bucket.Insert(big, nil) {
+		t.Error("expected insert into a non-empty bucket to fail")
+	}
+	bucket.Initialize(0)
+	if !bucket.Insert(big[:MaxPairSize/2], big[:MaxPairSize-MaxPairSize/2]) {
+		t.Error("expected a pair of MaxPairSize to fit into an empty bucket")
+	}
+}
+
+func TestHashIndex(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	idx, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create hash index: %v", err)
+	}
+
+	// バケットの分割とディレクトリの倍増が起きるだけ挿入する
+	const n = 5000
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		if err := idx.Insert(bufmgr, []byte(key), []byte("value"+key)); err != nil {
+			t.Fatalf("failed to insert %s: %v", key, err)
+		}
+	}
+	depth, err := idx.GlobalDepth(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to get global depth: %v", err)
+	}
+	if depth < 5 {
+		t.Errorf("expected the directory to have doubled several times, got depth %d", depth)
+	}
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		value, err := idx.Get(bufmgr, []byte(key))
+		if err != nil {
+			t.Fatalf("failed to get %s: %v", key, err)
+		}
+		if string(value) != "value"+key {
+			t.Errorf("%s: unexpected value %q", key, value)
+		}
+	}
+
+	if err := idx.Insert(bufmgr, []byte("key00042"), []byte("again")); err != ErrDuplicateKey {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+	if _, err := idx.Get(bufmgr, []byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	for i := 0; i < n; i += 2 {
+		if err := idx.Delete(bufmgr, []byte(fmt.Sprintf("key%05d", i))); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := idx.Delete(bufmgr, []byte("key00000")); err != ErrKeyNotFound {
+		t.Errorf("expected ErrKeyNotFound on second delete, got %v", err)
+	}
+
+	// 開き直しても同じ内容が読める
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	reopened := NewHashIndex(idx.RootPageID)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%05d", i)
+		_, err := reopened.Get(bufmgr, []byte(key))
+		if i%2 == 0 && err != ErrKeyNotFound {
+			t.Errorf("%s: expected ErrKeyNotFound, got %v", key, err)
+		}
+		if i%2 == 1 && err != nil {
+			t.Errorf("%s: %v", key, err)
+		}
+	}
+}
+
+func TestHashIndexLargePairs(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	idx, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create hash index: %v", err)
+	}
+
+	// 1つのバケットに1つしか入らないペアでも分割を繰り返して収める
+	value := bytes.Repeat([]byte("v"), MaxPairSize/2)
+	for i := 0; i < 50; i++ {
+		if err := idx.Insert(bufmgr, []byte(fmt.Sprintf("big%02d", i)), value); err != nil {
+			t.Fatalf("failed to insert big%02d: %v", i, err)
+		}
+	}
+	for i := 0; i < 50; i++ {
+		if got, err := idx.Get(bufmgr, []byte(fmt.Sprintf("big%02d", i))); err != nil || !bytes.Equal(got, value) {
+			t.Errorf("big%02d: unexpected result: %d bytes, %v", i, len(got), err)
+		}
+	}
+
+	if err := idx.Insert(bufmgr, []byte("k"), make([]byte, MaxPairSize)); !errors.Is(err, ErrPairTooLarge) {
+		t.Errorf("expected ErrPairTooLarge, got %v", err)
+	}
+}
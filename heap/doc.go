@@ -0,0 +1,60 @@
+/*
+Package heap はヒープファイル（順序を持たないレコードの格納領域）を提供する。
+
+# 概要
+
+table.SimpleTable は行をB-treeのリーフに直接格納する（インデックス構成表）。
+ヒープファイルはその代わりになる古典的な構成で、行をキーに関係なく空いている
+ページに格納し、その位置を RID（ページIDとスロット番号）で表す。
+キーによる検索は、キーから RID を引くB-treeのインデックスを別に作って行う：
+
+	┌──────────────────┐        ┌───────────────────────────┐
+	│ B-tree インデックス │  RID   │        ヒープファイル        │
+	│  key → RID       ├───────▶│ Page 1 │ Page 5 │ Page 9 │ │
+	└──────────────────┘        └───────────────────────────┘
+
+1つのヒープファイルに複数のインデックスを張っても、行の本体は1回しか格納しない。
+
+# ページの構成
+
+ヘッダーページが最初と最後のヒープページのIDを持ち、ヒープページは次のページへの
+リンクで一方向につながる。各ヒープページはスロットページ形式で、スロットには
+レコードのオフセットと長さが入る：
+
+	[next_page_id] [num_slots] [free_space_offset] [slot0] [slot1] ... [空き領域] ... [rec1] [rec0]
+
+挿入は常に最後のページに行い、収まらなければ新しいページをつなぐ。
+レコードを削除しても他のレコードのスロット番号は変わらないので、RID は
+レコードが削除されるまで有効なままになる。削除したスロットは同じページへの
+後の挿入で再利用される。
+
+# 更新
+
+Update は同じページに収まれば同じ RID のまま置き換える。収まらなければ
+レコードを別のページに移して新しい RID を返すので、インデックスを書き換えること。
+
+# 使用例
+
+	heapFile, _ := heap.Create(bufmgr)
+	index, _ := btree.Create(bufmgr)
+
+	// 行をヒープに入れ、キーから RID を引くインデックスを作る
+	rid, _ := heapFile.Insert(bufmgr, []byte("Alice,25"))
+	index.Insert(bufmgr, []byte("1"), rid.Bytes())
+
+	// インデックスで RID を引いてから行を読む
+	values, _ := index.GetAll(bufmgr, []byte("1"))
+	rid, _ = heap.RIDFromBytes(values[0])
+	row, _ := heapFile.Get(bufmgr, rid)
+
+	// 全行を格納順にスキャン
+	iter, _ := heapFile.Scan(bufmgr)
+	for {
+	    record, _ := iter.Next(bufmgr)
+	    if record == nil {
+	        break
+	    }
+	    fmt.Println(record.RID, string(record.Data))
+	}
+*/
+package heap
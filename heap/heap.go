@@ -0,0 +1,302 @@
+package heap
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// エラー定義
+var (
+	ErrRecordNotFound = errors.New("record not found")
+	ErrRecordTooLarge = errors.New("record too large")
+	ErrInvalidRID     = errors.New("invalid RID")
+)
+
+// RID はヒープファイル内のレコードの位置（ページIDとスロット番号）
+// レコードが削除されるまで変わらないので、インデックスから行を指すのに使う
+type RID struct {
+	PageID disk.PageID
+	Slot   uint16
+}
+
+// RIDSize はエンコードした RID のバイト数
+const RIDSize = 10
+
+// Bytes は RID をバイト列にエンコードする
+// フォーマット: [page_id: 8 (big endian)] [slot: 2 (big endian)]
+// ビッグエンディアンなので、バイト列の順序が RID の順序と一致する
+func (r RID) Bytes() []byte {
+	buf := make([]byte, RIDSize)
+	binary.BigEndian.PutUint64(buf[0:8], uint64(r.PageID))
+	binary.BigEndian.PutUint16(buf[8:10], r.Slot)
+	return buf
+}
+
+// String は RID を "(page_id,slot)" の形で返す
+func (r RID) String() string {
+	return fmt.Sprintf("(%d,%d)", r.PageID, r.Slot)
+}
+
+// RIDFromBytes は Bytes でエンコードしたバイト列から RID を取り出す
+func RIDFromBytes(data []byte) (RID, error) {
+	if len(data) != RIDSize {
+		return RID{}, fmt.Errorf("%w: %d bytes", ErrInvalidRID, len(data))
+	}
+	return RID{
+		PageID: disk.PageID(binary.BigEndian.Uint64(data[0:8])),
+		Slot:   binary.BigEndian.Uint16(data[8:10]),
+	}, nil
+}
+
+// ヘッダーページのレイアウト:
+// [first_page_id: 8] [last_page_id: 8]
+// ヒープページは first_page_id から next_page_id で一方向につながる
+
+const (
+	HeaderFirstPageIDOffset = 0
+	HeaderLastPageIDOffset  = 8
+)
+
+// HeapFile はレコードを順序なしに格納するヒープファイル
+// 挿入は常に最後のページに行い、収まらなければ新しいページを追加する
+type HeapFile struct {
+	HeaderPageID disk.PageID
+}
+
+// Create は新しいヒープファイルを作成する
+func Create(bufmgr *buffer.BufferPoolManager) (*HeapFile, error) {
+	headerBuffer, err := bufmgr.CreatePage()
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(headerBuffer)
+
+	pageBuffer, err := bufmgr.CreatePage()
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(pageBuffer)
+	NewPage(pageBuffer.Page[:]).Initialize()
+	pageBuffer.IsDirty = true
+
+	binary.LittleEndian.PutUint64(headerBuffer.Page[HeaderFirstPageIDOffset:], uint64(pageBuffer.PageID))
+	binary.LittleEndian.PutUint64(headerBuffer.Page[HeaderLastPageIDOffset:], uint64(pageBuffer.PageID))
+	headerBuffer.IsDirty = true
+
+	return &HeapFile{HeaderPageID: headerBuffer.PageID}, nil
+}
+
+// NewHeapFile は既存のヒープファイルを開く
+func NewHeapFile(headerPageID disk.PageID) *HeapFile {
+	return &HeapFile{HeaderPageID: headerPageID}
+}
+
+// Insert はレコードを挿入して RID を返す
+// レコードが MaxRecordSize を超える場合は ErrRecordTooLarge を返す
+func (h *HeapFile) Insert(bufmgr *buffer.BufferPoolManager, record []byte) (RID, error) {
+	return h.InsertContext(context.Background(), bufmgr, record)
+}
+
+// InsertContext は Insert と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HeapFile) InsertContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, record []byte) (RID, error) {
+	if err := ctx.Err(); err != nil {
+		return RID{}, err
+	}
+	if len(record) > MaxRecordSize {
+		return RID{}, fmt.Errorf("%w: %d bytes, max %d", ErrRecordTooLarge, len(record), MaxRecordSize)
+	}
+
+	headerBuffer, err := bufmgr.FetchPageContext(ctx, h.HeaderPageID)
+	if err != nil {
+		return RID{}, err
+	}
+	defer bufmgr.UnpinPage(headerBuffer)
+	lastPageID := disk.PageID(binary.LittleEndian.Uint64(headerBuffer.Page[HeaderLastPageIDOffset:]))
+
+	lastBuffer, err := bufmgr.FetchPageContext(ctx, lastPageID)
+	if err != nil {
+		return RID{}, err
+	}
+	defer bufmgr.UnpinPage(lastBuffer)
+	lastPage := NewPage(lastBuffer.Page[:])
+	if slotID, ok := lastPage.Insert(record); ok {
+		lastBuffer.IsDirty = true
+		return RID{PageID: lastPageID, Slot: uint16(slotID)}, nil
+	}
+
+	// 最後のページに収まらなければ新しいページをつなぐ
+	newBuffer, err := bufmgr.CreatePageContext(ctx)
+	if err != nil {
+		return RID{}, err
+	}
+	defer bufmgr.UnpinPage(newBuffer)
+	newPage := NewPage(newBuffer.Page[:])
+	newPage.Initialize()
+	slotID, _ := newPage.Insert(record)
+	newBuffer.IsDirty = true
+
+	lastPage.setNextPageID(newBuffer.PageID)
+	lastBuffer.IsDirty = true
+	binary.LittleEndian.PutUint64(headerBuffer.Page[HeaderLastPageIDOffset:], uint64(newBuffer.PageID))
+	headerBuffer.IsDirty = true
+
+	return RID{PageID: newBuffer.PageID, Slot: uint16(slotID)}, nil
+}
+
+// Get は RID のレコードを返す
+// レコードが削除済みなら ErrRecordNotFound を返す
+func (h *HeapFile) Get(bufmgr *buffer.BufferPoolManager, rid RID) ([]byte, error) {
+	return h.GetContext(context.Background(), bufmgr, rid)
+}
+
+// GetContext は Get と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HeapFile) GetContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, rid RID) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	pageBuffer, err := bufmgr.FetchPageContext(ctx, rid.PageID)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(pageBuffer)
+
+	record, ok := NewPage(pageBuffer.Page[:]).Record(int(rid.Slot))
+	if !ok {
+		return nil, fmt.Errorf("%w: %v", ErrRecordNotFound, rid)
+	}
+	return record, nil
+}
+
+// Update は RID のレコードを置き換え、置き換えた後の RID を返す
+// 同じページに収まらなければレコードを別のページに移すので、返った RID が変わっていたら
+// インデックスを書き換えること
+func (h *HeapFile) Update(bufmgr *buffer.BufferPoolManager, rid RID, record []byte) (RID, error) {
+	return h.UpdateContext(context.Background(), bufmgr, rid, record)
+}
+
+// UpdateContext は Update と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HeapFile) UpdateContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, rid RID, record []byte) (RID, error) {
+	if err := ctx.Err(); err != nil {
+		return RID{}, err
+	}
+	if len(record) > MaxRecordSize {
+		return RID{}, fmt.Errorf("%w: %d bytes, max %d", ErrRecordTooLarge, len(record), MaxRecordSize)
+	}
+	pageBuffer, err := bufmgr.FetchPageContext(ctx, rid.PageID)
+	if err != nil {
+		return RID{}, err
+	}
+	defer bufmgr.UnpinPage(pageBuffer)
+
+	page := NewPage(pageBuffer.Page[:])
+	if _, ok := page.Record(int(rid.Slot)); !ok {
+		return RID{}, fmt.Errorf("%w: %v", ErrRecordNotFound, rid)
+	}
+	if page.Update(int(rid.Slot), record) {
+		pageBuffer.IsDirty = true
+		return rid, nil
+	}
+
+	// 先に新しい場所に書いてから古いレコードを消す（失敗しても元のレコードが残る）
+	newRID, err := h.InsertContext(ctx, bufmgr, record)
+	if err != nil {
+		return RID{}, err
+	}
+	page.Delete(int(rid.Slot))
+	pageBuffer.IsDirty = true
+	return newRID, nil
+}
+
+// Delete は RID のレコードを削除する
+// レコードが削除済みなら ErrRecordNotFound を返す。削除した RID は後の挿入で再利用される
+func (h *HeapFile) Delete(bufmgr *buffer.BufferPoolManager, rid RID) error {
+	return h.DeleteContext(context.Background(), bufmgr, rid)
+}
+
+// DeleteContext は Delete と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HeapFile) DeleteContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, rid RID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	pageBuffer, err := bufmgr.FetchPageContext(ctx, rid.PageID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(pageBuffer)
+
+	page := NewPage(pageBuffer.Page[:])
+	if _, ok := page.Record(int(rid.Slot)); !ok {
+		return fmt.Errorf("%w: %v", ErrRecordNotFound, rid)
+	}
+	page.Delete(int(rid.Slot))
+	pageBuffer.IsDirty = true
+	return nil
+}
+
+// Record はスキャンで返すレコード
+type Record struct {
+	RID  RID
+	Data []byte
+}
+
+// Iter はヒープファイルの全レコードを格納順に返すイテレータ
+// ページをピンしたままにしないので、Close は不要
+type Iter struct {
+	pageID disk.PageID
+	slotID int
+}
+
+// Scan は全レコードをスキャンするイテレータを返す
+func (h *HeapFile) Scan(bufmgr *buffer.BufferPoolManager) (*Iter, error) {
+	return h.ScanContext(context.Background(), bufmgr)
+}
+
+// ScanContext は Scan と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (h *HeapFile) ScanContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*Iter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	headerBuffer, err := bufmgr.FetchPageContext(ctx, h.HeaderPageID)
+	if err != nil {
+		return nil, err
+	}
+	defer bufmgr.UnpinPage(headerBuffer)
+	firstPageID := disk.PageID(binary.LittleEndian.Uint64(headerBuffer.Page[HeaderFirstPageIDOffset:]))
+	return &Iter{pageID: firstPageID}, nil
+}
+
+// Next は次のレコードを返す
+// 全てのレコードを返し終わったら nil を返す
+func (it *Iter) Next(bufmgr *buffer.BufferPoolManager) (*Record, error) {
+	return it.NextContext(context.Background(), bufmgr)
+}
+
+// NextContext は Next と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (it *Iter) NextContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*Record, error) {
+	for it.pageID != InvalidPageID {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		pageBuffer, err := bufmgr.FetchPageContext(ctx, it.pageID)
+		if err != nil {
+			return nil, err
+		}
+		page := NewPage(pageBuffer.Page[:])
+		for it.slotID < page.NumSlots() {
+			slotID := it.slotID
+			it.slotID++
+			if data, ok := page.Record(slotID); ok {
+				bufmgr.UnpinPage(pageBuffer)
+				return &Record{RID: RID{PageID: it.pageID, Slot: uint16(slotID)}, Data: data}, nil
+			}
+		}
+		it.pageID, it.slotID = page.NextPageID(), 0
+		bufmgr.UnpinPage(pageBuffer)
+	}
+	return nil, nil
+}
@@ -0,0 +1,256 @@
+package heap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// テスト用のヘルパー関数
+func setupTestEnv(t *testing.T) (*buffer.BufferPoolManager, func()) {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "heap_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+
+	pool := buffer.NewBufferPool(10)
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+
+	cleanup := func() {
+		os.Remove(tmpPath)
+	}
+
+	return bufmgr, cleanup
+}
+
+func scanAll(t *testing.T, bufmgr *buffer.BufferPoolManager, h *HeapFile) []*Record {
+	t.Helper()
+	iter, err := h.Scan(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var records []*Record
+	for {
+		record, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if record == nil {
+			return records
+		}
+		records = append(records, record)
+	}
+}
+
+func TestPage(t *testing.T) {
+	data := make([]byte, disk.PageSize)
+	page := NewPage(data)
+	page.Initialize()
+
+	for i := 0; i < 3; i++ {
+		slotID, ok := page.Insert([]byte(fmt.Sprintf("record%d", i)))
+		if !ok || slotID != i {
+			t.Fatalf("insert %d: got slot %d, ok=%v", i, slotID, ok)
+		}
+	}
+
+	// 削除しても他のスロットの中身は変わらない
+	page.Delete(1)
+	if _, ok := page.Record(1); ok {
+		t.Error("expected slot 1 to be deleted")
+	}
+	if record, _ := page.Record(2); string(record) != "record2" {
+		t.Errorf("expected record2, got %q", record)
+	}
+
+	// 空いたスロットを再利用する
+	if slotID, _ := page.Insert([]byte("new")); slotID != 1 {
+		t.Errorf("expected slot 1 to be reused, got %d", slotID)
+	}
+
+	// 末尾の削除済みスロットは取り除く
+	page.Delete(2)
+	if page.NumSlots() != 2 {
+		t.Errorf("expected 2 slots, got %d", page.NumSlots())
+	}
+
+	if !page.Update(0, bytes.Repeat([]byte("x"), 100)) {
+		t.Fatal("expected update to fit")
+	}
+	if record, _ := page.Record(1); string(record) != "new" {
+		t.Errorf("expected new, got %q", record)
+	}
+	if page.Update(0, make([]byte, disk.PageSize)) {
+		t.Error("expected update larger than the page to fail")
+	}
+	if record, _ := page.Record(0); len(record) != 100 {
+		t.Errorf("failed update changed the record: %d bytes", len(record))
+	}
+}
+
+func TestHeapFile(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	h, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create heap file: %v", err)
+	}
+
+	// 複数ページにまたがるように挿入する
+	rids := make([]RID, 500)
+	for i := range rids {
+		record := []byte(fmt.Sprintf("record%03d:%s", i, bytes.Repeat([]byte("."), 40)))
+		if rids[i], err = h.Insert(bufmgr, record); err != nil {
+			t.Fatalf("failed to insert %d: %v", i, err)
+		}
+	}
+	if rids[0].PageID == rids[len(rids)-1].PageID {
+		t.Fatal("expected records to span several pages")
+	}
+
+	for i, rid := range rids {
+		record, err := h.Get(bufmgr, rid)
+		if err != nil {
+			t.Fatalf("failed to get %v: %v", rid, err)
+		}
+		if want := fmt.Sprintf("record%03d:", i); !bytes.HasPrefix(record, []byte(want)) {
+			t.Errorf("%v: expected %s..., got %s", rid, want, record)
+		}
+	}
+
+	// 削除したレコードは読めず、スキャンにも出てこない
+	for i := 0; i < len(rids); i += 2 {
+		if err := h.Delete(bufmgr, rids[i]); err != nil {
+			t.Fatalf("failed to delete %v: %v", rids[i], err)
+		}
+	}
+	if _, err := h.Get(bufmgr, rids[0]); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound, got %v", err)
+	}
+	if err := h.Delete(bufmgr, rids[0]); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("expected ErrRecordNotFound on second delete, got %v", err)
+	}
+	records := scanAll(t, bufmgr, h)
+	if len(records) != len(rids)/2 {
+		t.Fatalf("expected %d records, got %d", len(rids)/2, len(records))
+	}
+	for j, record := range records {
+		i := 2*j + 1
+		if record.RID != rids[i] {
+			t.Errorf("record %d: expected RID %v, got %v", j, rids[i], record.RID)
+		}
+	}
+
+	// 同じページに収まる更新は RID が変わらない
+	rid, err := h.Update(bufmgr, rids[1], []byte("short"))
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if rid != rids[1] {
+		t.Errorf("expected RID %v to be kept, got %v", rids[1], rid)
+	}
+
+	// 収まらない更新はレコードを移す
+	last := rids[len(rids)-1]
+	big := bytes.Repeat([]byte("y"), MaxRecordSize)
+	moved, err := h.Update(bufmgr, last, big)
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if moved == last {
+		t.Fatal("expected record to move")
+	}
+	if _, err := h.Get(bufmgr, last); !errors.Is(err, ErrRecordNotFound) {
+		t.Errorf("expected old RID to be gone, got %v", err)
+	}
+	if record, _ := h.Get(bufmgr, moved); !bytes.Equal(record, big) {
+		t.Errorf("moved record has %d bytes", len(record))
+	}
+
+	if _, err := h.Insert(bufmgr, make([]byte, MaxRecordSize+1)); !errors.Is(err, ErrRecordTooLarge) {
+		t.Errorf("expected ErrRecordTooLarge, got %v", err)
+	}
+
+	// 開き直しても同じ内容が読める
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	reopened := NewHeapFile(h.HeaderPageID)
+	if n := len(scanAll(t, bufmgr, reopened)); n != len(records) {
+		t.Errorf("expected %d records after reopen, got %d", len(records), n)
+	}
+}
+
+func TestRID(t *testing.T) {
+	rid := RID{PageID: 42, Slot: 7}
+	got, err := RIDFromBytes(rid.Bytes())
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if got != rid {
+		t.Errorf("expected %v, got %v", rid, got)
+	}
+	if bytes.Compare(RID{PageID: 1, Slot: 300}.Bytes(), RID{PageID: 2, Slot: 0}.Bytes()) >= 0 {
+		t.Error("expected encoded RIDs to sort by page then slot")
+	}
+	if _, err := RIDFromBytes([]byte{1, 2}); !errors.Is(err, ErrInvalidRID) {
+		t.Errorf("expected ErrInvalidRID, got %v", err)
+	}
+}
+
+func TestHeapFileWithIndex(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	h, err := Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create heap file: %v", err)
+	}
+	index, err := btree.Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create index: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		rid, err := h.Insert(bufmgr, []byte(fmt.Sprintf("row%d", i)))
+		if err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if err := index.Insert(bufmgr, []byte(fmt.Sprintf("key%02d", i)), rid.Bytes()); err != nil {
+			t.Fatalf("failed to index: %v", err)
+		}
+	}
+
+	values, err := index.GetAll(bufmgr, []byte("key17"))
+	if err != nil || len(values) != 1 {
+		t.Fatalf("failed to look up index: %v, %d values", err, len(values))
+	}
+	rid, err := RIDFromBytes(values[0])
+	if err != nil {
+		t.Fatalf("failed to decode RID: %v", err)
+	}
+	row, err := h.Get(bufmgr, rid)
+	if err != nil {
+		t.Fatalf("failed to get row: %v", err)
+	}
+	if string(row) != "row17" {
+		t.Errorf("expected row17, got %s", row)
+	}
+}
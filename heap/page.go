@@ -0,0 +1,177 @@
+package heap
+
+import (
+	"encoding/binary"
+
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// ヒープページのレイアウト:
+// [next_page_id: 8] [num_slots: 2] [free_space_offset: 2]
+// その後にスロット配列（各4バイト：オフセット 2バイト + 長さ 2バイト）が続き、
+// ページ末尾からレコードが詰められる
+//
+// レコードを削除してもスロットはオフセットを0にして残すので、他のレコードのスロット番号
+// （RID）は変わらない。空いたスロットは後の挿入で再利用する
+
+const (
+	PageNextPageIDOffset      = 0
+	PageNumSlotsOffset        = 8
+	PageFreeSpaceOffsetOffset = 10
+	PageHeaderSize            = 12
+	SlotSize                  = 4 // オフセット（2バイト）+ 長さ（2バイト）
+
+	// MaxRecordSize は1つのレコードの最大バイト数
+	MaxRecordSize = disk.PageSize - PageHeaderSize - SlotSize
+)
+
+// InvalidPageID は無効なページIDを示す
+const InvalidPageID = disk.PageID(0xFFFFFFFFFFFFFFFF)
+
+// Page はヒープページを表す
+type Page struct {
+	data []byte
+}
+
+// NewPage はデータからPageを作成する
+func NewPage(data []byte) *Page {
+	return &Page{data: data}
+}
+
+// Initialize は空のヒープページとして初期化する
+func (p *Page) Initialize() {
+	p.setNextPageID(InvalidPageID)
+	p.setNumSlots(0)
+	p.setFreeSpaceOffset(len(p.data))
+}
+
+// NextPageID は次のページIDを返す（最後のページなら InvalidPageID）
+func (p *Page) NextPageID() disk.PageID {
+	return disk.PageID(binary.LittleEndian.Uint64(p.data[PageNextPageIDOffset:]))
+}
+
+func (p *Page) setNextPageID(id disk.PageID) {
+	binary.LittleEndian.PutUint64(p.data[PageNextPageIDOffset:], uint64(id))
+}
+
+// NumSlots はスロットの数を返す（削除済みのスロットを含む）
+func (p *Page) NumSlots() int {
+	return int(binary.LittleEndian.Uint16(p.data[PageNumSlotsOffset:]))
+}
+
+func (p *Page) setNumSlots(n int) {
+	binary.LittleEndian.PutUint16(p.data[PageNumSlotsOffset:], uint16(n))
+}
+
+func (p *Page) freeSpaceOffset() int {
+	return int(binary.LittleEndian.Uint16(p.data[PageFreeSpaceOffsetOffset:]))
+}
+
+func (p *Page) setFreeSpaceOffset(offset int) {
+	binary.LittleEndian.PutUint16(p.data[PageFreeSpaceOffsetOffset:], uint16(offset))
+}
+
+// slot は指定スロットのレコードのオフセットと長さを返す
+func (p *Page) slot(slotID int) (offset, length int) {
+	pos := PageHeaderSize + slotID*SlotSize
+	return int(binary.LittleEndian.Uint16(p.data[pos:])), int(binary.LittleEndian.Uint16(p.data[pos+2:]))
+}
+
+func (p *Page) setSlot(slotID int, offset, length int) {
+	pos := PageHeaderSize + slotID*SlotSize
+	binary.LittleEndian.PutUint16(p.data[pos:], uint16(offset))
+	binary.LittleEndian.PutUint16(p.data[pos+2:], uint16(length))
+}
+
+// freeSpace は空き領域のサイズを返す
+func (p *Page) freeSpace() int {
+	return p.freeSpaceOffset() - (PageHeaderSize + p.NumSlots()*SlotSize)
+}
+
+// Record は指定スロットのレコードのコピーを返す
+// スロットが範囲外か削除済みなら (nil, false) を返す
+func (p *Page) Record(slotID int) ([]byte, bool) {
+	if slotID < 0 || slotID >= p.NumSlots() {
+		return nil, false
+	}
+	offset, length := p.slot(slotID)
+	if offset == 0 || offset+length > len(p.data) {
+		return nil, false
+	}
+	return append([]byte{}, p.data[offset:offset+length]...), true
+}
+
+// Insert はレコードを挿入してスロット番号を返す
+// 削除済みのスロットがあれば再利用する。スペース不足なら (0, false) を返す
+func (p *Page) Insert(record []byte) (int, bool) {
+	slotID := p.NumSlots()
+	for i := 0; i < p.NumSlots(); i++ {
+		if offset, _ := p.slot(i); offset == 0 {
+			slotID = i
+			break
+		}
+	}
+	need := len(record)
+	if slotID == p.NumSlots() {
+		need += SlotSize
+	}
+	if p.freeSpace() < need {
+		return 0, false
+	}
+	if slotID == p.NumSlots() {
+		p.setNumSlots(slotID + 1)
+	}
+	p.write(slotID, record)
+	return slotID, true
+}
+
+// Update は指定スロットのレコードを置き換える
+// 古いレコードの領域を空けても収まらなければ何もせず false を返す
+func (p *Page) Update(slotID int, record []byte) bool {
+	_, length := p.slot(slotID)
+	if p.freeSpace()+length < len(record) {
+		return false
+	}
+	p.remove(slotID)
+	p.write(slotID, record)
+	return true
+}
+
+// Delete は指定スロットのレコードを削除する
+// 末尾の削除済みスロットはスロット配列から取り除く
+func (p *Page) Delete(slotID int) {
+	p.remove(slotID)
+	n := p.NumSlots()
+	for n > 0 {
+		if offset, _ := p.slot(n - 1); offset != 0 {
+			break
+		}
+		n--
+	}
+	p.setNumSlots(n)
+}
+
+// write はレコードを空き領域の末尾に書き、スロットに設定する
+func (p *Page) write(slotID int, record []byte) {
+	offset := p.freeSpaceOffset() - len(record)
+	copy(p.data[offset:], record)
+	p.setSlot(slotID, offset, len(record))
+	p.setFreeSpaceOffset(offset)
+}
+
+// remove は指定スロットのレコードの領域を詰めて空き領域に戻し、スロットを空にする
+func (p *Page) remove(slotID int) {
+	offset, length := p.slot(slotID)
+
+	// 削除するレコードより手前（空き領域側）にあるレコードを後ろにずらす
+	freeSpaceOffset := p.freeSpaceOffset()
+	copy(p.data[freeSpaceOffset+length:offset+length], p.data[freeSpaceOffset:offset])
+	for i := 0; i < p.NumSlots(); i++ {
+		if o, l := p.slot(i); o != 0 && o < offset {
+			p.setSlot(i, o+length, l)
+		}
+	}
+
+	p.setSlot(slotID, 0, 0)
+	p.setFreeSpaceOffset(freeSpaceOffset + length)
+}
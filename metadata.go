@@ -0,0 +1,159 @@
+package minidb
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+// MetadataCreatedAt は CreateTable がテーブルを作った時刻（RFC 3339）を入れるメタデータのキー
+// 以前のバージョンで作ったテーブルにはない
+const MetadataCreatedAt = "created_at"
+
+// カタログの行の列
+// [name] [catalogEntry] [統計（Analyze していなければ空）] [メタデータ（なければ列がない）]
+const (
+	catalogStatsColumn    = 2
+	catalogMetadataColumn = 3
+)
+
+// encodeMetadata はメタデータをカタログの列に置くバイト列にする
+// キーの順に、キーと値を交互に並べた Tuple としてエンコードする
+func encodeMetadata(metadata map[string][]byte) []byte {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	tuple := make(Tuple, 0, 2*len(keys))
+	for _, key := range keys {
+		tuple = append(tuple, []byte(key), metadata[key])
+	}
+	return tuple.Encode()
+}
+
+// decodeMetadata は encodeMetadata したバイト列からメタデータを読み出す
+func decodeMetadata(data []byte) (map[string][]byte, error) {
+	tuple := table.DecodeTuple(data)
+	if len(tuple)%2 != 0 {
+		return nil, fmt.Errorf("table metadata has %d elements", len(tuple))
+	}
+	metadata := make(map[string][]byte, len(tuple)/2)
+	for i := 0; i < len(tuple); i += 2 {
+		metadata[string(tuple[i])] = tuple[i+1]
+	}
+	return metadata, nil
+}
+
+// createdMetadata は CreateTable でカタログに記録するメタデータを作る
+func createdMetadata() []byte {
+	return encodeMetadata(map[string][]byte{
+		MetadataCreatedAt: []byte(time.Now().UTC().Format(time.RFC3339Nano)),
+	})
+}
+
+// Metadata はテーブルのメタデータ（コメントや作った時刻など）を返す
+// 作った時刻は MetadataCreatedAt のキーにある
+func (t *Table) Metadata() (map[string][]byte, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	row, err := t.catalogRow()
+	if err != nil {
+		return nil, err
+	}
+	if len(row) <= catalogMetadataColumn {
+		return map[string][]byte{}, nil
+	}
+	return decodeMetadata(row[catalogMetadataColumn])
+}
+
+// SetMetadata はテーブルのメタデータの key に value を記録する。value が nil なら key を消す
+// メタデータはカタログに記録するので、開き直しても Metadata で読める
+func (t *Table) SetMetadata(key string, value []byte) error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	row, err := t.catalogRow()
+	if err != nil {
+		return err
+	}
+	metadata := map[string][]byte{}
+	if len(row) > catalogMetadataColumn {
+		if metadata, err = decodeMetadata(row[catalogMetadataColumn]); err != nil {
+			return err
+		}
+	}
+	if value == nil {
+		delete(metadata, key)
+	} else {
+		metadata[key] = value
+	}
+	for len(row) <= catalogMetadataColumn {
+		row = append(row, nil)
+	}
+	row[catalogMetadataColumn] = encodeMetadata(metadata)
+
+	batch := table.NewWriteBatch()
+	batch.Put(t.db.catalog, row)
+	return batch.Apply(t.db.bufmgr)
+}
+
+// catalogRow はカタログのテーブルの行を読む
+// 呼び出し時は db.mu を保持していること
+func (t *Table) catalogRow() (Tuple, error) {
+	row, found, err := get(t.db.bufmgr, t.db.catalog, Tuple{[]byte(t.name)})
+	if err != nil {
+		return nil, err
+	}
+	if !found || len(row) < 2 {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, t.name)
+	}
+	return row, nil
+}
+
+// RenameTable はテーブルの名前を変える
+// カタログの行を1つの WriteBatch で付け替えるので、途中で失敗しても元の名前のまま残る。
+// 開いていた Table はそのまま新しい名前で使える。Subscribe は名前で登録するので、
+// 古い名前で登録した関数には新しい名前のテーブルのイベントは届かない
+// oldName のテーブルがなければ ErrTableNotFound を、newName のテーブルがあれば ErrTableExists を返す
+func (db *DB) RenameTable(oldName, newName string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	row, found, err := get(db.bufmgr, db.catalog, Tuple{[]byte(oldName)})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, oldName)
+	}
+	if _, found, err := db.lookupTable(newName); err != nil {
+		return err
+	} else if found {
+		return fmt.Errorf("%w: %s", ErrTableExists, newName)
+	}
+
+	renamed := slices.Clone(row)
+	renamed[0] = []byte(newName)
+	batch := table.NewWriteBatch()
+	batch.Delete(db.catalog, Tuple{[]byte(oldName)})
+	batch.Insert(db.catalog, renamed)
+	if err := batch.Apply(db.bufmgr); err != nil {
+		return err
+	}
+	if t, ok := db.tables[oldName]; ok {
+		t.name = newName
+		delete(db.tables, oldName)
+		db.tables[newName] = t
+	}
+	return nil
+}
@@ -0,0 +1,669 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/cdc"
+	"github.com/kkumaki12/minidb/disk"
+	"github.com/kkumaki12/minidb/table"
+)
+
+// DefaultPoolSize はバッファプールのフレーム数の既定値（4MiB）
+const DefaultPoolSize = 1024
+
+// エラー定義
+var (
+	ErrClosed            = errors.New("database closed")
+	ErrTableExists       = errors.New("table already exists")
+	ErrTableNotFound     = errors.New("table not found")
+	ErrNotFound          = errors.New("row not found")
+	ErrNoStatistics      = errors.New("table has not been analyzed")
+	ErrSavepointNotFound = errors.New("savepoint not found")
+	ErrTooManyColumns    = errors.New("row has more columns than the table")
+	ErrNumColumnsUnknown = errors.New("table was created without NumColumns")
+	ErrColumnNotFound    = errors.New("column not found")
+	ErrKeyColumn         = errors.New("cannot drop a key column")
+	ErrChangeLog         = errors.New("write applied but not recorded in the change log")
+)
+
+// Tuple は行。table.Tuple と同じ
+type Tuple = table.Tuple
+
+// ScanOptions はスキャンの絞り込みと射影。table.ScanOptions と同じ
+type ScanOptions = table.ScanOptions
+
+// Options はデータベースを開くときの設定
+type Options struct {
+	// PoolSize はバッファプールのフレーム数（0なら DefaultPoolSize）
+	PoolSize int
+	// MigrateLegacy を有効にすると、ファイルヘッダーのない以前のファイル
+	// （ページ0がカタログのメタページ）を開いたときにヘッダーを加える
+	// 無効なら disk.ErrNotDatabase を返す
+	MigrateLegacy bool
+	// ChangeLog を有効にすると、書き込みで変わった行をヒープファイルとは別の変更ログ
+	// （cdc.Path のファイル）に書き足す。外部のシステムは cdc.Reader で読める
+	//
+	// 変更ログは書き込むたびに fsync するが、ヒープファイルは Flush するまでディスクに届かない。
+	// クラッシュした後は、変更ログの方がヒープファイルより先に進んでいることがある。
+	// 書き込みを適用した後に変更ログに書けなければ、その書き込みは ErrChangeLog を返し、
+	// 次に書けたときに cdc.Gap のレコードで欠けたことを示す（Subscribe にはイベントが届く）
+	ChangeLog bool
+}
+
+// DB は1つのヒープファイルに置いたテーブルの集まり
+// メソッドは複数の goroutine から呼んでよい。操作は1つずつ順に行う
+type DB struct {
+	mu      sync.Mutex
+	path    string
+	disk    *disk.DiskManager
+	bufmgr  *buffer.BufferPoolManager
+	catalog *table.SimpleTable // テーブル名 → catalogEntry
+	closed  bool
+
+	tables      map[string]*Table        // 開いたテーブル。同じ名前には同じ *Table を返す
+	changeLog   *cdc.Writer              // Options.ChangeLog が無効なら nil
+	changeGap   bool                     // 変更ログに書けなかった変更があり、まだ cdc.Gap を書いていない
+	subscribers map[string][]*subscriber // テーブル名 → Subscribe で登録した関数
+	pending     []pendingEvent           // まだ届けていないイベント
+	delivering  sync.Mutex               // イベントを届ける goroutine を1つにする
+}
+
+// Open はヒープファイルを開く。ファイルがなければ作る
+// 他のプロセスが開いていれば disk.ErrDatabaseLocked を、minidbのファイルでなければ
+// disk.ErrNotDatabase を、このバージョンで読めない形式なら disk.ErrUnsupportedFormat を返す
+func Open(path string, opts Options) (*DB, error) {
+	poolSize := opts.PoolSize
+	if poolSize <= 0 {
+		poolSize = DefaultPoolSize
+	}
+	diskMgr, err := disk.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(poolSize))
+
+	catalog, err := openCatalog(path, diskMgr, bufmgr, opts)
+	if err != nil {
+		diskMgr.Close()
+		return nil, err
+	}
+	db := &DB{path: path, disk: diskMgr, bufmgr: bufmgr, catalog: catalog}
+	if opts.ChangeLog {
+		if db.changeLog, err = cdc.OpenWriter(cdc.Path(path)); err != nil {
+			diskMgr.Close()
+			return nil, err
+		}
+	}
+	return db, nil
+}
+
+// openCatalog はファイルヘッダーを検証し、ヘッダーが指すカタログを開く
+// 新規ファイルならヘッダーとカタログを作る
+func openCatalog(path string, diskMgr *disk.DiskManager, bufmgr *buffer.BufferPoolManager, opts Options) (*table.SimpleTable, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		if pageID := diskMgr.AllocatePage(); pageID != disk.HeaderPageID {
+			return nil, fmt.Errorf("header allocated at page %d, expected %d", pageID, disk.HeaderPageID)
+		}
+		catalog, err := table.Create(bufmgr, 1)
+		if err != nil {
+			return nil, err
+		}
+		if err := diskMgr.WriteHeader(disk.NewHeader(catalog.MetaPageID)); err != nil {
+			return nil, err
+		}
+		return catalog, nil
+	}
+
+	header, err := diskMgr.ReadHeader()
+	if errors.Is(err, disk.ErrNotDatabase) && opts.MigrateLegacy {
+		header, err = migrateLegacy(diskMgr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return table.NewSimpleTable(header.CatalogPageID, 1), nil
+}
+
+// migrateLegacy はヘッダーのない以前のファイルにヘッダーを加える
+// 以前のファイルではページ0がカタログのメタページなので、それを末尾にコピーしてから
+// ページ0をヘッダーで上書きする。メタページを参照しているのはカタログの位置だけなので、
+// 移した先をヘッダーに書けば木はそのまま使える
+func migrateLegacy(diskMgr *disk.DiskManager) (disk.Header, error) {
+	page := make([]byte, disk.PageSize)
+	if err := diskMgr.ReadPageData(disk.HeaderPageID, page); err != nil {
+		return disk.Header{}, err
+	}
+	catalogPageID := diskMgr.AllocatePage()
+	if err := diskMgr.WritePageData(catalogPageID, page); err != nil {
+		return disk.Header{}, err
+	}
+	// 移した先がディスクに届いてからページ0を上書きする
+	if err := diskMgr.Sync(); err != nil {
+		return disk.Header{}, err
+	}
+	header := disk.NewHeader(catalogPageID)
+	if err := diskMgr.WriteHeader(header); err != nil {
+		return disk.Header{}, err
+	}
+	return header, diskMgr.Sync()
+}
+
+// Flush は全てのページをディスクに書き戻し、マニフェストを更新する
+func (db *DB) Flush() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	return db.flush()
+}
+
+// flush は Flush の本体。呼び出し時は db.mu を保持していること
+func (db *DB) flush() error {
+	if err := db.saveCounters(); err != nil {
+		return err
+	}
+	old, err := db.saveZoneMaps()
+	if err != nil {
+		return err
+	}
+	if err := db.bufmgr.Flush(); err != nil {
+		return err
+	}
+	// 新しく書き出したゾーンマップを記録したカタログがディスクに届いてから、古いものを戻す
+	for _, treeID := range old {
+		if err := db.freeTree(treeID); err != nil {
+			return err
+		}
+	}
+	return db.disk.UpdateManifest()
+}
+
+// Close は全てのページを書き戻してからファイルを閉じる
+// 閉じた後の操作は ErrClosed を返す
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+	if db.changeLog != nil {
+		if db.changeGap {
+			// 欠けた変更があったことを、次に開いて書き込むのを待たずに残す
+			db.changeLog.Append([]*cdc.Record{{Kind: cdc.Gap}})
+		}
+		db.changeLog.Close()
+	}
+	if err := db.flush(); err != nil {
+		db.disk.Close()
+		return err
+	}
+	return db.disk.Close()
+}
+
+// TableOptions はテーブルを作るときの設定
+// 設定はカタログに記録され、Table で開くときに引き継がれる
+type TableOptions struct {
+	// SoftDelete は table.Options.SoftDelete と同じ
+	SoftDelete bool
+	// SecureDelete は table.Options.SecureDelete と同じ
+	SecureDelete bool
+	// Expiry と ExpiryColumn は table.Options の同じ名前のフィールドと同じ
+	// 期限が過ぎた行は読めなくなり、PurgeExpired で削除される
+	Expiry       bool
+	ExpiryColumn int
+	// NotNull は table.Options.NotNull と同じ。挿入・置き換えた行の列が NULL（列がないか nil）なら
+	// table.ErrNullValue をラップした *table.ConstraintError を返す
+	NotNull []int
+	// Defaults と AutoIncrement は table.Options の同じ名前のフィールドと同じ
+	// 既定値は列ごとに 65535 バイトまで記録できる
+	Defaults      map[int][]byte
+	AutoIncrement bool
+	// NumColumns は行の列数（キーの列を含む）。AddColumn と DropColumn を使うテーブルでは
+	// 指定すること。指定したテーブルでは、これより多い列の行を書き込むと ErrTooManyColumns を返す
+	NumColumns int
+}
+
+// catalogEntry はカタログに記録するテーブルの情報
+//
+// カタログ自体も1列のキー（テーブル名）を持つテーブルで、値の1列目は次の形:
+// [meta_page_id: 8] [num_key_elems: 2] [flags: 2] [expiry_column: 2]
+// [num_not_null: 2] [not_null_column: 2]... [num_defaults: 2] ([column: 2] [len: 2] [value])...
+// [num_columns: 2] [schema_version: 2] [stored_width: 2] [num_mapped: 2] [stored_column: 2]...
+// 以前のバージョンで作ったエントリには expiry_column がない
+// 後ろの部分は、それより後ろに書くものがなければ省く（NOT NULL の列も既定値も列数もなければ
+// num_not_null から後ろを書かない）。まだ ALTER していなければ num_mapped は0になる
+// Table.Analyze を実行したテーブルでは、値の2列目に table.Statistics.Encode の結果を置く
+// 値の3列目はメタデータ（Table.SetMetadata）で、その前の統計の列は Analyze するまで空になる
+// 値の4列目は行数と大きさ（Table.Stats）で、Flush と Close で書き換える
+// 値の5列目はゾーンマップ（Table.EnableZoneMap）の列と、範囲を書き出したB-treeのメタページ
+type catalogEntry struct {
+	metaPageID    disk.PageID
+	numKeyElems   int
+	softDelete    bool
+	expiry        bool
+	autoIncrement bool
+	expiryColumn  int
+	notNull       []int
+	defaults      map[int][]byte
+
+	numColumns    int   // TableOptions.NumColumns。ALTER すると変わる
+	schemaVersion int   // ALTER のたびに1つ増える
+	storedWidth   int   // 格納した行の列数（DropColumn した列も含む）
+	columns       []int // 列 → 格納した行での位置。まだ ALTER していなければ nil
+}
+
+const (
+	catalogFlagSoftDelete    = 1 << 0
+	catalogFlagExpiry        = 1 << 1
+	catalogFlagAutoIncrement = 1 << 2
+)
+
+func (e catalogEntry) encode() []byte {
+	b := make([]byte, 14)
+	binary.BigEndian.PutUint64(b[0:8], uint64(e.metaPageID))
+	binary.BigEndian.PutUint16(b[8:10], uint16(e.numKeyElems))
+	var flags uint16
+	if e.softDelete {
+		flags |= catalogFlagSoftDelete
+	}
+	if e.expiry {
+		flags |= catalogFlagExpiry
+	}
+	if e.autoIncrement {
+		flags |= catalogFlagAutoIncrement
+	}
+	binary.BigEndian.PutUint16(b[10:12], flags)
+	binary.BigEndian.PutUint16(b[12:14], uint16(e.expiryColumn))
+	hasSchema := e.numColumns > 0 || e.columns != nil
+	if len(e.notNull) == 0 && len(e.defaults) == 0 && !hasSchema {
+		return b
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.notNull)))
+	for _, col := range e.notNull {
+		b = binary.BigEndian.AppendUint16(b, uint16(col))
+	}
+	if len(e.defaults) == 0 && !hasSchema {
+		return b
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.defaults)))
+	columns := make([]int, 0, len(e.defaults))
+	for col := range e.defaults {
+		columns = append(columns, col)
+	}
+	slices.Sort(columns)
+	for _, col := range columns {
+		b = binary.BigEndian.AppendUint16(b, uint16(col))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(e.defaults[col])))
+		b = append(b, e.defaults[col]...)
+	}
+	if !hasSchema {
+		return b
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(e.numColumns))
+	b = binary.BigEndian.AppendUint16(b, uint16(e.schemaVersion))
+	b = binary.BigEndian.AppendUint16(b, uint16(e.storedWidth))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(e.columns)))
+	for _, col := range e.columns {
+		b = binary.BigEndian.AppendUint16(b, uint16(col))
+	}
+	return b
+}
+
+func decodeCatalogEntry(b []byte) (catalogEntry, error) {
+	if len(b) < 12 {
+		return catalogEntry{}, fmt.Errorf("catalog entry has %d bytes, expected at least 12", len(b))
+	}
+	flags := binary.BigEndian.Uint16(b[10:12])
+	entry := catalogEntry{
+		metaPageID:    disk.PageID(binary.BigEndian.Uint64(b[0:8])),
+		numKeyElems:   int(binary.BigEndian.Uint16(b[8:10])),
+		softDelete:    flags&catalogFlagSoftDelete != 0,
+		expiry:        flags&catalogFlagExpiry != 0,
+		autoIncrement: flags&catalogFlagAutoIncrement != 0,
+	}
+	rest := b[12:]
+	// next は rest の先頭から n バイトを切り出す。足りなければ nil を返す
+	next := func(n int) []byte {
+		if len(rest) < n {
+			return nil
+		}
+		v := rest[:n]
+		rest = rest[n:]
+		return v
+	}
+	truncated := func() (catalogEntry, error) {
+		return catalogEntry{}, fmt.Errorf("catalog entry of %d bytes is truncated", len(b))
+	}
+	if len(rest) == 0 {
+		return entry, nil
+	}
+	v := next(2)
+	if v == nil {
+		return truncated()
+	}
+	entry.expiryColumn = int(binary.BigEndian.Uint16(v))
+	if len(rest) == 0 {
+		return entry, nil
+	}
+
+	v = next(2)
+	if v == nil {
+		return truncated()
+	}
+	for n := int(binary.BigEndian.Uint16(v)); n > 0; n-- {
+		col := next(2)
+		if col == nil {
+			return truncated()
+		}
+		entry.notNull = append(entry.notNull, int(binary.BigEndian.Uint16(col)))
+	}
+	if len(rest) == 0 {
+		return entry, nil
+	}
+
+	v = next(2)
+	if v == nil {
+		return truncated()
+	}
+	entry.defaults = make(map[int][]byte)
+	for n := int(binary.BigEndian.Uint16(v)); n > 0; n-- {
+		header := next(4)
+		if header == nil {
+			return truncated()
+		}
+		value := next(int(binary.BigEndian.Uint16(header[2:4])))
+		if value == nil {
+			return truncated()
+		}
+		entry.defaults[int(binary.BigEndian.Uint16(header[0:2]))] = bytes.Clone(value)
+	}
+	if len(rest) == 0 {
+		return entry, nil
+	}
+
+	v = next(8)
+	if v == nil {
+		return truncated()
+	}
+	entry.numColumns = int(binary.BigEndian.Uint16(v[0:2]))
+	entry.schemaVersion = int(binary.BigEndian.Uint16(v[2:4]))
+	entry.storedWidth = int(binary.BigEndian.Uint16(v[4:6]))
+	if n := int(binary.BigEndian.Uint16(v[6:8])); n > 0 {
+		entry.columns = make([]int, 0, n)
+		for ; n > 0; n-- {
+			col := next(2)
+			if col == nil {
+				return truncated()
+			}
+			entry.columns = append(entry.columns, int(binary.BigEndian.Uint16(col)))
+		}
+	}
+	if len(rest) != 0 {
+		return catalogEntry{}, fmt.Errorf("catalog entry has %d trailing bytes", len(rest))
+	}
+	return entry, nil
+}
+
+// open はエントリが指すテーブルを、記録された設定で開く
+func (e catalogEntry) open() *table.SimpleTable {
+	return table.NewSimpleTableWithOptions(e.metaPageID, e.numKeyElems, table.Options{
+		SoftDelete:   e.softDelete,
+		Expiry:       e.expiry,
+		ExpiryColumn: e.expiryColumn,
+		NotNull:      e.notNull,
+
+		Defaults:      e.defaults,
+		AutoIncrement: e.autoIncrement,
+	})
+}
+
+// lookupTable はカタログからテーブルの情報を探す
+// 呼び出し時は db.mu を保持していること
+func (db *DB) lookupTable(name string) (catalogEntry, bool, error) {
+	row, found, err := get(db.bufmgr, db.catalog, Tuple{[]byte(name)})
+	if err != nil || !found {
+		return catalogEntry{}, false, err
+	}
+	if len(row) < 2 {
+		return catalogEntry{}, false, fmt.Errorf("catalog row for %q has %d columns", name, len(row))
+	}
+	entry, err := decodeCatalogEntry(row[1])
+	return entry, err == nil, err
+}
+
+// CreateTable はテーブルを作り、カタログに記録する
+// 同じ名前のテーブルがあれば ErrTableExists を返す
+func (db *DB) CreateTable(name string, numKeyElems int, opts TableOptions) (*Table, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if _, found, err := db.lookupTable(name); err != nil {
+		return nil, err
+	} else if found {
+		return nil, fmt.Errorf("%w: %s", ErrTableExists, name)
+	}
+
+	tbl, err := table.CreateWithOptions(db.bufmgr, numKeyElems, table.Options{
+		SoftDelete:   opts.SoftDelete,
+		SecureDelete: opts.SecureDelete,
+		Expiry:       opts.Expiry,
+		ExpiryColumn: opts.ExpiryColumn,
+		NotNull:      opts.NotNull,
+
+		Defaults:      opts.Defaults,
+		AutoIncrement: opts.AutoIncrement,
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry := catalogEntry{
+		metaPageID:   tbl.MetaPageID,
+		numKeyElems:  numKeyElems,
+		softDelete:   opts.SoftDelete,
+		expiry:       opts.Expiry,
+		expiryColumn: opts.ExpiryColumn,
+		notNull:      opts.NotNull,
+
+		defaults:      opts.Defaults,
+		autoIncrement: opts.AutoIncrement,
+		numColumns:    opts.NumColumns,
+	}
+	counters := &tableCounters{}
+	row := Tuple{[]byte(name), entry.encode(), nil, createdMetadata(), counters.encode(false)}
+	if err := db.catalog.Insert(db.bufmgr, row); err != nil {
+		return nil, err
+	}
+	return db.cacheTable(name, tbl, entry, counters), nil
+}
+
+// cacheTable は開いたテーブルを覚えておき、*Table を返す
+// 呼び出し時は db.mu を保持していること
+func (db *DB) cacheTable(name string, tbl *table.SimpleTable, entry catalogEntry, counters *tableCounters) *Table {
+	if db.tables == nil {
+		db.tables = make(map[string]*Table)
+	}
+	t := &Table{db: db, name: name, tbl: tbl, schema: entry.schema(), counters: counters}
+	db.tables[name] = t
+	return t
+}
+
+// openTable は開いたテーブルを返す。まだ開いていなければカタログから開く
+// テーブルがなければ ErrTableNotFound を返す。呼び出し時は db.mu を保持していること
+func (db *DB) openTable(name string) (*Table, error) {
+	if t, ok := db.tables[name]; ok {
+		return t, nil
+	}
+	row, found, err := get(db.bufmgr, db.catalog, Tuple{[]byte(name)})
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	if len(row) < 2 {
+		return nil, fmt.Errorf("catalog row for %q has %d columns", name, len(row))
+	}
+	entry, err := decodeCatalogEntry(row[1])
+	if err != nil {
+		return nil, err
+	}
+	counters, err := catalogCounters(row)
+	if err != nil {
+		return nil, err
+	}
+	zones, err := catalogZoneMap(row)
+	if err != nil {
+		return nil, err
+	}
+	t := db.cacheTable(name, entry.open(), entry, counters)
+	if counters != nil && counters.stale {
+		// 前に開いていたときに、書き込んだ後の数を記録する前に終わった
+		if err := t.recount(); err != nil {
+			delete(db.tables, name)
+			return nil, err
+		}
+	}
+	if zones != nil {
+		if err := t.loadZoneMap(zones); err != nil {
+			delete(db.tables, name)
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// Table はカタログに記録されたテーブルを開く
+// 同じ名前には同じ *Table を返すので、AddColumn などで変えた列はどの値からも見える
+// テーブルがなければ ErrTableNotFound を返す
+func (db *DB) Table(name string) (*Table, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return db.openTable(name)
+}
+
+// DropTable はテーブルをカタログから消し、テーブルのB-treeの全てのページを空きページに戻す
+// 開いていた Table と、そのテーブルのスキャンの Rows は ErrTableNotFound を返すようになる
+// （スキャン中の Rows がピンしているページは、次の Vacuum で回収する）
+// 消した行のイベントは届かない。テーブルがなければ ErrTableNotFound を返す
+func (db *DB) DropTable(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	entry, found, err := db.lookupTable(name)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	tbl := entry.open()
+	pageIDs, err := tbl.Pages(db.bufmgr)
+	if err != nil {
+		return err
+	}
+	// ゾーンマップを書き出したB-treeのページも戻す
+	row, _, err := get(db.bufmgr, db.catalog, Tuple{[]byte(name)})
+	if err != nil {
+		return err
+	}
+	zones, err := catalogZoneMap(row)
+	if err != nil {
+		return err
+	}
+	if zones != nil {
+		treePageIDs, err := db.treePages(zones.treeID)
+		if err != nil {
+			return err
+		}
+		pageIDs = append(pageIDs, treePageIDs...)
+	}
+	if err := db.catalog.Delete(db.bufmgr, Tuple{[]byte(name)}); err != nil {
+		return err
+	}
+	if t, ok := db.tables[name]; ok {
+		t.dropped = true
+		delete(db.tables, name)
+	}
+	// カタログから消した後はどこからも参照されないので、解放に失敗したページも Vacuum で回収できる
+	for _, pageID := range pageIDs {
+		if err := db.bufmgr.FreePage(pageID); err != nil && !errors.Is(err, buffer.ErrPagePinned) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate はテーブルの全ての行を消す（table.SimpleTable.Truncate）
+// テーブルの設定・列・統計はそのまま残り、開いていた Table も使い続けられる
+// 消した行のイベントは届かない。テーブルがなければ ErrTableNotFound を返す
+func (db *DB) Truncate(name string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	t, err := db.openTable(name)
+	if err != nil {
+		return err
+	}
+	if err := t.markStale(); err != nil {
+		return err
+	}
+	if err := t.tbl.Truncate(db.bufmgr); err != nil {
+		return err
+	}
+	t.counters = &tableCounters{dirty: true}
+	return nil
+}
+
+// Update は fn の中で積んだ書き込みを、fn が nil を返したときにまとめて適用する
+// 全ての書き込みが適用されるか、1つも適用されないかのどちらかになる
+// fn がエラーを返した場合は何も適用せずにそのエラーを返す
+// 積めなかった書き込み（列の多すぎる行など）があれば、何も適用せずに最初のエラーを返す
+func (db *DB) Update(fn func(tx *Tx) error) error {
+	tx := &Tx{db: db}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if tx.err != nil {
+		return tx.err
+	}
+	defer db.deliver()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	batch, rows, err := tx.batch()
+	if err != nil {
+		return err
+	}
+	changes, err := db.watch(rows)
+	if err != nil {
+		return err
+	}
+	if err := batch.Apply(db.bufmgr); err != nil {
+		return err
+	}
+	return changes.publish()
+}
@@ -0,0 +1,1725 @@
+package minidb
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/cdc"
+	"github.com/kkumaki12/minidb/disk"
+	"github.com/kkumaki12/minidb/table"
+)
+
+func TestOpenCreateTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+
+	users, err := db.CreateTable("users", 1, TableOptions{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := db.CreateTable("users", 1, TableOptions{}); !errors.Is(err, ErrTableExists) {
+		t.Errorf("expected ErrTableExists, got %v", err)
+	}
+	for _, name := range []string{"1", "2", "3"} {
+		if err := users.Insert(Tuple{[]byte(name), []byte("user" + name)}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := users.Delete(Tuple{[]byte("2")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+	if _, err := users.Get(Tuple{[]byte("1")}); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected ErrClosed, got %v", err)
+	}
+
+	// 開き直してもカタログから設定ごと開ける
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Table("nosuch"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound, got %v", err)
+	}
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	row, err := users.Get(Tuple{[]byte("3")})
+	if err != nil || string(row[1]) != "user3" {
+		t.Errorf("expected user3, got %q %v", row, err)
+	}
+	// 削除済みの印が付いた行は返さない
+	if _, err := users.Get(Tuple{[]byte("2")}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if n, err := users.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 rows, got %d %v", n, err)
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	err = db.Update(func(tx *Tx) error {
+		tx.Insert(users, Tuple{[]byte("1"), []byte("Alice")})
+		tx.Insert(users, Tuple{[]byte("2"), []byte("Bob")})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+
+	// 途中で失敗したら何も適用しない
+	err = db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("3"), []byte("Carol")})
+		tx.Insert(users, Tuple{[]byte("1"), []byte("Dave")})
+		return nil
+	})
+	if err == nil {
+		t.Fatal("expected a duplicate key error")
+	}
+	cause := errors.New("abort")
+	if err := db.Update(func(tx *Tx) error {
+		tx.Delete(users, Tuple{[]byte("1")})
+		return cause
+	}); err != cause {
+		t.Errorf("expected the error from fn, got %v", err)
+	}
+
+	rows, err := users.Scan(ScanOptions{Columns: []int{1}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	defer rows.Close()
+	var names []string
+	for {
+		row, err := rows.Next()
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		names = append(names, string(row[0]))
+	}
+	if len(names) != 2 || names[0] != "Alice" || names[1] != "Bob" {
+		t.Errorf("expected [Alice Bob], got %v", names)
+	}
+}
+
+func TestBackup(t *testing.T) {
+	dir := t.TempDir()
+	db, err := Open(filepath.Join(dir, "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("%05d", i)), []byte("before")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	backupPath := filepath.Join(dir, "backup.db")
+	if err := db.BackupFile(backupPath); err != nil {
+		t.Fatalf("failed to back up: %v", err)
+	}
+	// バックアップの後の書き込みはコピーに入らない
+	if err := users.Insert(Tuple{[]byte("after"), []byte("after")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := disk.VerifyManifest(disk.ManifestPath(backupPath)); err != nil {
+		t.Errorf("expected a matching manifest, got %v", err)
+	}
+
+	backup, err := Open(backupPath, Options{})
+	if err != nil {
+		t.Fatalf("failed to open backup: %v", err)
+	}
+	defer backup.Close()
+	backupUsers, err := backup.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if n, err := backupUsers.Count(); err != nil || n != 500 {
+		t.Errorf("expected 500 rows, got %d %v", n, err)
+	}
+	if _, err := backupUsers.Get(Tuple{[]byte("after")}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestOpenHeader(t *testing.T) {
+	dir := t.TempDir()
+
+	// minidbのファイルでなければ開かない
+	randomPath := filepath.Join(dir, "random.db")
+	if err := os.WriteFile(randomPath, bytes.Repeat([]byte("x"), disk.PageSize), 0644); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	if _, err := Open(randomPath, Options{}); !errors.Is(err, disk.ErrNotDatabase) {
+		t.Errorf("expected ErrNotDatabase, got %v", err)
+	}
+
+	// ヘッダーのない以前のファイル（ページ0がカタログ）を作る
+	legacyPath := filepath.Join(dir, "legacy.db")
+	diskMgr, err := disk.Open(legacyPath)
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(16))
+	catalog, err := table.Create(bufmgr, 1)
+	if err != nil || catalog.MetaPageID != 0 {
+		t.Fatalf("failed to create catalog at page 0: %v", err)
+	}
+	users, err := table.Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	entry := catalogEntry{metaPageID: users.MetaPageID, numKeyElems: 1}
+	if err := catalog.Insert(bufmgr, Tuple{[]byte("users"), entry.encode()}); err != nil {
+		t.Fatalf("failed to insert catalog entry: %v", err)
+	}
+	if err := users.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	diskMgr.Close()
+
+	if _, err := Open(legacyPath, Options{}); !errors.Is(err, disk.ErrNotDatabase) {
+		t.Errorf("expected ErrNotDatabase without migration, got %v", err)
+	}
+	db, err := Open(legacyPath, Options{MigrateLegacy: true})
+	if err != nil {
+		t.Fatalf("failed to migrate: %v", err)
+	}
+	tbl, err := db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if row, err := tbl.Get(Tuple{[]byte("1")}); err != nil || string(row[1]) != "Alice" {
+		t.Errorf("expected Alice, got %q %v", row, err)
+	}
+	db.Close()
+
+	// 移行した後はヘッダーがあるので、そのまま開ける
+	db, err = Open(legacyPath, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	if _, err := db.Table("users"); err != nil {
+		t.Errorf("failed to open table after migration: %v", err)
+	}
+}
+
+func TestVacuum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	logs, err := db.CreateTable("logs", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("user%03d", i)), []byte("name")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	key := func(i int) []byte { return []byte(fmt.Sprintf("log%05d", i)) }
+	n := 3000
+	for i := 0; i < n; i++ {
+		if err := logs.Insert(Tuple{key(i), bytes.Repeat([]byte{byte(i)}, 200)}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	// 3行に2行を消しても、残った行がページに散らばるので併合では縮まない
+	for i := 0; i < n; i++ {
+		if i%3 == 0 {
+			continue
+		}
+		if err := logs.Delete(Tuple{key(i)}); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := info.Size()
+
+	// スキャンの途中で Vacuum しても、続きから読める
+	rows, err := users.Scan(ScanOptions{})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if row, err := rows.Next(); err != nil || string(row[0]) != "user000" {
+		t.Fatalf("expected user000, got %q %v", row, err)
+	}
+	if err := db.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+	for i := 1; i < 50; i++ {
+		row, err := rows.Next()
+		if want := fmt.Sprintf("user%03d", i); err != nil || row == nil || string(row[0]) != want {
+			t.Fatalf("expected %s, got %q %v", want, row, err)
+		}
+	}
+	rows.Close()
+
+	info, err = os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size()*2 > before {
+		t.Errorf("expected the file to shrink to half, got %d -> %d bytes", before, info.Size())
+	}
+	if err := disk.VerifyManifest(disk.ManifestPath(path)); err != nil {
+		t.Errorf("manifest is stale after vacuum: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 開き直しても残した行は全て読め、縮めたファイルに書き足せる
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	logs, err = db.Table("logs")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if count, err := logs.Count(); err != nil || count != n/3 {
+		t.Errorf("expected %d rows, got %d %v", n/3, count, err)
+	}
+	for i := 0; i < n; i += 3 {
+		row, err := logs.Get(Tuple{key(i)})
+		if err != nil || !bytes.Equal(row[1], bytes.Repeat([]byte{byte(i)}, 200)) {
+			t.Fatalf("failed to get %s: %q %v", key(i), row, err)
+		}
+	}
+	for i := 1; i < n; i += 3 {
+		if err := logs.Insert(Tuple{key(i), []byte("again")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := db.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum again: %v", err)
+	}
+	if count, err := logs.Count(); err != nil || count != 2*n/3 {
+		t.Errorf("expected %d rows, got %d %v", 2*n/3, count, err)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 1000; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("%04d", i)), []byte(fmt.Sprintf("city%d", i%4))}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if _, err := users.Statistics(); !errors.Is(err, ErrNoStatistics) {
+		t.Errorf("expected ErrNoStatistics, got %v", err)
+	}
+	stats, err := users.Analyze(AnalyzeOptions{})
+	if err != nil {
+		t.Fatalf("failed to analyze: %v", err)
+	}
+	if stats.Rows != 1000 || stats.Columns[1].Distinct != 4 {
+		t.Errorf("unexpected statistics: rows=%d distinct=%d", stats.Rows, stats.Columns[1].Distinct)
+	}
+	// 統計を書いたカタログでも、テーブルの設定と Vacuum はそのまま使える
+	if err := db.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	stored, err := users.Statistics()
+	if err != nil {
+		t.Fatalf("failed to read statistics: %v", err)
+	}
+	if stored.Rows != stats.Rows || stored.EstimateRows(1, []byte("city2"), []byte("city2")) != 250 {
+		t.Errorf("unexpected stored statistics: %+v", stored)
+	}
+	if err := users.Delete(Tuple{[]byte("0000")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, err := users.Get(Tuple{[]byte("0000")}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected soft delete to be kept, got %v", err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 25; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("%03d", i)), []byte("user")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// 1ページ目を読んでトークンだけを残す
+	rows, err := users.Scan(ScanOptions{Columns: []int{0}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if row, err := rows.Next(); err != nil || row == nil {
+			t.Fatalf("failed to get next: %q %v", row, err)
+		}
+	}
+	rows.Close()
+	token := rows.Token()
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 開き直した後でも続きから読める
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	rows, err = users.Resume(token, ScanOptions{Columns: []int{0}})
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	defer rows.Close()
+	var keys []string
+	for {
+		row, err := rows.Next()
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		keys = append(keys, string(row[0]))
+	}
+	if len(keys) != 15 || keys[0] != "010" || keys[14] != "024" {
+		t.Errorf("unexpected rows after resume: %v", keys)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	sessions, err := db.CreateTable("sessions", 1, TableOptions{Expiry: true, ExpiryColumn: 2})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		// 偶数の行は挿入した時点で期限が切れている
+		ttl := time.Hour
+		if i%2 == 0 {
+			ttl = -time.Second
+		}
+		if err := sessions.InsertWithTTL(Tuple{[]byte(fmt.Sprintf("s%d", i)), []byte("data")}, ttl); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := users.InsertWithTTL(Tuple{[]byte("1")}, time.Hour); !errors.Is(err, table.ErrExpiryDisabled) {
+		t.Errorf("expected ErrExpiryDisabled, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 開き直しても有効期限の設定はカタログから引き継がれる
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	sessions, err = db.Table("sessions")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if _, err := sessions.Get(Tuple{[]byte("s0")}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected expired row to be hidden, got %v", err)
+	}
+	if _, err := sessions.Get(Tuple{[]byte("s1")}); err != nil {
+		t.Errorf("failed to get live row: %v", err)
+	}
+	if n, err := sessions.Count(); err != nil || n != 5 {
+		t.Errorf("expected 5 rows, got %d %v", n, err)
+	}
+	if n, err := db.PurgeExpired(); err != nil || n != 5 {
+		t.Errorf("expected 5 purged rows, got %d %v", n, err)
+	}
+	if n, err := sessions.PurgeExpired(); err != nil || n != 0 {
+		t.Errorf("expected nothing left to purge, got %d %v", n, err)
+	}
+}
+
+func TestUpsertInsertIgnore(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	// 同じデータを何度読み込んでもエラーにならない
+	for i := 0; i < 2; i++ {
+		if err := users.Upsert(Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+		err = db.Update(func(tx *Tx) error {
+			tx.InsertIgnore(users, Tuple{[]byte("2"), []byte("Bob")})
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to update: %v", err)
+		}
+	}
+	if err := users.Upsert(Tuple{[]byte("1"), []byte("Alicia")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	if inserted, err := users.InsertIgnore(Tuple{[]byte("2"), []byte("Robert")}); err != nil || inserted {
+		t.Errorf("expected existing row to be kept, got %v %v", inserted, err)
+	}
+	for key, want := range map[string]string{"1": "Alicia", "2": "Bob"} {
+		if row, err := users.Get(Tuple{[]byte(key)}); err != nil || string(row[1]) != want {
+			t.Errorf("expected %s, got %q %v", want, row, err)
+		}
+	}
+	if n, err := users.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 rows, got %d %v", n, err)
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	var got []string
+	unsubscribe := db.Subscribe("users", func(ev ChangeEvent) {
+		got = append(got, fmt.Sprintf("%s %s %q %q", ev.Kind, ev.Key[0], ev.Old, ev.New))
+		// 購読者の中から書き込んでも止まらない
+		if ev.Kind == ChangeDelete {
+			if err := users.Insert(Tuple{[]byte("9"), []byte("Zed")}); err != nil {
+				t.Errorf("failed to insert from subscriber: %v", err)
+			}
+		}
+	})
+
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice")}); err == nil {
+		t.Fatalf("expected duplicate insert to fail")
+	}
+	if err := users.Upsert(Tuple{[]byte("1"), []byte("Alicia")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	if _, err := users.InsertIgnore(Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		tx.Insert(users, Tuple{[]byte("2"), []byte("Bob")})
+		tx.Put(users, Tuple{[]byte("2"), []byte("Robert")})
+		tx.Put(users, Tuple{[]byte("3"), []byte("Carol")})
+		tx.Delete(users, Tuple{[]byte("3")})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if err := users.Delete(Tuple{[]byte("1")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	want := []string{
+		`insert 1 [] ["1" "Alice"]`,
+		`update 1 ["1" "Alice"] ["1" "Alicia"]`,
+		`insert 2 [] ["2" "Robert"]`,
+		`delete 1 ["1" "Alicia"] []`,
+		`insert 9 [] ["9" "Zed"]`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected events:\n got %q\nwant %q", got, want)
+	}
+
+	unsubscribe()
+	if err := users.Insert(Tuple{[]byte("4"), []byte("Dave")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected no events after unsubscribe, got %q", got[len(want):])
+	}
+}
+
+func TestChangeLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("1"), []byte("Alicia")})
+		tx.Insert(users, Tuple{[]byte("2"), []byte("Bob")})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	reader, err := cdc.OpenReader(cdc.Path(path), 0)
+	if err != nil {
+		t.Fatalf("failed to open change log: %v", err)
+	}
+	defer reader.Close()
+	readAll := func() []string {
+		var got []string
+		for {
+			record, err := reader.Next()
+			if err != nil {
+				t.Fatalf("failed to read change log: %v", err)
+			}
+			if record == nil {
+				return got
+			}
+			got = append(got, fmt.Sprintf("%s %s %s %q %q", record.Table, record.Kind, record.Key[0], record.Old, record.New))
+		}
+	}
+	want := []string{
+		`users insert 1 [] ["1" "Alice"]`,
+		`users update 1 ["1" "Alice"] ["1" "Alicia"]`,
+		`users insert 2 [] ["2" "Bob"]`,
+	}
+	if got := readAll(); !slices.Equal(got, want) {
+		t.Errorf("unexpected records:\n got %q\nwant %q", got, want)
+	}
+
+	// 開き直した後の変更は続きに書かれる
+	db, err = Open(path, Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if err := users.Delete(Tuple{[]byte("2")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	want = []string{`users delete 2 ["2" "Bob"] []`}
+	if got := readAll(); !slices.Equal(got, want) {
+		t.Errorf("unexpected records:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestChangeLogGap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{ChangeLog: true})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	var events []string
+	unsubscribe := db.Subscribe("users", func(ev ChangeEvent) {
+		events = append(events, fmt.Sprintf("%s %s", ev.Kind, ev.Key[0]))
+	})
+	defer unsubscribe()
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	// 変更ログに書けなくても書き込みは適用済みなので、ErrChangeLog で知らせる
+	db.changeLog.Close()
+	if err := users.Insert(Tuple{[]byte("2"), []byte("Bob")}); !errors.Is(err, ErrChangeLog) {
+		t.Fatalf("expected ErrChangeLog, got %v", err)
+	}
+	if _, err := users.Get(Tuple{[]byte("2")}); err != nil {
+		t.Errorf("expected the row to be applied, got %v", err)
+	}
+
+	// 次に書けたときに、欠けた変更があることを示す Gap を先に書く
+	if db.changeLog, err = cdc.OpenWriter(cdc.Path(path)); err != nil {
+		t.Fatalf("failed to reopen change log: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("3"), []byte("Carol")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("4"), []byte("Dave")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	reader, err := cdc.OpenReader(cdc.Path(path), 0)
+	if err != nil {
+		t.Fatalf("failed to open change log: %v", err)
+	}
+	defer reader.Close()
+	var got []string
+	for {
+		record, err := reader.Next()
+		if err != nil {
+			t.Fatalf("failed to read change log: %v", err)
+		}
+		if record == nil {
+			break
+		}
+		if record.Kind == cdc.Gap {
+			got = append(got, "gap")
+			continue
+		}
+		got = append(got, fmt.Sprintf("%s %s", record.Kind, record.Key[0]))
+	}
+	if want := []string{"insert 1", "gap", "insert 3", "insert 4"}; !slices.Equal(got, want) {
+		t.Errorf("unexpected records:\n got %q\nwant %q", got, want)
+	}
+	// 購読者には適用した書き込みのイベントが全て届く
+	if want := []string{"insert 1", "insert 2", "insert 3", "insert 4"}; !slices.Equal(events, want) {
+		t.Errorf("unexpected events:\n got %q\nwant %q", events, want)
+	}
+}
+
+func TestSavepoint(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	// 読み込みに失敗したチャンクだけを捨てる
+	chunks := [][]string{{"1", "2"}, {"3", ""}, {"4"}}
+	err = db.Update(func(tx *Tx) error {
+		for _, chunk := range chunks {
+			tx.Savepoint("chunk")
+			for _, key := range chunk {
+				if key == "" {
+					if err := tx.RollbackTo("chunk"); err != nil {
+						return err
+					}
+					break
+				}
+				tx.Insert(users, Tuple{[]byte(key), []byte("v")})
+			}
+		}
+		if err := tx.RollbackTo("missing"); !errors.Is(err, ErrSavepointNotFound) {
+			t.Errorf("expected ErrSavepointNotFound, got %v", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	for key, want := range map[string]bool{"1": true, "2": true, "3": false, "4": true} {
+		if _, err := users.Get(Tuple{[]byte(key)}); (err == nil) != want {
+			t.Errorf("expected key %s present=%v, got %v", key, want, err)
+		}
+	}
+
+	// 戻った先より後に作ったセーブポイントは消える
+	err = db.Update(func(tx *Tx) error {
+		tx.Savepoint("a")
+		tx.Put(users, Tuple{[]byte("5"), []byte("v")})
+		tx.Savepoint("b")
+		tx.Put(users, Tuple{[]byte("6"), []byte("v")})
+		if err := tx.RollbackTo("a"); err != nil {
+			return err
+		}
+		if err := tx.RollbackTo("b"); !errors.Is(err, ErrSavepointNotFound) {
+			t.Errorf("expected ErrSavepointNotFound, got %v", err)
+		}
+		tx.Put(users, Tuple{[]byte("7"), []byte("v")})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if n, err := users.Count(); err != nil || n != 4 {
+		t.Errorf("expected 4 rows, got %d %v", n, err)
+	}
+
+	// 積めなかった書き込みのエラーも、セーブポイントに戻れば忘れる
+	pairs, err := db.CreateTable("pairs", 1, TableOptions{NumColumns: 2})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		tx.Put(pairs, Tuple{[]byte("1"), []byte("v")})
+		tx.Savepoint("row")
+		tx.Put(pairs, Tuple{[]byte("2"), []byte("v"), []byte("extra")})
+		if err := tx.RollbackTo("row"); err != nil {
+			return err
+		}
+		tx.Put(pairs, Tuple{[]byte("3"), []byte("v")})
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected the rolled back error to be forgotten, got %v", err)
+	}
+	if n, err := pairs.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 rows, got %d %v", n, err)
+	}
+
+	// セーブポイントより前のエラーは残る
+	err = db.Update(func(tx *Tx) error {
+		tx.Put(pairs, Tuple{[]byte("4"), []byte("v"), []byte("extra")})
+		tx.Savepoint("row")
+		tx.Put(pairs, Tuple{[]byte("5"), []byte("v")})
+		return tx.RollbackTo("row")
+	})
+	if !errors.Is(err, ErrTooManyColumns) {
+		t.Errorf("expected ErrTooManyColumns, got %v", err)
+	}
+	if n, err := pairs.Count(); err != nil || n != 2 {
+		t.Errorf("expected 2 rows, got %d %v", n, err)
+	}
+}
+
+func TestNotNull(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	if _, err := db.CreateTable("users", 1, TableOptions{NotNull: []int{1, 2}}); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 制約はカタログに記録され、開き直しても効く
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err := db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice"), []byte("25")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	var cerr *table.ConstraintError
+	err = users.Insert(Tuple{[]byte("2"), []byte("Bob")})
+	if !errors.As(err, &cerr) || !errors.Is(err, table.ErrNullValue) || fmt.Sprint(cerr.Columns) != "[2]" {
+		t.Errorf("expected not null violation on column 2, got %v", err)
+	}
+	err = db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("1"), nil, []byte("26")})
+		return nil
+	})
+	if !errors.Is(err, table.ErrNullValue) {
+		t.Errorf("expected not null violation in update, got %v", err)
+	}
+	if n, err := users.Count(); err != nil || n != 1 {
+		t.Errorf("expected 1 row, got %d %v", n, err)
+	}
+}
+
+func TestAutoIncrement(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{
+		AutoIncrement: true,
+		Defaults:      map[int][]byte{2: []byte("member")},
+	})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	var keys []uint64
+	db.Subscribe("users", func(ev ChangeEvent) {
+		id, _ := table.DecodeSequence(ev.Key[0])
+		keys = append(keys, id)
+	})
+	row, err := users.InsertReturning(Tuple{nil, []byte("Alice")})
+	if err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if id, _ := table.DecodeSequence(row[0]); id != 1 || string(row[2]) != "member" {
+		t.Errorf("unexpected returned row: %q", row)
+	}
+	if err := users.Upsert(Tuple{nil, []byte("Bob"), []byte("admin")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 連番と既定値は開き直しても引き継がれる
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	row, err = users.InsertReturning(Tuple{nil, []byte("Carol")})
+	if err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if id, _ := table.DecodeSequence(row[0]); id != 3 || string(row[2]) != "member" {
+		t.Errorf("unexpected returned row: %q", row)
+	}
+	if !slices.Equal(keys, []uint64{1, 2}) {
+		t.Errorf("expected events for keys 1 and 2, got %v", keys)
+	}
+}
+
+func TestAlterTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{NumColumns: 3})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice"), []byte("Tokyo")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("2"), []byte("Bob"), []byte("Osaka"), []byte("x")}); !errors.Is(err, ErrTooManyColumns) {
+		t.Errorf("expected ErrTooManyColumns, got %v", err)
+	}
+
+	// 足した列は、足す前に書いた行では既定値になる
+	col, err := users.AddColumn([]byte("member"))
+	if err != nil {
+		t.Fatalf("failed to add column: %v", err)
+	}
+	if col != 3 {
+		t.Errorf("expected new column 3, got %d", col)
+	}
+	if err := users.Insert(Tuple{[]byte("2"), []byte("Bob"), []byte("Osaka"), []byte("admin")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	row, err := users.Get(Tuple{[]byte("1")})
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if !equalTuples(row, Tuple{[]byte("1"), []byte("Alice"), []byte("Tokyo"), []byte("member")}) {
+		t.Errorf("unexpected row: %q", row)
+	}
+
+	// 除いた列は読めなくなり、後ろの列が前にずれる
+	if err := users.DropColumn(0); !errors.Is(err, ErrKeyColumn) {
+		t.Errorf("expected ErrKeyColumn, got %v", err)
+	}
+	if err := users.DropColumn(2); err != nil {
+		t.Fatalf("failed to drop column: %v", err)
+	}
+	if v := users.SchemaVersion(); v != 2 {
+		t.Errorf("expected schema version 2, got %d", v)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("3"), []byte("Carol")})
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 列の対応は開き直しても引き継がれる
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	rows, err := users.Scan(ScanOptions{Filter: func(row Tuple) bool {
+		return string(row[2]) == "member"
+	}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	defer rows.Close()
+	var got []Tuple
+	for {
+		row, err := rows.Next()
+		if err != nil {
+			t.Fatalf("failed to read row: %v", err)
+		}
+		if row == nil {
+			break
+		}
+		got = append(got, row)
+	}
+	want := []Tuple{
+		{[]byte("1"), []byte("Alice"), []byte("member")},
+		{[]byte("3"), []byte("Carol"), []byte("member")},
+	}
+	if !slices.EqualFunc(got, want, equalTuples) {
+		t.Errorf("unexpected rows: %q", got)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("4"), []byte("Dave"), []byte("admin"), []byte("x")})
+		return nil
+	}); !errors.Is(err, ErrTooManyColumns) {
+		t.Errorf("expected ErrTooManyColumns, got %v", err)
+	}
+	if users.SchemaVersion() != 2 {
+		t.Errorf("expected schema version 2 after reopen, got %d", users.SchemaVersion())
+	}
+}
+
+func TestAlterTableDuringUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{NumColumns: 3})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	// 積んだ後に列を変えても、適用するときの列の対応で書く
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("1"), []byte("Alice"), []byte("Tokyo")})
+		if _, err := users.AddColumn([]byte("member")); err != nil {
+			return err
+		}
+		if err := users.DropColumn(1); err != nil {
+			return err
+		}
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	row, err := users.Get(Tuple{[]byte("1")})
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if !equalTuples(row, Tuple{[]byte("1"), []byte("Tokyo"), []byte("member")}) {
+		t.Errorf("unexpected row: %q", row)
+	}
+
+	// 書き込みと列の追加を並行して行っても競合しない
+	stop, done := make(chan struct{}), make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			col, err := users.AddColumn([]byte("x"))
+			if err == nil {
+				err = users.DropColumn(col)
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if err := db.Update(func(tx *Tx) error {
+			for j := 0; j < 10; j++ {
+				tx.Put(users, Tuple{[]byte(fmt.Sprintf("k%03d-%d", i, j))})
+			}
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to update: %v", err)
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Fatalf("failed to add column: %v", err)
+	}
+}
+
+func TestDropAndTruncateTable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{AutoIncrement: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 500; i++ {
+		if err := users.Insert(Tuple{nil, bytes.Repeat([]byte("x"), 100)}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	// 消した後も同じ Table を使え、連番は続きから払い出す
+	if err := db.Truncate("users"); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	if n, err := users.Count(); err != nil || n != 0 {
+		t.Errorf("expected no rows after truncate, got %d %v", n, err)
+	}
+	row, err := users.InsertReturning(Tuple{nil, []byte("Alice")})
+	if err != nil {
+		t.Fatalf("failed to insert after truncate: %v", err)
+	}
+	if id, _ := table.DecodeSequence(row[0]); id != 501 {
+		t.Errorf("expected key 501, got %d", id)
+	}
+
+	if err := db.DropTable("users"); err != nil {
+		t.Fatalf("failed to drop table: %v", err)
+	}
+	if _, err := users.Get(Tuple{row[0]}); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound from a dropped table, got %v", err)
+	}
+	if _, err := db.Table("users"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound, got %v", err)
+	}
+	if err := db.DropTable("users"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound, got %v", err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("1")})
+		return nil
+	}); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound from Update, got %v", err)
+	}
+
+	// 同じ名前で作り直せ、空いたページを使う
+	pages := db.disk.NumPages()
+	users, err = db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to recreate table: %v", err)
+	}
+	if n, err := users.Count(); err != nil || n != 0 {
+		t.Errorf("expected an empty table, got %d %v", n, err)
+	}
+	if db.disk.NumPages() != pages {
+		t.Errorf("expected the new table to reuse freed pages, file grew from %d to %d pages", pages, db.disk.NumPages())
+	}
+}
+
+func TestRenameTableAndMetadata(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := db.CreateTable("orders", 1, TableOptions{}); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := users.Insert(Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := users.SetMetadata("comment", []byte("registered users")); err != nil {
+		t.Fatalf("failed to set metadata: %v", err)
+	}
+	if _, err := users.Analyze(AnalyzeOptions{}); err != nil {
+		t.Fatalf("failed to analyze: %v", err)
+	}
+
+	if err := db.RenameTable("users", "orders"); !errors.Is(err, ErrTableExists) {
+		t.Errorf("expected ErrTableExists, got %v", err)
+	}
+	if err := db.RenameTable("missing", "other"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound, got %v", err)
+	}
+	if err := db.RenameTable("users", "members"); err != nil {
+		t.Fatalf("failed to rename: %v", err)
+	}
+	if name := users.Name(); name != "members" {
+		t.Errorf("expected the open table to be renamed, got %q", name)
+	}
+	if _, err := db.Table("users"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound for the old name, got %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 行・統計・メタデータは新しい名前に引き継がれる
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	members, err := db.Table("members")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if _, err := members.Get(Tuple{[]byte("1")}); err != nil {
+		t.Errorf("failed to get: %v", err)
+	}
+	if stats, err := members.Statistics(); err != nil || stats.Rows != 1 {
+		t.Errorf("expected statistics for 1 row, got %v %v", stats, err)
+	}
+	metadata, err := members.Metadata()
+	if err != nil {
+		t.Fatalf("failed to get metadata: %v", err)
+	}
+	if string(metadata["comment"]) != "registered users" {
+		t.Errorf("unexpected comment: %q", metadata["comment"])
+	}
+	if _, err := time.Parse(time.RFC3339Nano, string(metadata[MetadataCreatedAt])); err != nil {
+		t.Errorf("unexpected creation time %q: %v", metadata[MetadataCreatedAt], err)
+	}
+	if err := members.SetMetadata("comment", nil); err != nil {
+		t.Fatalf("failed to delete metadata: %v", err)
+	}
+	if metadata, err := members.Metadata(); err != nil || metadata["comment"] != nil || len(metadata) != 1 {
+		t.Errorf("expected only the creation time, got %q %v", metadata, err)
+	}
+
+	orders, err := db.Table("orders")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if _, err := orders.Statistics(); !errors.Is(err, ErrNoStatistics) {
+		t.Errorf("expected ErrNoStatistics, got %v", err)
+	}
+}
+
+func TestSchema(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	users, err := db.CreateTable("users", 1, TableOptions{
+		NumColumns: 4,
+		NotNull:    []int{3},
+		Defaults:   map[int][]byte{3: []byte("member")},
+	})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := db.CreateTable("orders", 2, TableOptions{}); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	names, err := db.Tables()
+	if err != nil {
+		t.Fatalf("failed to list tables: %v", err)
+	}
+	if !slices.Equal(names, []string{"orders", "users"}) {
+		t.Errorf("unexpected tables: %q", names)
+	}
+
+	// 列の位置は除いた列を詰めた今の並びで返す
+	if err := users.DropColumn(1); err != nil {
+		t.Fatalf("failed to drop column: %v", err)
+	}
+	info, err := db.Schema("users")
+	if err != nil {
+		t.Fatalf("failed to get schema: %v", err)
+	}
+	if info.NumKeyElems != 1 || info.NumColumns != 3 || info.SchemaVersion != 1 {
+		t.Errorf("unexpected schema: %+v", info)
+	}
+	if !slices.Equal(info.NotNull, []int{2}) || string(info.Defaults[2]) != "member" {
+		t.Errorf("unexpected constraints: %v %q", info.NotNull, info.Defaults)
+	}
+	if _, ok := info.Metadata[MetadataCreatedAt]; !ok {
+		t.Errorf("expected the creation time in metadata, got %q", info.Metadata)
+	}
+	if _, err := db.Schema("missing"); !errors.Is(err, ErrTableNotFound) {
+		t.Errorf("expected ErrTableNotFound, got %v", err)
+	}
+}
+
+func TestTableStats(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	// 全ての行を読んで数えたものと比べる
+	expected := func(tbl *Table) TableStats {
+		t.Helper()
+		rows, err := tbl.Scan(ScanOptions{})
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		defer rows.Close()
+		var want TableStats
+		for {
+			row, err := rows.Next()
+			if err != nil {
+				t.Fatalf("failed to read row: %v", err)
+			}
+			if row == nil {
+				return want
+			}
+			want.Rows++
+			want.KeyBytes += len(row[:1].Encode())
+			want.ValueBytes += len(row[1:].Encode())
+		}
+	}
+	check := func(tbl *Table) {
+		t.Helper()
+		stats, err := tbl.Stats()
+		if err != nil {
+			t.Fatalf("failed to get stats: %v", err)
+		}
+		want := expected(tbl)
+		if stats.Rows != want.Rows || stats.KeyBytes != want.KeyBytes || stats.ValueBytes != want.ValueBytes {
+			t.Errorf("expected %+v, got %+v", want, *stats)
+		}
+		if stats.Pages < 2 {
+			t.Errorf("expected the meta page and a leaf, got %d pages", stats.Pages)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("%03d", i)), []byte("Alice")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := users.Upsert(Tuple{[]byte("000"), []byte("Bob"), []byte("admin")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	if err := users.Delete(Tuple{[]byte("001")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, err := users.InsertIgnore(Tuple{[]byte("002"), []byte("Carol")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := db.Update(func(tx *Tx) error {
+		tx.Put(users, Tuple{[]byte("100"), []byte("Dave")})
+		tx.Put(users, Tuple{[]byte("100"), []byte("Dave"), []byte("member")})
+		tx.Delete(users, Tuple{[]byte("003")})
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	check(users)
+	if stats, _ := users.Stats(); stats.Rows != 99 {
+		t.Errorf("expected 99 rows, got %d", stats.Rows)
+	}
+
+	// 期限切れの行も PurgeExpired で消すまでは数える
+	sessions, err := db.CreateTable("sessions", 1, TableOptions{Expiry: true, ExpiryColumn: 2})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i, ttl := range []time.Duration{-time.Second, -time.Second, time.Hour} {
+		if err := sessions.InsertWithTTL(Tuple{[]byte(fmt.Sprintf("s%d", i)), []byte("data")}, ttl); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := sessions.Insert(Tuple{[]byte("s0"), []byte("again")}); err != nil {
+		t.Fatalf("failed to insert over an expired row: %v", err)
+	}
+	if stats, err := sessions.Stats(); err != nil || stats.Rows != 3 {
+		t.Errorf("expected 3 rows before purging, got %+v %v", stats, err)
+	}
+	if _, err := db.PurgeExpired(); err != nil {
+		t.Fatalf("failed to purge: %v", err)
+	}
+	check(sessions)
+	if err := db.Close(); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	// 数はカタログに記録され、開き直しても行を読まずに返す
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	if users.counters == nil {
+		t.Fatal("expected counters to be loaded from the catalog")
+	}
+	check(users)
+	// 記録がなければ（以前のバージョンで作ったテーブル）、一度だけ全ての行を読んで数える
+	users.counters = nil
+	check(users)
+	if err := db.Truncate("users"); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	check(users)
+}
+
+func TestTableStatsAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	users, err := db.CreateTable("users", 1, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("%03d", i)), []byte("Alice")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatalf("failed to flush: %v", err)
+	}
+
+	// 行はディスクに届いたが、数を記録する前に終わる
+	for i := 10; i < 15; i++ {
+		if err := users.Insert(Tuple{[]byte(fmt.Sprintf("%03d", i)), []byte("Bob")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := users.Delete(Tuple{[]byte("000")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := db.bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush pages: %v", err)
+	}
+	if err := db.disk.Close(); err != nil {
+		t.Fatalf("failed to close disk: %v", err)
+	}
+
+	// 印があるので、開いたときに数え直す
+	db, err = Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	defer db.Close()
+	users, err = db.Table("users")
+	if err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	stats, err := users.Stats()
+	if err != nil {
+		t.Fatalf("failed to get stats: %v", err)
+	}
+	if stats.Rows != 14 {
+		t.Errorf("expected 14 rows, got %d", stats.Rows)
+	}
+}
+
+func TestZoneMapPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	events, err := db.CreateTable("events", 1, TableOptions{NumColumns: 3})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 2000; i++ {
+		row := Tuple{[]byte(fmt.Sprintf("%05d", i)), []byte(fmt.Sprintf("t%05d", i)), []byte("data")}
+		if err := events.Insert(row); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := events.EnableZoneMap(1); err != nil {
+		t.Fatalf("failed to enable zone map: %v", err)
+	}
+	if err := events.EnableZoneMap(3); !errors.Is(err, ErrColumnNotFound) {
+		t.Errorf("expected ErrColumnNotFound, got %v", err)
+	}
+
+	// scan は ScanColumnRange で読んだ行のキーを返す
+	scan := func(events *Table, col int, lo, hi string) []string {
+		t.Helper()
+		var hiBytes []byte
+		if hi != "" {
+			hiBytes = []byte(hi)
+		}
+		rows, err := events.ScanColumnRange(col, []byte(lo), hiBytes)
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		defer rows.Close()
+		var keys []string
+		for {
+			row, err := rows.Next()
+			if err != nil {
+				t.Fatalf("failed to read row: %v", err)
+			}
+			if row == nil {
+				return keys
+			}
+			keys = append(keys, string(row[0]))
+		}
+	}
+	// reopen は閉じてから開き直し、events を返す
+	reopen := func() *Table {
+		t.Helper()
+		if err := db.Close(); err != nil {
+			t.Fatalf("failed to close: %v", err)
+		}
+		if db, err = Open(path, Options{}); err != nil {
+			t.Fatalf("failed to reopen: %v", err)
+		}
+		events, err := db.Table("events")
+		if err != nil {
+			t.Fatalf("failed to open table: %v", err)
+		}
+		return events
+	}
+	if keys := scan(events, 1, "t01000", "t01002"); fmt.Sprint(keys) != "[01000 01001 01002]" {
+		t.Errorf("unexpected rows: %v", keys)
+	}
+
+	// 開き直すと、書き出した範囲を読み込む（全ての行は読まない）
+	events = reopen()
+	if z := events.zones; z == nil || z.dirty || z.stale || !slices.Equal(z.columns, []int{1}) {
+		t.Fatalf("expected zone map loaded from the catalog, got %+v", z)
+	}
+	if keys := scan(events, 1, "t01000", "t01002"); fmt.Sprint(keys) != "[01000 01001 01002]" {
+		t.Errorf("unexpected rows after reopen: %v", keys)
+	}
+
+	// 行はディスクに届いたが、範囲を書き出す前に終わる
+	if err := events.Insert(Tuple{[]byte("00000x"), []byte("t99999"), []byte("late")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := db.bufmgr.Flush(); err != nil {
+		t.Fatalf("failed to flush pages: %v", err)
+	}
+	if err := db.disk.Close(); err != nil {
+		t.Fatalf("failed to close disk: %v", err)
+	}
+	if db, err = Open(path, Options{}); err != nil {
+		t.Fatalf("failed to reopen: %v", err)
+	}
+	if events, err = db.Table("events"); err != nil {
+		t.Fatalf("failed to open table: %v", err)
+	}
+	// 印があるので、開いたときに作り直す
+	if z := events.zones; z == nil || !z.dirty {
+		t.Fatalf("expected zone map rebuilt after crash, got %+v", z)
+	}
+	if keys := scan(events, 1, "t99999", ""); fmt.Sprint(keys) != "[00000x]" {
+		t.Errorf("unexpected rows after crash: %v", keys)
+	}
+
+	// Vacuum でリーフが変わっても、作り直した範囲を書き出す
+	for i := 0; i < 2000; i += 2 {
+		if err := events.Delete(Tuple{[]byte(fmt.Sprintf("%05d", i))}); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+	}
+	if err := db.Vacuum(); err != nil {
+		t.Fatalf("failed to vacuum: %v", err)
+	}
+	if keys := scan(events, 1, "t01000", "t01003"); fmt.Sprint(keys) != "[01001 01003]" {
+		t.Errorf("unexpected rows after vacuum: %v", keys)
+	}
+	events = reopen()
+	if z := events.zones; z == nil || z.dirty {
+		t.Fatalf("expected zone map loaded after vacuum, got %+v", z)
+	}
+	if keys := scan(events, 1, "t01000", "t01003"); fmt.Sprint(keys) != "[01001 01003]" {
+		t.Errorf("unexpected rows after vacuum and reopen: %v", keys)
+	}
+
+	// 足した列は、足す前の行を既定値で埋めた値で絞り込む
+	col, err := events.AddColumn([]byte("new"))
+	if err != nil {
+		t.Fatalf("failed to add column: %v", err)
+	}
+	if keys := scan(events, col, "new", "new"); len(keys) != 1001 {
+		t.Errorf("expected 1001 rows with the default, got %d", len(keys))
+	}
+
+	if err := events.DisableZoneMap(); err != nil {
+		t.Fatalf("failed to disable zone map: %v", err)
+	}
+	events = reopen()
+	defer db.Close()
+	if events.zones != nil {
+		t.Errorf("expected no zone map after disable, got %+v", events.zones)
+	}
+	if keys := scan(events, 1, "t01000", "t01003"); fmt.Sprint(keys) != "[01001 01003]" {
+		t.Errorf("unexpected rows without zone map: %v", keys)
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), Options{})
+	if err != nil {
+		t.Fatalf("failed to open: %v", err)
+	}
+	defer db.Close()
+	events, err := db.CreateTable("events", 3, TableOptions{})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for _, user := range []string{"u1", "u10", "u2"} {
+		for _, day := range []string{"mon", "tue"} {
+			for i := 0; i < 3; i++ {
+				row := Tuple{[]byte(user), []byte(day), []byte(fmt.Sprintf("%02d", i)), []byte("data")}
+				if err := events.Insert(row); err != nil {
+					t.Fatalf("failed to insert: %v", err)
+				}
+			}
+		}
+	}
+	readAll := func(rows *Rows) []string {
+		t.Helper()
+		defer rows.Close()
+		var got []string
+		for {
+			row, err := rows.Next()
+			if err != nil {
+				t.Fatalf("failed to read row: %v", err)
+			}
+			if row == nil {
+				return got
+			}
+			got = append(got, string(bytes.Join(row, []byte("/"))))
+		}
+	}
+
+	// 先頭の列だけでも、先頭の2列でも絞れる。"u1" は "u10" の行に合わない
+	rows, err := events.ScanPrefix(Tuple{[]byte("u1")}, ScanOptions{Columns: []int{1, 2}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	want := []string{"mon/00", "mon/01", "mon/02", "tue/00", "tue/01", "tue/02"}
+	if got := readAll(rows); !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+	rows, err = events.ScanPrefix(Tuple{[]byte("u2"), []byte("tue")}, ScanOptions{Columns: []int{2}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	first, err := rows.Next()
+	if err != nil || string(first[0]) != "00" {
+		t.Fatalf("expected the first row, got %q %v", first, err)
+	}
+	token := rows.Token()
+	rows.Close()
+
+	// 続きを読んでも接頭辞の範囲の外には出ない
+	rows, err = events.Resume(token, ScanOptions{Columns: []int{2}})
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	if got := readAll(rows); !slices.Equal(got, []string{"01", "02"}) {
+		t.Errorf("unexpected rows after resume: %q", got)
+	}
+	if _, err := events.ScanPrefix(Tuple{[]byte("u1"), []byte("mon"), []byte("00"), []byte("x")}, ScanOptions{}); !errors.Is(err, table.ErrKeyColumnsMismatch) {
+		t.Errorf("expected ErrKeyColumnsMismatch, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+/*
+Package protocol はminidbサーバーとクライアントの間の通信プロトコルを定義する。
+
+# 概要
+
+TCP上で、長さを前置したフレームを1リクエストにつき1往復させる
+シンプルなリクエスト/レスポンス型のプロトコル。
+
+	クライアント                         サーバー
+	    │  ── Request (GET key) ──────────→  │
+	    │  ←───────── Response (OK value) ── │
+	    │  ── Request (SCAN key limit) ───→  │
+	    │  ←───────── Response (OK pairs) ── │
+
+# フレーム
+
+全てのメッセージは本体の長さ（4バイト）の後に本体が続く：
+
+	┌──────────────┬─────────────────────────┐
+	│ body_len (4) │ body (body_len バイト)   │
+	└──────────────┴─────────────────────────┘
+
+可変長のフィールドも同様に長さ（4バイト）＋データで表す。
+数値はディスク上のフォーマットと同じくリトルエンディアンで格納する。
+
+# 操作
+
+  - GET: キーの値を取得する
+  - PUT: キーに値を書き込む（既存の値は置き換える）
+  - DELETE: キーを削除する
+  - SCAN: キー以降のペアを指定件数まで取得する
+  - LOGIN: ユーザー名とパスワードでログインする（接続ごと）
+
+レスポンスのステータスは OK / NotFound / Error / Denied のいずれかで、
+Error と Denied の場合は理由が入る。
+
+# メトリクス
+
+全てのレスポンスには、そのリクエストの実行にかかったコスト（Metrics）が付く：
+
+  - RowsScanned: 読んだペアの数
+  - BufferHits / BufferMisses: バッファプール上にあった／ディスクから読んだページの数
+  - IOTime: ディスクの読み書きにかかった時間
+*/
+package protocol
@@ -0,0 +1,280 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// MaxFrameSize はフレーム本体の最大バイト数
+// 壊れたデータや悪意のある長さで巨大なメモリを確保しないための上限
+const MaxFrameSize = 16 << 20
+
+// エラー定義
+var (
+	ErrFrameTooLarge = errors.New("frame too large")
+	ErrShortFrame    = errors.New("short frame")
+)
+
+// Op はリクエストの操作の種類を表す
+type Op uint8
+
+const (
+	OpGet    Op = 1 // キーの値を取得する
+	OpPut    Op = 2 // キーに値を書き込む（既存の値は置き換える）
+	OpDelete Op = 3 // キーを削除する
+	OpScan   Op = 4 // キー以降のペアを Limit 件まで取得する
+	OpLogin  Op = 5 // Key をユーザー名、Value をパスワードとしてログインする
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpGet:
+		return "GET"
+	case OpPut:
+		return "PUT"
+	case OpDelete:
+		return "DELETE"
+	case OpScan:
+		return "SCAN"
+	case OpLogin:
+		return "LOGIN"
+	}
+	return fmt.Sprintf("Op(%d)", uint8(op))
+}
+
+// Status はレスポンスの結果を表す
+type Status uint8
+
+const (
+	StatusOK       Status = 0 // 成功
+	StatusNotFound Status = 1 // キーが存在しない
+	StatusError    Status = 2 // エラー（Message に内容が入る）
+	StatusDenied   Status = 3 // 認証されていない、または権限がない（Message に理由が入る）
+)
+
+// Pair はキーと値のペア
+type Pair struct {
+	Key   []byte
+	Value []byte
+}
+
+// Request はクライアントからサーバーへのリクエスト
+type Request struct {
+	Op    Op
+	Key   []byte
+	Value []byte // OpPut のみ
+	Limit uint32 // OpScan のみ（0なら無制限）
+}
+
+// Response はサーバーからクライアントへのレスポンス
+type Response struct {
+	Status  Status
+	Value   []byte  // OpGet の結果
+	Pairs   []Pair  // OpScan の結果
+	Message string  // StatusError の内容
+	Metrics Metrics // このリクエストの実行にかかったコスト
+}
+
+// Metrics はサーバーが1つのリクエストを実行した際のコスト
+// クライアントは EXPLAIN のような往復なしにクエリの効率を監視できる
+type Metrics struct {
+	RowsScanned  uint64        // 読んだペアの数
+	BufferHits   uint64        // バッファプール上にあったページの数
+	BufferMisses uint64        // ディスクから読み込んだページの数
+	IOTime       time.Duration // ディスクの読み書きにかかった時間
+}
+
+// フレームのフォーマット:
+// [body_len: 4] [body]
+//
+// リクエストの本体:
+// [op: 1] [key_len: 4] [key] [value_len: 4] [value] [limit: 4]
+//
+// レスポンスの本体:
+// [status: 1] [value_len: 4] [value] [message_len: 4] [message]
+// [num_pairs: 4] ([key_len: 4] [key] [value_len: 4] [value])...
+// [rows_scanned: 8] [buffer_hits: 8] [buffer_misses: 8] [io_time_ns: 8]
+//
+// 数値は全てリトルエンディアン
+
+// WriteRequest はリクエストをフレームとして書き込む
+func WriteRequest(w io.Writer, req *Request) error {
+	var e encoder
+	e.putUint8(uint8(req.Op))
+	e.putBytes(req.Key)
+	e.putBytes(req.Value)
+	e.putUint32(req.Limit)
+	return writeFrame(w, e.buf)
+}
+
+// ReadRequest はフレームを読み込んでリクエストを返す
+func ReadRequest(r io.Reader) (*Request, error) {
+	body, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	d := decoder{buf: body}
+	req := &Request{
+		Op:    Op(d.uint8()),
+		Key:   d.bytes(),
+		Value: d.bytes(),
+		Limit: d.uint32(),
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return req, nil
+}
+
+// WriteResponse はレスポンスをフレームとして書き込む
+func WriteResponse(w io.Writer, resp *Response) error {
+	var e encoder
+	e.putUint8(uint8(resp.Status))
+	e.putBytes(resp.Value)
+	e.putBytes([]byte(resp.Message))
+	e.putUint32(uint32(len(resp.Pairs)))
+	for _, p := range resp.Pairs {
+		e.putBytes(p.Key)
+		e.putBytes(p.Value)
+	}
+	e.putUint64(resp.Metrics.RowsScanned)
+	e.putUint64(resp.Metrics.BufferHits)
+	e.putUint64(resp.Metrics.BufferMisses)
+	e.putUint64(uint64(resp.Metrics.IOTime))
+	return writeFrame(w, e.buf)
+}
+
+// ReadResponse はフレームを読み込んでレスポンスを返す
+func ReadResponse(r io.Reader) (*Response, error) {
+	body, err := readFrame(r)
+	if err != nil {
+		return nil, err
+	}
+	d := decoder{buf: body}
+	resp := &Response{
+		Status:  Status(d.uint8()),
+		Value:   d.bytes(),
+		Message: string(d.bytes()),
+	}
+	numPairs := d.uint32()
+	for i := uint32(0); i < numPairs && d.err == nil; i++ {
+		resp.Pairs = append(resp.Pairs, Pair{Key: d.bytes(), Value: d.bytes()})
+	}
+	resp.Metrics = Metrics{
+		RowsScanned:  d.uint64(),
+		BufferHits:   d.uint64(),
+		BufferMisses: d.uint64(),
+		IOTime:       time.Duration(d.uint64()),
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return resp, nil
+}
+
+// writeFrame は長さを前置してフレームを書き込む
+func writeFrame(w io.Writer, body []byte) error {
+	if len(body) > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 4+len(body))
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(body)))
+	copy(frame[4:], body)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readFrame は長さ付きのフレームを1つ読み込み、本体を返す
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[:])
+	if size > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// encoder はフレーム本体を組み立てる
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) putUint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *encoder) putUint32(v uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, v)
+}
+
+func (e *encoder) putUint64(v uint64) {
+	e.buf = binary.LittleEndian.AppendUint64(e.buf, v)
+}
+
+func (e *encoder) putBytes(b []byte) {
+	e.putUint32(uint32(len(b)))
+	e.buf = append(e.buf, b...)
+}
+
+// decoder はフレーム本体を先頭から読み進める
+// 途中でデータが足りなくなった場合は err に ErrShortFrame を設定し、以降はゼロ値を返す
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if len(d.buf) < n {
+		d.err = ErrShortFrame
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *decoder) uint8() uint8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint64(b)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	b := d.take(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
@@ -0,0 +1,328 @@
+package minidb
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+// tableSchema はテーブルの列と、格納した行での位置の対応
+// AddColumn と DropColumn は格納した行を書き換えず、この対応だけを変える。
+// 読むときに足りない列を既定値で埋めるので、古い形のまま残った行も今の列で読める
+type tableSchema struct {
+	version    int   // ALTER のたびに1つ増える
+	numColumns int   // 列数（キーの列を含む）。0なら列数を決めていない
+	width      int   // 格納した行の列数（DropColumn した列も含む）
+	columns    []int // 列 → 格納した行での位置。まだ ALTER していなければ nil（同じ位置）
+}
+
+// schema はカタログのエントリに記録した列の対応を返す
+func (e catalogEntry) schema() tableSchema {
+	return tableSchema{
+		version:    e.schemaVersion,
+		numColumns: e.numColumns,
+		width:      e.storedWidth,
+		columns:    e.columns,
+	}
+}
+
+// SchemaVersion は AddColumn と DropColumn で列を変えた回数を返す
+func (t *Table) SchemaVersion() int {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	return t.schema.version
+}
+
+// AddColumn は最後に列を足し、足した列の位置を返す
+// 既にある行は書き換えず、読むときに足した列を def で埋める。def が nil なら NULL になる
+// TableOptions.NumColumns を指定せずに作ったテーブルでは ErrNumColumnsUnknown を返す
+func (t *Table) AddColumn(def []byte) (int, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	col := 0
+	err := t.alter(func(entry *catalogEntry) error {
+		stored := entry.storedWidth
+		entry.columns = append(entry.columns, stored)
+		entry.storedWidth++
+		if def != nil {
+			if entry.defaults == nil {
+				entry.defaults = make(map[int][]byte)
+			}
+			entry.defaults[stored] = def
+		}
+		col = entry.numColumns
+		entry.numColumns++
+		return nil
+	})
+	return col, err
+}
+
+// DropColumn は col 番目の列を除く。後ろの列は1つずつ前にずれる
+// 格納した行から値は消さないが、読めなくなる。キーの列と有効期限の列は除けない（ErrKeyColumn）
+// TableOptions.NumColumns を指定せずに作ったテーブルでは ErrNumColumnsUnknown を返す
+func (t *Table) DropColumn(col int) error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	return t.alter(func(entry *catalogEntry) error {
+		if col < 0 || col >= entry.numColumns {
+			return fmt.Errorf("%w: %d", ErrColumnNotFound, col)
+		}
+		stored := entry.columns[col]
+		if col < entry.numKeyElems || (entry.expiry && stored == entry.expiryColumn) {
+			return fmt.Errorf("%w: %d", ErrKeyColumn, col)
+		}
+		entry.columns = slices.Delete(entry.columns, col, col+1)
+		entry.notNull = slices.DeleteFunc(entry.notNull, func(c int) bool { return c == stored })
+		delete(entry.defaults, stored)
+		entry.numColumns--
+		return nil
+	})
+}
+
+// alter はカタログのエントリを fn で書き換えて記録し、開いているテーブルに反映する
+// 統計の列はそのまま残す。呼び出し時は db.mu を保持していること
+func (t *Table) alter(fn func(entry *catalogEntry) error) error {
+	row, found, err := get(t.db.bufmgr, t.db.catalog, Tuple{[]byte(t.name)})
+	if err != nil {
+		return err
+	}
+	if !found || len(row) < 2 {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, t.name)
+	}
+	entry, err := decodeCatalogEntry(row[1])
+	if err != nil {
+		return err
+	}
+	if entry.numColumns == 0 {
+		return fmt.Errorf("%w: %s", ErrNumColumnsUnknown, t.name)
+	}
+	if entry.columns == nil {
+		// 初めての ALTER では、格納した行の列は宣言した列と同じ位置にある
+		entry.storedWidth = entry.numColumns
+		for col := 0; col < entry.numColumns; col++ {
+			entry.columns = append(entry.columns, col)
+		}
+	}
+	if err := fn(&entry); err != nil {
+		return err
+	}
+	entry.schemaVersion++
+
+	batch := table.NewWriteBatch()
+	batch.Put(t.db.catalog, append(Tuple{[]byte(t.name), entry.encode()}, row[2:]...))
+	if err := batch.Apply(t.db.bufmgr); err != nil {
+		return err
+	}
+	t.tbl.NotNull = entry.notNull
+	t.tbl.Defaults = entry.defaults
+	t.schema = entry.schema()
+	return nil
+}
+
+// toStored は書き込む行を格納する形に並べ替える
+// 列数を決めたテーブルで、それより多い列の行には ErrTooManyColumns を返す
+// 呼び出し時は db.mu を保持していること
+func (t *Table) toStored(row Tuple) (Tuple, error) {
+	s := &t.schema
+	if s.numColumns > 0 && len(row) > s.numColumns {
+		return nil, fmt.Errorf("%w: %d > %d", ErrTooManyColumns, len(row), s.numColumns)
+	}
+	if s.columns == nil {
+		return row, nil
+	}
+	width := 0
+	for col := range row {
+		width = max(width, s.columns[col]+1)
+	}
+	stored := make(Tuple, width)
+	for col, value := range row {
+		stored[s.columns[col]] = value
+	}
+	return stored, nil
+}
+
+// storedRow は toStored と同じだが、db.mu を取って列の対応を読む
+// Tx の書き込みは Update がロックを取る前に積むので、こちらを使う
+func (t *Table) storedRow(row Tuple) (Tuple, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	return t.toStored(row)
+}
+
+// fromStored は格納した行を今の列の並びにする
+// 格納した後に足した列のように行にない列は、既定値で埋める
+// 呼び出し時は db.mu を保持していること
+func (t *Table) fromStored(row Tuple) Tuple {
+	columns := t.schema.columns
+	if columns == nil || row == nil {
+		return row
+	}
+	logical := make(Tuple, len(columns))
+	for col, stored := range columns {
+		if stored < len(row) && row[stored] != nil {
+			logical[col] = row[stored]
+		} else {
+			logical[col] = t.tbl.Defaults[stored]
+		}
+	}
+	return logical
+}
+
+// scanOptions は列の位置で書いた opts を、格納した行の位置に直す
+// 2つ目の戻り値は、返す行の NULL の列を既定値で埋める関数（ALTER していなければ nil）
+// 呼び出し時は db.mu を保持していること
+func (t *Table) scanOptions(opts ScanOptions) (ScanOptions, func(Tuple)) {
+	columns := t.schema.columns
+	if columns == nil {
+		return opts, nil
+	}
+	logical := opts.Columns
+	if logical == nil {
+		logical = make([]int, len(columns))
+		for col := range logical {
+			logical[col] = col
+		}
+	}
+	stored := make([]int, len(logical))
+	defaults := make(Tuple, len(logical))
+	for i, col := range logical {
+		stored[i] = -1
+		if col >= 0 && col < len(columns) {
+			stored[i] = columns[col]
+			defaults[i] = t.tbl.Defaults[columns[col]]
+		}
+	}
+	fill := func(row Tuple) {
+		for i := range row {
+			if row[i] == nil {
+				row[i] = defaults[i]
+			}
+		}
+	}
+	opts.Columns = stored
+	if filter := opts.Filter; filter != nil {
+		opts.Filter = func(row Tuple) bool {
+			fill(row)
+			return filter(row)
+		}
+	}
+	return opts, fill
+}
+
+// TableInfo はテーブルの定義。DB.Schema が返す
+// 列の位置は今の列の並び（AddColumn と DropColumn を反映したもの）で表す
+type TableInfo struct {
+	Name          string
+	NumKeyElems   int
+	NumColumns    int // TableOptions.NumColumns。0なら列数を決めていない
+	SchemaVersion int
+	SoftDelete    bool
+	Expiry        bool
+	ExpiryColumn  int
+	NotNull       []int
+	Defaults      map[int][]byte
+	AutoIncrement bool
+	Metadata      map[string][]byte // Table.Metadata と同じ
+}
+
+// Tables はカタログに記録された全てのテーブルの名前を、名前の順に返す
+func (db *DB) Tables() ([]string, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	return db.tableNames()
+}
+
+// tableNames はカタログに記録された全てのテーブルの名前を、名前の順に返す
+// 呼び出し時は db.mu を保持していること
+func (db *DB) tableNames() ([]string, error) {
+	iter, err := db.catalog.Scan(db.bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(db.bufmgr)
+	var names []string
+	for {
+		row, err := iter.Next(db.bufmgr)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			// カタログのキーの順は名前の順とは限らない
+			slices.Sort(names)
+			return names, nil
+		}
+		names = append(names, string(row[0]))
+	}
+}
+
+// Schema はカタログに記録されたテーブルの定義を返す
+// テーブルがなければ ErrTableNotFound を返す
+func (db *DB) Schema(name string) (*TableInfo, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return nil, ErrClosed
+	}
+	row, found, err := get(db.bufmgr, db.catalog, Tuple{[]byte(name)})
+	if err != nil {
+		return nil, err
+	}
+	if !found || len(row) < 2 {
+		return nil, fmt.Errorf("%w: %s", ErrTableNotFound, name)
+	}
+	entry, err := decodeCatalogEntry(row[1])
+	if err != nil {
+		return nil, err
+	}
+	info := &TableInfo{
+		Name:          name,
+		NumKeyElems:   entry.numKeyElems,
+		NumColumns:    entry.numColumns,
+		SchemaVersion: entry.schemaVersion,
+		SoftDelete:    entry.softDelete,
+		Expiry:        entry.expiry,
+		ExpiryColumn:  entry.logicalColumn(entry.expiryColumn),
+		AutoIncrement: entry.autoIncrement,
+		Metadata:      map[string][]byte{},
+	}
+	for _, stored := range entry.notNull {
+		if col := entry.logicalColumn(stored); col >= 0 {
+			info.NotNull = append(info.NotNull, col)
+		}
+	}
+	for stored, value := range entry.defaults {
+		if col := entry.logicalColumn(stored); col >= 0 {
+			if info.Defaults == nil {
+				info.Defaults = make(map[int][]byte)
+			}
+			info.Defaults[col] = value
+		}
+	}
+	if len(row) > catalogMetadataColumn {
+		if info.Metadata, err = decodeMetadata(row[catalogMetadataColumn]); err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// logicalColumn は格納した行での位置を今の列の位置にする。除いた列なら -1 を返す
+func (e catalogEntry) logicalColumn(stored int) int {
+	if e.columns == nil {
+		return stored
+	}
+	return slices.Index(e.columns, stored)
+}
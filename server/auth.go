@@ -0,0 +1,85 @@
+package server
+
+import (
+	"errors"
+
+	"github.com/kkumaki12/minidb/protocol"
+)
+
+// エラー定義
+var (
+	ErrLoginFailed      = errors.New("login failed")
+	ErrLoginRequired    = errors.New("login required")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// User はログインしたユーザー
+// 組み込み側の認証システムが持つ情報は Attrs に入れて Authorizer に渡せる
+type User struct {
+	Name  string
+	Attrs map[string]string
+}
+
+// Authenticator はログインを検証する
+// minidb自体はユーザーを管理しないので、組み込む側が自前の認証システムをつなぐ
+type Authenticator interface {
+	// CheckLogin はユーザー名とパスワードを検証し、ログインしたユーザーを返す
+	// 失敗した場合はエラーを返す（理由はクライアントにそのまま返るので、秘密を含めないこと）
+	CheckLogin(username, password string) (*User, error)
+}
+
+// Authorizer はユーザーがリクエストを実行してよいかを判定する
+type Authorizer interface {
+	// Authorize は実行してよければ nil を返す
+	// user は Authenticator が設定されていなければ nil になる
+	Authorize(req *protocol.Request, user *User) error
+}
+
+// AuthenticatorFunc は関数を Authenticator として使うためのアダプター
+type AuthenticatorFunc func(username, password string) (*User, error)
+
+func (f AuthenticatorFunc) CheckLogin(username, password string) (*User, error) {
+	return f(username, password)
+}
+
+// AuthorizerFunc は関数を Authorizer として使うためのアダプター
+type AuthorizerFunc func(req *protocol.Request, user *User) error
+
+func (f AuthorizerFunc) Authorize(req *protocol.Request, user *User) error {
+	return f(req, user)
+}
+
+// session は1つの接続の認証状態
+type session struct {
+	user *User
+}
+
+// login は OpLogin を処理する
+func (s *Server) login(sess *session, req *protocol.Request) *protocol.Response {
+	if s.opts.Authenticator == nil {
+		// 認証を使わない設定ではログインは常に成功する
+		return &protocol.Response{Status: protocol.StatusOK}
+	}
+	user, err := s.opts.Authenticator.CheckLogin(string(req.Key), string(req.Value))
+	if err != nil {
+		sess.user = nil
+		return deniedResponse(err)
+	}
+	sess.user = user
+	return &protocol.Response{Status: protocol.StatusOK}
+}
+
+// authorize はリクエストを実行してよいかを確認する
+func (s *Server) authorize(sess *session, req *protocol.Request) error {
+	if s.opts.Authenticator != nil && sess.user == nil {
+		return ErrLoginRequired
+	}
+	if s.opts.Authorizer != nil {
+		return s.opts.Authorizer.Authorize(req, sess.user)
+	}
+	return nil
+}
+
+func deniedResponse(err error) *protocol.Response {
+	return &protocol.Response{Status: protocol.StatusDenied, Message: err.Error()}
+}
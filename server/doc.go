@@ -0,0 +1,79 @@
+/*
+Package server はminidbをネットワーク越しに使えるようにするサーバーを提供する。
+
+# 概要
+
+ServerはB-treeをキー・値ストアとして、protocol パッケージで定義された
+プロトコルでTCP越しに公開する。接続ごとにgoroutineを起動するが、
+ストレージ層（BufferPoolManager / BTree）はスレッドセーフではないため、
+リクエストの実行そのものは1つずつ直列に行う。
+
+	┌──────────┐   ┌──────────┐
+	│ client A │   │ client B │
+	└────┬─────┘   └────┬─────┘
+	     │ TCP          │ TCP
+	┌────▼──────────────▼─────┐
+	│ Server（接続ごとにgoroutine）│
+	│        ↓ 直列化           │
+	│  BTree / BufferPoolManager │
+	└──────────────────────────┘
+
+# 使用例
+
+	tree, _ := btree.Create(bufmgr)
+	srv := server.New(bufmgr, tree)
+	go srv.ListenAndServe(":7070")
+
+	// 終了時
+	srv.Close()
+	bufmgr.Flush()
+
+スタンドアロンのプロセスとして動かす場合は cmd/minidbd を使う。
+
+# panic の封じ込め
+
+壊れたページを読んだときなど、リクエストの処理中に panic が起きても
+サーバーは止まらない。panic は回復され、そのリクエストだけが
+"internal error during GET: ..." という StatusError で失敗し、同じ接続も
+他の接続もそのまま使える。panic の値とスタックトレースは Options.PanicHandler に
+渡される（nil なら log パッケージで書き出す）。
+
+途中で止まった処理がピンしていたページはピンが外れないまま残ることがある。
+同じ panic が続くようなら、プロセスを再起動してデータファイルを Check で調べる。
+
+# ヘルスチェック
+
+Health はデータファイルに書き込めるか（fsync が通るか）を、Ready は Serve で
+接続を待ち受けているかを確認する。HealthHandler はこれを /healthz と /readyz として
+HTTP で公開し、成功なら 200、失敗なら 503 と理由を返す。オーケストレーターの
+liveness / readiness probe に向ける：
+
+	go http.ListenAndServe(":7071", srv.HealthHandler())
+
+WAL・起動時のリカバリ・カタログはまだないので、それらの状態は確認しない。
+
+# 認証と認可
+
+minidb自体はユーザーを管理しない。組み込む側は Authenticator と Authorizer を
+実装して、自前の認証システムをつなぐ。Authenticator を設定すると、クライアントは
+ログイン（OpLogin）するまで他のリクエストを実行できない。Authorizer は
+ログインしたユーザーとリクエストを受け取り、全てのリクエストを実行前に判定する：
+
+	srv := server.NewWithOptions(bufmgr, tree, server.Options{
+	    Authenticator: server.AuthenticatorFunc(func(name, password string) (*server.User, error) {
+	        if !myIdP.Verify(name, password) {
+	            return nil, server.ErrLoginFailed
+	        }
+	        return &server.User{Name: name}, nil
+	    }),
+	    Authorizer: server.AuthorizerFunc(func(req *protocol.Request, user *server.User) error {
+	        if req.Op != protocol.OpGet && req.Op != protocol.OpScan && !isWriter(user) {
+	            return server.ErrPermissionDenied
+	        }
+	        return nil
+	    }),
+	})
+
+拒否されたリクエストには StatusDenied が返り、クライアントでは *client.DeniedError になる。
+*/
+package server
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// エラー定義
+var (
+	ErrNotListening = errors.New("not listening")
+)
+
+// Health はプロセスがリクエストを処理できる状態かを確認する
+// データファイルに書き込めなければエラーを返す
+func (s *Server) Health() error {
+	if err := s.bufmgr.CheckDisk(); err != nil {
+		return fmt.Errorf("data file not writable: %w", err)
+	}
+	return nil
+}
+
+// Ready はサーバーが接続を受け付けているかを確認する
+// Serve で待ち受けを始める前と Close の後は ErrNotListening を返す
+func (s *Server) Ready() error {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closed {
+		return ErrServerClosed
+	}
+	if len(s.listeners) == 0 {
+		return ErrNotListening
+	}
+	return nil
+}
+
+// HealthHandler は /healthz と /readyz に応答する http.Handler を返す
+// それぞれ Health と Ready の結果を、成功なら 200、失敗なら 503 と理由で返す
+func (s *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, s.Health())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeCheck(w, s.Ready())
+	})
+	return mux
+}
+
+// writeCheck は確認の結果をレスポンスに書く
+func writeCheck(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
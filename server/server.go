@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/protocol"
+)
+
+// エラー定義
+var (
+	ErrServerClosed = errors.New("server closed")
+)
+
+// Server はB-treeをキー・値ストアとしてTCPで公開するサーバー
+type Server struct {
+	bufmgr *buffer.BufferPoolManager
+	tree   *btree.BTree
+	opts   Options
+
+	// ストレージ層はスレッドセーフではないので、リクエストの実行を直列化する
+	mu sync.Mutex
+
+	// 接続の管理用
+	connMu    sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// Options はServerの動作を設定する
+type Options struct {
+	// Authenticator を設定すると、クライアントは OpLogin でログインするまで
+	// 他のリクエストを実行できなくなる
+	Authenticator Authenticator
+	// Authorizer を設定すると、全てのリクエストを実行前に判定する
+	Authorizer Authorizer
+	// PanicHandler はリクエストの処理中に起きた panic の値とスタックトレースを受け取る
+	// nil なら log パッケージで書き出す。どちらの場合もサーバーは止まらない
+	PanicHandler func(req *protocol.Request, recovered any, stack []byte)
+}
+
+// New はB-treeを公開するServerを作成する
+func New(bufmgr *buffer.BufferPoolManager, tree *btree.BTree) *Server {
+	return NewWithOptions(bufmgr, tree, Options{})
+}
+
+// NewWithOptions は動作を指定してServerを作成する
+func NewWithOptions(bufmgr *buffer.BufferPoolManager, tree *btree.BTree, opts Options) *Server {
+	return &Server{
+		bufmgr:    bufmgr,
+		tree:      tree,
+		opts:      opts,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// ListenAndServe は addr でTCP接続を待ち受けてリクエストを処理する
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve はリスナーで接続を受け付け、接続ごとにgoroutineで処理する
+// Close が呼ばれるまで戻らない。Close 後は ErrServerClosed を返す
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l) {
+		l.Close()
+		return ErrServerClosed
+	}
+	defer s.untrackListener(l)
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrServerClosed
+			}
+			return err
+		}
+		if !s.trackConn(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.wg.Add(1)
+		go s.serveConn(conn)
+	}
+}
+
+// Close はリスナーと全ての接続を閉じ、処理中のリクエストの完了を待つ
+func (s *Server) Close() error {
+	s.connMu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.connMu.Unlock()
+
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) isClosed() bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	return s.closed
+}
+
+func (s *Server) trackListener(l net.Listener) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(l net.Listener) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	delete(s.listeners, l)
+}
+
+func (s *Server) trackConn(conn net.Conn) bool {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackConn(conn net.Conn) {
+	s.connMu.Lock()
+	defer s.connMu.Unlock()
+	delete(s.conns, conn)
+}
+
+// serveConn は1つの接続でリクエストを順番に処理する
+func (s *Server) serveConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer s.untrackConn(conn)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	sess := &session{}
+	for {
+		req, err := protocol.ReadRequest(r)
+		if err != nil {
+			// io.EOF はクライアントが接続を閉じただけ
+			if err != io.EOF {
+				protocol.WriteResponse(w, errorResponse(err))
+				w.Flush()
+			}
+			return
+		}
+
+		resp := s.process(sess, req)
+		if err := protocol.WriteResponse(w, resp); err != nil {
+			return
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// process はログイン・認可・実行を行ってレスポンスを返す
+// 処理中の panic（壊れたページなど）は回復してこのリクエストだけを失敗させ、
+// 他の接続やサーバー全体は動き続ける
+func (s *Server) process(sess *session, req *protocol.Request) (resp *protocol.Response) {
+	defer func() {
+		if r := recover(); r != nil {
+			s.reportPanic(req, r, debug.Stack())
+			resp = &protocol.Response{
+				Status:  protocol.StatusError,
+				Message: fmt.Sprintf("internal error during %s: %v", req.Op, r),
+			}
+		}
+	}()
+
+	if req.Op == protocol.OpLogin {
+		return s.login(sess, req)
+	}
+	if err := s.authorize(sess, req); err != nil {
+		return deniedResponse(err)
+	}
+	return s.handle(req)
+}
+
+// reportPanic は回復した panic を PanicHandler に渡す
+func (s *Server) reportPanic(req *protocol.Request, recovered any, stack []byte) {
+	if s.opts.PanicHandler != nil {
+		s.opts.PanicHandler(req, recovered, stack)
+		return
+	}
+	log.Printf("panic during %s: %v\n%s", req.Op, recovered, stack)
+}
+
+// handle はリクエストを実行してレスポンスを返す
+// 実行は直列化されているので、前後のバッファプールの統計の差がそのまま
+// このリクエストのコストになる
+func (s *Server) handle(req *protocol.Request) *protocol.Response {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := s.bufmgr.Stats()
+	resp := s.dispatch(req)
+	delta := s.bufmgr.Stats().Sub(before)
+
+	resp.Metrics.BufferHits = delta.Hits
+	resp.Metrics.BufferMisses = delta.Misses
+	resp.Metrics.IOTime = delta.IOTime
+	return resp
+}
+
+// dispatch は操作の種類ごとの処理を呼び出す
+// RowsScanned は各処理で設定する
+func (s *Server) dispatch(req *protocol.Request) *protocol.Response {
+	switch req.Op {
+	case protocol.OpGet:
+		return s.handleGet(req)
+	case protocol.OpPut:
+		return s.handlePut(req)
+	case protocol.OpDelete:
+		return s.handleDelete(req)
+	case protocol.OpScan:
+		return s.handleScan(req)
+	}
+	return &protocol.Response{Status: protocol.StatusError, Message: "unknown op " + req.Op.String()}
+}
+
+func (s *Server) handleGet(req *protocol.Request) *protocol.Response {
+	iter, err := s.tree.Search(s.bufmgr, btree.NewSearchKey(req.Key))
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer iter.Close(s.bufmgr)
+
+	pair, err := iter.Next(s.bufmgr)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if pair == nil {
+		return &protocol.Response{Status: protocol.StatusNotFound}
+	}
+	metrics := protocol.Metrics{RowsScanned: 1}
+	if !bytes.Equal(pair.Key, req.Key) {
+		return &protocol.Response{Status: protocol.StatusNotFound, Metrics: metrics}
+	}
+	return &protocol.Response{Status: protocol.StatusOK, Value: pair.Value, Metrics: metrics}
+}
+
+func (s *Server) handlePut(req *protocol.Request) *protocol.Response {
+	err := s.tree.Merge(s.bufmgr, req.Key, func([]byte) []byte {
+		return req.Value
+	})
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &protocol.Response{Status: protocol.StatusOK}
+}
+
+func (s *Server) handleDelete(req *protocol.Request) *protocol.Response {
+	err := s.tree.Delete(s.bufmgr, req.Key)
+	if err == btree.ErrKeyNotFound {
+		return &protocol.Response{Status: protocol.StatusNotFound}
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &protocol.Response{Status: protocol.StatusOK}
+}
+
+func (s *Server) handleScan(req *protocol.Request) *protocol.Response {
+	search := btree.NewSearchStart()
+	if len(req.Key) > 0 {
+		search = btree.NewSearchKey(req.Key)
+	}
+	iter, err := s.tree.Search(s.bufmgr, search)
+	if err != nil {
+		return errorResponse(err)
+	}
+	defer iter.Close(s.bufmgr)
+
+	resp := &protocol.Response{Status: protocol.StatusOK}
+	for req.Limit == 0 || uint32(len(resp.Pairs)) < req.Limit {
+		pair, err := iter.Next(s.bufmgr)
+		if err != nil {
+			return errorResponse(err)
+		}
+		if pair == nil {
+			break
+		}
+		resp.Pairs = append(resp.Pairs, protocol.Pair{Key: pair.Key, Value: pair.Value})
+		resp.Metrics.RowsScanned++
+	}
+	return resp
+}
+
+func errorResponse(err error) *protocol.Response {
+	return &protocol.Response{Status: protocol.StatusError, Message: err.Error()}
+}
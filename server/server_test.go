@@ -0,0 +1,308 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/client"
+	"github.com/kkumaki12/minidb/disk"
+	"github.com/kkumaki12/minidb/protocol"
+)
+
+// テスト用のヘルパー関数
+// サーバーを起動し、接続済みのクライアントを返す
+func setupTestServer(t *testing.T) (*client.Client, func()) {
+	t.Helper()
+	return setupTestServerWithOptions(t, Options{})
+}
+
+// setupTestServerWithOptions は動作を指定してサーバーを起動する
+func setupTestServerWithOptions(t *testing.T, opts Options) (*client.Client, func()) {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "server_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(100))
+	tree, err := btree.Create(bufmgr)
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to create btree: %v", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to listen: %v", err)
+	}
+	srv := NewWithOptions(bufmgr, tree, opts)
+	go srv.Serve(l)
+
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		srv.Close()
+		os.Remove(tmpPath)
+		t.Fatalf("failed to dial: %v", err)
+	}
+
+	cleanup := func() {
+		c.Close()
+		srv.Close()
+		os.Remove(tmpPath)
+	}
+	return c, cleanup
+}
+
+func TestServerGetPutDelete(t *testing.T) {
+	c, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	if _, err := c.Get([]byte("key")); err != client.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := c.Put([]byte("key"), []byte("value1")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	// 同じキーへの Put は値を置き換える
+	if err := c.Put([]byte("key"), []byte("value2")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	value, err := c.Get([]byte("key"))
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	if string(value) != "value2" {
+		t.Errorf("expected value2, got %s", value)
+	}
+
+	if err := c.Delete([]byte("key")); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := c.Delete([]byte("key")); err != client.ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestServerScan(t *testing.T) {
+	c, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key%02d", i)
+		if err := c.Put([]byte(key), []byte("value")); err != nil {
+			t.Fatalf("failed to put: %v", err)
+		}
+	}
+
+	pairs, err := c.Scan([]byte("key05"), 3)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var keys []string
+	for _, p := range pairs {
+		keys = append(keys, string(p.Key))
+	}
+	if got := fmt.Sprint(keys); got != "[key05 key06 key07]" {
+		t.Errorf("unexpected keys: %s", got)
+	}
+
+	pairs, err = c.Scan(nil, 0)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if len(pairs) != 10 {
+		t.Errorf("expected 10 pairs, got %d", len(pairs))
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	c, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	for i := 0; i < 20; i++ {
+		if err := c.Put([]byte(fmt.Sprintf("key%02d", i)), []byte("value")); err != nil {
+			t.Fatalf("failed to put: %v", err)
+		}
+	}
+
+	if _, err := c.Scan([]byte("key05"), 10); err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	metrics := c.LastMetrics()
+	if metrics.RowsScanned != 10 {
+		t.Errorf("expected 10 rows scanned, got %d", metrics.RowsScanned)
+	}
+	// メタページ・ルートの読み込みは全てバッファプール上で済む
+	if metrics.BufferHits == 0 || metrics.BufferMisses != 0 {
+		t.Errorf("unexpected buffer metrics: %+v", metrics)
+	}
+
+	if _, err := c.Get([]byte("missing")); err != client.ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if metrics := c.LastMetrics(); metrics.BufferHits == 0 {
+		t.Errorf("expected metrics for a not-found get, got %+v", metrics)
+	}
+}
+
+func TestServerAuth(t *testing.T) {
+	opts := Options{
+		Authenticator: AuthenticatorFunc(func(username, password string) (*User, error) {
+			if password != "secret" {
+				return nil, ErrLoginFailed
+			}
+			return &User{Name: username}, nil
+		}),
+		// reader は読み込みしかできない
+		Authorizer: AuthorizerFunc(func(req *protocol.Request, user *User) error {
+			if user.Name == "reader" && (req.Op == protocol.OpPut || req.Op == protocol.OpDelete) {
+				return ErrPermissionDenied
+			}
+			return nil
+		}),
+	}
+	c, cleanup := setupTestServerWithOptions(t, opts)
+	defer cleanup()
+
+	var denied *client.DeniedError
+	if err := c.Put([]byte("key"), []byte("value")); !errors.As(err, &denied) {
+		t.Errorf("expected DeniedError before login, got %v", err)
+	}
+	if err := c.Login("writer", "wrong"); !errors.As(err, &denied) {
+		t.Errorf("expected DeniedError for a wrong password, got %v", err)
+	}
+
+	if err := c.Login("writer", "secret"); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	if err := c.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+
+	if err := c.Login("reader", "secret"); err != nil {
+		t.Fatalf("failed to login: %v", err)
+	}
+	if _, err := c.Get([]byte("key")); err != nil {
+		t.Errorf("failed to get as reader: %v", err)
+	}
+	if err := c.Delete([]byte("key")); !errors.As(err, &denied) || denied.Message != ErrPermissionDenied.Error() {
+		t.Errorf("expected permission denied, got %v", err)
+	}
+}
+
+func TestServerHealth(t *testing.T) {
+	tmpFile, err := os.CreateTemp("", "server_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+	defer os.Remove(tmpPath)
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, buffer.NewBufferPool(100))
+	tree, err := btree.Create(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to create btree: %v", err)
+	}
+	srv := New(bufmgr, tree)
+	handler := srv.HealthHandler()
+	check := func(path string) int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		return rec.Code
+	}
+
+	if err := srv.Health(); err != nil {
+		t.Errorf("expected healthy, got %v", err)
+	}
+	if err := srv.Ready(); err != ErrNotListening {
+		t.Errorf("expected ErrNotListening before Serve, got %v", err)
+	}
+	if code := check("/readyz"); code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before Serve, got %d", code)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	go srv.Serve(l)
+	c, err := client.Dial(l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.Close()
+	// 1往復すれば Serve は待ち受けを始めている
+	if err := c.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to put: %v", err)
+	}
+	if code := check("/healthz"); code != http.StatusOK {
+		t.Errorf("expected 200 from /healthz, got %d", code)
+	}
+	if code := check("/readyz"); code != http.StatusOK {
+		t.Errorf("expected 200 from /readyz, got %d", code)
+	}
+
+	srv.Close()
+	if err := srv.Ready(); err != ErrServerClosed {
+		t.Errorf("expected ErrServerClosed after Close, got %v", err)
+	}
+}
+
+func TestServerPanicContainment(t *testing.T) {
+	var panicked []string
+	opts := Options{
+		// 壊れたページを読んだときの代わりに、特定のキーで panic させる
+		Authorizer: AuthorizerFunc(func(req *protocol.Request, user *User) error {
+			if string(req.Key) == "boom" {
+				panic("corrupt page")
+			}
+			return nil
+		}),
+		PanicHandler: func(req *protocol.Request, recovered any, stack []byte) {
+			panicked = append(panicked, fmt.Sprintf("%s %v", req.Op, recovered))
+			if len(stack) == 0 {
+				t.Error("expected a stack trace")
+			}
+		},
+	}
+	c, cleanup := setupTestServerWithOptions(t, opts)
+	defer cleanup()
+
+	var serverErr *client.ServerError
+	if _, err := c.Get([]byte("boom")); !errors.As(err, &serverErr) || serverErr.Message != "internal error during GET: corrupt page" {
+		t.Errorf("expected an internal error, got %v", err)
+	}
+	if got := fmt.Sprint(panicked); got != "[GET corrupt page]" {
+		t.Errorf("unexpected panics: %s", got)
+	}
+
+	// 同じ接続で続けてリクエストを処理できる
+	if err := c.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to put after a panic: %v", err)
+	}
+	if value, err := c.Get([]byte("key")); err != nil || string(value) != "value" {
+		t.Errorf("unexpected get after a panic: %q, %v", value, err)
+	}
+}
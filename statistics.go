@@ -0,0 +1,66 @@
+package minidb
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kkumaki12/minidb/table"
+)
+
+// AnalyzeOptions は統計を集めるときの設定。table.AnalyzeOptions と同じ
+type AnalyzeOptions = table.AnalyzeOptions
+
+// Statistics はテーブルの行と列の統計。table.Statistics と同じ
+type Statistics = table.Statistics
+
+// ColumnStatistics は1つの列の統計。table.ColumnStatistics と同じ
+type ColumnStatistics = table.ColumnStatistics
+
+// Analyze はテーブルの全ての行を読んで列ごとの統計を集め、カタログに記録する
+// 記録した統計は開き直しても Statistics で読める。行を書き換えても統計は自動では
+// 更新されないので、行数や値の分布が大きく変わったら実行し直すこと
+func (t *Table) Analyze(opts AnalyzeOptions) (*Statistics, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	row, err := t.catalogRow()
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := table.Analyze(t.db.bufmgr, t.tbl, opts)
+	if err != nil {
+		return nil, err
+	}
+	row = slices.Clone(row)
+	for len(row) <= catalogStatsColumn {
+		row = append(row, nil)
+	}
+	row[catalogStatsColumn] = stats.Encode()
+	batch := table.NewWriteBatch()
+	batch.Put(t.db.catalog, row)
+	if err := batch.Apply(t.db.bufmgr); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Statistics は Analyze でカタログに記録した統計を返す
+// まだ Analyze していなければ ErrNoStatistics を返す
+func (t *Table) Statistics() (*Statistics, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	row, err := t.catalogRow()
+	if err != nil {
+		return nil, err
+	}
+	if len(row) <= catalogStatsColumn || len(row[catalogStatsColumn]) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoStatistics, t.name)
+	}
+	return table.DecodeStatistics(row[catalogStatsColumn])
+}
@@ -0,0 +1,275 @@
+package minidb
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/kkumaki12/minidb/cdc"
+)
+
+// ChangeKind は行の変更の種類。cdc.Kind と同じ値を使う
+type ChangeKind int
+
+const (
+	ChangeInsert ChangeKind = iota + 1 // 行を挿入した
+	ChangeUpdate                       // 行を置き換えた
+	ChangeDelete                       // 行を削除した
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case ChangeInsert:
+		return "insert"
+	case ChangeUpdate:
+		return "update"
+	case ChangeDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// ChangeEvent はテーブルの1行の変更
+type ChangeEvent struct {
+	Table string     // テーブル名
+	Kind  ChangeKind // 変更の種類
+	Key   Tuple      // 行のキーの列
+	Old   Tuple      // 変更前の行。ChangeInsert なら nil
+	New   Tuple      // 変更後の行。ChangeDelete なら nil
+}
+
+// subscriber は Subscribe で登録した関数
+type subscriber struct {
+	fn func(ev ChangeEvent)
+}
+
+// pendingEvent は書き込みが終わって、まだ届けていないイベント
+// 書き込んだ時点の購読者に届ける
+type pendingEvent struct {
+	ev          ChangeEvent
+	subscribers []*subscriber
+}
+
+// Subscribe はテーブルの行が変わるたびに fn を呼ぶよう登録し、登録を外す関数を返す
+// fn は書き込みが適用された後に、db のロックを外してから呼ばれる。ふつうは書き込んだ goroutine が
+// 書き込みから戻る前に呼ぶが、他の goroutine が届けている途中ならその goroutine が続けて届ける
+// イベントは適用した順に1つずつ届き、Update では適用した後にまとめて届く。失敗した書き込みの
+// イベントは届かない。同じ行を変えない書き込み（InsertIgnore で既にあった行など）も届かない
+// fn の中から db のメソッドを呼んでよい。その書き込みのイベントは fn が戻ってから届く
+// PurgeExpired で消した行や、期限が来て読めなくなった行のイベントは届かない
+// まだないテーブルの名前でも登録できる
+func (db *DB) Subscribe(tableName string, fn func(ev ChangeEvent)) (unsubscribe func()) {
+	sub := &subscriber{fn: fn}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.subscribers == nil {
+		db.subscribers = make(map[string][]*subscriber)
+	}
+	db.subscribers[tableName] = append(db.subscribers[tableName], sub)
+	return func() {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		subs := slices.DeleteFunc(slices.Clone(db.subscribers[tableName]), func(s *subscriber) bool {
+			return s == sub
+		})
+		if len(subs) == 0 {
+			delete(db.subscribers, tableName)
+		} else {
+			db.subscribers[tableName] = subs
+		}
+	}
+}
+
+// watchedRow は書き込みの前後で比べる行
+type watchedRow struct {
+	table *Table
+	key   Tuple
+	old   Tuple
+}
+
+// changeSet は書き込む前の行を覚えておき、書き込んだ後の行と比べてイベントを作る
+type changeSet struct {
+	db   *DB
+	rows []watchedRow
+}
+
+// watching はテーブルの変更を購読者か変更ログに渡すかを返す
+// 呼び出し時は db.mu を保持していること
+func (db *DB) watching(name string) bool {
+	return db.changeLog != nil || len(db.subscribers[name]) > 0
+}
+
+// watch は購読者のいるテーブル（変更ログがあれば全てのテーブル）と、行数を数えているテーブルの行について、
+// 書き込む前の行を読んでおく。期限切れの行もページにあるうちは数えるので、rawTable で読む
+// 同じ行は1つにまとめるので、Update で何度書き換えても前後の差だけがイベントになる
+// 呼び出し時は db.mu を保持していること
+func (db *DB) watch(rows []watchedRow) (*changeSet, error) {
+	cs := &changeSet{db: db}
+	seen := make(map[string]bool)
+	for _, r := range rows {
+		if !db.watching(r.table.name) && r.table.counters == nil {
+			continue
+		}
+		if err := r.table.markStale(); err != nil {
+			return nil, err
+		}
+		id := string(Tuple{[]byte(r.table.name), r.key.Encode()}.Encode())
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		old, _, err := get(db.bufmgr, r.table.rawTable(), r.key)
+		if err != nil {
+			return nil, err
+		}
+		r.old = old
+		cs.rows = append(cs.rows, r)
+	}
+	return cs, nil
+}
+
+// watchRow は t の1行を watch する
+func (t *Table) watchRow(key Tuple) (*changeSet, error) {
+	return t.db.watch([]watchedRow{{table: t, key: key}})
+}
+
+// publishInserted は挿入した行を数え、イベントを積む
+// Expiry が無効なテーブルへの Insert は行がないときにだけ成功するので、書き込む前の行は読まなくてよい
+// 呼び出し時は db.mu を保持していること
+func (t *Table) publishInserted(row Tuple) error {
+	if !t.db.watching(t.name) {
+		t.count(nil, row)
+		return nil
+	}
+	changes := &changeSet{db: t.db, rows: []watchedRow{{table: t, key: t.rowKey(row)}}}
+	return changes.publish()
+}
+
+// watchInsert は挿入する行を返し、書き込む前の行を読んでおく
+// Expiry が有効なテーブルでは Insert が期限切れの行を置き換えることがあるので、先に採番して
+// 書き込む前の行を読む。そうでなければ nil の changeSet を返すので、書き込んだ後に publishInserted を呼ぶ
+// 呼び出し時は db.mu を保持していること
+func (t *Table) watchInsert(row Tuple) (Tuple, *changeSet, error) {
+	if err := t.markStale(); err != nil {
+		return nil, nil, err
+	}
+	if !t.tbl.Expiry {
+		return row, nil, nil
+	}
+	row, err := t.tbl.Prepare(t.db.bufmgr, row)
+	if err != nil {
+		return nil, nil, err
+	}
+	changes, err := t.watchRow(t.rowKey(row))
+	return row, changes, err
+}
+
+// rowKey は行のキーの列を返す
+func (t *Table) rowKey(row Tuple) Tuple {
+	return row[:min(len(row), t.tbl.NumKeyElems)]
+}
+
+// publish は書き込んだ後の行を読み、行数と大きさに反映する。変わった行をイベントを届ける列に積んで、
+// 変更ログに書く
+// 書き込みは適用済みなので、ここで失敗すると変更ログとイベントだけが欠ける
+// 呼び出し時は db.mu を保持していること
+func (cs *changeSet) publish() error {
+	var events []ChangeEvent
+	for _, r := range cs.rows {
+		row, _, err := get(cs.db.bufmgr, r.table.rawTable(), r.key)
+		if err != nil {
+			return err
+		}
+		r.table.count(r.old, row)
+		if !cs.db.watching(r.table.name) {
+			continue
+		}
+		// 期限切れの行は読めないので、イベントではない行として扱う
+		old, row := r.table.live(r.old), r.table.live(row)
+		ev := ChangeEvent{Table: r.table.name, Key: r.key, Old: r.table.fromStored(old), New: r.table.fromStored(row)}
+		switch {
+		case old == nil && row == nil:
+			continue
+		case old == nil:
+			ev.Kind = ChangeInsert
+		case row == nil:
+			ev.Kind = ChangeDelete
+		case equalTuples(old, row):
+			continue
+		default:
+			ev.Kind = ChangeUpdate
+		}
+		events = append(events, ev)
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	for _, ev := range events {
+		if subs := cs.db.subscribers[ev.Table]; len(subs) > 0 {
+			cs.db.pending = append(cs.db.pending, pendingEvent{ev: ev, subscribers: subs})
+		}
+	}
+	if cs.db.changeLog != nil {
+		return cs.db.appendChanges(events)
+	}
+	return nil
+}
+
+// appendChanges はイベントを変更ログに書く
+// 書けなければ、書き込みは適用済みなので ErrChangeLog を返し、次に書くときに先に cdc.Gap を書く
+// 呼び出し時は db.mu を保持していること
+func (db *DB) appendChanges(events []ChangeEvent) error {
+	records := make([]*cdc.Record, 0, len(events)+1)
+	if db.changeGap {
+		records = append(records, &cdc.Record{Kind: cdc.Gap})
+	}
+	for _, ev := range events {
+		records = append(records, &cdc.Record{Table: ev.Table, Kind: cdc.Kind(ev.Kind), Key: ev.Key, Old: ev.Old, New: ev.New})
+	}
+	if _, err := db.changeLog.Append(records); err != nil {
+		db.changeGap = true
+		return fmt.Errorf("%w: %w", ErrChangeLog, err)
+	}
+	db.changeGap = false
+	return nil
+}
+
+// equalTuples は2つの行が同じかを返す
+func equalTuples(a, b Tuple) bool {
+	return slices.EqualFunc(a, b, func(x, y []byte) bool { return string(x) == string(y) })
+}
+
+// deliver は積まれたイベントを購読者に届ける。db.mu を保持せずに呼ぶこと
+// 他の goroutine が届けている途中なら、その goroutine に任せて戻る。購読者の中から
+// 書き込んだときも同じで、積んだイベントは外側の deliver が続けて届ける
+func (db *DB) deliver() {
+	for db.delivering.TryLock() {
+		db.drain()
+		// ロックを外す間に積まれたイベントがなければ終わる
+		db.mu.Lock()
+		done := len(db.pending) == 0
+		db.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+// drain は積まれたイベントがなくなるまで届ける。db.delivering を保持して呼び、外して戻る
+func (db *DB) drain() {
+	defer db.delivering.Unlock()
+	for {
+		db.mu.Lock()
+		events := db.pending
+		db.pending = nil
+		db.mu.Unlock()
+		if len(events) == 0 {
+			return
+		}
+		for _, pe := range events {
+			for _, sub := range pe.subscribers {
+				sub.fn(pe.ev)
+			}
+		}
+	}
+}
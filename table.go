@@ -0,0 +1,426 @@
+package minidb
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/table"
+)
+
+// Table はカタログに記録されたテーブル
+type Table struct {
+	db       *DB
+	name     string
+	tbl      *table.SimpleTable
+	schema   tableSchema    // AddColumn と DropColumn で変えた列。db.mu で守る
+	counters *tableCounters // 行数と大きさ。以前のバージョンで作って、まだ数えていなければ nil
+	zones    *tableZoneMap  // EnableZoneMap で設定したゾーンマップ。設定していなければ nil
+	dropped  bool           // DropTable で消した
+}
+
+// check はテーブルを操作できるかを確かめる
+// DropTable で消したテーブルには ErrTableNotFound を返す。呼び出し時は db.mu を保持していること
+func (t *Table) check() error {
+	if t.db.closed {
+		return ErrClosed
+	}
+	if t.dropped {
+		return fmt.Errorf("%w: %s", ErrTableNotFound, t.name)
+	}
+	return nil
+}
+
+// Name はテーブル名を返す
+func (t *Table) Name() string {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	return t.name
+}
+
+// Insert は行を挿入する
+// 同じキーの行があれば btree.ErrDuplicateKey をラップした *table.ConstraintError を返す
+func (t *Table) Insert(row Tuple) error {
+	_, err := t.InsertReturning(row)
+	return err
+}
+
+// InsertReturning は行を挿入し、書き込んだ行を返す
+// TableOptions.AutoIncrement で採番したキーや、Defaults で埋めた列は返した行で分かる
+func (t *Table) InsertReturning(row Tuple) (Tuple, error) {
+	defer t.db.deliver()
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	row, err := t.toStored(row)
+	if err != nil {
+		return nil, err
+	}
+	row, changes, err := t.watchInsert(row)
+	if err != nil {
+		return nil, err
+	}
+	stored, err := t.tbl.InsertReturning(t.db.bufmgr, row)
+	if err != nil {
+		return nil, err
+	}
+	if changes != nil {
+		return t.fromStored(stored), changes.publish()
+	}
+	return t.fromStored(stored), t.publishInserted(stored)
+}
+
+// Upsert は行を書き込む。同じキーの行があれば置き換え、なければ挿入する
+func (t *Table) Upsert(row Tuple) error {
+	defer t.db.deliver()
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	row, err := t.toStored(row)
+	if err != nil {
+		return err
+	}
+	// 採番するキーを先に決めて、書き込む前の行を読めるようにする
+	row, err = t.tbl.Prepare(t.db.bufmgr, row)
+	if err != nil {
+		return err
+	}
+	changes, err := t.watchRow(t.rowKey(row))
+	if err != nil {
+		return err
+	}
+	if err := t.tbl.Upsert(t.db.bufmgr, row); err != nil {
+		return err
+	}
+	return changes.publish()
+}
+
+// InsertIgnore は同じキーの行がなければ挿入し、挿入したかを返す
+// 同じキーの行があればエラーにせずに何もしない
+func (t *Table) InsertIgnore(row Tuple) (bool, error) {
+	defer t.db.deliver()
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return false, err
+	}
+	row, err := t.toStored(row)
+	if err != nil {
+		return false, err
+	}
+	row, err = t.tbl.Prepare(t.db.bufmgr, row)
+	if err != nil {
+		return false, err
+	}
+	changes, err := t.watchRow(t.rowKey(row))
+	if err != nil {
+		return false, err
+	}
+	inserted, err := t.tbl.InsertIgnore(t.db.bufmgr, row)
+	if err != nil {
+		return false, err
+	}
+	return inserted, changes.publish()
+}
+
+// Delete はキーに一致する行を削除する
+// 行がなければ btree.ErrKeyNotFound を返す
+func (t *Table) Delete(key Tuple) error {
+	defer t.db.deliver()
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	changes, err := t.watchRow(key)
+	if err != nil {
+		return err
+	}
+	if err := t.tbl.Delete(t.db.bufmgr, key); err != nil {
+		return err
+	}
+	return changes.publish()
+}
+
+// Get はキーに一致する行を返す。行がなければ ErrNotFound を返す
+func (t *Table) Get(key Tuple) (Tuple, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	row, found, err := get(t.db.bufmgr, t.tbl, key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotFound
+	}
+	return t.fromStored(row), nil
+}
+
+// get はキーに一致する行を探す
+func get(bufmgr *buffer.BufferPoolManager, tbl *table.SimpleTable, key Tuple) (Tuple, bool, error) {
+	iter, err := tbl.ScanFrom(bufmgr, key)
+	if err != nil {
+		return nil, false, err
+	}
+	defer iter.Close(bufmgr)
+	row, err := iter.Next(bufmgr)
+	if err != nil || row == nil || len(row) < len(key) {
+		return nil, false, err
+	}
+	for i := range key {
+		if !bytes.Equal(row[i], key[i]) {
+			return nil, false, nil
+		}
+	}
+	return row, true, nil
+}
+
+// Count はテーブルの行数を返す
+func (t *Table) Count() (int, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return 0, err
+	}
+	return t.tbl.Count(t.db.bufmgr)
+}
+
+// Scan は opts で絞り込み・射影しながら全行を順に読む Rows を返す
+// 最後まで読まずに打ち切る場合は Close を呼ぶこと
+func (t *Table) Scan(opts ScanOptions) (*Rows, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	opts, fill := t.scanOptions(opts)
+	iter, err := t.tbl.ScanWithOptions(t.db.bufmgr, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{db: t.db, table: t, iter: iter, fill: fill}, nil
+}
+
+// ScanPrefix はキーの先頭の列が prefix に等しい行だけを、キーの順に読む Rows を返す
+// (a, b, c) をキーにしたテーブルでは (a) だけでも (a, b) までを指定してもよく、B-treeの
+// 該当する範囲だけを読む。prefix がキーの列数より多ければ table.ErrKeyColumnsMismatch を返す
+// Rows.Token は接頭辞も覚えているので、Resume で続きを読んでも範囲の外には出ない
+func (t *Table) ScanPrefix(prefix Tuple, opts ScanOptions) (*Rows, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	opts, fill := t.scanOptions(opts)
+	iter, err := t.tbl.ScanPrefixWithOptions(t.db.bufmgr, prefix, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{db: t.db, table: t, iter: iter, fill: fill}, nil
+}
+
+// Resume は Rows.Token で書き出した位置の続きから読む Rows を返す
+// 絞り込みと射影はトークンに含まれないので、最初の Scan と同じ opts を渡す
+// 壊れたトークンには btree.ErrInvalidToken を返す
+func (t *Table) Resume(token []byte, opts ScanOptions) (*Rows, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	opts, fill := t.scanOptions(opts)
+	iter, err := t.tbl.ResumeWithOptions(t.db.bufmgr, token, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{db: t.db, table: t, iter: iter, fill: fill}, nil
+}
+
+// Rows はスキャンの結果を1行ずつ返す
+type Rows struct {
+	db    *DB
+	table *Table
+	iter  *table.TableIter
+	fill  func(Tuple) // 足した列を既定値で埋める。ALTER していないテーブルでは nil
+}
+
+// Next は次の行を返す。終端に達したら nil を返す
+func (r *Rows) Next() (Tuple, error) {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	if err := r.table.check(); err != nil {
+		return nil, err
+	}
+	row, err := r.iter.Next(r.db.bufmgr)
+	if row != nil && r.fill != nil {
+		r.fill(row)
+	}
+	return row, err
+}
+
+// Token は最後に読んだ行の位置を、Table.Resume に渡せる不透明なバイト列にする
+// Close した後でも使えるので、ページ送りでは1ページ分読んだら Close してトークンを返す。
+// URL に載せるなら base64.RawURLEncoding などで文字列にする
+func (r *Rows) Token() []byte {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	return r.iter.Token()
+}
+
+// Close はスキャンが保持しているページのピンを外す
+func (r *Rows) Close() {
+	r.db.mu.Lock()
+	defer r.db.mu.Unlock()
+	r.iter.Close(r.db.bufmgr)
+}
+
+// Tx は Update の中で積む書き込み
+// まだ分離はなく、Tx の中の読み込みは積んだ書き込みを見ない
+type Tx struct {
+	db         *DB
+	ops        []txOp      // 積んだ書き込み
+	savepoints []savepoint // 作った順
+	err        error       // 積めなかった書き込みのエラー。Update が返す
+}
+
+// txOpKind は Tx に積んだ書き込みの種類
+type txOpKind int
+
+const (
+	txPut txOpKind = iota
+	txInsert
+	txInsertIgnore
+	txDelete
+)
+
+// txOp は Tx に積んだ1つの書き込み
+// 行は積んだときの列の対応で格納する形にしておく。格納した行での位置は ALTER しても
+// 変わらないので、既定値や NOT NULL は Update が db.mu を取ってから今の対応で確かめる
+type txOp struct {
+	kind  txOpKind
+	table *Table
+	row   Tuple // 格納する形の行。txDelete ではキー
+}
+
+// savepoint は Savepoint を作ったときに積んでいた書き込みの数と、それまでに積めなかった書き込みのエラー
+type savepoint struct {
+	name string
+	ops  int
+	err  error
+}
+
+// Put は行の書き込みを積む。同じキーの行があれば置き換える
+func (tx *Tx) Put(t *Table, row Tuple) {
+	tx.add(txPut, t, row)
+}
+
+// Insert は行の挿入を積む。同じキーの行があれば Update が失敗する
+func (tx *Tx) Insert(t *Table, row Tuple) {
+	tx.add(txInsert, t, row)
+}
+
+// InsertIgnore は行の挿入を積む。同じキーの行があれば何もしない
+func (tx *Tx) InsertIgnore(t *Table, row Tuple) {
+	tx.add(txInsertIgnore, t, row)
+}
+
+// Delete はキーに一致する行の削除を積む。行がなければ何もしない
+func (tx *Tx) Delete(t *Table, key Tuple) {
+	tx.ops = append(tx.ops, txOp{kind: txDelete, table: t, row: cloneTuple(key)})
+}
+
+// add は行を書き込む操作を積む
+// 呼び出し側が後で row を書き換えても積んだ行が変わらないよう、コピーして持っておく
+func (tx *Tx) add(kind txOpKind, t *Table, row Tuple) {
+	stored, err := t.storedRow(row)
+	if err != nil {
+		tx.fail(err)
+		return
+	}
+	tx.ops = append(tx.ops, txOp{kind: kind, table: t, row: cloneTuple(stored)})
+}
+
+// batch は積んだ書き込みを WriteBatch に積み、書き込む行と共に返す
+// WriteBatch は積むときにテーブルの既定値と NOT NULL を読むので、ALTER と競合しないよう
+// ここまで積むのを遅らせている。呼び出し時は db.mu を保持していること
+func (tx *Tx) batch() (*table.WriteBatch, []watchedRow, error) {
+	batch := table.NewWriteBatch()
+	rows := make([]watchedRow, 0, len(tx.ops))
+	for _, op := range tx.ops {
+		t := op.table
+		if err := t.check(); err != nil {
+			return nil, nil, err
+		}
+		if op.kind == txDelete {
+			batch.Delete(t.tbl, op.row)
+			rows = append(rows, watchedRow{table: t, key: op.row})
+			continue
+		}
+		switch op.kind {
+		case txPut:
+			batch.Put(t.tbl, op.row)
+		case txInsert:
+			batch.Insert(t.tbl, op.row)
+		case txInsertIgnore:
+			batch.InsertIgnore(t.tbl, op.row)
+		}
+		rows = append(rows, watchedRow{table: t, key: t.rowKey(op.row)})
+	}
+	return batch, rows, nil
+}
+
+// cloneTuple は row を列のバイト列までコピーする。NULL（nil）の列は nil のまま残す
+func cloneTuple(row Tuple) Tuple {
+	clone := make(Tuple, len(row))
+	for i, value := range row {
+		if value != nil {
+			clone[i] = bytes.Clone(value)
+		}
+	}
+	return clone
+}
+
+// fail は積めなかった書き込みのエラーを覚えておく。Update は最初のエラーを返す
+func (tx *Tx) fail(err error) {
+	if tx.err == nil {
+		tx.err = err
+	}
+}
+
+// Savepoint は今までに積んだ書き込みの位置に名前を付ける
+// 同じ名前で作り直すと、RollbackTo は新しい方に戻る
+//
+// RollbackTo で戻せるのは、積むときに分かるエラー（列数や NOT NULL の違反など）までになる。
+// キーの重複は Update の最後に書き込みを適用するときに初めて分かるので、
+// セーブポイントに戻っても避けられず、Update 全体が失敗する
+func (tx *Tx) Savepoint(name string) {
+	tx.savepoints = append(tx.savepoints, savepoint{name: name, ops: len(tx.ops), err: tx.err})
+}
+
+// RollbackTo は Savepoint の後に積んだ書き込みを捨てる。それまでに積んだ書き込みは残る
+// Savepoint の後に積めなかった書き込みのエラーも忘れるので、戻った後は Update が成功できる
+// セーブポイント自体は残るので、同じ名前に何度でも戻れる。その後に作ったセーブポイントは消える
+// 名前のセーブポイントがなければ ErrSavepointNotFound を返す
+//
+// 書き込みは Update の最後にまとめて適用するので、戻せるのは積んだ書き込みだけになる。
+// キーの重複のように適用するときに分かるエラーでは Update 全体が失敗する
+func (tx *Tx) RollbackTo(name string) error {
+	for i := len(tx.savepoints) - 1; i >= 0; i-- {
+		sp := tx.savepoints[i]
+		if sp.name != name {
+			continue
+		}
+		tx.ops = tx.ops[:sp.ops]
+		tx.err = sp.err
+		tx.savepoints = tx.savepoints[:i+1]
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrSavepointNotFound, name)
+}
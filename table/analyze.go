@@ -0,0 +1,324 @@
+package table
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"slices"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// 統計の既定値
+const (
+	DefaultAnalyzeSampleSize = 10000 // Analyze でヒストグラムのために残す行数
+	DefaultAnalyzeBuckets    = 32    // 列ごとのヒストグラムのバケット数
+)
+
+// distinctSketchSize は異なる値の数を見積もるときに残すハッシュ値の数
+// これより異なる値が少ない列では正確に数える
+const distinctSketchSize = 1024
+
+// エラー定義
+var (
+	ErrInvalidStatistics = errors.New("invalid table statistics")
+)
+
+// AnalyzeOptions は Analyze の設定
+type AnalyzeOptions struct {
+	// SampleSize はヒストグラムを作るために残す行数（0なら DefaultAnalyzeSampleSize）
+	// 行は全て読むが、メモリに残すのはこの数だけ
+	SampleSize int
+	// Buckets は列ごとのヒストグラムのバケット数（0なら DefaultAnalyzeBuckets）
+	Buckets int
+}
+
+// Statistics はテーブルの行と列の統計
+// 実行計画を選ぶときに、条件に合う行数を見積もるのに使う
+type Statistics struct {
+	Rows    int                // 行数
+	Sampled int                // ヒストグラムに使った行数
+	Columns []ColumnStatistics // 列ごとの統計。キーと値を合わせた Tuple での位置の順
+}
+
+// ColumnStatistics は1つの列の統計
+type ColumnStatistics struct {
+	Count    int // この列を持つ行の数
+	Distinct int // 異なる値の数の見積もり
+	// Bounds は等深ヒストグラムの境界。Bounds[0] が最小の値で、i 番目のバケットは
+	// [Bounds[i-1], Bounds[i]] の値を持ち、どのバケットにもほぼ同じ数の行が入る
+	// 多くの行が同じ値を持つ列では、同じ境界が続く
+	Bounds [][]byte
+}
+
+// Analyze はテーブルの全ての行を読んで、列ごとの統計を集める
+// 異なる値の数は全ての行の値のハッシュから見積もり、ヒストグラムは
+// リザーバサンプリングで残した SampleSize 行から作る。SoftDelete で削除した行は数えない
+func Analyze(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, opts AnalyzeOptions) (*Statistics, error) {
+	return AnalyzeContext(context.Background(), bufmgr, tbl, opts)
+}
+
+// AnalyzeContext は Analyze と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func AnalyzeContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, opts AnalyzeOptions) (*Statistics, error) {
+	sampleSize := opts.SampleSize
+	if sampleSize <= 0 {
+		sampleSize = DefaultAnalyzeSampleSize
+	}
+	buckets := opts.Buckets
+	if buckets <= 0 {
+		buckets = DefaultAnalyzeBuckets
+	}
+
+	iter, err := tbl.ScanContext(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(bufmgr)
+
+	// 同じテーブルには同じ統計を返すよう、乱数の種は固定する
+	rng := rand.New(rand.NewSource(1))
+	stats := &Statistics{}
+	var sketches []*distinctSketch
+	var sample []Tuple
+	for {
+		row, err := iter.NextContext(ctx, bufmgr)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			break
+		}
+		stats.Rows++
+		for len(stats.Columns) < len(row) {
+			stats.Columns = append(stats.Columns, ColumnStatistics{})
+			sketches = append(sketches, newDistinctSketch())
+		}
+		for i, value := range row {
+			stats.Columns[i].Count++
+			sketches[i].add(value)
+		}
+		if len(sample) < sampleSize {
+			sample = append(sample, row)
+		} else if j := rng.Intn(stats.Rows); j < sampleSize {
+			sample[j] = row
+		}
+	}
+
+	stats.Sampled = len(sample)
+	for i := range stats.Columns {
+		col := &stats.Columns[i]
+		col.Distinct = min(sketches[i].estimate(), col.Count)
+		var values [][]byte
+		for _, row := range sample {
+			if i < len(row) {
+				values = append(values, row[i])
+			}
+		}
+		col.Bounds = equiDepthBounds(values, buckets)
+	}
+	return stats, nil
+}
+
+// equiDepthBounds は values をソートして、buckets 個のバケットに同じ数ずつ分ける境界を返す
+func equiDepthBounds(values [][]byte, buckets int) [][]byte {
+	if len(values) == 0 {
+		return nil
+	}
+	slices.SortFunc(values, bytes.Compare)
+	buckets = min(buckets, len(values))
+	bounds := make([][]byte, 0, buckets+1)
+	bounds = append(bounds, values[0])
+	for b := 1; b <= buckets; b++ {
+		bounds = append(bounds, values[b*len(values)/buckets-1])
+	}
+	return bounds
+}
+
+// Selectivity は列の値が [lo, hi] に入る行の割合（0〜1）を見積もる。割合は列を持つ行に対するもの
+// lo, hi に nil を渡すとその側は無制限になる。lo と hi が等しければ 1 / Distinct を返す。
+// 範囲はヒストグラムのバケット単位で数え、範囲の端にかかるバケットは半分が入るとみなす
+func (c *ColumnStatistics) Selectivity(lo, hi []byte) float64 {
+	if c.Count == 0 || len(c.Bounds) == 0 {
+		return 0
+	}
+	minValue, maxValue := c.Bounds[0], c.Bounds[len(c.Bounds)-1]
+	if (lo != nil && bytes.Compare(lo, maxValue) > 0) || (hi != nil && bytes.Compare(hi, minValue) < 0) {
+		return 0
+	}
+	if lo != nil && hi != nil {
+		switch cmp := bytes.Compare(lo, hi); {
+		case cmp > 0:
+			return 0
+		case cmp == 0:
+			return 1 / float64(max(c.Distinct, 1))
+		}
+	}
+
+	var covered float64
+	for i := 1; i < len(c.Bounds); i++ {
+		bucketLo, bucketHi := c.Bounds[i-1], c.Bounds[i]
+		if (hi != nil && bytes.Compare(bucketLo, hi) > 0) || (lo != nil && bytes.Compare(bucketHi, lo) < 0) {
+			continue
+		}
+		if (lo == nil || bytes.Compare(lo, bucketLo) <= 0) && (hi == nil || bytes.Compare(bucketHi, hi) <= 0) {
+			covered++
+		} else {
+			covered += 0.5
+		}
+	}
+	return covered / float64(len(c.Bounds)-1)
+}
+
+// EstimateRows は col 番目の列の値が [lo, hi] に入る行数を見積もる
+// 列の位置はキーと値を合わせた Tuple での位置で、統計にない列なら 0 を返す
+func (s *Statistics) EstimateRows(col int, lo, hi []byte) int {
+	if col < 0 || col >= len(s.Columns) {
+		return 0
+	}
+	c := &s.Columns[col]
+	return int(math.Round(float64(c.Count) * c.Selectivity(lo, hi)))
+}
+
+// Encode は統計をカタログなどに格納するバイト列にする
+// フォーマット: 全て uvarint で、値の長さの後に値のバイト列を続ける
+//
+//	[rows] [sampled] [num_columns] ([count] [distinct] [num_bounds] ([len] [bound])...)...
+func (s *Statistics) Encode() []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(s.Rows))
+	b = binary.AppendUvarint(b, uint64(s.Sampled))
+	b = binary.AppendUvarint(b, uint64(len(s.Columns)))
+	for _, col := range s.Columns {
+		b = binary.AppendUvarint(b, uint64(col.Count))
+		b = binary.AppendUvarint(b, uint64(col.Distinct))
+		b = binary.AppendUvarint(b, uint64(len(col.Bounds)))
+		for _, bound := range col.Bounds {
+			b = binary.AppendUvarint(b, uint64(len(bound)))
+			b = append(b, bound...)
+		}
+	}
+	return b
+}
+
+// DecodeStatistics は Encode したバイト列から統計を読み出す
+// 壊れていれば ErrInvalidStatistics を返す
+func DecodeStatistics(data []byte) (*Statistics, error) {
+	d := &statsDecoder{data: data}
+	stats := &Statistics{Rows: d.int(), Sampled: d.int()}
+	numColumns := d.int()
+	for i := 0; i < numColumns && d.err == nil; i++ {
+		col := ColumnStatistics{Count: d.int(), Distinct: d.int()}
+		numBounds := d.int()
+		for j := 0; j < numBounds && d.err == nil; j++ {
+			col.Bounds = append(col.Bounds, d.bytes())
+		}
+		stats.Columns = append(stats.Columns, col)
+	}
+	if d.err == nil && len(d.data) != 0 {
+		d.err = ErrInvalidStatistics
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return stats, nil
+}
+
+// statsDecoder は DecodeStatistics で uvarint を順に読む。途中で壊れていたら err を残す
+type statsDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *statsDecoder) int() int {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 || v > math.MaxInt {
+		d.err = ErrInvalidStatistics
+		return 0
+	}
+	d.data = d.data[n:]
+	return int(v)
+}
+
+func (d *statsDecoder) bytes() []byte {
+	n := d.int()
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = ErrInvalidStatistics
+		return nil
+	}
+	b := bytes.Clone(d.data[:n])
+	d.data = d.data[n:]
+	return b
+}
+
+// distinctSketch は値のハッシュのうち小さいものから distinctSketchSize 個を残し、
+// 異なる値の数を見積もる（K Minimum Values）。ハッシュが一様に散らばっていれば、
+// k 番目に小さいハッシュの大きさから全体の異なる値の数が分かる
+type distinctSketch struct {
+	seen   map[uint64]struct{}
+	hashes uint64MaxHeap
+}
+
+func newDistinctSketch() *distinctSketch {
+	return &distinctSketch{seen: make(map[uint64]struct{})}
+}
+
+func (s *distinctSketch) add(value []byte) {
+	h := fnv.New64a()
+	h.Write(value)
+	hash := mix64(h.Sum64())
+	if _, ok := s.seen[hash]; ok {
+		return
+	}
+	if len(s.hashes) == distinctSketchSize {
+		if hash >= s.hashes[0] {
+			return
+		}
+		delete(s.seen, heap.Pop(&s.hashes).(uint64))
+	}
+	s.seen[hash] = struct{}{}
+	heap.Push(&s.hashes, hash)
+}
+
+func (s *distinctSketch) estimate() int {
+	if len(s.hashes) < distinctSketchSize {
+		return len(s.hashes)
+	}
+	fraction := float64(s.hashes[0]) / math.MaxUint64
+	return int(math.Round(float64(distinctSketchSize-1) / fraction))
+}
+
+// mix64 はハッシュ値のビットをかき混ぜる（splitmix64 の仕上げ）
+// FNV は末尾の数バイトだけが違う値のハッシュが偏るので、そのままでは見積もりがずれる
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// uint64MaxHeap は最大のハッシュを先頭に置くヒープ
+type uint64MaxHeap []uint64
+
+func (h uint64MaxHeap) Len() int           { return len(h) }
+func (h uint64MaxHeap) Less(i, j int) bool { return h[i] > h[j] }
+func (h uint64MaxHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *uint64MaxHeap) Push(x any)        { *h = append(*h, x.(uint64)) }
+func (h *uint64MaxHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
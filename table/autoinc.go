@@ -0,0 +1,86 @@
+package table
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// エラー定義
+var (
+	ErrAutoIncrementInBatch = errors.New("auto increment key cannot be generated in a write batch")
+)
+
+// EncodeSequence は自動採番した値を列に入れる形（ビッグエンディアン8バイト）にする
+// バイト順が数の順になるので、採番したキーの行は採番した順に並ぶ
+func EncodeSequence(n uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, n)
+}
+
+// DecodeSequence は EncodeSequence の値を数に戻す。形式が違えば false を返す
+func DecodeSequence(b []byte) (uint64, bool) {
+	if len(b) != 8 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(b), true
+}
+
+// fillDefaults は NULL（列がないか nil）の列に Defaults の値を入れた行を返す
+// 埋める列がなければ tuple をそのまま返し、あればコピーを返す
+func (t *SimpleTable) fillDefaults(tuple Tuple) Tuple {
+	filled, copied := tuple, false
+	for col, value := range t.Defaults {
+		if !isNull(tuple, col) {
+			continue
+		}
+		if !copied || len(filled) <= col {
+			grown := make(Tuple, max(len(filled), col+1))
+			copy(grown, filled)
+			filled, copied = grown, true
+		}
+		filled[col] = value
+	}
+	return filled
+}
+
+// Prepare は書き込む行の NULL の列を埋めた行を返す
+// AutoIncrement のテーブルでキーの最初の列が NULL なら連番を払い出して入れ、
+// Defaults の列には既定値を入れる。Insert などは書き込む前に同じことをするので、
+// 書き込む前にキーを知りたいときに使う。埋めた行を渡せば連番は払い出し直さない
+func (t *SimpleTable) Prepare(bufmgr *buffer.BufferPoolManager, tuple Tuple) (Tuple, error) {
+	return t.prepare(context.Background(), bufmgr, tuple)
+}
+
+// prepare は Prepare の本体
+func (t *SimpleTable) prepare(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple) (Tuple, error) {
+	if t.AutoIncrement && isNull(tuple, 0) {
+		seq, err := t.btree().NextSequenceContext(ctx, bufmgr)
+		if err != nil {
+			return nil, err
+		}
+		generated := make(Tuple, max(len(tuple), 1))
+		copy(generated, tuple)
+		// 連番は0から払い出すので、採番する値は1から始める
+		generated[0] = EncodeSequence(seq + 1)
+		tuple = generated
+	}
+	return t.fillDefaults(tuple), nil
+}
+
+// prepareInBatch は WriteBatch に積む行の NULL の列を埋める
+// WriteBatch では連番を払い出せないので、AutoIncrement のキーが NULL なら ErrAutoIncrementInBatch を返す
+func (t *SimpleTable) prepareInBatch(tuple Tuple, position int) (Tuple, error) {
+	if t.AutoIncrement && isNull(tuple, 0) {
+		return tuple, fmt.Errorf("%w: position %d", ErrAutoIncrementInBatch, position)
+	}
+	return t.fillDefaults(tuple), nil
+}
+
+// InsertReturning は Insert と同じだが、書き込んだ行を返す
+// AutoIncrement で採番したキーや Defaults で埋めた列は、返した行で分かる
+func (t *SimpleTable) InsertReturning(bufmgr *buffer.BufferPoolManager, tuple Tuple) (Tuple, error) {
+	return t.InsertReturningContext(context.Background(), bufmgr, tuple)
+}
@@ -0,0 +1,284 @@
+package table
+
+import (
+	"bytes"
+	"context"
+	"sort"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// batchOpKind はバッチ内の操作の種類を表す
+type batchOpKind int
+
+const (
+	batchOpPut batchOpKind = iota
+	batchOpInsert
+	batchOpInsertIgnore
+	batchOpDelete
+)
+
+// batchOp はバッチに積まれた1つの操作
+type batchOp struct {
+	kind  batchOpKind
+	table *SimpleTable
+	key   []byte // エンコード済みのキー
+	value []byte // エンコード済みの値（Deleteでは nil）
+	err   error  // 積んだときに見つかった制約違反。Apply は何も適用せずにこれを返す
+}
+
+// undoRecord は適用済みの操作を取り消すための情報
+// 操作前に行が存在していれば、その時の値を保持する
+type undoRecord struct {
+	table    *SimpleTable
+	key      []byte
+	oldValue []byte
+	existed  bool
+}
+
+// WriteBatch は複数テーブルへの書き込みをまとめて適用するバッチ
+// トランザクションほどの機能は持たないが、積んだ操作は全て適用されるか、
+// 1つも適用されないかのどちらかになる
+//
+// Apply はテーブルにラッチを掛けない。適用の途中や取り消しの途中の行も他の読み書きから見え、
+// 同じテーブルへの書き込みが挟まると取り消しが他の書き込みを上書きする。
+// Apply の間は、バッチのテーブルへの他の読み書きを呼び出し側で止めること
+// （minidb.DB.Update は DB のロックを取ってから Apply する）
+type WriteBatch struct {
+	ops []batchOp
+}
+
+// NewWriteBatch は空のWriteBatchを作成する
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Put はTupleの書き込みをバッチに積む
+// 同じキーの行が既にあれば値を置き換える
+func (b *WriteBatch) Put(tbl *SimpleTable, tuple Tuple) {
+	b.add(batchOpPut, tbl, tuple)
+}
+
+// Insert はTupleの挿入をバッチに積む
+// Putと違い、同じキーの行が既にあれば Apply が *ConstraintError で失敗する
+// ConstraintError.Position はこの操作がバッチに積まれた位置になる
+func (b *WriteBatch) Insert(tbl *SimpleTable, tuple Tuple) {
+	b.add(batchOpInsert, tbl, tuple)
+}
+
+// InsertIgnore はTupleの挿入をバッチに積む
+// Insertと違い、同じキーの行が既にあれば何もしない
+func (b *WriteBatch) InsertIgnore(tbl *SimpleTable, tuple Tuple) {
+	b.add(batchOpInsertIgnore, tbl, tuple)
+}
+
+// add は行を書き込む操作をバッチに積む
+// NULL の列を埋めて制約を検査し、違反していれば Apply で返すエラーを操作に残す
+func (b *WriteBatch) add(kind batchOpKind, tbl *SimpleTable, tuple Tuple) {
+	tuple, err := tbl.prepareInBatch(tuple, len(b.ops))
+	if err == nil {
+		err = tbl.validate(tuple, len(b.ops))
+	}
+	key, value := SplitTuple(tuple, tbl.NumKeyElems)
+	b.ops = append(b.ops, batchOp{
+		kind:  kind,
+		table: tbl,
+		key:   tbl.encodeKey(key),
+		value: tbl.encodeValue(value),
+		err:   err,
+	})
+}
+
+// Delete はキーに一致する行の削除をバッチに積む
+// 行が存在しない場合は何もしない
+// SoftDelete が有効なテーブルでは削除済みの印を付ける
+func (b *WriteBatch) Delete(tbl *SimpleTable, key Tuple) {
+	b.ops = append(b.ops, batchOp{
+		kind:  batchOpDelete,
+		table: tbl,
+		key:   tbl.encodeKey(key),
+	})
+}
+
+// Len はバッチに積まれた操作の数を返す
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset はバッチを空にする
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Truncate は先頭から n 個の操作を残し、その後に積んだ操作を捨てる
+// Len で覚えておいた位置に戻すのに使う。n が Len 以上なら何もしない
+func (b *WriteBatch) Truncate(n int) {
+	if n < 0 {
+		n = 0
+	}
+	if n < len(b.ops) {
+		b.ops = b.ops[:n]
+	}
+}
+
+// Apply はバッチに積まれた操作を順番に適用する
+// 途中でエラーが発生した場合は、適用済みの操作を逆順に取り消してからエラーを返す
+//
+// このDBにはまだWALがないため、Apply中にプロセスがクラッシュした場合の
+// 原子性までは保証しない。永続化は従来通り bufmgr.Flush() で行う。
+// 他の読み書きに対する分離もないので、呼び出し側で止めておくこと（WriteBatch を参照）
+func (b *WriteBatch) Apply(bufmgr *buffer.BufferPoolManager) error {
+	return b.ApplyContext(context.Background(), bufmgr)
+}
+
+// ApplyContext は Apply と同じだが、ctx がキャンセルされたら適用済みの操作を
+// 取り消して ctx.Err() を返す
+func (b *WriteBatch) ApplyContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	for _, op := range b.ops {
+		if op.err != nil {
+			return op.err
+		}
+	}
+
+	undo := make([]undoRecord, 0, len(b.ops))
+	for i, op := range b.ops {
+		oldValue, existed, err := op.table.lookup(ctx, bufmgr, op.key)
+		if err != nil {
+			return rollback(ctx, bufmgr, undo, err)
+		}
+
+		// 削除済みの印が付いた行や期限切れの行は存在しないものとして扱う
+		live := existed && op.table.isLive(op.key, oldValue)
+		if live && op.kind == batchOpInsert {
+			return rollback(ctx, bufmgr, undo, op.table.duplicateKeyError(op.key, i, btree.ErrDuplicateKey))
+		}
+		if live && op.kind == batchOpInsertIgnore {
+			continue
+		}
+
+		newValue := op.value
+		if op.kind == batchOpDelete {
+			if !live {
+				continue
+			}
+			newValue = nil
+			if op.table.SoftDelete {
+				newValue = op.table.markDeleted(oldValue)
+			}
+		}
+
+		if existed {
+			if err := op.table.deleteEncoded(ctx, bufmgr, op.key); err != nil {
+				return rollback(ctx, bufmgr, undo, err)
+			}
+		}
+		undo = append(undo, undoRecord{
+			table:    op.table,
+			key:      op.key,
+			oldValue: oldValue,
+			existed:  existed,
+		})
+
+		if newValue != nil {
+			if err := op.table.insertEncoded(ctx, bufmgr, op.key, newValue); err != nil {
+				return rollback(ctx, bufmgr, undo, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// rollback は適用済みの操作を逆順に取り消し、元のエラーを返す
+// 取り消しに失敗した場合はそのエラーを返す
+func rollback(ctx context.Context, bufmgr *buffer.BufferPoolManager, undo []undoRecord, cause error) error {
+	// 取り消しは ctx がキャンセルされていても最後まで行う
+	ctx = context.WithoutCancel(ctx)
+	for i := len(undo) - 1; i >= 0; i-- {
+		rec := undo[i]
+		_, exists, err := rec.table.lookup(ctx, bufmgr, rec.key)
+		if err != nil {
+			return err
+		}
+		if exists {
+			if err := rec.table.deleteEncoded(ctx, bufmgr, rec.key); err != nil {
+				return err
+			}
+		}
+		if rec.existed {
+			if err := rec.table.insertEncoded(ctx, bufmgr, rec.key, rec.oldValue); err != nil {
+				return err
+			}
+		}
+	}
+	return cause
+}
+
+// InsertBatch は複数の行をまとめて挿入する
+// 全ての行が挿入されるか、1行も挿入されないかのどちらかになる
+//
+// 行はキーの順に並べ替えてから挿入する。続く行は同じリーフに入ることが多いので、
+// 1行ずつ Insert するよりページの読み込みが少なく、WriteBatch と違って行ごとの
+// 存在確認もしない。既存の行やバッチ内の別の行とキーが重複した場合は
+// *ConstraintError を返す。ConstraintError.Position は tuples の中の位置になる
+func (t *SimpleTable) InsertBatch(bufmgr *buffer.BufferPoolManager, tuples []Tuple) error {
+	return t.InsertBatchContext(context.Background(), bufmgr, tuples)
+}
+
+// InsertBatchContext は InsertBatch と同じだが、ctx がキャンセルされたら
+// 挿入済みの行を取り消して ctx.Err() を返す
+func (t *SimpleTable) InsertBatchContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuples []Tuple) error {
+	type row struct {
+		position int
+		key      []byte
+		value    []byte
+	}
+	rows := make([]row, len(tuples))
+	for i, tuple := range tuples {
+		tuple, err := t.prepare(ctx, bufmgr, tuple)
+		if err != nil {
+			return err
+		}
+		if err := t.validate(tuple, i); err != nil {
+			return err
+		}
+		key, value := SplitTuple(tuple, t.NumKeyElems)
+		rows[i] = row{position: i, key: t.encodeKey(key), value: t.encodeValue(value)}
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		return bytes.Compare(rows[i].key, rows[j].key) < 0
+	})
+
+	// バッチ内の重複は木に触れる前に見つける（後から積まれた方を違反とする）
+	for i := 1; i < len(rows); i++ {
+		if bytes.Equal(rows[i-1].key, rows[i].key) {
+			return t.duplicateKeyError(rows[i].key, rows[i].position, btree.ErrDuplicateKey)
+		}
+	}
+
+	undo := make([]undoRecord, 0, len(rows))
+	for _, r := range rows {
+		err := t.insertEncoded(ctx, bufmgr, r.key, r.value)
+		if err == nil {
+			undo = append(undo, undoRecord{table: t, key: r.key})
+			continue
+		}
+		if err == btree.ErrDuplicateKey && (t.SoftDelete || t.Expiry) {
+			// 削除済みか期限切れの行なら置き換えてよい。取り消せるよう元の値を控えておく
+			oldValue, _, lookupErr := t.lookup(ctx, bufmgr, r.key)
+			if lookupErr != nil {
+				return rollback(ctx, bufmgr, undo, lookupErr)
+			}
+			if err = t.reviveDeleted(ctx, bufmgr, r.key, r.value); err == nil {
+				undo = append(undo, undoRecord{table: t, key: r.key, oldValue: oldValue, existed: true})
+				continue
+			}
+		}
+		if err == btree.ErrDuplicateKey {
+			err = t.duplicateKeyError(r.key, r.position, err)
+		}
+		return rollback(ctx, bufmgr, undo, err)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// TupleCodec は Tuple とB-treeに格納するバイト列を相互に変換する
+// テーブルごとに設定でき、固定長の行や圧縮した行などの別の形式を
+// SimpleTable を書き換えずに導入できる
+//
+// キーと値は別々に Encode される。B-treeはエンコードしたキーをバイト列として
+// 比べて並べるので、CompareKey は bytes.Compare と同じ順序を返さなければならない
+type TupleCodec interface {
+	// Encode は Tuple をバイト列にする
+	Encode(tuple Tuple) []byte
+	// Decode は Encode で作ったバイト列から Tuple を戻す
+	Decode(data []byte) Tuple
+	// CompareKey はエンコードしたキーどうしを比べ、a < b なら負、a == b なら0、a > b なら正を返す
+	CompareKey(a, b []byte) int
+}
+
+// PrefixCodec はキーの先頭の列から、それらの列で始まる全てのキーのエンコードに
+// 共通する接頭辞を作れる TupleCodec。ScanPrefix はこれを実装したコーデックでだけ使える
+type PrefixCodec interface {
+	// EncodePrefix は numKeyElems 列のキーのうち、先頭の列が prefix に等しいキーの
+	// エンコードが全て持つ接頭辞を返す
+	EncodePrefix(prefix Tuple, numKeyElems int) []byte
+}
+
+// DefaultCodec は Tuple.Encode と DecodeTuple の形式を使う TupleCodec
+// Options.Codec を指定しないテーブルはこれを使う
+var DefaultCodec TupleCodec = defaultCodec{}
+
+type defaultCodec struct{}
+
+func (defaultCodec) Encode(tuple Tuple) []byte { return tuple.Encode() }
+
+func (defaultCodec) Decode(data []byte) Tuple { return DecodeTuple(data) }
+
+func (defaultCodec) CompareKey(a, b []byte) int { return bytes.Compare(a, b) }
+
+// EncodePrefix は要素数を numKeyElems にして、prefix の要素だけを Tuple.Encode と同じ形で並べる
+func (defaultCodec) EncodePrefix(prefix Tuple, numKeyElems int) []byte {
+	encoded := prefix.Encode()
+	binary.LittleEndian.PutUint16(encoded[0:2], uint16(numKeyElems))
+	return encoded
+}
+
+// codec はテーブルの TupleCodec を返す
+func (t *SimpleTable) codec() TupleCodec {
+	if t.Codec == nil {
+		return DefaultCodec
+	}
+	return t.Codec
+}
+
+// encodeKey はキーの Tuple をエンコードする
+func (t *SimpleTable) encodeKey(key Tuple) []byte {
+	return t.codec().Encode(key)
+}
+
+// decodeKey はエンコード済みのキーをデコードする
+func (t *SimpleTable) decodeKey(data []byte) Tuple {
+	return t.codec().Decode(data)
+}
@@ -0,0 +1,110 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 制約の名前
+const (
+	// ConstraintPrimaryKey はキーの一意性制約
+	ConstraintPrimaryKey = "primary key"
+	// ConstraintNotNull は Options.NotNull の列に値を求める制約
+	ConstraintNotNull = "not null"
+)
+
+// エラー定義
+var (
+	ErrNullValue   = errors.New("null value in not null column")
+	ErrCheckFailed = errors.New("check constraint failed")
+)
+
+// Check は1つの列の値を検査する制約
+// SQL の式はまだ書けないので、式の代わりに Go の関数で条件を与える
+type Check struct {
+	Name   string                  // 制約の名前。違反したときの ConstraintError.Constraint になる
+	Column int                     // 検査する列（キーと値を合わせた Tuple での位置）
+	Valid  func(value []byte) bool // 値が条件を満たすか。SQL と同じく NULL の列では呼ばない
+}
+
+// ConstraintError は制約違反を、違反した行の情報と一緒に表すエラー
+// ローダーはこれを見て、どの行をなぜ読み飛ばしたのかを正確に報告できる
+//
+//	var cerr *table.ConstraintError
+//	if errors.As(err, &cerr) {
+//	    log.Printf("op %d: %s violated by key %s", cerr.Position, cerr.Constraint, cerr.Key)
+//	}
+type ConstraintError struct {
+	Constraint string // 違反した制約の名前（ConstraintPrimaryKey など）
+	Columns    []int  // 制約の対象の列番号（Tuple上の位置）
+	Key        Tuple  // 違反した行のキー
+	Position   int    // WriteBatch 内の操作や InsertBatch に渡した行の位置（0始まり、単独の操作なら0）
+	Err        error  // 元になったエラー（btree.ErrDuplicateKey など）
+}
+
+func (e *ConstraintError) Error() string {
+	key := make([]string, len(e.Key))
+	for i, elem := range e.Key {
+		key[i] = fmt.Sprintf("%q", elem)
+	}
+	return fmt.Sprintf("%s constraint violated at position %d (columns %v, key [%s]): %v",
+		e.Constraint, e.Position, e.Columns, strings.Join(key, " "), e.Err)
+}
+
+// Unwrap は errors.Is(err, btree.ErrDuplicateKey) や errors.Is(err, ErrNullValue) で判定できるようにする
+func (e *ConstraintError) Unwrap() error {
+	return e.Err
+}
+
+// keyColumns はキーを構成する列番号を返す
+func (t *SimpleTable) keyColumns() []int {
+	columns := make([]int, t.NumKeyElems)
+	for i := range columns {
+		columns[i] = i
+	}
+	return columns
+}
+
+// duplicateKeyError はキーの重複を ConstraintError にする
+func (t *SimpleTable) duplicateKeyError(key []byte, position int, err error) *ConstraintError {
+	return &ConstraintError{
+		Constraint: ConstraintPrimaryKey,
+		Columns:    t.keyColumns(),
+		Key:        t.decodeKey(key),
+		Position:   position,
+		Err:        err,
+	}
+}
+
+// isNull は tuple の col 番目の列が NULL（列がないか nil）かを返す
+// nil と空のバイト列は格納すると区別できないので、書き込む前の Tuple で判定する
+func isNull(tuple Tuple, col int) bool {
+	return col >= len(tuple) || tuple[col] == nil
+}
+
+// validate は書き込む行が NotNull と Checks を満たすかを確かめる
+// 違反していれば、最初に違反した制約の *ConstraintError を返す
+func (t *SimpleTable) validate(tuple Tuple, position int) error {
+	violation := func(constraint string, col int, err error) error {
+		key, _ := SplitTuple(tuple, t.NumKeyElems)
+		return &ConstraintError{
+			Constraint: constraint,
+			Columns:    []int{col},
+			Key:        key,
+			Position:   position,
+			Err:        err,
+		}
+	}
+	for _, col := range t.NotNull {
+		if isNull(tuple, col) {
+			return violation(ConstraintNotNull, col, ErrNullValue)
+		}
+	}
+	for _, check := range t.Checks {
+		if !isNull(tuple, check.Column) && !check.Valid(tuple[check.Column]) {
+			return violation(check.Name, check.Column, ErrCheckFailed)
+		}
+	}
+	return nil
+}
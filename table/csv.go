@@ -0,0 +1,215 @@
+package table
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// DefaultCSVBatchSize はCSVの読み込みで1回にまとめて挿入する行数の既定値
+const DefaultCSVBatchSize = 1000
+
+// エラー定義
+var (
+	ErrKeyColumnsMismatch = errors.New("number of key columns does not match table")
+)
+
+// CSVOptions はCSVの読み込み方法を指定する
+type CSVOptions struct {
+	// KeyColumns はキーとして使うCSVの列番号（0始まり）
+	// 省略した場合は先頭から NumKeyElems 列をキーとする
+	KeyColumns []int
+	// Header が true なら先頭行をヘッダーとして読み飛ばす
+	Header bool
+	// Comma は区切り文字（0ならカンマ）
+	Comma rune
+	// BatchSize は1回にまとめて挿入する行数（0なら DefaultCSVBatchSize）
+	BatchSize int
+}
+
+// RowError はCSVの特定の行で発生したエラー
+type RowError struct {
+	Line int   // CSV上の行番号（1始まり）
+	Err  error // 発生したエラー
+}
+
+func (e RowError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e RowError) Unwrap() error {
+	return e.Err
+}
+
+// ImportResult はCSVの読み込み結果
+type ImportResult struct {
+	Inserted int        // 挿入できた行数
+	Errors   []RowError // 挿入できなかった行とその理由
+}
+
+// csvRow は挿入待ちの1行
+type csvRow struct {
+	line  int
+	tuple Tuple
+}
+
+// ImportCSV はCSVを読み込んでテーブルに挿入する
+//
+// 各行は KeyColumns の列をキーとしてTupleに変換される。Tupleの並びは
+// キー列（KeyColumns の順）の後に残りの列（CSV上の順）が続く形になる。
+// 行は BatchSize 件ずつ WriteBatch でまとめて挿入し、バッチが失敗した場合は
+// 1行ずつ挿入し直して、失敗した行を ImportResult.Errors に記録する。
+// 行単位のエラーでは処理を止めず、読み込み自体の失敗のみエラーとして返す。
+func ImportCSV(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, r io.Reader, opts CSVOptions) (*ImportResult, error) {
+	keyColumns := opts.KeyColumns
+	if keyColumns == nil {
+		keyColumns = make([]int, tbl.NumKeyElems)
+		for i := range keyColumns {
+			keyColumns[i] = i
+		}
+	}
+	if len(keyColumns) != tbl.NumKeyElems {
+		return nil, ErrKeyColumnsMismatch
+	}
+	batchSize := opts.BatchSize
+	if batchSize <= 0 {
+		batchSize = DefaultCSVBatchSize
+	}
+
+	reader := csv.NewReader(r)
+	if opts.Comma != 0 {
+		reader.Comma = opts.Comma
+	}
+	// 列数のチェックは行ごとに自前で行う
+	reader.FieldsPerRecord = -1
+
+	result := &ImportResult{}
+	pending := make([]csvRow, 0, batchSize)
+	skipHeader := opts.Header
+
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return result, err
+			}
+			result.Errors = append(result.Errors, RowError{Line: parseErr.StartLine, Err: err})
+			continue
+		}
+		line, _ := reader.FieldPos(0)
+		if skipHeader {
+			skipHeader = false
+			continue
+		}
+
+		tuple, err := recordToTuple(record, keyColumns)
+		if err != nil {
+			result.Errors = append(result.Errors, RowError{Line: line, Err: err})
+			continue
+		}
+		pending = append(pending, csvRow{line: line, tuple: tuple})
+
+		if len(pending) >= batchSize {
+			insertCSVRows(bufmgr, tbl, pending, result)
+			pending = pending[:0]
+		}
+	}
+	insertCSVRows(bufmgr, tbl, pending, result)
+
+	// 変換エラーはその場で、挿入エラーはバッチ単位で記録されるので行番号順に並べ直す
+	sort.SliceStable(result.Errors, func(i, j int) bool {
+		return result.Errors[i].Line < result.Errors[j].Line
+	})
+	return result, nil
+}
+
+// recordToTuple はCSVの1行をTupleに変換する
+// キー列を先頭に、残りの列を元の順番で後ろに並べる
+func recordToTuple(record []string, keyColumns []int) (Tuple, error) {
+	isKey := make(map[int]bool, len(keyColumns))
+	tuple := make(Tuple, 0, len(record))
+	for _, col := range keyColumns {
+		if col < 0 || col >= len(record) {
+			return nil, fmt.Errorf("key column %d out of range (%d columns)", col, len(record))
+		}
+		isKey[col] = true
+		tuple = append(tuple, []byte(record[col]))
+	}
+	for col, field := range record {
+		if !isKey[col] {
+			tuple = append(tuple, []byte(field))
+		}
+	}
+	return tuple, nil
+}
+
+// insertCSVRows は行をまとめて挿入する
+// 制約違反でバッチが失敗した場合は、違反した行だけを記録して残りで挿入し直す
+// それ以外の理由で失敗した場合は1行ずつ挿入し直して、失敗した行を記録する
+func insertCSVRows(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, rows []csvRow, result *ImportResult) {
+	for len(rows) > 0 {
+		batch := NewWriteBatch()
+		for _, row := range rows {
+			batch.Insert(tbl, row.tuple)
+		}
+		err := batch.Apply(bufmgr)
+		if err == nil {
+			result.Inserted += len(rows)
+			return
+		}
+
+		var cerr *ConstraintError
+		if !errors.As(err, &cerr) {
+			break
+		}
+		bad := rows[cerr.Position]
+		result.Errors = append(result.Errors, RowError{Line: bad.line, Err: err})
+		rows = append(rows[:cerr.Position:cerr.Position], rows[cerr.Position+1:]...)
+	}
+
+	for _, row := range rows {
+		if err := tbl.Insert(bufmgr, row.tuple); err != nil {
+			result.Errors = append(result.Errors, RowError{Line: row.line, Err: err})
+			continue
+		}
+		result.Inserted++
+	}
+}
+
+// ExportCSV はテーブルの全行をCSVとして書き出す
+// 各行はTupleの並び（キー要素が先頭）のまま1レコードになる
+func ExportCSV(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, w io.Writer) error {
+	iter, err := tbl.Scan(bufmgr)
+	if err != nil {
+		return err
+	}
+	defer iter.Close(bufmgr)
+
+	writer := csv.NewWriter(w)
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			return err
+		}
+		if tuple == nil {
+			break
+		}
+		record := make([]string, len(tuple))
+		for i, elem := range tuple {
+			record[i] = string(elem)
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
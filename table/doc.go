@@ -31,6 +31,18 @@ Tupleの最初のn個の要素がキー、残りが値として扱われる：
 	       └───────┘ └──┘
 	          Key    Value
 
+# 行の形式
+
+キーと値の Tuple をB-treeに格納するバイト列に変換する方法は TupleCodec で差し替えられる。
+指定しなければ DefaultCodec（Tuple.Encode と DecodeTuple の形式）を使う。
+固定長の行や圧縮した行などの形式を、SimpleTable を書き換えずに試せる：
+
+	tbl, _ := table.CreateWithOptions(bufmgr, 1, table.Options{Codec: myCodec})
+
+B-treeはエンコードしたキーをバイト列として並べるので、CompareKey は
+bytes.Compare と同じ順序を返すこと。行の形式はディスク上のデータを決めるので、
+開く時も NewSimpleTableWithOptions で同じ Codec を指定する。
+
 # 使用例
 
 	// テーブル作成（最初の1要素がキー）
@@ -45,6 +57,7 @@ Tupleの最初のn個の要素がキー、残りが値として扱われる：
 
 	// 全件スキャン
 	iter, _ := tbl.Scan(bufmgr)
+	defer iter.Close(bufmgr)
 	for {
 	    tuple, _ := iter.Next(bufmgr)
 	    if tuple == nil {
@@ -56,9 +69,255 @@ Tupleの最初のn個の要素がキー、残りが値として扱われる：
 	// キーを指定してスキャン
 	iter, _ = tbl.ScanFrom(bufmgr, table.Tuple{[]byte("1")})
 
+	// Go 1.23 以降なら range で回せる。読み込みに失敗するとループが終わるので、後で Err を確かめる
+	iter, _ = tbl.Scan(bufmgr)
+	for row := range iter.All(bufmgr) {
+	    fmt.Println(row)
+	}
+	if err := iter.Err(); err != nil {
+	    log.Fatal(err)
+	}
+
+ScanPrefix はキーの先頭の列を指定して、その列が等しい行だけをスキャンする。
+(userID, timestamp) をキーにしたテーブルで、あるユーザーの行を時刻順に読める：
+
+	iter, _ = tbl.ScanPrefix(bufmgr, table.Tuple{[]byte("user42")})
+
+コーデックを指定したテーブルでは、コーデックが PrefixCodec を実装している必要がある。
+ScanPrefixWithOptions は ScanOptions で絞り込み・射影しながら同じ範囲を読む。
+
+# ページ送り
+
+TableIter.Token は最後に読んだ行のキーを不透明なバイト列にする。Resume に渡すと、
+イテレータを閉じた後でもその続きからスキャンできるので、ページのピンを持ったまま
+次のリクエストを待たずに済む。間に書き込みがあっても、まだ返していない行から読む：
+
+	token := iter.Token()
+	iter.Close(bufmgr)
+	// 次のリクエストで
+	iter, err := tbl.ResumeWithOptions(bufmgr, token, opts)
+
+絞り込みと射影はトークンに含まれないので、最初のスキャンと同じ ScanOptions を渡す。
+
+# ゾーンマップ
+
+EnableZoneMapで列を指定すると、リーフごとにその列の最小値・最大値を記録する。
+ScanColumnRangeで範囲条件を指定してスキャンすると、条件に合う行を含み得ない
+リーフを丸ごと読み飛ばせる。時刻のようにキーと相関のある列で特に効果が大きい：
+
+	tbl.EnableZoneMap(bufmgr, 2) // 3列目の範囲を記録
+	iter, _ := tbl.ScanColumnRange(bufmgr, 2, []byte("2024-01-01"), []byte("2024-01-31"))
+
+ゾーンマップはメモリ上で更新する。SaveZoneMap で範囲を別のB-treeに書き出し、開き直したときに
+LoadZoneMap で読み戻せば全件スキャンせずに済む。書き出した後の書き込みは反映されないので、
+書き込む前に書き出したものを使わない印を付けておくこと（minidb.Table.EnableZoneMap はそうしている）。
+
+# 絞り込みと射影
+
+ScanWithOptions は Filter と Columns を受け取り、イテレータの中で行を絞り込み、
+必要な列だけを取り出す。指定しなかった列はデコードもコピーもしない：
+
+	iter, _ := tbl.ScanWithOptions(bufmgr, table.ScanOptions{
+	    Columns: []int{0, 2}, // ID と Age だけ
+	    Filter: func(tuple table.Tuple) bool {
+	        return string(tuple[1]) >= "20" // Columns で射影した後の行
+	    },
+	})
+
+行数だけが必要なら Count を使う。論理削除が無効なテーブルではリーフのペア数を
+足すだけで、行を1つも取り出さない：
+
+	n, _ := tbl.Count(bufmgr)
+
+# 結合
+
+2つのテーブルの行を、列の値が等しいものどうしで組にする関数が3つある：
+
+  - NestedLoopJoin: 左を BlockSize 行ずつメモリに読み、ブロックごとに右を1回スキャンする。
+    どの列でも結合でき、メモリも BlockSize 行分しか使わない
+  - HashJoin: 右からハッシュ表を作って左の行で引く。右の行数が MaxBuildRows を超えると
+    両方を結合列のハッシュで一時ファイルに分割し、分割ごとに結合する
+  - MergeJoin: 両方をキーの順に並行してスキャンする。キー全体どうしの結合に限られるが、
+    両方のテーブルを1回ずつ読むだけで済む
+
+Join は PlanJoin で方法を選んでから結合する。結合列が両方ともキー全体で同じ TupleCodec を
+使っていれば MergeJoin、左が BlockSize 行以下なら NestedLoopJoin、それ以外は HashJoin を選ぶ。
+どれを選ぶかは PlanJoin で確かめられる：
+
+	err := table.Join(bufmgr, users, orders, table.JoinOptions{LeftColumn: 0, RightColumn: 1},
+	    func(user, order table.Tuple) error {
+	        fmt.Println(string(user[1]), string(order[0]))
+	        return nil
+	    })
+	method, _ := table.PlanJoin(bufmgr, users, orders, table.JoinOptions{LeftColumn: 0, RightColumn: 1})
+	fmt.Println(method) // users が BlockSize 行を超えていれば "hash"
+
+# 置き換えと重複の無視
+
+Insert は同じキーの行があれば *ConstraintError を返す。何度読み込んでもよいデータには
+Upsert か InsertIgnore を使う。Upsert は同じキーの行を置き換え、InsertIgnore は
+同じキーの行があれば何もせずに false を返す。WriteBatch.Put と WriteBatch.InsertIgnore も同じ：
+
+	tbl.Upsert(bufmgr, table.Tuple{[]byte("1"), []byte("Alice")})
+	inserted, _ := tbl.InsertIgnore(bufmgr, table.Tuple{[]byte("1"), []byte("Alice")})
+
+# WriteBatch
+
+複数のテーブルにまたがる書き込みをまとめて適用したい場合はWriteBatchを使う。
+途中で失敗した場合は適用済みの操作が取り消され、全て適用されるか
+1つも適用されないかのどちらかになる：
+
+	batch := table.NewWriteBatch()
+	batch.Put(users, table.Tuple{[]byte("1"), []byte("Alice")})
+	batch.Delete(orders, table.Tuple{[]byte("100")})
+	err := batch.Apply(bufmgr)
+
+Apply はテーブルにラッチを掛けないので、他の読み書きからは適用の途中の行が見える。
+全て適用した後か前の状態だけを見せたいなら、Apply の間はバッチのテーブルへの読み書きを
+呼び出し側のロックで止める。minidb.DB.Update はそうしている。
+
+キーの重複などの制約違反は *ConstraintError で返り、違反した制約の名前・列・
+行のキー・バッチ内の位置が分かる。errors.Is(err, btree.ErrDuplicateKey) も使える：
+
+	var cerr *table.ConstraintError
+	if errors.As(err, &cerr) {
+	    fmt.Println(cerr.Position, cerr.Constraint, cerr.Key)
+	}
+
+Truncate は Len で覚えておいた位置より後に積んだ操作を捨てる。適用する前に、
+積みかけた一部の操作だけをやめるのに使う。
+
+1つのテーブルに多くの行を挿入するだけなら InsertBatch の方が速い。行をキーの順に
+並べ替えてから挿入するので、続く行は同じリーフに入り、行ごとの存在確認もしない。
+こちらも全ての行が挿入されるか、1行も挿入されないかのどちらかになり、
+ConstraintError.Position は渡したスライスの中の位置になる：
+
+	err := users.InsertBatch(bufmgr, []table.Tuple{
+	    {[]byte("3"), []byte("Carol")},
+	    {[]byte("2"), []byte("Bob")},
+	})
+
+# 列の制約
+
+Options の NotNull に挙げた列は NULL（列がないか nil）を許さず、Checks の関数は
+列の値を検査する。SQL の式はまだ書けないので、CHECK の条件は Go の関数で与える。
+SQL と同じく、NULL の列には Checks を適用しない：
+
+	tbl, _ := table.CreateWithOptions(bufmgr, 1, table.Options{
+	    NotNull: []int{1},
+	    Checks: []table.Check{{
+	        Name:   "age_positive",
+	        Column: 2,
+	        Valid:  func(v []byte) bool { return len(v) > 0 && v[0] != '-' },
+	    }},
+	})
+
+Insert・Upsert・InsertBatch と WriteBatch の Put・Insert・InsertIgnore は、違反した行を
+書き込まずに *ConstraintError を返す。Constraint は ConstraintNotNull か Check.Name で、
+errors.Is(err, table.ErrNullValue) や errors.Is(err, table.ErrCheckFailed) で見分けられる。
+WriteBatch は積んだときに検査し、違反があれば Apply が何も適用せずに返す。
+
+# 既定値と自動採番
+
+Options の Defaults は、書き込む行の列が NULL のときに入れる値を列ごとに与える。
+AutoIncrement を有効にすると、キーの最初の列が NULL の行を挿入するときに連番を入れる。
+連番は B-tree のメタページに記録した値（btree.BTree.NextSequence）から1始まりで払い出し、
+EncodeSequence の形（ビッグエンディアン8バイト）で入れるので、採番した行は採番した順に並ぶ。
+採番したキーは InsertReturning が返す行で分かる：
+
+	tbl, _ := table.CreateWithOptions(bufmgr, 1, table.Options{
+	    AutoIncrement: true,
+	    Defaults:      map[int][]byte{2: []byte("member")},
+	})
+	row, _ := tbl.InsertReturning(bufmgr, table.Tuple{nil, []byte("Alice")})
+	id, _ := table.DecodeSequence(row[0]) // 1
+
+キーを指定した行はそのまま挿入し、連番は進めない。採番した値と重なれば、後から挿入した方が
+キーの重複になる。取り消した挿入で払い出した連番は再利用しない。WriteBatch では連番を
+払い出せないので、キーが NULL の行を積むと Apply が ErrAutoIncrementInBatch を返す。
+
+# 論理削除
+
+Options の SoftDelete を有効にすると、値の末尾に墓標列を持たせる。
+Delete は墓標列に削除済みの印を付けるだけで行は残り、監査などで後から参照できる。
+通常のスキャンは削除済みの行を返さず、Purge を呼ぶまで物理的には削除されない：
+
+	tbl, _ := table.CreateWithOptions(bufmgr, 1, table.Options{SoftDelete: true})
+	tbl.Delete(bufmgr, table.Tuple{[]byte("1")})
+
+	iter, _ := tbl.ScanIncludingDeleted(bufmgr)
+	tuple, _ := iter.Next(bufmgr)
+	if iter.Deleted() {
+	    // 削除済みの行
+	}
+
+	n, _ := tbl.Purge(bufmgr) // 削除済みの行を物理的に消す
+
+墓標列はディスク上の値の形式を変えるので、開く時も NewSimpleTableWithOptions で
+同じオプションを指定すること。
+
+削除した行をデータファイルから確実に消す必要がある場合は、SoftDelete ではなく
+SecureDelete を有効にする。Delete や Purge で消した行のバイトは0で上書きされる。
+
+# 有効期限
+
+Options.Expiry を有効にすると、ExpiryColumn 番目の列を行の有効期限として扱う。
+列には EncodeExpiry で時刻を入れるか、InsertWithTTL で挿入時からの期間を指定する。
+期限が過ぎた行はスキャンと Count に現れず、同じキーで挿入し直せる。
+ページからは PurgeExpired で削除する：
+
+	tbl, _ := table.CreateWithOptions(bufmgr, 1, table.Options{Expiry: true, ExpiryColumn: 2})
+	tbl.InsertWithTTL(bufmgr, table.Tuple{[]byte("session1"), data}, 30*time.Minute)
+	n, _ := tbl.PurgeExpired(bufmgr)
+
+期限切れの判定には Options.Clock の時刻を使う（nilなら time.Now）。
+PurgeExpiredReturning は削除した行も返すので、行数などを別に数えているときに引ける。
+
+# CSVの読み込みと書き出し
+
+ImportCSVはCSVの各行をTupleに変換して挿入する。KeyColumnsでキーにする列を
+指定でき、失敗した行は処理を止めずに行番号付きで報告される：
+
+	result, err := table.ImportCSV(bufmgr, tbl, file, table.CSVOptions{
+	    KeyColumns: []int{0},
+	    Header:     true,
+	})
+	for _, rowErr := range result.Errors {
+	    fmt.Println(rowErr)
+	}
+
+	// 全行をCSVとして書き出す
+	table.ExportCSV(bufmgr, tbl, os.Stdout)
+
+# 作り直し
+
+Rebuild はテーブルのB-treeを、各ページを指定した割合まで詰めて作り直す。
+読み込みが中心なら 0.9 などで詰め、書き込みが多いなら 0.7 などで分割の余地を残す：
+
+	err := table.Rebuild(bufmgr, tbl, 0.9)
+
+新しいページに組み立て終えてからメタページのルートを付け替えるので、それまでは元の木のまま
+読める。作り直している間の書き込みは呼び出し側で止めておく。ゾーンマップは作り直される。
+
+Truncate は全ての行を消し、B-treeのページを空きページに戻す。メタページは変わらないので
+テーブルはそのまま使え、AutoIncrement の連番も巻き戻らない。
+
+# 統計
+
+Analyze はテーブルの全ての行を読み、列ごとに行数・異なる値の数の見積もり・
+等深ヒストグラムを集める。異なる値の数は値のハッシュの小さいものを残して見積もり、
+ヒストグラムはリザーバサンプリングで残した行から作る。EstimateRows は統計から、
+列の値が範囲に入る行数を見積もる。インデックスを使うかや結合の順を決めるのに使える：
+
+	stats, _ := table.Analyze(bufmgr, tbl, table.AnalyzeOptions{})
+	n := stats.EstimateRows(2, []byte("2024-01"), []byte("2024-03"))
+
+統計は行を書き換えても更新されない。Encode と DecodeStatistics で保存して読み出せる。
+
 # データの永続化
 
 SimpleTableはB-treeを使用するため、データは自動的にページに格納される。
 bufmgr.Flush()を呼び出すことでディスクに永続化できる。
+1つのテーブルのページだけを書き戻すには tbl.Flush(bufmgr) を使う。
 */
 package table
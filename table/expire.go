@@ -0,0 +1,196 @@
+package table
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// エラー定義
+var (
+	ErrExpiryDisabled = errors.New("table has no expiry column")
+)
+
+// 有効期限の列には、時刻を EncodeExpiry の形（UnixNano のビッグエンディアン8バイト）で入れる
+// バイト順が時刻の順になるので、ゾーンマップや ScanColumnRange でもそのまま比べられる
+// 列がない行や、8バイトでない値の行は期限切れにならない
+
+// EncodeExpiry は有効期限の列に入れる値を作る
+func EncodeExpiry(at time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano()))
+}
+
+// DecodeExpiry は有効期限の列の値を時刻に戻す。形式が違えば false を返す
+func DecodeExpiry(b []byte) (time.Time, bool) {
+	if len(b) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+// now はテーブルの現在時刻を返す
+func (t *SimpleTable) now() time.Time {
+	if t.Clock != nil {
+		return t.Clock()
+	}
+	return time.Now()
+}
+
+// expiryChecker は行が期限切れかを判定する。Expiry が無効なテーブルでは nil を返す
+// スキャンの間は同じ時刻で判定するので、途中で期限が来た行も最後まで同じ扱いになる
+func (t *SimpleTable) expiryChecker() *expiryChecker {
+	if !t.Expiry {
+		return nil
+	}
+	return &expiryChecker{
+		column:      t.ExpiryColumn,
+		numKeyElems: t.NumKeyElems,
+		codec:       t.codec(),
+		now:         t.now().UnixNano(),
+	}
+}
+
+// expiryChecker は有効期限の列を読んで、行が期限切れかを判定する
+type expiryChecker struct {
+	column      int
+	numKeyElems int
+	codec       TupleCodec
+	now         int64 // UnixNano
+}
+
+// expired はエンコード済みのキーと値の行が期限切れかを返す
+// DefaultCodec なら有効期限の列の他はデコードしない
+func (c *expiryChecker) expired(key, value []byte) bool {
+	data, col := key, c.column
+	if col >= c.numKeyElems {
+		data, col = value, col-c.numKeyElems
+	}
+	var elems [][]byte
+	if c.codec == DefaultCodec {
+		elems = elements(data)
+	} else {
+		elems = c.codec.Decode(data)
+	}
+	if col < 0 || col >= len(elems) {
+		return false
+	}
+	at, ok := DecodeExpiry(elems[col])
+	return ok && at.UnixNano() <= c.now
+}
+
+// isExpired はエンコード済みのキーと値の行が、今の時刻で期限切れかを返す
+func (t *SimpleTable) isExpired(key, value []byte) bool {
+	checker := t.expiryChecker()
+	return checker != nil && checker.expired(key, value)
+}
+
+// InsertWithTTL は ttl 後に期限が切れる行を挿入する
+// 有効期限の列に今の時刻に ttl を足した時刻を入れる。tuple がその列まで届いていなければ
+// 間を nil で埋める。Expiry が無効なテーブルでは ErrExpiryDisabled を返す
+func (t *SimpleTable) InsertWithTTL(bufmgr *buffer.BufferPoolManager, tuple Tuple, ttl time.Duration) error {
+	return t.InsertWithTTLContext(context.Background(), bufmgr, tuple, ttl)
+}
+
+// InsertWithTTLContext は InsertWithTTL と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) InsertWithTTLContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple, ttl time.Duration) error {
+	_, err := t.InsertWithTTLReturningContext(ctx, bufmgr, tuple, ttl)
+	return err
+}
+
+// InsertWithTTLReturning は InsertWithTTL と同じだが、有効期限の列を入れて書き込んだ行を返す
+func (t *SimpleTable) InsertWithTTLReturning(bufmgr *buffer.BufferPoolManager, tuple Tuple, ttl time.Duration) (Tuple, error) {
+	return t.InsertWithTTLReturningContext(context.Background(), bufmgr, tuple, ttl)
+}
+
+// InsertWithTTLReturningContext は InsertWithTTLReturning と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) InsertWithTTLReturningContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple, ttl time.Duration) (Tuple, error) {
+	if !t.Expiry {
+		return nil, ErrExpiryDisabled
+	}
+	withExpiry := make(Tuple, max(len(tuple), t.ExpiryColumn+1))
+	copy(withExpiry, tuple)
+	withExpiry[t.ExpiryColumn] = EncodeExpiry(t.now().Add(ttl))
+	return t.InsertReturningContext(ctx, bufmgr, withExpiry)
+}
+
+// PurgeExpired は期限切れの行を物理的に削除し、削除した行数を返す
+// SoftDelete が有効なテーブルでも印を付けずに消す。Expiry が無効なテーブルでは何もしない
+// 期限切れの行はスキャンに現れないが、PurgeExpired を呼ぶまでページに残る。
+// アプリケーションは定期的に呼ぶこと
+func (t *SimpleTable) PurgeExpired(bufmgr *buffer.BufferPoolManager) (int, error) {
+	return t.PurgeExpiredContext(context.Background(), bufmgr)
+}
+
+// PurgeExpiredContext は PurgeExpired と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// キャンセルされたときは、それまでに削除した行数を返す
+func (t *SimpleTable) PurgeExpiredContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (int, error) {
+	return t.purgeExpired(ctx, bufmgr, nil)
+}
+
+// PurgeExpiredReturning は PurgeExpired と同じだが、削除した行数に加えて削除した行を返す
+// SoftDelete で既に削除済みの印が付いていた行は、消して数えるが返さない
+func (t *SimpleTable) PurgeExpiredReturning(bufmgr *buffer.BufferPoolManager) (int, []Tuple, error) {
+	return t.PurgeExpiredReturningContext(context.Background(), bufmgr)
+}
+
+// PurgeExpiredReturningContext は PurgeExpiredReturning と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// キャンセルされたときは、それまでに削除した行を返す
+func (t *SimpleTable) PurgeExpiredReturningContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (int, []Tuple, error) {
+	var purged []Tuple
+	n, err := t.purgeExpired(ctx, bufmgr, &purged)
+	return n, purged, err
+}
+
+// purgeExpired は期限切れの行を削除し、削除した行数を返す
+// purged が nil でなければ、削除した生きている行をデコードして加える
+func (t *SimpleTable) purgeExpired(ctx context.Context, bufmgr *buffer.BufferPoolManager, purged *[]Tuple) (int, error) {
+	checker := t.expiryChecker()
+	if checker == nil {
+		return 0, nil
+	}
+	tree := t.btree()
+
+	// スキャン中に木を書き換えないよう、先にキーを集める
+	iter, err := tree.SearchContext(ctx, bufmgr, btree.NewSearchStart())
+	if err != nil {
+		return 0, err
+	}
+	var keys [][]byte
+	var rows []Tuple // keys と同じ順。削除済みの行は nil
+	for {
+		pair, err := iter.NextContext(ctx, bufmgr)
+		if err != nil {
+			iter.Close(bufmgr)
+			return 0, err
+		}
+		if pair == nil {
+			break
+		}
+		if !checker.expired(pair.Key, pair.Value) {
+			continue
+		}
+		keys = append(keys, pair.Key)
+		if purged != nil {
+			var row Tuple
+			if value, deleted := decodeValue(t.codec(), pair.Value, t.SoftDelete); !deleted {
+				row = MergeTuple(t.decodeKey(pair.Key), value)
+			}
+			rows = append(rows, row)
+		}
+	}
+	iter.Close(bufmgr)
+
+	for i, key := range keys {
+		if err := t.deleteEncoded(ctx, bufmgr, key); err != nil {
+			return i, err
+		}
+		if purged != nil && rows[i] != nil {
+			*purged = append(*purged, rows[i])
+		}
+	}
+	return len(keys), nil
+}
@@ -0,0 +1,429 @@
+package table
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/fnv"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// 結合の既定値
+const (
+	DefaultJoinBlockSize    = 1000  // NestedLoopJoin で1回にメモリに読む左の行数
+	DefaultJoinMaxBuildRows = 10000 // HashJoin でメモリ上のハッシュ表に入れる右の行数の上限
+	DefaultJoinPartitions   = 16    // HashJoin で書き出すときの分割数
+)
+
+// JoinOptions は2つのテーブルの結合条件と方法を指定する
+// 結合条件は left の LeftColumn 列と right の RightColumn 列が等しいこと
+// 列番号はキーと値を合わせた Tuple での位置で、列がない行はどの行とも結合しない
+type JoinOptions struct {
+	LeftColumn  int
+	RightColumn int
+	// BlockSize は NestedLoopJoin で1回にメモリに読む左の行数（0なら DefaultJoinBlockSize）
+	BlockSize int
+	// MaxBuildRows は HashJoin でメモリ上に持つ右の行数の上限（0なら DefaultJoinMaxBuildRows）
+	// 右の行数がこれを超えると、両方のテーブルを一時ファイルに分割してから結合する
+	MaxBuildRows int
+	// Partitions は一時ファイルに分割するときの分割数（0なら DefaultJoinPartitions）
+	Partitions int
+	// TempDir は一時ファイルを作るディレクトリ（空なら os.TempDir()）
+	TempDir string
+}
+
+// JoinFunc は結合した行の組を受け取る
+// エラーを返すと結合を打ち切り、そのエラーが結合の結果になる
+type JoinFunc func(left, right Tuple) error
+
+// joinColumn は結合に使う列の値を返す。列がなければ false を返す
+func joinColumn(tuple Tuple, col int) ([]byte, bool) {
+	if col < 0 || col >= len(tuple) {
+		return nil, false
+	}
+	return tuple[col], true
+}
+
+// JoinMethod は結合の方法
+type JoinMethod int
+
+const (
+	JoinNestedLoop JoinMethod = iota + 1 // NestedLoopJoin
+	JoinHash                             // HashJoin
+	JoinMerge                            // MergeJoin
+)
+
+func (m JoinMethod) String() string {
+	switch m {
+	case JoinNestedLoop:
+		return "nested loop"
+	case JoinHash:
+		return "hash"
+	case JoinMerge:
+		return "merge"
+	}
+	return "unknown"
+}
+
+// PlanJoin は Join が使う結合の方法を選ぶ
+//
+//   - 結合列が両方ともキー全体で、2つのテーブルが同じ TupleCodec を使っていれば、
+//     B-tree のキーの順に読める MergeJoin を選ぶ
+//   - そうでなく、左の行数が BlockSize 以下なら NestedLoopJoin を選ぶ。
+//     右を1回スキャンするだけで済み、ハッシュ表も一時ファイルも要らない
+//   - それ以外は HashJoin を選ぶ（右の行数が MaxBuildRows を超えれば grace hash join になる）
+func PlanJoin(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, opts JoinOptions) (JoinMethod, error) {
+	if left.NumKeyElems == 1 && right.NumKeyElems == 1 && opts.LeftColumn == 0 && opts.RightColumn == 0 &&
+		sameCodec(left.codec(), right.codec()) {
+		return JoinMerge, nil
+	}
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultJoinBlockSize
+	}
+	count, err := left.Count(bufmgr)
+	if err != nil {
+		return 0, err
+	}
+	if count <= blockSize {
+		return JoinNestedLoop, nil
+	}
+	return JoinHash, nil
+}
+
+// Join は PlanJoin で選んだ方法で left と right を結合する
+func Join(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, opts JoinOptions, emit JoinFunc) error {
+	method, err := PlanJoin(bufmgr, left, right, opts)
+	if err != nil {
+		return err
+	}
+	switch method {
+	case JoinMerge:
+		return MergeJoin(bufmgr, left, right, emit)
+	case JoinNestedLoop:
+		return NestedLoopJoin(bufmgr, left, right, opts, emit)
+	}
+	return HashJoin(bufmgr, left, right, opts, emit)
+}
+
+// sameCodec は2つのコーデックが同じものかを返す
+// 比較できない型のコーデックは同じとみなさない（== で比べると panic する）
+func sameCodec(a, b TupleCodec) bool {
+	ta := reflect.TypeOf(a)
+	return ta == reflect.TypeOf(b) && ta.Comparable() && a == b
+}
+
+// NestedLoopJoin はブロック単位の入れ子ループで left と right を結合する
+// left を BlockSize 行ずつメモリに読み、ブロックごとに right を1回スキャンする
+// どんな列でも結合できるが、right を (left の行数 ÷ BlockSize) 回読むことになる
+func NestedLoopJoin(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, opts JoinOptions, emit JoinFunc) error {
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = DefaultJoinBlockSize
+	}
+
+	leftIter, err := left.Scan(bufmgr)
+	if err != nil {
+		return err
+	}
+	defer leftIter.Close(bufmgr)
+
+	for {
+		var block []Tuple
+		for len(block) < blockSize {
+			tuple, err := leftIter.Next(bufmgr)
+			if err != nil {
+				return err
+			}
+			if tuple == nil {
+				break
+			}
+			block = append(block, tuple)
+		}
+		if len(block) == 0 {
+			return nil
+		}
+		if err := joinBlock(bufmgr, block, right, opts, emit); err != nil {
+			return err
+		}
+		if len(block) < blockSize {
+			return nil
+		}
+	}
+}
+
+// joinBlock は right を1回スキャンし、block の行と結合する
+func joinBlock(bufmgr *buffer.BufferPoolManager, block []Tuple, right *SimpleTable, opts JoinOptions, emit JoinFunc) error {
+	rightIter, err := right.Scan(bufmgr)
+	if err != nil {
+		return err
+	}
+	defer rightIter.Close(bufmgr)
+
+	for {
+		r, err := rightIter.Next(bufmgr)
+		if err != nil {
+			return err
+		}
+		if r == nil {
+			return nil
+		}
+		rv, ok := joinColumn(r, opts.RightColumn)
+		if !ok {
+			continue
+		}
+		for _, l := range block {
+			if lv, ok := joinColumn(l, opts.LeftColumn); ok && bytes.Equal(lv, rv) {
+				if err := emit(l, r); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// HashJoin は right からハッシュ表を作り、left の行で引いて結合する
+// right の行数が MaxBuildRows を超える場合は、両方のテーブルを結合列のハッシュで
+// Partitions 個の一時ファイルに分け、分割ごとにハッシュ表を作る（grace hash join）
+// 分割した後の各分割はメモリに収まるものとする
+func HashJoin(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, opts JoinOptions, emit JoinFunc) error {
+	maxBuildRows := opts.MaxBuildRows
+	if maxBuildRows <= 0 {
+		maxBuildRows = DefaultJoinMaxBuildRows
+	}
+	count, err := right.Count(bufmgr)
+	if err != nil {
+		return err
+	}
+	if count <= maxBuildRows {
+		return hashJoinInMemory(bufmgr, left, right, opts, emit)
+	}
+	return hashJoinPartitioned(bufmgr, left, right, opts, emit)
+}
+
+// joinTable は結合列の値ごとに行を集めたハッシュ表
+type joinTable map[string][]Tuple
+
+// add は行を結合列の値で登録する
+func (h joinTable) add(tuple Tuple, col int) {
+	if v, ok := joinColumn(tuple, col); ok {
+		h[string(v)] = append(h[string(v)], tuple)
+	}
+}
+
+// probe は l と結合列の値が等しい行を全て emit に渡す
+func (h joinTable) probe(l Tuple, col int, emit JoinFunc) error {
+	v, ok := joinColumn(l, col)
+	if !ok {
+		return nil
+	}
+	for _, r := range h[string(v)] {
+		if err := emit(l, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashJoinInMemory は right 全体のハッシュ表をメモリに作って結合する
+func hashJoinInMemory(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, opts JoinOptions, emit JoinFunc) error {
+	build := joinTable{}
+	if err := scanEach(bufmgr, right, func(r Tuple) error {
+		build.add(r, opts.RightColumn)
+		return nil
+	}); err != nil {
+		return err
+	}
+	return scanEach(bufmgr, left, func(l Tuple) error {
+		return build.probe(l, opts.LeftColumn, emit)
+	})
+}
+
+// hashJoinPartitioned は両方のテーブルを一時ファイルに分割してから、分割ごとに結合する
+func hashJoinPartitioned(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, opts JoinOptions, emit JoinFunc) error {
+	partitions := opts.Partitions
+	if partitions <= 0 {
+		partitions = DefaultJoinPartitions
+	}
+
+	leftFiles, err := partitionTable(bufmgr, left, opts.LeftColumn, partitions, opts.TempDir)
+	if err != nil {
+		return err
+	}
+	defer removeAll(leftFiles)
+	rightFiles, err := partitionTable(bufmgr, right, opts.RightColumn, partitions, opts.TempDir)
+	if err != nil {
+		return err
+	}
+	defer removeAll(rightFiles)
+
+	// 結合列の値が等しい行は同じ番号の分割に入る
+	for i := 0; i < partitions; i++ {
+		build := joinTable{}
+		if err := readPartition(rightFiles[i], func(r Tuple) error {
+			build.add(r, opts.RightColumn)
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := readPartition(leftFiles[i], func(l Tuple) error {
+			return build.probe(l, opts.LeftColumn, emit)
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partitionTable はテーブルの行を結合列のハッシュで partitions 個の一時ファイルに書き分ける
+// 結合列がない行はどの行とも結合しないので書き出さない
+// 各行は [len: 4] [Tuple.Encode()] の形で書く
+func partitionTable(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, col, partitions int, dir string) ([]*os.File, error) {
+	files := make([]*os.File, 0, partitions)
+	writers := make([]*bufio.Writer, 0, partitions)
+	for i := 0; i < partitions; i++ {
+		f, err := os.CreateTemp(dir, "minidb_join_*.tmp")
+		if err != nil {
+			removeAll(files)
+			return nil, err
+		}
+		files = append(files, f)
+		writers = append(writers, bufio.NewWriter(f))
+	}
+
+	var lenBuf [4]byte
+	err := scanEach(bufmgr, tbl, func(tuple Tuple) error {
+		v, ok := joinColumn(tuple, col)
+		if !ok {
+			return nil
+		}
+		h := fnv.New32a()
+		h.Write(v)
+		w := writers[h.Sum32()%uint32(partitions)]
+		data := tuple.Encode()
+		binary.LittleEndian.PutUint32(lenBuf[:], uint32(len(data)))
+		if _, err := w.Write(lenBuf[:]); err != nil {
+			return err
+		}
+		_, err := w.Write(data)
+		return err
+	})
+	for _, w := range writers {
+		if err == nil {
+			err = w.Flush()
+		}
+	}
+	if err != nil {
+		removeAll(files)
+		return nil, err
+	}
+	return files, nil
+}
+
+// readPartition は partitionTable で書いた一時ファイルの行を先頭から fn に渡す
+func readPartition(f *os.File, fn func(Tuple) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var lenBuf [4]byte
+	for {
+		if _, err := io.ReadFull(r, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		data := make([]byte, binary.LittleEndian.Uint32(lenBuf[:]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+		if err := fn(DecodeTuple(data)); err != nil {
+			return err
+		}
+	}
+}
+
+// removeAll は一時ファイルを閉じて削除する
+func removeAll(files []*os.File) {
+	for _, f := range files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// MergeJoin は left と right をキーの順に並行してスキャンし、キーが等しい行を結合する
+// どちらも B-tree のキーの順に読めるので、ソートもハッシュ表も要らず、
+// 両方のテーブルを1回ずつ読むだけで済む。結合できるのはキー全体どうしに限られる
+// 2つのテーブルはキーを同じ順序に並べる TupleCodec を使っていなければならない
+func MergeJoin(bufmgr *buffer.BufferPoolManager, left, right *SimpleTable, emit JoinFunc) error {
+	leftIter, err := left.Scan(bufmgr)
+	if err != nil {
+		return err
+	}
+	defer leftIter.Close(bufmgr)
+	rightIter, err := right.Scan(bufmgr)
+	if err != nil {
+		return err
+	}
+	defer rightIter.Close(bufmgr)
+
+	l, err := leftIter.Next(bufmgr)
+	if err != nil {
+		return err
+	}
+	r, err := rightIter.Next(bufmgr)
+	if err != nil {
+		return err
+	}
+	codec := left.codec()
+	for l != nil && r != nil {
+		// 比べるのはエンコードしたキー。B-tree もこの順に並んでいる
+		leftKey, _ := SplitTuple(l, left.NumKeyElems)
+		rightKey, _ := SplitTuple(r, right.NumKeyElems)
+		cmp := codec.CompareKey(codec.Encode(leftKey), codec.Encode(rightKey))
+		if cmp == 0 {
+			if err := emit(l, r); err != nil {
+				return err
+			}
+		}
+		// キーはテーブルの中で一意なので、等しければ両方進める
+		if cmp <= 0 {
+			if l, err = leftIter.Next(bufmgr); err != nil {
+				return err
+			}
+		}
+		if cmp >= 0 {
+			if r, err = rightIter.Next(bufmgr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// scanEach はテーブルの全行を fn に渡す
+func scanEach(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, fn func(Tuple) error) error {
+	iter, err := tbl.Scan(bufmgr)
+	if err != nil {
+		return err
+	}
+	defer iter.Close(bufmgr)
+
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			return err
+		}
+		if tuple == nil {
+			return nil
+		}
+		if err := fn(tuple); err != nil {
+			return err
+		}
+	}
+}
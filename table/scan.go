@@ -0,0 +1,198 @@
+package table
+
+import (
+	"context"
+	"errors"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// ErrPrefixScanUnsupported はテーブルのコーデックが PrefixCodec を実装していないことを表す
+var ErrPrefixScanUnsupported = errors.New("table codec does not support prefix scans")
+
+// ScanOptions はスキャンの中で行う絞り込みと射影を指定する
+type ScanOptions struct {
+	// Columns を指定すると、返す行をその列だけにする（この順に並ぶ）
+	// 列番号はキーと値を合わせた Tuple での位置。指定しなかった列はデコードしない
+	// 行にない列は nil になる
+	Columns []int
+	// Filter を指定すると、true を返した行だけを返す
+	// Columns を指定した場合は射影した後の行が渡される
+	Filter func(Tuple) bool
+	// ReadAhead は btree.Iter.SetReadAhead に渡す先読みの深さ
+	// 正なら別の goroutine で先読みし、0なら既定の先読み、負なら先読みしない
+	ReadAhead int
+}
+
+// ScanWithOptions は opts で絞り込み・射影しながら全行をスキャンするイテレータを返す
+func (t *SimpleTable) ScanWithOptions(bufmgr *buffer.BufferPoolManager, opts ScanOptions) (*TableIter, error) {
+	return t.ScanWithOptionsContext(context.Background(), bufmgr, opts)
+}
+
+// ScanWithOptionsContext は ScanWithOptions と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) ScanWithOptionsContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, opts ScanOptions) (*TableIter, error) {
+	iter, err := t.ScanContext(ctx, bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	iter.apply(bufmgr, opts)
+	return iter, nil
+}
+
+// ScanFromWithOptions は ScanFrom と同じだが、opts で絞り込み・射影する
+func (t *SimpleTable) ScanFromWithOptions(bufmgr *buffer.BufferPoolManager, searchKey Tuple, opts ScanOptions) (*TableIter, error) {
+	iter, err := t.ScanFrom(bufmgr, searchKey)
+	if err != nil {
+		return nil, err
+	}
+	iter.apply(bufmgr, opts)
+	return iter, nil
+}
+
+// ScanPrefix はキーの先頭の列が prefix に等しい行だけをスキャンするイテレータを返す
+// (userID, timestamp) をキーにしたテーブルで、あるユーザーの行だけを読むときに使う。
+// prefix の列数はキーの列数以下でなければならない（超えていれば ErrKeyColumnsMismatch）
+// 先頭の行に位置を合わせ、prefix に合わない行に達したらそこで終わる。
+// テーブルのコーデックが PrefixCodec を実装していなければ ErrPrefixScanUnsupported を返す
+func (t *SimpleTable) ScanPrefix(bufmgr *buffer.BufferPoolManager, prefix Tuple) (*TableIter, error) {
+	return t.ScanPrefixContext(context.Background(), bufmgr, prefix)
+}
+
+// ScanPrefixContext は ScanPrefix と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) ScanPrefixContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, prefix Tuple) (*TableIter, error) {
+	if len(prefix) > t.NumKeyElems {
+		return nil, ErrKeyColumnsMismatch
+	}
+	codec, ok := t.codec().(PrefixCodec)
+	if !ok {
+		return nil, ErrPrefixScanUnsupported
+	}
+	search := btree.NewSearchPrefix(codec.EncodePrefix(prefix, t.NumKeyElems))
+	iter, err := t.btree().SearchContext(ctx, bufmgr, search)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.newIter(iter), nil
+}
+
+// ScanPrefixWithOptions は ScanPrefix と同じだが、opts で絞り込み・射影する
+func (t *SimpleTable) ScanPrefixWithOptions(bufmgr *buffer.BufferPoolManager, prefix Tuple, opts ScanOptions) (*TableIter, error) {
+	iter, err := t.ScanPrefix(bufmgr, prefix)
+	if err != nil {
+		return nil, err
+	}
+	iter.apply(bufmgr, opts)
+	return iter, nil
+}
+
+// Token はイテレータの位置を、後で Resume に渡せる不透明なバイト列にする
+// 位置は最後に読んだ行のキーで覚える（btree.Iter.Token）ので、ページのピンを持ったままにせずに
+// Close してから、別のリクエストで続きの行を読める（ページ送り）。
+// 絞り込みで返さなかった行も読んだ行に含む。ScanPrefix のトークンは接頭辞も覚えている
+func (it *TableIter) Token() []byte {
+	return it.btreeIter.Token()
+}
+
+// Resume は Token で書き出した位置の続きから、まだ返していない行をスキャンするイテレータを返す
+// 間に挿入や削除があっても、トークンのキーより後の行から読む
+// 壊れたトークンには btree.ErrInvalidToken を返す
+func (t *SimpleTable) Resume(bufmgr *buffer.BufferPoolManager, token []byte) (*TableIter, error) {
+	return t.ResumeContext(context.Background(), bufmgr, token)
+}
+
+// ResumeContext は Resume と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) ResumeContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, token []byte) (*TableIter, error) {
+	iter, err := t.btree().ResumeContext(ctx, bufmgr, token)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.newIter(iter), nil
+}
+
+// ResumeWithOptions は Resume と同じだが、opts で絞り込み・射影する
+// 絞り込みと射影はトークンに含まれないので、最初のスキャンと同じ opts を渡す
+func (t *SimpleTable) ResumeWithOptions(bufmgr *buffer.BufferPoolManager, token []byte, opts ScanOptions) (*TableIter, error) {
+	iter, err := t.Resume(bufmgr, token)
+	if err != nil {
+		return nil, err
+	}
+	iter.apply(bufmgr, opts)
+	return iter, nil
+}
+
+// apply はスキャンのオプションをイテレータに設定する
+func (it *TableIter) apply(bufmgr *buffer.BufferPoolManager, opts ScanOptions) {
+	it.columns = opts.Columns
+	it.predicate = opts.Filter
+	if opts.ReadAhead != 0 {
+		it.btreeIter.SetReadAhead(bufmgr, opts.ReadAhead)
+	}
+}
+
+// project はペアから columns の列だけを取り出した Tuple を返す
+// 2つ目の戻り値は削除済みの印が付いているかどうか
+// DefaultCodec なら取り出さない列はデコードしない
+func (it *TableIter) project(pair *btree.Pair) (Tuple, bool) {
+	var key, value [][]byte
+	if it.codec == DefaultCodec {
+		key, value = elements(pair.Key), elements(pair.Value)
+	} else {
+		key, value = it.codec.Decode(pair.Key), it.codec.Decode(pair.Value)
+	}
+	deleted := false
+	if it.softDelete && len(value) > 0 {
+		last := len(value) - 1
+		deleted = isTombstoneDeleted(value[last])
+		value = value[:last]
+	}
+
+	tuple := make(Tuple, len(it.columns))
+	for i, col := range it.columns {
+		switch {
+		case col < 0:
+		case col < len(key):
+			tuple[i] = append([]byte{}, key[col]...)
+		case col-len(key) < len(value):
+			tuple[i] = append([]byte{}, value[col-len(key)]...)
+		}
+	}
+	return tuple, deleted
+}
+
+// Count はテーブルの行数を返す
+// 行はデコードしない。SoftDelete が有効なテーブルでは削除済みの行を、
+// Expiry が有効なテーブルでは期限切れの行を数えない
+func (t *SimpleTable) Count(bufmgr *buffer.BufferPoolManager) (int, error) {
+	if !t.SoftDelete && !t.Expiry {
+		// リーフのペア数を足すだけで済む
+		stats, err := btree.Stats(bufmgr, t.btree())
+		if err != nil {
+			return 0, err
+		}
+		return stats.Pairs, nil
+	}
+
+	iter, err := t.btree().Search(bufmgr, btree.NewSearchStart())
+	if err != nil {
+		return 0, err
+	}
+	defer iter.Close(bufmgr)
+
+	expiry := t.expiryChecker()
+	count := 0
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			return 0, err
+		}
+		if pair == nil {
+			return count, nil
+		}
+		if !t.isDeleted(pair.Value) && (expiry == nil || !expiry.expired(pair.Key, pair.Value)) {
+			count++
+		}
+	}
+}
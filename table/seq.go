@@ -0,0 +1,36 @@
+//go:build go1.23
+
+package table
+
+import (
+	"iter"
+
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// All はイテレータの残りの行を返す range over func 用のイテレータを返す
+// ループが終わると（途中で抜けた場合も）イテレータを Close する。
+// 読み込みに失敗したらループを終わらせ、エラーは Err で返す
+//
+//	it, _ := tbl.Scan(bufmgr)
+//	for row := range it.All(bufmgr) {
+//	    ...
+//	}
+//	if err := it.Err(); err != nil {
+//	    ...
+//	}
+func (it *TableIter) All(bufmgr *buffer.BufferPoolManager) iter.Seq[Tuple] {
+	return func(yield func(Tuple) bool) {
+		defer it.Close(bufmgr)
+		for {
+			tuple, err := it.Next(bufmgr)
+			if err != nil {
+				it.err = err
+				return
+			}
+			if tuple == nil || !yield(tuple) {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+//go:build go1.23
+
+package table
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTableIterAll(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := tbl.Insert(bufmgr, Tuple{[]byte(fmt.Sprint(i)), []byte("row")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	iter, err := tbl.Scan(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var got []string
+	for row := range iter.All(bufmgr) {
+		got = append(got, fmt.Sprintf("%s", row))
+		if len(got) == 3 {
+			break
+		}
+	}
+	if fmt.Sprint(got) != "[[0 row] [1 row] [2 row]]" {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	if iter.Err() != nil {
+		t.Errorf("unexpected error %v", iter.Err())
+	}
+
+	iter, err = tbl.ScanPrefix(bufmgr, Tuple{[]byte("4")})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	count := 0
+	for range iter.All(bufmgr) {
+		count++
+	}
+	if count != 1 || iter.Err() != nil {
+		t.Errorf("expected 1 row, got %d (%v)", count, iter.Err())
+	}
+}
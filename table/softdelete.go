@@ -0,0 +1,160 @@
+package table
+
+import (
+	"context"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+)
+
+// 墓標列の値
+// SoftDelete が有効なテーブルでは、値の Tuple の末尾にこのどちらかが入る
+var (
+	tombstoneLive    = []byte{0}
+	tombstoneDeleted = []byte{1}
+)
+
+// encodeValue は値の Tuple をエンコードする
+// SoftDelete が有効なら末尾に生存中の墓標列を付ける
+func (t *SimpleTable) encodeValue(value Tuple) []byte {
+	if !t.SoftDelete {
+		return t.codec().Encode(value)
+	}
+	withTombstone := make(Tuple, len(value), len(value)+1)
+	copy(withTombstone, value)
+	return t.codec().Encode(append(withTombstone, tombstoneLive))
+}
+
+// decodeValue はエンコード済みの値をデコードし、墓標列を取り除いて返す
+// 2つ目の戻り値は削除済みの印が付いているかどうか
+func decodeValue(codec TupleCodec, data []byte, softDelete bool) (Tuple, bool) {
+	value := codec.Decode(data)
+	if !softDelete || len(value) == 0 {
+		return value, false
+	}
+	last := len(value) - 1
+	return value[:last], isTombstoneDeleted(value[last])
+}
+
+// isTombstoneDeleted は墓標列の値が削除済みの印かを返す
+func isTombstoneDeleted(tombstone []byte) bool {
+	return len(tombstone) == 1 && tombstone[0] == tombstoneDeleted[0]
+}
+
+// isDeleted はエンコード済みの値に削除済みの印が付いているかを返す
+// DefaultCodec なら値の他の列はデコードしない
+func (t *SimpleTable) isDeleted(data []byte) bool {
+	if !t.SoftDelete {
+		return false
+	}
+	if t.codec() != DefaultCodec {
+		_, deleted := decodeValue(t.codec(), data, true)
+		return deleted
+	}
+	value := elements(data)
+	return len(value) > 0 && isTombstoneDeleted(value[len(value)-1])
+}
+
+// markDeleted はエンコード済みの値の墓標列を削除済みに書き換えたものを返す
+func (t *SimpleTable) markDeleted(data []byte) []byte {
+	value := t.codec().Decode(data)
+	value[len(value)-1] = tombstoneDeleted
+	return t.codec().Encode(value)
+}
+
+// softDelete は行に削除済みの印を付ける
+func (t *SimpleTable) softDelete(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) error {
+	oldValue, existed, err := t.lookup(ctx, bufmgr, key)
+	if err != nil {
+		return err
+	}
+	if !existed || !t.isLive(key, oldValue) {
+		return btree.ErrKeyNotFound
+	}
+	swapped, err := t.btree().CompareAndSwap(bufmgr, key, oldValue, t.markDeleted(oldValue))
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return btree.ErrKeyNotFound
+	}
+	return nil
+}
+
+// isLive はエンコード済みのキーと値の行が、削除済みでも期限切れでもないかを返す
+func (t *SimpleTable) isLive(key, value []byte) bool {
+	return !t.isDeleted(value) && !t.isExpired(key, value)
+}
+
+// reviveDeleted は削除済みの印が付いた行や期限切れの行を新しい値で置き換える
+// 生存中の行があれば btree.ErrDuplicateKey を返す
+func (t *SimpleTable) reviveDeleted(ctx context.Context, bufmgr *buffer.BufferPoolManager, key, value []byte) error {
+	oldValue, existed, err := t.lookup(ctx, bufmgr, key)
+	if err != nil {
+		return err
+	}
+	if !existed || t.isLive(key, oldValue) {
+		return btree.ErrDuplicateKey
+	}
+	swapped, err := t.btree().CompareAndSwap(bufmgr, key, oldValue, value)
+	if err != nil {
+		return err
+	}
+	if !swapped {
+		return btree.ErrDuplicateKey
+	}
+	return t.updateZoneMap(ctx, bufmgr, key, value)
+}
+
+// ScanIncludingDeleted は削除済みの印が付いた行も含めて全行をスキャンするイテレータを返す
+// 返された行が削除済みかどうかは TableIter.Deleted で確認できる
+func (t *SimpleTable) ScanIncludingDeleted(bufmgr *buffer.BufferPoolManager) (*TableIter, error) {
+	iter, err := t.Scan(bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	iter.includeDeleted = true
+	return iter, nil
+}
+
+// Deleted は直前の Next で返した行に削除済みの印が付いているかを返す
+func (it *TableIter) Deleted() bool {
+	return it.deleted
+}
+
+// Purge は削除済みの印が付いた行を物理的に削除し、削除した行数を返す
+// SoftDelete が無効なテーブルでは何もしない
+func (t *SimpleTable) Purge(bufmgr *buffer.BufferPoolManager) (int, error) {
+	if !t.SoftDelete {
+		return 0, nil
+	}
+	tree := t.btree()
+
+	// スキャン中に木を書き換えないよう、先にキーを集める
+	iter, err := tree.Search(bufmgr, btree.NewSearchStart())
+	if err != nil {
+		return 0, err
+	}
+	var keys [][]byte
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			iter.Close(bufmgr)
+			return 0, err
+		}
+		if pair == nil {
+			break
+		}
+		if t.isDeleted(pair.Value) {
+			keys = append(keys, pair.Key)
+		}
+	}
+	iter.Close(bufmgr)
+
+	for i, key := range keys {
+		if err := t.deleteEncoded(context.Background(), bufmgr, key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
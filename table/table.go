@@ -1,6 +1,10 @@
 package table
 
 import (
+	"context"
+	"errors"
+	"time"
+
 	"github.com/kkumaki12/minidb/btree"
 	"github.com/kkumaki12/minidb/buffer"
 	"github.com/kkumaki12/minidb/disk"
@@ -9,90 +13,435 @@ import (
 // SimpleTable はB-treeをベースにしたシンプルなテーブル
 // Tupleの最初のnumKeyElems個の要素をキーとして使用する
 type SimpleTable struct {
-	MetaPageID  disk.PageID // B-treeのメタページID
-	NumKeyElems int         // キーを構成する要素数
+	MetaPageID  disk.PageID  // B-treeのメタページID
+	NumKeyElems int          // キーを構成する要素数
+	SoftDelete  bool         // Delete で行を消さずに墓標列に削除済みの印を付ける
+	Codec       TupleCodec   // 行の形式（nilなら DefaultCodec）
+	zoneMap     *ZoneMap     // 列ごとの値の範囲（EnableZoneMap で設定）
+	tree        *btree.BTree // MetaPageID のB-tree。ルートのキャッシュを操作の間で使い回す
+
+	Expiry       bool             // ExpiryColumn 番目の列を行の有効期限として扱う
+	ExpiryColumn int              // 有効期限の列（キーと値を合わせた Tuple での位置）
+	Clock        func() time.Time // 期限切れの判定に使う現在時刻（nilなら time.Now）
+
+	NotNull []int   // NULL（列がないか nil）を許さない列（キーと値を合わせた Tuple での位置）
+	Checks  []Check // 書き込む行の列の値の検査
+
+	Defaults      map[int][]byte // 列の位置 → 書き込む行の列が NULL のときに入れる値
+	AutoIncrement bool           // キーの最初の列が NULL なら連番を入れる
+}
+
+// Options はテーブルの動作を変えるオプション
+// テーブルの作成時と開く時で同じ値を指定すること
+type Options struct {
+	// SoftDelete を有効にすると、値の末尾に墓標列を持たせる
+	// Delete は墓標列に削除済みの印を付けるだけで、行は Purge まで残る
+	SoftDelete bool
+	// SecureDelete を有効にすると、削除・更新した行のバイトをデータファイルから0で消す
+	// 設定は B-tree のメタページに記録されるので、作成時にだけ効く
+	SecureDelete bool
+	// Codec は行をB-treeに格納する形式（nilなら DefaultCodec）
+	Codec TupleCodec
+	// Expiry を有効にすると、ExpiryColumn 番目の列（キーと値を合わせた Tuple での位置）を
+	// 行の有効期限として扱う。列には EncodeExpiry の値を入れるか、InsertWithTTL で挿入する
+	// 期限が過ぎた行はスキャンに現れず、PurgeExpired で削除される
+	Expiry       bool
+	ExpiryColumn int
+	// Clock は期限切れの判定に使う現在時刻を返す（nilなら time.Now）
+	Clock func() time.Time
+	// NotNull と Checks は挿入・置き換えのたびに検査する列の制約
+	// 違反した行は書き込まずに *ConstraintError を返す
+	NotNull []int
+	Checks  []Check
+	// Defaults は列の既定値（列の位置 → 値）。挿入・置き換える行の列が NULL なら既定値を入れる
+	// NotNull と Checks は既定値を入れた後の行で検査する
+	Defaults map[int][]byte
+	// AutoIncrement を有効にすると、キーの最初の列が NULL の行を挿入するときに、
+	// B-tree のメタページの連番（btree.BTree.NextSequence）から1始まりの値を払い出して
+	// EncodeSequence の形で入れる。値を指定した行はそのまま挿入し、連番は進めない
+	AutoIncrement bool
 }
 
 // Create は新しいSimpleTableを作成する
 func Create(bufmgr *buffer.BufferPoolManager, numKeyElems int) (*SimpleTable, error) {
-	tree, err := btree.Create(bufmgr)
+	return CreateWithOptions(bufmgr, numKeyElems, Options{})
+}
+
+// CreateWithOptions はオプションを指定して新しいSimpleTableを作成する
+func CreateWithOptions(bufmgr *buffer.BufferPoolManager, numKeyElems int, opts Options) (*SimpleTable, error) {
+	tree, err := btree.CreateWithOptions(bufmgr, btree.Options{SecureDelete: opts.SecureDelete})
 	if err != nil {
 		return nil, err
 	}
 
-	return &SimpleTable{
-		MetaPageID:  tree.MetaPageID,
-		NumKeyElems: numKeyElems,
-	}, nil
+	return NewSimpleTableWithOptions(tree.MetaPageID, numKeyElems, opts), nil
 }
 
 // NewSimpleTable は既存のSimpleTableを開く
 func NewSimpleTable(metaPageID disk.PageID, numKeyElems int) *SimpleTable {
+	return NewSimpleTableWithOptions(metaPageID, numKeyElems, Options{})
+}
+
+// NewSimpleTableWithOptions はオプションを指定して既存のSimpleTableを開く
+func NewSimpleTableWithOptions(metaPageID disk.PageID, numKeyElems int, opts Options) *SimpleTable {
 	return &SimpleTable{
 		MetaPageID:  metaPageID,
+		tree:        btree.NewBTree(metaPageID),
 		NumKeyElems: numKeyElems,
+		SoftDelete:  opts.SoftDelete,
+		Codec:       opts.Codec,
+
+		Expiry:       opts.Expiry,
+		ExpiryColumn: opts.ExpiryColumn,
+		Clock:        opts.Clock,
+
+		NotNull: opts.NotNull,
+		Checks:  opts.Checks,
+
+		Defaults:      opts.Defaults,
+		AutoIncrement: opts.AutoIncrement,
 	}
 }
 
 // btree は内部のB-treeを取得する
+// 開いたときに作った BTree を返すので、ルートのキャッシュが操作をまたいで効く。
+// 後から MetaPageID を書き換えた場合はその木を毎回作る
 func (t *SimpleTable) btree() *btree.BTree {
-	return btree.NewBTree(t.MetaPageID)
+	if t.tree == nil || t.tree.MetaPageID != t.MetaPageID {
+		return btree.NewBTree(t.MetaPageID)
+	}
+	return t.tree
+}
+
+// Flush はこのテーブルのB-treeのページのうち、dirty なものだけをディスクに書き戻す
+// 他のテーブルのページは書かない。ページを列挙するために木を全て辿る
+func (t *SimpleTable) Flush(bufmgr *buffer.BufferPoolManager) error {
+	pageIDs, err := btree.Pages(bufmgr, t.btree())
+	if err != nil {
+		return err
+	}
+	return bufmgr.FlushPages(pageIDs)
+}
+
+// Pages はこのテーブルのB-treeを構成する全てのページのIDを返す（btree.Pages と同じ）
+func (t *SimpleTable) Pages(bufmgr *buffer.BufferPoolManager) ([]disk.PageID, error) {
+	return btree.Pages(bufmgr, t.btree())
+}
+
+// PageCount はテーブルのB-treeのページ数を返す（btree.PageCount）。リーフは読まない
+func (t *SimpleTable) PageCount(bufmgr *buffer.BufferPoolManager) (int, error) {
+	return btree.PageCount(bufmgr, t.btree())
+}
+
+// Rebuild は削除で中身の減ったページを詰め直し、空いたページを空きページに戻す
+// btree.BTree.Rebuild を参照
+func (t *SimpleTable) Rebuild(bufmgr *buffer.BufferPoolManager) error {
+	if err := t.btree().Rebuild(bufmgr); err != nil {
+		return err
+	}
+	return t.refreshZoneMap(bufmgr)
+}
+
+// Truncate はテーブルの全ての行を消し、B-treeのページを空きページに戻す
+// メタページは変えないので、テーブルを開き直す必要はない。AutoIncrement の連番は巻き戻さない
+func (t *SimpleTable) Truncate(bufmgr *buffer.BufferPoolManager) error {
+	return t.TruncateContext(context.Background(), bufmgr)
+}
+
+// TruncateContext は Truncate と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) TruncateContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	if err := t.btree().TruncateContext(ctx, bufmgr); err != nil {
+		return err
+	}
+	return t.refreshZoneMap(bufmgr)
+}
+
+// Rebuild はテーブルのB-treeを、各ページを fillFactor の割合まで詰めて作り直す
+// 読み込みが中心なら 0.9、書き込みが多いなら 0.7 などにする（0なら満杯まで詰める）
+//
+// 新しいページに木を組み立ててからメタページのルートを付け替えるので、付け替えるまでは
+// 元の木のまま読め、途中で失敗しても元の木が残る。付け替えた後に元のページを空きページに戻す。
+// 作り直している間の書き込みは呼び出し側で止めておくこと
+func Rebuild(bufmgr *buffer.BufferPoolManager, tbl *SimpleTable, fillFactor float64) error {
+	opts := btree.RebuildOptions{FillFactor: fillFactor, Online: true}
+	if err := tbl.btree().RebuildWithOptions(bufmgr, opts); err != nil {
+		return err
+	}
+	return tbl.refreshZoneMap(bufmgr)
+}
+
+// refreshZoneMap はゾーンマップが設定されていれば、同じ列で作り直す
+// 木を作り直すとリーフのページIDが全て変わるので、記録した範囲は使えなくなる
+func (t *SimpleTable) refreshZoneMap(bufmgr *buffer.BufferPoolManager) error {
+	if t.zoneMap == nil {
+		return nil
+	}
+	return t.EnableZoneMap(bufmgr, t.zoneMap.Columns...)
 }
 
 // Insert はTupleをテーブルに挿入する
+// 同じキーの行が既にあれば btree.ErrDuplicateKey をラップした *ConstraintError を返す
+// NotNull や Checks に違反した行も、ErrNullValue や ErrCheckFailed をラップした *ConstraintError になる
 func (t *SimpleTable) Insert(bufmgr *buffer.BufferPoolManager, tuple Tuple) error {
+	return t.InsertContext(context.Background(), bufmgr, tuple)
+}
+
+// InsertContext は Insert と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) InsertContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple) error {
+	_, err := t.InsertReturningContext(ctx, bufmgr, tuple)
+	return err
+}
+
+// InsertReturningContext は InsertReturning と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) InsertReturningContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple) (Tuple, error) {
+	tuple, err := t.prepare(ctx, bufmgr, tuple)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.validate(tuple, 0); err != nil {
+		return nil, err
+	}
+	key, value := SplitTuple(tuple, t.NumKeyElems)
+	keyBytes, valueBytes := t.encodeKey(key), t.encodeValue(value)
+	err = t.insertEncoded(ctx, bufmgr, keyBytes, valueBytes)
+	if err == btree.ErrDuplicateKey && (t.SoftDelete || t.Expiry) {
+		// 削除済みか期限切れの行なら置き換えてよい
+		err = t.reviveDeleted(ctx, bufmgr, keyBytes, valueBytes)
+	}
+	if err == btree.ErrDuplicateKey {
+		return nil, t.duplicateKeyError(keyBytes, 0, err)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tuple, nil
+}
+
+// Upsert は行を書き込む。同じキーの行があれば値を置き換え、なければ挿入する
+// 存在の確認から書き込みまでを1回のリーフ探索の中で行う（btree.BTree.Merge）
+// 削除済みの印が付いた行や期限切れの行も置き換える
+func (t *SimpleTable) Upsert(bufmgr *buffer.BufferPoolManager, tuple Tuple) error {
+	return t.UpsertContext(context.Background(), bufmgr, tuple)
+}
+
+// UpsertContext は Upsert と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) UpsertContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	tuple, err := t.prepare(ctx, bufmgr, tuple)
+	if err != nil {
+		return err
+	}
+	if err := t.validate(tuple, 0); err != nil {
+		return err
+	}
 	key, value := SplitTuple(tuple, t.NumKeyElems)
-	keyBytes := key.Encode()
-	valueBytes := value.Encode()
+	keyBytes, valueBytes := t.encodeKey(key), t.encodeValue(value)
+	if err := t.btree().Merge(bufmgr, keyBytes, func([]byte) []byte { return valueBytes }); err != nil {
+		return err
+	}
+	return t.updateZoneMap(ctx, bufmgr, keyBytes, valueBytes)
+}
+
+// InsertIgnore は同じキーの行がなければ挿入し、挿入したかを返す
+// 同じキーの行があればエラーにせずに何もしないので、同じデータを何度読み込んでもよい
+func (t *SimpleTable) InsertIgnore(bufmgr *buffer.BufferPoolManager, tuple Tuple) (bool, error) {
+	return t.InsertIgnoreContext(context.Background(), bufmgr, tuple)
+}
+
+// InsertIgnoreContext は InsertIgnore と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) InsertIgnoreContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, tuple Tuple) (bool, error) {
+	err := t.InsertContext(ctx, bufmgr, tuple)
+	if errors.Is(err, btree.ErrDuplicateKey) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// insertEncoded はエンコード済みのキーと値を挿入する
+// ゾーンマップが設定されていれば合わせて更新する
+func (t *SimpleTable) insertEncoded(ctx context.Context, bufmgr *buffer.BufferPoolManager, key, value []byte) error {
+	if err := t.btree().InsertContext(ctx, bufmgr, key, value); err != nil {
+		return err
+	}
+	return t.updateZoneMap(ctx, bufmgr, key, value)
+}
+
+// Delete はキーに一致する行を削除する
+// 行が存在しない場合は btree.ErrKeyNotFound を返す
+// SoftDelete が有効なテーブルでは墓標列に削除済みの印を付けるだけで、行は Purge まで残る
+func (t *SimpleTable) Delete(bufmgr *buffer.BufferPoolManager, key Tuple) error {
+	return t.DeleteContext(context.Background(), bufmgr, key)
+}
+
+// DeleteContext は Delete と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) DeleteContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, key Tuple) error {
+	if t.SoftDelete {
+		return t.softDelete(ctx, bufmgr, t.encodeKey(key))
+	}
+	return t.deleteEncoded(ctx, bufmgr, t.encodeKey(key))
+}
+
+// deleteEncoded はエンコード済みのキーの行を削除する
+// ゾーンマップが設定されていれば、削除で行が移り得るリーフの範囲を先に忘れる
+func (t *SimpleTable) deleteEncoded(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) error {
+	if err := t.forgetZones(ctx, bufmgr, key); err != nil {
+		return err
+	}
+	return t.btree().DeleteContext(ctx, bufmgr, key)
+}
 
-	return t.btree().Insert(bufmgr, keyBytes, valueBytes)
+// lookup はエンコード済みのキーに一致する値を返す
+// 見つからない場合は (nil, false, nil) を返す
+// 削除済みの印が付いた行もそのまま返す（墓標列は値に含まれる）
+func (t *SimpleTable) lookup(ctx context.Context, bufmgr *buffer.BufferPoolManager, keyBytes []byte) ([]byte, bool, error) {
+	value, err := t.btree().GetContext(ctx, bufmgr, keyBytes)
+	if errors.Is(err, btree.ErrKeyNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return value, true, nil
 }
 
 // Scan はテーブルの全行をスキャンするイテレータを返す
 func (t *SimpleTable) Scan(bufmgr *buffer.BufferPoolManager) (*TableIter, error) {
-	iter, err := t.btree().Search(bufmgr, btree.NewSearchStart())
+	return t.ScanContext(context.Background(), bufmgr)
+}
+
+// ScanContext は Scan と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) ScanContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (*TableIter, error) {
+	iter, err := t.btree().SearchContext(ctx, bufmgr, btree.NewSearchStart())
 	if err != nil {
 		return nil, err
 	}
 
-	return &TableIter{
-		btreeIter:   iter,
-		numKeyElems: t.NumKeyElems,
-	}, nil
+	return t.newIter(iter), nil
 }
 
 // ScanFrom は指定したキーからスキャンするイテレータを返す
 func (t *SimpleTable) ScanFrom(bufmgr *buffer.BufferPoolManager, searchKey Tuple) (*TableIter, error) {
-	keyBytes := searchKey.Encode()
-	iter, err := t.btree().Search(bufmgr, btree.NewSearchKey(keyBytes))
+	return t.ScanFromContext(context.Background(), bufmgr, searchKey)
+}
+
+// ScanFromContext は ScanFrom と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+func (t *SimpleTable) ScanFromContext(ctx context.Context, bufmgr *buffer.BufferPoolManager, searchKey Tuple) (*TableIter, error) {
+	keyBytes := t.encodeKey(searchKey)
+	iter, err := t.btree().SearchContext(ctx, bufmgr, btree.NewSearchKey(keyBytes))
 	if err != nil {
 		return nil, err
 	}
 
+	return t.newIter(iter), nil
+}
+
+// newIter は B-tree のイテレータから TableIter を作る
+func (t *SimpleTable) newIter(iter *btree.Iter) *TableIter {
 	return &TableIter{
 		btreeIter:   iter,
 		numKeyElems: t.NumKeyElems,
-	}, nil
+		codec:       t.codec(),
+		softDelete:  t.SoftDelete,
+		expiry:      t.expiryChecker(),
+	}
 }
 
 // TableIter はテーブルのイテレータ
 type TableIter struct {
 	btreeIter   *btree.Iter
 	numKeyElems int
+	codec       TupleCodec
+
+	softDelete     bool // 値の末尾に墓標列がある
+	includeDeleted bool // 削除済みの行も返す
+	deleted        bool // 直前に返した行が削除済みか
+
+	expiry *expiryChecker // 期限切れの行を読み飛ばす（nilなら読み飛ばさない）
+
+	filter        *columnRange // 行の絞り込み条件（nilなら全行）
+	zoneMap       *ZoneMap     // リーフの読み飛ばしに使うゾーンマップ
+	checkedPageID *disk.PageID // ゾーンマップで判定済みのリーフ
+
+	columns   []int            // 返す列（nilなら全列）
+	predicate func(Tuple) bool // 射影した行に対する絞り込み条件（nilなら全行）
+
+	err error // All のループを終わらせたエラー（seq.go）
 }
 
 // Next は次のTupleを返す
 func (it *TableIter) Next(bufmgr *buffer.BufferPoolManager) (Tuple, error) {
-	pair, err := it.btreeIter.Next(bufmgr)
-	if err != nil {
-		return nil, err
-	}
-	if pair == nil {
-		return nil, nil
+	return it.NextContext(context.Background(), bufmgr)
+}
+
+// NextContext は Next と同じだが、ctx がキャンセルされたら ctx.Err() を返す
+// 絞り込み条件に合わない行を読み飛ばしている間もキャンセルを確認する
+func (it *TableIter) NextContext(ctx context.Context, bufmgr *buffer.BufferPoolManager) (Tuple, error) {
+	for {
+		if err := it.skipLeaves(ctx, bufmgr); err != nil {
+			return nil, err
+		}
+
+		pair, err := it.btreeIter.NextContext(ctx, bufmgr)
+		if err != nil {
+			return nil, err
+		}
+		if pair == nil {
+			return nil, nil
+		}
+		if it.expiry != nil && it.expiry.expired(pair.Key, pair.Value) {
+			continue
+		}
+
+		var tuple Tuple
+		var deleted bool
+		if it.columns != nil {
+			tuple, deleted = it.project(pair)
+		} else {
+			var value Tuple
+			value, deleted = decodeValue(it.codec, pair.Value, it.softDelete)
+			tuple = MergeTuple(it.codec.Decode(pair.Key), value)
+		}
+		if deleted && !it.includeDeleted {
+			continue
+		}
+
+		if (it.filter == nil || it.filter.match(tuple)) && (it.predicate == nil || it.predicate(tuple)) {
+			it.deleted = deleted
+			return tuple, nil
+		}
 	}
+}
+
+// Err は All のループを終わらせたエラーを返す。最後まで読めたなら nil
+func (it *TableIter) Err() error {
+	return it.err
+}
 
-	key := DecodeTuple(pair.Key)
-	value := DecodeTuple(pair.Value)
+// Close はイテレータが保持しているページのピンを外す
+// 最後まで読まずにスキャンを打ち切る場合は必ず呼ぶこと
+func (it *TableIter) Close(bufmgr *buffer.BufferPoolManager) {
+	it.btreeIter.Close(bufmgr)
+}
 
-	return MergeTuple(key, value), nil
+// skipLeaves は絞り込み条件に合う行を含み得ないリーフを読み飛ばす
+func (it *TableIter) skipLeaves(ctx context.Context, bufmgr *buffer.BufferPoolManager) error {
+	if it.filter == nil || it.zoneMap == nil {
+		return nil
+	}
+	for {
+		pageID := it.btreeIter.PageID()
+		if it.checkedPageID != nil && *it.checkedPageID == pageID {
+			return nil
+		}
+		it.checkedPageID = &pageID
+
+		if it.zoneMap.mayContain(pageID, it.filter.col, it.filter.lo, it.filter.hi) {
+			return nil
+		}
+		if err := it.btreeIter.SkipLeafContext(ctx, bufmgr); err != nil {
+			return err
+		}
+	}
 }
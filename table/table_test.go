@@ -0,0 +1,1409 @@
+package table
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// テスト用のヘルパー関数
+func setupTestEnv(t *testing.T) (*buffer.BufferPoolManager, func()) {
+	t.Helper()
+
+	tmpFile, err := os.CreateTemp("", "table_test_*.db")
+	if err != nil {
+		t.Fatalf("failed to create temp file: %v", err)
+	}
+	tmpPath := tmpFile.Name()
+	tmpFile.Close()
+
+	diskMgr, err := disk.Open(tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		t.Fatalf("failed to open disk manager: %v", err)
+	}
+
+	pool := buffer.NewBufferPool(10)
+	bufmgr := buffer.NewBufferPoolManager(diskMgr, pool)
+
+	cleanup := func() {
+		os.Remove(tmpPath)
+	}
+
+	return bufmgr, cleanup
+}
+
+// scanAll はテーブルの全行を文字列のスライスとして返す
+func scanAll(t *testing.T, bufmgr *buffer.BufferPoolManager, tbl *SimpleTable) [][]string {
+	t.Helper()
+
+	iter, err := tbl.Scan(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var rows [][]string
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if tuple == nil {
+			break
+		}
+		row := make([]string, len(tuple))
+		for i, elem := range tuple {
+			row[i] = string(elem)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestWriteBatchApply(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	users, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	orders, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := users.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := users.Insert(bufmgr, Tuple{[]byte("2"), []byte("Bob")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put(users, Tuple{[]byte("1"), []byte("Alicia")})
+	batch.Delete(users, Tuple{[]byte("2")})
+	batch.Put(orders, Tuple{[]byte("100"), []byte("1")})
+	if err := batch.Apply(bufmgr); err != nil {
+		t.Fatalf("failed to apply batch: %v", err)
+	}
+
+	if got := fmt.Sprint(scanAll(t, bufmgr, users)); got != "[[1 Alicia]]" {
+		t.Errorf("unexpected users: %s", got)
+	}
+	if got := fmt.Sprint(scanAll(t, bufmgr, orders)); got != "[[100 1]]" {
+		t.Errorf("unexpected orders: %s", got)
+	}
+}
+
+func TestWriteBatchTruncate(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	users, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	batch := NewWriteBatch()
+	batch.Put(users, Tuple{[]byte("1"), []byte("Alice")})
+	mark := batch.Len()
+	batch.Put(users, Tuple{[]byte("2"), []byte("Bob")})
+	batch.Delete(users, Tuple{[]byte("1")})
+	batch.Truncate(mark)
+	batch.Truncate(10)
+	if batch.Len() != 1 {
+		t.Fatalf("expected 1 op, got %d", batch.Len())
+	}
+	if err := batch.Apply(bufmgr); err != nil {
+		t.Fatalf("failed to apply batch: %v", err)
+	}
+	if got := fmt.Sprint(scanAll(t, bufmgr, users)); got != "[[1 Alice]]" {
+		t.Errorf("unexpected users: %s", got)
+	}
+}
+
+func TestWriteBatchRollback(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	// 存在しないページを指すテーブルへの操作を最後に積んで、途中で失敗させる
+	broken := NewSimpleTable(disk.PageID(1000), 1)
+	batch := NewWriteBatch()
+	batch.Put(tbl, Tuple{[]byte("1"), []byte("Alicia")})
+	batch.Put(tbl, Tuple{[]byte("2"), []byte("Bob")})
+	batch.Put(broken, Tuple{[]byte("3"), []byte("Carol")})
+	if err := batch.Apply(bufmgr); err == nil {
+		t.Fatal("expected apply to fail")
+	}
+
+	// 全ての操作が取り消されているか
+	if got := fmt.Sprint(scanAll(t, bufmgr, tbl)); got != "[[1 Alice]]" {
+		t.Errorf("unexpected rows after rollback: %s", got)
+	}
+}
+
+func TestWriteBatchConstraintError(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Insert(tbl, Tuple{[]byte("2"), []byte("Bob")})
+	batch.Insert(tbl, Tuple{[]byte("1"), []byte("Alicia")})
+	err = batch.Apply(bufmgr)
+
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) {
+		t.Fatalf("expected ConstraintError, got %v", err)
+	}
+	if !errors.Is(err, btree.ErrDuplicateKey) {
+		t.Errorf("expected error to wrap ErrDuplicateKey, got %v", err)
+	}
+	if cerr.Constraint != ConstraintPrimaryKey || cerr.Position != 1 || fmt.Sprint(cerr.Columns) != "[0]" {
+		t.Errorf("unexpected constraint error: %+v", cerr)
+	}
+	if len(cerr.Key) != 1 || string(cerr.Key[0]) != "1" {
+		t.Errorf("unexpected key: %v", cerr.Key)
+	}
+
+	// 単独の Insert でも同じ形のエラーになる
+	err = tbl.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alicia")})
+	if !errors.As(err, &cerr) || cerr.Position != 0 {
+		t.Errorf("expected ConstraintError at position 0, got %v", err)
+	}
+}
+
+func TestNotNullAndCheck(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{
+		NotNull: []int{1},
+		Checks: []Check{{
+			Name:   "age_positive",
+			Column: 2,
+			Valid:  func(value []byte) bool { return len(value) > 0 && value[0] != '-' },
+		}},
+	})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	// NULL の列は CHECK を通る
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("2"), []byte{}, []byte("30")}); err != nil {
+		t.Fatalf("expected empty value to be allowed, got %v", err)
+	}
+
+	var cerr *ConstraintError
+	err = tbl.Insert(bufmgr, Tuple{[]byte("3"), nil, []byte("30")})
+	if !errors.As(err, &cerr) || !errors.Is(err, ErrNullValue) {
+		t.Fatalf("expected not null violation, got %v", err)
+	}
+	if cerr.Constraint != ConstraintNotNull || fmt.Sprint(cerr.Columns) != "[1]" || string(cerr.Key[0]) != "3" {
+		t.Errorf("unexpected constraint error: %+v", cerr)
+	}
+	if err := tbl.Upsert(bufmgr, Tuple{[]byte("1")}); !errors.Is(err, ErrNullValue) {
+		t.Errorf("expected not null violation on upsert, got %v", err)
+	}
+	err = tbl.Upsert(bufmgr, Tuple{[]byte("1"), []byte("Alice"), []byte("-1")})
+	if !errors.As(err, &cerr) || !errors.Is(err, ErrCheckFailed) || cerr.Constraint != "age_positive" {
+		t.Errorf("expected check violation, got %v", err)
+	}
+
+	err = tbl.InsertBatch(bufmgr, []Tuple{
+		{[]byte("4"), []byte("Dave")},
+		{[]byte("5"), []byte("Eve"), []byte("-5")},
+	})
+	if !errors.As(err, &cerr) || cerr.Position != 1 {
+		t.Errorf("expected check violation at position 1, got %v", err)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put(tbl, Tuple{[]byte("6"), []byte("Frank")})
+	batch.Insert(tbl, Tuple{[]byte("7")})
+	err = batch.Apply(bufmgr)
+	if !errors.As(err, &cerr) || cerr.Position != 1 || !errors.Is(err, ErrNullValue) {
+		t.Errorf("expected not null violation at position 1, got %v", err)
+	}
+
+	if got := fmt.Sprint(scanAll(t, bufmgr, tbl)); got != "[[1 Alice] [2  30]]" {
+		t.Errorf("expected rejected rows to be left out, got %s", got)
+	}
+}
+
+func TestAutoIncrementAndDefaults(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{
+		AutoIncrement: true,
+		Defaults:      map[int][]byte{2: []byte("active")},
+		NotNull:       []int{2},
+	})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	row, err := tbl.InsertReturning(bufmgr, Tuple{nil, []byte("Alice")})
+	if err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if id, ok := DecodeSequence(row[0]); !ok || id != 1 || string(row[2]) != "active" {
+		t.Errorf("unexpected returned row: %q", row)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{nil, []byte("Bob"), []byte("banned")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	// 値を指定した行はそのまま挿入し、連番は進めない
+	if err := tbl.Insert(bufmgr, Tuple{EncodeSequence(10), []byte("Carol")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := tbl.InsertBatch(bufmgr, []Tuple{{nil, []byte("Dave")}}); err != nil {
+		t.Fatalf("failed to insert batch: %v", err)
+	}
+	if err := tbl.Upsert(bufmgr, Tuple{EncodeSequence(10), []byte("Caroline")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+
+	var got []string
+	for _, row := range scanAll(t, bufmgr, tbl) {
+		id, _ := DecodeSequence([]byte(row[0]))
+		got = append(got, fmt.Sprintf("%d %s %s", id, row[1], row[2]))
+	}
+	want := []string{"1 Alice active", "2 Bob banned", "3 Dave active", "10 Caroline active"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	batch := NewWriteBatch()
+	batch.Put(tbl, Tuple{EncodeSequence(11), []byte("Eve")})
+	batch.Insert(tbl, Tuple{nil, []byte("Frank")})
+	if err := batch.Apply(bufmgr); !errors.Is(err, ErrAutoIncrementInBatch) {
+		t.Errorf("expected ErrAutoIncrementInBatch, got %v", err)
+	}
+}
+
+func TestSimpleTableInsertBatch(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("10"), []byte("old")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("10")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	scanKeys := func() []string {
+		iter, err := tbl.Scan(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		var keys []string
+		for {
+			tuple, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next: %v", err)
+			}
+			if tuple == nil {
+				return keys
+			}
+			keys = append(keys, string(tuple[0])+"="+string(tuple[1]))
+		}
+	}
+
+	// 並びはキー順でなくてよく、削除済みの行は置き換えられる
+	rows := []Tuple{
+		{[]byte("30"), []byte("c")},
+		{[]byte("10"), []byte("a")},
+		{[]byte("20"), []byte("b")},
+	}
+	if err := tbl.InsertBatch(bufmgr, rows); err != nil {
+		t.Fatalf("failed to insert batch: %v", err)
+	}
+	if got := fmt.Sprint(scanKeys()); got != "[10=a 20=b 30=c]" {
+		t.Errorf("unexpected rows: %s", got)
+	}
+
+	// 既存の行と重複すると1行も挿入されない
+	err = tbl.InsertBatch(bufmgr, []Tuple{
+		{[]byte("40"), []byte("d")},
+		{[]byte("05"), []byte("e")},
+		{[]byte("20"), []byte("x")},
+	})
+	var cerr *ConstraintError
+	if !errors.As(err, &cerr) || cerr.Position != 2 || string(cerr.Key[0]) != "20" {
+		t.Fatalf("expected ConstraintError at position 2, got %v", err)
+	}
+	if got := fmt.Sprint(scanKeys()); got != "[10=a 20=b 30=c]" {
+		t.Errorf("batch was partially applied: %s", got)
+	}
+
+	// バッチ内の重複は後から現れた行を違反とする
+	err = tbl.InsertBatch(bufmgr, []Tuple{
+		{[]byte("50"), []byte("f")},
+		{[]byte("60"), []byte("g")},
+		{[]byte("50"), []byte("h")},
+	})
+	if !errors.As(err, &cerr) || cerr.Position != 2 || !errors.Is(err, btree.ErrDuplicateKey) {
+		t.Fatalf("expected ConstraintError at position 2, got %v", err)
+	}
+	if got := fmt.Sprint(scanKeys()); got != "[10=a 20=b 30=c]" {
+		t.Errorf("batch was partially applied: %s", got)
+	}
+}
+
+func TestSimpleTableDelete(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("1"), []byte("Alice")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("1")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("1")}); !errors.Is(err, btree.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+	if rows := scanAll(t, bufmgr, tbl); len(rows) != 0 {
+		t.Errorf("expected no rows, got %v", rows)
+	}
+}
+
+func TestSimpleTableSoftDelete(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		if err := tbl.Insert(bufmgr, Tuple{[]byte(name[:1]), []byte(name)}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("B")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("B")}); !errors.Is(err, btree.ErrKeyNotFound) {
+		t.Errorf("expected ErrKeyNotFound, got %v", err)
+	}
+
+	// 通常のスキャンでは削除済みの行は見えない
+	if got := fmt.Sprint(scanAll(t, bufmgr, tbl)); got != "[[A Alice] [C Carol]]" {
+		t.Errorf("unexpected rows: %s", got)
+	}
+
+	// 削除済みの行も含めてスキャンできる
+	iter, err := tbl.ScanIncludingDeleted(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var deleted []string
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if tuple == nil {
+			break
+		}
+		if iter.Deleted() {
+			deleted = append(deleted, string(tuple[1]))
+		}
+	}
+	if fmt.Sprint(deleted) != "[Bob]" {
+		t.Errorf("expected [Bob] to be deleted, got %v", deleted)
+	}
+
+	// WriteBatch の Delete も削除済みの印を付ける
+	batch := NewWriteBatch()
+	batch.Delete(tbl, Tuple{[]byte("C")})
+	if err := batch.Apply(bufmgr); err != nil {
+		t.Fatalf("failed to apply: %v", err)
+	}
+
+	// 削除済みのキーには再挿入できる
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("B"), []byte("Bill")}); err != nil {
+		t.Fatalf("failed to reinsert: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("B"), []byte("Ben")}); !errors.Is(err, btree.ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+
+	n, err := tbl.Purge(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to purge: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("expected 1 purged row, got %d", n)
+	}
+	if got := fmt.Sprint(scanAll(t, bufmgr, tbl)); got != "[[A Alice] [B Bill]]" {
+		t.Errorf("unexpected rows after purge: %s", got)
+	}
+}
+
+func TestImportExportCSV(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	// 3列目（id）をキーにして読み込む。重複した行と列の足りない行はエラーになる
+	input := "name,age,id\nAlice,25,1\nBob,30,2\nAlice2,26,1\nCarol,41\n"
+	result, err := ImportCSV(bufmgr, tbl, strings.NewReader(input), CSVOptions{
+		KeyColumns: []int{2},
+		Header:     true,
+		BatchSize:  2,
+	})
+	if err != nil {
+		t.Fatalf("failed to import: %v", err)
+	}
+	if result.Inserted != 2 {
+		t.Errorf("expected 2 inserted rows, got %d", result.Inserted)
+	}
+	if len(result.Errors) != 2 {
+		t.Fatalf("expected 2 row errors, got %v", result.Errors)
+	}
+	if result.Errors[0].Line != 4 || !errors.Is(result.Errors[0], btree.ErrDuplicateKey) {
+		t.Errorf("unexpected first row error: %v", result.Errors[0])
+	}
+	if result.Errors[1].Line != 5 {
+		t.Errorf("unexpected second row error: %v", result.Errors[1])
+	}
+
+	var out strings.Builder
+	if err := ExportCSV(bufmgr, tbl, &out); err != nil {
+		t.Fatalf("failed to export: %v", err)
+	}
+	if expected := "1,Alice,25\n2,Bob,30\n"; out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestScanColumnRangeWithZoneMap(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	// 時刻列がキーの順に増えていく、時系列的なデータ
+	insert := func(i int) {
+		tuple := Tuple{[]byte(fmt.Sprintf("id%05d", i)), []byte(fmt.Sprintf("ts%05d", i*10))}
+		if err := tbl.Insert(bufmgr, tuple); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	for i := 0; i < 400; i++ {
+		insert(i)
+	}
+	if err := tbl.EnableZoneMap(bufmgr, 1); err != nil {
+		t.Fatalf("failed to enable zone map: %v", err)
+	}
+	// ゾーンマップ作成後の挿入も範囲に反映される
+	insert(400)
+
+	// 先頭のリーフは条件に合わないので読み飛ばせるはず
+	iter, err := tbl.Scan(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if tbl.zoneMap.mayContain(iter.btreeIter.PageID(), 1, []byte("ts03900"), []byte("ts04000")) {
+		t.Errorf("expected first leaf to be skippable")
+	}
+
+	iter, err = tbl.ScanColumnRange(bufmgr, 1, []byte("ts03900"), []byte("ts04000"))
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var ids []string
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if tuple == nil {
+			break
+		}
+		ids = append(ids, string(tuple[0]))
+	}
+	expected := "[id00390 id00391 id00392 id00393 id00394 id00395 id00396 id00397 id00398 id00399 id00400]"
+	if got := fmt.Sprint(ids); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	// 書き出した範囲を読み戻すと同じになる。値のない列（2列目）も残る
+	if err := tbl.EnableZoneMap(bufmgr, 1, 2); err != nil {
+		t.Fatalf("failed to enable zone map: %v", err)
+	}
+	metaPageID, err := tbl.SaveZoneMap(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to save zone map: %v", err)
+	}
+	loaded := NewSimpleTable(tbl.MetaPageID, 1)
+	if err := loaded.LoadZoneMap(bufmgr, metaPageID, 1, 2); err != nil {
+		t.Fatalf("failed to load zone map: %v", err)
+	}
+	if !reflect.DeepEqual(loaded.zoneMap, tbl.zoneMap) {
+		t.Errorf("loaded zone map differs: %+v, expected %+v", loaded.zoneMap, tbl.zoneMap)
+	}
+
+	// 射影した列に範囲の列がなければ読めない
+	if _, err := tbl.ScanColumnRangeWithOptions(bufmgr, 1, nil, nil, ScanOptions{Columns: []int{0}}); !errors.Is(err, ErrColumnNotProjected) {
+		t.Errorf("expected ErrColumnNotProjected, got %v", err)
+	}
+	iter, err = tbl.ScanColumnRangeWithOptions(bufmgr, 1, []byte("ts04000"), nil, ScanOptions{Columns: []int{1, 0}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	if tuple, err := iter.Next(bufmgr); err != nil || fmt.Sprintf("%s", tuple) != "[ts04000 id00400]" {
+		t.Errorf("unexpected projected row %s (%v)", tuple, err)
+	}
+	iter.Close(bufmgr)
+}
+
+func TestScanWithOptions(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		tuple := Tuple{[]byte(fmt.Sprintf("id%03d", i)), []byte(fmt.Sprintf("name%03d", i)), []byte(fmt.Sprint(i % 3))}
+		if err := tbl.Insert(bufmgr, tuple); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("id003")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	// 3列目で絞り込み、3列目・1列目・存在しない列の順に射影する
+	iter, err := tbl.ScanWithOptions(bufmgr, ScanOptions{
+		Columns: []int{2, 0, 5},
+		Filter: func(tuple Tuple) bool {
+			return string(tuple[0]) == "0" && string(tuple[1]) < "id010"
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	var rows []string
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if tuple == nil {
+			break
+		}
+		if len(tuple) != 3 || tuple[2] != nil {
+			t.Fatalf("unexpected projection %q", tuple)
+		}
+		rows = append(rows, string(tuple[1])+"="+string(tuple[0]))
+	}
+	// id003 は削除済みなので返らない
+	expected := "[id000=0 id006=0 id009=0]"
+	if got := fmt.Sprint(rows); got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+
+	count, err := tbl.Count(bufmgr)
+	if err != nil {
+		t.Fatalf("failed to count: %v", err)
+	}
+	if count != 199 {
+		t.Errorf("expected 199 rows, got %d", count)
+	}
+
+	plain, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 300; i++ {
+		if err := plain.Insert(bufmgr, Tuple{[]byte(fmt.Sprintf("k%04d", i)), []byte("v")}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if count, err := plain.Count(bufmgr); err != nil || count != 300 {
+		t.Errorf("expected 300 rows, got %d (%v)", count, err)
+	}
+}
+
+func TestJoins(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	// users: [id, name] / orders: [order_id, user_id] / profiles: [id, city]
+	users, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	orders, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	profiles, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for i := 0; i < 30; i++ {
+		id := []byte(fmt.Sprintf("u%02d", i))
+		if err := users.Insert(bufmgr, Tuple{id, []byte(fmt.Sprintf("name%02d", i))}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+		if i%3 == 0 {
+			if err := profiles.Insert(bufmgr, Tuple{id, []byte("tokyo")}); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+	}
+	// u05 は2件、u07 は1件の注文、u99 は存在しないユーザー
+	for i, userID := range []string{"u05", "u07", "u05", "u99"} {
+		if err := orders.Insert(bufmgr, Tuple{[]byte(fmt.Sprintf("o%d", i)), []byte(userID)}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	collect := func(join func(emit JoinFunc) error) string {
+		t.Helper()
+		var pairs []string
+		if err := join(func(l, r Tuple) error {
+			pairs = append(pairs, string(l[0])+"-"+string(r[0]))
+			return nil
+		}); err != nil {
+			t.Fatalf("failed to join: %v", err)
+		}
+		sort.Strings(pairs)
+		return fmt.Sprint(pairs)
+	}
+
+	opts := JoinOptions{LeftColumn: 0, RightColumn: 1, BlockSize: 7}
+	expected := "[u05-o0 u05-o2 u07-o1]"
+	if got := collect(func(emit JoinFunc) error { return NestedLoopJoin(bufmgr, users, orders, opts, emit) }); got != expected {
+		t.Errorf("nested loop: expected %s, got %s", expected, got)
+	}
+	if got := collect(func(emit JoinFunc) error { return HashJoin(bufmgr, users, orders, opts, emit) }); got != expected {
+		t.Errorf("hash: expected %s, got %s", expected, got)
+	}
+	// 右の行数が上限を超えると一時ファイルに分割してから結合する
+	opts.MaxBuildRows, opts.Partitions = 2, 3
+	if got := collect(func(emit JoinFunc) error { return HashJoin(bufmgr, users, orders, opts, emit) }); got != expected {
+		t.Errorf("partitioned hash: expected %s, got %s", expected, got)
+	}
+
+	expected = "[u00-u00 u03-u03 u06-u06 u09-u09 u12-u12 u15-u15 u18-u18 u21-u21 u24-u24 u27-u27]"
+	if got := collect(func(emit JoinFunc) error { return MergeJoin(bufmgr, users, profiles, emit) }); got != expected {
+		t.Errorf("merge: expected %s, got %s", expected, got)
+	}
+
+	// Join は結合列とテーブルの大きさで方法を選ぶ
+	plans := []struct {
+		left, right *SimpleTable
+		opts        JoinOptions
+		method      JoinMethod
+		expected    string
+	}{
+		// キー全体どうしで同じコーデックなら merge join
+		{users, profiles, JoinOptions{}, JoinMerge, expected},
+		// キーでない列の結合で、左が1ブロックに収まれば nested loop
+		{users, orders, JoinOptions{RightColumn: 1}, JoinNestedLoop, "[u05-o0 u05-o2 u07-o1]"},
+		// 左が1ブロックに収まらなければ hash join
+		{users, orders, JoinOptions{RightColumn: 1, BlockSize: 7}, JoinHash, "[u05-o0 u05-o2 u07-o1]"},
+		// キーでない列どうしなら、キーの順は使えない
+		{users, profiles, JoinOptions{LeftColumn: 1, RightColumn: 1, BlockSize: 7}, JoinHash, "[]"},
+	}
+	for i, p := range plans {
+		method, err := PlanJoin(bufmgr, p.left, p.right, p.opts)
+		if err != nil {
+			t.Fatalf("plan %d: failed to plan join: %v", i, err)
+		}
+		if method != p.method {
+			t.Errorf("plan %d: expected %s, got %s", i, p.method, method)
+		}
+		if got := collect(func(emit JoinFunc) error { return Join(bufmgr, p.left, p.right, p.opts, emit) }); got != p.expected {
+			t.Errorf("plan %d: expected %s, got %s", i, p.expected, got)
+		}
+	}
+
+	// コーデックが違えばキーの順が揃わないので merge join は選ばない
+	other := NewSimpleTableWithOptions(users.MetaPageID, 1, Options{Codec: separatorCodec{}})
+	if method, err := PlanJoin(bufmgr, other, profiles, JoinOptions{BlockSize: 7}); err != nil || method != JoinHash {
+		t.Errorf("expected hash join for different codecs, got %s (%v)", method, err)
+	}
+}
+
+// separatorCodec は要素を区切り文字でつなぐだけの TupleCodec
+type separatorCodec struct{}
+
+func (separatorCodec) Encode(tuple Tuple) []byte {
+	parts := make([]string, len(tuple))
+	for i, elem := range tuple {
+		parts[i] = string(elem)
+	}
+	return []byte(strings.Join(parts, "|"))
+}
+
+func (separatorCodec) Decode(data []byte) Tuple {
+	var tuple Tuple
+	for _, part := range strings.Split(string(data), "|") {
+		tuple = append(tuple, []byte(part))
+	}
+	return tuple
+}
+
+func (separatorCodec) CompareKey(a, b []byte) int {
+	return strings.Compare(string(a), string(b))
+}
+
+func TestTableCodec(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{Codec: separatorCodec{}, SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for _, row := range [][]string{{"2", "Bob", "30"}, {"1", "Alice", "25"}, {"3", "Carol", "41"}} {
+		if err := tbl.Insert(bufmgr, Tuple{[]byte(row[0]), []byte(row[1]), []byte(row[2])}); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("3")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	// B-tree にはコーデックの形式で格納される
+	iter, err := btree.NewBTree(tbl.MetaPageID).Search(bufmgr, btree.NewSearchStart())
+	if err != nil {
+		t.Fatalf("failed to search: %v", err)
+	}
+	pair, err := iter.Next(bufmgr)
+	iter.Close(bufmgr)
+	if err != nil || string(pair.Key) != "1" || string(pair.Value) != "Alice|25|\x00" {
+		t.Fatalf("unexpected stored pair %q=%q (%v)", pair.Key, pair.Value, err)
+	}
+
+	if got := fmt.Sprint(scanAll(t, bufmgr, tbl)); got != "[[1 Alice 25] [2 Bob 30]]" {
+		t.Errorf("unexpected rows: %s", got)
+	}
+	scan, err := tbl.ScanWithOptions(bufmgr, ScanOptions{Columns: []int{2}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	defer scan.Close(bufmgr)
+	if tuple, err := scan.Next(bufmgr); err != nil || fmt.Sprintf("%s", tuple) != "[25]" {
+		t.Errorf("unexpected projection %s (%v)", tuple, err)
+	}
+
+	var cerr *ConstraintError
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("1"), []byte("Dave"), []byte("50")}); !errors.As(err, &cerr) || string(cerr.Key[0]) != "1" {
+		t.Errorf("expected a constraint error with the decoded key, got %v", err)
+	}
+}
+
+func TestSimpleTableFlush(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	a, _ := Create(bufmgr, 1)
+	b, _ := Create(bufmgr, 1)
+	if err := a.Insert(bufmgr, Tuple{[]byte("k"), []byte(strings.Repeat("v", 3000))}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Insert(bufmgr, Tuple{[]byte("k"), []byte("v")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a のメタページ・リーフ・オーバーフローページだけを書く
+	before := bufmgr.Stats()
+	if err := a.Flush(bufmgr); err != nil {
+		t.Fatalf("failed to flush table: %v", err)
+	}
+	if writes := bufmgr.Stats().Sub(before).Writes; writes != 3 {
+		t.Errorf("expected 3 pages written for table a, got %d", writes)
+	}
+
+	// 残りの dirty ページは b の2ページだけ。もう一度 Flush しても何も書かない
+	before = bufmgr.Stats()
+	if err := bufmgr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := bufmgr.Stats().Sub(before).Writes; writes != 2 {
+		t.Errorf("expected 2 pages written for table b, got %d", writes)
+	}
+	before = bufmgr.Stats()
+	bufmgr.Flush()
+	if writes := bufmgr.Stats().Sub(before).Writes; writes != 0 {
+		t.Errorf("expected no pages written for clean pool, got %d", writes)
+	}
+}
+
+func TestScanPrefix(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 2)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for user := 1; user <= 3; user++ {
+		for ts := 0; ts < 100; ts++ {
+			row := Tuple{[]byte(fmt.Sprintf("u%d", user)), []byte(fmt.Sprintf("%03d", ts)), []byte("event")}
+			if err := tbl.Insert(bufmgr, row); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+	}
+	// 先頭の列が長いだけのユーザーは含まない
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("u22"), []byte("000"), []byte("event")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	iter, err := tbl.ScanPrefix(bufmgr, Tuple{[]byte("u2")})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	defer iter.Close(bufmgr)
+	count := 0
+	for {
+		tuple, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if tuple == nil {
+			break
+		}
+		if string(tuple[0]) != "u2" {
+			t.Fatalf("unexpected row %s", tuple)
+		}
+		count++
+	}
+	if count != 100 {
+		t.Errorf("expected 100 rows, got %d", count)
+	}
+
+	// キー全体を指定すれば1行だけ
+	one, err := tbl.ScanPrefix(bufmgr, Tuple{[]byte("u3"), []byte("042")})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	defer one.Close(bufmgr)
+	if tuple, _ := one.Next(bufmgr); fmt.Sprintf("%s", tuple) != "[u3 042 event]" {
+		t.Errorf("unexpected row %s", tuple)
+	}
+	if tuple, _ := one.Next(bufmgr); tuple != nil {
+		t.Errorf("expected a single row, got %s", tuple)
+	}
+
+	if _, err := tbl.ScanPrefix(bufmgr, Tuple{[]byte("a"), []byte("b"), []byte("c")}); !errors.Is(err, ErrKeyColumnsMismatch) {
+		t.Errorf("expected ErrKeyColumnsMismatch, got %v", err)
+	}
+	custom, err := CreateWithOptions(bufmgr, 1, Options{Codec: separatorCodec{}})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if _, err := custom.ScanPrefix(bufmgr, Tuple{[]byte("a")}); !errors.Is(err, ErrPrefixScanUnsupported) {
+		t.Errorf("expected ErrPrefixScanUnsupported, got %v", err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	row := func(i int) Tuple {
+		return Tuple{[]byte(fmt.Sprintf("id%05d", i)), []byte(fmt.Sprintf("ts%05d", i*10)), []byte(strings.Repeat("x", 40))}
+	}
+	for i := 0; i < 2000; i++ {
+		if err := tbl.Insert(bufmgr, row(i)); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := tbl.EnableZoneMap(bufmgr, 1); err != nil {
+		t.Fatalf("failed to enable zone map: %v", err)
+	}
+	scanRange := func(lo, hi string) []string {
+		t.Helper()
+		iter, err := tbl.ScanColumnRange(bufmgr, 1, []byte(lo), []byte(hi))
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		var ids []string
+		for {
+			tuple, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next: %v", err)
+			}
+			if tuple == nil {
+				return ids
+			}
+			ids = append(ids, string(tuple[0]))
+		}
+	}
+
+	// 削除でリーフが併合されて行が隣に移っても、範囲の検索で読み落とさない
+	for i := 0; i < 2000; i++ {
+		if i%4 != 0 {
+			if err := tbl.Delete(bufmgr, Tuple{row(i)[0]}); err != nil {
+				t.Fatalf("failed to delete: %v", err)
+			}
+		}
+	}
+	for i := 0; i < 2000; i += 4 {
+		ts := string(row(i)[1])
+		if got := scanRange(ts, ts); len(got) != 1 || got[0] != string(row(i)[0]) {
+			t.Fatalf("after deletes: expected %s for %s, got %v", row(i)[0], ts, got)
+		}
+	}
+	expected := "[id01000 id01004 id01008 id01012 id01016 id01020 id01024 id01028]"
+
+	if err := Rebuild(bufmgr, tbl, 2); !errors.Is(err, btree.ErrInvalidFillFactor) {
+		t.Errorf("expected ErrInvalidFillFactor, got %v", err)
+	}
+	for _, fillFactor := range []float64{0.7, 0.9} {
+		if err := Rebuild(bufmgr, tbl, fillFactor); err != nil {
+			t.Fatalf("failed to rebuild: %v", err)
+		}
+		stats, err := btree.Stats(bufmgr, tbl.btree())
+		if err != nil {
+			t.Fatalf("failed to get stats: %v", err)
+		}
+		if fill := stats.Levels[len(stats.Levels)-1].FillFactor; fill > fillFactor || fill < fillFactor-0.1 {
+			t.Errorf("expected leaves filled to %.2f, got %.2f", fillFactor, fill)
+		}
+		if rows := scanAll(t, bufmgr, tbl); len(rows) != 500 {
+			t.Errorf("expected 500 rows, got %d", len(rows))
+		}
+		// ゾーンマップは新しいリーフで作り直されている
+		if got := fmt.Sprint(scanRange("ts10000", "ts10300")); got != expected {
+			t.Errorf("after rebuild: expected %s, got %s", expected, got)
+		}
+		iter, err := tbl.Scan(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		if tbl.zoneMap.mayContain(iter.btreeIter.PageID(), 1, []byte("ts19000"), nil) {
+			t.Error("expected first leaf to be skippable after rebuild")
+		}
+		iter.Close(bufmgr)
+	}
+}
+
+func TestAnalyze(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	n := 5000
+	for i := 0; i < n; i++ {
+		row := Tuple{[]byte(fmt.Sprintf("id%05d", i)), []byte(fmt.Sprintf("c%d", i%10))}
+		if i%2 == 0 {
+			// 3列目は半分の行にしかない
+			row = append(row, []byte("x"))
+		}
+		if err := tbl.Insert(bufmgr, row); err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+
+	stats, err := Analyze(bufmgr, tbl, AnalyzeOptions{SampleSize: 1000, Buckets: 10})
+	if err != nil {
+		t.Fatalf("failed to analyze: %v", err)
+	}
+	if stats.Rows != n || stats.Sampled != 1000 || len(stats.Columns) != 3 {
+		t.Fatalf("unexpected statistics: rows=%d sampled=%d columns=%d", stats.Rows, stats.Sampled, len(stats.Columns))
+	}
+	if id := stats.Columns[0]; id.Count != n || id.Distinct < n*95/100 || id.Distinct > n {
+		t.Errorf("id: expected count %d and about %d distinct, got %d, %d", n, n, id.Count, id.Distinct)
+	}
+	if category := stats.Columns[1]; category.Distinct != 10 {
+		t.Errorf("category: expected 10 distinct, got %d", category.Distinct)
+	}
+	if x := stats.Columns[2]; x.Count != n/2 || x.Distinct != 1 {
+		t.Errorf("x: expected count %d and 1 distinct, got %d, %d", n/2, x.Count, x.Distinct)
+	}
+	if bounds := stats.Columns[0].Bounds; len(bounds) != 11 || string(bounds[0]) > "id00100" || string(bounds[10]) < "id04900" {
+		t.Errorf("unexpected id bounds: %q", bounds)
+	}
+
+	within := func(name string, got, want int) {
+		t.Helper()
+		if got < want*75/100 || got > want*125/100 {
+			t.Errorf("%s: expected about %d, got %d", name, want, got)
+		}
+	}
+	within("id range", stats.EstimateRows(0, []byte("id01000"), []byte("id02999")), 2000)
+	within("id from", stats.EstimateRows(0, []byte("id04000"), nil), 1000)
+	within("category", stats.EstimateRows(1, []byte("c3"), []byte("c3")), 500)
+	if got := stats.EstimateRows(0, []byte("zzz"), nil); got != 0 {
+		t.Errorf("expected 0 rows above the maximum, got %d", got)
+	}
+	if got := stats.EstimateRows(0, []byte("id02000"), []byte("id01000")); got != 0 {
+		t.Errorf("expected 0 rows for reversed range, got %d", got)
+	}
+	if got := stats.EstimateRows(7, nil, nil); got != 0 {
+		t.Errorf("expected 0 rows for missing column, got %d", got)
+	}
+
+	decoded, err := DecodeStatistics(stats.Encode())
+	if err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, stats) {
+		t.Errorf("decoded statistics differ: %+v", decoded)
+	}
+	encoded := stats.Encode()
+	if _, err := DecodeStatistics(encoded[:len(encoded)-1]); !errors.Is(err, ErrInvalidStatistics) {
+		t.Errorf("expected ErrInvalidStatistics, got %v", err)
+	}
+
+	empty, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if stats, err := Analyze(bufmgr, empty, AnalyzeOptions{}); err != nil || stats.Rows != 0 || len(stats.Columns) != 0 {
+		t.Errorf("unexpected statistics for empty table: %+v, %v", stats, err)
+	}
+}
+
+func TestResume(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManagerWithOptions(disk.NewMemManager(), buffer.NewBufferPool(100), buffer.Options{
+		TrackPins: true,
+	})
+	tbl, err := CreateWithOptions(bufmgr, 2, Options{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	for _, user := range []string{"u1", "u2"} {
+		for i := 0; i < 50; i++ {
+			if err := tbl.Insert(bufmgr, Tuple{[]byte(user), []byte(fmt.Sprintf("%03d", i)), []byte("v")}); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+		}
+	}
+
+	// 10行ずつ読み、ページの間で閉じて書き込む
+	var got []string
+	iter, err := tbl.ScanWithOptions(bufmgr, ScanOptions{Columns: []int{0, 1}})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	for page := 0; ; page++ {
+		n := 0
+		for ; n < 10; n++ {
+			row, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next: %v", err)
+			}
+			if row == nil {
+				break
+			}
+			if len(row) != 2 {
+				t.Fatalf("expected projected row, got %q", row)
+			}
+			got = append(got, string(row[0])+"/"+string(row[1]))
+		}
+		token := iter.Token()
+		iter.Close(bufmgr)
+		if n < 10 {
+			break
+		}
+		if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+			t.Fatalf("pins left between pages: %v", leaks)
+		}
+		if page == 2 {
+			// 読み終えた行の前に挿入した行は返さず、まだ読んでいない行の削除は反映される
+			if err := tbl.Insert(bufmgr, Tuple{[]byte("u0"), []byte("000"), []byte("v")}); err != nil {
+				t.Fatalf("failed to insert: %v", err)
+			}
+			if err := tbl.Delete(bufmgr, Tuple{[]byte("u2"), []byte("000")}); err != nil {
+				t.Fatalf("failed to delete: %v", err)
+			}
+		}
+		if iter, err = tbl.ResumeWithOptions(bufmgr, token, ScanOptions{Columns: []int{0, 1}}); err != nil {
+			t.Fatalf("failed to resume: %v", err)
+		}
+	}
+	if len(got) != 99 || got[0] != "u1/000" || got[50] != "u2/001" || got[98] != "u2/049" {
+		t.Errorf("unexpected rows: %d rows, %v", len(got), got)
+	}
+
+	// 接頭辞のスキャンは再開しても接頭辞で止まる
+	iter, err = tbl.ScanPrefix(bufmgr, Tuple{[]byte("u1")})
+	if err != nil {
+		t.Fatalf("failed to scan prefix: %v", err)
+	}
+	for i := 0; i < 45; i++ {
+		iter.Next(bufmgr)
+	}
+	token := iter.Token()
+	iter.Close(bufmgr)
+	iter, err = tbl.Resume(bufmgr, token)
+	if err != nil {
+		t.Fatalf("failed to resume: %v", err)
+	}
+	rest := 0
+	for row, _ := iter.Next(bufmgr); row != nil; row, _ = iter.Next(bufmgr) {
+		rest++
+	}
+	iter.Close(bufmgr)
+	if rest != 5 {
+		t.Errorf("expected 5 rows after resume, got %d", rest)
+	}
+
+	if _, err := tbl.Resume(bufmgr, []byte{0xFF}); !errors.Is(err, btree.ErrInvalidToken) {
+		t.Errorf("expected ErrInvalidToken, got %v", err)
+	}
+	if leaks := bufmgr.PinLeaks(); len(leaks) != 0 {
+		t.Errorf("pins left after resume: %v", leaks)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	now := time.Unix(1700000000, 0)
+	clock := func() time.Time { return now }
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{Expiry: true, ExpiryColumn: 2, Clock: clock})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	// 1列目: キー、2列目: 値、3列目: 有効期限
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		if i%2 == 0 {
+			err = tbl.InsertWithTTL(bufmgr, Tuple{key, []byte("v")}, time.Duration(i+1)*time.Minute)
+		} else {
+			err = tbl.Insert(bufmgr, Tuple{key, []byte("v")})
+		}
+		if err != nil {
+			t.Fatalf("failed to insert: %v", err)
+		}
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("fixed"), []byte("v"), EncodeExpiry(now.Add(3 * time.Minute))}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	keys := func(opts ScanOptions) []string {
+		t.Helper()
+		iter, err := tbl.ScanWithOptions(bufmgr, opts)
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		defer iter.Close(bufmgr)
+		var keys []string
+		for {
+			row, err := iter.Next(bufmgr)
+			if err != nil {
+				t.Fatalf("failed to get next: %v", err)
+			}
+			if row == nil {
+				return keys
+			}
+			keys = append(keys, string(row[0]))
+		}
+	}
+	if got := keys(ScanOptions{}); len(got) != 11 {
+		t.Errorf("expected 11 rows before expiry, got %v", got)
+	}
+
+	// k0 (1分), k2 (3分), fixed (3分) の期限が切れる
+	now = now.Add(3 * time.Minute)
+	if got := keys(ScanOptions{Columns: []int{0}}); strings.Join(got, ",") != "k1,k3,k4,k5,k6,k7,k8,k9" {
+		t.Errorf("unexpected rows after expiry: %v", got)
+	}
+	if n, err := tbl.Count(bufmgr); err != nil || n != 8 {
+		t.Errorf("expected 8 rows, got %d %v", n, err)
+	}
+	// 期限切れの行と同じキーには挿入できる
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("k0"), []byte("again")}); err != nil {
+		t.Errorf("failed to insert over expired row: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("k1"), []byte("again")}); !errors.Is(err, btree.ErrDuplicateKey) {
+		t.Errorf("expected ErrDuplicateKey, got %v", err)
+	}
+	if err := tbl.InsertBatch(bufmgr, []Tuple{{[]byte("k2"), []byte("again")}, {[]byte("k21"), []byte("new")}}); err != nil {
+		t.Errorf("failed to insert batch over expired row: %v", err)
+	}
+
+	n, err := tbl.PurgeExpired(bufmgr)
+	if err != nil || n != 1 {
+		t.Errorf("expected 1 purged row, got %d %v", n, err)
+	}
+	if stats, _ := btree.Stats(bufmgr, tbl.btree()); stats.Pairs != 11 {
+		t.Errorf("expected 11 pairs after purge, got %d", stats.Pairs)
+	}
+
+	plain, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := plain.InsertWithTTL(bufmgr, Tuple{[]byte("k")}, time.Minute); !errors.Is(err, ErrExpiryDisabled) {
+		t.Errorf("expected ErrExpiryDisabled, got %v", err)
+	}
+	if n, err := plain.PurgeExpired(bufmgr); err != nil || n != 0 {
+		t.Errorf("expected nothing purged, got %d %v", n, err)
+	}
+}
+
+func TestUpsertInsertIgnore(t *testing.T) {
+	bufmgr := buffer.NewBufferPoolManager(disk.NewMemManager(), buffer.NewBufferPool(100))
+	tbl, err := CreateWithOptions(bufmgr, 1, Options{SoftDelete: true})
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := tbl.EnableZoneMap(bufmgr, 1); err != nil {
+		t.Fatalf("failed to enable zone map: %v", err)
+	}
+	value := func(key string) string {
+		t.Helper()
+		iter, err := tbl.ScanFrom(bufmgr, Tuple{[]byte(key)})
+		if err != nil {
+			t.Fatalf("failed to scan: %v", err)
+		}
+		defer iter.Close(bufmgr)
+		row, err := iter.Next(bufmgr)
+		if err != nil {
+			t.Fatalf("failed to get next: %v", err)
+		}
+		if row == nil || string(row[0]) != key {
+			return ""
+		}
+		return string(row[1])
+	}
+
+	for i := 0; i < 2; i++ {
+		// 同じ行を2回書いても1行のまま
+		if err := tbl.Upsert(bufmgr, Tuple{[]byte("a"), []byte("10")}); err != nil {
+			t.Fatalf("failed to upsert: %v", err)
+		}
+	}
+	if err := tbl.Upsert(bufmgr, Tuple{[]byte("a"), []byte("20")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	if got := value("a"); got != "20" {
+		t.Errorf("expected 20, got %q", got)
+	}
+	// 削除済みの行も置き換える
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("b"), []byte("30")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+	if err := tbl.Delete(bufmgr, Tuple{[]byte("b")}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if err := tbl.Upsert(bufmgr, Tuple{[]byte("b"), []byte("40")}); err != nil {
+		t.Fatalf("failed to upsert: %v", err)
+	}
+	if got := value("b"); got != "40" {
+		t.Errorf("expected 40, got %q", got)
+	}
+	// ゾーンマップも書き込んだ値を含む
+	iter, err := tbl.ScanColumnRange(bufmgr, 1, []byte("40"), []byte("40"))
+	if err != nil {
+		t.Fatalf("failed to scan range: %v", err)
+	}
+	if row, _ := iter.Next(bufmgr); row == nil || string(row[0]) != "b" {
+		t.Errorf("expected row b in range scan, got %q", row)
+	}
+	iter.Close(bufmgr)
+
+	inserted, err := tbl.InsertIgnore(bufmgr, Tuple{[]byte("a"), []byte("99")})
+	if err != nil || inserted {
+		t.Errorf("expected existing row to be kept, got %v %v", inserted, err)
+	}
+	inserted, err = tbl.InsertIgnore(bufmgr, Tuple{[]byte("c"), []byte("50")})
+	if err != nil || !inserted {
+		t.Errorf("expected row to be inserted, got %v %v", inserted, err)
+	}
+	if got := value("a"); got != "20" {
+		t.Errorf("expected 20 to be kept, got %q", got)
+	}
+
+	batch := NewWriteBatch()
+	batch.InsertIgnore(tbl, Tuple{[]byte("c"), []byte("99")})
+	batch.InsertIgnore(tbl, Tuple{[]byte("d"), []byte("60")})
+	batch.InsertIgnore(tbl, Tuple{[]byte("d"), []byte("99")})
+	if err := batch.Apply(bufmgr); err != nil {
+		t.Fatalf("failed to apply batch: %v", err)
+	}
+	if got := value("c") + "," + value("d"); got != "50,60" {
+		t.Errorf("expected 50,60, got %s", got)
+	}
+	if n, err := tbl.Count(bufmgr); err != nil || n != 4 {
+		t.Errorf("expected 4 rows, got %d %v", n, err)
+	}
+}
+
+func TestSimpleTableRootCache(t *testing.T) {
+	bufmgr, cleanup := setupTestEnv(t)
+	defer cleanup()
+
+	tbl, err := Create(bufmgr, 1)
+	if err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+	if err := tbl.Insert(bufmgr, Tuple{[]byte("a"), []byte("1")}); err != nil {
+		t.Fatalf("failed to insert: %v", err)
+	}
+
+	// 操作をまたいでルートのキャッシュが効くので、メタページは読まない（ルートのリーフだけ）
+	before := bufmgr.Stats()
+	iter, err := tbl.ScanWithOptions(bufmgr, ScanOptions{})
+	if err != nil {
+		t.Fatalf("failed to scan: %v", err)
+	}
+	iter.Close(bufmgr)
+	if fetches := bufmgr.Stats().Sub(before).Hits; fetches != 1 {
+		t.Errorf("expected 1 fetch with cached root, got %d", fetches)
+	}
+}
@@ -53,6 +53,23 @@ func DecodeTuple(data []byte) Tuple {
 	return tuple
 }
 
+// elements はエンコード済みのTupleの各要素を、コピーせずに data の一部として返す
+// 一部の列しか使わない場合に、DecodeTuple で全ての要素をコピーするのを避けられる
+func elements(data []byte) [][]byte {
+	numElems := int(binary.LittleEndian.Uint16(data[0:2]))
+	offset := 2
+
+	elems := make([][]byte, numElems)
+	for i := 0; i < numElems; i++ {
+		elemLen := int(binary.LittleEndian.Uint16(data[offset:]))
+		offset += 2
+		elems[i] = data[offset : offset+elemLen]
+		offset += elemLen
+	}
+
+	return elems
+}
+
 // SplitTuple はTupleをキー部分と値部分に分割する
 func SplitTuple(tuple Tuple, numKeyElems int) (key Tuple, value Tuple) {
 	if numKeyElems > len(tuple) {
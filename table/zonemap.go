@@ -0,0 +1,336 @@
+package table
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+)
+
+// エラー定義
+var (
+	ErrInvalidZoneMap     = errors.New("invalid zone map")
+	ErrColumnNotProjected = errors.New("range column is not in Columns")
+)
+
+// zone は1つのリーフに含まれる列の値の範囲
+type zone struct {
+	min []byte
+	max []byte
+}
+
+// ZoneMap はリーフごとに、指定した列の最小値・最大値を記録する
+// 範囲条件でスキャンする際に、条件に合う行を含み得ないリーフを丸ごと読み飛ばせる
+//
+// ゾーンマップはメモリ上で更新する。SaveZoneMap で別のB-treeに書き出し、LoadZoneMap で読み戻せる。
+// 挿入時には範囲を広げて追従するが、
+// 削除で範囲を狭めることはしないため、記録される範囲は常に実際の値を包含する。
+// 分割で新しくできたリーフは範囲が未記録となり、読み飛ばしの対象にならない。
+// 削除ではリーフの併合・再分配で行が隣に移り得るので、削除したリーフと両隣も未記録に戻す。
+// Rebuild で木を作り直したときは全件スキャンで作り直す。
+type ZoneMap struct {
+	Columns []int                  // 範囲を記録する列の番号
+	zones   map[disk.PageID][]zone // リーフページIDごとの各列の範囲
+}
+
+// newZoneMap は空のZoneMapを作成する
+func newZoneMap(columns []int) *ZoneMap {
+	return &ZoneMap{
+		Columns: columns,
+		zones:   make(map[disk.PageID][]zone),
+	}
+}
+
+// columnIndex は列番号に対応する Columns 内の位置を返す
+func (z *ZoneMap) columnIndex(col int) (int, bool) {
+	for i, c := range z.Columns {
+		if c == col {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// add はリーフに行が追加されたことを記録し、各列の範囲を広げる
+func (z *ZoneMap) add(pageID disk.PageID, tuple Tuple) {
+	zones, ok := z.zones[pageID]
+	if !ok {
+		zones = make([]zone, len(z.Columns))
+		z.zones[pageID] = zones
+	}
+	for i, col := range z.Columns {
+		if col >= len(tuple) {
+			continue
+		}
+		v := tuple[col]
+		if zones[i].min == nil || bytes.Compare(v, zones[i].min) < 0 {
+			zones[i].min = append([]byte{}, v...)
+		}
+		if zones[i].max == nil || bytes.Compare(v, zones[i].max) > 0 {
+			zones[i].max = append([]byte{}, v...)
+		}
+	}
+}
+
+// mayContain はリーフに列の値が [lo, hi] に入る行が含まれ得るかを返す
+// 範囲が記録されていないリーフや列については常に true を返す
+func (z *ZoneMap) mayContain(pageID disk.PageID, col int, lo, hi []byte) bool {
+	idx, ok := z.columnIndex(col)
+	if !ok {
+		return true
+	}
+	zones, ok := z.zones[pageID]
+	if !ok {
+		return true
+	}
+	r := zones[idx]
+	if r.min == nil {
+		// この列の値を持つ行がまだない
+		return false
+	}
+	if lo != nil && bytes.Compare(r.max, lo) < 0 {
+		return false
+	}
+	if hi != nil && bytes.Compare(r.min, hi) > 0 {
+		return false
+	}
+	return true
+}
+
+// EnableZoneMap は指定した列のゾーンマップを全件スキャンで作成し、テーブルに設定する
+// 以降の Insert ではゾーンマップも更新される。既に設定済みの場合は作り直す
+func (t *SimpleTable) EnableZoneMap(bufmgr *buffer.BufferPoolManager, columns ...int) error {
+	zoneMap := newZoneMap(columns)
+
+	iter, err := t.btree().Search(bufmgr, btree.NewSearchStart())
+	if err != nil {
+		return err
+	}
+	defer iter.Close(bufmgr)
+
+	for {
+		// Next で返るペアは、呼び出し前にイテレータが指しているリーフにある
+		pageID := iter.PageID()
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			return err
+		}
+		if pair == nil {
+			break
+		}
+		value, _ := decodeValue(t.codec(), pair.Value, t.SoftDelete)
+		zoneMap.add(pageID, MergeTuple(t.decodeKey(pair.Key), value))
+	}
+
+	t.zoneMap = zoneMap
+	return nil
+}
+
+// SaveZoneMap はゾーンマップの各リーフの範囲を新しいB-treeに書き出し、そのメタページIDを返す
+// キーはリーフのページID、値は列ごとの範囲。ゾーンマップが設定されていなければ ErrInvalidZoneMap を返す
+// 書き出した後の挿入や削除は反映されないので、呼び出し側で書き込みの前に書き出したものを無効にしておくこと
+func (t *SimpleTable) SaveZoneMap(bufmgr *buffer.BufferPoolManager) (disk.PageID, error) {
+	if t.zoneMap == nil {
+		return btree.InvalidPageID, ErrInvalidZoneMap
+	}
+	pairs := make([]btree.Pair, 0, len(t.zoneMap.zones))
+	for pageID, zones := range t.zoneMap.zones {
+		pairs = append(pairs, btree.Pair{
+			Key:   binary.BigEndian.AppendUint64(nil, uint64(pageID)),
+			Value: encodeZones(zones),
+		})
+	}
+	tree, err := btree.BulkLoad(bufmgr, pairs)
+	if err != nil {
+		return btree.InvalidPageID, err
+	}
+	return tree.MetaPageID, nil
+}
+
+// LoadZoneMap は SaveZoneMap で書き出したB-treeから columns のゾーンマップを読み込み、テーブルに設定する
+// columns は書き出したときと同じ列を同じ順に指定すること
+func (t *SimpleTable) LoadZoneMap(bufmgr *buffer.BufferPoolManager, metaPageID disk.PageID, columns ...int) error {
+	zoneMap := newZoneMap(columns)
+	iter, err := btree.NewBTree(metaPageID).Search(bufmgr, btree.NewSearchStart())
+	if err != nil {
+		return err
+	}
+	defer iter.Close(bufmgr)
+	for {
+		pair, err := iter.Next(bufmgr)
+		if err != nil {
+			return err
+		}
+		if pair == nil {
+			break
+		}
+		if len(pair.Key) != 8 {
+			return fmt.Errorf("%w: key of %d bytes", ErrInvalidZoneMap, len(pair.Key))
+		}
+		zones, err := decodeZones(pair.Value, len(columns))
+		if err != nil {
+			return err
+		}
+		zoneMap.zones[disk.PageID(binary.BigEndian.Uint64(pair.Key))] = zones
+	}
+	t.zoneMap = zoneMap
+	return nil
+}
+
+// encodeZones は1つのリーフの列ごとの範囲をバイト列にする
+// フォーマット: 列ごとに uvarint で [len(min)+1] [min] [len(max)] [max]。値のない列は [0] だけ
+func encodeZones(zones []zone) []byte {
+	var b []byte
+	for _, z := range zones {
+		if z.min == nil {
+			b = binary.AppendUvarint(b, 0)
+			continue
+		}
+		b = binary.AppendUvarint(b, uint64(len(z.min))+1)
+		b = append(b, z.min...)
+		b = binary.AppendUvarint(b, uint64(len(z.max)))
+		b = append(b, z.max...)
+	}
+	return b
+}
+
+// decodeZones は encodeZones したバイト列から n 列分の範囲を読み出す
+func decodeZones(b []byte, n int) ([]zone, error) {
+	// next は長さと、その長さのバイト列を読む
+	next := func(offset uint64) ([]byte, bool) {
+		v, size := binary.Uvarint(b)
+		if size <= 0 || v < offset || v-offset > uint64(len(b)-size) {
+			return nil, false
+		}
+		value := b[size : size+int(v-offset)]
+		b = b[size+int(v-offset):]
+		return append([]byte{}, value...), true
+	}
+	zones := make([]zone, n)
+	for i := range zones {
+		if len(b) > 0 && b[0] == 0 {
+			b = b[1:]
+			continue
+		}
+		min, ok := next(1)
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated range", ErrInvalidZoneMap)
+		}
+		max, ok := next(0)
+		if !ok {
+			return nil, fmt.Errorf("%w: truncated range", ErrInvalidZoneMap)
+		}
+		zones[i] = zone{min: min, max: max}
+	}
+	if len(b) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrInvalidZoneMap, len(b))
+	}
+	return zones, nil
+}
+
+// DisableZoneMap はテーブルのゾーンマップを破棄する
+func (t *SimpleTable) DisableZoneMap() {
+	t.zoneMap = nil
+}
+
+// updateZoneMap は挿入されたキーの行が置かれたリーフについてゾーンマップを更新する
+func (t *SimpleTable) updateZoneMap(ctx context.Context, bufmgr *buffer.BufferPoolManager, key, value []byte) error {
+	if t.zoneMap == nil {
+		return nil
+	}
+	iter, err := t.btree().SearchContext(ctx, bufmgr, btree.NewSearchKey(key))
+	if err != nil {
+		return err
+	}
+	decoded, _ := decodeValue(t.codec(), value, t.SoftDelete)
+	t.zoneMap.add(iter.PageID(), MergeTuple(t.decodeKey(key), decoded))
+	iter.Close(bufmgr)
+	return nil
+}
+
+// forgetZones は削除するキーの行があるリーフと、その両隣のリーフの範囲を忘れる
+// 削除で小さくなったリーフは隣のリーフと併合・再分配されるので行が隣に移り、
+// 木から外れたページは後で別のリーフに再利用される。どちらも記録した範囲が
+// 実際の値を包含しなくなるので、範囲が未記録（読み飛ばさない）の扱いに戻す
+func (t *SimpleTable) forgetZones(ctx context.Context, bufmgr *buffer.BufferPoolManager, key []byte) error {
+	if t.zoneMap == nil {
+		return nil
+	}
+	iter, err := t.btree().SearchContext(ctx, bufmgr, btree.NewSearchKey(key))
+	if err != nil {
+		return err
+	}
+	pageID := iter.PageID()
+	iter.Close(bufmgr)
+	if pageID == btree.InvalidPageID {
+		return nil
+	}
+	leafBuffer, err := bufmgr.FetchPageContext(ctx, pageID)
+	if err != nil {
+		return err
+	}
+	defer bufmgr.UnpinPage(leafBuffer)
+	leaf := btree.NewLeaf(leafBuffer.Page[btree.NodeHeaderSize:])
+	delete(t.zoneMap.zones, pageID)
+	for _, sibling := range []*disk.PageID{leaf.PrevPageID(), leaf.NextPageID()} {
+		if sibling != nil {
+			delete(t.zoneMap.zones, *sibling)
+		}
+	}
+	return nil
+}
+
+// ScanColumnRange は col 番目の列の値が [lo, hi] に入る行だけを返すイテレータを返す
+// lo, hi に nil を渡すとその側は無制限になる
+// ゾーンマップに col が含まれていれば、条件に合う行を含まないリーフは読み飛ばされる
+func (t *SimpleTable) ScanColumnRange(bufmgr *buffer.BufferPoolManager, col int, lo, hi []byte) (*TableIter, error) {
+	return t.ScanColumnRangeWithOptions(bufmgr, col, lo, hi, ScanOptions{})
+}
+
+// ScanColumnRangeWithOptions は ScanColumnRange と同じだが、opts で絞り込み・射影する
+// Columns を指定する場合は col も含めること。含めなければ ErrColumnNotProjected を返す
+func (t *SimpleTable) ScanColumnRangeWithOptions(bufmgr *buffer.BufferPoolManager, col int, lo, hi []byte, opts ScanOptions) (*TableIter, error) {
+	pos := col
+	if opts.Columns != nil {
+		pos = slices.Index(opts.Columns, col)
+		if pos < 0 {
+			return nil, fmt.Errorf("%w: %d", ErrColumnNotProjected, col)
+		}
+	}
+	iter, err := t.ScanWithOptions(bufmgr, opts)
+	if err != nil {
+		return nil, err
+	}
+	iter.filter = &columnRange{col: col, pos: pos, lo: lo, hi: hi}
+	iter.zoneMap = t.zoneMap
+	return iter, nil
+}
+
+// columnRange は列の値に対する範囲条件
+type columnRange struct {
+	col int // テーブルの列の番号（ゾーンマップを引く）
+	pos int // 返す行での列の位置（射影しなければ col と同じ）
+	lo  []byte
+	hi  []byte
+}
+
+// match はTupleが範囲条件を満たすかを返す
+func (r *columnRange) match(tuple Tuple) bool {
+	if r.pos >= len(tuple) {
+		return false
+	}
+	v := tuple[r.pos]
+	if r.lo != nil && bytes.Compare(v, r.lo) < 0 {
+		return false
+	}
+	if r.hi != nil && bytes.Compare(v, r.hi) > 0 {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,151 @@
+package minidb
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+	"github.com/kkumaki12/minidb/table"
+)
+
+// Vacuum は削除で空いた領域を回収し、ヒープファイルを縮める
+//
+//  1. カタログと全てのテーブルのB-treeを詰め直す（table.SimpleTable.Rebuild）
+//     リーフのページIDが変わるので、ゾーンマップを設定したテーブルは範囲を作り直して書き出す
+//  2. どの木からも参照されないページを空きページに戻す。作り直しで残した古いルートや、
+//     以前に開いていたときに解放したページ、参照されなくなったオーバーフローページもここで回収する
+//     （DB は btree.BTree の値を操作の間で持ち越さないので、古いルートを回収してよい）
+//  3. ファイルの末尾に並んだ空きページを切り詰め、全てのページを書き戻す
+//
+// 詰め直したページは空きページのうちIDの小さいものから使うので、使うページは
+// ファイルの先頭に寄る。メタページは動かさないので、開いている Table はそのまま使える。
+// 実行中は他の操作を待たせる
+func (db *DB) Vacuum() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	tables, err := db.catalogTables()
+	if err != nil {
+		return err
+	}
+	tables = append(tables, db.catalog)
+	for _, tbl := range tables {
+		if err := tbl.Rebuild(db.bufmgr); err != nil {
+			return err
+		}
+	}
+	// 古いゾーンマップは参照されなくなるので、下で空きページに戻る
+	if err := db.rebuildZoneMaps(); err != nil {
+		return err
+	}
+	live := map[disk.PageID]bool{disk.HeaderPageID: true}
+	for _, tbl := range tables {
+		pageIDs, err := tbl.Pages(db.bufmgr)
+		if err != nil {
+			return err
+		}
+		for _, pageID := range pageIDs {
+			live[pageID] = true
+		}
+	}
+	for _, t := range db.tables {
+		if t.zones == nil {
+			continue
+		}
+		pageIDs, err := db.treePages(t.zones.treeID)
+		if err != nil {
+			return err
+		}
+		for _, pageID := range pageIDs {
+			live[pageID] = true
+		}
+	}
+
+	// 既に空きページの一覧にあるページを戻しても、一覧に重複はできない
+	// スキャン中の Rows がピンしているページは、次の Vacuum まで残す
+	for pageID := disk.PageID(0); pageID < db.disk.NumPages(); pageID++ {
+		if live[pageID] {
+			continue
+		}
+		if err := db.bufmgr.FreePage(pageID); err != nil && !errors.Is(err, buffer.ErrPagePinned) {
+			return err
+		}
+	}
+	if _, err := db.bufmgr.TruncateFreePages(); err != nil {
+		return err
+	}
+	return db.flush()
+}
+
+// rebuildZoneMaps はゾーンマップを設定した全てのテーブルを開き、範囲を作り直して書き出す
+// 呼び出し時は db.mu を保持していること
+func (db *DB) rebuildZoneMaps() error {
+	iter, err := db.catalog.Scan(db.bufmgr)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for {
+		row, err := iter.Next(db.bufmgr)
+		if err != nil {
+			iter.Close(db.bufmgr)
+			return err
+		}
+		if row == nil {
+			break
+		}
+		if len(row) > catalogZoneMapColumn && len(row[catalogZoneMapColumn]) > 0 {
+			names = append(names, string(row[0]))
+		}
+	}
+	iter.Close(db.bufmgr)
+
+	for _, name := range names {
+		t, err := db.openTable(name)
+		if err != nil {
+			return err
+		}
+		// 書き出すまでに異常終了したら、開いたときに作り直す
+		if err := t.markStale(); err != nil {
+			return err
+		}
+		if err := t.tbl.EnableZoneMap(db.bufmgr, t.zones.columns...); err != nil {
+			return err
+		}
+		t.zones.dirty = true
+	}
+	_, err = db.saveZoneMaps()
+	return err
+}
+
+// catalogTables はカタログに記録された全てのテーブルを開く
+// 呼び出し時は db.mu を保持していること
+func (db *DB) catalogTables() ([]*table.SimpleTable, error) {
+	iter, err := db.catalog.Scan(db.bufmgr)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close(db.bufmgr)
+	var tables []*table.SimpleTable
+	for {
+		row, err := iter.Next(db.bufmgr)
+		if err != nil {
+			return nil, err
+		}
+		if row == nil {
+			return tables, nil
+		}
+		if len(row) < 2 {
+			return nil, fmt.Errorf("catalog row has %d columns", len(row))
+		}
+		entry, err := decodeCatalogEntry(row[1])
+		if err != nil {
+			return nil, err
+		}
+		tables = append(tables, entry.open())
+	}
+}
@@ -0,0 +1,304 @@
+package minidb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/kkumaki12/minidb/btree"
+	"github.com/kkumaki12/minidb/buffer"
+	"github.com/kkumaki12/minidb/disk"
+	"github.com/kkumaki12/minidb/table"
+)
+
+// catalogZoneMapColumn はカタログの行で、ゾーンマップの列と書き出した先を置く列
+// ゾーンマップを設定していないテーブルの行にはないか、空になる
+const catalogZoneMapColumn = 5
+
+// tableZoneMap はテーブルに設定したゾーンマップ
+// リーフごとの範囲は table.SimpleTable が持ち、Flush と Close で別のB-tree（table.SimpleTable.SaveZoneMap）に書き出す
+type tableZoneMap struct {
+	columns []int       // 範囲を記録する列（格納した行での位置）
+	treeID  disk.PageID // 書き出したB-treeのメタページ。まだ書き出していなければ btree.InvalidPageID
+	dirty   bool        // 書き出した後に変わったかもしれない
+	stale   bool        // 書き出した後に書き込みを始めた印があった（開いたときに作り直す）
+}
+
+// encode はカタログの列に置くバイト列にする
+// フォーマット: 全て uvarint で [tree_meta_page_id] [stale] [num_columns] [column]...
+func (z *tableZoneMap) encode(stale bool) []byte {
+	var b []byte
+	b = binary.AppendUvarint(b, uint64(z.treeID))
+	if stale {
+		b = binary.AppendUvarint(b, 1)
+	} else {
+		b = binary.AppendUvarint(b, 0)
+	}
+	b = binary.AppendUvarint(b, uint64(len(z.columns)))
+	for _, col := range z.columns {
+		b = binary.AppendUvarint(b, uint64(col))
+	}
+	return b
+}
+
+// decodeZoneMap は encode したバイト列からゾーンマップの設定を読み出す
+func decodeZoneMap(b []byte) (*tableZoneMap, error) {
+	var values []uint64
+	for len(b) > 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errors.New("invalid table zone map")
+		}
+		values, b = append(values, v), b[n:]
+	}
+	if len(values) < 3 || values[1] > 1 || uint64(len(values)-3) != values[2] {
+		return nil, errors.New("invalid table zone map")
+	}
+	z := &tableZoneMap{treeID: disk.PageID(values[0]), stale: values[1] == 1}
+	for _, col := range values[3:] {
+		z.columns = append(z.columns, int(col))
+	}
+	return z, nil
+}
+
+// catalogZoneMap はカタログの行からゾーンマップの設定を読み出す。設定していなければ nil を返す
+func catalogZoneMap(row Tuple) (*tableZoneMap, error) {
+	if len(row) <= catalogZoneMapColumn || len(row[catalogZoneMapColumn]) == 0 {
+		return nil, nil
+	}
+	return decodeZoneMap(row[catalogZoneMapColumn])
+}
+
+// EnableZoneMap は columns の列の値の範囲をリーフごとに記録する（table.SimpleTable.EnableZoneMap）
+// ScanColumnRange でその列の範囲を指定すると、条件に合う行を含み得ないリーフを読み飛ばす
+// 設定はカタログに記録し、範囲は Flush と Close で書き出すので、開き直しても全ての行を読まずに使える
+// 既に設定していれば、columns の列で作り直す。列がなければ ErrColumnNotFound を返す
+func (t *Table) EnableZoneMap(columns ...int) error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	stored := make([]int, len(columns))
+	for i, col := range columns {
+		var err error
+		if stored[i], err = t.storedColumn(col); err != nil {
+			return err
+		}
+	}
+	z := &tableZoneMap{columns: stored, treeID: btree.InvalidPageID}
+	if t.zones != nil {
+		// 前に書き出した範囲は、次に書き出したときに空きページに戻す
+		z.treeID = t.zones.treeID
+	}
+	// 作り終える前に異常終了しても、開いたときに作り直すよう印を付けて記録する
+	if err := t.writeZoneMap(z.encode(true)); err != nil {
+		return err
+	}
+	t.zones, z.dirty = z, true
+	if err := t.tbl.EnableZoneMap(t.db.bufmgr, stored...); err != nil {
+		return errors.Join(err, t.disableZoneMap())
+	}
+	return nil
+}
+
+// DisableZoneMap はゾーンマップを破棄し、カタログから消す
+func (t *Table) DisableZoneMap() error {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return err
+	}
+	return t.disableZoneMap()
+}
+
+// disableZoneMap は DisableZoneMap の本体。呼び出し時は db.mu を保持していること
+func (t *Table) disableZoneMap() error {
+	z := t.zones
+	if z == nil {
+		return nil
+	}
+	if err := t.writeZoneMap(nil); err != nil {
+		return err
+	}
+	t.zones = nil
+	t.tbl.DisableZoneMap()
+	return t.db.freeTree(z.treeID)
+}
+
+// writeZoneMap はカタログのゾーンマップの列を value に書き換えて、ディスクに書く
+// 書き出した範囲を空きページに戻す前や、書き込みの前に付けた印が先にディスクに届くようにする
+// 呼び出し時は db.mu を保持していること
+func (t *Table) writeZoneMap(value []byte) error {
+	row, err := t.catalogRow()
+	if err != nil {
+		return err
+	}
+	row = slices.Clone(row)
+	for len(row) <= catalogZoneMapColumn {
+		row = append(row, nil)
+	}
+	row[catalogZoneMapColumn] = value
+	batch := table.NewWriteBatch()
+	batch.Put(t.db.catalog, row)
+	if err := batch.Apply(t.db.bufmgr); err != nil {
+		return err
+	}
+	return t.db.bufmgr.Flush()
+}
+
+// loadZoneMap は開いたテーブルにカタログに記録したゾーンマップを設定する
+// 書き出した後に書き込みを始めた印があれば、書き出した範囲は使わずに全ての行を読んで作り直す
+// 呼び出し時は db.mu を保持していること
+func (t *Table) loadZoneMap(z *tableZoneMap) error {
+	if z.stale || z.treeID == btree.InvalidPageID {
+		if err := t.tbl.EnableZoneMap(t.db.bufmgr, z.columns...); err != nil {
+			return err
+		}
+		z.dirty = true
+	} else if err := t.tbl.LoadZoneMap(t.db.bufmgr, z.treeID, z.columns...); err != nil {
+		return err
+	}
+	t.zones = z
+	return nil
+}
+
+// ScanColumnRange は col 番目の列の値が [lo, hi] に入る行だけを、キーの順に読む Rows を返す
+// lo, hi に nil を渡すとその側は無制限になり、列が NULL の行は返さない
+// EnableZoneMap で col の範囲を記録していれば、条件に合う行を含み得ないリーフを読み飛ばす
+func (t *Table) ScanColumnRange(col int, lo, hi []byte) (*Rows, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+	if err := t.check(); err != nil {
+		return nil, err
+	}
+	stored, err := t.storedColumn(col)
+	if err != nil {
+		return nil, err
+	}
+	if t.schema.columns != nil && t.tbl.Defaults[stored] != nil {
+		// 列を足す前に格納した行はこの列を持たず、読むときに既定値で埋める。ゾーンマップの
+		// 範囲には既定値が入らないので、リーフを読み飛ばさずに埋めた後の値で絞り込む
+		opts, fill := t.scanOptions(ScanOptions{Filter: func(row Tuple) bool {
+			return inRange(row[col], lo, hi)
+		}})
+		iter, err := t.tbl.ScanWithOptions(t.db.bufmgr, opts)
+		if err != nil {
+			return nil, err
+		}
+		return &Rows{db: t.db, table: t, iter: iter, fill: fill}, nil
+	}
+	opts, fill := t.scanOptions(ScanOptions{})
+	iter, err := t.tbl.ScanColumnRangeWithOptions(t.db.bufmgr, stored, lo, hi, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &Rows{db: t.db, table: t, iter: iter, fill: fill}, nil
+}
+
+// inRange は v が [lo, hi] に入るかを返す。v が nil なら false
+func inRange(v, lo, hi []byte) bool {
+	if v == nil {
+		return false
+	}
+	return (lo == nil || bytes.Compare(v, lo) >= 0) && (hi == nil || bytes.Compare(v, hi) <= 0)
+}
+
+// storedColumn は今の列の並びでの位置を、格納した行での位置にする
+// 列がなければ ErrColumnNotFound を返す。呼び出し時は db.mu を保持していること
+func (t *Table) storedColumn(col int) (int, error) {
+	s := &t.schema
+	if col < 0 || (s.numColumns > 0 && col >= s.numColumns) {
+		return 0, fmt.Errorf("%w: %d", ErrColumnNotFound, col)
+	}
+	if s.columns == nil {
+		return col, nil
+	}
+	return s.columns[col], nil
+}
+
+// saveZoneMaps は開いているテーブルのうち、変わったかもしれないゾーンマップを書き出してカタログに記録する
+// 書き出したページをディスクに書いてからカタログを書き換えるので、カタログが指すB-treeは必ず揃っている
+// 前に書き出したB-treeのメタページを返すので、カタログをディスクに書いてから freeTree で空きページに戻す
+// 呼び出し時は db.mu を保持していること
+func (db *DB) saveZoneMaps() ([]disk.PageID, error) {
+	var tables []*Table
+	var treeIDs []disk.PageID
+	// fail は書き出したがカタログに記録していないB-treeを戻す
+	fail := func(err error) ([]disk.PageID, error) {
+		for _, treeID := range treeIDs {
+			err = errors.Join(err, db.freeTree(treeID))
+		}
+		return nil, err
+	}
+	for _, t := range db.tables {
+		if t.zones == nil || !t.zones.dirty {
+			continue
+		}
+		treeID, err := t.tbl.SaveZoneMap(db.bufmgr)
+		if err != nil {
+			return fail(err)
+		}
+		tables = append(tables, t)
+		treeIDs = append(treeIDs, treeID)
+	}
+	if len(tables) == 0 {
+		return nil, nil
+	}
+	if err := db.bufmgr.Flush(); err != nil {
+		return fail(err)
+	}
+
+	batch := table.NewWriteBatch()
+	for i, t := range tables {
+		row, err := t.catalogRow()
+		if err != nil {
+			return fail(err)
+		}
+		row = slices.Clone(row)
+		for len(row) <= catalogZoneMapColumn {
+			row = append(row, nil)
+		}
+		saved := *t.zones
+		saved.treeID = treeIDs[i]
+		row[catalogZoneMapColumn] = saved.encode(false)
+		batch.Put(db.catalog, row)
+	}
+	if err := batch.Apply(db.bufmgr); err != nil {
+		return fail(err)
+	}
+	var old []disk.PageID
+	for i, t := range tables {
+		if t.zones.treeID != btree.InvalidPageID {
+			old = append(old, t.zones.treeID)
+		}
+		t.zones.treeID, t.zones.dirty = treeIDs[i], false
+	}
+	return old, nil
+}
+
+// freeTree はゾーンマップを書き出したB-treeの全てのページを空きページに戻す
+// メタページが btree.InvalidPageID なら何もしない。呼び出し時は db.mu を保持していること
+func (db *DB) freeTree(metaPageID disk.PageID) error {
+	pageIDs, err := db.treePages(metaPageID)
+	if err != nil {
+		return err
+	}
+	for _, pageID := range pageIDs {
+		if err := db.bufmgr.FreePage(pageID); err != nil && !errors.Is(err, buffer.ErrPagePinned) {
+			return err
+		}
+	}
+	return nil
+}
+
+// treePages はゾーンマップを書き出したB-treeの全てのページのIDを返す
+// メタページが btree.InvalidPageID なら nil を返す
+func (db *DB) treePages(metaPageID disk.PageID) ([]disk.PageID, error) {
+	if metaPageID == btree.InvalidPageID {
+		return nil, nil
+	}
+	return btree.Pages(db.bufmgr, btree.NewBTree(metaPageID))
+}